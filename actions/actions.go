@@ -0,0 +1,131 @@
+// Package actions lets embedders and third-party code implement custom
+// rule actions. A rule names its action in a third field
+// ("DOMAIN-SUFFIX,corp.example,mytunnel"); when a query matches it, the
+// engine's action of that name receives the answer instead of the
+// default VPN route injection. Engines get their actions in their
+// options; a Registry can collect them, e.g. from plugins.
+package actions
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VPN is the built-in action: add a host route through the VPN interface.
+// Rules without an action use it.
+const VPN = "VPN"
+
+// Direct is the built-in action that leaves matching answers unrouted.
+// It ends rule evaluation, e.g. "GEOIP,CN,DIRECT" ahead of broader rules.
+const Direct = "DIRECT"
+
+// Proxy is the name Clash and Surge lists give the VPN action
+// ("DOMAIN-SUFFIX,netflix.com,PROXY")
+const Proxy = "PROXY"
+
+// Reject is the built-in action that answers matching domains with
+// 0.0.0.0 and :: or NXDOMAIN, without asking the upstream
+const Reject = "REJECT"
+
+// IsVPN reports whether name selects the built-in VPN route: it's empty,
+// VPN or PROXY
+func IsVPN(name string) bool {
+	return name == "" || strings.EqualFold(name, VPN) || strings.EqualFold(name, Proxy)
+}
+
+// Request describes an answer for a domain matching a rule bound to an action
+type Request struct {
+	// Domain is the queried name
+	Domain string
+	// IP is the resolved address returned to the client
+	IP string
+	// Action is the action name from the rule
+	Action string
+	// VPNIface is the interface the default action would route through
+	VPNIface string
+}
+
+// Action handles answers for matching domains, e.g. sending them to a
+// custom tunnel. Handle runs on the resolver worker after the client has
+// been answered, so it should not block for long.
+type Action interface {
+	Handle(req Request) error
+}
+
+// ActionFunc adapts a function to Action
+type ActionFunc func(req Request) error
+
+// Handle calls f(req)
+func (f ActionFunc) Handle(req Request) error {
+	return f(req)
+}
+
+// ErrDuplicate is returned by Register for a name already in use
+var ErrDuplicate = errors.New("action already registered")
+
+// Registry collects actions by name (case-insensitive), e.g. those of
+// plugins, for an engine's options. The zero value is an empty registry.
+type Registry struct {
+	mu      sync.RWMutex
+	actions map[string]Action
+}
+
+// Register adds a under name
+func (r *Registry) Register(name string, a Action) error {
+	key := strings.ToUpper(name)
+	if key == "" || key == VPN || key == Direct || key == Proxy || key == Reject {
+		return errors.New("reserved action name: " + name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.actions[key]; ok {
+		return ErrDuplicate
+	}
+	if r.actions == nil {
+		r.actions = make(map[string]Action)
+	}
+	r.actions[key] = a
+	return nil
+}
+
+// Unregister removes the action registered under name
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.actions, strings.ToUpper(name))
+}
+
+// Lookup returns the action registered under name
+func (r *Registry) Lookup(name string) (Action, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.actions[strings.ToUpper(name)]
+	return a, ok
+}
+
+// Names returns the registered action names, sorted
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.actions))
+	for name := range r.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Actions returns a copy of the registry keyed by upper-case name, e.g.
+// for engine.Options.Actions
+func (r *Registry) Actions() map[string]Action {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	all := make(map[string]Action, len(r.actions))
+	for name, a := range r.actions {
+		all[name] = a
+	}
+	return all
+}
@@ -0,0 +1,23 @@
+package adminapi
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// web holds the dashboard: a single page polling the API
+//
+//go:embed web
+var web embed.FS
+
+// dashboard serves the dashboard's files
+func dashboard() http.Handler {
+	files, _ := fs.Sub(web, "web")
+	fileServer := http.FileServerFS(files)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 升级后总是取新版本的页面
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
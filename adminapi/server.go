@@ -0,0 +1,404 @@
+// Package adminapi serves a JSON REST API for inspecting and controlling a
+// running daemon from dashboards and scripts: the rules, the cache, test
+// resolutions ("which way would x.example go?"), upstream health and live
+// counters. It covers what the gRPC Control service does for fleets, for
+// tools that only speak HTTP. A web dashboard built on the API is served
+// at the root.
+package adminapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/engine"
+	"openvpnadvanced/querylog"
+	"openvpnadvanced/version"
+)
+
+// Server serves the admin API for an engine
+type Server struct {
+	eng *engine.Engine
+	// token, when set, must be sent as "Authorization: Bearer <token>";
+	// without it only loopback clients are served
+	token string
+	mux   *http.ServeMux
+}
+
+// NewServer returns the admin API for eng
+func NewServer(eng *engine.Engine, token string) *Server {
+	s := &Server{eng: eng, token: token, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /api/status", s.status)
+	s.mux.HandleFunc("GET /api/stats", s.stats)
+	s.mux.HandleFunc("GET /api/rules", s.rules)
+	s.mux.HandleFunc("GET /api/cache", s.cache)
+	s.mux.HandleFunc("DELETE /api/cache", s.flushCache)
+	s.mux.HandleFunc("GET /api/resolve", s.resolve)
+	s.mux.HandleFunc("GET /api/upstreams", s.upstreams)
+	s.mux.HandleFunc("GET /api/queries", s.queries)
+	s.mux.HandleFunc("GET /api/hits", s.hits)
+	s.mux.Handle("GET /", dashboard())
+	return s
+}
+
+// Listen serves the admin API on addr, a host:port. It returns once
+// listening; call Close on the returned server to shut it down.
+func Listen(addr string, eng *engine.Engine, token string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: NewServer(eng, token), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(lis)
+	return srv, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 仪表盘页面本身不含数据，由其发出的 API 请求再做鉴权
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		if s.token != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("a bearer token is required"))
+			return
+		}
+		writeError(w, http.StatusForbidden, errors.New("only local clients are served without admin-token"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) == 1
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && addr.Addr().Unmap().IsLoopback()
+}
+
+type statusResponse struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Running bool   `json:"running"`
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	info := version.Get()
+	writeJSON(w, statusResponse{Version: info.Version, Commit: info.Commit, Running: s.eng.Running()})
+}
+
+type limitStats struct {
+	Name     string `json:"name"`
+	Limit    int    `json:"limit"`
+	InUse    int    `json:"in_use"`
+	Waited   uint64 `json:"waited"`
+	Rejected uint64 `json:"rejected"`
+}
+
+type udpStats struct {
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"`
+	Malformed uint64 `json:"malformed"`
+	Queued    int    `json:"queued"`
+	Queue     int    `json:"queue"`
+	Workers   int    `json:"workers"`
+	// KernelDrops and ReadBuffer are only reported on Linux
+	KernelDrops *uint64 `json:"kernel_drops,omitempty"`
+	ReadBuffer  int     `json:"read_buffer,omitempty"`
+}
+
+type statsResponse struct {
+	Queries          uint64       `json:"queries"`
+	RejectedQueries  uint64       `json:"rejected_queries"`
+	VerifyMismatches uint64       `json:"verify_mismatches"`
+	Rules            int          `json:"rules"`
+	CacheEntries     int          `json:"cache_entries"`
+	CacheHits        uint64       `json:"cache_hits"`
+	CacheMisses      uint64       `json:"cache_misses"`
+	Limits           []limitStats `json:"limits"`
+	UDP              udpStats     `json:"udp"`
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	resp := statsResponse{
+		Queries:          s.eng.Queries(),
+		RejectedQueries:  s.eng.Rejected(),
+		VerifyMismatches: s.eng.VerifyMismatches(),
+		Rules:            s.eng.RuleCount(),
+		CacheEntries:     len(s.eng.Cache().Raw()),
+		Limits:           []limitStats{},
+	}
+	resp.CacheHits, resp.CacheMisses = s.eng.CacheHits()
+	udp := s.eng.UDPStats()
+	resp.UDP = udpStats{
+		Received: udp.Received, Dropped: udp.Dropped, Malformed: udp.Malformed,
+		Queued: udp.Queued, Queue: udp.Queue, Workers: udp.Workers, ReadBuffer: udp.ReadBuffer,
+	}
+	if udp.KernelKnown {
+		resp.UDP.KernelDrops = &udp.KernelDrops
+	}
+	for _, l := range s.eng.Limits() {
+		resp.Limits = append(resp.Limits, limitStats{
+			Name: l.Name, Limit: l.Limit, InUse: l.InUse, Waited: l.Waited, Rejected: l.Rejected,
+		})
+	}
+	writeJSON(w, resp)
+}
+
+type rule struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Policy string `json:"policy"`
+	Action string `json:"action,omitempty"`
+}
+
+type ruleGroup struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Rules   int    `json:"rules"`
+}
+
+type rulesResponse struct {
+	Count int `json:"count"`
+	// Rules is empty with compile-rules, which keeps no list
+	Rules  []rule      `json:"rules"`
+	Groups []ruleGroup `json:"groups"`
+}
+
+// rules lists the loaded rules; ?q= keeps those whose value contains it
+func (s *Server) rules(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	resp := rulesResponse{Count: s.eng.RuleCount(), Rules: []rule{}, Groups: []ruleGroup{}}
+	for _, ru := range s.eng.Rules() {
+		if q != "" && !strings.Contains(strings.ToLower(ru.Suffix), q) {
+			continue
+		}
+		resp.Rules = append(resp.Rules, rule{
+			Type: ru.Type.String(), Value: ru.Suffix, Policy: ru.Policy().String(), Action: ru.Action,
+		})
+	}
+	for _, g := range s.eng.RuleGroups() {
+		resp.Groups = append(resp.Groups, ruleGroup{Name: g.Name, Enabled: g.Enabled, Rules: g.Rules})
+	}
+	writeJSON(w, resp)
+}
+
+type cacheEntry struct {
+	Domain string    `json:"domain"`
+	Value  string    `json:"value"`
+	Stored time.Time `json:"stored"`
+	TTL    float64   `json:"ttl_seconds,omitempty"`
+}
+
+// cache lists the cached answers by domain; ?q= keeps the domains
+// containing it
+func (s *Server) cache(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	entries := []cacheEntry{}
+	for domain, record := range s.eng.Cache().Raw() {
+		if q != "" && !strings.Contains(strings.ToLower(domain), q) {
+			continue
+		}
+		entries = append(entries, cacheEntry{
+			Domain: domain, Value: record.IP, Stored: record.Timestamp, TTL: record.TTL.Seconds(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Domain < entries[j].Domain })
+	writeJSON(w, entries)
+}
+
+type flushResponse struct {
+	Entries int      `json:"entries"`
+	IPs     []string `json:"ips"`
+}
+
+// flushCache drops the cached answers matching ?pattern= (all when
+// empty) and withdraws their routes
+func (s *Server) flushCache(w http.ResponseWriter, r *http.Request) {
+	n, ips, err := s.eng.FlushCache(r.URL.Query().Get("pattern"))
+	switch {
+	case err != nil && n == 0:
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ips == nil {
+		ips = []string{}
+	}
+	writeJSON(w, flushResponse{Entries: n, IPs: ips})
+}
+
+type resolveResponse struct {
+	Domain  string   `json:"domain"`
+	Answers []string `json:"answers"`
+	CNAMEs  []string `json:"cnames,omitempty"`
+	// Rule is the value of the matched rule; empty when none did
+	Rule     string  `json:"rule,omitempty"`
+	RuleType string  `json:"rule_type,omitempty"`
+	Policy   string  `json:"policy"`
+	Action   string  `json:"action,omitempty"`
+	Route    bool    `json:"route"`
+	Source   string  `json:"source"`
+	Upstream string  `json:"upstream,omitempty"`
+	Latency  float64 `json:"latency_ms"`
+}
+
+// resolve resolves ?domain= the way queries are and reports the way its
+// answer goes
+func (s *Server) resolve(w http.ResponseWriter, r *http.Request) {
+	domain := strings.TrimSuffix(strings.TrimSpace(r.URL.Query().Get("domain")), ".")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errors.New("domain is required"))
+		return
+	}
+	d, err := s.eng.Decide(domain)
+	if err != nil {
+		writeError(w, resolveStatus(err), err)
+		return
+	}
+	resp := resolveResponse{
+		Domain: domain, Answers: d.IPs(), CNAMEs: d.CNAMEs,
+		Policy: d.Policy.String(), Action: d.Action, Route: d.Routes(),
+		Source: d.Source.String(), Upstream: d.Upstream,
+		Latency: float64(d.Latency.Microseconds()) / 1000,
+	}
+	if d.Matched {
+		resp.Rule, resp.RuleType = d.Rule.Suffix, d.Rule.Type.String()
+	}
+	writeJSON(w, resp)
+}
+
+// resolveStatus maps resolver errors onto HTTP statuses
+func resolveStatus(err error) int {
+	switch {
+	case errors.Is(err, dnsmasq.ErrNXDomain), errors.Is(err, dnsmasq.ErrNoAnswer):
+		return http.StatusNotFound
+	case errors.Is(err, dnsmasq.ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, dnsmasq.ErrCircularCNAME):
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+type poolMember struct {
+	Name     string  `json:"name"`
+	Healthy  bool    `json:"healthy"`
+	RTT      float64 `json:"rtt_ms"`
+	Queries  uint64  `json:"queries"`
+	Failures uint64  `json:"failures"`
+	Err      string  `json:"error,omitempty"`
+}
+
+type endpoint struct {
+	Host     string `json:"host"`
+	Addr     string `json:"addr"`
+	Healthy  bool   `json:"healthy"`
+	Failures int    `json:"failures"`
+	Err      string `json:"error,omitempty"`
+}
+
+type upstreamsResponse struct {
+	// Pool is empty unless the upstream is a pool of several
+	Pool      []poolMember `json:"pool"`
+	Endpoints []endpoint   `json:"endpoints"`
+}
+
+func (s *Server) upstreams(w http.ResponseWriter, r *http.Request) {
+	resp := upstreamsResponse{Pool: []poolMember{}, Endpoints: []endpoint{}}
+	for _, m := range s.eng.Upstreams() {
+		resp.Pool = append(resp.Pool, poolMember{
+			Name: m.Name, Healthy: m.Healthy, RTT: float64(m.RTT.Microseconds()) / 1000,
+			Queries: m.Queries, Failures: m.Failures, Err: m.Err,
+		})
+	}
+	for _, e := range s.eng.UpstreamEndpoints() {
+		resp.Endpoints = append(resp.Endpoints, endpoint{
+			Host: e.Host, Addr: e.Addr.String(), Healthy: e.Healthy, Failures: e.Failures, Err: e.Err,
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// queries lists the latest resolutions from the query log, newest first;
+// ?since= (RFC 3339) keeps the newer ones, ?domain= and ?client= filter
+// and ?limit= caps them
+func (s *Server) queries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := querylog.Filter{Domain: q.Get("domain"), Client: q.Get("client")}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since: %v", err))
+			return
+		}
+		f.Since = since
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit: want a positive number, got %q", v))
+			return
+		}
+		f.Limit = n
+	}
+	entries, err := s.eng.QueryLog(f)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if entries == nil {
+		entries = []querylog.Entry{}
+	}
+	writeJSON(w, entries)
+}
+
+type ruleHits struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// hits lists how many resolutions each rule matched, the most matched
+// first
+func (s *Server) hits(w http.ResponseWriter, r *http.Request) {
+	resp := []ruleHits{}
+	for suffix, n := range s.eng.State().Hits() {
+		resp = append(resp, ruleHits{Rule: suffix, Hits: n})
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Hits != resp[j].Hits {
+			return resp[i].Hits > resp[j].Hits
+		}
+		return resp[i].Rule < resp[j].Rule
+	})
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,111 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/engine"
+)
+
+func newServer(t *testing.T, token string) *Server {
+	t.Helper()
+	eng, err := engine.New(engine.Options{
+		Rules:  []dnsmasq.Rule{{Suffix: "example.com"}},
+		Logger: dnsmasq.DiscardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(eng, token)
+}
+
+func serve(s *Server, method, path, remote, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = remote
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuth(t *testing.T) {
+	const (
+		loopback  = "127.0.0.1:5000"
+		loopback6 = "[::1]:5000"
+		remote    = "192.0.2.7:5000"
+	)
+	tests := []struct {
+		name          string
+		token         string
+		remote        string
+		authorization string
+		want          int
+	}{
+		{"loopback without token", "", loopback, "", http.StatusOK},
+		{"IPv6 loopback without token", "", loopback6, "", http.StatusOK},
+		{"remote without token", "", remote, "", http.StatusForbidden},
+		{"remote with token", "s3cret", remote, "Bearer s3cret", http.StatusOK},
+		{"wrong token", "s3cret", remote, "Bearer nope", http.StatusUnauthorized},
+		{"not a bearer token", "s3cret", remote, "Basic s3cret", http.StatusUnauthorized},
+		{"loopback missing token", "s3cret", loopback, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := serve(newServer(t, tt.token), "GET", "/api/status", tt.remote, tt.authorization)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: WWW-Authenticate = %q, want Bearer", tt.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	w := serve(newServer(t, ""), "GET", "/api/status", "127.0.0.1:5000", "")
+	var resp statusResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version == "" || resp.Running {
+		t.Errorf("status = %+v, want a version and a stopped engine", resp)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	// 页面不需鉴权，由其发出的 API 请求再鉴权
+	s := newServer(t, "s3cret")
+	tests := []struct {
+		path        string
+		contentType string
+	}{
+		{"/", "text/html"},
+		{"/app.js", "javascript"},
+		{"/style.css", "text/css"},
+	}
+	for _, tt := range tests {
+		w := serve(s, "GET", tt.path, "192.0.2.7:5000", "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d, want 200", tt.path, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, tt.contentType) {
+			t.Errorf("GET %s: Content-Type = %q, want %s", tt.path, ct, tt.contentType)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+			t.Errorf("GET %s: Cache-Control = %q, want no-cache", tt.path, cc)
+		}
+	}
+
+	if w := serve(s, "GET", "/missing.js", "192.0.2.7:5000", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /missing.js: got %d, want 404", w.Code)
+	}
+	if w := serve(s, "POST", "/", "192.0.2.7:5000", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /: got %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,206 @@
+// Dashboard for the admin API. Everything shown comes from /api/*; the
+// admin token, when one is needed, is kept in localStorage.
+"use strict";
+
+const streamSize = 200;
+let token = localStorage.getItem("adminToken") || "";
+let since = "";
+let seen = new Set();
+let timers = [];
+
+class Unauthorized extends Error {
+  constructor(message, status) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(path, opts = {}) {
+  const headers = {};
+  if (token) headers.Authorization = "Bearer " + token;
+  const resp = await fetch(path, { ...opts, headers });
+  if (resp.status === 401 || resp.status === 403) {
+    throw new Unauthorized((await resp.json()).error, resp.status);
+  }
+  const body = await resp.json();
+  if (!resp.ok) {
+    const err = new Error(body.error || resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  return body;
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (className) e.className = className;
+  return e;
+}
+
+// way describes where a resolution's traffic goes, in plain words
+function way(policy, route, err) {
+  if (err) return ["Failed", "block"];
+  if (policy === "REJECT") return ["Blocked", "block"];
+  if (route) return ["Through VPN", "vpn"];
+  return ["Direct", "direct"];
+}
+
+function setStatus(text, cls) {
+  const s = document.getElementById("status");
+  s.textContent = text;
+  s.className = "badge " + (cls || "");
+}
+
+function showLogin(message) {
+  timers.forEach(clearInterval);
+  timers = [];
+  document.getElementById("main").hidden = true;
+  document.getElementById("login").hidden = false;
+  document.getElementById("login-error").textContent = message || "";
+  setStatus("signed out");
+}
+
+// guard runs fn, sending the user to the login form when the token is
+// missing or wrong
+function guard(fn) {
+  return async () => {
+    try {
+      await fn();
+    } catch (e) {
+      if (e instanceof Unauthorized) {
+        // 403: no admin-token is set and this isn't the gateway itself
+        showLogin(token || e.status === 403 ? e.message : "");
+      } else {
+        console.error(e);
+      }
+    }
+  };
+}
+
+async function refreshStatus() {
+  const st = await api("/api/status");
+  setStatus(st.running ? "running · " + st.version : "stopped", st.running ? "ok" : "down");
+}
+
+async function refreshStats() {
+  const st = await api("/api/stats");
+  document.getElementById("queries").textContent = st.queries.toLocaleString();
+  document.getElementById("rules").textContent = st.rules.toLocaleString();
+  document.getElementById("refused").textContent = (st.rejected_queries + st.udp.dropped).toLocaleString();
+  const total = st.cache_hits + st.cache_misses;
+  document.getElementById("hit-rate").textContent = total ? Math.round((100 * st.cache_hits) / total) + "%" : "–";
+  document.getElementById("hit-detail").textContent =
+    st.cache_hits.toLocaleString() + " from cache, " + st.cache_misses.toLocaleString() + " asked upstream";
+}
+
+async function refreshStream() {
+  let entries;
+  try {
+    entries = await api("/api/queries?limit=" + streamSize + (since ? "&since=" + encodeURIComponent(since) : ""));
+  } catch (e) {
+    if (e.status === 409) {
+      document.getElementById("queries-off").hidden = false;
+      return;
+    }
+    throw e;
+  }
+  document.getElementById("queries-off").hidden = true;
+  const tbody = document.querySelector("#stream tbody");
+  const initial = tbody.rows.length === 0;
+  // entries come newest first; insert oldest first so the newest ends on top
+  for (const q of entries.reverse()) {
+    const key = q.time + " " + q.client + " " + q.domain + " " + q.qtype;
+    if (seen.has(key)) continue;
+    seen.add(key);
+    since = q.time;
+    const [label, cls] = way(q.policy, q.route, q.err);
+    const tr = el("tr", undefined, initial ? "" : "new");
+    tr.append(
+      el("td", new Date(q.time).toLocaleTimeString()),
+      el("td", q.client || ""),
+      el("td", q.domain),
+      el("td", label, "way " + cls),
+      el("td", q.err || (q.answers || []).join(", ")),
+      el("td", q.source === "cache" ? "cache" : q.upstream || q.source),
+    );
+    tr.title = q.rule ? "Rule: " + q.rule : "No rule matched";
+    tbody.prepend(tr);
+  }
+  while (tbody.rows.length > streamSize) {
+    tbody.deleteRow(-1);
+  }
+  if (seen.size > 4 * streamSize) {
+    seen = new Set([...seen].slice(-streamSize));
+  }
+}
+
+async function refreshHits() {
+  const hits = await api("/api/hits");
+  const tbody = document.querySelector("#hits tbody");
+  tbody.replaceChildren();
+  for (const h of hits.slice(0, 25)) {
+    const tr = el("tr");
+    tr.append(el("td", h.rule), el("td", h.hits.toLocaleString()));
+    tbody.append(tr);
+  }
+  if (!hits.length) {
+    const tr = el("tr");
+    const td = el("td", "No rule matched yet", "hint");
+    td.colSpan = 2;
+    tr.append(td);
+    tbody.append(tr);
+  }
+}
+
+async function testDomain(domain) {
+  const out = document.getElementById("test-result");
+  out.replaceChildren(el("span", "Resolving " + domain + "…", "hint"));
+  let d;
+  try {
+    d = await api("/api/resolve?domain=" + encodeURIComponent(domain));
+  } catch (e) {
+    if (e instanceof Unauthorized) throw e;
+    out.replaceChildren(el("span", domain + ": " + e.message, "error"));
+    return;
+  }
+  const [label, cls] = way(d.policy, d.route);
+  const dl = el("dl");
+  const row = (k, v) => v && dl.append(el("dt", k), el("dd", v));
+  row("Rule", d.rule ? d.rule + " (" + d.rule_type + ")" : "none matched");
+  row("Answers", (d.answers || []).join(", ") || "none");
+  row("CNAMEs", (d.cnames || []).join(" ➜ "));
+  row("Answered by", d.source === "cache" ? "cache" : d.upstream || d.source);
+  row("Took", d.latency_ms.toFixed(1) + " ms");
+  out.replaceChildren(el("div", d.domain + ": " + label, "way " + cls), dl);
+}
+
+function start() {
+  document.getElementById("login").hidden = true;
+  document.getElementById("main").hidden = false;
+  timers.forEach(clearInterval);
+  const every = (fn, ms) => {
+    const g = guard(fn);
+    g();
+    timers.push(setInterval(g, ms));
+  };
+  every(refreshStatus, 10000);
+  every(refreshStats, 2000);
+  every(refreshStream, 2000);
+  every(refreshHits, 10000);
+}
+
+document.getElementById("login-form").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  token = document.getElementById("token").value.trim();
+  localStorage.setItem("adminToken", token);
+  start();
+});
+
+document.getElementById("test-form").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  const domain = document.getElementById("domain").value.trim();
+  if (domain) guard(() => testDomain(domain))();
+});
+
+start();
@@ -0,0 +1,151 @@
+// Package analytics summarizes the query history: the busiest domains, how
+// much of the traffic the rules cover, and DOMAIN-SUFFIX rules worth
+// adding for domains that are queried often but match no rule.
+package analytics
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"golang.org/x/net/publicsuffix"
+
+	"openvpnadvanced/history"
+)
+
+// Defaults for Options
+const (
+	DefaultTop         = 10
+	DefaultMinQueries  = 5
+	DefaultSuggestions = 10
+)
+
+// Options tune Analyze; zero fields use the defaults
+type Options struct {
+	// Top is the length of the top-domain lists
+	Top int
+	// MinQueries is how many unmatched queries a site needs before a
+	// rule is suggested for it
+	MinQueries int
+	// Suggestions caps the number of suggested rules
+	Suggestions int
+}
+
+// Suggestion is a candidate rule for a frequently unmatched site
+type Suggestion struct {
+	// Rule is the line to add to the rule list
+	Rule   string `json:"rule"`
+	Suffix string `json:"suffix"`
+	// Queries is the number of unmatched queries the rule would cover
+	Queries int `json:"queries"`
+	// Domains is the number of distinct unmatched names under Suffix
+	Domains int `json:"domains"`
+	// Reason tells why the site likely belongs on the VPN
+	Reason string `json:"reason"`
+}
+
+// Report is the analysis of a stretch of query history
+type Report struct {
+	Queries   int `json:"queries"`
+	Matched   int `json:"matched"`
+	Unmatched int `json:"unmatched"`
+	Routed    int `json:"routed"`
+	Failed    int `json:"failed"`
+	Domains   int `json:"domains"`
+	// Top are the most queried domains, TopUnmatched those matching no rule
+	Top          []history.DomainStats `json:"top"`
+	TopUnmatched []history.DomainStats `json:"top_unmatched"`
+	Suggestions  []Suggestion          `json:"suggestions"`
+}
+
+// Coverage returns the share of resolved queries that matched a rule
+func (r Report) Coverage() float64 {
+	resolved := r.Queries - r.Failed
+	if resolved <= 0 {
+		return 0
+	}
+	return float64(r.Matched) / float64(resolved)
+}
+
+// site aggregates the domains under one registrable domain
+type site struct {
+	suffix    string
+	routed    int
+	unmatched int
+	failed    int
+	domains   int
+}
+
+// Analyze builds a report from per-domain counts (see history.Store.Stats)
+func Analyze(stats []history.DomainStats, opts Options) Report {
+	top := cmp.Or(opts.Top, DefaultTop)
+	minQueries := cmp.Or(opts.MinQueries, DefaultMinQueries)
+	limit := cmp.Or(opts.Suggestions, DefaultSuggestions)
+
+	stats = slices.Clone(stats)
+	slices.SortStableFunc(stats, func(a, b history.DomainStats) int { return cmp.Compare(b.Queries, a.Queries) })
+
+	var r Report
+	sites := make(map[string]*site)
+	for _, st := range stats {
+		r.Queries += st.Queries
+		r.Matched += st.Matched
+		r.Routed += st.Routed
+		r.Failed += st.Failed
+		unmatched := st.Queries - st.Matched
+		r.Unmatched += unmatched
+		if len(r.Top) < top {
+			r.Top = append(r.Top, st)
+		}
+		if unmatched > 0 && len(r.TopUnmatched) < top {
+			r.TopUnmatched = append(r.TopUnmatched, st)
+		}
+
+		suffix, err := publicsuffix.EffectiveTLDPlusOne(st.Domain)
+		if err != nil {
+			suffix = st.Domain
+		}
+		s := sites[suffix]
+		if s == nil {
+			s = &site{suffix: suffix}
+			sites[suffix] = s
+		}
+		s.routed += st.Routed
+		if unmatched > 0 {
+			s.unmatched += unmatched
+			s.failed += min(st.Failed, unmatched)
+			s.domains++
+		}
+	}
+	r.Domains = len(stats)
+
+	for _, s := range sites {
+		if s.unmatched < minQueries {
+			continue
+		}
+		// 同站点已有名字走 VPN，或直连解析大多失败，说明这个站点很可能需要 VPN
+		var reason string
+		switch {
+		case s.routed > 0:
+			reason = fmt.Sprintf("%d queries for other names under %s are routed", s.routed, s.suffix)
+		case s.failed*2 >= s.unmatched:
+			reason = fmt.Sprintf("%d of %d queries failed to resolve", s.failed, s.unmatched)
+		default:
+			continue
+		}
+		r.Suggestions = append(r.Suggestions, Suggestion{
+			Rule:    "DOMAIN-SUFFIX," + s.suffix,
+			Suffix:  s.suffix,
+			Queries: s.unmatched,
+			Domains: s.domains,
+			Reason:  reason,
+		})
+	}
+	slices.SortFunc(r.Suggestions, func(a, b Suggestion) int {
+		return cmp.Or(cmp.Compare(b.Queries, a.Queries), cmp.Compare(a.Suffix, b.Suffix))
+	})
+	if len(r.Suggestions) > limit {
+		r.Suggestions = r.Suggestions[:limit]
+	}
+	return r
+}
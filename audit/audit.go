@@ -0,0 +1,114 @@
+// Package audit keeps an append-only log of every change the daemon makes
+// to the system: routes added and removed, firewall rules, connections
+// killed and files written. It is separate from the debug log, which is
+// cleared and rotated freely, so an operator can always tell what the
+// daemon touched, when, and whether it worked.
+//
+// The log is JSON lines, one Entry per change, written unbuffered.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of change
+const (
+	RouteAdd        = "route-add"
+	RouteDelete     = "route-delete"
+	DefaultRoute    = "default-route"
+	Firewall        = "firewall"
+	KillConnections = "kill-connections"
+	FileWrite       = "file-write"
+)
+
+// Entry is one audited change
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+	OK     bool      `json:"ok"`
+	Err    string    `json:"err,omitempty"`
+}
+
+// Log appends Entries to a file. Methods are safe on a nil *Log, which
+// records nothing.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Open opens path for appending, creating it readable by the owner only
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Record appends a change of kind to target with its outcome err
+func (l *Log) Record(kind, target, detail string, err error) {
+	if l == nil {
+		return
+	}
+	e := Entry{Time: time.Now(), Kind: kind, Target: target, Detail: detail, OK: err == nil}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	_ = l.enc.Encode(&e)
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+var (
+	defaultMu  sync.RWMutex
+	defaultLog *Log
+)
+
+// SetDefault makes l receive the changes recorded with the package-level
+// Record by every package of the process, and returns a function
+// restoring the previous log
+func SetDefault(l *Log) (restore func()) {
+	defaultMu.Lock()
+	prev := defaultLog
+	defaultLog = l
+	defaultMu.Unlock()
+
+	return func() {
+		defaultMu.Lock()
+		defaultLog = prev
+		defaultMu.Unlock()
+	}
+}
+
+// Record appends a change to the default log; nothing is recorded until
+// SetDefault is called
+func Record(kind, target, detail string, err error) {
+	defaultMu.RLock()
+	l := defaultLog
+	defaultMu.RUnlock()
+	l.Record(kind, target, detail, err)
+}
@@ -0,0 +1,201 @@
+// Package bench measures encrypted DNS providers from the current
+// network: latency, error rate, and whether their answers agree with the
+// other providers (a provider that answers names the rest call
+// nonexistent, or vice versa, is filtering or hijacking).
+package bench
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// Provider is a candidate upstream
+type Provider struct {
+	Name string
+	// Spec is a DoH URL or DNS stamp, as accepted by doh.ParseUpstream
+	Spec string
+	// Relays are Anonymized DNSCrypt relays for a DNSCrypt Spec
+	Relays []string
+}
+
+// Builtin are well-known public DoH providers without filtering
+var Builtin = []Provider{
+	{Name: "Cloudflare", Spec: "https://cloudflare-dns.com/dns-query"},
+	{Name: "Google", Spec: "https://dns.google/dns-query"},
+	{Name: "Quad9", Spec: "https://dns.quad9.net/dns-query"},
+	{Name: "AdGuard (unfiltered)", Spec: "https://unfiltered.adguard-dns.com/dns-query"},
+	{Name: "OpenDNS", Spec: "https://doh.opendns.com/dns-query"},
+	{Name: "Mullvad", Spec: "https://doh.mullvad.net/dns-query"},
+}
+
+// DefaultDomains are queried when none are given. The .invalid name must
+// be NXDOMAIN everywhere (RFC 6761), which exposes NXDOMAIN hijacking.
+var DefaultDomains = []string{
+	"example.com",
+	"wikipedia.org",
+	"github.com",
+	"apple.com",
+	"microsoft.com",
+	"amazon.com",
+	"bench-probe.invalid",
+}
+
+// Result is one provider's measurements
+type Result struct {
+	Provider
+	Queries int
+	Errors  int
+	// Median and P90 are over successful queries
+	Median time.Duration
+	P90    time.Duration
+	// Consistency is the fraction of domains whose answer agreed with the
+	// majority of providers
+	Consistency float64
+	// Err is set when the provider couldn't be set up at all
+	Err error
+}
+
+// ErrorRate is the fraction of failed queries
+func (r Result) ErrorRate() float64 {
+	if r.Queries == 0 {
+		return 1
+	}
+	return float64(r.Errors) / float64(r.Queries)
+}
+
+// outcome classifies an answer for the consistency check; CDN answers
+// differ by resolver, so only the kind of answer is compared
+func outcome(msg *dns.Msg, err error) string {
+	switch {
+	case errors.Is(err, doh.ErrNXDomain):
+		return "nxdomain"
+	case err != nil:
+		return ""
+	}
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeA {
+			return "address"
+		}
+	}
+	return "empty"
+}
+
+// Run queries every domain rounds times through each provider, providers
+// in parallel, and returns the results ranked best first (see Rank)
+func Run(ctx context.Context, providers []Provider, domains []string, rounds int) []Result {
+	if len(domains) == 0 {
+		domains = DefaultDomains
+	}
+	if rounds <= 0 {
+		rounds = 3
+	}
+	results := make([]Result, len(providers))
+	// outcomes[i][j] is provider i's first answer for domain j
+	outcomes := make([][]string, len(providers))
+
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], outcomes[i] = measure(ctx, p, domains, rounds)
+		}()
+	}
+	wg.Wait()
+
+	for j := range domains {
+		majority := majorityOutcome(outcomes, j)
+		for i := range results {
+			if majority != "" && outcomes[i] != nil && outcomes[i][j] == majority {
+				results[i].Consistency += 1 / float64(len(domains))
+			}
+		}
+	}
+	Rank(results)
+	return results
+}
+
+func measure(ctx context.Context, p Provider, domains []string, rounds int) (Result, []string) {
+	res := Result{Provider: p}
+	up, err := doh.ParseUpstream(p.Spec, p.Relays...)
+	if err != nil {
+		res.Err = err
+		return res, nil
+	}
+	outcomes := make([]string, len(domains))
+	var latencies []time.Duration
+	for round := 0; round < rounds; round++ {
+		for j, domain := range domains {
+			if ctx.Err() != nil {
+				res.Err = ctx.Err()
+				return res, outcomes
+			}
+			start := time.Now()
+			msg, err := up.Exchange(domain, dns.TypeA)
+			elapsed := time.Since(start)
+			res.Queries++
+			o := outcome(msg, err)
+			if o == "" {
+				res.Errors++
+				continue
+			}
+			latencies = append(latencies, elapsed)
+			if round == 0 {
+				outcomes[j] = o
+			}
+		}
+	}
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		res.Median = latencies[len(latencies)/2]
+		res.P90 = latencies[len(latencies)*9/10]
+	}
+	return res, outcomes
+}
+
+func majorityOutcome(outcomes [][]string, j int) string {
+	counts := map[string]int{}
+	best, bestN := "", 0
+	for _, o := range outcomes {
+		if o == nil || o[j] == "" {
+			continue
+		}
+		counts[o[j]]++
+		if counts[o[j]] > bestN {
+			best, bestN = o[j], counts[o[j]]
+		}
+	}
+	return best
+}
+
+// Rank sorts results best first: usable providers before broken ones,
+// then by error rate, consistency and median latency
+func Rank(results []Result) {
+	slices.SortStableFunc(results, func(a, b Result) int {
+		if c := cmp.Compare(boolInt(a.Err != nil), boolInt(b.Err != nil)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.ErrorRate(), b.ErrorRate()); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Consistency, a.Consistency); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Median, b.Median)
+	})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+// Package boltcache implements dnsmasq.CacheBackend on an embedded bbolt
+// database, giving a single node a persistent cache without running Redis.
+package boltcache
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketName = []byte("dns")
+
+// Cache is a bbolt-backed dnsmasq.CacheBackend
+type Cache struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+var _ dnsmasq.CacheBackend = (*Cache)(nil)
+
+// Open opens (or creates) the database at path and drops entries older
+// than ttl
+func Open(path string, ttl time.Duration) (*Cache, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &Cache{db: db, ttl: ttl}
+	if err := c.Purge(); err != nil {
+		log.Printf("⚠️ Failed to purge expired bolt cache entries: %v", err)
+	}
+	return c, nil
+}
+
+// Get returns the cached value for domain if it hasn't expired
+func (c *Cache) Get(domain string) (string, bool) {
+	var record dnsmasq.DNSRecord
+	found := false
+
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketName).Get([]byte(domain))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil
+		}
+		found = true
+		return nil
+	})
+
+	if !found || record.Expired(c.ttl) {
+		return "", false
+	}
+	return record.IP, true
+}
+
+// Set stores value for domain. Concurrent writes are coalesced into a
+// single transaction so high query rates don't fsync per entry.
+func (c *Cache) Set(domain, value string) {
+	c.SetTTL(domain, value, 0)
+}
+
+// SetTTL stores value for domain, served for ttl instead of the cache's
+// TTL when positive
+func (c *Cache) SetTTL(domain, value string, ttl time.Duration) {
+	data, _ := json.Marshal(dnsmasq.DNSRecord{IP: value, Timestamp: time.Now(), TTL: max(ttl, 0)})
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put([]byte(domain), data)
+	})
+	if err != nil {
+		log.Printf("⚠️ Bolt cache set %s failed: %v", domain, err)
+	}
+}
+
+// Delete removes the entry for domain
+func (c *Cache) Delete(domain string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete([]byte(domain))
+	})
+}
+
+// Raw returns all unexpired entries
+func (c *Cache) Raw() map[string]dnsmasq.DNSRecord {
+	result := make(map[string]dnsmasq.DNSRecord)
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+			var record dnsmasq.DNSRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return nil
+			}
+			if !record.Expired(c.ttl) {
+				result[string(k)] = record
+			}
+			return nil
+		})
+	})
+	return result
+}
+
+// Purge deletes expired and unreadable entries
+func (c *Cache) Purge() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var record dnsmasq.DNSRecord
+			if err := json.Unmarshal(v, &record); err != nil || record.Expired(c.ttl) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the database
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
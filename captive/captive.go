@@ -0,0 +1,114 @@
+// Package captive detects captive portals the way operating systems do:
+// a probe URL returns a known answer on an open network, and a redirect or
+// a login page behind a portal.
+package captive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultURL is probed when Prober.URL is empty
+const DefaultURL = "http://captive.apple.com/hotspot-detect.html"
+
+// State is the outcome of a probe
+type State int
+
+const (
+	// Open means the probe got the expected answer
+	Open State = iota
+	// Portal means the probe was redirected or answered by something else
+	Portal
+	// Offline means the probe couldn't reach anything
+	Offline
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case Portal:
+		return "captive portal"
+	default:
+		return "offline"
+	}
+}
+
+// Prober checks for a captive portal
+type Prober struct {
+	// URL answers 204, or 200 with a body containing "Success", on an open
+	// network (default DefaultURL)
+	URL string
+	// Resolver is the plain DNS server (IP:port) the probe host is looked
+	// up with. Behind a portal the encrypted upstream is usually blocked,
+	// so this should be the network's own resolver rather than this daemon.
+	// The system resolver is used when empty.
+	Resolver string
+	// Timeout bounds one probe (default 5s)
+	Timeout time.Duration
+}
+
+// Probe fetches the probe URL without following redirects and classifies
+// the answer. err describes why the network isn't Open.
+func (p *Prober) Probe(ctx context.Context) (State, error) {
+	url := p.URL
+	if url == "" {
+		url = DefaultURL
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if p.Resolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, p.Resolver)
+			},
+		}
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Offline, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Offline, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return Open, nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return Portal, fmt.Errorf("redirected to %s", resp.Header.Get("Location"))
+	case resp.StatusCode != http.StatusOK:
+		return Portal, fmt.Errorf("probe returned HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return Offline, err
+	}
+	if !strings.Contains(string(body), "Success") {
+		return Portal, fmt.Errorf("unexpected probe response")
+	}
+	return Open, nil
+}
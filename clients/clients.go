@@ -0,0 +1,272 @@
+// Package clients identifies the LAN clients querying the DNS listener,
+// by source address, MAC address or an EDNS client-id, so their queries
+// can be tagged in logs and stats and given their own rule profile and
+// rate limit.
+//
+// The client-id is read from the EDNS0 options dnsmasq adds when
+// forwarding: add-cpe-id (option 65074) carries an id string, add-mac
+// (option 65073) the client's MAC. Clients querying directly are matched
+// by MAC through the ARP/NDP neighbor table.
+package clients
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option codes added by dnsmasq's add-cpe-id and add-mac
+const (
+	OptionClientID = 65074
+	OptionMAC      = 65073
+)
+
+// Client is a configured LAN client
+type Client struct {
+	Name string
+	// Addrs, MACs and IDs identify the client; any one matching is enough
+	Addrs []netip.Prefix
+	MACs  []string
+	IDs   []string
+	// Profile names the rule profile applied to the client's queries
+	Profile string
+	// RateLimit is the client's queries per second; 0 uses the registry's
+	// default and a negative value is unlimited
+	RateLimit float64
+}
+
+// Identity is who sent a query
+type Identity struct {
+	// Name is the configured client's name, empty when unknown
+	Name    string
+	Addr    netip.Addr
+	MAC     string
+	ID      string
+	Profile string
+}
+
+// String returns the client's name, or its address when unknown
+func (id Identity) String() string {
+	if id.Name != "" {
+		return id.Name
+	}
+	if id.Addr.IsValid() {
+		return id.Addr.String()
+	}
+	return "unknown"
+}
+
+// ParseMAC normalizes a MAC address to lower-case colon notation
+func ParseMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// FromMsg returns the client-id and MAC carried in r's EDNS0 options
+func FromMsg(r *dns.Msg) (id, mac string) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return "", ""
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok {
+			continue
+		}
+		switch local.Code {
+		case OptionClientID:
+			id = strings.TrimSpace(string(local.Data))
+		case OptionMAC:
+			if len(local.Data) == 6 {
+				mac = net.HardwareAddr(local.Data).String()
+			}
+		}
+	}
+	return id, mac
+}
+
+// Registry identifies clients and enforces their rate limits. Methods
+// are safe on a nil *Registry, which identifies clients by address only
+// and never limits them.
+type Registry struct {
+	Clients []Client
+	// DefaultRateLimit is the queries per second of clients without their
+	// own limit, per address for unknown clients; 0 is unlimited
+	DefaultRateLimit float64
+	// Neighbors looks up the MAC of a LAN address; the system ARP/NDP
+	// table when nil
+	Neighbors func(netip.Addr) string
+
+	once      sync.Once
+	neighbors *NeighborTable
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// Identify returns the identity of a query from addr. id and mac are the
+// EDNS client-id and MAC (see FromMsg); the id is matched first, then the
+// MAC, then the address.
+func (r *Registry) Identify(addr netip.Addr, id, mac string) Identity {
+	ident := Identity{Addr: addr.Unmap(), ID: id, MAC: mac}
+	if r == nil || len(r.Clients) == 0 {
+		return ident
+	}
+	if ident.MAC == "" && r.wantsMAC() {
+		ident.MAC = r.lookupMAC(ident.Addr)
+	}
+	match := func(c *Client) {
+		ident.Name, ident.Profile = c.Name, c.Profile
+	}
+	if id != "" {
+		for i := range r.Clients {
+			if containsFold(r.Clients[i].IDs, id) {
+				match(&r.Clients[i])
+				return ident
+			}
+		}
+	}
+	if ident.MAC != "" {
+		for i := range r.Clients {
+			if containsFold(r.Clients[i].MACs, ident.MAC) {
+				match(&r.Clients[i])
+				return ident
+			}
+		}
+	}
+	for i := range r.Clients {
+		for _, prefix := range r.Clients[i].Addrs {
+			if prefix.Contains(ident.Addr) {
+				match(&r.Clients[i])
+				return ident
+			}
+		}
+	}
+	return ident
+}
+
+// wantsMAC reports whether any client is matched by MAC
+func (r *Registry) wantsMAC() bool {
+	for _, c := range r.Clients {
+		if len(c.MACs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) lookupMAC(addr netip.Addr) string {
+	if r.Neighbors != nil {
+		return r.Neighbors(addr)
+	}
+	r.once.Do(func() { r.neighbors = NewNeighborTable(30 * time.Second) })
+	return r.neighbors.Lookup(addr)
+}
+
+// Allow takes one query from the client's rate limit and reports whether
+// it may be answered
+func (r *Registry) Allow(ident Identity) bool {
+	if r == nil {
+		return true
+	}
+	rate, key := r.DefaultRateLimit, ident.Addr.String()
+	if ident.Name != "" {
+		key = "client:" + ident.Name
+		for _, c := range r.Clients {
+			if c.Name == ident.Name && c.RateLimit != 0 {
+				rate = c.RateLimit
+				break
+			}
+		}
+	}
+	if rate <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucket)
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		// 允许一秒的突发
+		b = &bucket{tokens: rate, at: time.Now()}
+		r.buckets[key] = b
+	}
+	return b.take(rate, time.Now())
+}
+
+// bucket is a token bucket holding at most one second of queries
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func (b *bucket) take(rate float64, now time.Time) bool {
+	b.tokens = min(rate, b.tokens+now.Sub(b.at).Seconds()*rate)
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ParseAddrs parses addresses and CIDR prefixes
+func ParseAddrs(specs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if strings.Contains(spec, "/") {
+			prefix, err := netip.ParsePrefix(spec)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(spec)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// ParseMACs normalizes a list of MAC addresses
+func ParseMACs(specs []string) ([]string, error) {
+	var macs []string
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		mac, err := ParseMAC(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC %q", spec)
+		}
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
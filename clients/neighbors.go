@@ -0,0 +1,121 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NeighborTable maps LAN addresses to MACs from the system ARP/NDP
+// table: /proc/net/arp on Linux, `arp -an` and `ndp -an` elsewhere. The
+// table is re-read on a miss at most once per refresh interval.
+type NeighborTable struct {
+	refresh time.Duration
+
+	mu     sync.Mutex
+	macs   map[netip.Addr]string
+	loaded time.Time
+}
+
+// NewNeighborTable returns a table re-read at most every refresh
+func NewNeighborTable(refresh time.Duration) *NeighborTable {
+	return &NeighborTable{refresh: refresh}
+}
+
+// Lookup returns the MAC of addr, or "" when it isn't a known neighbor
+func (t *NeighborTable) Lookup(addr netip.Addr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if mac, ok := t.macs[addr]; ok {
+		return mac
+	}
+	if time.Since(t.loaded) < t.refresh {
+		return ""
+	}
+	t.macs, t.loaded = readNeighbors(), time.Now()
+	return t.macs[addr]
+}
+
+func readNeighbors() map[netip.Addr]string {
+	macs := make(map[netip.Addr]string)
+	if runtime.GOOS == "linux" {
+		if data, err := os.ReadFile("/proc/net/arp"); err == nil {
+			parseProcARP(data, macs)
+		}
+		return macs
+	}
+	for _, cmd := range [][]string{{"arp", "-an"}, {"ndp", "-an"}} {
+		if out, err := exec.Command(cmd[0], cmd[1:]...).Output(); err == nil {
+			parseNeighborOutput(out, macs)
+		}
+	}
+	return macs
+}
+
+// parseProcARP parses /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.20     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseProcARP(data []byte, macs map[netip.Addr]string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		if mac, err := ParseMAC(fields[3]); err == nil && mac != "00:00:00:00:00:00" {
+			macs[addr] = mac
+		}
+	}
+}
+
+// parseNeighborOutput parses `arp -an` and `ndp -an` output:
+//
+//	? (192.168.1.20) at aa:bb:cc:dd:ee:ff on en0 ifscope [ethernet]
+//	fe80::1%en0                          aa:bb:cc:dd:ee:ff   en0 permanent R
+func parseNeighborOutput(out []byte, macs map[netip.Addr]string) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		host, hw := fields[0], fields[1]
+		if len(fields) >= 4 && fields[2] == "at" {
+			host, hw = strings.Trim(fields[1], "()"), fields[3]
+		}
+		host, _, _ = strings.Cut(host, "%")
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		// macOS 省略前导零，如 a:b:c:d:e:f
+		if mac, err := ParseMAC(padMAC(hw)); err == nil {
+			macs[addr] = mac
+		}
+	}
+}
+
+// padMAC restores the leading zeros macOS drops from MAC octets
+func padMAC(s string) string {
+	parts := strings.Split(s, ":")
+	if len(parts) != 6 {
+		return s
+	}
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":")
+}
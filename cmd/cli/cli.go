@@ -5,6 +5,8 @@ import (
 	"os"
 	"strings"
 
+	"openvpnadvanced/version"
+
 	"github.com/peterh/liner"
 )
 
@@ -38,12 +40,16 @@ func getCompleter() func(string) []string {
 	return func(line string) (c []string) {
 		commands := []string{
 			"help", "auto-subscribe true", "auto-subscribe false", "update-period", "update-now",
-			"show-config", "show-iface", "reload-config", "exit",
-			"check-openvpn-on", "check-openvpn-off", "start", "startv",
+			"show-config", "show-iface", "reload-config", "reload-rules", "upgrade", "exit",
+			"check-openvpn-on", "check-openvpn-off", "start", "startv", "stop",
 			"view-log err", "view-log info", "view-log direct", "view-log vpn",
-			"set-log-level info", "set-log-level err", "set-log-level vpn",
+			"set-log-level debug", "set-log-level info", "set-log-level warn", "set-log-level error",
 			"clear-logs", "compress-logs", "clear", "test", "rtest",
-			"status",
+			"status", "diag", "version", "dryrun", "replay", "geo-update",
+			"telemetry", "bench upstreams", "presets", "override", "override clear", "overrides", "kill",
+			"pin", "pin clear", "pins", "fakeips",
+			"history", "history client", "querylog", "querylog export", "analytics", "cache flush",
+			"rules", "rules enable", "rules disable", "checkpoint", "confirm", "rollback", "leaktest",
 		}
 		for _, cmd := range commands {
 			if strings.HasPrefix(cmd, line) {
@@ -78,10 +84,16 @@ func handleCommand(parts []string) error {
 		return handleStart(false)
 	case "startv":
 		return handleStart(true)
+	case "stop":
+		return handleStop()
 	case "show-iface":
 		return handleShowIface()
 	case "reload-config":
 		return handleReloadConfig()
+	case "reload-rules":
+		return handleReloadRules()
+	case "upgrade":
+		return handleUpgrade()
 	case "set-log-level":
 		return handleSetLogLevel(parts)
 	case "view-log":
@@ -96,6 +108,52 @@ func handleCommand(parts []string) error {
 		return handleTest(parts)
 	case "rtest":
 		return handleRTest(parts)
+	case "diag":
+		return handleDiag(parts)
+	case "dryrun":
+		return handleDryRun(parts)
+	case "replay":
+		return handleReplay(parts)
+	case "geo-update":
+		return handleGeoUpdate()
+	case "telemetry":
+		return handleTelemetry()
+	case "bench":
+		return handleBench(parts)
+	case "presets":
+		return printPresets()
+	case "override":
+		return handleOverride(parts)
+	case "overrides":
+		printOverrides()
+	case "kill":
+		return handleKill(parts)
+	case "pin":
+		return handlePin(parts)
+	case "pins":
+		printPins()
+	case "fakeips":
+		printFakeIPs(parts)
+	case "history":
+		return handleHistory(parts)
+	case "querylog":
+		return handleQueryLog(parts)
+	case "analytics":
+		return handleAnalytics(parts)
+	case "cache":
+		return handleCache(parts)
+	case "rules":
+		return handleRules(parts)
+	case "checkpoint":
+		return handleCheckpoint(parts)
+	case "confirm":
+		return handleConfirm()
+	case "rollback":
+		return handleRollback()
+	case "leaktest":
+		return handleLeakTest()
+	case "version":
+		fmt.Println(version.String())
 	default:
 		return fmt.Errorf("unknown command: %s", parts[0])
 	}
@@ -1,17 +1,29 @@
 package cli
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"openvpnadvanced/cmd/config"
 	"openvpnadvanced/cmd/core"
+	"openvpnadvanced/cmd/diag"
+	"openvpnadvanced/cmd/logger"
 	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
 	"openvpnadvanced/fetcher"
+	"openvpnadvanced/history"
+	"openvpnadvanced/querylog"
 	"openvpnadvanced/vpn"
 )
 
@@ -23,28 +35,138 @@ func printHelp() {
   update-now - Force a manual subscription update
   show-config - Show current configuration
   show-iface - Show current VPN interface info
-  reload-config - Reload config.ini without restarting
+  reload-config - Reload the configuration and rules without restarting
+  reload-rules - Swap in the current rule list without restarting the DNS listener
+  upgrade - Hand the DNS listener over to a fresh start of the (replaced) binary
   exit - Exit the program
   check-openvpn-on - Enable OpenVPN check
   check-openvpn-off - Disable OpenVPN check
   start - Start the main DNS/VPN logic
   startv - Start the main logic and print to console
+  stop - Stop the DNS listener and background workers
   view-log err - Show only log lines with [ERROR]
   view-log info - Show all logs
   view-log direct - Show lines with [DIRECT]
   view-log vpn - Show lines with [VPN]
-  set-log-level info/err/vpn - Set logging level
+  set-log-level debug/info/warn/error - Set the logging level, at once (see log-modules for per-module levels)
   clear-logs - Clear all log files
   compress-logs - Archive all log files into a zip
   clear - Clear console output
   test <domain> - Check if a domain will be routed via VPN or direct
   rtest <domain> - Check routing and interface info for a domain
-  status - Show current running status of the core and VPN client`)
+  status - Show current running status of the core and VPN client
+  dryrun [file] - Resolve a domain list and report routing decisions without changing the system
+  geo-update - Download the configured GeoIP/GeoSite databases now
+  replay [file] - Re-run recorded routing decisions against the current rules and show changes
+  bench upstreams [rounds] [write] - Benchmark encrypted DNS providers; "write" saves the best as upstream
+  presets - List the upstream presets usable by name in upstream
+  override <domain> direct/vpn/<action> [duration] - Pin a domain to an egress above the rules (e.g. 1h)
+  override clear <domain> - Remove an override
+  overrides - List the active overrides
+  kill <domain/ip> - Close live connections so they reconnect along the current routes
+  history [domain] [count] - Show the latest queries, optionally for a domain and its subdomains
+  history client <name> [count] - Show the latest queries of a client
+  querylog [domain] [count] - Show the latest resolutions with their rule, policy, upstream and latency (query-log)
+  querylog export <path> [domain] - Write the query log to a file as JSON lines
+  analytics [window] - Show top domains, rule coverage and suggested rules from the query history (default 24h)
+  cache flush [pattern] - Drop cached answers matching a suffix or glob (all when omitted) and withdraw their routes
+  pin <domain> [ip] [duration] - Answer a domain with a fixed address (the current one when omitted)
+  pin clear <domain> - Remove a pin
+  pins - List the active pins
+  fakeips [domain] - List the fake addresses handed out in fake-ip mode and the real ones behind them
+  rules - List the rule groups and whether they are enabled
+  rules enable/disable <group> - Switch a rule group on or off; kept across restarts
+  checkpoint [duration] - Roll the rules, rule groups and overrides back unless confirmed in time (default rollback-timeout)
+  confirm - Keep the changes made since the checkpoint
+  rollback - Revert the changes made since the checkpoint now
+  leaktest - Show the resolver and exit address external services see for PROXY and DIRECT domains, and any leaks
+  telemetry - Show the anonymous usage report that would be sent (opt-in)
+  version - Show version, commit and build date
+  diag [path] - Export a diagnostics bundle (config, logs, rules, routes, upstream probes)`)
+}
+
+// printUDPStats prints what became of the UDP listener's datagrams
+func printUDPStats(st dnsproxy.UDPStats) {
+	fmt.Printf("   udp: %d received, %d/%d queued, %d dropped (queue full), %d malformed\n",
+		st.Received, st.Queued, st.Queue, st.Dropped, st.Malformed)
+	if st.KernelKnown {
+		fmt.Printf("   udp socket: %d bytes read buffer, %d dropped by the kernel\n", st.ReadBuffer, st.KernelDrops)
+	}
+}
+
+// printClientQueries prints the busiest clients first
+func printClientQueries(counts map[string]uint64) {
+	names := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(names, func(a, b string) int {
+		if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	for _, name := range names {
+		fmt.Printf("   client %s: %d queries\n", name, counts[name])
+	}
 }
 
 func printStatus() {
 	if core.IsCoreStarted() {
 		fmt.Println("✅ Core logic is running.")
+		for _, l := range core.Limits() {
+			fmt.Printf("   %s: %d/%d in use, waited %d, rejected %d\n", l.Name, l.InUse, l.Limit, l.Waited, l.Rejected)
+		}
+		printUDPStats(core.UDPStats())
+		if n, ok := core.HookDrops(); ok && n > 0 {
+			fmt.Printf("   hook script: %d events dropped (queue full)\n", n)
+		}
+		if d, ok := core.Designated(); ok {
+			fmt.Printf("   designated resolver: %s (via %s)\n", d.URL(), d.Resolver)
+		}
+		if prefix, ok := core.NAT64(); ok {
+			fmt.Printf("   NAT64 prefix: %s\n", prefix)
+		}
+		if list, ok := core.FakeIPs(); ok {
+			fmt.Printf("   fake-ip: %d addresses handed out\n", len(list))
+		}
+		conflicts, coexist := core.Conflicts()
+		for _, c := range conflicts {
+			fmt.Printf("   ⚠️ conflict: %s\n", c)
+		}
+		if coexist {
+			fmt.Println("   coexistence mode: default route and port 53 left alone")
+		}
+		if deadline, ok := core.PendingCheckpoint(); ok {
+			fmt.Printf("   ⏳ unconfirmed changes roll back in %s\n", time.Until(deadline).Round(time.Second))
+		}
+		if since, ok := core.Offline(); ok {
+			fmt.Printf("   📴 offline since %s: no upstream reachable, answering from the cache only\n", since.Format(time.TimeOnly))
+		}
+		if resolver := core.CaptivePortal(); resolver != "" {
+			fmt.Printf("   captive portal: DNS passed through to %s until it clears\n", resolver)
+		}
+		if n := core.VerifyMismatches(); n > 0 {
+			fmt.Printf("   🚨 %d answers disagreed with verify-upstream\n", n)
+		}
+		for _, u := range core.Upstreams() {
+			state := "healthy"
+			if !u.Healthy {
+				state = "down: " + u.Err
+			}
+			fmt.Printf("   upstream %s: %s, rtt %s, %d/%d failed\n", u.Name, state, u.RTT.Round(time.Millisecond), u.Failures, u.Queries)
+		}
+		for _, ep := range core.UpstreamEndpoints() {
+			state := "healthy"
+			if !ep.Healthy {
+				state = fmt.Sprintf("skipped after %d failures: %s", ep.Failures, ep.Err)
+			}
+			fmt.Printf("   %s at %s: %s\n", ep.Host, ep.Addr, state)
+		}
+		for _, st := range core.Probes() {
+			fmt.Printf("   egress %s (%s): rtt %s, loss %.0f%% over %d probes\n", st.Egress, cmp.Or(st.Iface, "default route"), st.RTT.Round(time.Millisecond), st.Loss*100, st.Samples)
+		}
+		printClientQueries(core.ClientQueries())
 	} else {
 		fmt.Println("🛑 Core logic is not running.")
 	}
@@ -67,7 +189,7 @@ func handleAutoSubscribe(parts []string) error {
 	cfg := config.GetConfig()
 	cfg.AutoSubscribe = (parts[1] == "true")
 	config.SetConfig(cfg)
-	return config.SaveINIConfig("config.ini")
+	return config.Save(config.Path())
 }
 
 func handleUpdatePeriod(parts []string) error {
@@ -81,7 +203,7 @@ func handleUpdatePeriod(parts []string) error {
 	cfg := config.GetConfig()
 	cfg.UpdatePeriod = dur
 	config.SetConfig(cfg)
-	return config.SaveINIConfig("config.ini")
+	return config.Save(config.Path())
 }
 
 func handleUpdateNow() error {
@@ -94,6 +216,9 @@ func handleUpdateNow() error {
 			return err
 		}
 		fmt.Println("✅ Subscription updated.")
+		if core.IsCoreStarted() {
+			return handleReloadRules()
+		}
 	} else {
 		fmt.Println("Auto Subscribe is disabled. Skipping update.")
 	}
@@ -107,6 +232,9 @@ func showConfig() {
 		"Update Period":  cfg.UpdatePeriod.String(),
 		"Check OpenVPN":  fmt.Sprintf("%v", cfg.CheckOpenVPN),
 		"Log Level":      cfg.LogLevel,
+		"Helper Socket":  cfg.HelperSocket,
+		"Cache Backend":  cfg.CacheBackend,
+		"Workers":        fmt.Sprintf("%d / queue %d", cfg.Workers, cfg.QueueSize),
 	}
 
 	// Calculate max widths
@@ -134,7 +262,7 @@ func handleCheckOpenVPN(enable bool) error {
 	cfg := config.GetConfig()
 	cfg.CheckOpenVPN = enable
 	config.SetConfig(cfg)
-	return config.SaveINIConfig("config.ini")
+	return config.Save(config.Path())
 }
 
 func handleStart(verbose bool) error {
@@ -157,6 +285,18 @@ func handleStart(verbose bool) error {
 	return nil
 }
 
+func handleStop() error {
+	if !core.IsCoreStarted() {
+		fmt.Println("🛑 Core logic is not running.")
+		return nil
+	}
+	if err := core.StopCoreLogic(); err != nil {
+		return fmt.Errorf("failed to stop core: %v", err)
+	}
+	fmt.Println("✅ Core logic stopped.")
+	return nil
+}
+
 func handleShowIface() error {
 	iface, err := vpn.FindVPNInterface()
 	if err != nil {
@@ -171,22 +311,42 @@ func handleShowIface() error {
 	return nil
 }
 
+func handleUpgrade() error {
+	if err := core.Upgrade(); err != nil {
+		return err
+	}
+	fmt.Println("✅ The new process has taken over the DNS listener.")
+	os.Exit(0)
+	return nil
+}
+
 func handleReloadConfig() error {
-	if err := config.LoadINIConfig("config.ini"); err != nil {
-		return fmt.Errorf("failed to reload config.ini: %v", err)
+	if err := core.Reload(); err != nil {
+		return err
 	}
 	fmt.Println("✅ Configuration reloaded.")
 	return nil
 }
 
+func handleReloadRules() error {
+	if err := core.ReloadRules(); err != nil {
+		return fmt.Errorf("failed to reload rules: %v", err)
+	}
+	fmt.Println("✅ Rules reloaded.")
+	return nil
+}
+
 func handleSetLogLevel(parts []string) error {
 	if len(parts) < 2 {
-		return fmt.Errorf("missing log level: info, err, or vpn")
+		return fmt.Errorf("missing log level: debug, info, warn or error")
 	}
 	cfg := config.GetConfig()
+	if err := logger.Apply(parts[1], cfg.LogModules); err != nil {
+		return err
+	}
 	cfg.LogLevel = parts[1]
 	config.SetConfig(cfg)
-	if err := config.SaveINIConfig("config.ini"); err != nil {
+	if err := config.Save(config.Path()); err != nil {
 		return err
 	}
 	fmt.Println("Log level set to:", cfg.LogLevel)
@@ -309,3 +469,522 @@ func handleRTest(parts []string) error {
 	fmt.Printf("   ➜ Interface: %s (IP: %s)\n", routeIface, ip)
 	return nil
 }
+
+func handleDiag(parts []string) error {
+	archive := fmt.Sprintf("logs/diag_%s.zip", time.Now().Format("20060102_150405"))
+	if len(parts) > 1 {
+		archive = parts[1]
+	}
+	fmt.Println("⏳ Collecting diagnostics...")
+	if err := diag.Export(archive, config.Path(), "assets/merged_rule.list"); err != nil {
+		return fmt.Errorf("failed to export diagnostics: %v", err)
+	}
+	fmt.Println("✅ Diagnostics bundle written to", archive)
+	return nil
+}
+
+func handleDryRun(parts []string) error {
+	domainsFile := "assets/dryrun_domains.txt"
+	if len(parts) > 1 {
+		domainsFile = parts[1]
+	}
+	report, err := core.DryRun("assets/merged_rule.list", domainsFile, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if report.Failures > 0 {
+		return fmt.Errorf("%d domain(s) failed to resolve", report.Failures)
+	}
+	return nil
+}
+
+func handleReplay(parts []string) error {
+	recordPath := config.GetConfig().ReplayRecord
+	if len(parts) > 1 {
+		recordPath = parts[1]
+	}
+	if recordPath == "" {
+		return fmt.Errorf("usage: replay <file> (or set replay-record)")
+	}
+	_, err := core.Replay("assets/merged_rule.list", recordPath, os.Stdout)
+	return err
+}
+
+func handleGeoUpdate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	statuses, err := core.UpdateGeoData(ctx)
+	for _, st := range statuses {
+		if st.Err != nil {
+			fmt.Printf("❌ %s: %v\n", st.Name, st.Err)
+			continue
+		}
+		fmt.Printf("✅ %s: %s (sha256 %s)\n", st.Name, st.Path, st.SHA256)
+	}
+	return err
+}
+
+func handleTelemetry() error {
+	report, ok := core.Telemetry()
+	if !ok {
+		fmt.Println("📴 Telemetry is off (set telemetry = true and telemetry-url to opt in).")
+		return nil
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println("📊 Next usage report (this is the entire payload):")
+	fmt.Println(string(out))
+	return nil
+}
+
+func handleBench(parts []string) error {
+	if len(parts) < 2 || parts[1] != "upstreams" {
+		return fmt.Errorf("usage: bench upstreams [rounds] [write]")
+	}
+	rounds, write := 3, false
+	for _, arg := range parts[2:] {
+		if arg == "write" {
+			write = true
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("usage: bench upstreams [rounds] [write]")
+		}
+		rounds = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	fmt.Println("⏱️ Benchmarking encrypted DNS providers from this network...")
+	results, err := core.BenchUpstreams(ctx, rounds, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || results[0].Err != nil || results[0].Errors == results[0].Queries {
+		return fmt.Errorf("no provider answered")
+	}
+	best := results[0]
+	fmt.Printf("🏆 Best: %s (%s)\n", best.Name, best.Spec)
+	if !write {
+		return nil
+	}
+	cfg := config.GetConfig()
+	if len(cfg.Upstreams) == 1 && cfg.Upstreams[0] == best.Spec {
+		fmt.Println("✅ Already the configured upstream.")
+		return nil
+	}
+	cfg.Upstreams = []string{best.Spec}
+	config.SetConfig(cfg)
+	if err := config.Save(config.Path()); err != nil {
+		return err
+	}
+	fmt.Println("✅ Saved as upstream; restart the core to use it.")
+	return nil
+}
+
+func handleOverride(parts []string) error {
+	if len(parts) == 3 && parts[1] == "clear" {
+		if err := core.ClearOverride(parts[2]); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Override for %s removed\n", parts[2])
+		return nil
+	}
+	if len(parts) != 3 && len(parts) != 4 {
+		return fmt.Errorf("usage: override <domain> direct/vpn/<action> [duration] | override clear <domain>")
+	}
+	var ttl time.Duration
+	if len(parts) == 4 {
+		d, err := time.ParseDuration(parts[3])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration: %s", parts[3])
+		}
+		ttl = d
+	}
+	ov, err := core.Override(parts[1], parts[2], ttl)
+	if err != nil {
+		return err
+	}
+	if ov.Expires.IsZero() {
+		fmt.Printf("📌 %s ➜ %s until cleared\n", ov.Suffix, ov.Egress)
+	} else {
+		fmt.Printf("📌 %s ➜ %s until %s\n", ov.Suffix, ov.Egress, ov.Expires.Format("15:04:05"))
+	}
+	return nil
+}
+
+func printOverrides() {
+	list := core.Overrides()
+	if len(list) == 0 {
+		fmt.Println("No active overrides.")
+		return
+	}
+	for _, ov := range list {
+		until := "until cleared"
+		if !ov.Expires.IsZero() {
+			until = fmt.Sprintf("%s left", time.Until(ov.Expires).Round(time.Second))
+		}
+		fmt.Printf("📌 %-30s ➜ %-8s (%s)\n", ov.Suffix, ov.Egress, until)
+	}
+}
+
+func handlePin(parts []string) error {
+	if len(parts) == 3 && parts[1] == "clear" {
+		if err := core.Unpin(parts[2]); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Pin for %s removed\n", parts[2])
+		return nil
+	}
+	usage := fmt.Errorf("usage: pin <domain> [ip] [duration] | pin clear <domain>")
+	if len(parts) < 2 || len(parts) > 4 {
+		return usage
+	}
+	var ip string
+	var ttl time.Duration
+	for _, arg := range parts[2:] {
+		if _, err := netip.ParseAddr(arg); err == nil && ip == "" {
+			ip = arg
+			continue
+		}
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 || ttl != 0 {
+			return usage
+		}
+		ttl = d
+	}
+	pin, err := core.Pin(parts[1], ip, ttl)
+	if err != nil {
+		return err
+	}
+	if pin.Expires.IsZero() {
+		fmt.Printf("📍 %s ➜ %s until cleared\n", pin.Domain, pin.IP)
+	} else {
+		fmt.Printf("📍 %s ➜ %s until %s\n", pin.Domain, pin.IP, pin.Expires.Format("15:04:05"))
+	}
+	return nil
+}
+
+func printPins() {
+	list := core.Pins()
+	if len(list) == 0 {
+		fmt.Println("No active pins.")
+		return
+	}
+	for _, pin := range list {
+		until := "until cleared"
+		if !pin.Expires.IsZero() {
+			until = fmt.Sprintf("%s left", time.Until(pin.Expires).Round(time.Second))
+		}
+		fmt.Printf("📍 %-30s ➜ %-15s (%s)\n", pin.Domain, pin.IP, until)
+	}
+}
+
+// printFakeIPs lists the fake-ip mappings, those of a domain suffix when
+// one is given
+func printFakeIPs(parts []string) {
+	list, ok := core.FakeIPs()
+	if !ok {
+		fmt.Println("Fake-IP mode is off (set fake-ip = true) or the core isn't running.")
+		return
+	}
+	suffix := ""
+	if len(parts) > 1 {
+		suffix = strings.ToLower(strings.TrimSuffix(parts[1], "."))
+	}
+	n := 0
+	for _, m := range list {
+		if suffix != "" && m.Domain != suffix && !strings.HasSuffix(m.Domain, "."+suffix) {
+			continue
+		}
+		fmt.Printf("🎭 %-15s ➜ %-15s %-30s (used %s ago)\n", m.Fake, m.Real, m.Domain, time.Since(m.Used).Round(time.Second))
+		n++
+	}
+	if n == 0 {
+		fmt.Println("No fake addresses handed out.")
+	}
+}
+
+func printPresets() error {
+	presets, err := core.UpstreamPresets()
+	if err != nil {
+		return err
+	}
+	for _, p := range presets {
+		caps := p.Capabilities.String()
+		if caps == "" {
+			caps = "-"
+		}
+		fmt.Printf("🌐 %-12s %-8s %-24s %s\n", p.Name, p.Region, caps, strings.Join(p.Upstreams, ", "))
+	}
+	return nil
+}
+
+func handleRules(parts []string) error {
+	if len(parts) == 1 {
+		groups := core.RuleGroups()
+		if len(groups) == 0 {
+			fmt.Println("No rule groups configured.")
+			return nil
+		}
+		for _, g := range groups {
+			state := "⏸️ disabled"
+			if g.Enabled {
+				state = "✅ enabled"
+			}
+			fmt.Printf("%-24s %-12s %d rules\n", g.Name, state, g.Rules)
+		}
+		return nil
+	}
+	if len(parts) != 3 || (parts[1] != "enable" && parts[1] != "disable") {
+		return fmt.Errorf("usage: rules | rules enable <group> | rules disable <group>")
+	}
+	if err := core.SetRuleGroup(parts[2], parts[1] == "enable"); err != nil {
+		return err
+	}
+	fmt.Printf("✅ Rule group %s %sd\n", parts[2], parts[1])
+	return nil
+}
+
+func handleCheckpoint(parts []string) error {
+	if len(parts) > 2 {
+		return fmt.Errorf("usage: checkpoint [duration]")
+	}
+	timeout := config.GetConfig().Rollback
+	if len(parts) == 2 {
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration: %s", parts[1])
+		}
+		timeout = d
+	}
+	deadline, err := core.Checkpoint(timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("⏳ Changes roll back at %s unless you run confirm\n", deadline.Format(time.TimeOnly))
+	return nil
+}
+
+func handleConfirm() error {
+	if err := core.Confirm(); err != nil {
+		return err
+	}
+	fmt.Println("✅ Changes confirmed")
+	return nil
+}
+
+func handleRollback() error {
+	if err := core.Rollback(); err != nil {
+		return err
+	}
+	fmt.Println("⏪ Changes rolled back")
+	return nil
+}
+
+func handleHistory(parts []string) error {
+	var f history.Filter
+	args := parts[1:]
+	if len(args) >= 2 && args[0] == "client" {
+		f.Client, args = args[1], args[2:]
+	} else if len(args) > 0 {
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			f.Domain, args = args[0], args[1:]
+		}
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("usage: history [domain] [count] | history client <name> [count]")
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count: %s", args[0])
+		}
+		f.Limit = n
+	}
+
+	entries, err := core.History(f)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No queries recorded.")
+		return nil
+	}
+	for _, e := range entries {
+		egress := "DIRECT"
+		if e.Route {
+			egress = "VPN"
+			if e.Action != "" {
+				egress = e.Action
+			}
+		}
+		answer := e.IP
+		if e.Err != "" {
+			egress, answer = "ERROR", e.Err
+		}
+		fmt.Printf("%s  %-8s %s ➜ %s (%s, %s)\n", e.Time.Format("01-02 15:04:05"), egress, e.Domain, answer, e.Client, e.Duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func handleQueryLog(parts []string) error {
+	if len(parts) >= 3 && parts[1] == "export" {
+		if len(parts) > 4 {
+			return fmt.Errorf("usage: querylog export <path> [domain]")
+		}
+		f := querylog.Filter{Limit: -1}
+		if len(parts) == 4 {
+			f.Domain = parts[3]
+		}
+		n, err := core.ExportQueryLog(parts[2], f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("📤 Exported %d queries to %s\n", n, parts[2])
+		return nil
+	}
+
+	var f querylog.Filter
+	args := parts[1:]
+	if len(args) > 0 {
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			f.Domain, args = args[0], args[1:]
+		}
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("usage: querylog [domain] [count] | querylog export <path> [domain]")
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count: %s", args[0])
+		}
+		f.Limit = n
+	}
+
+	entries, err := core.QueryLog(f)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No queries logged.")
+		return nil
+	}
+	for _, e := range entries {
+		egress := e.Policy
+		if e.Route && e.Action != "" {
+			egress = e.Action
+		}
+		answer := strings.Join(e.Answers, ", ")
+		if e.Err != "" {
+			egress, answer = "ERROR", e.Err
+		}
+		rule := cmp.Or(e.Rule, "-")
+		from := cmp.Or(e.Upstream, e.Source)
+		fmt.Printf("%s  %-8s %-4s %s ➜ %s (rule %s, %s, %s, %s)\n", e.Time.Format("01-02 15:04:05"), egress, e.QType, e.Domain, answer, rule, from, e.Client, e.Latency.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func handleAnalytics(parts []string) error {
+	if len(parts) > 2 {
+		return fmt.Errorf("usage: analytics [window]")
+	}
+	window := 24 * time.Hour
+	if len(parts) == 2 {
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid window: %s", parts[1])
+		}
+		window = d
+	}
+	report, err := core.Analytics(window)
+	if err != nil {
+		return err
+	}
+	if report.Queries == 0 {
+		fmt.Println("No queries recorded.")
+		return nil
+	}
+
+	fmt.Printf("📊 Last %s: %d queries for %d domains, %d failed\n", window, report.Queries, report.Domains, report.Failed)
+	fmt.Printf("   Matched by rules: %d (%.1f%% of resolved), routed: %d, unmatched: %d\n",
+		report.Matched, report.Coverage()*100, report.Routed, report.Unmatched)
+	fmt.Println("\nTop domains:")
+	for _, st := range report.Top {
+		fmt.Printf("  %6d  %-40s matched %d\n", st.Queries, st.Domain, st.Matched)
+	}
+	if len(report.TopUnmatched) > 0 {
+		fmt.Println("\nTop unmatched domains:")
+		for _, st := range report.TopUnmatched {
+			fmt.Printf("  %6d  %-40s failed %d\n", st.Queries-st.Matched, st.Domain, st.Failed)
+		}
+	}
+	if len(report.Suggestions) > 0 {
+		fmt.Println("\nSuggested rules:")
+		for _, sg := range report.Suggestions {
+			fmt.Printf("  %-40s %d queries, %d names: %s\n", sg.Rule, sg.Queries, sg.Domains, sg.Reason)
+		}
+	}
+	return nil
+}
+
+func handleKill(parts []string) error {
+	if len(parts) != 2 {
+		return fmt.Errorf("usage: kill <domain/ip>")
+	}
+	ips, err := core.Kill(parts[1])
+	if len(ips) > 0 {
+		fmt.Printf("🔪 Killed connections to %s\n", strings.Join(ips, ", "))
+	}
+	return err
+}
+
+func handleLeakTest() error {
+	fmt.Println("⏳ Asking external services what they see...")
+	results, leaks, err := core.LeakTest()
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		fmt.Printf("%s via %s:\n", r.Policy, cmp.Or(r.Iface, "default route"))
+		if r.ResolverErr != nil {
+			fmt.Printf("   resolver: ❌ %v (upstream %s)\n", r.ResolverErr, r.Upstream)
+		} else {
+			fmt.Printf("   resolver: %s (upstream %s)\n", r.Resolver, r.Upstream)
+		}
+		if r.ExitErr != nil {
+			fmt.Printf("   exit: ❌ %v\n", r.ExitErr)
+		} else {
+			fmt.Printf("   exit: %s\n", r.Exit)
+		}
+	}
+	for _, leak := range leaks {
+		fmt.Printf("🚨 Leak: %s\n", leak)
+	}
+	if len(leaks) == 0 {
+		fmt.Println("✅ No leaks found")
+	}
+	return nil
+}
+
+func handleCache(parts []string) error {
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "flush" {
+		return fmt.Errorf("usage: cache flush [pattern]")
+	}
+	pattern := ""
+	if len(parts) == 3 {
+		pattern = parts[2]
+	}
+	n, ips, err := core.FlushCache(pattern)
+	fmt.Printf("🧹 Flushed %d cache entries\n", n)
+	if len(ips) > 0 {
+		fmt.Printf("   Routes withdrawn: %s\n", strings.Join(ips, ", "))
+	}
+	return err
+}
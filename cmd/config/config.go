@@ -2,45 +2,593 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"openvpnadvanced/audit"
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/leaktest"
+	"openvpnadvanced/logging"
+	"openvpnadvanced/querylog"
+
 	"gopkg.in/ini.v1"
 )
 
 type AppConfig struct {
 	AutoSubscribe bool
 	UpdatePeriod  time.Duration
-	CheckOpenVPN  bool
-	LogLevel      string
+	// UpdateSchedule and GeoSchedule are cron schedules replacing
+	// UpdatePeriod and GeoRefresh when set
+	UpdateSchedule    string
+	GeoSchedule       string
+	UpdateJitter      time.Duration
+	UpdateSkipMetered bool
+	MeteredIfaces     []string
+	CheckOpenVPN      bool
+	LogLevel          string
+	LogFormat         string
+	LogModules        []string
+	HelperSocket      string
+	CacheBackend      string
+	RedisAddr         string
+	RedisPassword     string
+	RedisDB           int
+	BoltPath          string
+	WALPath           string
+	WALSync           bool
+	Workers           int
+	QueueSize         int
+	UDPReaders        int
+	UDPWorkers        int
+	UDPQueue          int
+	UDPReadBuffer     int
+	UDPWriteBuffer    int
+	MaxUpstream       int
+	MaxRouteOps       int
+	MaxConns          int
+	CompileRules      bool
+	RuleDB            string
+	RuleGroups        []RuleGroup
+	Presets           []Preset
+	GroupState        string
+	HookScript        string
+	HookWorkers       int
+	HookQueue         int
+	HookTimeout       time.Duration
+	GRPCListen        string
+	AdminListen       string
+	AdminToken        string
+	DNSListen         string
+	StateFile         string
+	ReplayRecord      string
+	GeoIPURL          string
+	GeoIPPath         string
+	GeoSiteURL        string
+	GeoSitePath       string
+	GeoRefresh        time.Duration
+	GeoIPReload       time.Duration
+	CacheFile         string
+	CacheSave         time.Duration
+	CacheMinTTL       time.Duration
+	CacheMaxTTL       time.Duration
+	CacheStale        time.Duration
+	NegativeTTL       time.Duration
+	ServFailTTL       time.Duration
+	AnswerOrder       string
+	QueryTimeout      time.Duration
+	AddrFamily        string
+	DDR               bool
+	DDRResolver       string
+	NAT64             string
+	FakeIP            bool
+	FakeIPRange       string
+	FakeIPTTL         time.Duration
+	Upstreams         []string
+	UpstreamRace      bool
+	Relays            []string
+	Bootstrap         []string
+	FilterAAAA        bool
+	FilterDomains     []string
+	HTTPSRecords      bool
+	ECH               string
+	ECHStrip          []string
+	ECHPass           []string
+	Captive           bool
+	CaptiveURL        string
+	CaptiveEvery      time.Duration
+	Offline           bool
+	OfflineEvery      time.Duration
+	Rollback          time.Duration
+	Coexist           string
+	CoexistListen     string
+	SafeSearch        bool
+	SafeYouTube       string
+	Profiles          []Profile
+	Clients           []Client
+	ClientRate        float64
+	CNAMEMatch        string
+	CNAMEDepth        int
+	CNAMEPartial      bool
+	VerifyURL         string
+	VerifyDomains     []string
+	VerifyPolicy      string
+	WarmUp            []string
+	WarmUpTop         int
+	QoSDSCP           string
+	QoSFWMark         string
+	QoS               []QoSClass
+	ProbeTargets      []string
+	ProbeEvery        time.Duration
+	ProbeFallback     bool
+	AuditLog          string
+	HistoryDB         string
+	HistoryMaxAge     time.Duration
+	HistoryRows       int
+	QueryLog          bool
+	QueryLogSize      int
+	QueryLogFile      string
+	QueryLogMaxMB     int
+	QueryLogKeep      int
+	Telemetry         bool
+	TelemetryURL      string
+	VPNDown           string
+	VPNDownDirect     []string
+	VPNDownBlock      []string
+	ReconnectFlush    bool
+	Reject            string
+	SyncListen        string
+	SyncPeers         []string
+	SyncSecret        string
+	SyncID            string
+	HotReload         bool
+	DoHUserAgent      string
+	DoHHeaders        []string
+	MetricsListen     string
+	LeakTestName      string
+	LeakTestURL       string
+}
+
+// Profile is a [profile NAME] section: safe-search settings for a group of
+// clients, overriding the global ones
+type Profile struct {
+	Name       string
+	Clients    []string
+	SafeSearch bool
+	YouTube    string
+}
+
+// Client is a [client NAME] section: how a LAN client is recognized, and
+// the profile and rate limit applied to it
+type Client struct {
+	Name      string
+	Addresses []string
+	MACs      []string
+	IDs       []string
+	Profile   string
+	RateLimit float64
+}
+
+// QoSClass is a [qos NAME] section: the DSCP and fwmark set on traffic to
+// the addresses of its domains
+type QoSClass struct {
+	Name    string
+	Domains []string
+	DSCP    string
+	FWMark  string
 }
 
-var appConfig AppConfig
+// RuleGroup is a [group NAME] section: rule lists that can be switched on
+// and off at runtime with the rules command
+type RuleGroup struct {
+	Name    string
+	Rules   []string
+	Enabled bool
+}
+
+// Preset is a [preset NAME] section: a custom upstream provider usable by
+// name in upstream, replacing a built-in preset of the same name
+type Preset struct {
+	Name         string
+	Region       string
+	Upstreams    []string
+	Bootstrap    []string
+	Capabilities []string
+}
+
+// profilePrefix starts the names of profile sections
+const profilePrefix = "profile "
+
+// clientPrefix starts the names of client sections
+const clientPrefix = "client "
+
+// qosPrefix starts the names of QoS class sections
+const qosPrefix = "qos "
+
+// groupPrefix starts the names of rule group sections
+const groupPrefix = "group "
+
+// presetPrefix starts the names of upstream preset sections
+const presetPrefix = "preset "
 
+var (
+	configMu  sync.RWMutex
+	appConfig AppConfig
+)
+
+// LoadINIConfig reads an INI configuration, see Load
 func LoadINIConfig(path string) error {
 	cfg, err := ini.Load(path)
 	if err != nil {
 		return err
 	}
-	appConfig.AutoSubscribe = cfg.Section("").Key("auto-subscribe").MustBool(false)
-	appConfig.UpdatePeriod = cfg.Section("").Key("update-period").MustDuration(30 * time.Minute)
-	appConfig.CheckOpenVPN = cfg.Section("").Key("check-openvpn").MustBool(true)
-	appConfig.LogLevel = cfg.Section("").Key("log-level").MustString("info")
+	return apply(path, cfg, false)
+}
+
+// apply validates cfg, read from path, and replaces the configuration
+// with it; structured names settings as in YAML and TOML files in errors
+func apply(path string, cfg *ini.File, structured bool) error {
+	if err := validate(path, cfg, structured); err != nil {
+		return err
+	}
+	// 先解析到副本，读取中的配置不会看到一半新一半旧的值
+	var c AppConfig
+	c.AutoSubscribe = cfg.Section("").Key("auto-subscribe").MustBool(false)
+	c.UpdatePeriod = cfg.Section("").Key("update-period").MustDuration(30 * time.Minute)
+	c.UpdateSchedule = cfg.Section("").Key("update-schedule").MustString("")
+	c.GeoSchedule = cfg.Section("").Key("geo-schedule").MustString("")
+	c.UpdateJitter = cfg.Section("").Key("update-jitter").MustDuration(0)
+	c.UpdateSkipMetered = cfg.Section("").Key("update-skip-metered").MustBool(false)
+	c.MeteredIfaces = cfg.Section("").Key("metered-ifaces").Strings(",")
+	c.CheckOpenVPN = cfg.Section("").Key("check-openvpn").MustBool(true)
+	c.LogLevel = cfg.Section("").Key("log-level").MustString("info")
+	c.LogFormat = cfg.Section("").Key("log-format").MustString(logging.FormatPlain)
+	c.LogModules = cfg.Section("").Key("log-modules").Strings(",")
+	c.HelperSocket = cfg.Section("").Key("helper-socket").MustString("")
+	c.CacheBackend = cfg.Section("").Key("cache-backend").MustString("memory")
+	c.RedisAddr = cfg.Section("").Key("redis-addr").MustString("127.0.0.1:6379")
+	c.RedisPassword = cfg.Section("").Key("redis-password").MustString("")
+	c.RedisDB = cfg.Section("").Key("redis-db").MustInt(0)
+	c.BoltPath = cfg.Section("").Key("bolt-path").MustString("assets/cache.db")
+	c.WALPath = cfg.Section("").Key("wal-path").MustString("assets/cache.snap")
+	c.WALSync = cfg.Section("").Key("wal-sync").MustBool(false)
+	c.Workers = cfg.Section("").Key("resolve-workers").MustInt(64)
+	c.QueueSize = cfg.Section("").Key("resolve-queue").MustInt(1024)
+	c.UDPReaders = cfg.Section("").Key("udp-readers").MustInt(0)
+	c.UDPWorkers = cfg.Section("").Key("udp-workers").MustInt(256)
+	c.UDPQueue = cfg.Section("").Key("udp-queue").MustInt(1024)
+	c.UDPReadBuffer = cfg.Section("").Key("udp-read-buffer").MustInt(0)
+	c.UDPWriteBuffer = cfg.Section("").Key("udp-write-buffer").MustInt(0)
+	c.MaxUpstream = cfg.Section("").Key("max-upstream-queries").MustInt(256)
+	c.MaxRouteOps = cfg.Section("").Key("max-route-ops").MustInt(16)
+	c.MaxConns = cfg.Section("").Key("max-connections").MustInt(512)
+	c.CompileRules = cfg.Section("").Key("compile-rules").MustBool(false)
+	c.RuleDB = cfg.Section("").Key("rule-db").MustString("")
+	c.GroupState = cfg.Section("").Key("rule-groups-state").MustString("assets/rule_groups.json")
+	c.HookScript = cfg.Section("").Key("hook-script").MustString("")
+	c.HookWorkers = cfg.Section("").Key("hook-workers").MustInt(hooks.DefaultScriptWorkers)
+	c.HookQueue = cfg.Section("").Key("hook-queue").MustInt(hooks.DefaultScriptQueue)
+	c.HookTimeout = cfg.Section("").Key("hook-timeout").MustDuration(hooks.DefaultScriptTimeout)
+	c.DNSListen = cfg.Section("").Key("dns-listen").MustString(":53")
+	c.GRPCListen = cfg.Section("").Key("grpc-listen").MustString("")
+	c.AdminListen = cfg.Section("").Key("admin-listen").MustString("")
+	c.AdminToken = cfg.Section("").Key("admin-token").MustString("")
+	c.StateFile = cfg.Section("").Key("state-file").MustString("")
+	c.ReplayRecord = cfg.Section("").Key("replay-record").MustString("")
+	c.GeoIPURL = cfg.Section("").Key("geoip-url").MustString("")
+	c.GeoIPPath = cfg.Section("").Key("geoip-path").MustString("assets/geoip.mmdb")
+	c.GeoSiteURL = cfg.Section("").Key("geosite-url").MustString("")
+	c.GeoSitePath = cfg.Section("").Key("geosite-path").MustString("assets/geosite.dat")
+	c.GeoRefresh = cfg.Section("").Key("geo-refresh").MustDuration(24 * time.Hour)
+	c.GeoIPReload = cfg.Section("").Key("geoip-reload").MustDuration(time.Hour)
+	c.CacheFile = cfg.Section("").Key("cache-file").MustString("assets/cache.json")
+	c.CacheSave = cfg.Section("").Key("cache-save-interval").MustDuration(30 * time.Second)
+	c.CacheMinTTL = cfg.Section("").Key("cache-min-ttl").MustDuration(0)
+	c.CacheMaxTTL = cfg.Section("").Key("cache-max-ttl").MustDuration(24 * time.Hour)
+	c.CacheStale = cfg.Section("").Key("cache-stale").MustDuration(0)
+	c.NegativeTTL = cfg.Section("").Key("negative-cache-ttl").MustDuration(30 * time.Second)
+	c.ServFailTTL = cfg.Section("").Key("servfail-cache-ttl").MustDuration(5 * time.Second)
+	c.QueryTimeout = cfg.Section("").Key("query-timeout").MustDuration(2 * time.Second)
+	c.AddrFamily = cfg.Section("").Key("address-preference").MustString("prefer-ipv4")
+	c.AnswerOrder = cfg.Section("").Key("answer-order").MustString("upstream")
+	c.DDR = cfg.Section("").Key("ddr").MustBool(false)
+	c.DDRResolver = cfg.Section("").Key("ddr-resolver").MustString("")
+	c.NAT64 = cfg.Section("").Key("nat64").MustString("auto")
+	c.FakeIP = cfg.Section("").Key("fake-ip").MustBool(false)
+	c.FakeIPRange = cfg.Section("").Key("fake-ip-range").MustString(fakeip.DefaultRange)
+	c.FakeIPTTL = cfg.Section("").Key("fake-ip-ttl").MustDuration(fakeip.DefaultTTL)
+	c.Upstreams = cfg.Section("").Key("upstream").Strings(",")
+	c.UpstreamRace = cfg.Section("").Key("upstream-race").MustBool(false)
+	c.Relays = cfg.Section("").Key("upstream-relays").Strings(",")
+	c.Bootstrap = cfg.Section("").Key("upstream-bootstrap").Strings(",")
+	c.FilterAAAA = cfg.Section("").Key("filter-aaaa").MustBool(true)
+	c.FilterDomains = cfg.Section("").Key("filter-aaaa-domains").Strings(",")
+	c.HTTPSRecords = cfg.Section("").Key("https-records").MustBool(false)
+	c.ECH = cfg.Section("").Key("ech").MustString("strip-matched")
+	c.ECHStrip = cfg.Section("").Key("ech-strip-domains").Strings(",")
+	c.ECHPass = cfg.Section("").Key("ech-pass-domains").Strings(",")
+	c.Captive = cfg.Section("").Key("captive-detect").MustBool(false)
+	c.CaptiveURL = cfg.Section("").Key("captive-url").MustString("")
+	c.CaptiveEvery = cfg.Section("").Key("captive-interval").MustDuration(time.Minute)
+	c.Offline = cfg.Section("").Key("offline-detect").MustBool(true)
+	c.OfflineEvery = cfg.Section("").Key("offline-interval").MustDuration(30 * time.Second)
+	c.Rollback = cfg.Section("").Key("rollback-timeout").MustDuration(time.Minute)
+	c.Coexist = cfg.Section("").Key("coexist").MustString("off")
+	c.CoexistListen = cfg.Section("").Key("coexist-listen").MustString("127.0.0.1:5353")
+	c.SafeSearch = cfg.Section("").Key("safe-search").MustBool(false)
+	c.SafeYouTube = cfg.Section("").Key("safe-search-youtube").MustString("off")
+	c.Telemetry = cfg.Section("").Key("telemetry").MustBool(false)
+	c.TelemetryURL = cfg.Section("").Key("telemetry-url").MustString("")
+	c.VPNDown = cfg.Section("").Key("vpn-down").MustString("block")
+	c.VPNDownDirect = cfg.Section("").Key("vpn-down-direct-domains").Strings(",")
+	c.VPNDownBlock = cfg.Section("").Key("vpn-down-block-domains").Strings(",")
+	c.ReconnectFlush = cfg.Section("").Key("vpn-reconnect-flush").MustBool(false)
+	c.Reject = cfg.Section("").Key("reject").MustString("zero")
+	c.ClientRate = cfg.Section("").Key("client-rate-limit").MustFloat64(0)
+	c.CNAMEMatch = cfg.Section("").Key("cname-match").MustString("query-first")
+	c.CNAMEDepth = cfg.Section("").Key("cname-max-depth").MustInt(10)
+	c.CNAMEPartial = cfg.Section("").Key("cname-partial-chain").MustBool(false)
+	c.VerifyURL = cfg.Section("").Key("verify-upstream").MustString("")
+	c.VerifyDomains = cfg.Section("").Key("verify-domains").Strings(",")
+	c.VerifyPolicy = cfg.Section("").Key("verify-policy").MustString("fallback")
+	c.WarmUp = cfg.Section("").Key("warm-up-domains").Strings(",")
+	c.WarmUpTop = cfg.Section("").Key("warm-up-top").MustInt(0)
+	c.QoSDSCP = cfg.Section("").Key("qos-upstream-dscp").MustString("")
+	c.QoSFWMark = cfg.Section("").Key("qos-upstream-fwmark").MustString("")
+	c.ProbeTargets = cfg.Section("").Key("probe-targets").Strings(",")
+	c.ProbeEvery = cfg.Section("").Key("probe-interval").MustDuration(30 * time.Second)
+	c.ProbeFallback = cfg.Section("").Key("probe-fallback").MustBool(false)
+	c.AuditLog = cfg.Section("").Key("audit-log").MustString("logs/audit.log")
+	c.HistoryDB = cfg.Section("").Key("history-db").MustString("")
+	c.HistoryMaxAge = cfg.Section("").Key("history-max-age").MustDuration(7 * 24 * time.Hour)
+	c.HistoryRows = cfg.Section("").Key("history-max-rows").MustInt(1000000)
+	c.QueryLog = cfg.Section("").Key("query-log").MustBool(false)
+	c.QueryLogSize = cfg.Section("").Key("query-log-size").MustInt(querylog.DefaultSize)
+	c.QueryLogFile = cfg.Section("").Key("query-log-file").MustString("")
+	c.QueryLogMaxMB = cfg.Section("").Key("query-log-max-mb").MustInt(10)
+	c.QueryLogKeep = cfg.Section("").Key("query-log-backups").MustInt(3)
+	c.SyncListen = cfg.Section("").Key("sync-listen").MustString("")
+	c.SyncPeers = cfg.Section("").Key("sync-peers").Strings(",")
+	c.SyncSecret = cfg.Section("").Key("sync-secret").MustString("")
+	c.SyncID = cfg.Section("").Key("sync-id").MustString("")
+	c.HotReload = cfg.Section("").Key("hot-reload").MustBool(false)
+	c.DoHUserAgent = cfg.Section("").Key("doh-user-agent").MustString("none")
+	c.DoHHeaders = cfg.Section("").Key("doh-headers").Strings(",")
+	c.MetricsListen = cfg.Section("").Key("metrics-listen").MustString("")
+	c.LeakTestName = cfg.Section("").Key("leaktest-domain").MustString(leaktest.DefaultResolverName)
+	c.LeakTestURL = cfg.Section("").Key("leaktest-url").MustString(leaktest.DefaultExitURL)
+	for _, sec := range cfg.Sections() {
+		if name, ok := strings.CutPrefix(sec.Name(), presetPrefix); ok {
+			c.Presets = append(c.Presets, Preset{
+				Name:         strings.TrimSpace(name),
+				Region:       sec.Key("region").MustString(""),
+				Upstreams:    sec.Key("upstream").Strings(","),
+				Bootstrap:    sec.Key("bootstrap").Strings(","),
+				Capabilities: sec.Key("capabilities").Strings(","),
+			})
+			continue
+		}
+		if name, ok := strings.CutPrefix(sec.Name(), groupPrefix); ok {
+			c.RuleGroups = append(c.RuleGroups, RuleGroup{
+				Name:    strings.TrimSpace(name),
+				Rules:   sec.Key("rules").Strings(","),
+				Enabled: sec.Key("enabled").MustBool(true),
+			})
+			continue
+		}
+		if name, ok := strings.CutPrefix(sec.Name(), qosPrefix); ok {
+			c.QoS = append(c.QoS, QoSClass{
+				Name:    strings.TrimSpace(name),
+				Domains: sec.Key("domains").Strings(","),
+				DSCP:    sec.Key("dscp").MustString(""),
+				FWMark:  sec.Key("fwmark").MustString(""),
+			})
+			continue
+		}
+		if name, ok := strings.CutPrefix(sec.Name(), clientPrefix); ok {
+			c.Clients = append(c.Clients, Client{
+				Name:      strings.TrimSpace(name),
+				Addresses: sec.Key("addresses").Strings(","),
+				MACs:      sec.Key("macs").Strings(","),
+				IDs:       sec.Key("client-ids").Strings(","),
+				Profile:   sec.Key("profile").MustString(""),
+				RateLimit: sec.Key("rate-limit").MustFloat64(0),
+			})
+			continue
+		}
+		name, ok := strings.CutPrefix(sec.Name(), profilePrefix)
+		if !ok {
+			continue
+		}
+		c.Profiles = append(c.Profiles, Profile{
+			Name:       strings.TrimSpace(name),
+			Clients:    sec.Key("clients").Strings(","),
+			SafeSearch: sec.Key("safe-search").MustBool(false),
+			YouTube:    sec.Key("youtube").MustString("off"),
+		})
+	}
+	SetConfig(c)
 	return nil
 }
 
+// SaveINIConfig writes the configuration to path as INI, see Save
 func SaveINIConfig(path string) error {
+	err := toINI(GetConfig()).SaveTo(path)
+	audit.Record(audit.FileWrite, path, "config", err)
+	return err
+}
+
+// toINI returns appConfig in the layout of an INI file
+func toINI(appConfig AppConfig) *ini.File {
 	cfg := ini.Empty()
 	cfg.Section("").Key("auto-subscribe").SetValue(fmt.Sprintf("%v", appConfig.AutoSubscribe))
 	cfg.Section("").Key("update-period").SetValue(appConfig.UpdatePeriod.String())
+	cfg.Section("").Key("update-schedule").SetValue(appConfig.UpdateSchedule)
+	cfg.Section("").Key("geo-schedule").SetValue(appConfig.GeoSchedule)
+	cfg.Section("").Key("update-jitter").SetValue(appConfig.UpdateJitter.String())
+	cfg.Section("").Key("update-skip-metered").SetValue(fmt.Sprintf("%v", appConfig.UpdateSkipMetered))
+	cfg.Section("").Key("metered-ifaces").SetValue(strings.Join(appConfig.MeteredIfaces, ","))
 	cfg.Section("").Key("check-openvpn").SetValue(fmt.Sprintf("%v", appConfig.CheckOpenVPN))
 	cfg.Section("").Key("log-level").SetValue(appConfig.LogLevel)
-	return cfg.SaveTo(path)
+	cfg.Section("").Key("log-format").SetValue(appConfig.LogFormat)
+	cfg.Section("").Key("log-modules").SetValue(strings.Join(appConfig.LogModules, ","))
+	cfg.Section("").Key("helper-socket").SetValue(appConfig.HelperSocket)
+	cfg.Section("").Key("cache-backend").SetValue(appConfig.CacheBackend)
+	cfg.Section("").Key("redis-addr").SetValue(appConfig.RedisAddr)
+	cfg.Section("").Key("redis-password").SetValue(appConfig.RedisPassword)
+	cfg.Section("").Key("redis-db").SetValue(fmt.Sprintf("%d", appConfig.RedisDB))
+	cfg.Section("").Key("bolt-path").SetValue(appConfig.BoltPath)
+	cfg.Section("").Key("wal-path").SetValue(appConfig.WALPath)
+	cfg.Section("").Key("wal-sync").SetValue(fmt.Sprintf("%v", appConfig.WALSync))
+	cfg.Section("").Key("resolve-workers").SetValue(fmt.Sprintf("%d", appConfig.Workers))
+	cfg.Section("").Key("resolve-queue").SetValue(fmt.Sprintf("%d", appConfig.QueueSize))
+	cfg.Section("").Key("udp-readers").SetValue(fmt.Sprintf("%d", appConfig.UDPReaders))
+	cfg.Section("").Key("udp-workers").SetValue(fmt.Sprintf("%d", appConfig.UDPWorkers))
+	cfg.Section("").Key("udp-queue").SetValue(fmt.Sprintf("%d", appConfig.UDPQueue))
+	cfg.Section("").Key("udp-read-buffer").SetValue(fmt.Sprintf("%d", appConfig.UDPReadBuffer))
+	cfg.Section("").Key("udp-write-buffer").SetValue(fmt.Sprintf("%d", appConfig.UDPWriteBuffer))
+	cfg.Section("").Key("max-upstream-queries").SetValue(fmt.Sprintf("%d", appConfig.MaxUpstream))
+	cfg.Section("").Key("max-route-ops").SetValue(fmt.Sprintf("%d", appConfig.MaxRouteOps))
+	cfg.Section("").Key("max-connections").SetValue(fmt.Sprintf("%d", appConfig.MaxConns))
+	cfg.Section("").Key("compile-rules").SetValue(fmt.Sprintf("%v", appConfig.CompileRules))
+	cfg.Section("").Key("rule-db").SetValue(appConfig.RuleDB)
+	cfg.Section("").Key("rule-groups-state").SetValue(appConfig.GroupState)
+	cfg.Section("").Key("hook-script").SetValue(appConfig.HookScript)
+	cfg.Section("").Key("hook-workers").SetValue(fmt.Sprintf("%d", appConfig.HookWorkers))
+	cfg.Section("").Key("hook-queue").SetValue(fmt.Sprintf("%d", appConfig.HookQueue))
+	cfg.Section("").Key("hook-timeout").SetValue(appConfig.HookTimeout.String())
+	cfg.Section("").Key("dns-listen").SetValue(appConfig.DNSListen)
+	cfg.Section("").Key("grpc-listen").SetValue(appConfig.GRPCListen)
+	cfg.Section("").Key("admin-listen").SetValue(appConfig.AdminListen)
+	cfg.Section("").Key("admin-token").SetValue(appConfig.AdminToken)
+	cfg.Section("").Key("state-file").SetValue(appConfig.StateFile)
+	cfg.Section("").Key("replay-record").SetValue(appConfig.ReplayRecord)
+	cfg.Section("").Key("geoip-url").SetValue(appConfig.GeoIPURL)
+	cfg.Section("").Key("geoip-path").SetValue(appConfig.GeoIPPath)
+	cfg.Section("").Key("geosite-url").SetValue(appConfig.GeoSiteURL)
+	cfg.Section("").Key("geosite-path").SetValue(appConfig.GeoSitePath)
+	cfg.Section("").Key("geo-refresh").SetValue(appConfig.GeoRefresh.String())
+	cfg.Section("").Key("geoip-reload").SetValue(appConfig.GeoIPReload.String())
+	cfg.Section("").Key("cache-file").SetValue(appConfig.CacheFile)
+	cfg.Section("").Key("cache-save-interval").SetValue(appConfig.CacheSave.String())
+	cfg.Section("").Key("cache-min-ttl").SetValue(appConfig.CacheMinTTL.String())
+	cfg.Section("").Key("cache-max-ttl").SetValue(appConfig.CacheMaxTTL.String())
+	cfg.Section("").Key("cache-stale").SetValue(appConfig.CacheStale.String())
+	cfg.Section("").Key("negative-cache-ttl").SetValue(appConfig.NegativeTTL.String())
+	cfg.Section("").Key("servfail-cache-ttl").SetValue(appConfig.ServFailTTL.String())
+	cfg.Section("").Key("query-timeout").SetValue(appConfig.QueryTimeout.String())
+	cfg.Section("").Key("address-preference").SetValue(appConfig.AddrFamily)
+	cfg.Section("").Key("answer-order").SetValue(appConfig.AnswerOrder)
+	cfg.Section("").Key("ddr").SetValue(fmt.Sprintf("%v", appConfig.DDR))
+	cfg.Section("").Key("ddr-resolver").SetValue(appConfig.DDRResolver)
+	cfg.Section("").Key("nat64").SetValue(appConfig.NAT64)
+	cfg.Section("").Key("fake-ip").SetValue(fmt.Sprintf("%v", appConfig.FakeIP))
+	cfg.Section("").Key("fake-ip-range").SetValue(appConfig.FakeIPRange)
+	cfg.Section("").Key("fake-ip-ttl").SetValue(appConfig.FakeIPTTL.String())
+	cfg.Section("").Key("upstream").SetValue(strings.Join(appConfig.Upstreams, ","))
+	cfg.Section("").Key("upstream-race").SetValue(fmt.Sprintf("%v", appConfig.UpstreamRace))
+	cfg.Section("").Key("upstream-relays").SetValue(strings.Join(appConfig.Relays, ","))
+	cfg.Section("").Key("upstream-bootstrap").SetValue(strings.Join(appConfig.Bootstrap, ","))
+	cfg.Section("").Key("filter-aaaa").SetValue(fmt.Sprintf("%v", appConfig.FilterAAAA))
+	cfg.Section("").Key("filter-aaaa-domains").SetValue(strings.Join(appConfig.FilterDomains, ","))
+	cfg.Section("").Key("https-records").SetValue(fmt.Sprintf("%v", appConfig.HTTPSRecords))
+	cfg.Section("").Key("ech").SetValue(appConfig.ECH)
+	cfg.Section("").Key("ech-strip-domains").SetValue(strings.Join(appConfig.ECHStrip, ","))
+	cfg.Section("").Key("ech-pass-domains").SetValue(strings.Join(appConfig.ECHPass, ","))
+	cfg.Section("").Key("captive-detect").SetValue(fmt.Sprintf("%v", appConfig.Captive))
+	cfg.Section("").Key("captive-url").SetValue(appConfig.CaptiveURL)
+	cfg.Section("").Key("captive-interval").SetValue(appConfig.CaptiveEvery.String())
+	cfg.Section("").Key("offline-detect").SetValue(fmt.Sprintf("%v", appConfig.Offline))
+	cfg.Section("").Key("offline-interval").SetValue(appConfig.OfflineEvery.String())
+	cfg.Section("").Key("rollback-timeout").SetValue(appConfig.Rollback.String())
+	cfg.Section("").Key("coexist").SetValue(appConfig.Coexist)
+	cfg.Section("").Key("coexist-listen").SetValue(appConfig.CoexistListen)
+	cfg.Section("").Key("safe-search").SetValue(fmt.Sprintf("%v", appConfig.SafeSearch))
+	cfg.Section("").Key("safe-search-youtube").SetValue(appConfig.SafeYouTube)
+	cfg.Section("").Key("telemetry").SetValue(fmt.Sprintf("%v", appConfig.Telemetry))
+	cfg.Section("").Key("telemetry-url").SetValue(appConfig.TelemetryURL)
+	cfg.Section("").Key("vpn-down").SetValue(appConfig.VPNDown)
+	cfg.Section("").Key("vpn-down-direct-domains").SetValue(strings.Join(appConfig.VPNDownDirect, ","))
+	cfg.Section("").Key("vpn-down-block-domains").SetValue(strings.Join(appConfig.VPNDownBlock, ","))
+	cfg.Section("").Key("vpn-reconnect-flush").SetValue(fmt.Sprintf("%v", appConfig.ReconnectFlush))
+	cfg.Section("").Key("reject").SetValue(appConfig.Reject)
+	cfg.Section("").Key("client-rate-limit").SetValue(fmt.Sprintf("%v", appConfig.ClientRate))
+	cfg.Section("").Key("cname-match").SetValue(appConfig.CNAMEMatch)
+	cfg.Section("").Key("cname-max-depth").SetValue(fmt.Sprintf("%d", appConfig.CNAMEDepth))
+	cfg.Section("").Key("cname-partial-chain").SetValue(fmt.Sprintf("%v", appConfig.CNAMEPartial))
+	cfg.Section("").Key("verify-upstream").SetValue(appConfig.VerifyURL)
+	cfg.Section("").Key("verify-domains").SetValue(strings.Join(appConfig.VerifyDomains, ","))
+	cfg.Section("").Key("verify-policy").SetValue(appConfig.VerifyPolicy)
+	cfg.Section("").Key("warm-up-domains").SetValue(strings.Join(appConfig.WarmUp, ","))
+	cfg.Section("").Key("warm-up-top").SetValue(fmt.Sprintf("%d", appConfig.WarmUpTop))
+	cfg.Section("").Key("qos-upstream-dscp").SetValue(appConfig.QoSDSCP)
+	cfg.Section("").Key("qos-upstream-fwmark").SetValue(appConfig.QoSFWMark)
+	cfg.Section("").Key("probe-targets").SetValue(strings.Join(appConfig.ProbeTargets, ","))
+	cfg.Section("").Key("probe-interval").SetValue(appConfig.ProbeEvery.String())
+	cfg.Section("").Key("probe-fallback").SetValue(fmt.Sprintf("%v", appConfig.ProbeFallback))
+	cfg.Section("").Key("audit-log").SetValue(appConfig.AuditLog)
+	cfg.Section("").Key("history-db").SetValue(appConfig.HistoryDB)
+	cfg.Section("").Key("history-max-age").SetValue(appConfig.HistoryMaxAge.String())
+	cfg.Section("").Key("history-max-rows").SetValue(fmt.Sprintf("%d", appConfig.HistoryRows))
+	cfg.Section("").Key("query-log").SetValue(fmt.Sprintf("%v", appConfig.QueryLog))
+	cfg.Section("").Key("query-log-size").SetValue(fmt.Sprintf("%d", appConfig.QueryLogSize))
+	cfg.Section("").Key("query-log-file").SetValue(appConfig.QueryLogFile)
+	cfg.Section("").Key("query-log-max-mb").SetValue(fmt.Sprintf("%d", appConfig.QueryLogMaxMB))
+	cfg.Section("").Key("query-log-backups").SetValue(fmt.Sprintf("%d", appConfig.QueryLogKeep))
+	cfg.Section("").Key("sync-listen").SetValue(appConfig.SyncListen)
+	cfg.Section("").Key("sync-peers").SetValue(strings.Join(appConfig.SyncPeers, ","))
+	cfg.Section("").Key("sync-secret").SetValue(appConfig.SyncSecret)
+	cfg.Section("").Key("sync-id").SetValue(appConfig.SyncID)
+	cfg.Section("").Key("hot-reload").SetValue(fmt.Sprintf("%v", appConfig.HotReload))
+	cfg.Section("").Key("doh-user-agent").SetValue(appConfig.DoHUserAgent)
+	cfg.Section("").Key("doh-headers").SetValue(strings.Join(appConfig.DoHHeaders, ","))
+	cfg.Section("").Key("metrics-listen").SetValue(appConfig.MetricsListen)
+	cfg.Section("").Key("leaktest-domain").SetValue(appConfig.LeakTestName)
+	cfg.Section("").Key("leaktest-url").SetValue(appConfig.LeakTestURL)
+	for _, p := range appConfig.Profiles {
+		sec := cfg.Section(profilePrefix + p.Name)
+		sec.Key("clients").SetValue(strings.Join(p.Clients, ","))
+		sec.Key("safe-search").SetValue(fmt.Sprintf("%v", p.SafeSearch))
+		sec.Key("youtube").SetValue(p.YouTube)
+	}
+	for _, c := range appConfig.Clients {
+		sec := cfg.Section(clientPrefix + c.Name)
+		sec.Key("addresses").SetValue(strings.Join(c.Addresses, ","))
+		sec.Key("macs").SetValue(strings.Join(c.MACs, ","))
+		sec.Key("client-ids").SetValue(strings.Join(c.IDs, ","))
+		sec.Key("profile").SetValue(c.Profile)
+		sec.Key("rate-limit").SetValue(fmt.Sprintf("%v", c.RateLimit))
+	}
+	for _, c := range appConfig.QoS {
+		sec := cfg.Section(qosPrefix + c.Name)
+		sec.Key("domains").SetValue(strings.Join(c.Domains, ","))
+		sec.Key("dscp").SetValue(c.DSCP)
+		sec.Key("fwmark").SetValue(c.FWMark)
+	}
+	for _, g := range appConfig.RuleGroups {
+		sec := cfg.Section(groupPrefix + g.Name)
+		sec.Key("rules").SetValue(strings.Join(g.Rules, ","))
+		sec.Key("enabled").SetValue(fmt.Sprintf("%v", g.Enabled))
+	}
+	for _, p := range appConfig.Presets {
+		sec := cfg.Section(presetPrefix + p.Name)
+		sec.Key("region").SetValue(p.Region)
+		sec.Key("upstream").SetValue(strings.Join(p.Upstreams, ","))
+		sec.Key("bootstrap").SetValue(strings.Join(p.Bootstrap, ","))
+		sec.Key("capabilities").SetValue(strings.Join(p.Capabilities, ","))
+	}
+	return cfg
 }
 
 func GetConfig() AppConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	return appConfig
 }
 
 func SetConfig(cfg AppConfig) {
+	configMu.Lock()
+	defer configMu.Unlock()
 	appConfig = cfg
 }
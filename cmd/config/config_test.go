@@ -0,0 +1,135 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFormats(t *testing.T) {
+	files := map[string]string{
+		"config.ini": `upstream    = quad9,cloudflare
+cache-stale = 1h
+dns-listen  = 127.0.0.1:53
+
+[group streaming]
+rules   = assets/a.list,assets/b.list
+enabled = false
+`,
+		"config.yaml": `upstream: [quad9, cloudflare]
+cache-stale: 1h
+dns-listen: "127.0.0.1:53"
+groups:
+  streaming:
+    rules: [assets/a.list, assets/b.list]
+    enabled: false
+`,
+		"config.toml": `upstream = ["quad9", "cloudflare"]
+cache-stale = "1h"
+dns-listen = "127.0.0.1:53"
+
+[groups.streaming]
+rules = ["assets/a.list", "assets/b.list"]
+enabled = false
+`,
+	}
+	for name, content := range files {
+		if err := Load(writeConfig(t, name, content)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c := GetConfig()
+		if strings.Join(c.Upstreams, ",") != "quad9,cloudflare" || c.CacheStale != time.Hour || c.DNSListen != "127.0.0.1:53" {
+			t.Errorf("%s: main settings = %v %v %q", name, c.Upstreams, c.CacheStale, c.DNSListen)
+		}
+		if len(c.RuleGroups) != 1 || c.RuleGroups[0].Name != "streaming" || c.RuleGroups[0].Enabled || len(c.RuleGroups[0].Rules) != 2 {
+			t.Errorf("%s: groups = %+v", name, c.RuleGroups)
+		}
+		// 未设置的项取默认值
+		if c.Workers != 64 || !c.FilterAAAA {
+			t.Errorf("%s: defaults not applied: %d %v", name, c.Workers, c.FilterAAAA)
+		}
+	}
+}
+
+func TestSaveRoundTrip(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.toml", "config.ini"} {
+		if err := Load(writeConfig(t, name, "")); err != nil {
+			t.Fatal(err)
+		}
+		want := GetConfig()
+		want.Upstreams = []string{"quad9"}
+		want.CacheStale = 90 * time.Second
+		want.RuleGroups = []RuleGroup{{Name: "ads", Rules: []string{"assets/ads.list"}, Enabled: true}}
+		SetConfig(want)
+
+		path := filepath.Join(t.TempDir(), name)
+		if err := Save(path); err != nil {
+			t.Fatal(err)
+		}
+		SetConfig(AppConfig{})
+		if err := Load(path); err != nil {
+			data, _ := os.ReadFile(path)
+			t.Fatalf("%s: %v\n%s", name, err, data)
+		}
+		got := GetConfig()
+		if strings.Join(got.Upstreams, ",") != "quad9" || got.CacheStale != want.CacheStale || len(got.RuleGroups) != 1 || got.Workers != want.Workers {
+			t.Errorf("%s: round trip = %v %v %+v", name, got.Upstreams, got.CacheStale, got.RuleGroups)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Load(writeConfig(t, "config.yaml", "resolve-workers: 8\n")); err != nil {
+		t.Fatal(err)
+	}
+	before := GetConfig()
+
+	path := writeConfig(t, "config.yaml", `cache-stal: 1h
+cache-stale: soon
+resolve-workers: -1
+reject: drop
+dns-listen: 53
+groups:
+  ads:
+    enabld: true
+`)
+	err := Load(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		`cache-stal: unknown setting, did you mean "cache-stale"?`,
+		`cache-stale: "soon" is not a duration`,
+		`resolve-workers: -1 must not be negative`,
+		`reject: unknown reject policy "drop"`,
+		`dns-listen: "53" is not an address`,
+		`groups.ads.enabld: unknown setting, did you mean "enabled"?`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q:\n%v", want, err)
+		}
+	}
+	if GetConfig().Workers != before.Workers {
+		t.Error("a rejected file replaced the configuration")
+	}
+
+	err = Load(writeConfig(t, "config.toml", "[profile.kids]\nsafe-search = true\n"))
+	if err == nil || !strings.Contains(err.Error(), "profile: unknown section, want one of clients, groups, presets, profiles, qos") {
+		t.Errorf("TOML error = %v", err)
+	}
+	err = Load(writeConfig(t, "config.ini", "[grup ads]\nrules = a.list\n"))
+	if err == nil || !strings.Contains(err.Error(), "[grup ads]: unknown section") {
+		t.Errorf("INI error = %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"openvpnadvanced/audit"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the configuration read when no other is found
+const DefaultPath = "config.ini"
+
+// candidates are the configurations Find looks for, in order
+var candidates = []string{"config.yaml", "config.yml", "config.toml", DefaultPath}
+
+// tables name the sections of YAML and TOML files, which hold one table
+// per named section: "groups: {streaming: {rules: [...]}}" is the INI
+// section [group streaming]
+var tables = map[string]string{
+	profilePrefix: "profiles",
+	clientPrefix:  "clients",
+	qosPrefix:     "qos",
+	groupPrefix:   "groups",
+	presetPrefix:  "presets",
+}
+
+var (
+	pathMu sync.Mutex
+	// loaded is the file the configuration was last loaded from
+	loaded = DefaultPath
+)
+
+// Find returns the first of config.yaml, config.yml, config.toml and
+// config.ini in the working directory, config.ini when none exists
+func Find() string {
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return DefaultPath
+}
+
+// Path returns the file the configuration was last loaded from, which
+// Save should write back to
+func Path() string {
+	pathMu.Lock()
+	defer pathMu.Unlock()
+	return loaded
+}
+
+// Load reads the configuration at path, as YAML (.yaml, .yml), TOML
+// (.toml) or INI, and replaces the current one. The three formats hold
+// the same settings under the same names. Every value is checked before
+// anything is replaced; the error lists all the problems found, one per
+// line.
+func Load(path string) error {
+	var cfg *ini.File
+	var err error
+	format := formatOf(path)
+	if format == "ini" {
+		cfg, err = ini.Load(path)
+	} else {
+		cfg, err = decode(path, format)
+	}
+	if err != nil {
+		return err
+	}
+	if err := apply(path, cfg, format != "ini"); err != nil {
+		return err
+	}
+	pathMu.Lock()
+	loaded = path
+	pathMu.Unlock()
+	return nil
+}
+
+// Save writes the configuration to path, in the format its extension
+// names
+func Save(path string) error {
+	cfg := toINI(GetConfig())
+	var err error
+	switch format := formatOf(path); format {
+	case "ini":
+		err = cfg.SaveTo(path)
+	default:
+		var data []byte
+		if data, err = encode(cfg, format); err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+	}
+	audit.Record(audit.FileWrite, path, "config", err)
+	return err
+}
+
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "ini"
+}
+
+// decode reads a YAML or TOML file into the layout of an INI file
+func decode(path, format string) (*ini.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]any{}
+	if format == "yaml" {
+		err = yaml.Unmarshal(data, &doc)
+	} else {
+		err = toml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// 按名称排序，错误信息的顺序固定
+	cfg := ini.Empty()
+	for _, name := range slices.Sorted(maps.Keys(doc)) {
+		value := doc[name]
+		prefix, ok := tableOf(name)
+		if _, table := value.(map[string]any); !ok && table {
+			return nil, fmt.Errorf("%s: %s: unknown section, want one of %s", path, name, strings.Join(sectionNames(true), ", "))
+		}
+		if !ok {
+			if err := setKey(cfg.Section(""), name, value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+			continue
+		}
+		entries, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s: want a table of named sections, got %s", path, name, typeName(value))
+		}
+		for _, entry := range slices.Sorted(maps.Keys(entries)) {
+			body := entries[entry]
+			keys, ok := body.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s.%s: want a table of settings, got %s", path, name, entry, typeName(body))
+			}
+			sec := cfg.Section(prefix + entry)
+			for _, key := range slices.Sorted(maps.Keys(keys)) {
+				if err := setKey(sec, key, keys[key]); err != nil {
+					return nil, fmt.Errorf("%s: %s.%s.%s: %v", path, name, entry, key, err)
+				}
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// tableOf returns the section prefix of a YAML or TOML table name
+func tableOf(name string) (string, bool) {
+	for prefix, table := range tables {
+		if table == name {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// setKey stores a scalar, or a list of them, as an INI value
+func setKey(sec *ini.Section, key string, value any) error {
+	if list, ok := value.([]any); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			s, err := scalar(item)
+			if err != nil {
+				return fmt.Errorf("item %d: %v", i+1, err)
+			}
+			if strings.Contains(s, ",") {
+				return fmt.Errorf("item %d: %q can't contain a comma", i+1, s)
+			}
+			items[i] = s
+		}
+		sec.Key(key).SetValue(strings.Join(items, ","))
+		return nil
+	}
+	s, err := scalar(value)
+	if err != nil {
+		return err
+	}
+	sec.Key(key).SetValue(s)
+	return nil
+}
+
+func scalar(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("want a string, number or boolean, got %s", typeName(value))
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "a table"
+	case []any:
+		return "a list"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// encode writes the settings of cfg as YAML or TOML, typed per the
+// schema: lists as arrays, booleans and numbers unquoted
+func encode(cfg *ini.File, format string) ([]byte, error) {
+	doc := map[string]any{}
+	for _, sec := range cfg.Sections() {
+		known, target := settings, doc
+		if sec.Name() != ini.DefaultSection {
+			prefix, ok := sectionPrefix(sec.Name())
+			if !ok {
+				continue
+			}
+			known = sections[prefix]
+			table, _ := doc[tables[prefix]].(map[string]any)
+			if table == nil {
+				table = map[string]any{}
+				doc[tables[prefix]] = table
+			}
+			target = map[string]any{}
+			table[strings.TrimSpace(strings.TrimPrefix(sec.Name(), prefix))] = target
+		}
+		for _, key := range sec.Keys() {
+			target[key.Name()] = typed(key, known[key.Name()].kind)
+		}
+	}
+	if format == "yaml" {
+		return yaml.Marshal(ordered(doc))
+	}
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(doc)
+	return buf.Bytes(), err
+}
+
+func typed(key *ini.Key, k kind) any {
+	switch k {
+	case kindList:
+		if key.String() == "" {
+			return []string{}
+		}
+		return key.Strings(",")
+	case kindBool:
+		return key.MustBool(false)
+	case kindInt:
+		return key.MustInt(0)
+	case kindFloat:
+		return key.MustFloat64(0)
+	}
+	return key.String()
+}
+
+// ordered returns doc as a YAML node with the main settings ahead of the
+// tables, each in alphabetical order
+func ordered(doc map[string]any) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		_, ti := tableOf(keys[i])
+		_, tj := tableOf(keys[j])
+		if ti != tj {
+			return tj
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		var value yaml.Node
+		if m, ok := doc[k].(map[string]any); ok {
+			value = *ordered(m)
+		} else if err := value.Encode(doc[k]); err != nil {
+			continue
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, &value)
+	}
+	return node
+}
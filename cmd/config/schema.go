@@ -0,0 +1,431 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/engine"
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/logging"
+	"openvpnadvanced/nat64"
+	"openvpnadvanced/qos"
+	"openvpnadvanced/safesearch"
+	"openvpnadvanced/schedule"
+
+	"gopkg.in/ini.v1"
+)
+
+// kind is the type of a setting's value
+type kind uint8
+
+const (
+	kindString kind = iota
+	kindList
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindList:
+		return "a list"
+	case kindBool:
+		return "true or false"
+	case kindInt:
+		return "a whole number"
+	case kindFloat:
+		return "a number"
+	case kindDuration:
+		return "a duration like 30s, 5m or 1h"
+	}
+	return "a string"
+}
+
+// setting describes the values a key takes; check, when set, rejects
+// values of the right kind the core would refuse
+type setting struct {
+	kind  kind
+	check func(string) error
+}
+
+// settings are the keys of the main section, as read by apply
+var settings = map[string]setting{
+	"auto-subscribe":          {kind: kindBool},
+	"update-period":           {kind: kindDuration},
+	"update-schedule":         {kind: kindString, check: parsed(schedule.ParseCron)},
+	"geo-schedule":            {kind: kindString, check: parsed(schedule.ParseCron)},
+	"update-jitter":           {kind: kindDuration},
+	"update-skip-metered":     {kind: kindBool},
+	"metered-ifaces":          {kind: kindList},
+	"check-openvpn":           {kind: kindBool},
+	"log-level":               {kind: kindString, check: parsed(logging.ParseLevel)},
+	"log-format":              {kind: kindString, check: parsed(logging.ParseFormat)},
+	"log-modules":             {kind: kindList, check: logModules},
+	"helper-socket":           {kind: kindString},
+	"cache-backend":           {kind: kindString, check: oneOf("memory", "redis", "bolt", "wal")},
+	"redis-addr":              {kind: kindString, check: hostPort},
+	"redis-password":          {kind: kindString},
+	"redis-db":                {kind: kindInt},
+	"bolt-path":               {kind: kindString},
+	"wal-path":                {kind: kindString},
+	"wal-sync":                {kind: kindBool},
+	"resolve-workers":         {kind: kindInt},
+	"resolve-queue":           {kind: kindInt},
+	"udp-readers":             {kind: kindInt},
+	"udp-workers":             {kind: kindInt},
+	"udp-queue":               {kind: kindInt},
+	"udp-read-buffer":         {kind: kindInt},
+	"udp-write-buffer":        {kind: kindInt},
+	"max-upstream-queries":    {kind: kindInt},
+	"max-route-ops":           {kind: kindInt},
+	"max-connections":         {kind: kindInt},
+	"compile-rules":           {kind: kindBool},
+	"rule-db":                 {kind: kindString},
+	"rule-groups-state":       {kind: kindString},
+	"hook-script":             {kind: kindString},
+	"hook-workers":            {kind: kindInt},
+	"hook-queue":              {kind: kindInt},
+	"hook-timeout":            {kind: kindDuration},
+	"dns-listen":              {kind: kindString, check: hostPort},
+	"grpc-listen":             {kind: kindString},
+	"admin-listen":            {kind: kindString, check: hostPort},
+	"admin-token":             {kind: kindString},
+	"state-file":              {kind: kindString},
+	"replay-record":           {kind: kindString},
+	"geoip-url":               {kind: kindString},
+	"geoip-path":              {kind: kindString},
+	"geosite-url":             {kind: kindString},
+	"geosite-path":            {kind: kindString},
+	"geo-refresh":             {kind: kindDuration},
+	"geoip-reload":            {kind: kindDuration},
+	"cache-file":              {kind: kindString},
+	"cache-save-interval":     {kind: kindDuration},
+	"cache-min-ttl":           {kind: kindDuration},
+	"cache-max-ttl":           {kind: kindDuration},
+	"cache-stale":             {kind: kindDuration},
+	"negative-cache-ttl":      {kind: kindDuration},
+	"servfail-cache-ttl":      {kind: kindDuration},
+	"query-timeout":           {kind: kindDuration},
+	"address-preference":      {kind: kindString, check: parsed(dnsmasq.ParseFamily)},
+	"answer-order":            {kind: kindString, check: parsed(engine.ParseAnswerOrder)},
+	"ddr":                     {kind: kindBool},
+	"ddr-resolver":            {kind: kindString},
+	"nat64":                   {kind: kindString, check: nat64Setting},
+	"fake-ip":                 {kind: kindBool, check: fakeIPSetting},
+	"fake-ip-range":           {kind: kindString, check: fakeIPRange},
+	"fake-ip-ttl":             {kind: kindDuration},
+	"upstream":                {kind: kindList},
+	"upstream-race":           {kind: kindBool},
+	"upstream-relays":         {kind: kindList},
+	"upstream-bootstrap":      {kind: kindList},
+	"filter-aaaa":             {kind: kindBool},
+	"filter-aaaa-domains":     {kind: kindList},
+	"https-records":           {kind: kindBool},
+	"ech":                     {kind: kindString, check: parsed(dnsproxy.ParseECHPolicy)},
+	"ech-strip-domains":       {kind: kindList},
+	"ech-pass-domains":        {kind: kindList},
+	"captive-detect":          {kind: kindBool},
+	"captive-url":             {kind: kindString},
+	"captive-interval":        {kind: kindDuration},
+	"offline-detect":          {kind: kindBool},
+	"offline-interval":        {kind: kindDuration},
+	"rollback-timeout":        {kind: kindDuration},
+	"coexist":                 {kind: kindString, check: parsed(engine.ParseCoexistMode)},
+	"coexist-listen":          {kind: kindString, check: hostPort},
+	"safe-search":             {kind: kindBool},
+	"safe-search-youtube":     {kind: kindString, check: parsed(safesearch.ParseYouTube)},
+	"telemetry":               {kind: kindBool},
+	"telemetry-url":           {kind: kindString},
+	"vpn-down":                {kind: kindString, check: parsed(dnsproxy.ParseVPNDownPolicy)},
+	"vpn-reconnect-flush":     {kind: kindBool},
+	"vpn-down-direct-domains": {kind: kindList},
+	"vpn-down-block-domains":  {kind: kindList},
+	"reject":                  {kind: kindString, check: parsed(dnsproxy.ParseRejectPolicy)},
+	"client-rate-limit":       {kind: kindFloat},
+	"cname-match":             {kind: kindString, check: parsed(dnsproxy.ParseCNAMEMatch)},
+	"cname-max-depth":         {kind: kindInt},
+	"cname-partial-chain":     {kind: kindBool},
+	"verify-upstream":         {kind: kindString},
+	"verify-domains":          {kind: kindList},
+	"verify-policy":           {kind: kindString, check: parsed(dnsproxy.ParseVerifyPolicy)},
+	"warm-up-domains":         {kind: kindList},
+	"warm-up-top":             {kind: kindInt},
+	"qos-upstream-dscp":       {kind: kindString, check: parsed(qos.ParseDSCP)},
+	"qos-upstream-fwmark":     {kind: kindString, check: parsed(qos.ParseFWMark)},
+	"probe-targets":           {kind: kindList},
+	"probe-interval":          {kind: kindDuration},
+	"probe-fallback":          {kind: kindBool},
+	"audit-log":               {kind: kindString},
+	"history-db":              {kind: kindString},
+	"history-max-age":         {kind: kindDuration},
+	"history-max-rows":        {kind: kindInt},
+	"query-log":               {kind: kindBool},
+	"query-log-size":          {kind: kindInt},
+	"query-log-file":          {kind: kindString},
+	"query-log-max-mb":        {kind: kindInt},
+	"query-log-backups":       {kind: kindInt},
+	"sync-listen":             {kind: kindString, check: hostPort},
+	"sync-peers":              {kind: kindList},
+	"sync-secret":             {kind: kindString},
+	"sync-id":                 {kind: kindString},
+	"hot-reload":              {kind: kindBool},
+	"doh-user-agent":          {kind: kindString},
+	"doh-headers":             {kind: kindList, check: dohHeaders},
+	"metrics-listen":          {kind: kindString, check: hostPort},
+	"leaktest-domain":         {kind: kindString},
+	"leaktest-url":            {kind: kindString},
+}
+
+// sections are the keys of the named sections, by name prefix
+var sections = map[string]map[string]setting{
+	profilePrefix: {
+		"clients":     {kind: kindList},
+		"safe-search": {kind: kindBool},
+		"youtube":     {kind: kindString, check: parsed(safesearch.ParseYouTube)},
+	},
+	clientPrefix: {
+		"addresses":  {kind: kindList},
+		"macs":       {kind: kindList},
+		"client-ids": {kind: kindList},
+		"profile":    {kind: kindString},
+		"rate-limit": {kind: kindFloat},
+	},
+	qosPrefix: {
+		"domains": {kind: kindList},
+		"dscp":    {kind: kindString, check: parsed(qos.ParseDSCP)},
+		"fwmark":  {kind: kindString, check: parsed(qos.ParseFWMark)},
+	},
+	groupPrefix: {
+		"rules":   {kind: kindList},
+		"enabled": {kind: kindBool},
+	},
+	presetPrefix: {
+		"region":       {kind: kindString},
+		"upstream":     {kind: kindList},
+		"bootstrap":    {kind: kindList},
+		"capabilities": {kind: kindList},
+	},
+}
+
+// validate checks every key of cfg, read from path, against the settings
+// and returns all the problems found at once
+func validate(path string, cfg *ini.File, structured bool) error {
+	var errs []error
+	report := func(where, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s: %s", path, where, fmt.Sprintf(format, args...)))
+	}
+	for _, sec := range cfg.Sections() {
+		known, prefix := settings, ""
+		if sec.Name() != ini.DefaultSection {
+			var ok bool
+			if prefix, ok = sectionPrefix(sec.Name()); !ok {
+				report(sectionName(sec.Name(), structured), "unknown section, want one of %s", strings.Join(sectionNames(structured), ", "))
+				continue
+			}
+			known = sections[prefix]
+		}
+		for _, key := range sec.Keys() {
+			where := key.Name()
+			if prefix != "" {
+				where = sectionName(sec.Name(), structured) + keySeparator(structured) + key.Name()
+			}
+			s, ok := known[key.Name()]
+			if !ok {
+				report(where, "unknown setting%s", suggest(key.Name(), known))
+				continue
+			}
+			if err := s.validate(key); err != nil {
+				report(where, "%v", err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the value of key; empty values take the default
+func (s setting) validate(key *ini.Key) error {
+	value := key.String()
+	if value == "" {
+		return nil
+	}
+	var err error
+	negative := false
+	switch s.kind {
+	case kindBool:
+		_, err = key.Bool()
+	case kindInt:
+		var v int
+		v, err = key.Int()
+		negative = v < 0
+	case kindFloat:
+		var v float64
+		v, err = key.Float64()
+		negative = v < 0
+	case kindDuration:
+		var d time.Duration
+		d, err = key.Duration()
+		negative = d < 0
+	}
+	switch {
+	case err != nil:
+		return fmt.Errorf("%q is not %s", value, s.kind)
+	case negative:
+		return fmt.Errorf("%s must not be negative", value)
+	case s.check != nil:
+		return s.check(value)
+	}
+	return nil
+}
+
+// parsed turns a parser of the core into a check
+func parsed[T any](parse func(string) (T, error)) func(string) error {
+	return func(s string) error {
+		_, err := parse(s)
+		return err
+	}
+}
+
+// oneOf accepts the values given, case-insensitively
+func oneOf(values ...string) func(string) error {
+	return func(s string) error {
+		for _, v := range values {
+			if strings.EqualFold(s, v) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", s, strings.Join(values, ", "))
+	}
+}
+
+// hostPort accepts listen and server addresses like 127.0.0.1:53 or :53
+func hostPort(s string) error {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return fmt.Errorf("%q is not an address like 127.0.0.1:53 or :53", s)
+	}
+	return nil
+}
+
+func dohHeaders(s string) error {
+	_, err := doh.ParseHeader("", strings.Split(s, ","))
+	return err
+}
+
+func logModules(s string) error {
+	_, err := logging.ParseModules(strings.Split(s, ","))
+	return err
+}
+
+func nat64Setting(s string) error {
+	_, _, err := nat64.ParseSetting(s)
+	return err
+}
+
+// fakeIPSetting refuses fake-ip mode where it can't work: it relies on
+// iptables DNAT and policy routing
+func fakeIPSetting(s string) error {
+	switch strings.ToLower(s) {
+	case "1", "t", "true", "y", "yes", "on":
+		if runtime.GOOS != "linux" {
+			return errors.New("fake-ip mode is only supported on Linux")
+		}
+	}
+	return nil
+}
+
+func fakeIPRange(s string) error {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return err
+	}
+	_, err = fakeip.New(prefix)
+	return err
+}
+
+// suggest names the known key closest to a misspelled one, if any
+func suggest(name string, known map[string]setting) string {
+	best, dist := "", 3
+	for key := range known {
+		if d := distance(name, key); d < dist || d == dist && key < best {
+			best, dist = key, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// distance is the Levenshtein distance between a and b
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// sectionPrefix returns the prefix of a section name, e.g. "group "
+func sectionPrefix(name string) (string, bool) {
+	for prefix := range sections {
+		if strings.HasPrefix(name, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// sectionName names a section as the file format writes it
+func sectionName(name string, structured bool) string {
+	if !structured {
+		return "[" + name + "]"
+	}
+	prefix, ok := sectionPrefix(name)
+	if !ok {
+		return name
+	}
+	return tables[prefix] + "." + strings.TrimSpace(strings.TrimPrefix(name, prefix))
+}
+
+func keySeparator(structured bool) string {
+	if structured {
+		return "."
+	}
+	return " "
+}
+
+// sectionNames lists the kinds of sections, as the file format writes them
+func sectionNames(structured bool) []string {
+	var names []string
+	for prefix, table := range tables {
+		if structured {
+			names = append(names, table)
+		} else {
+			names = append(names, "["+prefix+"NAME]")
+		}
+	}
+	sort.Strings(names)
+	return names
+}
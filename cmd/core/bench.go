@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	"openvpnadvanced/bench"
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/doh"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// BenchUpstreams measures the configured upstreams and the built-in
+// providers from the current network and writes a ranked table to out.
+// Results are returned best first.
+func BenchUpstreams(ctx context.Context, rounds int, out io.Writer) ([]bench.Result, error) {
+	cfg := config.GetConfig()
+	presets, err := newPresets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, _, err := doh.ExpandPresets(cfg.Upstreams, presets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %v", err)
+	}
+	var providers []bench.Provider
+	for i, spec := range upstreams {
+		name := "configured"
+		if len(upstreams) > 1 {
+			name = fmt.Sprintf("configured %d", i+1)
+		}
+		providers = append(providers, bench.Provider{Name: name, Spec: spec, Relays: cfg.Relays})
+	}
+	for _, p := range bench.Builtin {
+		if !slices.Contains(upstreams, p.Spec) {
+			providers = append(providers, p)
+		}
+	}
+
+	results := bench.Run(ctx, providers, nil, rounds)
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"#", "Provider", "Median", "P90", "Errors", "Consistent", "Upstream"})
+	table.SetAutoWrapText(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetBorder(false)
+	for i, r := range results {
+		if r.Err != nil {
+			table.Append([]string{fmt.Sprint(i + 1), r.Name, "-", "-", r.Err.Error(), "-", r.Spec})
+			continue
+		}
+		table.Append([]string{
+			fmt.Sprint(i + 1), r.Name,
+			r.Median.Round(1e6).String(), r.P90.Round(1e6).String(),
+			fmt.Sprintf("%d/%d", r.Errors, r.Queries),
+			fmt.Sprintf("%.0f%%", r.Consistency*100),
+			r.Spec,
+		})
+	}
+	table.Render()
+	return results, nil
+}
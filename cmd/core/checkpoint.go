@@ -0,0 +1,53 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Checkpoint records the running core's rules, rule groups and overrides.
+// Changes made afterwards roll back unless Confirm is called within
+// timeout. It returns when the rollback is due.
+func Checkpoint(timeout time.Duration) (time.Time, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return time.Time{}, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Checkpoint(timeout)
+}
+
+// Confirm keeps the changes made since the pending checkpoint
+func Confirm() error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Confirm()
+}
+
+// Rollback reverts the changes made since the pending checkpoint
+func Rollback() error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Rollback()
+}
+
+// PendingCheckpoint returns when the pending checkpoint rolls back, if
+// one awaits confirmation
+func PendingCheckpoint() (time.Time, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return time.Time{}, false
+	}
+	return coreEng.PendingCheckpoint()
+}
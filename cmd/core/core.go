@@ -1,34 +1,96 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
+	"openvpnadvanced/adminapi"
+	"openvpnadvanced/boltcache"
+	"openvpnadvanced/clients"
 	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/cmd/logger"
+	"openvpnadvanced/controlapi"
+	"openvpnadvanced/ddr"
 	"openvpnadvanced/dnsmasq"
 	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/engine"
+	"openvpnadvanced/fakeip"
 	"openvpnadvanced/fetcher"
+	"openvpnadvanced/geodata"
+	"openvpnadvanced/geoip"
+	"openvpnadvanced/handoff"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/leaktest"
+	"openvpnadvanced/limits"
+	"openvpnadvanced/nat64"
+	"openvpnadvanced/privhelper"
+	"openvpnadvanced/probe"
+	"openvpnadvanced/qos"
+	"openvpnadvanced/rediscache"
+	"openvpnadvanced/safesearch"
+	"openvpnadvanced/schedule"
+	"openvpnadvanced/telemetry"
 	"openvpnadvanced/vpn"
+	"openvpnadvanced/walcache"
+
+	"google.golang.org/grpc"
 )
 
-var coreStarted bool
+var (
+	coreMu    sync.Mutex
+	coreEng   *engine.Engine
+	coreCache dnsmasq.CacheBackend
+	coreGRPC  *grpc.Server
+	coreAdmin *http.Server
+	coreGeo   *geodata.Manager
+	coreGeoIP *geoip.DB
+	coreHooks *hooks.ScriptRunner
+)
 
 func RunCoreLogic(verbose bool) error {
-	if coreStarted {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng != nil {
 		if verbose {
 			fmt.Println("⚠️ Core logic is already running.")
 		}
 		log.Println("Core logic already started.")
 		return nil
 	}
-	coreStarted = true
+	// 升级后的新进程接管旧进程的监听套接字
+	sockets, err := handoff.Inherited()
+	if err == nil {
+		err = runCore(verbose, sockets)
+	}
+	if err != nil {
+		sockets.Close()
+	}
+	handoff.Ready(err)
+	return err
+}
+
+// runCore builds and starts the engine, serving sockets when set
+func runCore(verbose bool, sockets *handoff.Sockets) error {
 
 	cfg := config.GetConfig()
 
+	var subs *fetcher.Subscriptions
 	if cfg.AutoSubscribe {
-		err := fetcher.FetchAndMergeRules("assets/subscriptions.txt", "assets/merged_rule.list")
-		if err != nil {
+		subs = fetcher.NewSubscriptions("assets/subscriptions.txt", "assets/merged_rule.list", cfg.UpdatePeriod)
+		subs.Window = refreshWindow(cfg, cfg.UpdateSchedule)
+		if _, err := subs.Update(context.Background()); err != nil {
 			return fmt.Errorf("failed to fetch subscriptions: %v", err)
 		}
 		if verbose {
@@ -36,66 +98,791 @@ func RunCoreLogic(verbose bool) error {
 		}
 	}
 
-	// Load DNS cache from file
-	rawCache, err := dnsmasq.LoadCacheFromFile()
-	if err != nil {
-		return fmt.Errorf("failed to load DNS cache: %v", err)
+	var helper *privhelper.Client
+	if cfg.HelperSocket != "" {
+		helper = privhelper.NewClient(cfg.HelperSocket)
+		log.Printf("Using privileged helper at %s", cfg.HelperSocket)
 	}
-	cache := dnsmasq.NewCacheWithTTL(10 * time.Minute)
-	for domain, record := range rawCache {
-		cache.Set(domain, record.IP)
+
+	// Check if VPN is up
+	if cfg.CheckOpenVPN && !vpn.IsTunnelblickRunning() {
+		return fmt.Errorf("Tunnelblick is not running. Please start your OpenVPN profile")
 	}
 
-	// Load routing rules
-	rules, err := dnsmasq.LoadDomainRules("assets/merged_rule.list")
+	cache, cachePath, err := newCacheBackend(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to load rule list: %v", err)
+		return err
 	}
 
-	// Check if VPN is up and get interface
-	if cfg.CheckOpenVPN && !vpn.IsTunnelblickRunning() {
-		return fmt.Errorf("Tunnelblick is not running. Please start your OpenVPN profile")
+	presets, err := newPresets(cfg)
+	if err != nil {
+		return err
+	}
+	upstreams, bootstrap, err := doh.ExpandPresets(cfg.Upstreams, presets)
+	if err != nil {
+		return fmt.Errorf("invalid upstream: %v", err)
+	}
+	if len(cfg.Bootstrap) > 0 {
+		bootstrap = cfg.Bootstrap
+	}
+	var upstream *doh.Upstream
+	if len(upstreams) > 0 {
+		upstream, err = doh.ParseUpstreams(upstreams, cfg.Relays...)
+		if err != nil {
+			return fmt.Errorf("invalid upstream: %v", err)
+		}
+		if pool := upstream.Pool(); pool != nil {
+			pool.Race = cfg.UpstreamRace
+		}
+	} else if len(cfg.Relays) > 0 {
+		return fmt.Errorf("upstream-relays requires a DNSCrypt upstream")
+	}
+	if len(bootstrap) > 0 {
+		if upstream == nil {
+			upstream = &doh.Upstream{URL: doh.Endpoint}
+		}
+		if err := upstream.UseBootstrap(bootstrap); err != nil {
+			return fmt.Errorf("invalid upstream-bootstrap: %v", err)
+		}
 	}
 
-	iface, err := vpn.FindVPNInterface()
+	ech, err := dnsproxy.ParseECHPolicy(cfg.ECH)
 	if err != nil {
-		return fmt.Errorf("no VPN interface found: %v", err)
+		return err
 	}
-	if verbose {
-		fmt.Printf("✅ VPN interface detected: %s\n", iface)
+	coexist, err := engine.ParseCoexistMode(cfg.Coexist)
+	if err != nil {
+		return err
 	}
-	log.Printf("VPN interface detected: %s\n", iface)
+	vpnDown, err := dnsproxy.ParseVPNDownPolicy(cfg.VPNDown)
+	if err != nil {
+		return err
+	}
+	reject, err := dnsproxy.ParseRejectPolicy(cfg.Reject)
+	if err != nil {
+		return err
+	}
+	answerOrder, err := engine.ParseAnswerOrder(cfg.AnswerOrder)
+	if err != nil {
+		return err
+	}
+	family, err := dnsmasq.ParseFamily(cfg.AddrFamily)
+	if err != nil {
+		return err
+	}
+	nat64Detect, nat64Prefix, err := nat64.ParseSetting(cfg.NAT64)
+	if err != nil {
+		return err
+	}
+	var fakeIPRange netip.Prefix
+	if cfg.FakeIP {
+		if fakeIPRange, err = netip.ParsePrefix(cfg.FakeIPRange); err != nil {
+			return fmt.Errorf("fake-ip-range: %v", err)
+		}
+	}
+	safe, err := newSafeSearch(cfg)
+	if err != nil {
+		return err
+	}
+	registry, err := newClients(cfg)
+	if err != nil {
+		return err
+	}
+	cnameMatch, err := dnsproxy.ParseCNAMEMatch(cfg.CNAMEMatch)
+	if err != nil {
+		return err
+	}
+	verify, err := dnsproxy.ParseVerifyPolicy(cfg.VerifyPolicy)
+	if err != nil {
+		return err
+	}
+	upstreamMark, classes, err := newQoS(cfg)
+	if err != nil {
+		return err
+	}
+	dohHeader, err := doh.ParseHeader(cfg.DoHUserAgent, cfg.DoHHeaders)
+	if err != nil {
+		return fmt.Errorf("invalid doh-headers: %v", err)
+	}
+	var verifyUpstream *doh.Upstream
+	if cfg.VerifyURL != "" {
+		specs, _, err := doh.ExpandPresets([]string{cfg.VerifyURL}, presets)
+		if err != nil {
+			return fmt.Errorf("invalid verify-upstream: %v", err)
+		}
+		verifyUpstream, err = doh.ParseUpstreams(specs)
+		if err != nil {
+			return fmt.Errorf("invalid verify-upstream: %v", err)
+		}
+	}
+
+	geo := newGeoData(cfg)
+	geoIP := newGeoIP(cfg)
 
-	// Remove catch-all VPN routes
-	if err := vpn.DeleteDefaultVPNRoutes(); err != nil {
-		log.Printf("Warning: failed to delete default VPN routes: %v", err)
+	// 结构化日志取代逐条查询的彩色控制台输出
+	var engLogger dnsmasq.Logger
+	if l := logger.Logger(); l != nil {
+		engLogger = l
 	}
 
-	if err := vpn.CorrectDefaultRoute(); err != nil {
-		log.Printf("Warning: failed to correct default route: %v", err)
+	var hk *hooks.Hooks
+	var script *hooks.ScriptRunner
+	if cfg.HookScript != "" {
+		script = hooks.Script(cfg.HookScript, hooks.ScriptOptions{
+			Workers: cfg.HookWorkers, Queue: cfg.HookQueue, Timeout: cfg.HookTimeout,
+		})
+		hk = script.Hooks()
+	}
+
+	eng, err := engine.New(engine.Options{
+		RulePath:          "assets/merged_rule.list",
+		Cache:             cache,
+		CachePath:         cachePath,
+		CacheSaveInterval: cfg.CacheSave,
+		CacheMinTTL:       cfg.CacheMinTTL,
+		CacheMaxTTL:       cfg.CacheMaxTTL,
+		CacheStale:        cfg.CacheStale,
+		NegativeTTL:       cfg.NegativeTTL,
+		ServFailTTL:       cfg.ServFailTTL,
+		AnswerOrder:       answerOrder,
+		QueryTimeout:      cfg.QueryTimeout,
+		AddressFamily:     family,
+		FixRoutes:         true,
+		Helper:            helper,
+
+		ResolveWorkers:     cfg.Workers,
+		ResolveQueue:       cfg.QueueSize,
+		UDP:                udpOptions(cfg),
+		MaxUpstreamQueries: cfg.MaxUpstream,
+		MaxRouteOps:        cfg.MaxRouteOps,
+		MaxConnections:     cfg.MaxConns,
+		CompileRules:       cfg.CompileRules,
+		RuleDBPath:         cfg.RuleDB,
+		RuleGroups:         ruleGroups(cfg),
+		RuleGroupStatePath: cfg.GroupState,
+		Subscriptions:      subs,
+		Hooks:              hk,
+		Logger:             engLogger,
+		StatePath:          cfg.StateFile,
+		ReplayPath:         cfg.ReplayRecord,
+		HistoryPath:        cfg.HistoryDB,
+		QueryLog:           queryLogOptions(cfg),
+		SyncListen:         cfg.SyncListen,
+		SyncPeers:          cfg.SyncPeers,
+		SyncSecret:         cfg.SyncSecret,
+		SyncID:             cfg.SyncID,
+		MetricsListen:      cfg.MetricsListen,
+		LeakTest:           leaktest.Tester{ResolverName: cfg.LeakTestName, ExitURL: cfg.LeakTestURL},
+		HistoryRetention:   historyRetention(cfg),
+		GeoData:            geo,
+		GeoIP:              geoIP,
+		DDR:                cfg.DDR,
+		DDRResolver:        cfg.DDRResolver,
+		NAT64Detect:        nat64Detect,
+		NAT64Prefix:        nat64Prefix,
+		FakeIP:             fakeIPRange,
+		FakeIPTTL:          cfg.FakeIPTTL,
+		Upstream:           upstream,
+		DoHHeader:          dohHeader,
+		ResolveAAAA:        !cfg.FilterAAAA,
+		FilterAAAA:         cfg.FilterDomains,
+		HTTPSRecords:       cfg.HTTPSRecords,
+		ECH:                ech,
+		ECHStrip:           cfg.ECHStrip,
+		ECHPass:            cfg.ECHPass,
+		CaptiveDetect:      cfg.Captive,
+		CaptiveURL:         cfg.CaptiveURL,
+		CaptiveInterval:    cfg.CaptiveEvery,
+		OfflineDetect:      cfg.Offline,
+		OfflineInterval:    cfg.OfflineEvery,
+		Coexist:            coexist,
+		ListenAddr:         cfg.DNSListen,
+		CoexistListenAddr:  cfg.CoexistListen,
+		SafeSearch:         safe,
+		Clients:            registry,
+		CNAMEMatch:         cnameMatch,
+		MaxCNAMEDepth:      cfg.CNAMEDepth,
+		PartialChain:       cfg.CNAMEPartial,
+		VerifyUpstream:     verifyUpstream,
+		VerifyDomains:      cfg.VerifyDomains,
+		Verify:             verify,
+		WarmUp:             cfg.WarmUp,
+		WarmUpTop:          cfg.WarmUpTop,
+		UpstreamMark:       upstreamMark,
+		QoS:                classes,
+		ProbeTargets:       cfg.ProbeTargets,
+		ProbeInterval:      cfg.ProbeEvery,
+		ProbeFallback:      cfg.ProbeFallback,
+		TelemetryURL:       telemetryURL(cfg),
+		VPNDown:            vpnDown,
+		VPNDownDirect:      cfg.VPNDownDirect,
+		VPNDownBlock:       cfg.VPNDownBlock,
+		FlushOnReconnect:   cfg.ReconnectFlush,
+		Reject:             reject,
+		WatchRules:         cfg.HotReload,
+		Inherited:          sockets,
+	})
+	if err != nil {
+		closeCache(cache)
+		geoIP.Close()
+		script.Close()
+		return err
 	}
 
-	// Start DNS server
 	if verbose {
-		fmt.Printf("🧠 Loaded %d domain rules\n", len(rules))
+		fmt.Printf("🧠 Loaded %d domain rules\n", eng.RuleCount())
 		fmt.Println("🚦 Starting DNS proxy server...")
 	}
-	dnsServer := dnsproxy.NewServer(rules, cache, "127.0.0.1:53", iface)
-	dnsServer.Start()
+	if err := eng.Start(); err != nil {
+		closeCache(cache)
+		geoIP.Close()
+		script.Close()
+		return err
+	}
+	coreEng = eng
+	coreHooks = script
+	coreCache = cache
+	coreGeo = geo
+	coreGeoIP = geoIP
+	ctx, cancel := context.WithCancel(context.Background())
+	coreWatch = cancel
+	go watchReload(ctx, cfg.HotReload)
 
-	// Periodically save cache to disk
-	go func() {
-		for {
-			time.Sleep(30 * time.Second)
-			if err := dnsmasq.SaveCacheToFile(cache); err != nil {
-				log.Printf("Failed to save cache: %v", err)
-			}
+	if cfg.GRPCListen != "" {
+		srv, err := controlapi.Listen(cfg.GRPCListen, eng, cfg.AdminToken)
+		if err != nil {
+			log.Printf("⚠️ Failed to start gRPC control API on %s: %v", cfg.GRPCListen, err)
+		} else {
+			coreGRPC = srv
+			log.Printf("gRPC control API listening on %s", cfg.GRPCListen)
 		}
-	}()
+	}
+	if cfg.AdminListen != "" {
+		srv, err := adminapi.Listen(cfg.AdminListen, eng, cfg.AdminToken)
+		if err != nil {
+			log.Printf("⚠️ Failed to start admin API on %s: %v", cfg.AdminListen, err)
+		} else {
+			coreAdmin = srv
+			log.Printf("Admin API listening on http://%s/api/", cfg.AdminListen)
+		}
+	}
 
+	// 所有套接字都已到手，其余特权操作交给 helper
+	if helper != nil {
+		dropped, err := privhelper.DropPrivileges()
+		if err != nil {
+			stopCore()
+			return fmt.Errorf("failed to drop privileges: %v", err)
+		}
+		if dropped {
+			log.Printf("Dropped root privileges, now running as uid %d", os.Getuid())
+		}
+	}
 	return nil
 }
 
+// newCacheBackend builds the configured cache backend and returns the file
+// it should be persisted to (only the in-memory cache is persisted locally)
+func newCacheBackend(cfg config.AppConfig) (dnsmasq.CacheBackend, string, error) {
+	switch cfg.CacheBackend {
+	case "", "memory":
+		return nil, cfg.CacheFile, nil
+	case "redis":
+		cache, err := rediscache.New(rediscache.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to connect to Redis at %s: %v", cfg.RedisAddr, err)
+		}
+		log.Printf("Using Redis cache backend at %s", cfg.RedisAddr)
+		return cache, "", nil
+	case "bolt":
+		cache, err := boltcache.Open(cfg.BoltPath, 10*time.Minute)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to open bolt cache %s: %v", cfg.BoltPath, err)
+		}
+		log.Printf("Using bolt cache backend at %s", cfg.BoltPath)
+		return cache, "", nil
+	case "wal":
+		cache, err := walcache.Open(cfg.WALPath, walcache.Options{TTL: 10 * time.Minute, Sync: cfg.WALSync})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to open cache WAL %s: %v", cfg.WALPath, err)
+		}
+		log.Printf("Using WAL cache backend at %s", cfg.WALPath)
+		return cache, "", nil
+	default:
+		return nil, "", fmt.Errorf("unknown cache-backend: %q", cfg.CacheBackend)
+	}
+}
+
+// newGeoData returns a manager for the configured GeoIP/GeoSite
+// databases, or nil when no download URL is set
+func newGeoData(cfg config.AppConfig) *geodata.Manager {
+	var sources []geodata.Source
+	if cfg.GeoIPURL != "" {
+		sources = append(sources, geodata.Source{Name: "geoip", URL: cfg.GeoIPURL, Path: cfg.GeoIPPath, Refresh: cfg.GeoRefresh})
+	}
+	if cfg.GeoSiteURL != "" {
+		sources = append(sources, geodata.Source{Name: "geosite", URL: cfg.GeoSiteURL, Path: cfg.GeoSitePath, Refresh: cfg.GeoRefresh})
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	m := geodata.NewManager(sources...)
+	m.Window = refreshWindow(cfg, cfg.GeoSchedule)
+	return m
+}
+
+// refreshWindow returns when remote rules or databases refresh: on spec
+// when set, deferred on metered networks with update-skip-metered; nil
+// keeps their intervals
+func refreshWindow(cfg config.AppConfig, spec string) *schedule.Window {
+	var cron *schedule.Cron
+	if spec != "" {
+		c, err := schedule.ParseCron(spec)
+		if err != nil {
+			log.Printf("⚠️ Ignoring refresh schedule: %v", err)
+		} else {
+			cron = c
+		}
+	}
+	var metered func() bool
+	if cfg.UpdateSkipMetered {
+		ifaces := cfg.MeteredIfaces
+		metered = func() bool {
+			if _, iface, err := vpn.GetDefaultGateway(); err == nil && slices.Contains(ifaces, iface) {
+				return true
+			}
+			return schedule.NetworkMetered()
+		}
+	}
+	if cron == nil && metered == nil {
+		return nil
+	}
+	return schedule.New(cron, cfg.UpdateJitter, metered)
+}
+
+// udpOptions tunes the UDP listener from the config
+func udpOptions(cfg config.AppConfig) dnsproxy.UDPOptions {
+	return dnsproxy.UDPOptions{
+		Readers:     cfg.UDPReaders,
+		Workers:     cfg.UDPWorkers,
+		Queue:       cfg.UDPQueue,
+		ReadBuffer:  cfg.UDPReadBuffer,
+		WriteBuffer: cfg.UDPWriteBuffer,
+	}
+}
+
+// newGeoIP returns the GeoIP database for GEOIP rules, loaded from
+// geoip-path when the file exists already; nil when geoip-path is empty
+func newGeoIP(cfg config.AppConfig) *geoip.DB {
+	if cfg.GeoIPPath == "" {
+		return nil
+	}
+	db := &geoip.DB{Path: cfg.GeoIPPath, Interval: cfg.GeoIPReload}
+	if _, err := db.Reload(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("⚠️ Failed to load GeoIP database %s: %v", cfg.GeoIPPath, err)
+	}
+	return db
+}
+
+// telemetryURL returns where usage reports go, or "" unless the user
+// opted in and configured an endpoint
+func telemetryURL(cfg config.AppConfig) string {
+	if !cfg.Telemetry {
+		return ""
+	}
+	if cfg.TelemetryURL == "" {
+		log.Printf("⚠️ telemetry is on but telemetry-url is empty, nothing will be sent")
+	}
+	return cfg.TelemetryURL
+}
+
+// Telemetry returns the usage report the running core would send now, and
+// false when telemetry is off
+func Telemetry() (telemetry.Report, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return telemetry.Report{}, false
+	}
+	return coreEng.Telemetry()
+}
+
+// newSafeSearch builds the safe-search policy from the global settings and
+// the profile sections, or nil when nothing is enforced
+func newSafeSearch(cfg config.AppConfig) (*safesearch.Policy, error) {
+	youtube, err := safesearch.ParseYouTube(cfg.SafeYouTube)
+	if err != nil {
+		return nil, err
+	}
+	policy := &safesearch.Policy{Default: safesearch.Profile{Name: "default", Search: cfg.SafeSearch, YouTube: youtube}}
+	enforced := cfg.SafeSearch || youtube != safesearch.YouTubeOff
+	for _, p := range cfg.Profiles {
+		clients, err := safesearch.ParseClients(p.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+		youtube, err := safesearch.ParseYouTube(p.YouTube)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+		policy.Profiles = append(policy.Profiles, safesearch.Profile{Name: p.Name, Clients: clients, Search: p.SafeSearch, YouTube: youtube})
+		enforced = enforced || p.SafeSearch || youtube != safesearch.YouTubeOff
+	}
+	if !enforced {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// newClients builds the client registry from the client sections, or nil
+// when no client is configured and nothing is rate-limited
+func newClients(cfg config.AppConfig) (*clients.Registry, error) {
+	if len(cfg.Clients) == 0 && cfg.ClientRate <= 0 {
+		return nil, nil
+	}
+	registry := &clients.Registry{DefaultRateLimit: cfg.ClientRate}
+	for _, c := range cfg.Clients {
+		addrs, err := clients.ParseAddrs(c.Addresses)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %v", c.Name, err)
+		}
+		macs, err := clients.ParseMACs(c.MACs)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %v", c.Name, err)
+		}
+		if c.Profile != "" && c.Profile != "default" && !slices.ContainsFunc(cfg.Profiles, func(p config.Profile) bool { return p.Name == c.Profile }) {
+			return nil, fmt.Errorf("client %s: unknown profile %q", c.Name, c.Profile)
+		}
+		registry.Clients = append(registry.Clients, clients.Client{
+			Name: c.Name, Addrs: addrs, MACs: macs, IDs: c.IDs, Profile: c.Profile, RateLimit: c.RateLimit,
+		})
+	}
+	return registry, nil
+}
+
+// newQoS parses the upstream socket mark and the qos sections
+// newPresets converts the [preset NAME] sections
+func newPresets(cfg config.AppConfig) ([]doh.Preset, error) {
+	var presets []doh.Preset
+	for _, p := range cfg.Presets {
+		caps, err := doh.ParseCapabilities(p.Capabilities)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %v", p.Name, err)
+		}
+		presets = append(presets, doh.Preset{
+			Name:         p.Name,
+			Region:       p.Region,
+			Upstreams:    p.Upstreams,
+			Bootstrap:    p.Bootstrap,
+			Capabilities: caps,
+		})
+	}
+	return presets, nil
+}
+
+// UpstreamPresets returns the upstream presets usable by name in
+// upstream: the custom ones, then the built-in ones they don't replace
+func UpstreamPresets() ([]doh.Preset, error) {
+	presets, err := newPresets(config.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range doh.Presets {
+		if _, ok := doh.LookupPreset(p.Name, presets); !ok {
+			presets = append(presets, p)
+		}
+	}
+	return presets, nil
+}
+
+func newQoS(cfg config.AppConfig) (qos.Mark, []qos.Class, error) {
+	parse := func(dscp, fwmark string) (qos.Mark, error) {
+		d, err := qos.ParseDSCP(dscp)
+		if err != nil {
+			return qos.Mark{}, err
+		}
+		m, err := qos.ParseFWMark(fwmark)
+		if err != nil {
+			return qos.Mark{}, err
+		}
+		return qos.Mark{DSCP: d, FWMark: m}, nil
+	}
+	upstream, err := parse(cfg.QoSDSCP, cfg.QoSFWMark)
+	if err != nil {
+		return qos.Mark{}, nil, fmt.Errorf("qos-upstream: %v", err)
+	}
+	var classes []qos.Class
+	for _, c := range cfg.QoS {
+		mark, err := parse(c.DSCP, c.FWMark)
+		if err != nil {
+			return qos.Mark{}, nil, fmt.Errorf("qos %s: %v", c.Name, err)
+		}
+		classes = append(classes, qos.Class{Name: c.Name, Domains: c.Domains, Mark: mark})
+	}
+	return upstream, classes, nil
+}
+
+// Probes returns the running core's egress measurements
+func Probes() []probe.Stats {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Probes()
+}
+
+// LeakTest checks what external services observe for the PROXY and DIRECT
+// domains of the running core. The checks take a while, so the core isn't
+// locked meanwhile.
+func LeakTest() ([]leaktest.Result, []string, error) {
+	coreMu.Lock()
+	eng := coreEng
+	coreMu.Unlock()
+
+	if eng == nil {
+		return nil, nil, fmt.Errorf("core logic is not running")
+	}
+	return eng.LeakTest(context.Background())
+}
+
+// VerifyMismatches returns how many answers of the running core disagreed
+// with verify-upstream
+func VerifyMismatches() uint64 {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return 0
+	}
+	return coreEng.VerifyMismatches()
+}
+
+// ClientQueries returns how many queries each client sent to the running
+// core, keyed by client name or address
+func ClientQueries() map[string]uint64 {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.State().ClientQueries()
+}
+
+// UpdateGeoData downloads every configured GeoIP/GeoSite database now,
+// reloading the rules of the running engine when one changed
+func UpdateGeoData(ctx context.Context) ([]geodata.Status, error) {
+	coreMu.Lock()
+	geo := coreGeo
+	coreMu.Unlock()
+
+	if geo == nil {
+		geo = newGeoData(config.GetConfig())
+	}
+	if geo == nil {
+		return nil, fmt.Errorf("no geoip-url or geosite-url configured")
+	}
+	var firstErr error
+	for _, st := range geo.Status() {
+		if _, err := geo.Update(ctx, st.Name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return geo.Status(), firstErr
+}
+
+// StopCoreLogic stops the DNS listener and background workers
+func StopCoreLogic() error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return stopCore()
+}
+
+// stopCore stops the running core; coreMu must be held
+func stopCore() error {
+	if coreGRPC != nil {
+		coreGRPC.Stop()
+		coreGRPC = nil
+	}
+	if coreAdmin != nil {
+		coreAdmin.Close()
+		coreAdmin = nil
+	}
+	coreWatch()
+	coreWatch = nil
+	err := coreEng.Stop()
+	closeCache(coreCache)
+	coreEng = nil
+	coreCache = nil
+	coreGeo = nil
+	coreGeoIP.Close()
+	coreGeoIP = nil
+	coreHooks.Close()
+	coreHooks = nil
+	return err
+}
+
+// closeCache releases external cache backends (Redis connections, bolt files)
+func closeCache(cache dnsmasq.CacheBackend) {
+	if closer, ok := cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close cache backend: %v", err)
+		}
+	}
+}
+
+// ReloadRules swaps freshly loaded rules into the running engine without
+// restarting the DNS listener
+func ReloadRules() error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Reload()
+}
+
+// Upstreams returns the state of the running engine's upstream pool, or
+// nil with a single upstream
+func Upstreams() []doh.PoolMember {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Upstreams()
+}
+
+// UpstreamEndpoints returns the state of the addresses the running
+// engine's DoH servers rotate over, or nil without upstream-bootstrap
+func UpstreamEndpoints() []doh.EndpointAddr {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.UpstreamEndpoints()
+}
+
+// Limits returns the running engine's concurrency limits, or nil
+func Limits() []limits.Stats {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Limits()
+}
+
+// HookDrops returns how many events the hook script dropped because it
+// couldn't keep up, and false without a hook-script
+func HookDrops() (uint64, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+	if coreHooks == nil {
+		return 0, false
+	}
+	return coreHooks.Dropped(), true
+}
+
+// UDPStats returns the running listener's UDP counters
+func UDPStats() dnsproxy.UDPStats {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return dnsproxy.UDPStats{}
+	}
+	return coreEng.UDPStats()
+}
+
+// Designated returns the DDR-discovered resolver in use, if any
+func Designated() (ddr.Designated, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return ddr.Designated{}, false
+	}
+	return coreEng.Designated()
+}
+
+// FakeIPs returns the fake addresses handed out, and false when fake-ip
+// mode is off or the core isn't running
+func FakeIPs() ([]fakeip.Mapping, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil, false
+	}
+	return coreEng.FakeIPs()
+}
+
+// NAT64 returns the NAT64 prefix in use, if any
+func NAT64() (netip.Prefix, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return netip.Prefix{}, false
+	}
+	return coreEng.NAT64()
+}
+
+// Offline reports whether the running engine answers from the cache only
+// because no upstream is reachable, and since when
+func Offline() (time.Time, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return time.Time{}, false
+	}
+	return coreEng.Offline()
+}
+
+// CaptivePortal returns the resolver DNS is passed through to while a
+// captive portal is detected, or "" during normal operation
+func CaptivePortal() string {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return ""
+	}
+	return coreEng.CaptivePortal()
+}
+
+// Conflicts returns the VPN clients and services detected managing DNS or
+// routes, and whether the core runs in coexistence mode
+func Conflicts() ([]vpn.Conflict, bool) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil, false
+	}
+	return coreEng.Conflicts()
+}
+
 func IsCoreStarted() bool {
-	return coreStarted
+	coreMu.Lock()
+	defer coreMu.Unlock()
+	return coreEng != nil
 }
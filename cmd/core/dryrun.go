@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// DryRunReport summarizes a dry run
+type DryRunReport struct {
+	Rules    int
+	Domains  int
+	VPN      int
+	Direct   int
+	Failures int
+}
+
+// DryRun exercises the full pipeline (load rules, resolve every domain in
+// domainsFile, compute routing decisions) and writes a report to out.
+// It never binds ports, touches routes or DNS settings, or persists the cache.
+func DryRun(rulePath, domainsFile string, out io.Writer) (DryRunReport, error) {
+	var report DryRunReport
+
+	rules, err := dnsmasq.LoadDomainRules(rulePath)
+	if err != nil {
+		return report, fmt.Errorf("failed to load rule list: %v", err)
+	}
+	report.Rules = len(rules)
+	cfg := config.GetConfig()
+	cnameMatch, err := dnsproxy.ParseCNAMEMatch(cfg.CNAMEMatch)
+	if err != nil {
+		return report, err
+	}
+
+	domains, err := readDomainList(domainsFile)
+	if err != nil {
+		return report, fmt.Errorf("failed to read domain list: %v", err)
+	}
+	report.Domains = len(domains)
+
+	// 干跑时总是保留失败的 CNAME 链，便于排查
+	sn := &dnsproxy.Snapshot{
+		Rules: rules, Cache: dnsmasq.NewCacheWithTTL(10 * time.Minute),
+		CNAMEMatch: cnameMatch, MaxCNAMEDepth: cfg.CNAMEDepth, PartialChain: true,
+	}
+	if db := newGeoIP(cfg); db != nil {
+		defer db.Close()
+		sn.GeoIP = db
+	}
+	resolver := sn.Resolver(nil)
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"Domain", "Decision", "IP", "Latency"})
+	table.SetAutoWrapText(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetBorder(false)
+
+	for _, domain := range domains {
+		start := time.Now()
+		ip, cnames, err := resolver.ResolveChain(domain)
+		latency := time.Since(start).Round(time.Millisecond).String()
+		var shouldRoute bool
+		if err == nil {
+			shouldRoute, _, _ = sn.Decide(domain, cnames, ip, netip.AddrPort{}, start)
+		}
+
+		decision := "DIRECT"
+		switch {
+		case err != nil:
+			decision = "FAILED"
+			ip = err.Error()
+			var chainErr *dnsmasq.ChainError
+			if len(cnames) > 0 && !errors.As(err, &chainErr) {
+				ip += " (via " + strings.Join(cnames, " ➜ ") + ")"
+			}
+			report.Failures++
+		case shouldRoute:
+			decision = "VPN"
+			report.VPN++
+		default:
+			report.Direct++
+		}
+		table.Append([]string{domain, decision, ip, latency})
+	}
+	table.Render()
+
+	fmt.Fprintf(out, "\nRules: %d | Domains: %d | VPN: %d | Direct: %d | Failed: %d\n",
+		report.Rules, report.Domains, report.VPN, report.Direct, report.Failures)
+	return report, nil
+}
+
+func readDomainList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, scanner.Err()
+}
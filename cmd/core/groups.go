@@ -0,0 +1,40 @@
+package core
+
+import (
+	"fmt"
+
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/engine"
+)
+
+// ruleGroups returns the engine rule groups of the group sections of cfg
+func ruleGroups(cfg config.AppConfig) []engine.RuleGroup {
+	groups := make([]engine.RuleGroup, len(cfg.RuleGroups))
+	for i, g := range cfg.RuleGroups {
+		groups[i] = engine.RuleGroup{Name: g.Name, Paths: g.Rules, Enabled: g.Enabled}
+	}
+	return groups
+}
+
+// RuleGroups returns the state of the running core's rule groups
+func RuleGroups() []engine.RuleGroupStatus {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.RuleGroups()
+}
+
+// SetRuleGroup enables or disables a rule group of the running core. The
+// toggle is kept across restarts in rule-groups-state.
+func SetRuleGroup(name string, enabled bool) error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	return coreEng.SetRuleGroup(name, enabled)
+}
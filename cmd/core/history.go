@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"openvpnadvanced/analytics"
+	"openvpnadvanced/audit"
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/history"
+	"openvpnadvanced/querylog"
+)
+
+// historyRetention returns the query history retention of cfg
+func historyRetention(cfg config.AppConfig) history.Retention {
+	return history.Retention{MaxAge: cfg.HistoryMaxAge, MaxRows: cfg.HistoryRows}
+}
+
+// queryLogOptions returns the query log settings, nil when it's off
+func queryLogOptions(cfg config.AppConfig) *querylog.Options {
+	if !cfg.QueryLog {
+		return nil
+	}
+	return &querylog.Options{
+		Size:    cfg.QueryLogSize,
+		File:    cfg.QueryLogFile,
+		MaxSize: int64(cfg.QueryLogMaxMB) << 20,
+		Backups: cfg.QueryLogKeep,
+	}
+}
+
+// QueryLog returns the latest resolutions of the running core matching f,
+// newest first
+func QueryLog(f querylog.Filter) ([]querylog.Entry, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.QueryLog(f)
+}
+
+// ExportQueryLog writes the resolutions of the running core matching f to
+// path as JSON lines, oldest first
+func ExportQueryLog(path string, f querylog.Filter) (int, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return 0, fmt.Errorf("core logic is not running")
+	}
+	var buf bytes.Buffer
+	n, err := coreEng.ExportQueryLog(&buf, f)
+	if err != nil {
+		return 0, err
+	}
+	err = os.WriteFile(path, buf.Bytes(), 0600)
+	audit.Record(audit.FileWrite, path, "query log export", err)
+	return n, err
+}
+
+// History returns the query history entries matching f, newest first. The
+// database named by history-db is read directly while the core is stopped.
+func History(f history.Filter) ([]history.Entry, error) {
+	var entries []history.Entry
+	err := withHistory(func(store *history.Store) (err error) {
+		entries, err = store.Query(f)
+		return err
+	})
+	return entries, err
+}
+
+// Analytics reports the top domains, rule coverage and suggested rules of
+// the query history over the last window
+func Analytics(window time.Duration) (analytics.Report, error) {
+	var stats []history.DomainStats
+	err := withHistory(func(store *history.Store) (err error) {
+		stats, err = store.Stats(time.Now().Add(-window))
+		return err
+	})
+	if err != nil {
+		return analytics.Report{}, err
+	}
+	return analytics.Analyze(stats, analytics.Options{}), nil
+}
+
+// withHistory calls fn with the running core's query history, or with the
+// database named by history-db while the core is stopped
+func withHistory(fn func(*history.Store) error) error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng != nil {
+		return coreEng.WithHistory(fn)
+	}
+	cfg := config.GetConfig()
+	if cfg.HistoryDB == "" {
+		return fmt.Errorf("query history is off; set history-db in the configuration")
+	}
+	store, err := history.Open(cfg.HistoryDB, historyRetention(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return fn(store)
+}
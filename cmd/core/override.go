@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"openvpnadvanced/dnsproxy"
+)
+
+// Override pins the domains under suffix to egress (DIRECT, VPN or an
+// action) for ttl, or until cleared when ttl is 0. Overrides live in the
+// running core only and are lost when it stops.
+func Override(suffix, egress string, ttl time.Duration) (dnsproxy.Override, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return dnsproxy.Override{}, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Override(suffix, egress, ttl)
+}
+
+// ClearOverride removes the override for suffix
+func ClearOverride(suffix string) error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	if !coreEng.ClearOverride(suffix) {
+		return fmt.Errorf("no override for %s", suffix)
+	}
+	return nil
+}
+
+// Overrides returns the running core's active overrides
+func Overrides() []dnsproxy.Override {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Overrides()
+}
+
+// FlushCache drops the cached answers of the domains matching pattern (a
+// suffix, a glob or empty for all) and withdraws their routes
+func FlushCache(pattern string) (int, []string, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return 0, nil, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.FlushCache(pattern)
+}
+
+// Kill closes the live connections to an address or to the routed
+// addresses of a domain suffix, returning the addresses killed
+func Kill(target string) ([]string, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Kill(target)
+}
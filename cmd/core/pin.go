@@ -0,0 +1,46 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"openvpnadvanced/dnsproxy"
+)
+
+// Pin answers domain with ip, or the address it resolves to now when ip
+// is empty, for ttl or until cleared when ttl is 0. Pins live in the
+// running core only and are lost when it stops.
+func Pin(domain, ip string, ttl time.Duration) (dnsproxy.Pin, error) {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return dnsproxy.Pin{}, fmt.Errorf("core logic is not running")
+	}
+	return coreEng.Pin(domain, ip, ttl)
+}
+
+// Unpin removes the pin of domain
+func Unpin(domain string) error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	if !coreEng.Unpin(domain) {
+		return fmt.Errorf("no pin for %s", domain)
+	}
+	return nil
+}
+
+// Pins returns the running core's active pins
+func Pins() []dnsproxy.Pin {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Pins()
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/cmd/logger"
+	"openvpnadvanced/filewatch"
+)
+
+// liveSettings are the AppConfig fields read on use rather than when the
+// core starts, so a reload applies them at once
+var liveSettings = map[string]bool{
+	"AutoSubscribe": true,
+	"LogLevel":      true,
+	"LogModules":    true,
+	"Rollback":      true,
+	"ReplayRecord":  true,
+	"Presets":       true,
+}
+
+var coreWatch context.CancelFunc
+
+// Reload re-reads the configuration file and, while the core runs, its rules, and logs
+// what changed. The new settings replace the old ones at once; on error
+// both stay as they were. Settings read when the core starts only apply
+// after a restart, which Reload reports. Routes and connections are left
+// alone.
+func Reload() error {
+	prev := config.GetConfig()
+	path := config.Path()
+	if err := config.Load(path); err != nil {
+		return fmt.Errorf("failed to reload %s: %v", path, err)
+	}
+	next := config.GetConfig()
+	if err := logger.Apply(next.LogLevel, next.LogModules); err != nil {
+		log.Printf("⚠️ Failed to apply the log levels: %v", err)
+	}
+	live, restart := configChanges(prev, next)
+	if len(live)+len(restart) > 0 {
+		log.Printf("🔄 Config reloaded, changed: %s", strings.Join(append(live, restart...), ", "))
+	}
+	if len(restart) > 0 {
+		log.Printf("⚠️ Restart the core to apply: %s", strings.Join(restart, ", "))
+	}
+
+	coreMu.Lock()
+	defer coreMu.Unlock()
+	if coreEng == nil {
+		return nil
+	}
+	return coreEng.Reload()
+}
+
+// configChanges returns the names of the settings that differ between
+// prev and next, split into those applied live and those needing a restart
+func configChanges(prev, next config.AppConfig) (live, restart []string) {
+	a, b := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := 0; i < a.NumField(); i++ {
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		name := a.Type().Field(i).Name
+		if liveSettings[name] {
+			live = append(live, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return live, restart
+}
+
+// watchReload calls Reload on SIGHUP, and when the configuration file is
+// edited with hot-reload on, until ctx is canceled
+func watchReload(ctx context.Context, hot bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	edited := make(chan struct{}, 1)
+	if hot {
+		go func() {
+			err := filewatch.Watch(ctx, []string{config.Path()}, filewatch.DefaultDelay, func([]string) {
+				select {
+				case edited <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("⚠️ Stopped watching %s: %v", config.Path(), err)
+			}
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("🔄 SIGHUP received, reloading")
+		case <-edited:
+			log.Printf("🔄 %s changed, reloading", config.Path())
+		}
+		if err := Reload(); err != nil {
+			log.Printf("⚠️ Reload failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+	"io"
+
+	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/exprrules"
+	"openvpnadvanced/replay"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Replay re-runs the routing decisions of a recording (see replay-record)
+// against the rules currently in rulePath and writes the queries whose
+// decision changed to out. Nothing is resolved, routed or persisted.
+func Replay(rulePath, recordPath string, out io.Writer) (replay.Report, error) {
+	rules, err := dnsmasq.LoadDomainRules(rulePath)
+	if err != nil {
+		return replay.Report{}, fmt.Errorf("failed to load rule list: %v", err)
+	}
+	exprs, err := exprrules.LoadFile(rulePath)
+	if err != nil {
+		return replay.Report{}, fmt.Errorf("failed to load expression rules: %v", err)
+	}
+	cfg := config.GetConfig()
+	cnameMatch, err := dnsproxy.ParseCNAMEMatch(cfg.CNAMEMatch)
+	if err != nil {
+		return replay.Report{}, err
+	}
+	sn := &dnsproxy.Snapshot{Rules: rules, Exprs: exprs, CNAMEMatch: cnameMatch}
+	if db := newGeoIP(cfg); db != nil {
+		defer db.Close()
+		sn.GeoIP = db
+	}
+
+	report, err := replay.RunFile(recordPath, sn.Decide)
+	if err != nil {
+		return report, fmt.Errorf("failed to replay %s: %v", recordPath, err)
+	}
+
+	if len(report.Diffs) > 0 {
+		table := tablewriter.NewWriter(out)
+		table.SetHeader([]string{"Time", "Domain", "IP", "Recorded", "Now", "Rule"})
+		table.SetAutoWrapText(false)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetBorder(false)
+		for _, d := range report.Diffs {
+			rule := d.Rule
+			if d.Err != nil {
+				rule = d.Err.Error()
+			}
+			table.Append([]string{
+				d.Record.Time.Format("2006-01-02 15:04:05"),
+				d.Record.Domain,
+				d.Record.IP,
+				decisionString(d.Record.Route, d.Record.Action),
+				decisionString(d.Route, d.Action),
+				rule,
+			})
+		}
+		table.Render()
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintf(out, "Recorded: %d | Unchanged: %d | Changed: %d | Failed (skipped): %d\n",
+		report.Total, report.Unchanged, len(report.Diffs), report.Skipped)
+	return report, nil
+}
+
+// decisionString renders a routing decision as VPN, DIRECT or the action name
+func decisionString(route bool, action string) string {
+	switch {
+	case !route:
+		return "DIRECT"
+	case action != "":
+		return action
+	default:
+		return "VPN"
+	}
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"openvpnadvanced/handoff"
+)
+
+// Upgrade hands the DNS listener over to a fresh start of the executable,
+// which may have been replaced since, and returns once it serves; the
+// calling process should exit then. The core is stopped first, saving the
+// cache and state-file for the new process, while the sockets stay open:
+// queries arriving meanwhile wait in their buffers. When the new process
+// fails, the core starts again on the same sockets.
+func Upgrade() error {
+	coreMu.Lock()
+	defer coreMu.Unlock()
+
+	if coreEng == nil {
+		return fmt.Errorf("core logic is not running")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files, err := coreEng.Handoff()
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	if err := stopCore(); err != nil {
+		log.Printf("⚠️ Failed to stop core logic cleanly: %v", err)
+	}
+	err = handoff.Start(files, []string{exe, "--start"}, handoff.DefaultTimeout)
+	if err == nil {
+		log.Printf("DNS listener handed over to the new process")
+		return nil
+	}
+	log.Printf("⚠️ Upgrade failed, resuming: %v", err)
+	sockets, serr := files.Sockets()
+	if serr == nil {
+		serr = runCore(false, sockets)
+	}
+	if serr != nil {
+		sockets.Close()
+		return fmt.Errorf("%v; failed to resume: %v", err, serr)
+	}
+	return err
+}
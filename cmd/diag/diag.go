@@ -0,0 +1,216 @@
+package diag
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/version"
+)
+
+// logTailLines is how many trailing lines of each log file go into the bundle
+const logTailLines = 500
+
+var logFiles = []string{"logs/app.log", "logs/err.log", "logs/vpn.log"}
+
+// probeDomains are resolved through the DoH upstream to check reachability
+var probeDomains = []string{"example.com", "cloudflare.com", "google.com"}
+
+// sensitiveKeys are config keys whose values are redacted in the bundle
+var sensitiveKeys = []string{"password", "secret", "token", "auth"}
+
+type section struct {
+	name    string
+	collect func() (string, error)
+}
+
+// Export collects sanitized config, recent logs, rule stats, routing and
+// interface snapshots and upstream probe results into a zip archive at path.
+func Export(path, configPath, rulePath string) (err error) {
+	defer func() { audit.Record(audit.FileWrite, path, "diagnostics bundle", err) }()
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+
+	sections := []section{
+		{"summary.txt", collectSummary},
+		{filepath.Base(configPath), func() (string, error) { return collectConfig(configPath) }},
+		{"rules.txt", func() (string, error) { return collectRuleStats(rulePath) }},
+		{"routes.txt", collectRoutes},
+		{"interfaces.txt", collectInterfaces},
+		{"upstream.txt", collectUpstream},
+	}
+	for _, logPath := range logFiles {
+		sections = append(sections, section{
+			name:    strings.TrimPrefix(logPath, "logs/"),
+			collect: func() (string, error) { return tailFile(logPath, logTailLines) },
+		})
+	}
+
+	for _, s := range sections {
+		content, err := s.collect()
+		if err != nil {
+			// 单个部分失败不影响整个诊断包
+			content = fmt.Sprintf("collection failed: %v\n", err)
+		}
+		w, err := zw.Create(s.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func collectSummary() (string, error) {
+	var b strings.Builder
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&b, "Generated: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Version:   %s\n", version.String())
+	fmt.Fprintf(&b, "Hostname:  %s\n", hostname)
+	fmt.Fprintf(&b, "Platform:  %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "Go:        %s\n", runtime.Version())
+	return b.String(), nil
+}
+
+// collectConfig returns the config file with sensitive values redacted
+func collectConfig(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// INI 和 TOML 用 "="，YAML 用 ":"
+		if i := strings.IndexAny(line, "=:"); i > 0 && isSensitive(line[:i]) {
+			line = strings.TrimRight(line[:i], " ") + " " + line[i:i+1] + " <redacted>"
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String(), scanner.Err()
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(strings.TrimSpace(key))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectRuleStats counts rule lines per rule type
+func collectRuleStats(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	counts := make(map[string]int)
+	total := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ruleType, _, _ := strings.Cut(line, ",")
+		counts[ruleType]++
+		total++
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rule file: %s\n", path)
+	fmt.Fprintf(&b, "Total:     %d\n", total)
+	for _, t := range types {
+		fmt.Fprintf(&b, "  %-16s %d\n", t, counts[t])
+	}
+	return b.String(), nil
+}
+
+func collectRoutes() (string, error) {
+	out, err := exec.Command("netstat", "-rn").CombinedOutput()
+	return string(out), err
+}
+
+func collectInterfaces() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, iface := range ifaces {
+		fmt.Fprintf(&b, "%s mtu=%d flags=%s\n", iface.Name, iface.MTU, iface.Flags)
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			fmt.Fprintf(&b, "   ➜ %s\n", addr.String())
+		}
+	}
+	return b.String(), nil
+}
+
+// collectUpstream resolves the probe domains and records latency and errors
+func collectUpstream() (string, error) {
+	var b strings.Builder
+	for _, domain := range probeDomains {
+		start := time.Now()
+		ip, err := doh.Query(domain)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Fprintf(&b, "%-16s FAIL %v (%s)\n", domain, err, elapsed)
+			continue
+		}
+		fmt.Fprintf(&b, "%-16s OK   %s (%s)\n", domain, ip, elapsed)
+	}
+	return b.String(), nil
+}
+
+// tailFile returns the last n lines of a file
+func tailFile(path string, n int) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
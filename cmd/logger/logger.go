@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+
+	"openvpnadvanced/logging"
 )
 
 var (
 	logFile    *os.File
 	errLogFile *os.File
 	vpnLogFile *os.File
+	// std receives the log package's output once Setup ran
+	std *logging.Logger
 )
 
 func Init() error {
@@ -32,6 +36,43 @@ func Init() error {
 	return nil
 }
 
+// Setup routes the log package's output through a leveled logger writing
+// to standard error in format (plain, text or json)
+func Setup(format string) error {
+	l, err := logging.New(os.Stderr, format)
+	if err != nil {
+		return err
+	}
+	std = l
+	log.SetFlags(0)
+	log.SetOutput(l)
+	return nil
+}
+
+// Apply sets the level of every module, and of those listed as
+// "module=level" their own; it takes effect at once
+func Apply(level string, modules []string) error {
+	if std == nil {
+		return fmt.Errorf("logging is not set up")
+	}
+	lvl, err := logging.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	mods, err := logging.ParseModules(modules)
+	if err != nil {
+		return err
+	}
+	std.SetLevel(lvl)
+	std.SetModules(mods)
+	return nil
+}
+
+// Logger returns the logger Setup installed, nil before
+func Logger() *logging.Logger {
+	return std
+}
+
 func SetOutput(verbose bool) {
 	if !verbose {
 		log.SetOutput(logFile)
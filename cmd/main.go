@@ -4,13 +4,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 
+	"openvpnadvanced/audit"
 	"openvpnadvanced/cmd/cli"
 	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/cmd/core"
 	"openvpnadvanced/cmd/logger"
+	"openvpnadvanced/handoff"
+	"openvpnadvanced/privhelper"
+	"openvpnadvanced/version"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Println(version.String())
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "--helper" {
+		runHelper(os.Args[2:])
+		return
+	}
+
 	// Ensure logs directory exists
 	if _, err := os.Stat("logs"); os.IsNotExist(err) {
 		_ = os.Mkdir("logs", 0755)
@@ -23,16 +39,88 @@ func main() {
 	defer logger.Close()
 
 	// Load configuration
-	if err := config.LoadINIConfig("config.ini"); err != nil {
-		log.Fatalf("Failed to load config.ini: %v", err)
+	// 依次查找 config.yaml、config.yml、config.toml 和 config.ini
+	if err := config.Load(config.Find()); err != nil {
+		log.Fatalf("Failed to load configuration:\n%v", err)
+	}
+	cfg := config.GetConfig()
+	if err := logger.Setup(cfg.LogFormat); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	if err := logger.Apply(cfg.LogLevel, cfg.LogModules); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	// 审计日志独立于调试日志，clear-logs 不会清空它
+	if path := config.GetConfig().AuditLog; path != "" {
+		auditLog, err := audit.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+		defer audit.SetDefault(auditLog)()
 	}
 
 	if len(os.Args) > 1 && os.Args[1] == "--start" {
+		// 由 upgrade 启动时直接接管监听
+		if handoff.Pending() {
+			if err := core.RunCoreLogic(false); err != nil {
+				log.Fatalf("Failed to take over the DNS listener: %v", err)
+			}
+		}
 		cli.StartConsole()
+	} else if len(os.Args) > 1 && os.Args[1] == "--dry-run" {
+		domainsFile := "assets/dryrun_domains.txt"
+		if len(os.Args) > 2 {
+			domainsFile = os.Args[2]
+		}
+		report, err := core.DryRun("assets/merged_rule.list", domainsFile, os.Stdout)
+		if err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		if report.Failures > 0 {
+			os.Exit(1)
+		}
+	} else if len(os.Args) > 1 && os.Args[1] == "--replay" {
+		recordPath := config.GetConfig().ReplayRecord
+		if len(os.Args) > 2 {
+			recordPath = os.Args[2]
+		}
+		if recordPath == "" {
+			log.Fatalf("No recording given and replay-record is not set")
+		}
+		report, err := core.Replay("assets/merged_rule.list", recordPath, os.Stdout)
+		if err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		if len(report.Diffs) > 0 {
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println(`Usage:
   sudo ./openvpnadvanced --start     Launch interactive console
+  ./openvpnadvanced --dry-run [file] Resolve a domain list and report decisions without changing the system
+  ./openvpnadvanced --replay [file]  Re-run recorded decisions against the current rules and show changes
+  sudo ./openvpnadvanced --helper [socket] [uid]  Run the privileged helper
+  ./openvpnadvanced --version        Show version information
   sudo ./openvpnadvanced             Show this help message`)
 		os.Exit(0)
 	}
 }
+
+// runHelper starts the privileged helper: --helper [socket] [uid]
+func runHelper(args []string) {
+	socketPath := "/var/run/openvpnadvanced.sock"
+	if len(args) > 0 {
+		socketPath = args[0]
+	}
+	uid := -1
+	if len(args) > 1 {
+		uid, _ = strconv.Atoi(args[1])
+	} else if sudoUID := os.Getenv("SUDO_UID"); sudoUID != "" {
+		uid, _ = strconv.Atoi(sudoUID)
+	}
+	if err := privhelper.Serve(socketPath, uid); err != nil {
+		log.Fatalf("Privileged helper failed: %v", err)
+	}
+}
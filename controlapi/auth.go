@@ -0,0 +1,60 @@
+package controlapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// auth enforces the admin API's rule on every call: with a token, the
+// call must carry "authorization: Bearer <token>" metadata; without one,
+// only Unix socket and loopback clients are served
+type auth struct {
+	token string
+}
+
+func (a auth) check(ctx context.Context) error {
+	if a.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			got, ok := strings.CutPrefix(v, "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "a bearer token is required")
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "unknown client")
+	}
+	if _, unix := p.Addr.(*net.UnixAddr); unix {
+		return nil
+	}
+	if addr, err := netip.ParseAddrPort(p.Addr.String()); err == nil && addr.Addr().Unmap().IsLoopback() {
+		return nil
+	}
+	return status.Error(codes.PermissionDenied, "only local clients are served without admin-token")
+}
+
+func (a auth) unary(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := a.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a auth) stream(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
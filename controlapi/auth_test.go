@@ -0,0 +1,42 @@
+package controlapi
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuth(t *testing.T) {
+	from := func(addr net.Addr, md ...string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(md...))
+	}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5000}
+	socket := &net.UnixAddr{Name: "@", Net: "unix"}
+
+	tests := []struct {
+		name  string
+		token string
+		ctx   context.Context
+		want  codes.Code
+	}{
+		{"loopback without token", "", from(loopback), codes.OK},
+		{"unix socket without token", "", from(socket), codes.OK},
+		{"remote without token", "", from(remote), codes.PermissionDenied},
+		{"remote with token", "s3cret", from(remote, "authorization", "Bearer s3cret"), codes.OK},
+		{"wrong token", "s3cret", from(remote, "authorization", "Bearer nope"), codes.Unauthenticated},
+		{"loopback missing token", "s3cret", from(loopback), codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		err := auth{token: tt.token}.check(tt.ctx)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: got %v (%v), want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Package controlapi implements the gRPC Control service described in
+// control.proto, letting infrastructure tooling manage fleets of daemons
+// with typed clients generated from the published proto.
+package controlapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/engine"
+	"openvpnadvanced/querylog"
+	"openvpnadvanced/version"
+	"openvpnadvanced/vpn"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements ControlServer on top of an engine
+type Server struct {
+	UnimplementedControlServer
+	eng *engine.Engine
+}
+
+// NewServer returns a Control service for eng
+func NewServer(eng *engine.Engine) *Server {
+	return &Server{eng: eng}
+}
+
+// Listen serves the Control service on addr, a host:port or a
+// "unix:/path" socket (created with mode 0600). Calls are authorized like
+// the admin API's: with token they must carry it as a bearer token,
+// without it only local clients are served. It returns once listening;
+// call GracefulStop on the returned server to shut it down.
+func Listen(addr string, eng *engine.Engine, token string) (*grpc.Server, error) {
+	var lis net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		lis, err = listenUnix(path)
+	} else {
+		lis, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := auth{token: token}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(a.unary), grpc.StreamInterceptor(a.stream))
+	RegisterControlServer(srv, NewServer(eng))
+	go srv.Serve(lis)
+	return srv, nil
+}
+
+func (s *Server) status() *Status {
+	info := version.Get()
+	return &Status{
+		Version:         info.Version,
+		Commit:          info.Commit,
+		Running:         s.eng.Running(),
+		Rules:           int64(s.eng.RuleCount()),
+		CacheEntries:    int64(len(s.eng.Cache().Raw())),
+		RejectedQueries: s.eng.Rejected(),
+	}
+}
+
+// GetStatus reports the daemon version and engine state
+func (s *Server) GetStatus(ctx context.Context, _ *GetStatusRequest) (*Status, error) {
+	return s.status(), nil
+}
+
+// Start starts the engine; starting a running engine is not an error
+func (s *Server) Start(ctx context.Context, _ *StartRequest) (*Status, error) {
+	if err := s.eng.Start(); err != nil && !errors.Is(err, engine.ErrAlreadyRunning) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s.status(), nil
+}
+
+// Stop stops the engine
+func (s *Server) Stop(ctx context.Context, _ *StopRequest) (*Status, error) {
+	if err := s.eng.Stop(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s.status(), nil
+}
+
+// Resolve resolves a domain through the engine
+func (s *Server) Resolve(ctx context.Context, req *ResolveRequest) (*ResolveResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	res, viaVPN, err := s.eng.ResolveFull(req.GetDomain())
+	if err != nil {
+		return nil, status.Error(resolveCode(err), err.Error())
+	}
+	resp := &ResolveResponse{Domain: req.GetDomain(), ViaVpn: viaVPN, Cnames: res.CNAMEs}
+	for _, a := range append(res.A, res.AAAA...) {
+		resp.Addresses = append(resp.Addresses, &ResolvedAddress{Ip: a.IP, TtlSeconds: int64(a.TTL / time.Second)})
+	}
+	if len(resp.Addresses) > 0 {
+		resp.Ip = resp.Addresses[0].Ip
+	}
+	if res.Matched {
+		resp.Rule, resp.Action = res.Rule.Suffix, res.Rule.Action
+	}
+	return resp, nil
+}
+
+// resolveCode maps resolver errors onto gRPC status codes
+func resolveCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, dnsmasq.ErrNXDomain), errors.Is(err, dnsmasq.ErrNoAnswer):
+		return codes.NotFound
+	case errors.Is(err, dnsmasq.ErrUpstreamTimeout):
+		return codes.DeadlineExceeded
+	case errors.Is(err, dnsmasq.ErrCircularCNAME):
+		return codes.FailedPrecondition
+	default:
+		return codes.Unavailable
+	}
+}
+
+// Match reports whether a domain matches the rules
+func (s *Server) Match(ctx context.Context, req *MatchRequest) (*MatchResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	return &MatchResponse{Matched: s.eng.Match(req.GetDomain())}, nil
+}
+
+// ListCache returns the cached answers
+func (s *Server) ListCache(ctx context.Context, _ *ListCacheRequest) (*ListCacheResponse, error) {
+	raw := s.eng.Cache().Raw()
+	resp := &ListCacheResponse{Entries: make([]*CacheEntry, 0, len(raw))}
+	for domain, record := range raw {
+		resp.Entries = append(resp.Entries, &CacheEntry{
+			Domain:        domain,
+			Value:         record.IP,
+			TimestampUnix: record.Timestamp.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+// FlushCache drops the cached answers matching a pattern and withdraws
+// their routes
+func (s *Server) FlushCache(ctx context.Context, req *FlushCacheRequest) (*FlushCacheResponse, error) {
+	n, ips, err := s.eng.FlushCache(req.GetPattern())
+	if err != nil && n == 0 {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &FlushCacheResponse{Entries: int64(n), Ips: ips}, nil
+}
+
+// SetOverride pins a domain suffix to an egress
+func (s *Server) SetOverride(ctx context.Context, req *SetOverrideRequest) (*Override, error) {
+	if req.GetSuffix() == "" || req.GetEgress() == "" {
+		return nil, status.Error(codes.InvalidArgument, "suffix and egress are required")
+	}
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	ov, err := s.eng.Override(req.GetSuffix(), req.GetEgress(), time.Duration(req.GetTtlSeconds())*time.Second)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return toOverride(ov), nil
+}
+
+// ClearOverride removes the override for a suffix
+func (s *Server) ClearOverride(ctx context.Context, req *ClearOverrideRequest) (*ClearOverrideResponse, error) {
+	if req.GetSuffix() == "" {
+		return nil, status.Error(codes.InvalidArgument, "suffix is required")
+	}
+	return &ClearOverrideResponse{Removed: s.eng.ClearOverride(req.GetSuffix())}, nil
+}
+
+// ListOverrides returns the active overrides
+func (s *Server) ListOverrides(ctx context.Context, _ *ListOverridesRequest) (*ListOverridesResponse, error) {
+	list := s.eng.Overrides()
+	resp := &ListOverridesResponse{Overrides: make([]*Override, 0, len(list))}
+	for _, ov := range list {
+		resp.Overrides = append(resp.Overrides, toOverride(ov))
+	}
+	return resp, nil
+}
+
+func toOverride(ov dnsproxy.Override) *Override {
+	out := &Override{Suffix: ov.Suffix, Egress: ov.Egress}
+	if !ov.Expires.IsZero() {
+		out.ExpiresUnix = ov.Expires.Unix()
+	}
+	return out
+}
+
+// SetPin answers a domain with a fixed address
+func (s *Server) SetPin(ctx context.Context, req *SetPinRequest) (*Pin, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	if ip := req.GetIp(); ip != "" {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	pin, err := s.eng.Pin(req.GetDomain(), req.GetIp(), time.Duration(req.GetTtlSeconds())*time.Second)
+	if err != nil {
+		return nil, status.Error(resolveCode(err), err.Error())
+	}
+	return toPin(pin), nil
+}
+
+// ClearPin removes the pin of a domain
+func (s *Server) ClearPin(ctx context.Context, req *ClearPinRequest) (*ClearPinResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	return &ClearPinResponse{Removed: s.eng.Unpin(req.GetDomain())}, nil
+}
+
+// ListPins returns the active pins
+func (s *Server) ListPins(ctx context.Context, _ *ListPinsRequest) (*ListPinsResponse, error) {
+	list := s.eng.Pins()
+	resp := &ListPinsResponse{Pins: make([]*Pin, 0, len(list))}
+	for _, pin := range list {
+		resp.Pins = append(resp.Pins, toPin(pin))
+	}
+	return resp, nil
+}
+
+func toPin(pin dnsproxy.Pin) *Pin {
+	out := &Pin{Domain: pin.Domain, Ip: pin.IP.String()}
+	if !pin.Expires.IsZero() {
+		out.ExpiresUnix = pin.Expires.Unix()
+	}
+	return out
+}
+
+// Kill closes the live connections to an address or domain suffix
+func (s *Server) Kill(ctx context.Context, req *KillRequest) (*KillResponse, error) {
+	if req.GetTarget() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target is required")
+	}
+	ips, err := s.eng.Kill(req.GetTarget())
+	switch {
+	case errors.Is(err, vpn.ErrKillUnsupported):
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	case err != nil && len(ips) == 0:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &KillResponse{Ips: ips}, nil
+}
+
+// ListRuleGroups returns the rule groups
+func (s *Server) ListRuleGroups(ctx context.Context, _ *ListRuleGroupsRequest) (*ListRuleGroupsResponse, error) {
+	groups := s.eng.RuleGroups()
+	resp := &ListRuleGroupsResponse{Groups: make([]*RuleGroup, 0, len(groups))}
+	for _, g := range groups {
+		resp.Groups = append(resp.Groups, toRuleGroup(g))
+	}
+	return resp, nil
+}
+
+// SetRuleGroup enables or disables a rule group
+func (s *Server) SetRuleGroup(ctx context.Context, req *SetRuleGroupRequest) (*RuleGroup, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	err := s.eng.SetRuleGroup(req.GetName(), req.GetEnabled())
+	switch {
+	case errors.Is(err, engine.ErrUnknownGroup):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, g := range s.eng.RuleGroups() {
+		if strings.EqualFold(g.Name, req.GetName()) {
+			return toRuleGroup(g), nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "no such rule group")
+}
+
+// Checkpoint takes a checkpoint the changes roll back to unless confirmed
+func (s *Server) Checkpoint(ctx context.Context, req *CheckpointRequest) (*CheckpointResponse, error) {
+	if req.GetTimeoutSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "timeout_seconds must not be negative")
+	}
+	deadline, err := s.eng.Checkpoint(time.Duration(req.GetTimeoutSeconds()) * time.Second)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &CheckpointResponse{DeadlineUnix: deadline.Unix()}, nil
+}
+
+// Confirm keeps the changes made since the pending checkpoint
+func (s *Server) Confirm(ctx context.Context, _ *ConfirmRequest) (*ConfirmResponse, error) {
+	if err := s.eng.Confirm(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &ConfirmResponse{}, nil
+}
+
+// Rollback reverts the changes made since the pending checkpoint
+func (s *Server) Rollback(ctx context.Context, _ *RollbackRequest) (*RollbackResponse, error) {
+	err := s.eng.Rollback()
+	switch {
+	case errors.Is(err, engine.ErrNoCheckpoint):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &RollbackResponse{}, nil
+}
+
+// ListQueries returns the latest resolutions from the query log
+func (s *Server) ListQueries(ctx context.Context, req *ListQueriesRequest) (*ListQueriesResponse, error) {
+	f := querylog.Filter{
+		Domain: req.GetDomain(), Client: req.GetClient(),
+		Routed: req.GetRouted(), Failed: req.GetFailed(), Limit: int(req.GetLimit()),
+	}
+	if since := req.GetSinceUnix(); since > 0 {
+		f.Since = time.Unix(since, 0)
+	}
+	entries, err := s.eng.QueryLog(f)
+	if errors.Is(err, engine.ErrNoQueryLog) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	resp := &ListQueriesResponse{Queries: make([]*Query, 0, len(entries))}
+	for _, e := range entries {
+		resp.Queries = append(resp.Queries, &Query{
+			TimeUnixNano: e.Time.UnixNano(), Client: e.Client, Domain: e.Domain, Qtype: e.QType,
+			Answers: e.Answers, Rule: e.Rule, Policy: e.Policy, Action: e.Action, Route: e.Route,
+			Upstream: e.Upstream, Source: e.Source, LatencyMicros: e.Latency.Microseconds(), Error: e.Err,
+		})
+	}
+	return resp, nil
+}
+
+func toRuleGroup(g engine.RuleGroupStatus) *RuleGroup {
+	return &RuleGroup{Name: g.Name, Enabled: g.Enabled, Rules: int64(g.Rules)}
+}
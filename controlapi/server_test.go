@@ -0,0 +1,28 @@
+package controlapi
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenSocketMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs Unix socket permissions")
+	}
+	path := filepath.Join(t.TempDir(), "control.sock")
+	srv, err := Listen("unix:"+path, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("socket mode = %o, want 600", mode)
+	}
+}
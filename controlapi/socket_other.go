@@ -0,0 +1,11 @@
+//go:build !unix
+
+package controlapi
+
+import "net"
+
+// listenUnix listens on a Unix socket at path; the platform has no umask
+// to restrict it with
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
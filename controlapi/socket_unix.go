@@ -0,0 +1,16 @@
+//go:build unix
+
+package controlapi
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a Unix socket at path with mode 0600
+func listenUnix(path string) (net.Listener, error) {
+	// 在限制性 umask 下创建，套接字从出现起就是 0600，不存在 chmod 之前的窗口
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
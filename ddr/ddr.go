@@ -0,0 +1,257 @@
+// Package ddr implements Discovery of Designated Resolvers (RFC 9462): the
+// network's unencrypted resolver is asked for the SVCB records of
+// _dns.resolver.arpa, and an advertised DoH endpoint is used only once
+// its TLS certificate proves it's operated by that same resolver
+// (Verified Discovery, RFC 9462 section 4.2).
+package ddr
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// Name is the special-use name designated resolvers are published under
+const Name = "_dns.resolver.arpa."
+
+// ResolvConf is read by SystemResolver
+const ResolvConf = "/etc/resolv.conf"
+
+var (
+	// ErrNotFound is returned when the resolver advertises no usable DoH
+	// endpoint
+	ErrNotFound = errors.New("no designated DoH resolver")
+	// ErrNotDesignated is returned when an endpoint's certificate doesn't
+	// cover the unencrypted resolver's address
+	ErrNotDesignated = errors.New("certificate does not cover the resolver address")
+)
+
+// Designated is an encrypted endpoint advertised by a resolver
+type Designated struct {
+	// Resolver is the unencrypted resolver that advertised the endpoint
+	Resolver netip.Addr
+	// Target is the endpoint's host name, without the trailing dot
+	Target   string
+	Priority uint16
+	// Port is the advertised port, 0 for the protocol default
+	Port uint16
+	ALPN []string
+	// DoHPath is the URI template from the dohpath parameter (RFC 9461)
+	DoHPath string
+	// Hints are the advertised and additional-section addresses of Target
+	Hints []netip.Addr
+}
+
+// DoH reports whether the endpoint speaks DNS over HTTPS over TCP
+func (d Designated) DoH() bool {
+	return d.DoHPath != "" && (slices.Contains(d.ALPN, "h2") || slices.Contains(d.ALPN, "http/1.1"))
+}
+
+// URL returns the DoH endpoint URL, with the {?dns} variable of the
+// template dropped since queries are POSTed
+func (d Designated) URL() string {
+	path, _, _ := strings.Cut(d.DoHPath, "{")
+	host := d.Target
+	if d.Port != 0 && d.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(d.Port)))
+	}
+	return "https://" + host + path
+}
+
+// Discover queries resolver (port 53 when omitted) for its designated
+// resolvers over plain DNS and returns the DoH endpoints among them by
+// priority. They are unverified; see Verify.
+func Discover(ctx context.Context, resolver string) ([]Designated, error) {
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	addr, err := netip.ParseAddrPort(resolver)
+	if err != nil {
+		return nil, fmt.Errorf("resolver must be an IP address: %v", err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(Name, dns.TypeSVCB)
+	client := &dns.Client{Timeout: 3 * time.Second}
+	resp, _, err := client.ExchangeContext(ctx, query, resolver)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, query, resolver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, dns.RcodeToString[resp.Rcode])
+	}
+
+	var found []Designated
+	for _, rr := range resp.Answer {
+		svcb, ok := rr.(*dns.SVCB)
+		// AliasMode 与目标为 "." 的记录无法验证，忽略
+		if !ok || svcb.Priority == 0 || svcb.Target == "." {
+			continue
+		}
+		d := parseSVCB(svcb, addr.Addr().Unmap())
+		d.Hints = append(d.Hints, additionalAddrs(resp.Extra, svcb.Target)...)
+		if d.DoH() {
+			found = append(found, d)
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrNotFound
+	}
+	slices.SortStableFunc(found, func(a, b Designated) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	return found, nil
+}
+
+func parseSVCB(svcb *dns.SVCB, resolver netip.Addr) Designated {
+	d := Designated{
+		Resolver: resolver,
+		Target:   strings.TrimSuffix(svcb.Target, "."),
+		Priority: svcb.Priority,
+	}
+	for _, kv := range svcb.Value {
+		switch v := kv.(type) {
+		case *dns.SVCBAlpn:
+			d.ALPN = v.Alpn
+		case *dns.SVCBPort:
+			d.Port = v.Port
+		case *dns.SVCBDoHPath:
+			d.DoHPath = v.Template
+		case *dns.SVCBIPv4Hint:
+			d.Hints = appendIPs(d.Hints, v.Hint)
+		case *dns.SVCBIPv6Hint:
+			d.Hints = appendIPs(d.Hints, v.Hint)
+		}
+	}
+	return d
+}
+
+func additionalAddrs(extra []dns.RR, target string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range extra {
+		if !strings.EqualFold(rr.Header().Name, target) {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.A:
+			addrs = appendIPs(addrs, []net.IP{v.A})
+		case *dns.AAAA:
+			addrs = appendIPs(addrs, []net.IP{v.AAAA})
+		}
+	}
+	return addrs
+}
+
+func appendIPs(addrs []netip.Addr, ips []net.IP) []netip.Addr {
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok && !slices.Contains(addrs, addr.Unmap()) {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// Upstream returns a DoH upstream for d whose every TLS connection is
+// verified for Target as usual and must also present a certificate
+// covering the unencrypted resolver's IP address. Connections go to the
+// address hints when there are any, so Target needn't be resolvable.
+func (d Designated) Upstream() *doh.Upstream {
+	tlsConfig := &tls.Config{
+		ServerName: d.Target,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrNotDesignated
+			}
+			if err := cs.PeerCertificates[0].VerifyHostname(d.Resolver.String()); err != nil {
+				return fmt.Errorf("%w: %v", ErrNotDesignated, err)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	if len(d.Hints) > 0 {
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			var lastErr error
+			for _, hint := range d.Hints {
+				conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(hint.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+	}
+	return &doh.Upstream{
+		URL:    d.URL(),
+		Client: &http.Client{Timeout: 5 * time.Second, Transport: transport},
+	}
+}
+
+// Verify connects to d and checks it is designated by its resolver by
+// sending one query through Upstream
+func (d Designated) Verify() (*doh.Upstream, error) {
+	up := d.Upstream()
+	if _, err := up.Exchange(".", dns.TypeNS); err != nil {
+		return nil, fmt.Errorf("%s: %w", d.URL(), err)
+	}
+	return up, nil
+}
+
+// Find discovers resolver's designated DoH endpoints and returns the first
+// one that verifies
+func Find(ctx context.Context, resolver string) (Designated, *doh.Upstream, error) {
+	found, err := Discover(ctx, resolver)
+	if err != nil {
+		return Designated{}, nil, err
+	}
+	var errs []error
+	for _, d := range found {
+		up, err := d.Verify()
+		if err == nil {
+			return d, up, nil
+		}
+		errs = append(errs, err)
+	}
+	return Designated{}, nil, errors.Join(errs...)
+}
+
+// SystemResolver returns the first nameserver of ResolvConf that isn't a
+// loopback address (which would usually be this daemon itself)
+func SystemResolver() (string, error) {
+	conf, err := dns.ClientConfigFromFile(ResolvConf)
+	if err != nil {
+		return "", err
+	}
+	for _, server := range conf.Servers {
+		addr, err := netip.ParseAddr(server)
+		if err != nil || addr.IsLoopback() {
+			continue
+		}
+		return net.JoinHostPort(addr.String(), conf.Port), nil
+	}
+	return "", fmt.Errorf("no non-loopback nameserver in %s", ResolvConf)
+}
@@ -0,0 +1,120 @@
+package dnscrypt
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Encryption systems (es-version) of DNSCrypt v2 certificates
+const (
+	XSalsa20Poly1305  uint16 = 0x0001
+	XChaCha20Poly1305 uint16 = 0x0002
+)
+
+// tagSize is the Poly1305 tag prepended to every sealed message
+const tagSize = poly1305.TagSize
+
+// sharedKey derives the symmetric key for es from our secret key and the
+// resolver's public key
+func sharedKey(es uint16, secret, peer *[32]byte) ([32]byte, bool) {
+	var key [32]byte
+	switch es {
+	case XSalsa20Poly1305:
+		box.Precompute(&key, peer, secret)
+	case XChaCha20Poly1305:
+		dh, err := curve25519.X25519(secret[:], peer[:])
+		if err != nil {
+			return key, false
+		}
+		sub, err := chacha20.HChaCha20(dh, make([]byte, 16))
+		if err != nil {
+			return key, false
+		}
+		copy(key[:], sub)
+	default:
+		return key, false
+	}
+	return key, true
+}
+
+// seal encrypts msg with the secretbox construction of es: the Poly1305
+// tag followed by the ciphertext
+func seal(es uint16, msg []byte, nonce *[24]byte, key *[32]byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+	// 与 libsodium crypto_secretbox_xchacha20poly1305 相同：
+	// 第一个密钥流块的前 32 字节作为 Poly1305 密钥
+	cipher, polyKey := xchacha(nonce, key)
+	out := make([]byte, tagSize+len(msg))
+	cipher.XORKeyStream(out[tagSize:], msg)
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, out[tagSize:], &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// open authenticates and decrypts a message produced by seal
+func open(es uint16, sealed []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	if es == XSalsa20Poly1305 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+	if len(sealed) < tagSize {
+		return nil, false
+	}
+	cipher, polyKey := xchacha(nonce, key)
+	var tag [tagSize]byte
+	copy(tag[:], sealed)
+	if !poly1305.Verify(&tag, sealed[tagSize:], &polyKey) {
+		return nil, false
+	}
+	out := make([]byte, len(sealed)-tagSize)
+	cipher.XORKeyStream(out, sealed[tagSize:])
+	return out, true
+}
+
+// xchacha returns an XChaCha20 stream positioned after the Poly1305 key,
+// i.e. at byte 32 of the first block
+func xchacha(nonce *[24]byte, key *[32]byte) (*chacha20.Cipher, [32]byte) {
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		panic(err) // 密钥与 nonce 长度固定，不会出错
+	}
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	return cipher, polyKey
+}
+
+// pad appends ISO/IEC 7816-4 padding up to a multiple of 64 bytes and at
+// least min bytes
+func pad(msg []byte, min int) []byte {
+	n := max(len(msg)+1, min)
+	n = (n + 63) &^ 63
+	out := make([]byte, n)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+// unpad strips the padding added by pad
+func unpad(msg []byte) ([]byte, bool) {
+	for i := len(msg) - 1; i >= 0; i-- {
+		switch msg[i] {
+		case 0:
+			continue
+		case 0x80:
+			return msg[:i], true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,116 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// certMagic starts every resolver certificate
+const certMagic = "DNSC"
+
+// certSize is the size of a certificate without extensions
+const certSize = 124
+
+// ErrCert is returned when a resolver publishes no valid certificate
+var ErrCert = errors.New("no valid DNSCrypt certificate")
+
+// Cert is a verified resolver certificate
+type Cert struct {
+	// ES is the encryption system, XSalsa20Poly1305 or XChaCha20Poly1305
+	ES          uint16
+	ResolverKey [32]byte
+	ClientMagic [8]byte
+	Serial      uint32
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// Valid reports whether the certificate may be used at t
+func (c *Cert) Valid(t time.Time) bool {
+	return !t.Before(c.NotBefore) && t.Before(c.NotAfter)
+}
+
+// ParseCert decodes a binary certificate and verifies its signature with
+// the provider's public key
+func ParseCert(raw []byte, key ed25519.PublicKey) (*Cert, error) {
+	if len(raw) < certSize || string(raw[:4]) != certMagic {
+		return nil, errors.New("not a DNSCrypt certificate")
+	}
+	if minor := binary.BigEndian.Uint16(raw[6:]); minor != 0 {
+		return nil, fmt.Errorf("unsupported protocol minor version %d", minor)
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, raw[72:], raw[8:72]) {
+		return nil, errors.New("bad certificate signature")
+	}
+	c := &Cert{
+		ES:        binary.BigEndian.Uint16(raw[4:]),
+		Serial:    binary.BigEndian.Uint32(raw[112:]),
+		NotBefore: time.Unix(int64(binary.BigEndian.Uint32(raw[116:])), 0),
+		NotAfter:  time.Unix(int64(binary.BigEndian.Uint32(raw[120:])), 0),
+	}
+	if c.ES != XSalsa20Poly1305 && c.ES != XChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported encryption system %d", c.ES)
+	}
+	copy(c.ResolverKey[:], raw[72:104])
+	copy(c.ClientMagic[:], raw[104:112])
+	return c, nil
+}
+
+// bestCert returns the valid certificate with the highest serial among the
+// TXT answers of resp, preferring XChaCha20 on a tie
+func bestCert(resp *dns.Msg, key ed25519.PublicKey, now time.Time) (*Cert, error) {
+	var best *Cert
+	var lastErr error = ErrCert
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		c, err := ParseCert(unescapeTXT(strings.Join(txt.Txt, "")), key)
+		if err != nil {
+			lastErr = fmt.Errorf("%w: %v", ErrCert, err)
+			continue
+		}
+		if !c.Valid(now) {
+			lastErr = fmt.Errorf("%w: certificate %d expired or not yet valid", ErrCert, c.Serial)
+			continue
+		}
+		if best == nil || c.Serial > best.Serial || c.Serial == best.Serial && c.ES > best.ES {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// unescapeTXT reverses the presentation escaping (\DDD and \X) miekg/dns
+// applies to TXT data, recovering the binary certificate
+func unescapeTXT(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			out = append(out, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,287 @@
+// Package dnscrypt is a DNSCrypt v2 client (https://dnscrypt.info/protocol)
+// usable as a doh.Transport. Queries are encrypted to the resolver's
+// short-term key, taken from a certificate signed with the provider's
+// long-term Ed25519 key (the one pinned in its DNS stamp).
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// resolverMagic starts every encrypted response
+const resolverMagic = "r6fnvWj8"
+
+// anonMagic prefixes queries sent through an Anonymized DNSCrypt relay,
+// followed by the server's IPv6 (or IPv4-mapped) address and port
+var anonMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// minUDPQuery is the minimum padded size of a UDP query
+const minUDPQuery = 256
+
+// ErrDecrypt is returned for responses that fail authentication, e.g.
+// after the resolver rotated its key
+var ErrDecrypt = errors.New("DNSCrypt response failed to decrypt")
+
+// Client sends queries to one DNSCrypt resolver
+type Client struct {
+	// Addr is the resolver's IP address and port
+	Addr string
+	// ProviderName is the name certificates are published under, e.g.
+	// 2.dnscrypt-cert.example.com
+	ProviderName string
+	// PublicKey is the provider's key certificates are signed with
+	PublicKey ed25519.PublicKey
+	// Relays are Anonymized DNSCrypt relays (IP:port). When set, every
+	// packet, including certificate queries, goes through one picked at
+	// random, so the resolver never sees the client's address and the
+	// relay never sees the query. Each relayed query also uses a fresh
+	// key pair so the resolver can't link them. Addr must then be an IP
+	// address.
+	Relays []string
+	// Control, when set, is applied to every socket before it connects
+	// (see net.Dialer.Control)
+	Control func(network, address string, c syscall.RawConn) error
+	// ControlContext, when set, is used instead of Control (see
+	// net.Dialer.ControlContext)
+	ControlContext func(ctx context.Context, network, address string, c syscall.RawConn) error
+
+	mu      sync.Mutex
+	current *session
+}
+
+// session is the key material derived from one certificate
+type session struct {
+	cert   *Cert
+	public [32]byte
+	shared [32]byte
+}
+
+// RoundTrip encrypts a packed query, sends it over UDP (retrying over TCP
+// when the answer is truncated) and returns the decrypted response
+func (c *Client) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(ctx, s, query, "udp")
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		resp, err = c.exchange(ctx, s, query, "tcp")
+	}
+	if errors.Is(err, ErrDecrypt) {
+		// 证书可能已轮换，下次查询时重新获取
+		c.mu.Lock()
+		if c.current == s {
+			c.current = nil
+		}
+		c.mu.Unlock()
+	}
+	return resp, err
+}
+
+// Cert returns the certificate queries are encrypted for, fetching it
+// first if there's none or it expired
+func (c *Client) Cert(ctx context.Context) (*Cert, error) {
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.cert, nil
+}
+
+func (c *Client) session(ctx context.Context) (*session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil && c.current.cert.Valid(time.Now()) {
+		return c.current, nil
+	}
+
+	cert, err := c.fetchCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	public, secret, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, ok := sharedKey(cert.ES, secret, &cert.ResolverKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: unusable resolver key", ErrCert)
+	}
+	c.current = &session{cert: cert, public: *public, shared: shared}
+	return c.current, nil
+}
+
+// fetchCert asks the resolver for its certificates in plain DNS and
+// returns the best verified one
+func (c *Client) fetchCert(ctx context.Context) (*Cert, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(c.ProviderName), dns.TypeTXT)
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.plainExchange(ctx, packed, query.Id, "udp")
+	if err == nil && resp.Truncated {
+		resp, err = c.plainExchange(ctx, packed, query.Id, "tcp")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: fetching certificate: %w", c.ProviderName, err)
+	}
+	return bestCert(resp, c.PublicKey, time.Now())
+}
+
+func (c *Client) plainExchange(ctx context.Context, packed []byte, id uint16, network string) (*dns.Msg, error) {
+	raw, err := c.send(ctx, network, packed)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if resp.Id != id {
+		return nil, errors.New("certificate response ID mismatch")
+	}
+	return resp, nil
+}
+
+// exchange sends one encrypted query over network and decrypts the answer
+func (c *Client) exchange(ctx context.Context, s *session, query []byte, network string) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+	minLen := 0
+	if network == "udp" {
+		minLen = minUDPQuery
+	}
+	public, shared := s.public, s.shared
+	if len(c.Relays) > 0 {
+		// 经中继时每个查询使用临时密钥，解析器无法关联同一客户端的查询
+		pub, secret, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if shared, ok = sharedKey(s.cert.ES, secret, &s.cert.ResolverKey); !ok {
+			return nil, fmt.Errorf("%w: unusable resolver key", ErrCert)
+		}
+		public = *pub
+	}
+
+	packet := make([]byte, 0, 8+32+12+tagSize+len(query)+64)
+	packet = append(packet, s.cert.ClientMagic[:]...)
+	packet = append(packet, public[:]...)
+	packet = append(packet, nonce[:12]...)
+	packet = append(packet, seal(s.cert.ES, pad(query, minLen), &nonce, &shared)...)
+
+	resp, err := c.send(ctx, network, packet)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(s.cert.ES, &shared, resp, nonce[:12])
+}
+
+// send delivers packet to the resolver, directly or through a relay, and
+// returns its reply
+func (c *Client) send(ctx context.Context, network string, packet []byte) ([]byte, error) {
+	addr := c.Addr
+	if len(c.Relays) > 0 {
+		var err error
+		if packet, err = c.anonymize(packet); err != nil {
+			return nil, err
+		}
+		addr = c.Relays[mrand.IntN(len(c.Relays))]
+	}
+
+	d := net.Dialer{Control: c.Control, ControlContext: c.ControlContext}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return roundTrip(conn, network, packet)
+}
+
+// anonymize prepends the relay header naming the resolver to packet
+func (c *Client) anonymize(packet []byte) ([]byte, error) {
+	server, err := netip.ParseAddrPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("relayed resolver address must be IP:port: %v", err)
+	}
+	ip := server.Addr().As16()
+	out := make([]byte, 0, len(anonMagic)+16+2+len(packet))
+	out = append(out, anonMagic...)
+	out = append(out, ip[:]...)
+	out = binary.BigEndian.AppendUint16(out, server.Port())
+	return append(out, packet...), nil
+}
+
+// roundTrip writes packet and reads one reply, framing both with a length
+// prefix over TCP
+func roundTrip(conn net.Conn, network string, packet []byte) ([]byte, error) {
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packet)), uint16(len(packet)))
+	if _, err := conn.Write(append(framed, packet...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decrypt checks the response is for clientNonce and opens it
+func decrypt(es uint16, shared *[32]byte, resp, clientNonce []byte) ([]byte, error) {
+	if len(resp) < 8+24+tagSize || string(resp[:8]) != resolverMagic {
+		return nil, errors.New("not a DNSCrypt response")
+	}
+	if !equal(resp[8:20], clientNonce) {
+		return nil, errors.New("DNSCrypt response nonce mismatch")
+	}
+	var nonce [24]byte
+	copy(nonce[:], resp[8:32])
+	plain, ok := open(es, resp[32:], &nonce, shared)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	msg, ok := unpad(plain)
+	if !ok {
+		return nil, fmt.Errorf("%w: bad padding", ErrDecrypt)
+	}
+	return msg, nil
+}
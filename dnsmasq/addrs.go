@@ -0,0 +1,34 @@
+package dnsmasq
+
+import "strings"
+
+// The addresses of an answer are cached together, joined by commas and
+// best first (see AddrSorter), so every address a client may pick can be
+// routed. Values without a comma are a single address or a CNAME target.
+
+// JoinAddrs encodes the addresses of an answer as a cache value
+func JoinAddrs(ips []string) string {
+	return strings.Join(ips, ",")
+}
+
+// SplitAddrs decodes a cache value holding addresses, and reports false
+// for the next name of a CNAME chain
+func SplitAddrs(value string) ([]string, bool) {
+	if !isAddrs(value) {
+		return nil, false
+	}
+	return strings.Split(value, ","), true
+}
+
+// isAddrs reports whether a cache value holds addresses without allocating
+func isAddrs(value string) bool {
+	return isIP(firstAddr(value))
+}
+
+// firstAddr returns the best address of a cache value holding addresses
+func firstAddr(value string) string {
+	if i := strings.IndexByte(value, ','); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package dnsmasq_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+func benchRules(n int) []dnsmasq.Rule {
+	rules := make([]dnsmasq.Rule, 0, n)
+	for i := 0; i < n; i++ {
+		rules = append(rules, dnsmasq.Rule{Suffix: fmt.Sprintf("example%d.com", i)})
+	}
+	return rules
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	cache := dnsmasq.NewCacheWithTTL(time.Hour)
+	cache.Set("www.example.com", "93.184.216.34")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cache.Get("www.example.com")
+	}
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	cache := dnsmasq.NewCacheWithTTL(time.Hour)
+	domains := make([]string, 1024)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("host%d.example.com", i)
+		cache.Set(domains[i], "93.184.216.34")
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(domains[i&1023])
+			i++
+		}
+	})
+}
+
+// benchSizes are the rule counts matching is benchmarked at, up to a
+// large blocklist
+var benchSizes = []int{100, 1000, 10000, 100000}
+
+func BenchmarkMatchesRules(b *testing.B) {
+	for _, n := range benchSizes {
+		rules := benchRules(n)
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				dnsmasq.MatchesRules("www.unmatched.org", rules)
+			}
+		})
+	}
+}
+
+// BenchmarkRuleIndex is BenchmarkMatchesRules through a RuleIndex, whose
+// cost shouldn't grow with the number of rules
+func BenchmarkRuleIndex(b *testing.B) {
+	for _, n := range benchSizes {
+		index := dnsmasq.NewRuleIndex(benchRules(n))
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				index.Match("www.unmatched.org")
+			}
+		})
+	}
+}
+
+func BenchmarkNewRuleIndex(b *testing.B) {
+	rules := benchRules(100000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dnsmasq.NewRuleIndex(rules)
+	}
+}
+
+func BenchmarkResolveCached(b *testing.B) {
+	cache := dnsmasq.NewCacheWithTTL(time.Hour)
+	cache.Set("www.example1.com", "93.184.216.34")
+	r := &dnsmasq.Resolver{
+		Rules:  benchRules(1000),
+		Cache:  cache,
+		Logger: dnsmasq.DiscardLogger,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := r.Resolve("www.example1.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -8,53 +8,304 @@ import (
 type DNSRecord struct {
 	IP        string    `json:"ip"`
 	Timestamp time.Time `json:"timestamp"`
+	// TTL is how long the answer may be served, from the upstream's
+	// record TTL; zero uses the cache's own TTL
+	TTL time.Duration `json:"ttl,omitempty"`
+	// mono is when the record was stored on the monotonic clock (see
+	// monoNow); zero for records read from disk
+	mono int64
+	// refreshing is set while a caller of GetStale refreshes the record
+	refreshing bool
 }
 
-type Cache struct {
-	data map[string]DNSRecord
+// CacheBackend stores resolved answers keyed by domain. Values are either
+// an IP address or the next name of a CNAME chain. Cache is the in-memory
+// default; other backends let several daemon instances share answers.
+type CacheBackend interface {
+	Get(domain string) (string, bool)
+	Set(domain, value string)
+	// Raw returns a snapshot of all live entries
+	Raw() map[string]DNSRecord
+}
+
+// TTLCache is a CacheBackend that can expire entries individually. Backends
+// without it keep every entry for their own TTL.
+type TTLCache interface {
+	CacheBackend
+	// SetTTL stores value for domain, served for ttl
+	SetTTL(domain, value string, ttl time.Duration)
+}
+
+// StaleCache is a CacheBackend that keeps serving an entry past its TTL
+// while a single caller refreshes it (stale-while-revalidate), so a
+// popular name expiring doesn't send every concurrent query upstream
+type StaleCache interface {
+	CacheBackend
+	// GetStale returns domain's entry while it may be served, fresh or
+	// stale, and whether the caller should refresh it. Once the entry
+	// expires, or is about to, exactly one caller is told to, until the
+	// entry is stored again or EndRefresh gives the refresh up.
+	GetStale(domain string) (value string, refresh bool, ok bool)
+	EndRefresh(domain string)
+}
+
+// DeleteCache is a CacheBackend that can drop entries before they expire,
+// e.g. to flush answers after a provider moved to new addresses
+type DeleteCache interface {
+	CacheBackend
+	// Delete removes the entry for domain; a missing entry is not an error
+	Delete(domain string) error
+}
+
+// SetWithTTL stores value in cache for ttl when the backend supports
+// per-entry TTLs and ttl is positive, and with the backend's TTL otherwise
+func SetWithTTL(cache CacheBackend, domain, value string, ttl time.Duration) {
+	if tc, ok := cache.(TTLCache); ok && ttl > 0 {
+		tc.SetTTL(domain, value, ttl)
+		return
+	}
+	cache.Set(domain, value)
+}
+
+// Remaining returns how much longer domain's entry is served for. Backends
+// other than Cache can't tell and report false.
+func Remaining(cache CacheBackend, domain string) (time.Duration, bool) {
+	if c, ok := cache.(*Cache); ok {
+		return c.Remaining(domain)
+	}
+	return 0, false
+}
+
+// Expired reports whether the record outlived its TTL, or defaultTTL for
+// records without one
+func (r DNSRecord) Expired(defaultTTL time.Duration) bool {
+	ttl := r.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return r.Age() > ttl
+}
+
+// cacheShards is the number of independently locked partitions. A power
+// of two so the shard index is a mask of the hash.
+const cacheShards = 64
+
+// StaleAnswerTTL bounds the TTL clients are given with a stale answer, as
+// RFC 8767 recommends
+const StaleAnswerTTL = 30 * time.Second
+
+// refreshAhead makes GetStale have entries refreshed in the last
+// 1/refreshAhead of their TTL, before they expire
+const refreshAhead = 10
+
+type cacheShard struct {
 	mu   sync.RWMutex
-	ttl  time.Duration
+	data map[string]DNSRecord
+}
+
+// Cache is the default in-memory CacheBackend. Entries are spread over
+// lock-striped shards so concurrent lookups of different domains don't
+// contend on a single mutex when the listener handles thousands of QPS.
+type Cache struct {
+	shards [cacheShards]cacheShard
+	ttl    time.Duration
+	// stale is how long GetStale serves expired entries
+	stale time.Duration
 }
 
 func NewCacheWithTTL(ttl time.Duration) *Cache {
-	return &Cache{
-		data: make(map[string]DNSRecord),
-		ttl:  ttl,
+	c := &Cache{ttl: ttl}
+	for i := range c.shards {
+		c.shards[i].data = make(map[string]DNSRecord)
+	}
+	return c
+}
+
+// shard picks the partition for a domain using inline FNV-1a, which
+// avoids the allocation of hash/fnv on the lookup path
+func (c *Cache) shard(domain string) *cacheShard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(domain); i++ {
+		h ^= uint32(domain[i])
+		h *= 16777619
 	}
+	return &c.shards[h&(cacheShards-1)]
 }
 
 func (c *Cache) Get(domain string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	s := c.shard(domain)
+	s.mu.RLock()
+	record, ok := s.data[domain]
+	s.mu.RUnlock()
 
-	record, ok := c.data[domain]
 	if !ok {
 		return "", false
 	}
-	if time.Since(record.Timestamp) > c.ttl {
-		// expired
+	if record.Expired(c.ttl) {
 		return "", false
 	}
 	return record.IP, true
 }
 
+// SetStale makes GetStale serve entries for up to stale past their TTL,
+// and Purge keep them that long. Zero, the default, turns stale serving
+// and refreshing ahead off: GetStale then behaves like Get.
+func (c *Cache) SetStale(stale time.Duration) {
+	c.stale = max(stale, 0)
+}
+
+// ttlOf returns how long record is served for before it's stale
+func (c *Cache) ttlOf(record DNSRecord) time.Duration {
+	if record.TTL > 0 {
+		return record.TTL
+	}
+	return c.ttl
+}
+
+// GetStale implements StaleCache
+func (c *Cache) GetStale(domain string) (string, bool, bool) {
+	if c.stale == 0 {
+		value, ok := c.Get(domain)
+		return value, false, ok
+	}
+	s := c.shard(domain)
+	s.mu.RLock()
+	record, ok := s.data[domain]
+	s.mu.RUnlock()
+	if !ok {
+		return "", false, false
+	}
+	ttl, age := c.ttlOf(record), record.Age()
+	switch {
+	case age > ttl+c.stale:
+		return "", false, false
+	case age < ttl-ttl/refreshAhead || record.refreshing:
+		return record.IP, false, true
+	}
+
+	// 只让一个调用方刷新，其余的继续使用当前的值
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok = s.data[domain]
+	if !ok || record.refreshing {
+		return record.IP, false, ok
+	}
+	record.refreshing = true
+	s.data[domain] = record
+	return record.IP, true, true
+}
+
+// EndRefresh implements StaleCache
+func (c *Cache) EndRefresh(domain string) {
+	s := c.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.data[domain]; ok && record.refreshing {
+		record.refreshing = false
+		s.data[domain] = record
+	}
+}
+
+// Remaining returns how much longer domain's entry is served for. A stale
+// entry (see SetStale) is served for StaleAnswerTTL at most, as it's
+// about to be replaced.
+func (c *Cache) Remaining(domain string) (time.Duration, bool) {
+	s := c.shard(domain)
+	s.mu.RLock()
+	record, ok := s.data[domain]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	left := c.ttlOf(record) - record.Age()
+	switch {
+	case left >= 0:
+		return left, true
+	case left+c.stale > 0:
+		return min(left+c.stale, StaleAnswerTTL), true
+	}
+	return 0, false
+}
+
 func (c *Cache) Set(domain, ip string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.SetTTL(domain, ip, 0)
+}
+
+// SetTTL stores ip for domain, served for ttl instead of the cache's TTL
+// when positive
+func (c *Cache) SetTTL(domain, ip string, ttl time.Duration) {
+	s := c.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	c.data[domain] = DNSRecord{
+	s.data[domain] = DNSRecord{
 		IP:        ip,
 		Timestamp: time.Now(),
+		TTL:       max(ttl, 0),
+		mono:      monoNow(),
 	}
 }
 
-func (c *Cache) Raw() map[string]DNSRecord {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// SetRecord stores a record keeping its age, so entries restored from
+// disk expire when they originally would have. From then on the entry
+// ages on the monotonic clock.
+func (c *Cache) SetRecord(domain string, record DNSRecord) {
+	record = record.withMono()
+	s := c.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[domain] = record
+}
+
+// Delete removes the entry for domain
+func (c *Cache) Delete(domain string) error {
+	s := c.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, domain)
+	return nil
+}
 
+func (c *Cache) Raw() map[string]DNSRecord {
 	copied := make(map[string]DNSRecord)
-	for k, v := range c.data {
-		copied[k] = v
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for k, v := range s.data {
+			copied[k] = v
+		}
+		s.mu.RUnlock()
 	}
 	return copied
 }
+
+// Purge drops expired entries, one shard at a time, and returns how many
+// were removed. Entries GetStale may still serve are kept.
+func (c *Cache) Purge() int {
+	removed := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for k, v := range s.data {
+			if v.Age() > c.ttlOf(v)+c.stale {
+				delete(s.data, k)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// Len returns the number of stored entries, including expired ones not
+// yet purged
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		n += len(s.data)
+		s.mu.RUnlock()
+	}
+	return n
+}
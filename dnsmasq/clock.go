@@ -0,0 +1,47 @@
+package dnsmasq
+
+import (
+	"math"
+	"time"
+)
+
+// monoBase anchors monotonic readings. Durations measured against it come
+// from the monotonic clock, so NTP corrections and manual clock changes
+// don't shift them, and on macOS and Linux the clock doesn't advance
+// while the machine sleeps.
+var monoBase = time.Now()
+
+// monoNow returns the monotonic clock in nanoseconds since monoBase. It's
+// never zero, so zero marks a record without a monotonic reading.
+func monoNow() int64 {
+	return int64(time.Since(monoBase)) + 1
+}
+
+// Age returns how long ago the record was stored. Records stored by this
+// process are measured on the monotonic clock; records read from disk
+// fall back to the wall clock, and a timestamp in the future (the clock
+// was set back since) can't be trusted and counts as expired rather than
+// living forever.
+func (r DNSRecord) Age() time.Duration {
+	if r.mono != 0 {
+		return time.Duration(monoNow() - r.mono)
+	}
+	age := time.Since(r.Timestamp)
+	if age < 0 {
+		return math.MaxInt64
+	}
+	return age
+}
+
+// withMono anchors a record on the monotonic clock, keeping its age
+func (r DNSRecord) withMono() DNSRecord {
+	if r.mono == 0 {
+		age := r.Age()
+		if age == math.MaxInt64 {
+			// 时钟回拨产生的未来时间戳，视为已过期（避免相减溢出）
+			age = 1 << 62
+		}
+		r.mono = monoNow() - int64(age)
+	}
+	return r
+}
@@ -0,0 +1,158 @@
+package dnsmasq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Source tells where the answer of a Decision came from
+type Source uint8
+
+const (
+	// SourceUpstream means the upstream was asked
+	SourceUpstream Source = iota
+	// SourceCache means the answer, or the failure, was cached
+	SourceCache
+	// SourceLocal means the answer was made up without asking anyone,
+	// e.g. for a REJECT rule or a rewrite
+	SourceLocal
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceCache:
+		return "cache"
+	case SourceLocal:
+		return "local"
+	}
+	return "upstream"
+}
+
+// Decision is the outcome of resolving a query: the answer, where it came
+// from and what the rules do with it
+type Decision struct {
+	Domain string
+	// Answers are the addresses of the answer, best first
+	Answers []Address
+	// CNAMEs is the chain followed from Domain, in order
+	CNAMEs []string
+	// Rule is the rule that matched, when Matched is set, and Policy its
+	// policy; PolicyDirect when none did
+	Rule    Rule
+	Matched bool
+	Policy  Policy
+	// Action is what handles a routed answer: the rule's action, empty
+	// for the default VPN route
+	Action string
+	Source Source
+	// Upstream names the upstream asked; empty unless Source is
+	// SourceUpstream
+	Upstream string
+	// Latency is how long the resolution took
+	Latency time.Duration
+}
+
+// Routes reports whether the answer is routed
+func (d *Decision) Routes() bool {
+	return d.Matched && d.Policy.Routes()
+}
+
+// IP returns the best address of the answer, empty when there is none
+func (d *Decision) IP() string {
+	if len(d.Answers) == 0 {
+		return ""
+	}
+	return d.Answers[0].IP
+}
+
+// IPs returns the addresses of the answer, best first
+func (d *Decision) IPs() []string {
+	ips := make([]string, len(d.Answers))
+	for i, a := range d.Answers {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// SetAnswers replaces the answer with ips, all valid for ttl
+func (d *Decision) SetAnswers(ips []string, ttl time.Duration) {
+	d.Answers = d.Answers[:0]
+	for _, ip := range ips {
+		d.Answers = append(d.Answers, Address{IP: ip, TTL: ttl})
+	}
+}
+
+// Match records the rule the answer matched, which decides Policy and
+// Action; a zero Rule and ok false mean none did
+func (d *Decision) Match(rule Rule, ok bool) {
+	d.Rule, d.Matched = rule, ok
+	d.Policy, d.Action = PolicyDirect, ""
+	if ok {
+		d.Policy, d.Action = rule.Policy(), rule.Action
+	}
+}
+
+// from records where the answer came from; d may be nil
+func (d *Decision) from(src Source, upstream Upstream) {
+	if d == nil {
+		return
+	}
+	d.Source, d.Upstream = src, ""
+	if src == SourceUpstream {
+		d.Upstream = upstreamName(upstream)
+	}
+}
+
+// upstreamName labels u for a Decision
+func upstreamName(u Upstream) string {
+	if s, ok := u.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", u)
+}
+
+// Decide resolves the A (or, for dns.TypeAAAA, the AAAA) records of
+// domain and matches the answer against the rules: domain first, then
+// the best address against the IP rules. On failure the Decision still
+// carries what is known, such as the rule of a REJECT or the CNAMEs
+// followed with PartialChain.
+func (r *Resolver) Decide(domain string, qtype uint16) (*Decision, error) {
+	start := time.Now()
+	d := &Decision{Domain: domain}
+	d.Match(r.matchRule(domain))
+
+	var err error
+	switch {
+	case d.Policy == PolicyReject:
+		d.Source = SourceLocal
+		err = r.rejected(domain)
+	case qtype == dns.TypeAAAA:
+		var ips []string
+		var ttl time.Duration
+		ips, d.CNAMEs, ttl, err = r.resolveAAAA(domain)
+		d.SetAnswers(ips, ttl)
+		d.from(SourceUpstream, r.upstream(domain))
+	default:
+		var value string
+		value, d.CNAMEs, err = r.resolveValue(domain, d)
+		if err == nil {
+			owner := domain
+			if len(d.CNAMEs) > 0 {
+				owner = d.CNAMEs[len(d.CNAMEs)-1]
+			}
+			ttl, _ := Remaining(r.Cache, owner)
+			ips, _ := SplitAddrs(value)
+			d.SetAnswers(ips, ttl)
+		}
+	}
+	d.Latency = time.Since(start)
+	if err != nil {
+		return d, err
+	}
+	if !d.Matched {
+		d.Match(r.matchIPRule(d.IP()))
+	}
+	return d, nil
+}
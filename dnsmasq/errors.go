@@ -0,0 +1,50 @@
+package dnsmasq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"openvpnadvanced/doh"
+)
+
+// Resolution failures returned by ResolveRecursive and ResolveWithCNAME.
+// They are wrapped with the queried domain, so compare with errors.Is.
+var (
+	// ErrNXDomain means the upstream reported that the name doesn't exist
+	ErrNXDomain = doh.ErrNXDomain
+	// ErrUpstreamTimeout means the upstream didn't answer in time
+	ErrUpstreamTimeout = doh.ErrUpstreamTimeout
+	// ErrServFail means the upstream failed to resolve the name
+	// (SERVFAIL), which clients mustn't take for an empty answer
+	ErrServFail = doh.ErrServFail
+	// ErrCircularCNAME means the CNAME chain loops back on itself
+	ErrCircularCNAME = errors.New("circular CNAME chain")
+	// ErrCNAMEDepth means the CNAME chain is longer than the resolver
+	// follows (see Resolver.MaxDepth)
+	ErrCNAMEDepth = errors.New("CNAME chain too long")
+	// ErrNoAnswer means the name exists but yielded no usable address
+	ErrNoAnswer = errors.New("no usable answer")
+	// ErrOffline means the resolver is offline (see Resolver.Offline)
+	// and the answer isn't cached
+	ErrOffline = errors.New("offline and not cached")
+	// ErrRejected means a REJECT rule matches the name, which isn't
+	// resolved
+	ErrRejected = errors.New("rejected by rule")
+)
+
+// ChainError is a broken CNAME chain: ErrCircularCNAME or ErrCNAMEDepth
+// with the CNAMEs followed before giving up
+type ChainError struct {
+	Domain string
+	Chain  []string
+	Err    error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%s: %v (%s ➜ %s)", e.Domain, e.Err, e.Domain, strings.Join(e.Chain, " ➜ "))
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
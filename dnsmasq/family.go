@@ -0,0 +1,88 @@
+package dnsmasq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// Family orders the addresses of a name when both its A and AAAA records
+// are asked for (see ResolveFull), which are then queried concurrently. A
+// and AAAA queries are only ever answered with their own family.
+type Family int
+
+const (
+	// PreferIPv4 puts the IPv4 addresses first
+	PreferIPv4 Family = iota
+	// PreferIPv6 puts the IPv6 addresses first
+	PreferIPv6
+	// Fastest puts first the family whose answer arrived first
+	Fastest
+)
+
+// ParseFamily parses "prefer-ipv4", "prefer-ipv6" or "fastest"
+func ParseFamily(s string) (Family, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "prefer-ipv4", "ipv4":
+		return PreferIPv4, nil
+	case "prefer-ipv6", "ipv6":
+		return PreferIPv6, nil
+	case "fastest":
+		return Fastest, nil
+	}
+	return 0, fmt.Errorf("unknown address family preference %q (want prefer-ipv4, prefer-ipv6 or fastest)", s)
+}
+
+func (f Family) String() string {
+	switch f {
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case Fastest:
+		return "fastest"
+	default:
+		return "prefer-ipv4"
+	}
+}
+
+// lookupResult is the answer of one address query
+type lookupResult struct {
+	v6  bool
+	ips []string
+	// cname is the next name when the answer holds no address
+	cname string
+	ttl   time.Duration
+	err   error
+}
+
+func (l *lookupResult) usable() bool {
+	return l != nil && len(l.ips) > 0
+}
+
+func (l *lookupResult) kind() string {
+	if l.v6 {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// lookup queries the qtype (A or AAAA) records of name. Only addresses of
+// that family are returned, never the other's, along with the CNAME
+// leading on when the answer holds none.
+func (r *Resolver) lookup(ctx context.Context, upstream Upstream, name string, qtype uint16) lookupResult {
+	v6 := qtype == dns.TypeAAAA
+	answer, err := upstream.Query(ctx, name, qtype)
+	if err != nil {
+		return lookupResult{v6: v6, err: err}
+	}
+	if v6 {
+		ips, ttl, err := answer.Addrs(doh.TypeAAAA)
+		return lookupResult{v6: true, ips: ips, ttl: ttl, err: err}
+	}
+	ips, cname, ttl, err := answer.AddrsOrCNAME()
+	return lookupResult{ips: ips, cname: cname, ttl: ttl, err: err}
+}
@@ -0,0 +1,71 @@
+package dnsmasq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// slowA answers AAAA queries at once and A queries after a delay, so the
+// AAAA answer always arrives first
+type slowA struct{}
+
+func (slowA) Query(ctx context.Context, name string, qtype uint16) (doh.Answer, error) {
+	switch qtype {
+	case dns.TypeA:
+		time.Sleep(20 * time.Millisecond)
+		return doh.Answer{Records: []doh.DoHAnswer{{Name: name, Type: doh.TypeA, TTL: 60, Data: "192.0.2.1"}}}, nil
+	case dns.TypeAAAA:
+		return doh.Answer{Records: []doh.DoHAnswer{{Name: name, Type: doh.TypeAAAA, TTL: 60, Data: "2001:db8::1"}}}, nil
+	}
+	return doh.Answer{}, nil
+}
+
+func TestDecideAnswersAskedFamily(t *testing.T) {
+	for _, prefer := range []dnsmasq.Family{dnsmasq.PreferIPv4, dnsmasq.PreferIPv6, dnsmasq.Fastest} {
+		r := &dnsmasq.Resolver{Cache: dnsmasq.NewCacheWithTTL(time.Hour), Upstream: slowA{}, Prefer: prefer, Logger: dnsmasq.DiscardLogger}
+		d, err := r.Decide("example.com", dns.TypeA)
+		if err != nil {
+			t.Fatalf("%v: Decide(A): %v", prefer, err)
+		}
+		if got := d.IPs(); len(got) != 1 || got[0] != "192.0.2.1" {
+			t.Errorf("%v: Decide(A) = %v, want [192.0.2.1]", prefer, got)
+		}
+		d, err = r.Decide("example.com", dns.TypeAAAA)
+		if err != nil {
+			t.Fatalf("%v: Decide(AAAA): %v", prefer, err)
+		}
+		if got := d.IPs(); len(got) != 1 || got[0] != "2001:db8::1" {
+			t.Errorf("%v: Decide(AAAA) = %v, want [2001:db8::1]", prefer, got)
+		}
+	}
+}
+
+func TestResolveFullOrdersByPreference(t *testing.T) {
+	tests := []struct {
+		prefer dnsmasq.Family
+		first  string
+	}{
+		{dnsmasq.PreferIPv4, "192.0.2.1"},
+		{dnsmasq.PreferIPv6, "2001:db8::1"},
+		{dnsmasq.Fastest, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := &dnsmasq.Resolver{Cache: dnsmasq.NewCacheWithTTL(time.Hour), Upstream: slowA{}, Prefer: tt.prefer, Logger: dnsmasq.DiscardLogger}
+		res, err := r.ResolveFull("example.com")
+		if err != nil {
+			t.Fatalf("%v: %v", tt.prefer, err)
+		}
+		if len(res.A) != 1 || len(res.AAAA) != 1 {
+			t.Fatalf("%v: A = %v, AAAA = %v", tt.prefer, res.A, res.AAAA)
+		}
+		if got := res.Addrs(); got[0] != tt.first {
+			t.Errorf("%v: Addrs() = %v, want %s first", tt.prefer, got, tt.first)
+		}
+	}
+}
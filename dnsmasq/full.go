@@ -0,0 +1,132 @@
+package dnsmasq
+
+import "time"
+
+// Address is one address of a Result
+type Address struct {
+	IP string
+	// TTL is how long the address stays valid; zero when unknown
+	TTL time.Duration
+}
+
+// Result is the complete answer of ResolveFull
+type Result struct {
+	Domain string
+	// CNAMEs is the chain followed from Domain, in order
+	CNAMEs []string
+	// A and AAAA are every address of the answer, best first
+	A    []Address
+	AAAA []Address
+	// Rule is the rule that matched, when Matched is set
+	Rule    Rule
+	Matched bool
+	// v6First puts the AAAA addresses first in Addrs
+	v6First bool
+}
+
+// Addrs returns the addresses of the answer, the family the resolver's
+// Prefer picked first
+func (res *Result) Addrs() []string {
+	first, second := res.A, res.AAAA
+	if res.v6First {
+		first, second = res.AAAA, res.A
+	}
+	ips := make([]string, 0, len(res.A)+len(res.AAAA))
+	for _, a := range first {
+		ips = append(ips, a.IP)
+	}
+	for _, a := range second {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// ResolveFull resolves both the A and AAAA records of domain,
+// concurrently, and returns the whole answer, so a multi-homed service
+// can be routed at every address. The rules are matched against domain,
+// then each CNAME of the chain, then each address. It fails only when
+// neither family resolves, with the error of the A query.
+func (r *Resolver) ResolveFull(domain string) (*Result, error) {
+	type answer struct {
+		ips, cnames []string
+		ttl         time.Duration
+		err         error
+	}
+	v6c := make(chan answer, 1)
+	go func() {
+		var v6 answer
+		v6.ips, v6.cnames, v6.ttl, v6.err = r.resolveAAAA(domain)
+		v6c <- v6
+	}()
+
+	res := &Result{Domain: domain}
+	ips, cnames, err := r.ResolveAddrs(domain)
+	var v6 answer
+	v6Done := false
+	select {
+	case v6 = <-v6c:
+		v6Done = true
+	default:
+		v6 = <-v6c
+	}
+	switch r.Prefer {
+	case PreferIPv6:
+		res.v6First = true
+	case Fastest:
+		// AAAA 答案先到时排在前面
+		res.v6First = v6Done && v6.err == nil
+	}
+
+	if err == nil {
+		owner := domain
+		if len(cnames) > 0 {
+			owner = cnames[len(cnames)-1]
+		}
+		ttl, _ := Remaining(r.Cache, owner)
+		for _, ip := range ips {
+			res.A = append(res.A, Address{IP: ip, TTL: ttl})
+		}
+		res.CNAMEs = cnames
+	}
+	for _, ip := range v6.ips {
+		res.AAAA = append(res.AAAA, Address{IP: ip, TTL: v6.ttl})
+	}
+	if err != nil && v6.err == nil {
+		err, res.CNAMEs = nil, v6.cnames
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := append([]string{domain}, res.CNAMEs...)
+	for _, name := range names {
+		if rule, ok := r.matchRule(name); ok {
+			res.Rule, res.Matched = rule, true
+			return res, nil
+		}
+	}
+	for _, ip := range res.Addrs() {
+		if rule, ok := r.matchIPRule(ip); ok {
+			res.Rule, res.Matched = rule, true
+			break
+		}
+	}
+	return res, nil
+}
+
+// matchRule returns the rule of Matcher, or Rules when unset, matching
+// domain. A Matcher that can't name its rules reports the domain itself
+// as the suffix.
+func (r *Resolver) matchRule(domain string) (Rule, bool) {
+	switch m := r.Matcher.(type) {
+	case nil:
+		return MatchRule(domain, r.Rules)
+	case RuleFinder:
+		return m.MatchRule(domain)
+	case ActionMatcher:
+		action, ok := m.MatchAction(domain)
+		return Rule{Suffix: domain, Action: action}, ok
+	default:
+		return Rule{Suffix: domain}, m.Match(domain)
+	}
+}
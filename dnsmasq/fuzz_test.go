@@ -0,0 +1,70 @@
+package dnsmasq_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+func FuzzParseRuleLine(f *testing.F) {
+	f.Add([]byte("DOMAIN-SUFFIX,example.com"))
+	f.Add([]byte("DOMAIN-SUFFIX,.corp.example,direct"))
+	f.Add([]byte("  DOMAIN-SUFFIX , x"))
+	f.Add([]byte("# comment"))
+	f.Add([]byte("DOMAIN-SUFFIX,..."))
+	f.Add([]byte("DOMAIN-SUFFIX,*.example.com"))
+	f.Add([]byte("DOMAIN,*.*"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		rule, ok := dnsmasq.ParseRuleLine(line)
+		if !ok {
+			return
+		}
+		if strings.Trim(strings.TrimPrefix(rule.Suffix, "*."), ".") == "" || strings.ContainsAny(rule.Suffix, " \t,") {
+			t.Fatalf("accepted invalid suffix %q from %q", rule.Suffix, line)
+		}
+	})
+}
+
+func FuzzBuildRuleTrie(f *testing.F) {
+	f.Add([]byte("DOMAIN-SUFFIX,example.com\nDOMAIN-SUFFIX,a.b.c,direct\n"), "x.example.com")
+	f.Add([]byte("DOMAIN-SUFFIX,t.co\n"), "nott.co")
+	f.Add([]byte("DOMAIN-SUFFIX,*.t.co\n"), "x.t.co")
+	f.Add([]byte("payload:\n  - '+.example.com'\n  - '.sub.example'\n"), "x.example.com")
+	f.Add([]byte("payload:\n  - DOMAIN-SUFFIX,example.com\n"), "example.com")
+	f.Fuzz(func(t *testing.T, rules []byte, domain string) {
+		trie, err := dnsmasq.BuildRuleTrie(bytes.NewReader(rules), 0)
+		if err != nil {
+			return
+		}
+		matched := trie.Match(domain)
+		if _, ok := trie.MatchAction(domain); ok != matched {
+			t.Fatalf("Match and MatchAction disagree on %q", domain)
+		}
+	})
+}
+
+func FuzzParseRuleDB(f *testing.F) {
+	trie, _ := dnsmasq.BuildRuleTrie(strings.NewReader("DOMAIN-SUFFIX,example.com\nDOMAIN-SUFFIX,corp.example,direct\n"), 0)
+	path := filepath.Join(f.TempDir(), "rules.db")
+	if err := dnsmasq.SaveRuleDB(path, trie, nil); err != nil {
+		f.Fatal(err)
+	}
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add(seed[:64])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		trie, err := dnsmasq.ParseRuleDB(data)
+		if err != nil {
+			return
+		}
+		trie.Match("www.example.com")
+		trie.MatchAction("a.corp.example")
+	})
+}
@@ -0,0 +1,60 @@
+package dnsmasq
+
+// RuleIndex matches a rule list the way MatchRule does, the first
+// matching rule winning, without scanning it. It is a RuleTrie built from
+// the list that also keeps the rules themselves, so MatchRule returns the
+// rule as written; it is built at load time for plain rule lists.
+type RuleIndex struct {
+	rules   []Rule
+	trie    *RuleTrie
+	ipRules []Rule
+}
+
+// NewRuleIndex indexes rules, which must not be modified afterwards
+func NewRuleIndex(rules []Rule) *RuleIndex {
+	x := &RuleIndex{rules: rules, trie: NewRuleTrie(len(rules))}
+	for i, rule := range rules {
+		if rule.Type.IsIP() {
+			x.ipRules = append(x.ipRules, rule)
+			continue
+		}
+		// 动作从 rules 中取，trie 只记录位置
+		x.trie.insertAt(int32(i), rule.Type, []byte(rule.Suffix), nil)
+	}
+	return x
+}
+
+// Len returns the number of rules
+func (x *RuleIndex) Len() int {
+	return len(x.rules)
+}
+
+// Rules returns the indexed rules, in order
+func (x *RuleIndex) Rules() []Rule {
+	return x.rules
+}
+
+// Match reports whether a rule matches domain
+func (x *RuleIndex) Match(domain string) bool {
+	return x.trie.Match(domain)
+}
+
+// MatchAction returns the action of the first rule matching domain
+func (x *RuleIndex) MatchAction(domain string) (string, bool) {
+	rule, ok := x.MatchRule(domain)
+	return rule.Action, ok
+}
+
+// MatchRule returns the first rule matching domain, like MatchRule
+func (x *RuleIndex) MatchRule(domain string) (Rule, bool) {
+	m, ok := x.trie.match(domain)
+	if !ok {
+		return Rule{}, false
+	}
+	return x.rules[m.pos], true
+}
+
+// MatchIP returns the first IP-CIDR, IP-CIDR6 or GEOIP rule matching ip
+func (x *RuleIndex) MatchIP(ip string, geo CountryLookup) (Rule, bool) {
+	return MatchIPRule(ip, x.ipRules, geo)
+}
@@ -0,0 +1,34 @@
+package dnsmasq
+
+import (
+	"io"
+	"log"
+)
+
+// Logger receives the resolver's diagnostic output. *log.Logger satisfies
+// it; use LoggerFunc to adapt slog or any other logging library.
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// LoggerFunc adapts a plain function to the Logger interface
+type LoggerFunc func(format string, args ...any)
+
+// Printf calls f(format, args...)
+func (f LoggerFunc) Printf(format string, args ...any) {
+	f(format, args...)
+}
+
+// DiscardLogger silences all resolver output
+var DiscardLogger Logger = log.New(io.Discard, "", 0)
+
+// stdLogger forwards to the standard library's global logger
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+// DefaultLogger writes through the global log package and is used when no
+// logger is configured
+var DefaultLogger Logger = stdLogger{}
@@ -0,0 +1,259 @@
+package dnsmasq_test
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+func TestMatchSuffix(t *testing.T) {
+	tests := []struct {
+		domain, suffix string
+		want           bool
+	}{
+		{"t.co", "t.co", true},
+		{"x.t.co", "t.co", true},
+		{"a.b.t.co", "t.co", true},
+		{"nott.co", "t.co", false},
+		{"example-not-t.co", "t.co", false},
+		{"t.co.evil.com", "t.co", false},
+		{"co", "t.co", false},
+		{"t.co.", "t.co", true},
+		{"x.t.co", ".t.co", true},
+		{"t.co", ".t.co", true},
+		{"t.co", "t.co.", true},
+		{"t.co", "*.t.co", false},
+		{"x.t.co", "*.t.co", true},
+		{"a.b.t.co", "*.t.co", true},
+		{"x.t.co.", "*.t.co", true},
+		{"nott.co", "*.t.co", false},
+		{"anything.com", "", false},
+		{"anything.com", ".", false},
+		{"anything.com", "*.", false},
+	}
+	for _, tt := range tests {
+		if got := dnsmasq.MatchSuffix(tt.domain, tt.suffix); got != tt.want {
+			t.Errorf("MatchSuffix(%q, %q) = %v, want %v", tt.domain, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleLineWildcard(t *testing.T) {
+	tests := []struct {
+		line   string
+		suffix string
+		typ    dnsmasq.RuleType
+		ok     bool
+	}{
+		{"DOMAIN-SUFFIX,*.example.com", "*.example.com", dnsmasq.RuleSuffix, true},
+		{"DOMAIN-SUFFIX,*.Example.COM,direct", "*.example.com", dnsmasq.RuleSuffix, true},
+		{"DOMAIN,*.example.com", "*.example.com", dnsmasq.RuleSuffix, true},
+		{"DOMAIN,example.com", "example.com", dnsmasq.RuleDomain, true},
+		{"DOMAIN-SUFFIX,*.", "", 0, false},
+		{"DOMAIN-SUFFIX,*", "", 0, false},
+		{"DOMAIN-SUFFIX,a.*.example.com", "", 0, false},
+		{"DOMAIN-SUFFIX,*.*.example.com", "", 0, false},
+		{"DOMAIN-SUFFIX,*example.com", "", 0, false},
+		{"DOMAIN-KEYWORD,*", "*", dnsmasq.RuleKeyword, true},
+	}
+	for _, tt := range tests {
+		rule, ok := dnsmasq.ParseRuleLine([]byte(tt.line))
+		if ok != tt.ok {
+			t.Errorf("ParseRuleLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && (rule.Suffix != tt.suffix || rule.Type != tt.typ) {
+			t.Errorf("ParseRuleLine(%q) = %q %v, want %q %v", tt.line, rule.Suffix, rule.Type, tt.suffix, tt.typ)
+		}
+	}
+}
+
+// TestRuleMatching checks that rule lists, compiled tries and rule
+// databases agree on label boundaries and wildcards
+func TestRuleMatching(t *testing.T) {
+	const list = `DOMAIN-SUFFIX,t.co
+DOMAIN-SUFFIX,*.wild.example,direct
+DOMAIN-SUFFIX,.dotted.example
+DOMAIN,exact.example
+DOMAIN,*.sub.example
+DOMAIN-KEYWORD,tracker
+`
+	tests := []struct {
+		domain string
+		want   bool
+		suffix string
+	}{
+		{"t.co", true, "t.co"},
+		{"x.t.co", true, "t.co"},
+		{"X.T.CO.", true, "t.co"},
+		{"example-not-t.co", false, ""},
+		{"nott.co", false, ""},
+		{"wild.example", false, ""},
+		{"a.wild.example", true, "*.wild.example"},
+		{"a.b.wild.example", true, "*.wild.example"},
+		{"notwild.example", false, ""},
+		{"dotted.example", true, "dotted.example"},
+		{"a.dotted.example", true, "dotted.example"},
+		{"exact.example", true, "exact.example"},
+		{"a.exact.example", false, ""},
+		{"notexact.example", false, ""},
+		{"sub.example", false, ""},
+		{"a.sub.example", true, "*.sub.example"},
+		{"mytracker.net", true, "tracker"},
+		{"example.org", false, ""},
+	}
+
+	rules, err := dnsmasq.ReadRules(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trie, err := dnsmasq.BuildRuleTrie(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rules.db")
+	if err := dnsmasq.SaveRuleDB(path, trie, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, err := dnsmasq.OpenRuleDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	index := dnsmasq.NewRuleIndex(rules)
+	for _, tt := range tests {
+		if got := dnsmasq.MatchesRules(tt.domain, rules); got != tt.want {
+			t.Errorf("MatchesRules(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+		if got := index.Match(tt.domain); got != tt.want {
+			t.Errorf("index.Match(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+		for name, m := range map[string]*dnsmasq.RuleTrie{"trie": trie, "db": db} {
+			if got := m.Match(tt.domain); got != tt.want {
+				t.Errorf("%s.Match(%q) = %v, want %v", name, tt.domain, got, tt.want)
+			}
+			rule, ok := m.MatchRule(tt.domain)
+			if ok != tt.want || rule.Suffix != tt.suffix {
+				t.Errorf("%s.MatchRule(%q) = %q %v, want %q", name, tt.domain, rule.Suffix, ok, tt.suffix)
+			}
+		}
+	}
+	if rule, _ := trie.MatchRule("a.wild.example"); rule.Action != "direct" {
+		t.Errorf("wildcard rule lost its action: %+v", rule)
+	}
+}
+
+// TestRuleIndexFirstMatch checks that the index picks the rule MatchRule
+// picks, the first in list order, whatever its kind
+func TestRuleIndexFirstMatch(t *testing.T) {
+	rules := []dnsmasq.Rule{
+		{Suffix: "example.com", Action: "broad"},
+		{Suffix: "www.example.com", Action: "specific"},
+		{Suffix: "ads", Type: dnsmasq.RuleKeyword, Action: "keyword"},
+		{Suffix: "ads.example.org", Action: "after-keyword"},
+		{Suffix: "exact.example.org", Type: dnsmasq.RuleDomain, Action: "exact"},
+		{Suffix: "example.org", Action: "suffix"},
+		{Suffix: "*.wild.example.net", Action: "wild"},
+		{Suffix: "wild.example.net", Action: "apex"},
+		{Suffix: "Mixed.Case.Example", Action: "mixed"},
+		{Suffix: "example.com", Action: "duplicate"},
+		{Suffix: "10.0.0.0/8", Type: dnsmasq.RuleIPCIDR, Action: "cidr"},
+	}
+	index := dnsmasq.NewRuleIndex(rules)
+	for _, domain := range []string{
+		"www.example.com", "example.com", "ads.example.org", "exact.example.org", "a.exact.example.org",
+		"x.wild.example.net", "wild.example.net", "mixed.case.example", "A.MIXED.CASE.EXAMPLE.",
+		"10.0.0.1", "unmatched.test", "", ".", "a..example.org",
+	} {
+		want, wantOK := dnsmasq.MatchRule(domain, rules)
+		got, ok := index.MatchRule(domain)
+		if ok != wantOK || got != want {
+			t.Errorf("MatchRule(%q) = %+v %v, want %+v %v", domain, got, ok, want, wantOK)
+		}
+	}
+	if index.Len() != len(rules) {
+		t.Errorf("Len() = %d, want %d", index.Len(), len(rules))
+	}
+}
+
+// randomRules returns random rules and a generator of domains drawn from
+// a small alphabet of labels, so they collide. Each rule's action is its
+// position.
+func randomRules(rng *rand.Rand) ([]dnsmasq.Rule, func() string) {
+	labels := []string{"a", "b", "co", "t", "ads", "x"}
+	name := func() string {
+		parts := make([]string, 1+rng.Intn(4))
+		for i := range parts {
+			parts[i] = labels[rng.Intn(len(labels))]
+		}
+		return strings.Join(parts, ".")
+	}
+	types := []dnsmasq.RuleType{dnsmasq.RuleSuffix, dnsmasq.RuleDomain, dnsmasq.RuleKeyword}
+	rules := make([]dnsmasq.Rule, 1+rng.Intn(20))
+	for i := range rules {
+		rules[i] = dnsmasq.Rule{Suffix: name(), Type: types[rng.Intn(len(types))], Action: fmt.Sprint(i)}
+		if rules[i].Type == dnsmasq.RuleSuffix && rng.Intn(4) == 0 {
+			rules[i].Suffix = "*." + rules[i].Suffix
+		}
+	}
+	return rules, name
+}
+
+// TestRuleIndexRandom compares the index with MatchRule on random rules
+func TestRuleIndexRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		rules, name := randomRules(rng)
+		index := dnsmasq.NewRuleIndex(rules)
+		for i := 0; i < 50; i++ {
+			domain := name()
+			want, wantOK := dnsmasq.MatchRule(domain, rules)
+			got, ok := index.MatchRule(domain)
+			if ok != wantOK || got != want {
+				t.Fatalf("rules %v: MatchRule(%q) = %+v %v, want %+v %v", rules, domain, got, ok, want, wantOK)
+			}
+		}
+	}
+}
+
+// TestRuleTrieRandom compares the trie, and the database compiled from
+// it, with MatchRule on random rules: the first rule in list order must
+// win, not the most specific one
+func TestRuleTrieRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	path := filepath.Join(t.TempDir(), "rules.db")
+	for round := 0; round < 200; round++ {
+		rules, name := randomRules(rng)
+		trie := dnsmasq.NewRuleTrie(len(rules))
+		for _, rule := range rules {
+			trie.InsertRule(rule)
+		}
+		if err := dnsmasq.SaveRuleDB(path, trie, nil); err != nil {
+			t.Fatal(err)
+		}
+		db, err := dnsmasq.OpenRuleDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			domain := name()
+			want, wantOK := dnsmasq.MatchRule(domain, rules)
+			for kind, m := range map[string]*dnsmasq.RuleTrie{"trie": trie, "db": db} {
+				// 动作即规则的位置，比较动作就是比较命中的是哪条规则
+				got, ok := m.MatchRule(domain)
+				if ok != wantOK || got.Action != want.Action || got.Type != want.Type {
+					t.Fatalf("rules %v: %s.MatchRule(%q) = %+v %v, want %+v %v", rules, kind, domain, got, ok, want, wantOK)
+				}
+				if action, _ := m.MatchAction(domain); action != want.Action {
+					t.Fatalf("rules %v: %s.MatchAction(%q) = %q, want %q", rules, kind, domain, action, want.Action)
+				}
+			}
+		}
+		db.Close()
+	}
+}
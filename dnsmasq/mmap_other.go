@@ -0,0 +1,25 @@
+//go:build !unix
+
+package dnsmasq
+
+import "os"
+
+// mapFile reads path into memory on platforms without mmap
+func mapFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < ruleDBHeaderSize {
+		return nil, ErrRuleDBFormat
+	}
+	// 按 8 字节对齐，与 mmap 的页对齐保持一致
+	buf := make([]uint64, (len(data)+7)/8)
+	aligned := bytesOf(buf, 8)[:len(data)]
+	copy(aligned, data)
+	return aligned, nil
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
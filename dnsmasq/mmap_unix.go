@@ -0,0 +1,30 @@
+//go:build unix
+
+package dnsmasq
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps path read-only and shared
+func mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < ruleDBHeaderSize {
+		return nil, ErrRuleDBFormat
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,162 @@
+package dnsmasq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNegativeCached marks a failure served from the negative cache instead
+// of the upstream. It is wrapped together with the original failure, so
+// errors.Is(err, ErrNXDomain) still holds for a name known not to exist.
+var ErrNegativeCached = errors.New("cached failure")
+
+// maxNegative bounds the negative cache; expired entries are dropped when
+// it fills up
+const maxNegative = 65536
+
+// NegativeCache remembers failed resolutions for a short while, so a name
+// that doesn't resolve isn't sent upstream again on every query. NXDOMAIN
+// and empty answers are kept for TTL, timeouts and other server failures
+// for ServFailTTL. Methods are safe on a nil *NegativeCache, which
+// remembers nothing.
+type NegativeCache struct {
+	TTL         time.Duration
+	ServFailTTL time.Duration
+
+	mu sync.Mutex
+	m  map[negKey]negEntry
+}
+
+// negKey is a domain and query type; NXDOMAIN is stored with qtype 0, as
+// it holds for every type
+type negKey struct {
+	domain string
+	qtype  uint16
+}
+
+type negEntry struct {
+	err     error
+	expires int64 // monoNow 时间
+}
+
+// NewNegativeCache returns a negative cache, or nil when both TTLs are zero
+func NewNegativeCache(ttl, servFailTTL time.Duration) *NegativeCache {
+	if ttl <= 0 && servFailTTL <= 0 {
+		return nil
+	}
+	return &NegativeCache{TTL: ttl, ServFailTTL: servFailTTL, m: make(map[negKey]negEntry)}
+}
+
+// Get returns the cached failure of a qtype query for domain, wrapped with
+// ErrNegativeCached
+func (c *NegativeCache) Get(domain string, qtype uint16) (error, bool) {
+	if c == nil {
+		return nil, false
+	}
+	now := monoNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []negKey{{domain, 0}, {domain, qtype}} {
+		e, ok := c.m[key]
+		if !ok {
+			continue
+		}
+		if now >= e.expires {
+			delete(c.m, key)
+			continue
+		}
+		return fmt.Errorf("%s: %w (%w)", domain, e.err, ErrNegativeCached), true
+	}
+	return nil, false
+}
+
+// Set remembers that a qtype query for domain failed with err. Failures
+// already served from the cache and unclassified errors are ignored.
+func (c *NegativeCache) Set(domain string, qtype uint16, err error) {
+	if c == nil || err == nil || errors.Is(err, ErrNegativeCached) {
+		return
+	}
+	var kind error
+	ttl := c.ServFailTTL
+	switch {
+	case errors.Is(err, ErrNXDomain):
+		kind, ttl, qtype = ErrNXDomain, c.TTL, 0
+	case errors.Is(err, ErrNoAnswer):
+		kind, ttl = ErrNoAnswer, c.TTL
+	case errors.Is(err, ErrUpstreamTimeout):
+		kind = ErrUpstreamTimeout
+	case errors.Is(err, ErrServFail):
+		kind = ErrServFail
+	case errors.Is(err, ErrCircularCNAME):
+		kind = ErrCircularCNAME
+	case errors.Is(err, ErrCNAMEDepth):
+		kind = ErrCNAMEDepth
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := monoNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= maxNegative {
+		c.purgeLocked(now)
+		if len(c.m) >= maxNegative {
+			return
+		}
+	}
+	c.m[negKey{domain, qtype}] = negEntry{err: kind, expires: now + int64(ttl)}
+}
+
+// Purge drops expired entries and returns how many were removed
+func (c *NegativeCache) Purge() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.purgeLocked(monoNow())
+}
+
+func (c *NegativeCache) purgeLocked(now int64) int {
+	removed := 0
+	for key, e := range c.m {
+		if now >= e.expires {
+			delete(c.m, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush drops the entries of the domains for which match returns true
+// and returns how many were removed
+func (c *NegativeCache) Flush(match func(domain string) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key := range c.m {
+		if match(key.domain) {
+			delete(c.m, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of entries, including expired ones not yet purged
+func (c *NegativeCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
@@ -0,0 +1,30 @@
+package dnsmasq
+
+import "math/rand/v2"
+
+// AddrSorter orders the addresses of an answer, best first, before the
+// resolver answers with and routes the first. viaVPN tells whether domain
+// matches the rules, i.e. which egress the addresses will be reached
+// through. Implementations must be safe for concurrent use.
+type AddrSorter interface {
+	SortAddrs(domain string, ips []string, viaVPN bool)
+}
+
+// Shuffle is an AddrSorter spreading load over the addresses of an answer
+// by picking them in random order
+var Shuffle AddrSorter = shuffle{}
+
+type shuffle struct{}
+
+func (shuffle) SortAddrs(domain string, ips []string, viaVPN bool) {
+	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+}
+
+// pick returns the address of an answer to use, after sorting ips with
+// Sorter
+func (r *Resolver) pick(domain string, ips []string) string {
+	if len(ips) > 1 && r.Sorter != nil {
+		r.Sorter.SortAddrs(domain, ips, !r.direct(domain))
+	}
+	return ips[0]
+}
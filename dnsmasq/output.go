@@ -3,6 +3,8 @@ package dnsmasq
 import (
 	"fmt"
 	"os"
+
+	"openvpnadvanced/audit"
 )
 
 type ResolvedResult struct {
@@ -12,7 +14,8 @@ type ResolvedResult struct {
 }
 
 // ExportVPNIPs writes all VPN-targeted domain-IP mappings to a file
-func ExportVPNIPs(results []ResolvedResult, outputPath string) error {
+func ExportVPNIPs(results []ResolvedResult, outputPath string) (err error) {
+	defer func() { audit.Record(audit.FileWrite, outputPath, "VPN IP export", err) }()
 	file, err := os.Create(outputPath)
 	if err != nil {
 		return err
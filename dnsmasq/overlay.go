@@ -0,0 +1,60 @@
+package dnsmasq
+
+// Overlay matches Rules before Base, layering a short rule list (e.g. the
+// enabled rule groups) over a compiled one
+type Overlay struct {
+	Rules []Rule
+	Base  RuleMatcher
+}
+
+// Match reports whether domain matches Rules or Base
+func (o *Overlay) Match(domain string) bool {
+	_, ok := o.MatchRule(domain)
+	return ok
+}
+
+// MatchAction returns the action of the rule matching domain
+func (o *Overlay) MatchAction(domain string) (string, bool) {
+	rule, ok := o.MatchRule(domain)
+	return rule.Action, ok
+}
+
+// MatchRule returns the first of Rules matching domain, else Base's match.
+// A Base that can't name its rules reports the domain itself as the suffix.
+func (o *Overlay) MatchRule(domain string) (Rule, bool) {
+	if rule, ok := MatchRule(domain, o.Rules); ok {
+		return rule, true
+	}
+	switch m := o.Base.(type) {
+	case nil:
+		return Rule{}, false
+	case RuleFinder:
+		return m.MatchRule(domain)
+	case ActionMatcher:
+		action, ok := m.MatchAction(domain)
+		return Rule{Suffix: domain, Action: action}, ok
+	default:
+		return Rule{Suffix: domain}, m.Match(domain)
+	}
+}
+
+// MatchIP returns the first IP-CIDR or GEOIP rule of Rules matching ip,
+// else Base's match
+func (o *Overlay) MatchIP(ip string, geo CountryLookup) (Rule, bool) {
+	if rule, ok := MatchIPRule(ip, o.Rules, geo); ok {
+		return rule, true
+	}
+	if m, ok := o.Base.(IPMatcher); ok {
+		return m.MatchIP(ip, geo)
+	}
+	return Rule{}, false
+}
+
+// Len returns the number of rules of both layers
+func (o *Overlay) Len() int {
+	n := len(o.Rules)
+	if t, ok := o.Base.(interface{ Len() int }); ok {
+		n += t.Len()
+	}
+	return n
+}
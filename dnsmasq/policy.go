@@ -0,0 +1,79 @@
+package dnsmasq
+
+import (
+	"fmt"
+	"strings"
+
+	"openvpnadvanced/actions"
+)
+
+// Policy is what a matching rule does with the answer, as named by the
+// trailing field of its line ("DOMAIN-SUFFIX,netflix.com,PROXY")
+type Policy uint8
+
+const (
+	// PolicyProxy routes the answer through the VPN, or hands it to the
+	// rule's custom action. Rules without an action, VPN and PROXY ones
+	// have it.
+	PolicyProxy Policy = iota
+	// PolicyDirect leaves the answer unrouted, and resolves it through
+	// Resolver.Direct when set. A DIRECT rule ahead of a broader PROXY
+	// one exempts part of a proxied zone.
+	PolicyDirect
+	// PolicyReject answers without asking the upstream: 0.0.0.0 and ::
+	// or NXDOMAIN, depending on the server
+	PolicyReject
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyDirect:
+		return actions.Direct
+	case PolicyReject:
+		return actions.Reject
+	}
+	return actions.Proxy
+}
+
+// Routes reports whether the policy routes the answer
+func (p Policy) Routes() bool {
+	return p == PolicyProxy
+}
+
+// Policy returns the policy the rule's action names
+func (r Rule) Policy() Policy {
+	switch {
+	case strings.EqualFold(r.Action, actions.Direct):
+		return PolicyDirect
+	case strings.EqualFold(r.Action, actions.Reject):
+		return PolicyReject
+	}
+	return PolicyProxy
+}
+
+// Policy returns the policy of the rule matching domain, and the rule.
+// Domains no rule matches go DIRECT, with ok false.
+func (r *Resolver) Policy(domain string) (p Policy, rule Rule, ok bool) {
+	rule, ok = r.matchRule(domain)
+	if !ok {
+		return PolicyDirect, Rule{}, false
+	}
+	return rule.Policy(), rule, true
+}
+
+// direct reports whether domain resolves through Resolver.Direct
+func (r *Resolver) direct(domain string) bool {
+	p, _, _ := r.Policy(domain)
+	return p == PolicyDirect
+}
+
+// rejected returns ErrRejected for a domain a REJECT rule matches
+func (r *Resolver) rejected(domain string) error {
+	if p, rule, _ := r.Policy(domain); p == PolicyReject {
+		if r.verbose() {
+			r.logf("[REJECT] %s (%s)", domain, rule.Suffix)
+		}
+		return fmt.Errorf("%s: %w", domain, ErrRejected)
+	}
+	return nil
+}
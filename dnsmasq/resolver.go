@@ -1,193 +1,646 @@
 package dnsmasq
 
 import (
-	"bufio"
-	"log"
-	"net"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
 	"openvpnadvanced/doh"
-	"os"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RuleType is the kind of a rule line
+type RuleType uint8
+
+const (
+	// RuleSuffix (DOMAIN-SUFFIX) matches the domain Suffix and its
+	// subdomains, on label boundaries; a Suffix of the form *.parent
+	// matches only the subdomains of parent
+	RuleSuffix RuleType = iota
+	// RuleDomain (DOMAIN) matches the domain Suffix exactly
+	RuleDomain
+	// RuleKeyword (DOMAIN-KEYWORD) matches domains containing Suffix
+	RuleKeyword
+	// RuleIPCIDR (IP-CIDR) and RuleIPCIDR6 (IP-CIDR6) match resolved
+	// addresses within Prefix rather than domains
+	RuleIPCIDR
+	RuleIPCIDR6
+	// RuleGeoIP (GEOIP) matches resolved addresses located in the country
+	// Suffix, an ISO 3166 code; LAN matches private and local addresses
+	RuleGeoIP
 )
 
+// IsIP reports whether rules of type t match addresses instead of domains
+func (t RuleType) IsIP() bool {
+	return t == RuleIPCIDR || t == RuleIPCIDR6 || t == RuleGeoIP
+}
+
+// CountryLookup finds the country of an address for GEOIP rules (see
+// package geoip). Country returns an upper-case ISO 3166 code, or "".
+type CountryLookup interface {
+	Country(ip netip.Addr) string
+}
+
+// String returns the rule-list keyword of t
+func (t RuleType) String() string {
+	switch t {
+	case RuleDomain:
+		return "DOMAIN"
+	case RuleKeyword:
+		return "DOMAIN-KEYWORD"
+	case RuleIPCIDR:
+		return "IP-CIDR"
+	case RuleIPCIDR6:
+		return "IP-CIDR6"
+	case RuleGeoIP:
+		return "GEOIP"
+	default:
+		return "DOMAIN-SUFFIX"
+	}
+}
+
 type Rule struct {
+	// Suffix is the value the rule matches with: the suffix, the exact
+	// domain, the keyword, the CIDR or the country code, depending on Type
 	Suffix string
+	// Action is the trailing field of the rule line: PROXY, DIRECT,
+	// REJECT or a custom action (see package actions); empty means the
+	// default VPN route. Policy interprets it.
+	Action string
+	Type   RuleType
+	// Prefix is the parsed Suffix of IP-CIDR and IP-CIDR6 rules
+	Prefix netip.Prefix
+}
+
+// Matches reports whether the rule matches domain, case-insensitively
+func (r Rule) Matches(domain string) bool {
+	return r.matches(strings.ToLower(domain))
+}
+
+// matches is Matches for a lower-cased domain
+func (r Rule) matches(domain string) bool {
+	// 将规则转换为小写进行匹配
+	value := strings.ToLower(r.Suffix)
+	switch r.Type {
+	case RuleDomain:
+		return strings.TrimSuffix(domain, ".") == strings.Trim(value, ".")
+	case RuleKeyword:
+		return strings.Contains(domain, value)
+	case RuleIPCIDR, RuleIPCIDR6, RuleGeoIP:
+		return false
+	default:
+		return MatchSuffix(domain, value)
+	}
+}
+
+// MatchSuffix reports whether domain is suffix or a subdomain of it,
+// comparing whole labels, so "t.co" matches "x.t.co" but not "nott.co".
+// A suffix of the form *.parent matches the subdomains of parent but not
+// parent itself. Leading and trailing dots are ignored; both are expected
+// in lower case.
+func MatchSuffix(domain, suffix string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	parent, wild := strings.CutPrefix(suffix, "*.")
+	parent = strings.Trim(parent, ".")
+	if parent == "" {
+		return false
+	}
+	if len(domain) == len(parent) {
+		return !wild && domain == parent
+	}
+	return len(domain) > len(parent) && domain[len(domain)-len(parent)-1] == '.' && strings.HasSuffix(domain, parent)
 }
 
 func MatchesRules(domain string, rules []Rule) bool {
+	_, ok := MatchRule(domain, rules)
+	return ok
+}
+
+// MatchRule returns the first rule matching domain
+func MatchRule(domain string, rules []Rule) (Rule, bool) {
 	// 将域名转换为小写，确保不受大小写影响
 	domain = strings.ToLower(domain)
 
 	for _, rule := range rules {
-		// 将规则后缀转换为小写进行匹配
-		if strings.HasSuffix(domain, strings.ToLower(rule.Suffix)) {
-			return true
+		if rule.matches(domain) {
+			return rule, true
 		}
 	}
-	return false
+	return Rule{}, false
 }
 
-func ResolveRecursive(domain string, rules []Rule, cache *Cache) (bool, string) {
-	visited := make(map[string]bool)
-	current := domain
-	originalDomain := domain // 保持原始域名
-
-	for depth := 0; depth < 10; depth++ {
-		if visited[current] {
-			log.Printf("⚠️ Circular CNAME detected for %s", domain)
-			return false, ""
-		}
-		visited[current] = true
-
-		// 缓存检查（保留原始域名规则匹配）
-		if cachedVal, ok := cache.Get(current); ok {
-			if net.ParseIP(cachedVal) != nil {
-				log.Printf("[CACHE] %s ➜ %s", current, cachedVal)
-				return MatchesRules(originalDomain, rules), cachedVal // 使用原始域名进行匹配
-			} else {
-				log.Printf("[CACHE-CNAME] %s ➜ %s", current, cachedVal)
-				current = cachedVal
+// MatchIPRule returns the first IP-CIDR, IP-CIDR6 or GEOIP rule matching
+// ip, looking its country up in geo at most once
+func MatchIPRule(ip string, rules []Rule, geo CountryLookup) (Rule, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Rule{}, false
+	}
+	addr = addr.Unmap()
+	var country string
+	looked := false
+	for _, rule := range rules {
+		switch rule.Type {
+		case RuleIPCIDR, RuleIPCIDR6:
+			if rule.Prefix.Contains(addr) {
+				return rule, true
+			}
+		case RuleGeoIP:
+			if rule.Suffix == "LAN" || rule.Suffix == "PRIVATE" {
+				if isLocal(addr) {
+					return rule, true
+				}
 				continue
 			}
+			if !looked && geo != nil {
+				country, looked = geo.Country(addr), true
+			}
+			if country != "" && country == rule.Suffix {
+				return rule, true
+			}
 		}
+	}
+	return Rule{}, false
+}
 
-		// DNS查询流程
-		ip, cname, err := doh.QueryWithCNAME(current)
-		if err == nil && ip != "" {
-			log.Printf("[A] %s ➜ %s", current, ip)
-			cache.Set(originalDomain, ip) // 使用原始域名缓存
-			cache.Set(current, ip)
-			return MatchesRules(originalDomain, rules), ip
-		}
+// isLocal reports whether addr is private, loopback or link-local
+func isLocal(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+}
 
-		ipv6, err := doh.QueryAAAA(current)
-		if err == nil && ipv6 != "" {
-			log.Printf("[AAAA] %s ➜ %s", current, ipv6)
-			cache.Set(originalDomain, ipv6) // 使用原始域名缓存
-			cache.Set(current, ipv6)
-			return MatchesRules(originalDomain, rules), ipv6
-		}
+// Resolver resolves domains over DoH following CNAME chains, consulting
+// and filling Cache and matching the original name against Rules
+type Resolver struct {
+	Rules []Rule
+	// Matcher, when set, is used instead of Rules (e.g. a RuleTrie)
+	Matcher RuleMatcher
+	Cache   CacheBackend
+	// Upstream answers the queries; doh.Endpoint when nil
+	Upstream Upstream
+	// Direct, when set, resolves domains that don't match the rules (e.g.
+	// the network's designated resolver); matched domains and all domains
+	// when unset use Upstream
+	Direct Upstream
+	// Logger receives diagnostic output; DefaultLogger when nil
+	Logger Logger
+	// MaxDepth is the number of CNAMEs followed before giving up with
+	// ErrCNAMEDepth (default DefaultMaxDepth)
+	MaxDepth int
+	// PartialChain makes ResolveChain return the CNAMEs followed so far
+	// when resolution fails, to diagnose broken CDN configurations
+	PartialChain bool
+	// GeoIP locates answers for GEOIP rules
+	GeoIP CountryLookup
+	// MinTTL and MaxTTL clamp the record TTLs answers are cached for;
+	// zero doesn't clamp. Backends without per-entry TTLs (see TTLCache)
+	// keep answers for their own TTL.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Negative remembers failed resolutions, which are then returned
+	// wrapped with ErrNegativeCached without asking the upstream
+	Negative *NegativeCache
+	// Sorter orders the addresses of answers holding several before the
+	// first is used; nil keeps the upstream's order
+	Sorter AddrSorter
+	// Prefer orders the addresses of ResolveFull, which queries the A and
+	// AAAA records concurrently (default PreferIPv4)
+	Prefer Family
+	// Offline answers only from Cache, failing with ErrOffline instead of
+	// querying an upstream, e.g. while none is reachable. AAAA answers
+	// aren't cached, so they always fail.
+	Offline bool
+	// Timeout bounds a whole resolution: the A, AAAA and CNAME queries of
+	// a chain share it, and once it passes resolution fails
+	// with ErrUpstreamTimeout. Zero leaves each query its own timeout.
+	Timeout time.Duration
 
-		if cname != "" {
-			log.Printf("[CNAME] %s ➜ %s", current, cname)
-			current = cname
-			continue
-		}
+	// revalidating skips the cache, for the refresh of a stale entry
+	revalidating bool
+}
 
-		// 后备查询逻辑
-		allRecords, err := doh.QueryAll(current)
-		if err == nil {
-			for recordType, answers := range allRecords {
-				for _, answer := range answers {
-					if net.ParseIP(answer) != nil {
-						log.Printf("[FALLBACK][%s] %s ➜ %s", recordType, current, answer)
-						cache.Set(originalDomain, answer) // 使用原始域名缓存
-						cache.Set(current, answer)
-						return MatchesRules(originalDomain, rules), answer
-					}
-				}
-			}
+// context returns the context bounding one resolution by Timeout
+func (r *Resolver) context() (context.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), r.Timeout)
+}
+
+// cacheTTL clamps a record TTL to MinTTL and MaxTTL. A zero TTL still
+// caches the answer for a second, as the cache's own TTL would apply to a
+// zero duration; an unknown (negative) TTL gets the cache's own.
+func (r *Resolver) cacheTTL(ttl time.Duration) time.Duration {
+	if ttl < 0 {
+		return 0
+	}
+	if r.MinTTL > 0 && ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	return max(ttl, time.Second)
+}
+
+// DefaultMaxDepth is the CNAME chain length followed by default
+const DefaultMaxDepth = 10
+
+// ResolveRecursive resolves domain following CNAMEs and reports whether it
+// or the resolved address matches the rules. Failures are reported as ErrNXDomain,
+// ErrUpstreamTimeout, ErrCircularCNAME or ErrNoAnswer (use errors.Is).
+func ResolveRecursive(domain string, rules []Rule, cache CacheBackend) (bool, string, error) {
+	r := &Resolver{Rules: rules, Cache: cache}
+	return r.Resolve(domain)
+}
+
+// ResolveWithCNAME is like ResolveRecursive but also returns the first
+// CNAME of the chain
+func ResolveWithCNAME(domain string, rules []Rule, cache CacheBackend) (bool, string, string, error) {
+	r := &Resolver{Rules: rules, Cache: cache}
+	return r.ResolveWithCNAME(domain)
+}
+
+// Resolve is the Resolver counterpart of ResolveRecursive
+func (r *Resolver) Resolve(domain string) (bool, string, error) {
+	shouldRoute, ip, _, err := r.ResolveWithCNAME(domain)
+	return shouldRoute, ip, err
+}
+
+// verbose reports whether log output is kept, so hot paths can skip
+// formatting (and its allocations) when logging is discarded
+func (r *Resolver) verbose() bool {
+	return r.Logger != DiscardLogger
+}
+
+// isIP reports whether s is an IP address without allocating
+func isIP(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+// matchIP reports whether ip matches an IP-CIDR or GEOIP rule of
+// Matcher, or of Rules when unset
+func (r *Resolver) matchIP(ip string) bool {
+	_, ok := r.matchIPRule(ip)
+	return ok
+}
+
+// matchIPRule is matchIP returning the rule
+func (r *Resolver) matchIPRule(ip string) (Rule, bool) {
+	if r.Matcher != nil {
+		m, ok := r.Matcher.(IPMatcher)
+		if !ok {
+			return Rule{}, false
 		}
+		return m.MatchIP(ip, r.GeoIP)
+	}
+	return MatchIPRule(ip, r.Rules, r.GeoIP)
+}
 
-		break
+// upstream returns the upstream for domain
+func (r *Resolver) upstream(domain string) Upstream {
+	if r.Direct != nil && r.direct(domain) {
+		return r.UpstreamFor(PolicyDirect)
+	}
+	return r.UpstreamFor(PolicyProxy)
+}
+
+// UpstreamFor returns the upstream that resolves domains with policy p:
+// Direct for DIRECT ones when set, Upstream otherwise
+func (r *Resolver) UpstreamFor(p Policy) Upstream {
+	switch {
+	case r.Offline:
+		return offline{}
+	case p == PolicyDirect && r.Direct != nil:
+		return r.Direct
+	case r.Upstream != nil:
+		return r.Upstream
 	}
+	return (*doh.Upstream)(nil)
+}
 
-	log.Printf("❌ Resolution failed for %s", domain)
-	return false, ""
+func (r *Resolver) logf(format string, args ...any) {
+	if r.Logger == nil {
+		DefaultLogger.Printf(format, args...)
+		return
+	}
+	r.Logger.Printf(format, args...)
 }
 
+// LoadDomainRules reads the rule list at path (see ReadRules), with the
+// rule sets its RULE-SET and DOMAIN-SET lines include, relative to its
+// directory, in their place
 func LoadDomainRules(path string) ([]Rule, error) {
-	file, err := os.Open(path)
-	if err != nil {
+	var rules []Rule
+	rr := &ruleReader{fn: appendRule(&rules)}
+	if err := rr.readFile(path, "", nil); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return rules, nil
+}
+
+// appendRule returns a ruleReader callback appending to rules
+func appendRule(rules *[]Rule) func(typ RuleType, value, action []byte) {
+	return func(typ RuleType, value, action []byte) {
+		if rule, ok := ruleOf(typ, value, action); ok {
+			*rules = append(*rules, rule)
+		}
+	}
+}
 
+// ReadRules parses a rule list line by line (see ParseRuleLine), or a
+// Clash rule-provider payload. RULE-SET includes are skipped.
+func ReadRules(r io.Reader) ([]Rule, error) {
 	var rules []Rule
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		if strings.HasPrefix(line, "DOMAIN-SUFFIX,") {
-			parts := strings.SplitN(line, ",", 2)
-			if len(parts) == 2 {
-				rules = append(rules, Rule{Suffix: strings.ToLower(parts[1])})
-			}
+	rr := &ruleReader{fn: appendRule(&rules)}
+	err := rr.read(r, "", "", nil)
+	return rules, err
+}
+
+// ResolveWithCNAME is like Resolve but also returns the first CNAME of the
+// chain. It's Decide reduced to a few values.
+func (r *Resolver) ResolveWithCNAME(domain string) (bool, string, string, error) {
+	d, err := r.Decide(domain, dns.TypeA)
+	if err != nil {
+		return false, "", "", err
+	}
+	var firstCNAME string
+	if len(d.CNAMEs) > 0 {
+		firstCNAME = d.CNAMEs[0]
+	}
+	return d.Routes(), d.IP(), firstCNAME, nil
+}
+
+// ResolveChain resolves domain following CNAMEs and returns the address
+// with every CNAME of the chain, in order. CNAME links are cached per
+// hop, so answers served from the cache keep their chain. A chain that
+// loops or runs past MaxDepth fails with a *ChainError.
+func (r *Resolver) ResolveChain(domain string) (string, []string, error) {
+	value, cnames, err := r.resolveValue(domain, nil)
+	return firstAddr(value), cnames, err
+}
+
+// ResolveAddrs is like ResolveChain but returns every address of the
+// answer, best first
+func (r *Resolver) ResolveAddrs(domain string) ([]string, []string, error) {
+	value, cnames, err := r.resolveValue(domain, nil)
+	if err != nil {
+		return nil, cnames, err
+	}
+	ips, _ := SplitAddrs(value)
+	return ips, cnames, nil
+}
+
+// resolveValue returns the cache value (see JoinAddrs) of domain's answer,
+// recording its source in d unless nil
+func (r *Resolver) resolveValue(domain string, d *Decision) (string, []string, error) {
+	if err := r.rejected(domain); err != nil {
+		return "", nil, err
+	}
+	value, cnames, err := r.resolveChain(domain, d)
+	if err != nil {
+		r.Negative.Set(domain, doh.TypeA, err)
+		if !r.PartialChain {
+			cnames = nil
 		}
 	}
-	return rules, nil
+	return value, cnames, err
 }
 
-func ResolveWithCNAME(domain string, rules []Rule, cache *Cache) (bool, string, string) {
+func (r *Resolver) resolveChain(domain string, d *Decision) (string, []string, error) {
+	cache := r.Cache
+	// 快速路径：缓存直接命中 IP 时不分配内存
+	if cachedVal, ok := r.cached(domain); ok && isAddrs(cachedVal) {
+		if r.verbose() {
+			r.logf("[CACHE] %s ➜ %s", domain, cachedVal)
+		}
+		d.from(SourceCache, nil)
+		return cachedVal, nil, nil
+	}
+	if err, ok := r.Negative.Get(domain, doh.TypeA); ok {
+		if r.verbose() {
+			r.logf("[NEGATIVE] %v", err)
+		}
+		d.from(SourceCache, nil)
+		return "", nil, err
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+
 	visited := make(map[string]bool)
 	current := domain
 	originalDomain := domain
-	var firstCNAME string
+	var cnames []string
+	var lastErr error
+	upstream := r.upstream(originalDomain)
+	// asked 表示已查询过上游，之后命中缓存的链接不改变来源
+	asked := false
 
-	for depth := 0; depth < 10; depth++ {
+	// found caches the answer for its TTL; behind a CNAME the links
+	// already lead to it
+	found := func(ips []string, ttl time.Duration) (string, []string, error) {
+		ttl = r.cacheTTL(ttl)
+		value := JoinAddrs(ips)
+		if len(cnames) == 0 {
+			SetWithTTL(cache, originalDomain, value, ttl) // 使用原始域名缓存
+		}
+		SetWithTTL(cache, current, value, ttl)
+		return value, cnames, nil
+	}
+
+	maxDepth := r.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	for {
 		if visited[current] {
-			log.Printf("⚠️ Circular CNAME detected for %s", domain)
-			return false, "", ""
+			err := &ChainError{Domain: domain, Chain: cnames, Err: ErrCircularCNAME}
+			if r.verbose() {
+				r.logf("⚠️ CNAME loop: %v", err)
+			}
+			return "", cnames, err
+		}
+		if len(cnames) > maxDepth {
+			err := &ChainError{Domain: domain, Chain: cnames, Err: ErrCNAMEDepth}
+			if r.verbose() {
+				r.logf("⚠️ CNAME depth %d exceeded: %v", maxDepth, err)
+			}
+			return "", cnames, err
 		}
 		visited[current] = true
 
 		// 缓存检查（保持规则匹配）
-		if cachedVal, ok := cache.Get(current); ok {
-			if net.ParseIP(cachedVal) != nil {
-				log.Printf("[CACHE] %s ➜ %s", current, cachedVal)
-				return MatchesRules(originalDomain, rules), cachedVal, firstCNAME
+		if cachedVal, ok := r.cached(current); ok {
+			if !asked {
+				d.from(SourceCache, nil)
+			}
+			if isAddrs(cachedVal) {
+				if r.verbose() {
+					r.logf("[CACHE] %s ➜ %s", current, cachedVal)
+				}
+				return cachedVal, cnames, nil
 			} else {
-				log.Printf("[CACHE-CNAME] %s ➜ %s", current, cachedVal)
+				if r.verbose() {
+					r.logf("[CACHE-CNAME] %s ➜ %s", current, cachedVal)
+				}
+				cnames = append(cnames, cachedVal)
 				current = cachedVal
 				continue
 			}
 		}
 
-		// DNS查询流程
-		ip, cname, err := doh.QueryWithCNAME(current)
-		if err == nil && ip != "" {
-			log.Printf("[A] %s ➜ %s", current, ip)
-			cache.Set(originalDomain, ip) // 使用原始域名缓存
-			cache.Set(current, ip)
-			return MatchesRules(originalDomain, rules), ip, firstCNAME
+		// 只查询 A 记录，A 查询不能用 AAAA 地址回答
+		asked = true
+		d.from(SourceUpstream, upstream)
+		a := r.lookup(ctx, upstream, current, dns.TypeA)
+		if a.usable() {
+			r.pick(originalDomain, a.ips)
+			if r.verbose() {
+				r.logf("[%s] %s ➜ %s", a.kind(), current, strings.Join(a.ips, ", "))
+			}
+			return found(a.ips, a.ttl)
 		}
-
-		ipv6, err := doh.QueryAAAA(current)
-		if err == nil && ipv6 != "" {
-			log.Printf("[AAAA] %s ➜ %s", current, ipv6)
-			cache.Set(originalDomain, ipv6) // 使用原始域名缓存
-			cache.Set(current, ipv6)
-			return MatchesRules(originalDomain, rules), ipv6, firstCNAME
+		if errors.Is(a.err, ErrNXDomain) {
+			if r.verbose() {
+				r.logf("[NXDOMAIN] %s", current)
+			}
+			return "", cnames, fmt.Errorf("%s: %w", domain, ErrNXDomain)
+		}
+		lastErr = a.err
+		if ctx.Err() != nil {
+			// 整体时限已用完
+			lastErr = ErrUpstreamTimeout
+			break
+		}
+		if errors.Is(a.err, ErrServFail) {
+			break
 		}
 
-		if cname != "" {
-			log.Printf("[CNAME] %s ➜ %s", current, cname)
-			if firstCNAME == "" {
-				firstCNAME = cname
+		if cname := a.cname; cname != "" {
+			if r.verbose() {
+				r.logf("[CNAME] %s ➜ %s", current, cname)
 			}
+			// 按跳缓存 CNAME，缓存命中时仍能还原整条链
+			SetWithTTL(cache, current, cname, r.cacheTTL(a.ttl))
+			cnames = append(cnames, cname)
 			current = cname
 			continue
 		}
 
-		// 后备查询逻辑
-		allRecords, err := doh.QueryAll(current)
-		if err == nil {
-			for recordType, answers := range allRecords {
-				for _, answer := range answers {
-					if net.ParseIP(answer) != nil {
-						log.Printf("[FALLBACK][%s] %s ➜ %s", recordType, current, answer)
-						cache.Set(originalDomain, answer) // 使用原始域名缓存
-						cache.Set(current, answer)
-						return MatchesRules(originalDomain, rules), answer, firstCNAME
-					}
-				}
-			}
-		}
-
+		// 没有地址也没有 CNAME：其他记录类型不会带来 IPv4 地址
 		break
 	}
 
-	log.Printf("❌ Resolution failed for %s", domain)
-	return false, "", ""
+	if r.verbose() {
+		r.logf("❌ Resolution failed for %s", domain)
+	}
+	if errors.Is(lastErr, ErrOffline) {
+		return "", cnames, fmt.Errorf("%s: %w", domain, ErrOffline)
+	}
+	if errors.Is(lastErr, ErrUpstreamTimeout) || ctx.Err() != nil {
+		return "", cnames, fmt.Errorf("%s: %w", domain, ErrUpstreamTimeout)
+	}
+	if errors.Is(lastErr, ErrServFail) {
+		return "", cnames, fmt.Errorf("%s: %w", domain, ErrServFail)
+	}
+	return "", cnames, fmt.Errorf("%s: %w", domain, ErrNoAnswer)
+}
+
+// Exchange sends a raw query for domain to the upstream the rules select
+// for it (see Direct), bypassing the cache. Domains a REJECT rule matches
+// fail with ErrRejected.
+func (r *Resolver) Exchange(domain string, qtype uint16) (*dns.Msg, error) {
+	if err := r.rejected(domain); err != nil {
+		return nil, err
+	}
+	ctx, cancel := r.context()
+	defer cancel()
+	answer, err := r.upstream(domain).Query(ctx, domain, qtype)
+	return answer.Msg, err
+}
+
+// ResolveAAAA resolves the first IPv6 address of domain and reports
+// whether it or the address matches the rules. AAAA answers aren't cached,
+// only failures (see Negative).
+func (r *Resolver) ResolveAAAA(domain string) (bool, string, error) {
+	d, err := r.Decide(domain, dns.TypeAAAA)
+	if err != nil {
+		return false, "", err
+	}
+	return d.Routes(), d.IP(), nil
+}
+
+// ResolveAAAAChain is like ResolveAAAA but returns the CNAMEs of the
+// answer, in order, instead of the rule match
+func (r *Resolver) ResolveAAAAChain(domain string) (string, []string, error) {
+	ips, cnames, err := r.ResolveAAAAAddrs(domain)
+	if err != nil {
+		return "", cnames, err
+	}
+	return ips[0], cnames, nil
+}
+
+// ResolveAAAAAddrs is like ResolveAAAAChain but returns every address of
+// the answer, best first
+func (r *Resolver) ResolveAAAAAddrs(domain string) ([]string, []string, error) {
+	ips, cnames, _, err := r.resolveAAAA(domain)
+	return ips, cnames, err
+}
+
+// resolveAAAA is ResolveAAAAAddrs also returning the TTL of the answer
+func (r *Resolver) resolveAAAA(domain string) ([]string, []string, time.Duration, error) {
+	if err := r.rejected(domain); err != nil {
+		return nil, nil, 0, err
+	}
+	if err, ok := r.Negative.Get(domain, doh.TypeAAAA); ok {
+		r.logf("[NEGATIVE] %v", err)
+		return nil, nil, 0, err
+	}
+	ips, cnames, ttl, err := r.resolveAAAAChain(domain)
+	r.Negative.Set(domain, doh.TypeAAAA, err)
+	return ips, cnames, ttl, err
+}
+
+func (r *Resolver) resolveAAAAChain(domain string) ([]string, []string, time.Duration, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	answer, err := r.upstream(domain).Query(ctx, domain, doh.TypeAAAA)
+	switch {
+	case errors.Is(err, ErrNXDomain):
+		return nil, nil, 0, fmt.Errorf("%s: %w", domain, ErrNXDomain)
+	case errors.Is(err, ErrUpstreamTimeout):
+		return nil, nil, 0, fmt.Errorf("%s: %w", domain, ErrUpstreamTimeout)
+	case errors.Is(err, ErrOffline):
+		return nil, nil, 0, fmt.Errorf("%s: %w", domain, ErrOffline)
+	case errors.Is(err, ErrServFail):
+		return nil, nil, 0, fmt.Errorf("%s: %w", domain, ErrServFail)
+	case err != nil:
+		return nil, nil, 0, err
+	}
+	var cnames, ips []string
+	var ttl time.Duration
+	for _, rec := range answer.Records {
+		switch rec.Type {
+		case doh.TypeCNAME:
+			if len(ips) == 0 {
+				cnames = append(cnames, strings.TrimSuffix(rec.Data, "."))
+			}
+		case doh.TypeAAAA:
+			if len(ips) == 0 {
+				ttl = time.Duration(max(rec.TTL, 0)) * time.Second
+			}
+			ips = append(ips, rec.Data)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil, 0, fmt.Errorf("%s: %w", domain, ErrNoAnswer)
+	}
+	r.pick(domain, ips)
+	r.logf("[AAAA] %s ➜ %s", domain, strings.Join(ips, ", "))
+	return ips, cnames, ttl, nil
 }
@@ -0,0 +1,434 @@
+package dnsmasq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"openvpnadvanced/audit"
+)
+
+// 编译后的规则数据库格式（小端序）：
+//
+//	magic[8] srcSize srcMtime rules nodes used nEdges nTerminal nLabels nOrder
+//	edges[nEdges]{parent,child,label} terminal[nTerminal] order[nOrder]uint32
+//	labels[nLabels]
+//	nActions {pos uint32, len uint8, name}[nActions]
+//	nMixed {node, suffix, exact, wild int32}[nMixed]
+//	nExact exact[nExact]uint64
+//	nWild wild[nWild]uint64
+//	nKeywords {pos uint32, len uint8, keyword}[nKeywords]
+//	nIPRules {type uint8, len uint8, value, len uint8, action}[nIPRules]
+//
+// 各段在文件中的布局与内存中的 RuleTrie 完全一致，因此可以直接 mmap；
+// 末尾的动作表、多类型节点、DOMAIN 和通配符位图、关键字和 IP 规则较小，打开时读入堆内存。
+var ruleDBMagic = [8]byte{'O', 'V', 'A', 'R', 'D', 'B', '0', '6'}
+
+const ruleDBHeaderSize = 72
+
+// ErrRuleDBFormat is returned for a rule database that isn't readable by
+// this build (corrupt, truncated, or written with a different layout)
+var ErrRuleDBFormat = errors.New("invalid rule database")
+
+type ruleDBHeader struct {
+	Magic     [8]byte
+	SrcSize   int64
+	SrcMtime  int64
+	Rules     uint64
+	Nodes     uint32
+	Used      uint32
+	NEdges    uint64
+	NTerminal uint64
+	NLabels   uint64
+	NOrder    uint64
+}
+
+// littleEndian reports whether the host can use the file sections in place
+func littleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
+
+// SaveRuleDB writes t to path as a compiled rule database tagged with the
+// size and modification time of the rule file it was built from. The file
+// is replaced atomically, so processes that have the old one mapped keep
+// a consistent view.
+func SaveRuleDB(path string, t *RuleTrie, src os.FileInfo) (err error) {
+	defer func() { audit.Record(audit.FileWrite, path, "compiled rules", err) }()
+	if !littleEndian() {
+		return fmt.Errorf("%w: big-endian hosts are not supported", ErrRuleDBFormat)
+	}
+
+	hdr := ruleDBHeader{
+		Magic:     ruleDBMagic,
+		Rules:     uint64(t.rules),
+		Nodes:     uint32(t.nodes),
+		Used:      uint32(t.used),
+		NEdges:    uint64(len(t.edges)),
+		NTerminal: uint64(len(t.terminal)),
+		NLabels:   uint64(len(t.labels)),
+		NOrder:    uint64(len(t.order)),
+	}
+	if src != nil {
+		hdr.SrcSize = src.Size()
+		hdr.SrcMtime = src.ModTime().UnixNano()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, 1<<20)
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		tmp.Close()
+		return err
+	}
+	w.Write(bytesOf(t.edges, 12))
+	if pad := (len(t.edges) * 12) % 8; pad != 0 {
+		w.Write(make([]byte, 8-pad))
+	}
+	w.Write(bytesOf(t.terminal, 8))
+	w.Write(bytesOf(t.order, 4))
+	w.Write(t.labels)
+	binary.Write(w, binary.LittleEndian, uint32(len(t.actions)))
+	for pos, action := range t.actions {
+		n := min(len(action), 255)
+		binary.Write(w, binary.LittleEndian, uint32(pos))
+		w.WriteByte(byte(n))
+		w.WriteString(action[:n])
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(t.mixed)))
+	for node, e := range t.mixed {
+		binary.Write(w, binary.LittleEndian, [4]int32{node, e.suffix, e.exact, e.wild})
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(t.exact)))
+	w.Write(bytesOf(t.exact, 8))
+	binary.Write(w, binary.LittleEndian, uint32(len(t.wild)))
+	w.Write(bytesOf(t.wild, 8))
+	binary.Write(w, binary.LittleEndian, uint32(len(t.keywords)))
+	for _, k := range t.keywords {
+		binary.Write(w, binary.LittleEndian, uint32(k.pos))
+		writeShortString(w, k.keyword)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(t.ipRules)))
+	for _, rule := range t.ipRules {
+		w.WriteByte(byte(rule.Type))
+		writeShortString(w, rule.Suffix)
+		writeShortString(w, rule.Action)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeShortString writes s prefixed by its length, truncated to 255 bytes
+func writeShortString(w *bufio.Writer, s string) {
+	n := min(len(s), 255)
+	w.WriteByte(byte(n))
+	w.WriteString(s[:n])
+}
+
+// readShortString reads a string written by writeShortString
+func readShortString(rest []byte) (string, []byte, bool) {
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return "", nil, false
+	}
+	return string(rest[1 : 1+int(rest[0])]), rest[1+int(rest[0]):], true
+}
+
+// bytesOf views a slice of fixed-size values as raw bytes
+func bytesOf[T any](s []T, size int) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&s[0])), len(s)*size)
+}
+
+// OpenRuleDB maps a compiled rule database read-only. Matching reads the
+// mapped pages directly, so opening is near-instant and the memory is
+// shared by every process mapping the same file. Call Close to unmap.
+func OpenRuleDB(path string) (*RuleTrie, error) {
+	t, _, err := openRuleDB(path)
+	return t, err
+}
+
+func openRuleDB(path string) (*RuleTrie, ruleDBHeader, error) {
+	var hdr ruleDBHeader
+	if !littleEndian() {
+		return nil, hdr, fmt.Errorf("%w: big-endian hosts are not supported", ErrRuleDBFormat)
+	}
+
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, hdr, err
+	}
+	t, hdr, err := ruleTrieFromBytes(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, hdr, fmt.Errorf("%s: %w", path, err)
+	}
+	t.mapping = data
+	// 热重载后旧规则不再被引用时自动解除映射
+	runtime.SetFinalizer(t, (*RuleTrie).Close)
+	return t, hdr, nil
+}
+
+func ruleTrieFromBytes(data []byte) (*RuleTrie, ruleDBHeader, error) {
+	var hdr ruleDBHeader
+	if len(data) < ruleDBHeaderSize {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	hdr.Magic = [8]byte(data[:8])
+	hdr.SrcSize = int64(binary.LittleEndian.Uint64(data[8:]))
+	hdr.SrcMtime = int64(binary.LittleEndian.Uint64(data[16:]))
+	hdr.Rules = binary.LittleEndian.Uint64(data[24:])
+	hdr.Nodes = binary.LittleEndian.Uint32(data[32:])
+	hdr.Used = binary.LittleEndian.Uint32(data[36:])
+	hdr.NEdges = binary.LittleEndian.Uint64(data[40:])
+	hdr.NTerminal = binary.LittleEndian.Uint64(data[48:])
+	hdr.NLabels = binary.LittleEndian.Uint64(data[56:])
+	hdr.NOrder = binary.LittleEndian.Uint64(data[64:])
+	if hdr.Magic != ruleDBMagic {
+		return nil, hdr, ErrRuleDBFormat
+	}
+
+	// 边表必须是 2 的幂，否则哈希掩码失效；各段长度先与文件大小比较，防止乘法溢出
+	size := uint64(len(data))
+	if hdr.NEdges == 0 || hdr.NEdges&(hdr.NEdges-1) != 0 || hdr.NEdges > size/12 ||
+		hdr.NTerminal > size/8 || hdr.NLabels > size || hdr.Nodes > math.MaxInt32 || hdr.NOrder > uint64(hdr.Nodes) {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	// 开放寻址表至少要留一个空槽，否则查找不会终止
+	if uint64(hdr.Used) >= hdr.NEdges {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	edgesLen := hdr.NEdges * 12
+	termOff := ruleDBHeaderSize + (edgesLen+7)/8*8
+	orderOff := termOff + hdr.NTerminal*8
+	labelsOff := orderOff + hdr.NOrder*4
+	actionsOff := labelsOff + hdr.NLabels
+	if uint64(len(data)) < actionsOff+4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+
+	t := &RuleTrie{
+		edges:  unsafe.Slice((*trieEdge)(unsafe.Pointer(&data[ruleDBHeaderSize])), hdr.NEdges),
+		labels: data[labelsOff : labelsOff+hdr.NLabels : labelsOff+hdr.NLabels],
+		used:   int(hdr.Used),
+		nodes:  int32(hdr.Nodes),
+		rules:  int(hdr.Rules),
+	}
+	if hdr.NTerminal > 0 {
+		t.terminal = unsafe.Slice((*uint64)(unsafe.Pointer(&data[termOff])), hdr.NTerminal)
+	}
+	if hdr.NOrder > 0 {
+		t.order = unsafe.Slice((*uint32)(unsafe.Pointer(&data[orderOff])), hdr.NOrder)
+	}
+	used := 0
+	for _, e := range t.edges {
+		if e.child == 0 {
+			continue
+		}
+		if e.child < 0 || e.child >= t.nodes || e.parent < 0 || e.parent >= t.nodes ||
+			uint64(e.label) >= hdr.NLabels || uint64(e.label)+1+uint64(t.labels[e.label]) > hdr.NLabels {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		used++
+	}
+	if used != t.used {
+		return nil, hdr, ErrRuleDBFormat
+	}
+
+	rest := data[actionsOff:]
+	n := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	for i := uint32(0); i < n; i++ {
+		if len(rest) < 5 || len(rest) < 5+int(rest[4]) {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		if t.actions == nil {
+			t.actions = make(map[int32]string)
+		}
+		pos := int32(binary.LittleEndian.Uint32(rest))
+		t.actions[pos] = string(rest[5 : 5+int(rest[4])])
+		rest = rest[5+int(rest[4]):]
+	}
+
+	if len(rest) < 4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	n = binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(len(rest)) < uint64(n)*16 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	for i := uint32(0); i < n; i++ {
+		node := int32(binary.LittleEndian.Uint32(rest))
+		if node <= 0 || node >= t.nodes {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		if t.mixed == nil {
+			t.mixed = make(map[int32]indexEntry)
+		}
+		t.mixed[node] = indexEntry{
+			suffix: int32(binary.LittleEndian.Uint32(rest[4:])),
+			exact:  int32(binary.LittleEndian.Uint32(rest[8:])),
+			wild:   int32(binary.LittleEndian.Uint32(rest[12:])),
+		}
+		rest = rest[16:]
+	}
+
+	if len(rest) < 4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	nExact := uint64(binary.LittleEndian.Uint32(rest))
+	rest = rest[4:]
+	if uint64(len(rest)) < nExact*8 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	for i := uint64(0); i < nExact; i++ {
+		t.exact = append(t.exact, binary.LittleEndian.Uint64(rest[i*8:]))
+	}
+	rest = rest[nExact*8:]
+	if len(rest) < 4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	nWild := uint64(binary.LittleEndian.Uint32(rest))
+	rest = rest[4:]
+	if uint64(len(rest)) < nWild*8 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	for i := uint64(0); i < nWild; i++ {
+		t.wild = append(t.wild, binary.LittleEndian.Uint64(rest[i*8:]))
+	}
+	rest = rest[nWild*8:]
+	if len(rest) < 4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	n = binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	for i := uint32(0); i < n; i++ {
+		if len(rest) < 4 {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		pos := int32(binary.LittleEndian.Uint32(rest))
+		keyword, r, ok := readShortString(rest[4:])
+		if !ok || keyword == "" {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		rest = r
+		t.keywords = append(t.keywords, indexedKeyword{pos: pos, keyword: keyword})
+	}
+	if len(rest) < 4 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	n = binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	for i := uint32(0); i < n; i++ {
+		if len(rest) < 1 || !RuleType(rest[0]).IsIP() {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		typ := RuleType(rest[0])
+		var prefix, action string
+		var ok bool
+		if prefix, rest, ok = readShortString(rest[1:]); !ok {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		if action, rest, ok = readShortString(rest); !ok {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		rule, ok := ipRule(typ, []byte(prefix), []byte(action))
+		if !ok {
+			return nil, hdr, ErrRuleDBFormat
+		}
+		t.ipRules = append(t.ipRules, rule)
+	}
+	if len(rest) != 0 {
+		return nil, hdr, ErrRuleDBFormat
+	}
+	return t, hdr, nil
+}
+
+// ParseRuleDB decodes a compiled rule database held in memory, validating
+// it the same way OpenRuleDB does. data is copied, so it may be reused.
+func ParseRuleDB(data []byte) (*RuleTrie, error) {
+	if !littleEndian() {
+		return nil, fmt.Errorf("%w: big-endian hosts are not supported", ErrRuleDBFormat)
+	}
+	// 复制到 8 字节对齐的缓冲区，与 mmap 的页对齐保持一致
+	buf := make([]uint64, (len(data)+7)/8)
+	aligned := bytesOf(buf, 8)[:len(data)]
+	copy(aligned, data)
+	t, _, err := ruleTrieFromBytes(aligned)
+	return t, err
+}
+
+// Close unmaps a trie opened with OpenRuleDB; it's a no-op otherwise. The
+// trie must not be used afterwards. A trie that is simply dropped is
+// unmapped when garbage collected.
+func (t *RuleTrie) Close() error {
+	if t.mapping == nil {
+		return nil
+	}
+	runtime.SetFinalizer(t, nil)
+	data := t.mapping
+	t.mapping, t.edges, t.terminal, t.order, t.labels = nil, nil, nil, nil, nil
+	return unmapFile(data)
+}
+
+// detach copies a mapped trie onto the heap so it can be modified
+func (t *RuleTrie) detach() {
+	if t.mapping == nil {
+		return
+	}
+	t.edges = append([]trieEdge(nil), t.edges...)
+	t.terminal = append([]uint64(nil), t.terminal...)
+	t.order = append([]uint32(nil), t.order...)
+	t.labels = append([]byte(nil), t.labels...)
+	unmapFile(t.mapping)
+	t.mapping = nil
+	runtime.SetFinalizer(t, nil)
+}
+
+// LoadRuleDB returns the compiled rules for rulePath, mapping dbPath when
+// it was built from the current rule file and recompiling it otherwise
+func LoadRuleDB(rulePath, dbPath string) (*RuleTrie, error) {
+	src, err := os.Stat(rulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	t, hdr, err := openRuleDB(dbPath)
+	if err == nil {
+		if hdr.SrcSize == src.Size() && hdr.SrcMtime == src.ModTime().UnixNano() {
+			return t, nil
+		}
+		t.Close()
+	}
+
+	t, err = LoadRuleTrie(rulePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveRuleDB(dbPath, t, src); err != nil {
+		// 数据库只是加速手段，写入失败时继续使用堆上的规则
+		return t, nil
+	}
+	if mapped, err := OpenRuleDB(dbPath); err == nil {
+		return mapped, nil
+	}
+	return t, nil
+}
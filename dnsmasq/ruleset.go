@@ -0,0 +1,234 @@
+package dnsmasq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule set formats, as Clash calls a rule provider's behavior
+const (
+	// FormatClassical lists rule lines ("DOMAIN-SUFFIX,example.com")
+	FormatClassical = "classical"
+	// FormatDomain lists domains: "example.com" exactly, "+.example.com"
+	// with its subdomains, ".example.com" and "*.example.com" only its
+	// subdomains
+	FormatDomain = "domain"
+	// FormatIPCIDR lists address prefixes
+	FormatIPCIDR = "ipcidr"
+	// formatDomainSet is a Surge DOMAIN-SET: ".example.com" matches the
+	// domain and its subdomains, anything else only the domain
+	formatDomainSet = "domain-set"
+)
+
+// maxIncludeDepth bounds nested RULE-SET includes
+const maxIncludeDepth = 8
+
+// includePrefixes start the lines including another rule set
+var includePrefixes = []struct {
+	prefix []byte
+	format string
+}{
+	{[]byte("RULE-SET,"), ""},
+	{[]byte("DOMAIN-SET,"), formatDomainSet},
+}
+
+// payloadKey starts a Clash rule-provider file
+var payloadKey = []byte("payload:")
+
+// ruleReader reads rule lists and rule sets, calling fn for every rule.
+// Included rule sets are read in place of their RULE-SET line, so the
+// rules keep their order.
+type ruleReader struct {
+	fn func(typ RuleType, value, action []byte)
+	// open are the files being read, to refuse include cycles
+	open []string
+}
+
+// readFile reads the rule list or rule set at path, following its
+// includes relative to its directory
+func (rr *ruleReader) readFile(path, format string, action []byte) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(rr.open, abs) {
+		return fmt.Errorf("%s: RULE-SET includes itself", path)
+	}
+	if len(rr.open) >= maxIncludeDepth {
+		return fmt.Errorf("%s: RULE-SET includes nested deeper than %d", path, maxIncludeDepth)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rr.open = append(rr.open, abs)
+	defer func() { rr.open = rr.open[:len(rr.open)-1] }()
+	return rr.read(file, filepath.Dir(path), format, action)
+}
+
+// read reads a rule list, or a Clash rule-provider payload, from r.
+// Includes are resolved relative to dir, and skipped when dir is empty.
+// Rules without an action of their own take action.
+func (rr *ruleReader) read(r io.Reader, dir, format string, action []byte) error {
+	br := bufio.NewReader(r)
+	if isPayload(br) {
+		return rr.readPayload(br, dir, format, action)
+	}
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		if err := rr.line(scanner.Bytes(), dir, format, action); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// isPayload reports whether the first line that isn't blank or a comment
+// starts a YAML payload list
+func isPayload(br *bufio.Reader) bool {
+	head, _ := br.Peek(4096)
+	for len(head) > 0 {
+		var line []byte
+		line, head, _ = bytes.Cut(head, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return bytes.HasPrefix(line, payloadKey)
+	}
+	return false
+}
+
+func (rr *ruleReader) readPayload(r io.Reader, dir, format string, action []byte) error {
+	var doc struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid rule-provider payload: %v", err)
+	}
+	if format == "" {
+		format = detectFormat(doc.Payload)
+	}
+	for _, entry := range doc.Payload {
+		if err := rr.line([]byte(entry), dir, format, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detectFormat guesses the behavior of a payload: rule lines have a
+// comma, and a list of prefixes is an ipcidr one
+func detectFormat(payload []string) string {
+	if len(payload) == 0 {
+		return FormatClassical
+	}
+	cidr := true
+	for _, entry := range payload {
+		if strings.Contains(entry, ",") {
+			return FormatClassical
+		}
+		if _, err := netip.ParsePrefix(strings.TrimSpace(entry)); err != nil {
+			cidr = false
+		}
+	}
+	if cidr {
+		return FormatIPCIDR
+	}
+	return FormatDomain
+}
+
+func (rr *ruleReader) line(line []byte, dir, format string, action []byte) error {
+	line = bytes.TrimSpace(line)
+	for _, inc := range includePrefixes {
+		if rest, ok := bytes.CutPrefix(line, inc.prefix); ok {
+			return rr.include(rest, inc.format, dir)
+		}
+	}
+	switch format {
+	case FormatDomain, formatDomainSet:
+		line = domainLine(line, format == formatDomainSet)
+	case FormatIPCIDR:
+		line = cidrLine(line)
+	}
+	typ, value, own, ok := parseRuleLine(line)
+	if !ok {
+		return nil
+	}
+	if len(own) == 0 {
+		own = action
+	}
+	rr.fn(typ, value, own)
+	return nil
+}
+
+// include reads the rule set of a "RULE-SET,target,action[,format]" or
+// "DOMAIN-SET,target,action" line. Remote targets are left to the
+// subscription fetcher, which replaces them with its cached copy.
+func (rr *ruleReader) include(rest []byte, format, dir string) error {
+	fields := strings.Split(string(rest), ",")
+	target := strings.TrimSpace(fields[0])
+	var action string
+	if len(fields) > 1 {
+		action = strings.TrimSpace(fields[1])
+	}
+	if format == "" && len(fields) > 2 {
+		switch opt := strings.ToLower(strings.TrimSpace(fields[2])); opt {
+		case FormatClassical, FormatDomain, FormatIPCIDR:
+			format = opt
+		}
+	}
+	switch {
+	case dir == "" || target == "":
+		return nil
+	case strings.Contains(target, "://"):
+		DefaultLogger.Printf("⚠️ Skipping remote rule set %s: list it in a subscription to have it fetched", target)
+		return nil
+	case !filepath.IsAbs(target):
+		target = filepath.Join(dir, target)
+	}
+	return rr.readFile(target, format, []byte(action))
+}
+
+// domainLine turns a domain list entry into a rule line
+func domainLine(entry []byte, surge bool) []byte {
+	if len(entry) == 0 || entry[0] == '#' {
+		return nil
+	}
+	if name, ok := bytes.CutPrefix(entry, []byte("+.")); ok {
+		return append([]byte("DOMAIN-SUFFIX,"), name...)
+	}
+	if name, ok := bytes.CutPrefix(entry, []byte(".")); ok {
+		if surge {
+			return append([]byte("DOMAIN-SUFFIX,"), name...)
+		}
+		return append([]byte("DOMAIN-SUFFIX,*."), name...)
+	}
+	if bytes.HasPrefix(entry, []byte("*.")) {
+		return append([]byte("DOMAIN-SUFFIX,"), entry...)
+	}
+	return append([]byte("DOMAIN,"), entry...)
+}
+
+// cidrLine turns an address prefix list entry into a rule line
+func cidrLine(entry []byte) []byte {
+	if len(entry) == 0 || entry[0] == '#' {
+		return nil
+	}
+	if bytes.IndexByte(entry, ':') >= 0 {
+		return append([]byte("IP-CIDR6,"), entry...)
+	}
+	return append([]byte("IP-CIDR,"), entry...)
+}
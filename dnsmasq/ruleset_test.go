@@ -0,0 +1,123 @@
+package dnsmasq_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadRuleSets(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.list": `DOMAIN-SUFFIX,first.example
+RULE-SET,sets/domain.yaml,direct
+RULE-SET,sets/classical.yaml,backup
+RULE-SET,sets/cidr.yaml
+DOMAIN-SET,surge.txt,direct
+RULE-SET,plain.txt,backup,domain
+RULE-SET,https://example.com/remote.list,direct
+DOMAIN,last.example
+`,
+		"sets/domain.yaml": `# Clash domain provider
+payload:
+  - '+.suffix.example'
+  - '.sub.example'
+  - '*.wild.example'
+  - 'exact.example'
+`,
+		"sets/classical.yaml": `payload:
+  - DOMAIN-KEYWORD,tracker
+  - DOMAIN-SUFFIX,own.example,direct
+  - IP-CIDR,10.0.0.0/8,no-resolve
+  - PROCESS-NAME,curl
+  - RULE-SET,nested.list
+`,
+		"sets/nested.list": "DOMAIN,nested.example\n",
+		"sets/cidr.yaml": `payload:
+  - 192.168.0.0/16
+  - 2001:db8::/32
+`,
+		"surge.txt": ".surge.example\nsurge-exact.example\n",
+		"plain.txt": "+.plain.example\n",
+	})
+
+	rules, err := dnsmasq.LoadDomainRules(filepath.Join(dir, "main.list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dnsmasq.Rule{
+		{Suffix: "first.example", Type: dnsmasq.RuleSuffix},
+		{Suffix: "suffix.example", Type: dnsmasq.RuleSuffix, Action: "direct"},
+		{Suffix: "*.sub.example", Type: dnsmasq.RuleSuffix, Action: "direct"},
+		{Suffix: "*.wild.example", Type: dnsmasq.RuleSuffix, Action: "direct"},
+		{Suffix: "exact.example", Type: dnsmasq.RuleDomain, Action: "direct"},
+		{Suffix: "tracker", Type: dnsmasq.RuleKeyword, Action: "backup"},
+		{Suffix: "own.example", Type: dnsmasq.RuleSuffix, Action: "direct"},
+		{Suffix: "10.0.0.0/8", Type: dnsmasq.RuleIPCIDR, Action: "backup"},
+		{Suffix: "nested.example", Type: dnsmasq.RuleDomain},
+		{Suffix: "192.168.0.0/16", Type: dnsmasq.RuleIPCIDR},
+		{Suffix: "2001:db8::/32", Type: dnsmasq.RuleIPCIDR6},
+		{Suffix: "surge.example", Type: dnsmasq.RuleSuffix, Action: "direct"},
+		{Suffix: "surge-exact.example", Type: dnsmasq.RuleDomain, Action: "direct"},
+		{Suffix: "plain.example", Type: dnsmasq.RuleSuffix, Action: "backup"},
+		{Suffix: "last.example", Type: dnsmasq.RuleDomain},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d: %+v", len(rules), len(want), rules)
+	}
+	for i, rule := range rules {
+		if rule.Suffix != want[i].Suffix || rule.Type != want[i].Type || rule.Action != want[i].Action {
+			t.Errorf("rule %d = %q %v %q, want %q %v %q", i, rule.Suffix, rule.Type, rule.Action, want[i].Suffix, want[i].Type, want[i].Action)
+		}
+	}
+
+	trie, err := dnsmasq.LoadRuleTrie(filepath.Join(dir, "main.list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"a.suffix.example", "x.sub.example", "exact.example", "nested.example", "a.surge.example", "plain.example"} {
+		if !trie.Match(domain) {
+			t.Errorf("trie doesn't match %q", domain)
+		}
+	}
+	if rule, _ := trie.MatchRule("mytracker.net"); rule.Action != "backup" {
+		t.Errorf("included keyword lost the RULE-SET action: %+v", rule)
+	}
+}
+
+func TestLoadRuleSetErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"loop.list":    "RULE-SET,loop2.list\n",
+		"loop2.list":   "RULE-SET,loop.list\n",
+		"missing.list": "RULE-SET,nowhere.list\n",
+		"bad.yaml":     "payload: [unterminated\n",
+	})
+	for _, name := range []string{"loop.list", "missing.list", "bad.yaml"} {
+		if _, err := dnsmasq.LoadDomainRules(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// 从 io.Reader 读取时不跟随引用
+	rules, err := dnsmasq.ReadRules(strings.NewReader("RULE-SET,loop.list\nDOMAIN,a.example\n"))
+	if err != nil || len(rules) != 1 {
+		t.Errorf("ReadRules = %+v, %v", rules, err)
+	}
+}
@@ -0,0 +1,38 @@
+package dnsmasq
+
+// cached returns the cache entry of name. A StaleCache may return an entry
+// past its TTL, while one query refreshes it in the background.
+func (r *Resolver) cached(name string) (string, bool) {
+	if r.revalidating {
+		return "", false
+	}
+	sc, ok := r.Cache.(StaleCache)
+	if !ok {
+		return r.Cache.Get(name)
+	}
+	value, refresh, ok := sc.GetStale(name)
+	switch {
+	case refresh && r.Offline:
+		// 离线时无法刷新，继续使用旧值直到过期太久
+		sc.EndRefresh(name)
+	case refresh:
+		go r.revalidate(sc, name)
+	}
+	return value, ok
+}
+
+// revalidate resolves name again, replacing its cache entry. On failure
+// the refresh is given up, so a later query retries it, and the entry is
+// served until it's too stale.
+func (r *Resolver) revalidate(sc StaleCache, name string) {
+	rr := *r
+	rr.revalidating = true
+	if _, _, err := rr.resolveChain(name, nil); err != nil {
+		r.logf("⚠️ Failed to refresh %s: %v", name, err)
+		sc.EndRefresh(name)
+		return
+	}
+	if r.verbose() {
+		r.logf("[REFRESH] %s", name)
+	}
+}
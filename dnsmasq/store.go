@@ -1,11 +1,18 @@
 package dnsmasq
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"openvpnadvanced/audit"
 )
 
 const cacheFilePath = "assets/cache.json"
@@ -16,9 +23,28 @@ func LoadCacheFromFile() (map[string]DNSRecord, error) {
 	storeLock.RLock()
 	defer storeLock.RUnlock()
 
+	return LoadCacheFile(cacheFilePath)
+}
+
+func SaveCacheToFile(cache CacheBackend) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if err := SaveCacheFile(cacheFilePath, cache); err != nil {
+		return err
+	}
+
+	fmt.Println("✅ Cache saved to cache.json")
+	return nil
+}
+
+// LoadCacheFile reads a persisted cache from path, as gob when path ends
+// in ".gob" and JSON otherwise. A missing or empty file yields an empty
+// map. Callers are responsible for serializing access.
+func LoadCacheFile(path string) (map[string]DNSRecord, error) {
 	data := make(map[string]DNSRecord)
 
-	file, err := os.Open(cacheFilePath)
+	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return data, nil
@@ -27,39 +53,103 @@ func LoadCacheFromFile() (map[string]DNSRecord, error) {
 	}
 	defer file.Close()
 
-	bytes, err := io.ReadAll(file)
+	raw, err := io.ReadAll(file)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(bytes) == 0 {
+	if len(raw) == 0 {
 		return data, nil
 	}
 
-	err = json.Unmarshal(bytes, &data)
+	if isGob(path) {
+		err = gob.NewDecoder(bytes.NewReader(raw)).Decode(&data)
+	} else {
+		err = json.Unmarshal(raw, &data)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
 
 	return data, nil
 }
 
-func SaveCacheToFile(cache *Cache) error {
-	storeLock.Lock()
-	defer storeLock.Unlock()
-
+// SaveCacheFile writes the cache contents to path, as gob when path ends
+// in ".gob" and JSON otherwise. The file is replaced atomically, so a
+// crash mid-write keeps the previous snapshot. Callers are responsible
+// for serializing access.
+func SaveCacheFile(path string, cache CacheBackend) (err error) {
+	defer func() { audit.Record(audit.FileWrite, path, "DNS cache", err) }()
 	data := cache.Raw()
 
-	bytes, err := json.MarshalIndent(data, "", "  ")
+	var buf bytes.Buffer
+	if isGob(path) {
+		err = gob.NewEncoder(&buf).Encode(data)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(data)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(cacheFilePath, bytes, 0644)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	fmt.Println("✅ Cache saved to cache.json")
-	return nil
+func isGob(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gob")
+}
+
+// RestoreCache stores records read from disk into cache, skipping those
+// past their TTL (defaultTTL for records without one), and returns how
+// many were restored. The in-memory Cache keeps each record's age; other
+// backends get the remaining TTL when they support per-entry TTLs.
+func RestoreCache(cache CacheBackend, records map[string]DNSRecord, defaultTTL time.Duration) int {
+	mem, _ := cache.(*Cache)
+	n := 0
+	for domain, record := range records {
+		if record.Expired(defaultTTL) {
+			continue
+		}
+		if mem != nil {
+			mem.SetRecord(domain, record)
+		} else {
+			// 没有 TTL 的记录剩余时间为负，按后端自身的 TTL 保存
+			SetWithTTL(cache, domain, record.IP, record.TTL-record.Age())
+		}
+		n++
+	}
+	return n
+}
+
+// SaveToFile writes the cache to path (see SaveCacheFile)
+func (c *Cache) SaveToFile(path string) error {
+	return SaveCacheFile(path, c)
+}
+
+// LoadFromFile adds the unexpired entries of a file written by SaveToFile,
+// keeping their age so they expire when they originally would have, and
+// returns how many were loaded. A missing file loads nothing.
+func (c *Cache) LoadFromFile(path string) (int, error) {
+	records, err := LoadCacheFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return RestoreCache(c, records, c.ttl), nil
 }
@@ -0,0 +1,661 @@
+package dnsmasq
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// RuleMatcher decides whether a domain matches the routing rules
+type RuleMatcher interface {
+	Match(domain string) bool
+}
+
+// ActionMatcher is a RuleMatcher that also reports the action of the
+// matching rule (empty for the default VPN route)
+type ActionMatcher interface {
+	RuleMatcher
+	MatchAction(domain string) (string, bool)
+}
+
+// RuleFinder is an ActionMatcher that also reports which rule matched
+type RuleFinder interface {
+	ActionMatcher
+	MatchRule(domain string) (Rule, bool)
+}
+
+// IPMatcher is a RuleMatcher that also matches resolved addresses against
+// IP-CIDR and GEOIP rules, looking countries up in geo (GEOIP rules other
+// than LAN never match when nil)
+type IPMatcher interface {
+	RuleMatcher
+	MatchIP(ip string, geo CountryLookup) (Rule, bool)
+}
+
+// RuleTrie is a compiled DOMAIN-SUFFIX and DOMAIN index keyed by reversed
+// domain labels. Matching costs O(labels in the domain) regardless of how
+// many rules are loaded, and a suffix only matches on a label boundary
+// ("t.co" matches "t.co" and "x.t.co", not "nott.co"); a wildcard suffix
+// "*.t.co" matches "x.t.co" but not "t.co". Like MatchRule, the first
+// matching rule in list order wins, whatever its kind. DOMAIN-KEYWORD
+// rules can't be indexed by label; they are kept in a list and scanned
+// up to the best match found so far, so they should stay few. IP-CIDR
+// rules and GEOIP rules are kept in a list too and matched by MatchIP.
+//
+// All storage lives in a few flat arenas (a length-prefixed label byte
+// arena, an open-addressing edge table, a terminal bitset and the rule
+// position of each node) rather than a node per label, so million-line
+// blocklists fit in tens of MB.
+type RuleTrie struct {
+	labels   []byte
+	edges    []trieEdge
+	used     int
+	terminal []uint64
+	// order holds 1 + the position of the first rule ending at each node,
+	// 0 for none; mixed holds the positions of nodes ending rules of more
+	// than one kind, which are rare
+	order []uint32
+	mixed map[int32]indexEntry
+	// exact marks the nodes of DOMAIN rules, wild those of wildcard
+	// suffixes, which match below the node only
+	exact    []uint64
+	wild     []uint64
+	keywords []indexedKeyword
+	ipRules  []Rule
+	nodes    int32
+	rules    int
+	// actions holds the action of each rule naming one, by position
+	actions map[int32]string
+	// mapping is the read-only file backing the arenas (see OpenRuleDB)
+	mapping []byte
+}
+
+// trieEdge links parent to child by the label at labels[label]. child == 0
+// marks an empty slot since the root is never a child.
+type trieEdge struct {
+	parent int32
+	child  int32
+	label  uint32
+}
+
+// indexEntry holds the position of the first rule of each kind ending at
+// a node, or -1
+type indexEntry struct {
+	suffix, exact, wild int32
+}
+
+type indexedKeyword struct {
+	pos     int32
+	keyword string
+}
+
+// NewRuleTrie returns an empty trie with arenas sized for about sizeHint rules
+func NewRuleTrie(sizeHint int) *RuleTrie {
+	if sizeHint < 16 {
+		sizeHint = 16
+	}
+	// 大多数规则只新增一个标签，负载因子保持在 0.75 以下
+	return &RuleTrie{
+		labels:   make([]byte, 0, sizeHint*8),
+		edges:    make([]trieEdge, nextPow2(sizeHint*4/3)),
+		terminal: make([]uint64, sizeHint/64+1),
+		nodes:    1, // root
+	}
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// Len returns the number of suffixes inserted
+func (t *RuleTrie) Len() int {
+	return t.rules
+}
+
+// MemoryUsage returns the approximate number of bytes held by the arenas
+func (t *RuleTrie) MemoryUsage() int {
+	return cap(t.labels) + cap(t.edges)*12 + cap(t.terminal)*8 + cap(t.order)*4 + cap(t.exact)*8 + cap(t.wild)*8
+}
+
+// Insert adds a domain suffix. The suffix is lower-cased; a leading "."
+// is ignored, and a leading "*." adds a wildcard suffix. Inserting into a mapped trie first copies it onto the heap.
+func (t *RuleTrie) Insert(suffix string) {
+	t.insert(RuleSuffix, []byte(suffix), nil)
+}
+
+// InsertRule adds a rule of any type together with its action
+func (t *RuleTrie) InsertRule(rule Rule) {
+	t.insert(rule.Type, []byte(rule.Suffix), []byte(rule.Action))
+}
+
+func (t *RuleTrie) insert(typ RuleType, suffix, action []byte) {
+	t.insertAt(int32(t.rules), typ, suffix, action)
+}
+
+// insertAt adds a rule at position pos in list order; positions must
+// increase from one call to the next
+func (t *RuleTrie) insertAt(pos int32, typ RuleType, suffix, action []byte) {
+	t.detach()
+	if typ.IsIP() {
+		rule, ok := ipRule(typ, suffix, action)
+		if ok {
+			t.ipRules = append(t.ipRules, rule)
+			t.rules++
+		}
+		return
+	}
+	if typ == RuleKeyword {
+		if len(bytes.Trim(suffix, ".")) == 0 {
+			return
+		}
+		t.keywords = append(t.keywords, indexedKeyword{pos: pos, keyword: string(bytes.ToLower(suffix))})
+		t.setAction(pos, action)
+		t.rules++
+		return
+	}
+	wild := false
+	if typ != RuleDomain {
+		suffix, wild = bytes.CutPrefix(suffix, []byte("*."))
+	}
+	suffix = bytes.Trim(suffix, ".")
+	if len(suffix) == 0 {
+		return
+	}
+
+	node := int32(0)
+	end := len(suffix)
+	for end > 0 {
+		start := bytes.LastIndexByte(suffix[:end], '.') + 1
+		label := suffix[start:end]
+		if len(label) == 0 || len(label) > 63 {
+			return
+		}
+		node = t.child(node, label)
+		end = start - 1
+	}
+	t.rules++
+
+	e := t.firstRules(node)
+	slot := &e.suffix
+	if typ == RuleDomain {
+		slot = &e.exact
+	} else if wild {
+		slot = &e.wild
+	}
+	// 重复规则永远不会胜出，保留第一次出现的位置和动作
+	if *slot >= 0 {
+		return
+	}
+	if e == (indexEntry{-1, -1, -1}) {
+		for int(node) >= len(t.order) {
+			t.order = append(t.order, 0)
+		}
+		t.order[node] = uint32(pos) + 1
+	} else {
+		*slot = pos
+		if t.mixed == nil {
+			t.mixed = make(map[int32]indexEntry)
+		}
+		t.mixed[node] = e
+	}
+	t.setAction(pos, action)
+	switch {
+	case wild:
+		t.wild = setBit(t.wild, node)
+	case typ == RuleDomain:
+		t.exact = setBit(t.exact, node)
+	default:
+		t.setTerminal(node)
+	}
+}
+
+func (t *RuleTrie) setAction(pos int32, action []byte) {
+	if len(action) == 0 {
+		return
+	}
+	if t.actions == nil {
+		t.actions = make(map[int32]string)
+	}
+	t.actions[pos] = string(action)
+}
+
+// firstRules returns the positions of the first rule of each kind ending
+// at node
+func (t *RuleTrie) firstRules(node int32) indexEntry {
+	if e, ok := t.mixed[node]; ok {
+		return e
+	}
+	e := indexEntry{suffix: -1, exact: -1, wild: -1}
+	if int(node) >= len(t.order) || t.order[node] == 0 {
+		return e
+	}
+	pos := int32(t.order[node] - 1)
+	switch {
+	case t.isTerminal(node):
+		e.suffix = pos
+	case isSet(t.exact, node):
+		e.exact = pos
+	case isSet(t.wild, node):
+		e.wild = pos
+	}
+	return e
+}
+
+// Match reports whether domain equals a suffix or domain in the trie, is
+// a subdomain of a suffix, or contains a keyword. It doesn't allocate.
+func (t *RuleTrie) Match(domain string) bool {
+	if len(domain) > 0 && domain[len(domain)-1] == '.' {
+		domain = domain[:len(domain)-1]
+	}
+
+	node := int32(0)
+	end := len(domain)
+	for end > 0 {
+		start := lastDot(domain[:end]) + 1
+		node = t.lookup(node, domain[start:end])
+		if node == 0 {
+			break
+		}
+		// start > 0 表示前面还有标签，即 domain 是该节点的子域名
+		if t.isTerminal(node) || (start > 0 && isSet(t.wild, node)) {
+			return true
+		}
+		end = start - 1
+	}
+	// 映射的 trie 在查找期间不能被回收解除映射
+	runtime.KeepAlive(t)
+	if node != 0 && end <= 0 && isSet(t.exact, node) {
+		return true
+	}
+	for _, k := range t.keywords {
+		if containsLower(domain, k.keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAction is like Match but also returns the action of the first
+// matching rule
+func (t *RuleTrie) MatchAction(domain string) (string, bool) {
+	m, ok := t.match(domain)
+	return t.actions[m.pos], ok
+}
+
+// MatchRule returns the first rule matching domain in list order. A
+// suffix or domain is spelled as it appears in domain (lower-cased, with
+// "*." before a wildcard suffix).
+func (t *RuleTrie) MatchRule(domain string) (Rule, bool) {
+	m, ok := t.match(domain)
+	if !ok {
+		return Rule{}, false
+	}
+	if m.typ == RuleKeyword {
+		return Rule{Suffix: m.keyword, Action: t.actions[m.pos], Type: RuleKeyword}, true
+	}
+	suffix := strings.ToLower(strings.TrimSuffix(domain[m.start:], "."))
+	if m.wild {
+		suffix = "*." + suffix
+	}
+	return Rule{Suffix: suffix, Action: t.actions[m.pos], Type: m.typ}, true
+}
+
+// trieMatch describes the first rule matching a domain: its position, its
+// type, and for a suffix or domain the offset in the domain where it
+// starts and whether it's a wildcard suffix
+type trieMatch struct {
+	pos     int32
+	typ     RuleType
+	start   int
+	wild    bool
+	keyword string
+}
+
+// match finds the lowest-positioned suffix, domain or keyword rule
+// matching domain
+func (t *RuleTrie) match(domain string) (trieMatch, bool) {
+	if len(domain) > 0 && domain[len(domain)-1] == '.' {
+		domain = domain[:len(domain)-1]
+	}
+
+	best := trieMatch{pos: -1}
+	better := func(pos int32, typ RuleType, start int, wild bool) {
+		if pos >= 0 && (best.pos < 0 || pos < best.pos) {
+			best = trieMatch{pos: pos, typ: typ, start: start, wild: wild}
+		}
+	}
+	node := int32(0)
+	end := len(domain)
+	for end > 0 {
+		start := lastDot(domain[:end]) + 1
+		node = t.lookup(node, domain[start:end])
+		if node == 0 {
+			break
+		}
+		// start > 0 表示前面还有标签，即 domain 是该节点的子域名
+		e := t.firstRules(node)
+		better(e.suffix, RuleSuffix, start, false)
+		if start > 0 {
+			better(e.wild, RuleSuffix, start, true)
+		} else {
+			better(e.exact, RuleDomain, 0, false)
+		}
+		end = start - 1
+	}
+	// 映射的 trie 在查找期间不能被回收解除映射
+	runtime.KeepAlive(t)
+	for _, k := range t.keywords {
+		if best.pos >= 0 && k.pos > best.pos {
+			break
+		}
+		if containsLower(domain, k.keyword) {
+			return trieMatch{pos: k.pos, typ: RuleKeyword, keyword: k.keyword}, true
+		}
+	}
+	return best, best.pos >= 0
+}
+
+// MatchIP returns the first IP-CIDR, IP-CIDR6 or GEOIP rule matching ip
+func (t *RuleTrie) MatchIP(ip string, geo CountryLookup) (Rule, bool) {
+	return MatchIPRule(ip, t.ipRules, geo)
+}
+
+// containsLower reports whether s contains the lower-case substr,
+// ignoring the case of s, without allocating
+func containsLower(s, substr string) bool {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		j := 0
+		for j < len(substr) && lower(s[i+j]) == substr[j] {
+			j++
+		}
+		if j == len(substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func lastDot(s string) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == '.' {
+			return i
+		}
+	}
+	return -1
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// edgeHash is FNV-1a over the lower-cased label, seeded with the parent
+func edgeHash[T string | []byte](parent int32, label T) uint32 {
+	h := uint32(2166136261) ^ uint32(parent)*16777619
+	for i := 0; i < len(label); i++ {
+		h ^= uint32(lower(label[i]))
+		h *= 16777619
+	}
+	return h
+}
+
+// lookup finds the child of parent for a label of the queried domain
+func (t *RuleTrie) lookup(parent int32, label string) int32 {
+	if len(label) == 0 || len(label) > 63 {
+		return 0
+	}
+	mask := uint32(len(t.edges) - 1)
+	h := edgeHash(parent, label)
+	for i := h & mask; ; i = (i + 1) & mask {
+		e := &t.edges[i]
+		if e.child == 0 {
+			return 0
+		}
+		if e.parent == parent && labelEqual(t.stored(e), label) {
+			return e.child
+		}
+	}
+}
+
+// child finds (or creates) the child of parent for a rule label
+func (t *RuleTrie) child(parent int32, label []byte) int32 {
+	if (t.used+1)*4 > len(t.edges)*3 {
+		t.grow()
+	}
+	mask := uint32(len(t.edges) - 1)
+	h := edgeHash(parent, label)
+	i := h & mask
+	for ; t.edges[i].child != 0; i = (i + 1) & mask {
+		e := &t.edges[i]
+		if e.parent == parent && labelEqual(t.stored(e), label) {
+			return e.child
+		}
+	}
+	off := uint32(len(t.labels))
+	t.labels = append(t.labels, byte(len(label)))
+	for _, c := range label {
+		t.labels = append(t.labels, lower(c))
+	}
+	node := t.nodes
+	t.nodes++
+	t.edges[i] = trieEdge{parent: parent, child: node, label: off}
+	t.used++
+	return node
+}
+
+func (t *RuleTrie) stored(e *trieEdge) []byte {
+	n := uint32(t.labels[e.label])
+	return t.labels[e.label+1 : e.label+1+n]
+}
+
+// labelEqual compares a stored (lower-case) label case-insensitively
+func labelEqual[T string | []byte](stored []byte, label T) bool {
+	if len(stored) != len(label) {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		if stored[i] != lower(label[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// grow doubles the edge table and rehashes every edge
+func (t *RuleTrie) grow() {
+	old := t.edges
+	t.edges = make([]trieEdge, len(old)*2)
+	mask := uint32(len(t.edges) - 1)
+	for _, e := range old {
+		if e.child == 0 {
+			continue
+		}
+		h := edgeHash(e.parent, t.stored(&e))
+		i := h & mask
+		for t.edges[i].child != 0 {
+			i = (i + 1) & mask
+		}
+		t.edges[i] = e
+	}
+}
+
+func (t *RuleTrie) isTerminal(node int32) bool {
+	return isSet(t.terminal, node)
+}
+
+func (t *RuleTrie) setTerminal(node int32) {
+	t.terminal = setBit(t.terminal, node)
+}
+
+func isSet(bits []uint64, node int32) bool {
+	w := int(node) / 64
+	return w < len(bits) && bits[w]&(1<<(uint(node)%64)) != 0
+}
+
+func setBit(bits []uint64, node int32) []uint64 {
+	w := int(node) / 64
+	for w >= len(bits) {
+		bits = append(bits, 0)
+	}
+	bits[w] |= 1 << (uint(node) % 64)
+	return bits
+}
+
+// rulePrefixes are the supported rule types by line prefix
+var rulePrefixes = []struct {
+	prefix []byte
+	typ    RuleType
+}{
+	{[]byte("DOMAIN-SUFFIX,"), RuleSuffix},
+	{[]byte("DOMAIN-KEYWORD,"), RuleKeyword},
+	{[]byte("DOMAIN,"), RuleDomain},
+	{[]byte("IP-CIDR,"), RuleIPCIDR},
+	{[]byte("IP-CIDR6,"), RuleIPCIDR6},
+	{[]byte("GEOIP,"), RuleGeoIP},
+}
+
+// noResolve is the Clash option after an IP-CIDR or GEOIP rule; matching here
+// always happens after resolution, so it is accepted and ignored
+var noResolve = []byte("no-resolve")
+
+// maxDomainLen is the longest presentation-format domain name
+const maxDomainLen = 253
+
+// parseRuleLine splits a rule line (see rulePrefixes) into type, value
+// and action without copying. Blank lines, comments, other
+// rule types and empty or oversized values (an empty suffix would match
+// every domain) are rejected, as are domains with a "*" anywhere but as
+// their whole first label. A wildcard DOMAIN rule is a wildcard suffix.
+func parseRuleLine(line []byte) (typ RuleType, value, action []byte, ok bool) {
+	line = bytes.TrimSpace(line)
+	var rest []byte
+	for _, p := range rulePrefixes {
+		if bytes.HasPrefix(line, p.prefix) {
+			typ, rest, ok = p.typ, line[len(p.prefix):], true
+			break
+		}
+	}
+	if !ok {
+		return 0, nil, nil, false
+	}
+	value, action, _ = bytes.Cut(rest, []byte(","))
+	value = bytes.TrimSpace(value)
+	if len(bytes.Trim(value, ".")) == 0 || len(value) > maxDomainLen || bytes.ContainsAny(value, " \t") {
+		return 0, nil, nil, false
+	}
+	if typ == RuleSuffix || typ == RuleDomain {
+		parent, wild := bytes.CutPrefix(value, []byte("*."))
+		if bytes.IndexByte(parent, '*') >= 0 || len(bytes.Trim(parent, ".")) == 0 {
+			return 0, nil, nil, false
+		}
+		if wild {
+			typ = RuleSuffix
+		}
+	}
+	action = bytes.TrimSpace(action)
+	if typ.IsIP() {
+		before, opt, _ := bytes.Cut(action, []byte(","))
+		if bytes.Equal(bytes.TrimSpace(before), noResolve) {
+			action = nil
+		} else if bytes.Equal(bytes.TrimSpace(opt), noResolve) {
+			action = bytes.TrimSpace(before)
+		}
+	}
+	return typ, value, action, true
+}
+
+// ipRule parses the value of an address rule
+func ipRule(typ RuleType, value, action []byte) (Rule, bool) {
+	if typ == RuleGeoIP {
+		return geoIPRule(value, action)
+	}
+	return cidrRule(typ, value, action)
+}
+
+// geoIPRule parses the country code of a GEOIP rule (or LAN/PRIVATE)
+func geoIPRule(value, action []byte) (Rule, bool) {
+	if len(value) < 2 || len(value) > 16 {
+		return Rule{}, false
+	}
+	for _, c := range value {
+		if lower(c) < 'a' || lower(c) > 'z' {
+			return Rule{}, false
+		}
+	}
+	return Rule{Suffix: strings.ToUpper(string(value)), Action: string(action), Type: RuleGeoIP}, true
+}
+
+// cidrRule parses the prefix of an IP-CIDR or IP-CIDR6 rule; a bare
+// address is a single-host prefix
+func cidrRule(typ RuleType, value, action []byte) (Rule, bool) {
+	prefix, err := netip.ParsePrefix(string(value))
+	if err != nil {
+		addr, err := netip.ParseAddr(string(value))
+		if err != nil || addr.Zone() != "" {
+			return Rule{}, false
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	// 与 MatchIPRule 一致，IPv4 映射地址按 IPv4 匹配
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	if !prefix.IsValid() {
+		return Rule{}, false
+	}
+	return Rule{Suffix: prefix.String(), Action: string(action), Type: typ, Prefix: prefix}, true
+}
+
+// ParseRuleLine parses one rule-list line into a Rule. It reports false
+// for anything that isn't a valid DOMAIN-SUFFIX, DOMAIN, DOMAIN-KEYWORD,
+// IP-CIDR, IP-CIDR6 or GEOIP rule and never panics.
+func ParseRuleLine(line []byte) (Rule, bool) {
+	typ, value, action, ok := parseRuleLine(line)
+	if !ok {
+		return Rule{}, false
+	}
+	return ruleOf(typ, value, action)
+}
+
+// ruleOf builds the Rule of a parsed rule line
+func ruleOf(typ RuleType, value, action []byte) (Rule, bool) {
+	if typ.IsIP() {
+		return ipRule(typ, value, action)
+	}
+	return Rule{Suffix: strings.ToLower(string(value)), Action: string(action), Type: typ}, true
+}
+
+// LoadRuleTrie streams a rule file, following its RULE-SET includes,
+// straight into a compiled RuleTrie without materializing a []Rule, so
+// huge blocklists load in bounded memory
+func LoadRuleTrie(path string) (*RuleTrie, error) {
+	sizeHint := 0
+	if info, err := os.Stat(path); err == nil {
+		// 规则行平均约 32 字节
+		sizeHint = int(info.Size() / 32)
+	}
+	t := NewRuleTrie(sizeHint)
+	rr := &ruleReader{fn: t.insert}
+	if err := rr.readFile(path, "", nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// BuildRuleTrie reads rules line by line, or a Clash rule-provider
+// payload, from r. RULE-SET includes are skipped.
+func BuildRuleTrie(r io.Reader, sizeHint int) (*RuleTrie, error) {
+	t := NewRuleTrie(sizeHint)
+	rr := &ruleReader{fn: t.insert}
+	return t, rr.read(r, "", "", nil)
+}
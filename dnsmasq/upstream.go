@@ -0,0 +1,21 @@
+package dnsmasq
+
+import (
+	"context"
+
+	"openvpnadvanced/doh"
+)
+
+// Upstream answers the queries of a Resolver. *doh.Upstream implements it
+// over DoH, DoT, DoQ, DNSCrypt and plain DNS; tests can plug in a fake to
+// resolve without network access.
+type Upstream interface {
+	Query(ctx context.Context, domain string, qtype uint16) (doh.Answer, error)
+}
+
+// offline is the upstream of an Offline resolver
+type offline struct{}
+
+func (offline) Query(context.Context, string, uint16) (doh.Answer, error) {
+	return doh.Answer{}, ErrOffline
+}
@@ -0,0 +1,64 @@
+package dnsproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+// DefaultAnswerTTL is the TTL of records whose remaining lifetime in the
+// cache is unknown: rewrites, AAAA answers and backends that don't track
+// per-entry TTLs
+const DefaultAnswerTTL = 300 * time.Second
+
+// answerRecords builds the answer section for domain: a CNAME to the
+// rewrite or safe-search target name when it differs, the CNAME chain the
+// upstream returned for it, and the qtype address records owned by the
+// last name. Addresses of the other family are left out, so the answer is
+// NODATA when none is left. Each record carries the remaining TTL of its
+// cache entry, so clients don't hold an answer longer than the cache would.
+func answerRecords(cache dnsmasq.CacheBackend, domain, name string, cnames, ips []string, qtype uint16) []dns.RR {
+	chain := []string{domain}
+	if name != domain {
+		chain = append(chain, name)
+	}
+	chain = append(chain, cnames...)
+
+	records := make([]dns.RR, 0, len(chain)+len(ips))
+	for i := 0; i+1 < len(chain); i++ {
+		records = append(records, &dns.CNAME{
+			Hdr:    header(chain[i], dns.TypeCNAME, answerTTL(cache, chain[i])),
+			Target: dns.Fqdn(chain[i+1]),
+		})
+	}
+	owner := chain[len(chain)-1]
+	ttl := answerTTL(cache, owner)
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		switch {
+		case addr == nil:
+		case qtype == dns.TypeAAAA && addr.To4() == nil:
+			records = append(records, &dns.AAAA{Hdr: header(owner, dns.TypeAAAA, ttl), AAAA: addr})
+		case qtype == dns.TypeA && addr.To4() != nil:
+			records = append(records, &dns.A{Hdr: header(owner, dns.TypeA, ttl), A: addr})
+		}
+	}
+	return records
+}
+
+// answerTTL returns the TTL in seconds to answer name with, at least one
+// so clients don't query again right away
+func answerTTL(cache dnsmasq.CacheBackend, name string) uint32 {
+	ttl, ok := dnsmasq.Remaining(cache, name)
+	if !ok {
+		ttl = DefaultAnswerTTL
+	}
+	return uint32(max((ttl+time.Second-1)/time.Second, 1))
+}
+
+func header(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
@@ -0,0 +1,84 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// LocalNS is the name server named in the SOA and NS records of answers
+// the proxy synthesizes itself
+const LocalNS = "localhost."
+
+// localTTL is the TTL, in seconds, of synthesized SOA and NS records and
+// the negative TTL (SOA minimum) of empty local answers
+const localTTL = 60
+
+// zoneOf returns the zone of a locally answered name: the name of the
+// rewrite rule mapping it, else its registrable domain
+func (s *DNSServer) zoneOf(domain string) string {
+	if rw, ok := s.Current().Rewrites.Lookup(domain); ok {
+		return rw.Name
+	}
+	if zone, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return zone
+	}
+	return domain
+}
+
+func localSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     header(zone, dns.TypeSOA, localTTL),
+		Ns:      LocalNS,
+		Mbox:    "hostmaster." + LocalNS,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  localTTL,
+	}
+}
+
+func localNS(zone string) dns.RR {
+	return &dns.NS{Hdr: header(zone, dns.TypeNS, localTTL), Ns: LocalNS}
+}
+
+// writeLocal writes an answer the proxy synthesized for domain instead of
+// asking the upstream. Empty answers carry the zone's SOA in the authority
+// section, so stub resolvers cache them for the SOA minimum instead of
+// retrying (RFC 2308); other answers carry the zone's NS.
+func (s *DNSServer) writeLocal(w dns.ResponseWriter, msg *dns.Msg, domain string) {
+	zone := s.zoneOf(domain)
+	msg.Authoritative = true
+	if len(msg.Answer) == 0 {
+		msg.Answer = []dns.RR{}
+		msg.Ns = append(msg.Ns, localSOA(zone))
+	} else {
+		msg.Ns = append(msg.Ns, localNS(zone))
+	}
+	_ = w.WriteMsg(msg)
+}
+
+// answerZone answers SOA and NS queries for names a rewrite rule maps to
+// fixed addresses, whose zone the proxy serves itself, and reports
+// whether it did
+func (s *DNSServer) answerZone(w dns.ResponseWriter, msg *dns.Msg, domain string, qtype uint16) bool {
+	rw, ok := s.Current().Rewrites.Lookup(domain)
+	if !ok || rw.Target != "" || (qtype != dns.TypeSOA && qtype != dns.TypeNS) {
+		return false
+	}
+	// 只有区域顶点才有 SOA/NS 记录，子域名返回空答案
+	if strings.EqualFold(domain, rw.Name) {
+		if qtype == dns.TypeSOA {
+			msg.Answer = append(msg.Answer, localSOA(rw.Name))
+		} else {
+			msg.Answer = append(msg.Answer, localNS(rw.Name))
+		}
+		msg.Authoritative = true
+		_ = w.WriteMsg(msg)
+		return true
+	}
+	s.writeLocal(w, msg, domain)
+	return true
+}
@@ -0,0 +1,62 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// CNAMEMatch decides which names of a CNAME chain the static rules are
+// matched against, and which match wins. CDNs often answer a brand's name
+// with a CNAME into their own zone, or serve an unrelated name through a
+// CNAME into the brand's zone.
+type CNAMEMatch int
+
+const (
+	// CNAMEQueryFirst matches the query name, then every CNAME in chain
+	// order; the first match wins
+	CNAMEQueryFirst CNAMEMatch = iota
+	// CNAMETargetFirst matches the last CNAME first, walking back to the
+	// query name
+	CNAMETargetFirst
+	// CNAMEOff matches the query name only
+	CNAMEOff
+)
+
+// ParseCNAMEMatch parses "query-first", "target-first" or "off"
+func ParseCNAMEMatch(s string) (CNAMEMatch, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "query-first":
+		return CNAMEQueryFirst, nil
+	case "target-first":
+		return CNAMETargetFirst, nil
+	case "off":
+		return CNAMEOff, nil
+	}
+	return 0, fmt.Errorf("unknown CNAME match %q (want query-first, target-first or off)", s)
+}
+
+func (m CNAMEMatch) String() string {
+	switch m {
+	case CNAMETargetFirst:
+		return "target-first"
+	case CNAMEOff:
+		return "off"
+	default:
+		return "query-first"
+	}
+}
+
+// Names returns the names of a chain to match, in order of precedence
+func (m CNAMEMatch) Names(domain string, cnames []string) []string {
+	if m == CNAMEOff || len(cnames) == 0 {
+		return []string{domain}
+	}
+	names := make([]string, 0, len(cnames)+1)
+	names = append(names, domain)
+	names = append(names, cnames...)
+	if m == CNAMETargetFirst {
+		slices.Reverse(names)
+	}
+	return names
+}
@@ -0,0 +1,79 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/fakeip"
+
+	"github.com/miekg/dns"
+)
+
+// fakes reports whether the answer d is answered from the fake-ip pool:
+// it goes through the VPN, not to another action's egress
+func (s *DNSServer) fakes(d *dnsmasq.Decision) bool {
+	return s.FakeIP != nil && d.Routes() && actions.IsVPN(d.Action)
+}
+
+// writeFake answers d with its fake address once connections to it are
+// translated to a real one, and reports whether it did. It doesn't when
+// the answer has no IPv4 address, the range is exhausted or the
+// translation failed, leaving the real answer to be written and routed.
+// AAAA queries are answered empty so clients connect to the fake IPv4
+// address.
+func (s *DNSServer) writeFake(w dns.ResponseWriter, msg *dns.Msg, d *dnsmasq.Decision, qtype uint16) bool {
+	if qtype == dns.TypeAAAA {
+		s.writeLocal(w, msg, d.Domain)
+		return true
+	}
+	var reals []netip.Addr
+	for _, ip := range d.IPs() {
+		if addr, err := netip.ParseAddr(ip); err == nil && addr.Unmap().Is4() {
+			reals = append(reals, addr.Unmap())
+		}
+	}
+	if len(reals) == 0 {
+		return false
+	}
+	m, err := s.assignFake(d.Domain, reals)
+	if err != nil {
+		s.logf("⚠️ No fake IP for %s, answering the real address: %v", d.Domain, err)
+		return false
+	}
+	ttl := uint32(max((s.FakeIPTTL+time.Second-1)/time.Second, 1))
+	msg.Answer = append(msg.Answer, &dns.A{Hdr: header(d.Domain, dns.TypeA, ttl), A: m.Fake.AsSlice()})
+	_ = w.WriteMsg(msg)
+	return true
+}
+
+// assignFake returns the fake address of domain, installing its
+// translation first when it is new or its address left the answer.
+// Answers rotating between the same addresses run no command.
+func (s *DNSServer) assignFake(domain string, reals []netip.Addr) (fakeip.Mapping, error) {
+	// 串行化：并发查询同一新域名时，后者要等转换规则装好再应答
+	s.fakeMu.Lock()
+	defer s.fakeMu.Unlock()
+	a, err := s.FakeIP.Assign(domain, reals, time.Now())
+	if err != nil {
+		return a.Mapping, err
+	}
+	if a.Evicted != nil {
+		s.logf("♻️ Fake IP %s recycled from %s", a.Evicted.Fake, a.Evicted.Domain)
+		_ = s.Router.UnmapFakeIP(a.Evicted.Fake, a.Evicted.Real)
+	}
+	if !a.Changed {
+		return a.Mapping, nil
+	}
+	if a.Prev != nil {
+		_ = s.Router.UnmapFakeIP(a.Prev.Fake, a.Prev.Real)
+	}
+	if err := s.Router.MapFakeIP(a.Fake, a.Real); err != nil {
+		s.FakeIP.Release(domain)
+		return a.Mapping, fmt.Errorf("translating %s ➜ %s: %v", a.Fake, a.Real, err)
+	}
+	s.logf("🎭 Fake IP: %s ➜ %s (%s)", domain, a.Fake, a.Real)
+	return a.Mapping, nil
+}
@@ -0,0 +1,76 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/dnsmasq"
+)
+
+// VPNDownPolicy decides what happens to matched domains while the VPN
+// interface is down
+type VPNDownPolicy int
+
+const (
+	// VPNDownBlock keeps routing matched domains into the dead tunnel, so
+	// they fail instead of leaking onto the local network
+	VPNDownBlock VPNDownPolicy = iota
+	// VPNDownDirect answers matched domains without routes until the
+	// tunnel recovers
+	VPNDownDirect
+)
+
+// ParseVPNDownPolicy parses "block" or "direct"
+func ParseVPNDownPolicy(s string) (VPNDownPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "block":
+		return VPNDownBlock, nil
+	case "direct":
+		return VPNDownDirect, nil
+	}
+	return 0, fmt.Errorf("unknown vpn-down policy %q (want block or direct)", s)
+}
+
+func (p VPNDownPolicy) String() string {
+	if p == VPNDownDirect {
+		return "direct"
+	}
+	return "block"
+}
+
+// SetVPNDown marks the VPN as down or recovered. While down, matched
+// domains go DIRECT according to VPNDown, VPNDownDirectDomains and
+// VPNDownBlockDomains.
+func (s *DNSServer) SetVPNDown(down bool) {
+	s.vpnDown.Store(down)
+}
+
+// VPNDownNow reports whether the VPN is marked down
+func (s *DNSServer) VPNDownNow() bool {
+	return s.vpnDown.Load()
+}
+
+// FallsBack reports whether domain goes DIRECT while the VPN is down: the
+// per-suffix lists first, then the global policy
+func (s *DNSServer) FallsBack(domain string) bool {
+	switch {
+	case dnsmasq.MatchesRules(domain, s.VPNDownBlockDomains):
+		return false
+	case dnsmasq.MatchesRules(domain, s.VPNDownDirectDomains):
+		return true
+	}
+	return s.VPNDown == VPNDownDirect
+}
+
+// fallBack reports whether a matched answer skips its VPN route right now.
+// Only the default VPN action falls back; custom actions run as usual.
+func (s *DNSServer) fallBack(domain, action string) bool {
+	if !s.VPNDownNow() {
+		return false
+	}
+	if !actions.IsVPN(action) {
+		return false
+	}
+	return s.FallsBack(domain)
+}
@@ -0,0 +1,43 @@
+package dnsproxy
+
+import (
+	"errors"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/miekg/dns"
+)
+
+// forwardRaw answers a query of a type the proxy doesn't resolve itself
+// (TXT, SRV, NAPTR, CAA, ...) by relaying the upstream's answer as is.
+// Nothing is cached, matched or routed.
+func (s *DNSServer) forwardRaw(w dns.ResponseWriter, msg *dns.Msg, domain string, qtype uint16) {
+	resp, err := s.resolver(s.Current()).Exchange(domain, qtype)
+	if errors.Is(err, dnsmasq.ErrRejected) {
+		s.writeRejected(w, msg, domain, qtype)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, dnsmasq.ErrNXDomain) {
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			s.logf("⚠️ %s query failed for %s: %v", dns.TypeToString[qtype], domain, err)
+			msg.Rcode = dns.RcodeServerFailure
+		}
+		_ = w.WriteMsg(msg)
+		return
+	}
+
+	msg.Rcode = resp.Rcode
+	msg.AuthenticatedData = resp.AuthenticatedData
+	msg.Answer = resp.Answer
+	msg.Ns = resp.Ns
+	// OPT 记录属于上游连接，不转给客户端
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			msg.Extra = append(msg.Extra, rr)
+		}
+	}
+	s.logf("[%s] %s ➜ %d records", dns.TypeToString[qtype], domain, len(msg.Answer))
+	_ = w.WriteMsg(msg)
+}
@@ -0,0 +1,122 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/miekg/dns"
+)
+
+// ECHPolicy decides whether Encrypted Client Hello configs in forwarded
+// HTTPS records reach clients. ECH hides the real SNI, which defeats
+// SNI-based matching on the proxy path.
+type ECHPolicy int
+
+const (
+	// ECHStripMatched strips ECH for domains matching the routing rules,
+	// unless fake-ip mode routes them by address
+	ECHStripMatched ECHPolicy = iota
+	// ECHStrip strips ECH for every domain
+	ECHStrip
+	// ECHPass passes ECH through unchanged
+	ECHPass
+)
+
+// ParseECHPolicy parses "strip-matched", "strip" or "pass"
+func ParseECHPolicy(s string) (ECHPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "strip-matched":
+		return ECHStripMatched, nil
+	case "strip":
+		return ECHStrip, nil
+	case "pass":
+		return ECHPass, nil
+	}
+	return 0, fmt.Errorf("unknown ECH policy %q (want strip-matched, strip or pass)", s)
+}
+
+func (p ECHPolicy) String() string {
+	switch p {
+	case ECHStrip:
+		return "strip"
+	case ECHPass:
+		return "pass"
+	default:
+		return "strip-matched"
+	}
+}
+
+// stripECH applies the per-suffix overrides, then the global policy
+func (s *DNSServer) stripECH(domain string, matched bool) bool {
+	switch {
+	case dnsmasq.MatchesRules(domain, s.ECHStripDomains):
+		return true
+	case dnsmasq.MatchesRules(domain, s.ECHPassDomains):
+		return false
+	case s.ECH == ECHStripMatched:
+		// 假 IP 按目的地址分流，不依赖 SNI，ECH 可以保留
+		return matched && s.FakeIP == nil
+	}
+	return s.ECH == ECHStrip
+}
+
+// forwardHTTPS answers an HTTPS query from the upstream. ECH configs are
+// stripped per stripECH, and address hints are dropped for matched domains
+// so clients resolve A/AAAA through the proxy and get routed.
+func (s *DNSServer) forwardHTTPS(w dns.ResponseWriter, msg *dns.Msg, domain string) {
+	sn := s.Current()
+	resp, err := s.resolver(sn).Exchange(domain, dns.TypeHTTPS)
+	if errors.Is(err, dnsmasq.ErrRejected) {
+		s.writeRejected(w, msg, domain, dns.TypeHTTPS)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, dnsmasq.ErrNXDomain) {
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			s.logf("⚠️ HTTPS query failed for %s: %v", domain, err)
+			msg.Rcode = dns.RcodeServerFailure
+		}
+		_ = w.WriteMsg(msg)
+		return
+	}
+
+	matched := sn.Routes(domain)
+	strip := s.stripECH(domain, matched)
+	var hasECH bool
+	msg.Answer = make([]dns.RR, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		if https, ok := rr.(*dns.HTTPS); ok {
+			https = dns.Copy(https).(*dns.HTTPS)
+			https.Value = filterSvcParams(https.Value, func(kv dns.SVCBKeyValue) bool {
+				switch kv.Key() {
+				case dns.SVCB_ECHCONFIG:
+					hasECH = true
+					return !strip
+				case dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT:
+					return !matched
+				}
+				return true
+			})
+			rr = https
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	if hasECH {
+		s.logf("[HTTPS] %s carries ECH (stripped: %v)", domain, strip)
+	}
+	_ = w.WriteMsg(msg)
+}
+
+func filterSvcParams(values []dns.SVCBKeyValue, keep func(dns.SVCBKeyValue) bool) []dns.SVCBKeyValue {
+	out := values[:0]
+	for _, kv := range values {
+		if keep(kv) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"openvpnadvanced/limits"
+)
+
+// limitListener stops accepting TCP connections while the limiter is
+// full, leaving new clients in the kernel backlog
+type limitListener struct {
+	net.Listener
+	limit *limits.Limiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if err := l.limit.Acquire(context.Background()); err != nil {
+		return nil, err
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.limit.Release()
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: l.limit.Release}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
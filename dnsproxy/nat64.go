@@ -0,0 +1,54 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net/netip"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/nat64"
+)
+
+// dns64 adjusts the AAAA answer of name on a NAT64 network. A name without
+// AAAA records gets them synthesized from its A records (RFC 6147), so
+// IPv6-only clients reach it through the gateway. It returns the answer's
+// addresses and the IPv4 addresses they translate to, which are what the
+// rules and routes apply to; none when the answer is native IPv6.
+func dns64(resolver *dnsmasq.Resolver, prefix netip.Prefix, name string, ips []string, err error) ([]string, []string, error) {
+	if errors.Is(err, dnsmasq.ErrNoAnswer) {
+		v4, _, aErr := resolver.ResolveAddrs(name)
+		if aErr != nil {
+			return ips, nil, err
+		}
+		var synth, translated []string
+		for _, ip := range v4 {
+			addr, perr := netip.ParseAddr(ip)
+			if perr != nil {
+				continue
+			}
+			if v6, ok := nat64.Synthesize(prefix, addr); ok {
+				synth = append(synth, v6.String())
+				translated = append(translated, ip)
+			}
+		}
+		if len(synth) == 0 {
+			return ips, nil, err
+		}
+		return synth, translated, nil
+	}
+	if err != nil {
+		return ips, nil, err
+	}
+
+	// 上游（如网络自带的 DNS64 解析器）已经合成的地址，还原出 IPv4 地址
+	var translated []string
+	for _, ip := range ips {
+		addr, perr := netip.ParseAddr(ip)
+		if perr != nil {
+			continue
+		}
+		if v4, ok := nat64.Extract(prefix, addr); ok {
+			translated = append(translated, v4.String())
+		}
+	}
+	return ips, translated, nil
+}
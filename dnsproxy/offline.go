@@ -0,0 +1,35 @@
+package dnsproxy
+
+import (
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+// SetOffline switches offline mode on or off. While offline, queries are
+// answered only from the cache, rewrites and local zones; anything else
+// gets SERVFAIL at once instead of waiting for an unreachable upstream.
+func (s *DNSServer) SetOffline(offline bool) {
+	if !offline {
+		s.offlineSince.Store(nil)
+		return
+	}
+	now := time.Now()
+	s.offlineSince.CompareAndSwap(nil, &now)
+}
+
+// Offline reports whether offline mode is on, and since when
+func (s *DNSServer) Offline() (time.Time, bool) {
+	if since := s.offlineSince.Load(); since != nil {
+		return *since, true
+	}
+	return time.Time{}, false
+}
+
+// resolver returns the resolver of sn, answering from the cache only
+// while offline
+func (s *DNSServer) resolver(sn *Snapshot) *dnsmasq.Resolver {
+	r := sn.Resolver(s.Logger)
+	_, r.Offline = s.Offline()
+	return r
+}
@@ -0,0 +1,111 @@
+package dnsproxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/dnsmasq"
+)
+
+// Direct is the egress of an override that keeps domains off the VPN
+const Direct = actions.Direct
+
+// Override pins the domains under Suffix (see dnsmasq.MatchSuffix) to an
+// egress, above the rules: Direct, the VPN or a custom action name
+type Override struct {
+	Suffix string `json:"suffix"`
+	Egress string `json:"egress"`
+	// Expires is when the override lapses; zero keeps it until removed
+	Expires time.Time `json:"expires"`
+}
+
+// Routes reports whether the override's egress is a route (the VPN or an
+// action) rather than Direct
+func (o Override) Routes() bool {
+	return !strings.EqualFold(o.Egress, Direct)
+}
+
+// Overrides are the ephemeral runtime overrides layered above the rule
+// file. They are never persisted. Methods are safe on a nil *Overrides,
+// which holds none.
+type Overrides struct {
+	mu sync.Mutex
+	m  map[string]Override
+}
+
+// NewOverrides returns an empty set of overrides
+func NewOverrides() *Overrides {
+	return &Overrides{m: make(map[string]Override)}
+}
+
+// Set adds o, replacing any override for the same suffix
+func (ov *Overrides) Set(o Override) {
+	if ov == nil {
+		return
+	}
+	o.Suffix = strings.ToLower(o.Suffix)
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+	ov.m[o.Suffix] = o
+}
+
+// Remove drops the override for suffix and reports whether there was one
+func (ov *Overrides) Remove(suffix string) bool {
+	if ov == nil {
+		return false
+	}
+	suffix = strings.ToLower(suffix)
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+	_, ok := ov.m[suffix]
+	delete(ov.m, suffix)
+	return ok
+}
+
+// Lookup returns the override with the longest suffix of domain still
+// active at at
+func (ov *Overrides) Lookup(domain string, at time.Time) (Override, bool) {
+	if ov == nil {
+		return Override{}, false
+	}
+	domain = strings.ToLower(domain)
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	var best Override
+	found := false
+	for suffix, o := range ov.m {
+		if !o.Expires.IsZero() && !at.Before(o.Expires) {
+			delete(ov.m, suffix)
+			continue
+		}
+		if dnsmasq.MatchSuffix(domain, suffix) && (!found || len(suffix) > len(best.Suffix)) {
+			best, found = o, true
+		}
+	}
+	return best, found
+}
+
+// List returns the active overrides sorted by suffix
+func (ov *Overrides) List() []Override {
+	if ov == nil {
+		return nil
+	}
+	now := time.Now()
+	ov.mu.Lock()
+	list := make([]Override, 0, len(ov.m))
+	for suffix, o := range ov.m {
+		if !o.Expires.IsZero() && !now.Before(o.Expires) {
+			delete(ov.m, suffix)
+			continue
+		}
+		list = append(list, o)
+	}
+	ov.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Suffix < list[j].Suffix })
+	return list
+}
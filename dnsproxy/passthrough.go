@@ -0,0 +1,39 @@
+package dnsproxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// SetPassThrough forwards every query unchanged to the plain DNS server
+// addr (IP:port) without matching rules or installing routes, e.g. while a
+// captive portal blocks the encrypted upstream. An empty addr restores
+// normal operation.
+func (s *DNSServer) SetPassThrough(addr string) {
+	s.passThrough.Store(&addr)
+}
+
+// PassThrough returns the server queries are passed through to, or ""
+func (s *DNSServer) PassThrough() string {
+	if addr := s.passThrough.Load(); addr != nil {
+		return *addr
+	}
+	return ""
+}
+
+// passThroughReply relays r to addr and writes its answer back
+func (s *DNSServer) passThroughReply(w dns.ResponseWriter, r *dns.Msg, addr string) {
+	client := &dns.Client{}
+	resp, _, err := client.Exchange(r, addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(r, addr)
+	}
+	if err != nil {
+		s.logf("⚠️ Pass-through query to %s failed: %v", addr, err)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(msg)
+		return
+	}
+	_ = w.WriteMsg(resp)
+}
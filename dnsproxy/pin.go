@@ -0,0 +1,112 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/rewrite"
+)
+
+// Pin answers a domain with a fixed address instead of asking the
+// upstream, e.g. to keep a CDN from rotating a routed site to an address
+// without a route mid-session. Queries for the other address family get
+// an empty answer, so clients use the pinned address.
+type Pin struct {
+	Domain string     `json:"domain"`
+	IP     netip.Addr `json:"ip"`
+	// Expires is when the pin lapses; zero keeps it until removed
+	Expires time.Time `json:"expires"`
+}
+
+// rule returns the address rewrite answering like the pin
+func (p Pin) rule() rewrite.Rule {
+	rw := rewrite.Rule{Name: p.Domain}
+	if p.IP.Is4() {
+		rw.IPv4 = p.IP
+	} else {
+		rw.IPv6 = p.IP
+	}
+	return rw
+}
+
+// Pins are the runtime pins of exact domains, above the rewrite rules
+// and the upstream. They are never persisted. Methods are safe on a nil
+// *Pins, which holds none.
+type Pins struct {
+	mu sync.Mutex
+	m  map[string]Pin
+}
+
+// NewPins returns an empty set of pins
+func NewPins() *Pins {
+	return &Pins{m: make(map[string]Pin)}
+}
+
+func pinKey(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// Set adds p, replacing any pin of the same domain
+func (ps *Pins) Set(p Pin) {
+	if ps == nil {
+		return
+	}
+	p.Domain = pinKey(p.Domain)
+	p.IP = p.IP.Unmap()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.m[p.Domain] = p
+}
+
+// Remove drops the pin of domain and reports whether there was one
+func (ps *Pins) Remove(domain string) bool {
+	if ps == nil {
+		return false
+	}
+	domain = pinKey(domain)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	_, ok := ps.m[domain]
+	delete(ps.m, domain)
+	return ok
+}
+
+// Lookup returns the pin of domain still active at at
+func (ps *Pins) Lookup(domain string, at time.Time) (Pin, bool) {
+	if ps == nil {
+		return Pin{}, false
+	}
+	domain = pinKey(domain)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.m[domain]
+	if ok && !p.Expires.IsZero() && !at.Before(p.Expires) {
+		delete(ps.m, domain)
+		return Pin{}, false
+	}
+	return p, ok
+}
+
+// List returns the active pins sorted by domain
+func (ps *Pins) List() []Pin {
+	if ps == nil {
+		return nil
+	}
+	now := time.Now()
+	ps.mu.Lock()
+	list := make([]Pin, 0, len(ps.m))
+	for domain, p := range ps.m {
+		if !p.Expires.IsZero() && !now.Before(p.Expires) {
+			delete(ps.m, domain)
+			continue
+		}
+		list = append(list, p)
+	}
+	ps.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
@@ -0,0 +1,55 @@
+package dnsproxy
+
+import "sync"
+
+// Defaults for the resolution worker pool
+const (
+	DefaultWorkers   = 64
+	DefaultQueueSize = 1024
+)
+
+// resolvePool runs resolutions on a fixed number of workers. Jobs beyond
+// the queue capacity are rejected instead of spawning more goroutines, so
+// a flood of unique domains can't exhaust goroutines or file descriptors.
+type resolvePool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newResolvePool(workers, queueSize int) *resolvePool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize < 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	p := &resolvePool{jobs: make(chan func(), queueSize)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a job and reports false when the queue is full
+func (p *resolvePool) submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop lets the workers drain the queue and waits for them to exit.
+// No submit may happen after stop.
+func (p *resolvePool) stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
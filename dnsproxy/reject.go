@@ -0,0 +1,57 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RejectPolicy decides how queries for domains a REJECT rule matches are
+// answered
+type RejectPolicy int
+
+const (
+	// RejectZero answers A queries with 0.0.0.0, AAAA queries with :: and
+	// other types with an empty answer, so clients fail fast without
+	// retrying other resolvers
+	RejectZero RejectPolicy = iota
+	// RejectNXDomain answers that the name doesn't exist
+	RejectNXDomain
+)
+
+// ParseRejectPolicy parses "zero" or "nxdomain"
+func ParseRejectPolicy(s string) (RejectPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "zero":
+		return RejectZero, nil
+	case "nxdomain":
+		return RejectNXDomain, nil
+	}
+	return 0, fmt.Errorf("unknown reject policy %q (want zero or nxdomain)", s)
+}
+
+func (p RejectPolicy) String() string {
+	if p == RejectNXDomain {
+		return "nxdomain"
+	}
+	return "zero"
+}
+
+// writeRejected answers a query for a domain a REJECT rule matches, per
+// Reject. Nothing is routed.
+func (s *DNSServer) writeRejected(w dns.ResponseWriter, msg *dns.Msg, domain string, qtype uint16) {
+	if s.Reject == RejectNXDomain {
+		msg.Rcode = dns.RcodeNameError
+		s.writeLocal(w, msg, domain)
+		return
+	}
+	switch qtype {
+	case dns.TypeA:
+		msg.Answer = append(msg.Answer, &dns.A{Hdr: header(domain, dns.TypeA, localTTL), A: net.IPv4zero})
+	case dns.TypeAAAA:
+		msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: header(domain, dns.TypeAAAA, localTTL), AAAA: net.IPv6zero})
+	}
+	s.writeLocal(w, msg, domain)
+}
@@ -1,54 +1,343 @@
 package dnsproxy
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"openvpnadvanced/actions"
+	"openvpnadvanced/clients"
 	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/exprrules"
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/handoff"
+	"openvpnadvanced/history"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/limits"
+	"openvpnadvanced/metrics"
+	"openvpnadvanced/privhelper"
+	"openvpnadvanced/qos"
+	"openvpnadvanced/querylog"
+	"openvpnadvanced/replay"
+	"openvpnadvanced/rewrite"
+	"openvpnadvanced/safesearch"
 	"openvpnadvanced/utils"
 	"openvpnadvanced/vpn"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 type DNSServer struct {
-	Rules    []dnsmasq.Rule
-	Cache    *dnsmasq.Cache
+	// Rules, Matcher, Exprs, Rewrites and Cache form the initial Snapshot;
+	// use Swap to change them while running
+	Rules []dnsmasq.Rule
+	// Matcher, when set, is used instead of Rules
+	Matcher  dnsmasq.RuleMatcher
+	Cache    dnsmasq.CacheBackend
 	Fallback string
 	VPNIface string
+	// Addr is the listen address for both UDP and TCP, ":53" by default
+	Addr string
+	// Helper, when set, binds the listening sockets on behalf of an
+	// unprivileged process
+	Helper *privhelper.Client
+	// PacketConn and Listener, when set, are served instead of binding
+	// Addr, e.g. sockets inherited from the process being replaced
+	PacketConn net.PacketConn
+	Listener   net.Listener
+	// Router installs routes for matched domains; defaults to sudo
+	Router *vpn.Router
+	// Actions are custom rule actions keyed by the upper-cased name used
+	// in rules
+	Actions map[string]actions.Action
+	// Exprs are expression rules evaluated when no static rule matches
+	Exprs *exprrules.Set
+	// Rewrites override answers for selected names
+	Rewrites *rewrite.Set
+	// Hooks are notified of resolutions, rule matches and injected routes
+	Hooks *hooks.Hooks
+	// State records installed routes and rule hit counters; not recorded
+	// when nil
+	State *State
+	// Logger receives server and resolver output; dnsmasq.DefaultLogger when nil
+	Logger dnsmasq.Logger
+	// PrintQueries prints the colored per-query [VPN]/[DIRECT] console lines
+	PrintQueries bool
+	// Workers bounds concurrent resolutions (NewServer sets DefaultWorkers)
+	Workers int
+	// QueueSize bounds resolutions waiting for a worker; queries beyond it
+	// are answered with SERVFAIL (NewServer sets DefaultQueueSize)
+	QueueSize int
+	// UDP tunes the UDP listener's readers, workers, queue and socket
+	// buffers
+	UDP UDPOptions
+	// Recorder, when set, records every resolution and decision for replay
+	Recorder *replay.Recorder
+	// History, when set, keeps every resolution for the history command
+	History *history.Store
+	// QueryLog, when set, keeps the latest resolutions in memory
+	QueryLog *querylog.Log
+	// ConnLimiter bounds concurrent TCP client connections; further
+	// clients wait in the accept backlog. Unlimited when nil.
+	ConnLimiter *limits.Limiter
+	// FilterAAAA answers every AAAA query with an empty NOERROR so clients
+	// fall back to IPv4 (NewServer enables it). When off, AAAA queries are
+	// resolved and routed like A queries, except for domains matching
+	// FilterAAAADomains.
+	FilterAAAA        bool
+	FilterAAAADomains []dnsmasq.Rule
+	// HTTPSRecords forwards HTTPS queries to the upstream instead of
+	// answering them empty, applying ECH to the ECH configs they carry;
+	// ECHStripDomains and ECHPassDomains override ECH per suffix
+	HTTPSRecords    bool
+	ECH             ECHPolicy
+	ECHStripDomains []dnsmasq.Rule
+	ECHPassDomains  []dnsmasq.Rule
+	// SafeSearch answers search engine and YouTube queries with a CNAME to
+	// their safe-search endpoints, per client profile; nothing is
+	// rewritten when nil
+	SafeSearch *safesearch.Policy
+	// Clients identifies the querying clients, picks their profile and
+	// enforces their rate limits; queries over the limit are REFUSED.
+	// Clients are known by address only when nil.
+	Clients *clients.Registry
+	// VPNDown decides whether matched domains go DIRECT instead of into
+	// the tunnel while SetVPNDown(true) is in effect;
+	// VPNDownDirectDomains and VPNDownBlockDomains override it per suffix
+	VPNDown              VPNDownPolicy
+	VPNDownDirectDomains []dnsmasq.Rule
+	VPNDownBlockDomains  []dnsmasq.Rule
+	// Reject decides how queries for domains a REJECT rule matches are
+	// answered
+	Reject RejectPolicy
+	// VerifyUpstream, when set, cross-checks the answers for
+	// VerifyDomains; Verify decides what happens when they disagree
+	VerifyUpstream *doh.Upstream
+	VerifyDomains  []dnsmasq.Rule
+	Verify         VerifyPolicy
+	// QoS marks traffic to the routed addresses of the domains in each
+	// class so downstream shaping can prioritize it
+	QoS []qos.Class
+	// Overrides pin domains to an egress above the rules
+	Overrides *Overrides
+	// Pins answer domains with a fixed address above the rewrite rules
+	Pins *Pins
+	// Metrics, when set, counts resolutions and installed routes
+	Metrics *metrics.Metrics
+	// FakeIP, when set, answers domains routed through the VPN with
+	// addresses from its range instead of installing host routes; the
+	// range must be routed through the VPN already (see
+	// vpn.Router.SetupFakeIP). FakeIPTTL is the TTL of those answers.
+	FakeIP    *fakeip.Pool
+	FakeIPTTL time.Duration
+
+	snapshot     atomic.Pointer[Snapshot]
+	passThrough  atomic.Pointer[string]
+	servers      []*dns.Server
+	udp          atomic.Pointer[udpServer]
+	pc           net.PacketConn
+	ln           net.Listener
+	poolMu       sync.RWMutex
+	pool         *resolvePool
+	rejected     atomic.Uint64
+	queries      atomic.Uint64
+	cacheHits    atomic.Uint64
+	cacheMisses  atomic.Uint64
+	vpnDown      atomic.Bool
+	mismatches   atomic.Uint64
+	offlineSince atomic.Pointer[time.Time]
+	verifyMu     sync.Mutex
+	verified     map[string]time.Time
+	qosWarned    atomic.Bool
+	fakeMu       sync.Mutex
 }
 
-func NewServer(rules []dnsmasq.Rule, cache *dnsmasq.Cache, fallback string, vpnIface string) *DNSServer {
+func NewServer(rules []dnsmasq.Rule, cache dnsmasq.CacheBackend, fallback string, vpnIface string) *DNSServer {
 	return &DNSServer{
-		Rules:    rules,
-		Cache:    cache,
-		Fallback: "127.0.0.1:53",
-		VPNIface: vpnIface,
+		Rules:        rules,
+		Cache:        cache,
+		Fallback:     "127.0.0.1:53",
+		VPNIface:     vpnIface,
+		Addr:         ":53",
+		Router:       &vpn.Router{},
+		PrintQueries: true,
+		Workers:      DefaultWorkers,
+		QueueSize:    DefaultQueueSize,
+		FilterAAAA:   true,
 	}
 }
 
-func (s *DNSServer) Start() {
+// Rejected returns how many queries were refused because the resolution
+// queue was full
+func (s *DNSServer) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+// Queries returns how many queries the server has received
+func (s *DNSServer) Queries() uint64 {
+	return s.queries.Load()
+}
+
+// CacheHits returns how many resolutions were answered from the cache and
+// how many asked the upstream
+func (s *DNSServer) CacheHits() (hits, misses uint64) {
+	return s.cacheHits.Load(), s.cacheMisses.Load()
+}
+
+// UDPStats returns the counters of the UDP listener; zero before Start
+func (s *DNSServer) UDPStats() UDPStats {
+	udp := s.udp.Load()
+	if udp == nil {
+		return UDPStats{}
+	}
+	return udp.stats()
+}
+
+func (s *DNSServer) logf(format string, args ...any) {
+	if s.Logger == nil {
+		dnsmasq.DefaultLogger.Printf(format, args...)
+		return
+	}
+	s.Logger.Printf(format, args...)
+}
+
+// Start binds the UDP and TCP listeners and serves them in the background.
+// Bind errors are returned instead of terminating the process.
+func (s *DNSServer) Start() error {
 	handler := dns.NewServeMux()
 	handler.HandleFunc(".", s.handleDNSRequest)
 
+	pc, ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.pc, s.ln = pc, ln
+	if s.ConnLimiter != nil {
+		ln = &limitListener{Listener: ln, limit: s.ConnLimiter}
+	}
+	s.snapshot.CompareAndSwap(nil, s.Current())
+	s.poolMu.Lock()
+	s.pool = newResolvePool(s.Workers, s.QueueSize)
+	s.poolMu.Unlock()
+
+	via := ""
+	if s.Helper != nil {
+		via = " via helper"
+	}
+	started := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	notify := func() { started <- struct{}{} }
+
+	udp := newUDPServer(pc, handler, s.UDP)
+	udp.logf = s.logf
+	udp.onDrop = s.Metrics.UDPDropped
+	tcpServer := &dns.Server{Listener: ln, Handler: handler, NotifyStartedFunc: notify}
+
 	go func() {
-		server := &dns.Server{Addr: ":53", Net: "udp", Handler: handler}
-		log.Println("🌀 DNS server (UDP) listening on :53")
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to start UDP DNS server: %v", err)
+		if err := tcpServer.ActivateAndServe(); err != nil {
+			s.logf("❌ DNS server stopped: %v", err)
+			failed <- err
 		}
 	}()
 
-	go func() {
-		server := &dns.Server{Addr: ":53", Net: "tcp", Handler: handler}
-		log.Println("🌀 DNS server (TCP) listening on :53")
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to start TCP DNS server: %v", err)
+	// 等待 TCP 监听器就绪，避免 Stop 与启动竞争
+	select {
+	case <-started:
+	case err := <-failed:
+		_ = tcpServer.Shutdown()
+		pc.Close()
+		ln.Close()
+		s.poolMu.Lock()
+		s.pool.stop()
+		s.pool = nil
+		s.poolMu.Unlock()
+		return err
+	}
+	udp.start()
+	s.udp.Store(udp)
+	s.servers = []*dns.Server{tcpServer}
+	s.logf("🌀 DNS server (UDP/TCP) listening on %s%s", s.Addr, via)
+	return nil
+}
+
+// listen binds the sockets directly or through the privileged helper,
+// unless they were given
+func (s *DNSServer) listen() (net.PacketConn, net.Listener, error) {
+	if s.PacketConn != nil && s.Listener != nil {
+		return s.PacketConn, s.Listener, nil
+	}
+	if s.Helper != nil {
+		pc, err := s.Helper.ListenPacket(s.Addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get UDP socket from helper: %v", err)
 		}
-	}()
+		ln, err := s.Helper.Listen(s.Addr)
+		if err != nil {
+			pc.Close()
+			return nil, nil, fmt.Errorf("failed to get TCP socket from helper: %v", err)
+		}
+		return pc, ln, nil
+	}
+
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start UDP DNS server: %v", err)
+	}
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		pc.Close()
+		return nil, nil, fmt.Errorf("failed to start TCP DNS server: %v", err)
+	}
+	return pc, ln, nil
+}
+
+// Handoff duplicates the listening sockets, which stay open after Stop
+// for a new process to serve (see package handoff)
+func (s *DNSServer) Handoff() (*handoff.Files, error) {
+	if s.pc == nil {
+		return nil, errors.New("server is not listening")
+	}
+	return handoff.Dup(s.Addr, s.pc, s.ln)
+}
+
+// Stop shuts down both listeners
+func (s *DNSServer) Stop() error {
+	var firstErr error
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.servers = nil
+	if udp := s.udp.Swap(nil); udp != nil {
+		if err := udp.shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.pc, s.ln = nil, nil
+
+	s.poolMu.Lock()
+	pool := s.pool
+	s.pool = nil
+	s.poolMu.Unlock()
+	if pool != nil {
+		pool.stop()
+	}
+	return firstErr
 }
 
 func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	s.queries.Add(1)
+	if addr := s.PassThrough(); addr != "" {
+		s.passThroughReply(w, r, addr)
+		return
+	}
+
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 
@@ -60,43 +349,425 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	q := r.Question[0]
 	domain := strings.TrimSuffix(q.Name, ".")
 
+	clientID, mac := clients.FromMsg(r)
+	remote, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	ident := s.Clients.Identify(remote.Addr(), clientID, mac)
+	s.State.Queried(ident.String())
+	if !s.Clients.Allow(ident) {
+		s.logf("⚠️ Rate limit exceeded by %s, refusing %s", ident, domain)
+		msg.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(msg)
+		return
+	}
+
 	switch q.Qtype {
 	case dns.TypeA:
 		// Handle A record normally
-	case dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB, dns.TypePTR, dns.TypeSOA:
-		msg.Answer = []dns.RR{}
-		_ = w.WriteMsg(msg)
+	case dns.TypeAAAA:
+		if s.filterAAAA(domain) {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+	case dns.TypeHTTPS:
+		if !s.HTTPSRecords {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+	case dns.TypeSOA:
+		if !s.answerZone(w, msg, domain, q.Qtype) {
+			s.writeLocal(w, msg, domain)
+		}
+		return
+	case dns.TypeSVCB, dns.TypePTR:
+		s.writeLocal(w, msg, domain)
 		return
 	default:
-		log.Printf("⚠️ Unsupported query type: %d for %s", q.Qtype, domain)
-		msg.Answer = []dns.RR{}
+		// 其他类型（TXT、SRV、CAA 等）原样转发给上游
+	}
+
+	// 通过有界工作池解析，避免大量不同域名导致 goroutine 和文件描述符无限增长
+	done := make(chan struct{})
+	s.poolMu.RLock()
+	pool := s.pool
+	queued := pool != nil && pool.submit(func() {
+		defer close(done)
+		s.reply(w, msg, domain, q.Qtype, ident)
+	})
+	s.poolMu.RUnlock()
+
+	if pool == nil {
+		s.reply(w, msg, domain, q.Qtype, ident)
+		return
+	}
+	if !queued {
+		s.rejected.Add(1)
+		s.logf("⚠️ Resolution queue full, refusing %s", domain)
+		msg.Rcode = dns.RcodeServerFailure
 		_ = w.WriteMsg(msg)
 		return
 	}
+	<-done
+}
+
+// reply answers an accepted query on a worker
+func (s *DNSServer) reply(w dns.ResponseWriter, msg *dns.Msg, domain string, qtype uint16, ident clients.Identity) {
+	if qtype == dns.TypeHTTPS {
+		// 被改写的域名不转发 HTTPS 记录，避免地址提示绕过改写
+		if _, ok := s.safeSearch(ident, domain); ok {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+		if _, ok := s.Current().Rewrites.Lookup(domain); ok {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+		if _, ok := s.Pins.Lookup(domain, time.Now()); ok {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+		s.forwardHTTPS(w, msg, domain)
+		return
+	}
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		if !s.answerZone(w, msg, domain, qtype) {
+			s.forwardRaw(w, msg, domain, qtype)
+		}
+		return
+	}
+	s.resolveAndReply(w, msg, domain, qtype, ident)
+}
+
+// safeSearch returns the safe-search endpoint for the client's query:
+// the client's configured profile when it names one, else the profile
+// its address falls under
+func (s *DNSServer) safeSearch(ident clients.Identity, domain string) (string, bool) {
+	if s.SafeSearch == nil {
+		return "", false
+	}
+	if profile, ok := s.SafeSearch.Named(ident.Profile); ok {
+		return profile.Rewrite(domain)
+	}
+	return s.SafeSearch.Rewrite(ident.Addr, domain)
+}
+
+// filterAAAA reports whether AAAA answers are suppressed for domain
+func (s *DNSServer) filterAAAA(domain string) bool {
+	return s.FilterAAAA || dnsmasq.MatchesRules(domain, s.FilterAAAADomains)
+}
+
+// answer is the answer to an A or AAAA query as resolveAndReply builds it
+type answer struct {
+	d *dnsmasq.Decision
+	// name is the name resolved: the domain or the target redirecting it
+	name string
+	// fixed is the pin or address rewrite answering the query, if any
+	fixed  *rewrite.Rule
+	pinned bool
+	// ip is the address the rules are matched against
+	ip  string
+	ips []string
+	// translated are the IPv4 addresses behind a NAT64 AAAA answer
+	translated []string
+	ttl        time.Duration
+	err        error
+}
 
+// resolveAndReply resolves domain, writes the answer and installs the route.
+// Domains SafeSearch or a rewrite rule redirects are answered with a CNAME
+// to the target and its address, and pins and address rewrites with the
+// fixed address; either way they are still routed by the original name.
+func (s *DNSServer) resolveAndReply(w dns.ResponseWriter, msg *dns.Msg, domain string, qtype uint16, ident clients.Identity) {
 	// 使用递归解析逻辑（带缓存）
-	shouldRoute, ip := dnsmasq.ResolveRecursive(domain, s.Rules, s.Cache)
+	sn := s.Current()
+	resolver := s.resolver(sn)
+	start := time.Now()
+	client, _ := netip.ParseAddrPort(w.RemoteAddr().String())
 
-	log.Printf("🔍 Domain: %s | IP: %s | VPN: %v", domain, ip, shouldRoute)
+	a := s.redirect(sn, domain, ident, start)
+	if a.fixed != nil {
+		s.answerFixed(a, domain, qtype)
+	} else {
+		a.d, a.err = resolver.Decide(a.name, qtype)
+		a.ips = a.d.IPs()
+		s.verifyAnswer(a, domain, qtype)
+		if qtype == dns.TypeAAAA && sn.NAT64.IsValid() {
+			a.translate(resolver, sn.NAT64)
+		}
+	}
 
-	if ip == "" {
-		utils.PrintError(domain, "failed to resolve")
-		_ = w.WriteMsg(msg)
+	// 校验和 NAT64 可能替换了答案；名称被改写时按原始域名判定规则
+	d := a.d
+	if len(d.Answers) > 0 {
+		a.ttl = d.Answers[0].TTL
+	}
+	d.Domain = domain
+	d.SetAnswers(a.ips, a.ttl)
+	if a.err == nil {
+		s.decide(sn, d, a.ip, client, start)
+	}
+	s.record(a, qtype, client, ident, start)
+
+	if a.err != nil {
+		s.writeError(w, msg, a, qtype)
 		return
 	}
+	faked := s.writeAnswer(w, msg, sn, a, qtype)
 
-	msg.Answer = append(msg.Answer, makeARecord(domain, ip))
+	if s.PrintQueries {
+		printDNSLog(domain, a.ip, d.Routes())
+	}
+
+	if d.Routes() {
+		s.Hooks.RuleMatch(hooks.RuleMatchEvent{Domain: domain, IP: a.ip, Action: d.Action})
+		if !faked {
+			s.route(d)
+		}
+	}
+}
+
+// redirect starts the answer to domain from the first of its pin, its
+// safe-search target and its rewrite rule that applies
+func (s *DNSServer) redirect(sn *Snapshot, domain string, ident clients.Identity, at time.Time) *answer {
+	a := &answer{name: domain}
+	if pin, ok := s.Pins.Lookup(domain, at); ok {
+		rw := pin.rule()
+		a.fixed, a.pinned = &rw, true
+	} else if target, ok := s.safeSearch(ident, domain); ok {
+		s.logf("🛡️ Safe search: %s ➜ %s", domain, target)
+		a.name = target
+	} else if rw, ok := sn.Rewrites.Lookup(domain); ok {
+		if rw.Target != "" {
+			s.logf("✏️ Rewrite: %s ➜ %s", domain, rw.Target)
+			a.name = rw.Target
+		} else {
+			a.fixed = &rw
+		}
+	}
+	return a
+}
+
+// answerFixed answers a with the address of its pin or address rewrite
+func (s *DNSServer) answerFixed(a *answer, domain string, qtype uint16) {
+	a.d = &dnsmasq.Decision{Domain: domain, Source: dnsmasq.SourceLocal}
+	a.ip, a.err = fixedAnswer(*a.fixed, qtype)
+	a.d.SetAnswers([]string{a.ip}, 0)
+	a.ips = a.d.IPs()
+	if a.err == nil && a.pinned {
+		s.logf("📍 Pinned: %s ➜ %s", domain, a.ip)
+	} else if a.err == nil {
+		s.logf("✏️ Rewrite: %s ➜ %s", domain, a.ip)
+	}
+}
+
+// verifyAnswer checks the resolved answer a against the verification
+// upstream and keeps only its address when it replaced the answer
+func (s *DNSServer) verifyAnswer(a *answer, domain string, qtype uint16) {
+	if a.err != nil {
+		return
+	}
+	a.ip, a.err = s.verify(domain, a.name, a.ips[0], qtype)
+	if a.ip != a.ips[0] {
+		// 校验上游替换了答案，只使用它给出的地址
+		a.ips = []string{a.ip}
+	}
+}
+
+// translate adjusts the AAAA answer a on a NAT64 network, matching the
+// rules against the IPv4 address behind it, per dns64
+func (a *answer) translate(resolver *dnsmasq.Resolver, prefix netip.Prefix) {
+	a.ips, a.translated, a.err = dns64(resolver, prefix, a.name, a.ips, a.err)
+	if len(a.translated) > 0 {
+		a.ip = a.translated[0]
+	}
+}
+
+// record reports the decided answer a to the recorder, the history, the
+// query log, the hooks, the metrics and the log
+func (s *DNSServer) record(a *answer, qtype uint16, client netip.AddrPort, ident clients.Identity, start time.Time) {
+	d := a.d
+	domain, shouldRoute, action := d.Domain, d.Routes(), d.Action
+	s.Recorder.Record(replay.Record{
+		Time: start, Domain: domain, CNAMEs: d.CNAMEs, IP: a.ip, Client: client, ClientName: ident.Name,
+		Route: shouldRoute, Rule: d.Rule.Suffix, Action: action, Err: errString(a.err),
+	})
+	s.History.Record(history.Entry{
+		Time: start, Domain: domain, Client: ident.String(), IP: a.ip,
+		Route: shouldRoute, Rule: d.Rule.Suffix, Action: action, Upstream: d.Upstream, Err: errString(a.err), Duration: time.Since(start),
+	})
+	s.QueryLog.Record(querylog.Entry{
+		Time: start, Client: ident.String(), Domain: domain, QType: dns.TypeToString[qtype], Answers: a.ips,
+		Rule: d.Rule.Suffix, Policy: d.Policy.String(), Action: action, Route: shouldRoute,
+		Upstream: d.Upstream, Source: d.Source.String(), Latency: time.Since(start), Err: errString(a.err),
+	})
+	s.Hooks.Resolve(hooks.ResolveEvent{Domain: domain, IP: a.ip, Matched: shouldRoute, Err: a.err, Duration: time.Since(start), Client: ident.String()})
+	s.Metrics.Observe(d, a.err)
+	switch d.Source {
+	case dnsmasq.SourceCache:
+		s.cacheHits.Add(1)
+	case dnsmasq.SourceUpstream:
+		s.cacheMisses.Add(1)
+	}
+
+	s.logf("[QUERY] 🔍 Domain: %s | IP: %s | VPN: %v | Client: %s", domain, strings.Join(a.ips, ", "), shouldRoute, ident)
+}
+
+// writeError answers the failed query a
+func (s *DNSServer) writeError(w dns.ResponseWriter, msg *dns.Msg, a *answer, qtype uint16) {
+	domain, err := a.d.Domain, a.err
+	if len(a.d.CNAMEs) > 0 {
+		s.logf("🔗 Partial chain for %s: %s", domain, strings.Join(a.d.CNAMEs, " ➜ "))
+	}
+	if s.PrintQueries {
+		utils.PrintError(domain, err.Error())
+	}
+	switch {
+	case errors.Is(err, dnsmasq.ErrRejected):
+		s.writeRejected(w, msg, domain, qtype)
+		return
+	case errors.Is(err, dnsmasq.ErrNXDomain):
+		msg.Rcode = dns.RcodeNameError
+	case errors.Is(err, dnsmasq.ErrNoAnswer):
+		// NOERROR with an empty answer section
+		if a.fixed != nil {
+			s.writeLocal(w, msg, domain)
+			return
+		}
+	default:
+		// ErrServFail, timeouts and broken chains: the name may well
+		// have records, so clients mustn't cache an empty answer
+		msg.Rcode = dns.RcodeServerFailure
+	}
 	_ = w.WriteMsg(msg)
+}
 
-	printDNSLog(domain, ip, shouldRoute)
+// writeAnswer writes the decided answer a, with a fake address where the
+// fake-ip pool applies, and reports whether it did so
+func (s *DNSServer) writeAnswer(w dns.ResponseWriter, msg *dns.Msg, sn *Snapshot, a *answer, qtype uint16) bool {
+	d, domain := a.d, a.d.Domain
+	switch {
+	case a.fixed == nil && len(a.translated) == 0 && s.fakes(d) && s.writeFake(w, msg, d, qtype):
+		return true
+	case d.Routes() && len(a.translated) > 0:
+		// 走 VPN 的域名不返回 NAT64 地址，客户端改用 A 记录经 VPN 访问
+		s.logf("🔀 NAT64: %s routes as %s", domain, strings.Join(a.translated, ", "))
+		d.SetAnswers(a.translated, a.ttl)
+		s.writeLocal(w, msg, domain)
+	case a.fixed != nil:
+		msg.Answer = append(msg.Answer, answerRecords(sn.Cache, domain, a.name, d.CNAMEs, a.ips, qtype)...)
+		s.writeLocal(w, msg, domain)
+	default:
+		msg.Answer = append(msg.Answer, answerRecords(sn.Cache, domain, a.name, d.CNAMEs, a.ips, qtype)...)
+		_ = w.WriteMsg(msg)
+	}
+	return false
+}
+
+// route runs the action of the routed answer d for each of its addresses
+func (s *DNSServer) route(d *dnsmasq.Decision) {
+	// 客户端可能选用答案中的任一地址，全部加路由以免绕过 VPN
+	for _, a := range d.Answers {
+		s.applyAction(d.Domain, a.IP, d.Action)
+	}
+}
+
+// decide matches the answer d, whose best address is ip, against the
+// overrides and the snapshot's rules, which also look at its CNAME chain
+// and the expressions, and records the verdict in d. A routed answer goes
+// DIRECT instead while the VPN is down, per fallBack.
+func (s *DNSServer) decide(sn *Snapshot, d *dnsmasq.Decision, ip string, client netip.AddrPort, at time.Time) {
+	domain, cnames := d.Domain, d.CNAMEs
+	if ov, ok := s.override(sn, domain, cnames, at); ok {
+		s.logf("📌 Override: %s ➜ %s", domain, ov.Egress)
+		d.Match(dnsmasq.Rule{Action: ov.Egress}, true)
+	} else {
+		routes, rule, err := sn.Decide(domain, cnames, ip, client, at)
+		if err != nil {
+			s.logf("⚠️ Expression rule failed for %s: %v", domain, err)
+		}
+		if routes && len(cnames) > 0 && rule.Suffix != "" && !rule.Type.IsIP() && !sn.Match(domain) {
+			s.logf("🔗 %s matched %s through its CNAME chain %s", domain, rule.Suffix, strings.Join(cnames, " ➜ "))
+		}
+		d.Match(rule, routes || rule.Suffix != "")
+		if d.Routes() {
+			s.State.Hit(rule.Suffix)
+		}
+	}
+	if d.Routes() && s.fallBack(domain, d.Action) {
+		s.logf("↩️ VPN down, %s goes DIRECT", domain)
+		d.Policy = dnsmasq.PolicyDirect
+	}
+}
+
+// override returns the runtime override for domain or, in CNAMEMatch
+// order, the names of its CNAME chain
+func (s *DNSServer) override(sn *Snapshot, domain string, cnames []string, at time.Time) (Override, bool) {
+	for _, name := range sn.CNAMEMatch.Names(domain, cnames) {
+		if ov, ok := s.Overrides.Lookup(name, at); ok {
+			return ov, true
+		}
+	}
+	return Override{}, false
+}
+
+// fixedAnswer returns the address an address rewrite answers qtype with
+func fixedAnswer(rw rewrite.Rule, qtype uint16) (string, error) {
+	addr := rw.IPv4
+	if qtype == dns.TypeAAAA {
+		addr = rw.IPv6
+	}
+	if !addr.IsValid() {
+		return "", dnsmasq.ErrNoAnswer
+	}
+	return addr.String(), nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// applyAction runs the matched rule's action, adding the VPN route by default
+func (s *DNSServer) applyAction(domain, ip, name string) {
+	if !actions.IsVPN(name) {
+		if action, ok := s.Actions[strings.ToUpper(name)]; ok {
+			req := actions.Request{Domain: domain, IP: ip, Action: name, VPNIface: s.VPNIface}
+			if err := action.Handle(req); err != nil {
+				s.logf("⚠️ Action %s failed for %s ➜ %s: %v", name, domain, ip, err)
+			}
+			return
+		}
+		s.logf("⚠️ Unknown action %s for %s, routing through VPN", name, domain)
+	}
 
 	// 添加静态路由（确保 VPN 拦截）
-	if shouldRoute {
-		if err := vpn.AddRoute(ip, s.VPNIface); err != nil {
-			log.Printf("⚠️ Failed to add route for %s ➜ %s: %v", ip, s.VPNIface, err)
-		} else {
-			log.Printf("✅ Route added: %s ➜ %s", ip, s.VPNIface)
+	err := s.Router.AddHostRoute(ip, s.VPNIface)
+	if err != nil {
+		s.logf("⚠️ Failed to add route for %s ➜ %s: %v", ip, s.VPNIface, err)
+	} else {
+		s.logf("✅ Route added: %s ➜ %s", ip, s.VPNIface)
+		s.State.AddRoute(Route{Domain: domain, IP: ip, Iface: s.VPNIface, Added: time.Now()})
+		s.markHost(domain, ip)
+	}
+	s.Hooks.RouteInjected(hooks.RouteEvent{Domain: domain, IP: ip, Iface: s.VPNIface, Err: err})
+	s.Metrics.RouteInstalled(err)
+}
+
+// markHost applies the QoS mark of domain's class to traffic to ip
+func (s *DNSServer) markHost(domain, ip string) {
+	mark, ok := qos.Classify(s.QoS, domain)
+	if !ok {
+		return
+	}
+	err := s.Router.MarkHost(ip, mark)
+	switch {
+	case errors.Is(err, vpn.ErrMarkUnsupported):
+		if !s.qosWarned.Swap(true) {
+			s.logf("⚠️ %v, QoS classes are ignored", err)
 		}
+	case err != nil:
+		s.logf("⚠️ Failed to mark %s ➜ %s: %v", domain, ip, err)
 	}
 }
 
@@ -119,18 +790,6 @@ func (s *DNSServer) forwardToFallback(domain string) (string, error) {
 	return "", nil
 }
 
-func makeARecord(domain, ip string) dns.RR {
-	return &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   dns.Fqdn(domain),
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    300,
-		},
-		A: net.ParseIP(ip),
-	}
-}
-
 func printDNSLog(domain, ip string, vpn bool) {
 	if ip == "" {
 		utils.PrintError(domain, "no A record")
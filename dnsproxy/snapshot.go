@@ -0,0 +1,183 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/exprrules"
+	"openvpnadvanced/rewrite"
+)
+
+// Snapshot is the rule and cache state queries are served with. A running
+// server holds it behind an atomic pointer and replaces it wholesale
+// (copy-on-write), so a reload never blocks in-flight queries or the
+// listener; each query finishes with the snapshot it started with.
+type Snapshot struct {
+	Rules []dnsmasq.Rule
+	// Matcher, when set, is used instead of Rules
+	Matcher dnsmasq.RuleMatcher
+	// Exprs are expression rules evaluated when no static rule matches
+	Exprs *exprrules.Set
+	// Rewrites override answers for selected names
+	Rewrites *rewrite.Set
+	Cache    dnsmasq.CacheBackend
+	// Upstream answers the resolver's queries; doh.Endpoint when nil
+	Upstream dnsmasq.Upstream
+	// Direct resolves domains that don't match the static rules; Upstream
+	// when nil
+	Direct *doh.Upstream
+	// CNAMEMatch decides which names of an answer's CNAME chain the
+	// static rules are matched against
+	CNAMEMatch CNAMEMatch
+	// MaxCNAMEDepth and PartialChain configure the resolver (see
+	// dnsmasq.Resolver)
+	MaxCNAMEDepth int
+	PartialChain  bool
+	// GeoIP locates answers for GEOIP rules
+	GeoIP dnsmasq.CountryLookup
+	// MinTTL and MaxTTL clamp the record TTLs answers are cached for
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Negative remembers failed resolutions for a short while
+	Negative *dnsmasq.NegativeCache
+	// Sorter orders the addresses of answers holding several
+	Sorter dnsmasq.AddrSorter
+	// Timeout bounds each resolution as a whole (see dnsmasq.Resolver)
+	Timeout time.Duration
+	// Prefer orders the addresses of both families (see dnsmasq.Resolver)
+	Prefer dnsmasq.Family
+	// NAT64 is the prefix of the network's NAT64 gateway; AAAA answers
+	// are synthesized and translated through it when valid
+	NAT64 netip.Prefix
+}
+
+// Match reports whether domain matches the static rules
+func (sn *Snapshot) Match(domain string) bool {
+	if sn.Matcher != nil {
+		return sn.Matcher.Match(domain)
+	}
+	return dnsmasq.MatchesRules(domain, sn.Rules)
+}
+
+// Routes reports whether the static rule matching domain routes its
+// answer, i.e. one matches and its policy isn't DIRECT or REJECT
+func (sn *Snapshot) Routes(domain string) bool {
+	rule, ok := sn.MatchedRule(domain)
+	return ok && Routes(rule)
+}
+
+// RuleAction returns the action of the static rule matching domain
+func (sn *Snapshot) RuleAction(domain string) string {
+	if sn.Matcher != nil {
+		if m, ok := sn.Matcher.(dnsmasq.ActionMatcher); ok {
+			action, _ := m.MatchAction(domain)
+			return action
+		}
+		return ""
+	}
+	rule, _ := dnsmasq.MatchRule(domain, sn.Rules)
+	return rule.Action
+}
+
+// MatchedRule returns the static rule matching domain. Matchers that can't
+// name the rule report the domain itself as the suffix.
+func (sn *Snapshot) MatchedRule(domain string) (dnsmasq.Rule, bool) {
+	switch m := sn.Matcher.(type) {
+	case nil:
+		return dnsmasq.MatchRule(domain, sn.Rules)
+	case dnsmasq.RuleFinder:
+		return m.MatchRule(domain)
+	case dnsmasq.ActionMatcher:
+		action, ok := m.MatchAction(domain)
+		return dnsmasq.Rule{Suffix: domain, Action: action}, ok
+	default:
+		return dnsmasq.Rule{Suffix: domain}, m.Match(domain)
+	}
+}
+
+// MatchedIP returns the IP-CIDR or GEOIP rule matching the resolved
+// address ip
+func (sn *Snapshot) MatchedIP(ip string) (dnsmasq.Rule, bool) {
+	switch m := sn.Matcher.(type) {
+	case nil:
+		return dnsmasq.MatchIPRule(ip, sn.Rules, sn.GeoIP)
+	case dnsmasq.IPMatcher:
+		return m.MatchIP(ip, sn.GeoIP)
+	default:
+		return dnsmasq.Rule{}, false
+	}
+}
+
+// Decide computes the routing decision for a resolved answer: the static
+// rules first, against domain and the CNAMEs of its answer as CNAMEMatch
+// orders them, then the IP-CIDR and GEOIP rules against ip, then the
+// expression rules evaluated against ip, client and
+// at (qtype is AAAA for IPv6 addresses). The returned rule carries the
+// action; its Suffix is empty when an expression matched. Decide depends
+// only on its arguments and the snapshot, so recorded queries can be
+// replayed against other rules.
+func (sn *Snapshot) Decide(domain string, cnames []string, ip string, client netip.AddrPort, at time.Time) (bool, dnsmasq.Rule, error) {
+	for _, name := range sn.CNAMEMatch.Names(domain, cnames) {
+		if rule, ok := sn.MatchedRule(name); ok {
+			return Routes(rule), rule, nil
+		}
+	}
+	if rule, ok := sn.MatchedIP(ip); ok {
+		return Routes(rule), rule, nil
+	}
+	if sn.Exprs.Len() == 0 {
+		return false, dnsmasq.Rule{}, nil
+	}
+
+	var clientIP string
+	if client.IsValid() {
+		clientIP = client.Addr().Unmap().String()
+	}
+	qtype := "A"
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() {
+		qtype = "AAAA"
+	}
+	env := exprrules.NewEnv(domain, ip, clientIP, int(client.Port()), qtype, at)
+	matched, action, err := sn.Exprs.Eval(env)
+	return matched, dnsmasq.Rule{Action: action}, err
+}
+
+// Routes reports whether a matched rule routes its answer, i.e. its
+// action isn't DIRECT or REJECT
+func Routes(rule dnsmasq.Rule) bool {
+	return rule.Policy().Routes()
+}
+
+// Resolver returns a resolver over the snapshot's rules and cache
+func (sn *Snapshot) Resolver(logger dnsmasq.Logger) *dnsmasq.Resolver {
+	r := &dnsmasq.Resolver{
+		Rules: sn.Rules, Matcher: sn.Matcher, Cache: sn.Cache, Upstream: sn.Upstream, Logger: logger,
+		MaxDepth: sn.MaxCNAMEDepth, PartialChain: sn.PartialChain, GeoIP: sn.GeoIP,
+		MinTTL: sn.MinTTL, MaxTTL: sn.MaxTTL, Negative: sn.Negative,
+		Sorter: sn.Sorter, Timeout: sn.Timeout, Prefer: sn.Prefer,
+	}
+	// nil 指针不能放进接口，否则 Resolver 会把它当作已设置
+	if sn.Direct != nil {
+		r.Direct = sn.Direct
+	}
+	return r
+}
+
+// Current returns the snapshot queries are being served with. Before
+// Start it reflects the server's Rules, Matcher, Exprs, Rewrites and Cache
+// fields.
+func (s *DNSServer) Current() *Snapshot {
+	if sn := s.snapshot.Load(); sn != nil {
+		return sn
+	}
+	return &Snapshot{Rules: s.Rules, Matcher: s.Matcher, Exprs: s.Exprs, Rewrites: s.Rewrites, Cache: s.Cache}
+}
+
+// Swap atomically replaces the rules and cache used for new queries.
+// Queries already resolving keep the previous snapshot; nothing is
+// stopped or rebound.
+func (s *DNSServer) Swap(next *Snapshot) {
+	s.snapshot.Store(next)
+}
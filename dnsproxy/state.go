@@ -0,0 +1,143 @@
+package dnsproxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Route is a route the server installed for a matched domain
+type Route struct {
+	Domain string    `json:"domain"`
+	IP     string    `json:"ip"`
+	Iface  string    `json:"iface"`
+	Added  time.Time `json:"added"`
+}
+
+// State is the runtime state accumulated while serving: the routes
+// installed through the VPN, how often each static rule matched and how
+// many queries each client sent. It
+// outlives a single DNSServer so it can be carried across restarts.
+// Methods are safe on a nil *State, which records nothing.
+type State struct {
+	mu      sync.Mutex
+	routes  map[string]Route
+	hits    map[string]uint64
+	clients map[string]uint64
+}
+
+// NewState returns an empty State
+func NewState() *State {
+	return &State{
+		routes:  make(map[string]Route),
+		hits:    make(map[string]uint64),
+		clients: make(map[string]uint64),
+	}
+}
+
+// AddRoute records an installed route, replacing any earlier one for r.IP
+func (st *State) AddRoute(r Route) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.routes[r.IP] = r
+}
+
+// RemoveRoute forgets the route recorded for ip
+func (st *State) RemoveRoute(ip string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.routes, ip)
+}
+
+// Routes returns the recorded routes, oldest first
+func (st *State) Routes() []Route {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	routes := make([]Route, 0, len(st.routes))
+	for _, r := range st.routes {
+		routes = append(routes, r)
+	}
+	st.mu.Unlock()
+
+	sort.Slice(routes, func(i, j int) bool {
+		if !routes[i].Added.Equal(routes[j].Added) {
+			return routes[i].Added.Before(routes[j].Added)
+		}
+		return routes[i].IP < routes[j].IP
+	})
+	return routes
+}
+
+// Hit counts a match of the rule with the given suffix
+func (st *State) Hit(suffix string) {
+	if st == nil || suffix == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.hits[suffix]++
+}
+
+// Hits returns a copy of the rule hit counters keyed by rule suffix
+func (st *State) Hits() map[string]uint64 {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	hits := make(map[string]uint64, len(st.hits))
+	for k, v := range st.hits {
+		hits[k] = v
+	}
+	return hits
+}
+
+// Queried counts a query from the named client
+func (st *State) Queried(client string) {
+	if st == nil || client == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.clients[client]++
+}
+
+// ClientQueries returns a copy of the per-client query counters, keyed by
+// client name or address
+func (st *State) ClientQueries() map[string]uint64 {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	counts := make(map[string]uint64, len(st.clients))
+	for k, v := range st.clients {
+		counts[k] = v
+	}
+	return counts
+}
+
+// Restore merges previously saved routes and hit counters into st
+func (st *State) Restore(routes []Route, hits map[string]uint64) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, r := range routes {
+		if _, ok := st.routes[r.IP]; !ok {
+			st.routes[r.IP] = r
+		}
+	}
+	for k, v := range hits {
+		st.hits[k] += v
+	}
+}
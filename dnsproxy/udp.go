@@ -0,0 +1,278 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Defaults for the UDP listener
+const (
+	DefaultUDPWorkers = 256
+	DefaultUDPQueue   = 1024
+	// udpBufSize fits any query; clients advertise larger EDNS0 sizes for
+	// answers, not questions
+	udpBufSize = 4096
+	// overloadWarnEvery throttles the warning about dropped queries
+	overloadWarnEvery = 10 * time.Second
+)
+
+// UDPOptions tune the UDP listener
+type UDPOptions struct {
+	// Readers is the number of goroutines reading the socket
+	// (runtime.NumCPU when 0)
+	Readers int
+	// Workers is the number of queries handled at once, each until its
+	// answer is written (DefaultUDPWorkers when 0)
+	Workers int
+	// Queue bounds the queries read and waiting for a worker; queries
+	// beyond it are dropped and counted (DefaultUDPQueue when 0)
+	Queue int
+	// ReadBuffer and WriteBuffer set the socket buffer sizes in bytes;
+	// the system's defaults when 0. A larger read buffer absorbs bursts
+	// the readers can't drain at once.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// UDPStats counts what became of the datagrams of the UDP listener
+type UDPStats struct {
+	Received uint64
+	// Dropped counts queries dropped because the queue was full
+	Dropped uint64
+	// Malformed counts datagrams that weren't a DNS query
+	Malformed uint64
+	// KernelDrops counts datagrams the kernel dropped because the socket
+	// read buffer was full; KernelKnown is false where they can't be
+	// read (outside Linux)
+	KernelDrops uint64
+	KernelKnown bool
+	// ReadBuffer is the socket read buffer size, when known
+	ReadBuffer int
+	Queued     int
+	Queue      int
+	Workers    int
+}
+
+// udpServer serves DNS over a packet socket with a fixed number of
+// readers and workers, so a burst queues up to a bound and the excess is
+// counted instead of spawning a goroutine per datagram
+type udpServer struct {
+	conn    net.PacketConn
+	handler dns.Handler
+	opts    UDPOptions
+	logf    func(format string, args ...any)
+	// onDrop, when set, is told about every dropped datagram
+	onDrop func(reason string)
+
+	queue    chan udpPacket
+	bufs     sync.Pool
+	readers  sync.WaitGroup
+	workers  sync.WaitGroup
+	closing  atomic.Bool
+	lastWarn atomic.Int64
+
+	received  atomic.Uint64
+	dropped   atomic.Uint64
+	malformed atomic.Uint64
+}
+
+type udpPacket struct {
+	buf     *[]byte
+	n       int
+	session *dns.SessionUDP
+	addr    net.Addr
+}
+
+func newUDPServer(conn net.PacketConn, handler dns.Handler, opts UDPOptions) *udpServer {
+	if opts.Readers <= 0 {
+		opts.Readers = runtime.NumCPU()
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultUDPWorkers
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultUDPQueue
+	}
+	u := &udpServer{conn: conn, handler: handler, opts: opts, queue: make(chan udpPacket, opts.Queue)}
+	u.bufs.New = func() any {
+		b := make([]byte, udpBufSize)
+		return &b
+	}
+	return u
+}
+
+// start tunes the socket and starts the readers and workers
+func (u *udpServer) start() {
+	if c, ok := u.conn.(interface{ SetReadBuffer(int) error }); ok && u.opts.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(u.opts.ReadBuffer); err != nil {
+			u.logf("⚠️ Failed to set the UDP read buffer to %d bytes: %v", u.opts.ReadBuffer, err)
+		}
+	}
+	if c, ok := u.conn.(interface{ SetWriteBuffer(int) error }); ok && u.opts.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(u.opts.WriteBuffer); err != nil {
+			u.logf("⚠️ Failed to set the UDP write buffer to %d bytes: %v", u.opts.WriteBuffer, err)
+		}
+	}
+	if udp, ok := u.conn.(*net.UDPConn); ok {
+		// 记录目的地址，回复从查询到达的地址发出（监听 :53 时）
+		err6 := ipv6.NewPacketConn(udp).SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+		err4 := ipv4.NewPacketConn(udp).SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+		if err4 != nil && err6 != nil {
+			u.logf("⚠️ Replies may come from another address than queries went to: %v", err4)
+		}
+	}
+	u.workers.Add(u.opts.Workers)
+	for range u.opts.Workers {
+		go u.work()
+	}
+	u.readers.Add(u.opts.Readers)
+	for range u.opts.Readers {
+		go u.read()
+	}
+}
+
+func (u *udpServer) read() {
+	defer u.readers.Done()
+	udp, _ := u.conn.(*net.UDPConn)
+	for {
+		buf := u.bufs.Get().(*[]byte)
+		p := udpPacket{buf: buf}
+		var err error
+		if udp != nil {
+			p.n, p.session, err = dns.ReadFromSessionUDP(udp, *buf)
+		} else {
+			p.n, p.addr, err = u.conn.ReadFrom(*buf)
+		}
+		if err != nil {
+			u.bufs.Put(buf)
+			if u.closing.Load() {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 单个数据报的错误（如 ICMP 不可达）不影响其他读取
+			continue
+		}
+		u.received.Add(1)
+		if p.n < 12 {
+			u.bufs.Put(buf)
+			u.drop(&u.malformed, "malformed")
+			continue
+		}
+		select {
+		case u.queue <- p:
+		default:
+			u.bufs.Put(buf)
+			u.drop(&u.dropped, "queue_full")
+			u.warnOverload()
+		}
+	}
+}
+
+func (u *udpServer) work() {
+	defer u.workers.Done()
+	for p := range u.queue {
+		req := new(dns.Msg)
+		err := req.Unpack((*p.buf)[:p.n])
+		u.bufs.Put(p.buf)
+		if err != nil || req.Response {
+			u.drop(&u.malformed, "malformed")
+			continue
+		}
+		u.handler.ServeDNS(&udpWriter{conn: u.conn, session: p.session, addr: p.addr}, req)
+	}
+}
+
+func (u *udpServer) drop(counter *atomic.Uint64, reason string) {
+	counter.Add(1)
+	if u.onDrop != nil {
+		u.onDrop(reason)
+	}
+}
+
+// warnOverload logs dropped queries at most every overloadWarnEvery
+func (u *udpServer) warnOverload() {
+	now := time.Now().UnixNano()
+	last := u.lastWarn.Load()
+	if now-last < int64(overloadWarnEvery) || !u.lastWarn.CompareAndSwap(last, now) {
+		return
+	}
+	u.logf("⚠️ UDP listener overloaded: %d queries dropped so far (queue of %d full)", u.dropped.Load(), u.opts.Queue)
+}
+
+// shutdown stops reading, lets the workers answer the queued queries and
+// closes the socket
+func (u *udpServer) shutdown() error {
+	u.closing.Store(true)
+	// 让阻塞的读取立即返回
+	_ = u.conn.SetReadDeadline(time.Unix(1, 0))
+	u.readers.Wait()
+	close(u.queue)
+	u.workers.Wait()
+	return u.conn.Close()
+}
+
+func (u *udpServer) stats() UDPStats {
+	st := UDPStats{
+		Received:  u.received.Load(),
+		Dropped:   u.dropped.Load(),
+		Malformed: u.malformed.Load(),
+		Queued:    len(u.queue),
+		Queue:     u.opts.Queue,
+		Workers:   u.opts.Workers,
+	}
+	st.ReadBuffer, st.KernelDrops, st.KernelKnown = socketStats(u.conn)
+	return st
+}
+
+// udpWriter answers one query of a udpServer
+type udpWriter struct {
+	conn    net.PacketConn
+	session *dns.SessionUDP
+	addr    net.Addr
+}
+
+func (w *udpWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *udpWriter) RemoteAddr() net.Addr {
+	if w.session != nil {
+		return w.session.RemoteAddr()
+	}
+	return w.addr
+}
+
+func (w *udpWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *udpWriter) Write(b []byte) (int, error) {
+	if w.session != nil {
+		return dns.WriteToSessionUDP(w.conn.(*net.UDPConn), b, w.session)
+	}
+	return w.conn.WriteTo(b, w.addr)
+}
+
+func (w *udpWriter) Close() error        { return nil }
+func (w *udpWriter) TsigStatus() error   { return nil }
+func (w *udpWriter) TsigTimersOnly(bool) {}
+func (w *udpWriter) Hijack()             {}
@@ -0,0 +1,64 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketStats returns the read buffer size of conn and the datagrams the
+// kernel dropped on it, which /proc/net/udp{,6} count per socket inode
+func socketStats(conn net.PacketConn) (readBuffer int, drops uint64, known bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var inode string
+	raw.Control(func(fd uintptr) {
+		// 内核报告的是实际分配的大小（通常为设置值的两倍）
+		readBuffer, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		if err == nil {
+			inode = strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		}
+	})
+	if inode == "" {
+		return readBuffer, 0, false
+	}
+	for _, table := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		if drops, ok := udpDrops(table, inode); ok {
+			return readBuffer, drops, true
+		}
+	}
+	return readBuffer, 0, false
+}
+
+// udpDrops finds the socket with inode in a /proc/net/udp table and
+// returns its drops column
+func udpDrops(table, inode string) (uint64, bool) {
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头
+	for sc.Scan() {
+		// sl local rem st tx:rx tr:when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[12], 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dnsproxy
+
+import "net"
+
+// socketStats returns nothing: kernel drop counters are only read on Linux
+func socketStats(conn net.PacketConn) (readBuffer int, drops uint64, known bool) {
+	return 0, 0, false
+}
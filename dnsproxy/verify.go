@@ -0,0 +1,153 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// VerifyPolicy decides what happens when the verification upstream
+// disagrees with the answer for a verified domain
+type VerifyPolicy int
+
+const (
+	// VerifyFallback answers with the verification upstream's address
+	VerifyFallback VerifyPolicy = iota
+	// VerifyWarn only logs the mismatch and keeps the answer
+	VerifyWarn
+	// VerifyRefuse answers SERVFAIL
+	VerifyRefuse
+)
+
+// ParseVerifyPolicy parses "fallback", "warn" or "refuse"
+func ParseVerifyPolicy(s string) (VerifyPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "fallback":
+		return VerifyFallback, nil
+	case "warn":
+		return VerifyWarn, nil
+	case "refuse":
+		return VerifyRefuse, nil
+	}
+	return 0, fmt.Errorf("unknown verify policy %q (want fallback, warn or refuse)", s)
+}
+
+func (p VerifyPolicy) String() string {
+	switch p {
+	case VerifyWarn:
+		return "warn"
+	case VerifyRefuse:
+		return "refuse"
+	default:
+		return "fallback"
+	}
+}
+
+// verifyTrust is how long an answer that passed verification is trusted
+// before it's checked again
+const verifyTrust = 5 * time.Minute
+
+// errVerifyMismatch fails a query refused by VerifyRefuse
+var errVerifyMismatch = errors.New("answer disagrees with the verification upstream")
+
+// VerifyMismatches returns how many answers disagreed with the
+// verification upstream
+func (s *DNSServer) VerifyMismatches() uint64 {
+	return s.mismatches.Load()
+}
+
+// verify cross-checks ip, the answer for name, against VerifyUpstream when
+// domain is listed in VerifyDomains, and returns the address to answer
+// with. Answers agree when they share an address or, as CDNs hand out
+// different edges per resolver, a /16 (IPv4) or /32 (IPv6) network; a name
+// the verification upstream calls nonexistent disagrees with any answer.
+// Failed verification queries keep the answer.
+func (s *DNSServer) verify(domain, name, ip string, qtype uint16) (string, error) {
+	if s.VerifyUpstream == nil || !dnsmasq.MatchesRules(domain, s.VerifyDomains) {
+		return ip, nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip, nil
+	}
+	key := name + "|" + ip
+	s.verifyMu.Lock()
+	until, ok := s.verified[key]
+	s.verifyMu.Unlock()
+	if ok && time.Now().Before(until) {
+		return ip, nil
+	}
+
+	msg, err := s.VerifyUpstream.Exchange(name, qtype)
+	var others []netip.Addr
+	switch {
+	case errors.Is(err, doh.ErrNXDomain):
+	case err != nil:
+		s.logf("⚠️ Could not verify %s: %v", domain, err)
+		return ip, nil
+	default:
+		others = answerAddrs(msg, qtype)
+	}
+	if answersAgree(addr.Unmap(), others) {
+		s.verifyMu.Lock()
+		if s.verified == nil {
+			s.verified = make(map[string]time.Time)
+		}
+		s.verified[key] = time.Now().Add(verifyTrust)
+		s.verifyMu.Unlock()
+		return ip, nil
+	}
+
+	s.mismatches.Add(1)
+	s.logf("🚨 Upstreams disagree on %s: %s vs %v (verify-policy %s)", domain, ip, others, s.Verify)
+	switch {
+	case s.Verify == VerifyRefuse:
+		return "", fmt.Errorf("%s: %w", domain, errVerifyMismatch)
+	case s.Verify == VerifyFallback && len(others) > 0:
+		fixed := others[0].String()
+		if qtype == dns.TypeA {
+			// 用校验上游的结果覆盖缓存，避免后续命中被污染的地址
+			s.Current().Cache.Set(name, fixed)
+		}
+		return fixed, nil
+	case s.Verify == VerifyFallback:
+		return "", fmt.Errorf("%s: %w", domain, dnsmasq.ErrNXDomain)
+	}
+	return ip, nil
+}
+
+// answerAddrs returns the addresses of qtype in msg
+func answerAddrs(msg *dns.Msg, qtype uint16) []netip.Addr {
+	var addrs []netip.Addr
+	for _, answer := range doh.ParseAnswers(msg) {
+		if uint16(answer.Type) != qtype {
+			continue
+		}
+		if addr, err := netip.ParseAddr(answer.Data); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// answersAgree reports whether addr is in others or shares its network
+func answersAgree(addr netip.Addr, others []netip.Addr) bool {
+	bits := 16
+	if addr.Is6() {
+		bits = 32
+	}
+	network, _ := addr.Prefix(bits)
+	for _, other := range others {
+		if other == addr || network.Contains(other) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// WarmUp resolves domain as if a client had asked for it, filling the
+// cache and running the action of a matched answer for each of its
+// addresses (installing their VPN routes by default). It reports whether the answer matched.
+func (s *DNSServer) WarmUp(domain string) (bool, error) {
+	sn := s.Current()
+	d, err := s.resolver(sn).Decide(domain, dns.TypeA)
+	if err != nil {
+		return false, err
+	}
+	matched, rule, err := sn.Decide(domain, d.CNAMEs, d.IP(), netip.AddrPort{}, time.Now())
+	if err != nil || !matched {
+		return false, err
+	}
+	d.Match(rule, true)
+	s.State.Hit(rule.Suffix)
+	if !s.fallBack(domain, d.Action) {
+		s.route(d)
+	}
+	return true, nil
+}
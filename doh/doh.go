@@ -1,14 +1,23 @@
 package doh
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
-// DoHAnswer represents a DNS answer
+// DoHAnswer is a simplified view of an answer record
 type DoHAnswer struct {
 	Name string `json:"name"`
 	Type int    `json:"type"`
@@ -16,11 +25,94 @@ type DoHAnswer struct {
 	Data string `json:"data"`
 }
 
-// DoHResponse represents a DNS response
+// Answer is an upstream's response to one query
+type Answer struct {
+	// Msg is the response message. Fake upstreams that only answer
+	// address queries may leave it nil.
+	Msg *dns.Msg
+	// Records is the answer section of Msg (see ParseAnswers)
+	Records []DoHAnswer
+}
+
+// Addrs returns every address of type t (TypeA or TypeAAAA) in the
+// answer, in the upstream's order, with the TTL of the first
+func (a Answer) Addrs(t int) ([]string, time.Duration, error) {
+	var ips []string
+	var ttl time.Duration
+	for _, rec := range a.Records {
+		if rec.Type != t {
+			continue
+		}
+		if len(ips) == 0 {
+			ttl = ttlOf(rec)
+		}
+		ips = append(ips, rec.Data)
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no %s record found", dnsTypeToString(t))
+	}
+	return ips, ttl, nil
+}
+
+// AddrsOrCNAME returns the A records of the answer, or the CNAME leading
+// to them when none precedes it, with the TTL of the record found
+func (a Answer) AddrsOrCNAME() (ips []string, cname string, ttl time.Duration, err error) {
+	for _, answer := range a.Records {
+		switch answer.Type {
+		case TypeA:
+			if len(ips) == 0 {
+				ttl = ttlOf(answer)
+			}
+			ips = append(ips, answer.Data)
+		case TypeCNAME:
+			if len(ips) == 0 {
+				return nil, strings.TrimSuffix(answer.Data, "."), ttlOf(answer), nil
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, "", ttl, nil
+	}
+	return nil, "", 0, fmt.Errorf("no A record or CNAME found")
+}
+
+// DoHResponse is a simplified view of a DNS response
 type DoHResponse struct {
+	Status int         `json:"Status"`
 	Answer []DoHAnswer `json:"Answer"`
 }
 
+// Response codes carried in DoHResponse.Status
+const (
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+)
+
+var (
+	// ErrNXDomain is returned when the upstream reports the name doesn't exist
+	ErrNXDomain = errors.New("NXDOMAIN")
+	// ErrServFail is returned when the upstream failed to resolve the name
+	ErrServFail = errors.New("SERVFAIL")
+	// ErrUpstreamTimeout is returned when the upstream didn't answer in time
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+	// ErrMalformed is returned for responses that can't be parsed or don't
+	// answer the query
+	ErrMalformed = errors.New("malformed DNS response")
+)
+
+// queryTimeout bounds each upstream query
+const queryTimeout = 5 * time.Second
+
+// newTransport returns an HTTP transport whose sockets go through
+// dialControl
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, ControlContext: dialControl}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
 // DNS record types (https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml)
 const (
 	TypeA     = 1
@@ -49,6 +141,35 @@ func QueryAAAA(domain string) (string, error) {
 	return querySingleType(domain, TypeAAAA)
 }
 
+// QueryAAAA returns the first AAAA record (IPv6) from u
+func (u *Upstream) QueryAAAA(domain string) (string, error) {
+	return u.querySingleType(domain, TypeAAAA)
+}
+
+// QueryAAAATTL is QueryAAAA also returning the record's TTL
+func (u *Upstream) QueryAAAATTL(domain string) (string, time.Duration, error) {
+	ips, ttl, err := u.QueryAddrs(domain, TypeAAAA)
+	if err != nil {
+		return "", 0, err
+	}
+	return ips[0], ttl, nil
+}
+
+// QueryAddrs returns every address of type t (TypeA or TypeAAAA) in the
+// answer, in the upstream's order, with the TTL of the first
+func (u *Upstream) QueryAddrs(domain string, t int) ([]string, time.Duration, error) {
+	return u.QueryAddrsContext(context.Background(), domain, t)
+}
+
+// QueryAddrsContext is QueryAddrs giving up when ctx is done
+func (u *Upstream) QueryAddrsContext(ctx context.Context, domain string, t int) ([]string, time.Duration, error) {
+	answer, err := u.Query(ctx, domain, uint16(t))
+	if err != nil {
+		return nil, 0, err
+	}
+	return answer.Addrs(t)
+}
+
 // QueryTXT returns the first TXT record
 func QueryTXT(domain string) (string, error) {
 	return querySingleType(domain, TypeTXT)
@@ -71,11 +192,25 @@ func QueryCNAME(domain string) (string, error) {
 
 // QueryAll returns all records of all known types for a domain
 func QueryAll(domain string) (map[string][]string, error) {
+	return (*Upstream)(nil).QueryAll(domain)
+}
+
+// QueryAll returns all records of all known types for a domain from u
+func (u *Upstream) QueryAll(domain string) (map[string][]string, error) {
+	return u.QueryAllContext(context.Background(), domain)
+}
+
+// QueryAllContext is QueryAll giving up on the remaining types when ctx
+// is done
+func (u *Upstream) QueryAllContext(ctx context.Context, domain string) (map[string][]string, error) {
 	types := []int{TypeA, TypeAAAA, TypeCNAME, TypeMX, TypeTXT, TypeNS, TypeSOA, TypePTR, TypeSRV}
 	results := make(map[string][]string)
 
 	for _, t := range types {
-		records, err := queryRaw(domain, t)
+		if ctx.Err() != nil {
+			break
+		}
+		records, err := u.queryRaw(ctx, domain, t)
 		if err == nil && len(records) > 0 {
 			typeStr := dnsTypeToString(t)
 			for _, rec := range records {
@@ -89,76 +224,352 @@ func QueryAll(domain string) (map[string][]string, error) {
 
 // QueryWithCNAME returns IP or next CNAME if found (for routing fallback)
 func QueryWithCNAME(domain string) (ip string, cname string, err error) {
-	url := fmt.Sprintf("https://cloudflare-dns.com/dns-query?name=%s&type=A", domain)
+	return (*Upstream)(nil).QueryWithCNAME(domain)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", "", err
+// QueryWithCNAME returns IP or next CNAME from u
+func (u *Upstream) QueryWithCNAME(domain string) (ip string, cname string, err error) {
+	ip, cname, _, err = u.QueryWithCNAMETTL(domain)
+	return ip, cname, err
+}
+
+// QueryWithCNAMETTL is QueryWithCNAME also returning the TTL of the
+// record found
+func (u *Upstream) QueryWithCNAMETTL(domain string) (ip string, cname string, ttl time.Duration, err error) {
+	ips, cname, ttl, err := u.QueryAddrsOrCNAME(domain)
+	if len(ips) > 0 {
+		ip = ips[0]
 	}
-	req.Header.Set("Accept", "application/dns-json")
+	return ip, cname, ttl, err
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// QueryAddrsOrCNAME is like QueryWithCNAMETTL but returns every A record
+// of the answer, in the upstream's order
+func (u *Upstream) QueryAddrsOrCNAME(domain string) (ips []string, cname string, ttl time.Duration, err error) {
+	return u.QueryAddrsOrCNAMEContext(context.Background(), domain)
+}
+
+// QueryAddrsOrCNAMEContext is QueryAddrsOrCNAME giving up when ctx is done
+func (u *Upstream) QueryAddrsOrCNAMEContext(ctx context.Context, domain string) (ips []string, cname string, ttl time.Duration, err error) {
+	answer, err := u.Query(ctx, domain, TypeA)
 	if err != nil {
-		return "", "", err
+		return nil, "", 0, err
 	}
-	defer resp.Body.Close()
+	return answer.AddrsOrCNAME()
+}
 
-	body, _ := io.ReadAll(resp.Body)
+// ttlOf returns the TTL of an answer
+func ttlOf(answer DoHAnswer) time.Duration {
+	return time.Duration(max(answer.TTL, 0)) * time.Second
+}
 
-	var dohRes DoHResponse
-	err = json.Unmarshal(body, &dohRes)
+// querySingleType fetches the first answer of a given DNS type
+func querySingleType(domain string, t int) (string, error) {
+	return (*Upstream)(nil).querySingleType(domain, t)
+}
+
+func (u *Upstream) querySingleType(domain string, t int) (string, error) {
+	records, err := u.queryRaw(context.Background(), domain, t)
 	if err != nil {
-		return "", "", err
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no %s record found", dnsTypeToString(t))
 	}
+	return records[0].Data, nil
+}
 
+// queryRaw returns all answers of the specified type
+func (u *Upstream) queryRaw(ctx context.Context, domain string, t int) ([]DoHAnswer, error) {
+	dohRes, err := u.fetch(ctx, domain, t)
+	if err != nil {
+		return nil, err
+	}
+	// 响应中可能带有 CNAME 链，只保留请求的类型
+	var answers []DoHAnswer
 	for _, answer := range dohRes.Answer {
-		switch answer.Type {
-		case TypeA:
-			return answer.Data, "", nil
-		case TypeCNAME:
-			return "", strings.TrimSuffix(answer.Data, "."), nil
+		if answer.Type == t {
+			answers = append(answers, answer)
 		}
 	}
+	return answers, nil
+}
+
+// Endpoint is the default RFC 8484 DoH endpoint queried by this package
+const Endpoint = "https://cloudflare-dns.com/dns-query"
 
-	return "", "", fmt.Errorf("no A record or CNAME found")
+// dialControl is the net.Dialer ControlContext of upstream sockets,
+// applying the Control of the Settings carried by ctx
+func dialControl(ctx context.Context, network, address string, c syscall.RawConn) error {
+	control := settingsFrom(ctx).Control
+	if control == nil {
+		return nil
+	}
+	return control(network, address, c)
 }
 
-// querySingleType fetches the first answer of a given DNS type
-func querySingleType(domain string, t int) (string, error) {
-	records, err := queryRaw(domain, t)
-	if err != nil || len(records) == 0 {
-		return "", fmt.Errorf("no %s record found", dnsTypeToString(t))
+// Upstream is a DNS server queried explicitly (e.g. the network's
+// designated resolver, see package ddr). A nil *Upstream queries Endpoint
+// with the default settings.
+type Upstream struct {
+	// Name labels the upstream in logs and status output; URL when empty
+	Name string
+	// URL is the RFC 8484 endpoint
+	URL string
+	// Client sends the queries; the client of Settings when nil
+	Client *http.Client
+	// Transport, when set, carries the queries instead of HTTPS (e.g.
+	// DNSCrypt); URL and Client are then ignored
+	Transport Transport
+	// Endpoints, set by UseBootstrap, are the rotating addresses Client
+	// dials; answers and failures of each are recorded in it
+	Endpoints *Endpoints
+	// Settings apply to the queries through u (see Settings); the
+	// defaults when nil
+	Settings *Settings
+}
+
+// Transport sends a packed DNS query over a protocol other than DoH and
+// returns the packed response
+type Transport interface {
+	RoundTrip(ctx context.Context, query []byte) ([]byte, error)
+}
+
+func (u *Upstream) String() string {
+	switch {
+	case u == nil:
+		return Endpoint
+	case u.Name != "":
+		return u.Name
+	case u.URL != "":
+		return u.URL
 	}
-	return records[0].Data, nil
+	return fmt.Sprintf("%T", u.Transport)
 }
 
-// queryRaw returns all answers of the specified type
-func queryRaw(domain string, t int) ([]DoHAnswer, error) {
-	url := fmt.Sprintf("https://cloudflare-dns.com/dns-query?name=%s&type=%d", domain, t)
+// resolve returns u, or an upstream querying Endpoint when u is nil
+func (u *Upstream) resolve() *Upstream {
+	if u != nil {
+		return u
+	}
+	return &Upstream{URL: Endpoint}
+}
+
+// Exchange sends a wire-format (RFC 8484) query for domain and returns the
+// raw response message. NXDOMAIN and SERVFAIL are returned as errors.
+func Exchange(domain string, qtype uint16) (*dns.Msg, error) {
+	return (*Upstream)(nil).Exchange(domain, qtype)
+}
+
+// Exchange is the Upstream counterpart of the package-level Exchange
+func (u *Upstream) Exchange(domain string, qtype uint16) (*dns.Msg, error) {
+	return u.ExchangeContext(context.Background(), domain, qtype)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// ExchangeContext is Exchange giving up when ctx is done. Each query
+// still times out on its own after the client timeout; a deadline on ctx
+// bounds several queries together, e.g. all those of a CNAME chain.
+func (u *Upstream) ExchangeContext(ctx context.Context, domain string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(domain), qtype)
+	query.RecursionDesired = true
+	// RFC 8484 建议 ID 置零以提高 HTTP 缓存命中
+	query.Id = 0
+
+	packed, err := query.Pack()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", "application/dns-json")
 
-	client := &http.Client{}
+	if u != nil {
+		ctx = WithSettings(ctx, u.Settings)
+	}
+	u = u.resolve()
+	limit := settingsFrom(ctx).Limiter
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	if err := limit.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer limit.Release()
+
+	body, err := u.roundTrip(ctx, packed)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %v", ErrUpstreamTimeout, err)
+		}
+		return nil, err
+	}
+
+	msg, err := ParseResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	q := msg.Question[0]
+	if q.Qtype != qtype || !strings.EqualFold(q.Name, query.Question[0].Name) {
+		return nil, fmt.Errorf("%w: answer for %s %s", ErrMalformed, q.Name, dns.TypeToString[q.Qtype])
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return nil, ErrNXDomain
+	case dns.RcodeServerFailure:
+		return nil, ErrServFail
+	}
+	return msg, nil
+}
+
+// Query is ExchangeContext returning the parsed answer. It makes
+// *Upstream a dnsmasq.Upstream.
+func (u *Upstream) Query(ctx context.Context, domain string, qtype uint16) (Answer, error) {
+	msg, err := u.ExchangeContext(ctx, domain, qtype)
+	if err != nil {
+		return Answer{}, err
+	}
+	return Answer{Msg: msg, Records: ParseAnswers(msg)}, nil
+}
+
+// roundTrip sends a packed query over Transport, or to the DoH endpoint,
+// and returns the packed response
+func (u *Upstream) roundTrip(ctx context.Context, packed []byte) ([]byte, error) {
+	if u.Transport != nil {
+		return u.Transport.RoundTrip(ctx, packed)
+	}
+	return u.post(ctx, packed)
+}
+
+// post sends a packed query to the DoH endpoint and returns the body
+func (u *Upstream) post(ctx context.Context, packed []byte) ([]byte, error) {
+	client := u.Client
+	if client == nil {
+		client = settingsFrom(ctx).httpClient()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	addHeader(req)
+
+	// 记录本次查询所用的服务器地址，用于按地址统计失败
+	var remote netip.Addr
+	if u.Endpoints != nil {
+		req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			ConnectDone: func(_, addr string, err error) {
+				if ap, perr := netip.ParseAddrPort(addr); perr == nil && err == nil {
+					remote = ap.Addr().Unmap()
+				}
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				if ap, perr := netip.ParseAddrPort(info.Conn.RemoteAddr().String()); perr == nil {
+					remote = ap.Addr().Unmap()
+				}
+			},
+		}))
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
+		if ctx.Err() == nil {
+			u.Endpoints.Fail(remote, err)
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("upstream returned HTTP %d", resp.StatusCode)
+		u.Endpoints.Fail(remote, err)
+		return nil, err
+	}
+	u.Endpoints.Succeed(remote)
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+}
 
-	var dohRes DoHResponse
-	err = json.Unmarshal(body, &dohRes)
+// ParseResponse unpacks a wire-format DNS response and rejects messages
+// that aren't a usable answer to a single question (not a response,
+// truncated, or without exactly one question). It never panics on
+// malformed input.
+func ParseResponse(body []byte) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	switch {
+	case !msg.Response:
+		return nil, fmt.Errorf("%w: not a response", ErrMalformed)
+	case msg.Truncated:
+		return nil, fmt.Errorf("%w: truncated", ErrMalformed)
+	case len(msg.Question) != 1:
+		return nil, fmt.Errorf("%w: %d questions", ErrMalformed, len(msg.Question))
+	}
+	return msg, nil
+}
+
+// ParseAnswers converts the answer section of msg to DoHAnswers, dropping
+// address records without a valid address
+func ParseAnswers(msg *dns.Msg) []DoHAnswer {
+	var answers []DoHAnswer
+	for _, rr := range msg.Answer {
+		if rr == nil {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.A:
+			if v.A.To4() == nil {
+				continue
+			}
+		case *dns.AAAA:
+			if len(v.AAAA) != net.IPv6len {
+				continue
+			}
+		}
+		hdr := rr.Header()
+		answers = append(answers, DoHAnswer{
+			Name: hdr.Name,
+			Type: int(hdr.Rrtype),
+			TTL:  int(hdr.Ttl),
+			Data: rrData(rr),
+		})
+	}
+	return answers
+}
+
+// fetch queries domain and converts the answer section to DoHAnswers
+func (u *Upstream) fetch(ctx context.Context, domain string, t int) (*DoHResponse, error) {
+	msg, err := u.ExchangeContext(ctx, domain, uint16(t))
 	if err != nil {
 		return nil, err
 	}
+	return &DoHResponse{Status: msg.Rcode, Answer: ParseAnswers(msg)}, nil
+}
 
-	return dohRes.Answer, nil
+// rrData renders the record data the way the DoH JSON API did
+func rrData(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	case *dns.CNAME:
+		return v.Target
+	case *dns.NS:
+		return v.Ns
+	case *dns.PTR:
+		return v.Ptr
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", v.Preference, v.Mx)
+	case *dns.TXT:
+		return strings.Join(v.Txt, "")
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target)
+	default:
+		// 去掉头部，只保留记录数据
+		return strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
 }
 
 // dnsTypeToString maps DNS type code to human-readable name
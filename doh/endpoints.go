@@ -0,0 +1,330 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultEndpointRefresh is the longest the addresses of Endpoints are
+	// used before they're looked up again, whatever their TTL
+	DefaultEndpointRefresh = 10 * time.Minute
+	// minEndpointRefresh keeps short TTLs from looking the host up on
+	// every connection
+	minEndpointRefresh = time.Minute
+	// endpointBackoff is how long an address is skipped after its first
+	// failure, doubling with each further one up to maxEndpointBackoff
+	endpointBackoff    = 30 * time.Second
+	maxEndpointBackoff = 10 * time.Minute
+)
+
+// Endpoints is the rotating set of addresses of a DoH server, looked up
+// through bootstrap resolvers over plain DNS instead of the system
+// resolver. Connections go to the next healthy address in turn. An
+// address that fails to connect or answer is skipped for a backoff that
+// doubles with every consecutive failure, so a network blocking some of
+// the server's addresses is routed around.
+type Endpoints struct {
+	// Host is the server's host name
+	Host string
+	// Bootstrap are the plain DNS resolvers (IP:port) Host is looked up
+	// through, tried in order
+	Bootstrap []string
+	// Refresh is the longest the addresses are used before they're looked
+	// up again (default DefaultEndpointRefresh)
+	Refresh time.Duration
+
+	mu      sync.Mutex
+	addrs   []*endpointAddr
+	next    int
+	expires time.Time
+}
+
+type endpointAddr struct {
+	addr      netip.Addr
+	failures  int
+	downUntil time.Time
+	lastErr   error
+}
+
+// EndpointAddr is the state of one address of Endpoints
+type EndpointAddr struct {
+	Host    string
+	Addr    netip.Addr
+	Healthy bool
+	// Failures counts the consecutive failures
+	Failures int
+	// Err is the last failure
+	Err string
+}
+
+// UseBootstrap makes the DoH servers of u (the members, when u is a Pool)
+// look their host names up through resolvers (IP, port 53 when omitted)
+// and rotate over the addresses found (see Endpoints). Servers given by IP
+// address or with a stamp carrying their address are left alone.
+func (u *Upstream) UseBootstrap(resolvers []string) error {
+	if len(resolvers) == 0 || u == nil {
+		return nil
+	}
+	bootstrap := make([]string, len(resolvers))
+	for i, r := range resolvers {
+		addr := r
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		if _, err := netip.ParseAddrPort(addr); err != nil {
+			return fmt.Errorf("bootstrap resolver %q must be an IP address: %v", r, err)
+		}
+		bootstrap[i] = addr
+	}
+
+	if pool := u.Pool(); pool != nil {
+		for _, m := range pool.members {
+			if err := m.up.UseBootstrap(bootstrap); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if u.Transport != nil || u.Client != nil || u.URL == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(u.URL)
+	if err != nil {
+		return err
+	}
+	if _, err := netip.ParseAddr(endpoint.Hostname()); err == nil {
+		return nil
+	}
+	u.Endpoints = &Endpoints{Host: endpoint.Hostname(), Bootstrap: bootstrap}
+	transport := newTransport()
+	transport.DialContext = u.Endpoints.DialContext
+	u.Client = &http.Client{Timeout: queryTimeout, Transport: transport}
+	return nil
+}
+
+// EndpointStatus returns the state of the addresses of u's DoH servers that
+// use bootstrap resolvers, and nil when none do
+func (u *Upstream) EndpointStatus() []EndpointAddr {
+	if pool := u.Pool(); pool != nil {
+		var status []EndpointAddr
+		for _, m := range pool.members {
+			status = append(status, m.up.EndpointStatus()...)
+		}
+		return status
+	}
+	if u == nil {
+		return nil
+	}
+	return u.Endpoints.Status()
+}
+
+// DialContext dials the port of addr at the addresses of Host in turn,
+// healthy ones first, until one connects. It's the DialContext of the
+// server's http.Transport.
+func (e *Endpoints) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := e.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second, ControlContext: dialControl}
+	var errs []error
+	for _, a := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		// 每个地址只给一小段时间，被封锁的地址常常表现为超时
+		attempt, cancel := context.WithTimeout(ctx, DefaultAttemptTimeout)
+		conn, err := dialer.DialContext(attempt, network, net.JoinHostPort(a.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		e.Fail(a, err)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// candidates returns the addresses to try, starting one further in the
+// rotation each call, with those in backoff last. The addresses are
+// looked up again once they expire; a failed lookup keeps the old ones.
+func (e *Endpoints) candidates(ctx context.Context) ([]netip.Addr, error) {
+	e.mu.Lock()
+	stale := len(e.addrs) == 0 || time.Now().After(e.expires)
+	e.mu.Unlock()
+	if stale {
+		addrs, ttl, err := e.lookup(ctx)
+		e.mu.Lock()
+		switch {
+		case err == nil:
+			e.merge(addrs, ttl)
+		case len(e.addrs) == 0:
+			e.mu.Unlock()
+			return nil, fmt.Errorf("bootstrap lookup of %s: %v", e.Host, err)
+		}
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	n := len(e.addrs)
+	start := e.next % n
+	e.next++
+	var healthy, down []*endpointAddr
+	for i := range n {
+		a := e.addrs[(start+i)%n]
+		if now.Before(a.downUntil) {
+			down = append(down, a)
+		} else {
+			healthy = append(healthy, a)
+		}
+	}
+	// 全部处于退避期时仍要尝试，最早恢复的优先
+	slices.SortStableFunc(down, func(a, b *endpointAddr) int { return a.downUntil.Compare(b.downUntil) })
+	candidates := make([]netip.Addr, 0, n)
+	for _, a := range append(healthy, down...) {
+		candidates = append(candidates, a.addr)
+	}
+	return candidates, nil
+}
+
+// merge replaces the addresses with addrs, keeping the failures of those
+// still present. Called with e.mu held.
+func (e *Endpoints) merge(addrs []netip.Addr, ttl time.Duration) {
+	merged := make([]*endpointAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		i := slices.IndexFunc(e.addrs, func(a *endpointAddr) bool { return a.addr == addr })
+		if i >= 0 {
+			merged = append(merged, e.addrs[i])
+		} else {
+			merged = append(merged, &endpointAddr{addr: addr})
+		}
+	}
+	e.addrs = merged
+	refresh := e.Refresh
+	if refresh <= 0 {
+		refresh = DefaultEndpointRefresh
+	}
+	e.expires = time.Now().Add(min(max(ttl, minEndpointRefresh), refresh))
+}
+
+// lookup asks the bootstrap resolvers in turn for the A and AAAA records
+// of Host and returns the addresses of the first that has any, with their
+// shortest TTL
+func (e *Endpoints) lookup(ctx context.Context) ([]netip.Addr, time.Duration, error) {
+	client := &dns.Client{Timeout: DefaultAttemptTimeout, Dialer: &net.Dialer{ControlContext: dialControl}}
+	var errs []error
+	for _, resolver := range e.Bootstrap {
+		var addrs []netip.Addr
+		ttl := time.Duration(-1)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			query := new(dns.Msg)
+			query.SetQuestion(dns.Fqdn(e.Host), qtype)
+			resp, _, err := client.ExchangeContext(ctx, query, resolver)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", resolver, err))
+				continue
+			}
+			for _, rr := range resp.Answer {
+				var ip net.IP
+				switch v := rr.(type) {
+				case *dns.A:
+					ip = v.A
+				case *dns.AAAA:
+					ip = v.AAAA
+				default:
+					continue
+				}
+				addr, ok := netip.AddrFromSlice(ip)
+				if !ok {
+					continue
+				}
+				addrs = append(addrs, addr.Unmap())
+				if rttl := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || rttl < ttl {
+					ttl = rttl
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, 0, errors.New("no address found")
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+// Fail puts addr in backoff after it failed to connect or answer
+func (e *Endpoints) Fail(addr netip.Addr, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := slices.IndexFunc(e.addrs, func(a *endpointAddr) bool { return a.addr == addr })
+	if i < 0 {
+		return
+	}
+	a := e.addrs[i]
+	a.failures++
+	a.lastErr = err
+	backoff := endpointBackoff << min(a.failures-1, 5)
+	a.downUntil = time.Now().Add(min(backoff, maxEndpointBackoff))
+}
+
+// Succeed clears the failures of addr after it answered
+func (e *Endpoints) Succeed(addr netip.Addr) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := slices.IndexFunc(e.addrs, func(a *endpointAddr) bool { return a.addr == addr })
+	if i < 0 {
+		return
+	}
+	e.addrs[i].failures = 0
+	e.addrs[i].downUntil = time.Time{}
+}
+
+// Status returns the state of every address, in lookup order
+func (e *Endpoints) Status() []EndpointAddr {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	status := make([]EndpointAddr, len(e.addrs))
+	for i, a := range e.addrs {
+		status[i] = EndpointAddr{Host: e.Host, Addr: a.addr, Healthy: !now.Before(a.downUntil), Failures: a.failures}
+		if a.lastErr != nil {
+			status[i].Err = a.lastErr.Error()
+		}
+	}
+	return status
+}
@@ -0,0 +1,38 @@
+package doh_test
+
+import (
+	"net"
+	"testing"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+func FuzzParseResponse(f *testing.F) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = append(resp.Answer,
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "edge.example.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "edge.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(93, 184, 216, 34)},
+	)
+	packed, err := resp.Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packed)
+	f.Add(packed[:12])
+	f.Fuzz(func(t *testing.T, body []byte) {
+		msg, err := doh.ParseResponse(body)
+		if err != nil {
+			return
+		}
+		for _, ans := range doh.ParseAnswers(msg) {
+			if ans.Type == int(dns.TypeA) && net.ParseIP(ans.Data).To4() == nil {
+				t.Fatalf("A answer with invalid address %q", ans.Data)
+			}
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package doh
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"openvpnadvanced/version"
+)
+
+// reservedHeaders are set by the DoH protocol and can't be changed
+var reservedHeaders = []string{"Content-Type", "Accept", "Content-Length", "Host"}
+
+// DefaultHeader returns the headers DoH requests carry unless their
+// Settings name others: none beyond the protocol's own. The User-Agent Go would
+// add, naming the HTTP library, is removed too, leaving providers
+// nothing to tell installs or versions apart.
+func DefaultHeader() http.Header {
+	return http.Header{"User-Agent": {""}}
+}
+
+// ParseHeader builds the headers for Settings.Header from a User-Agent and
+// "Name: value" lines. userAgent is "none" or empty to send none,
+// "default" for version.UserAgent, or the value to send. A line with an
+// empty value drops that header, e.g. "User-Agent:".
+func ParseHeader(userAgent string, lines []string) (http.Header, error) {
+	h := DefaultHeader()
+	switch ua := strings.TrimSpace(userAgent); strings.ToLower(ua) {
+	case "", "none":
+	case "default":
+		h.Set("User-Agent", version.UserAgent())
+	default:
+		h.Set("User-Agent", ua)
+	}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q: want Name: value", line)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		for _, r := range reservedHeaders {
+			if name == r {
+				return nil, fmt.Errorf("header %s is set by DoH and can't be changed", name)
+			}
+		}
+		switch value = strings.TrimSpace(value); {
+		case value != "":
+			h.Set(name, value)
+		case name == "User-Agent":
+			h.Set(name, "")
+		default:
+			h.Del(name)
+		}
+	}
+	return h, nil
+}
+
+// addHeader adds the headers of the Settings carried by req's context to
+// req
+func addHeader(req *http.Request) {
+	h := settingsFrom(req.Context()).Header
+	if h == nil {
+		h = DefaultHeader()
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+}
@@ -0,0 +1,346 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootServers are the IPv4 addresses of the root name servers
+var RootServers = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// Limits of an iterative resolution
+const (
+	// maxReferrals bounds the queries of one resolution
+	maxReferrals = 32
+	// maxNSDepth bounds the nested lookups of name server addresses
+	maxNSDepth = 4
+	// maxCNAMEs bounds the CNAMEs followed for one query
+	maxCNAMEs = 8
+	// iterativeTimeout bounds one query to one server
+	iterativeTimeout = 2 * time.Second
+	// maxZones bounds the cached delegations
+	maxZones = 10000
+)
+
+var errLameDelegation = errors.New("no name server answered")
+
+// Iterative is a Transport resolving names itself, from the root servers
+// down, instead of asking a recursive resolver, which learns every name
+// asked. It minimizes query names (RFC 7816): each server is asked only
+// for the name one label below the zone it serves, so the root servers
+// learn the TLD and the TLD servers the domain, not the full name. A
+// server that mishandles a minimized query (NXDOMAIN or an error for an
+// empty non-terminal) gets the full name instead. Queries go out over
+// unencrypted UDP, TCP when truncated.
+type Iterative struct {
+	// Roots are the root server addresses (default RootServers)
+	Roots []string
+	// NoMinimize sends every server the full query name
+	NoMinimize bool
+
+	mu sync.Mutex
+	// zones caches the name server addresses of the delegations seen
+	zones map[string]delegation
+
+	// exchange sends one query to addr; replaced in tests
+	exchange func(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, error)
+}
+
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// RoundTrip resolves a packed query and returns the packed response
+func (it *Iterative) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(msg.Question) != 1 {
+		return nil, ErrMalformed
+	}
+	q := msg.Question[0]
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.RecursionAvailable = true
+	name := q.Name
+	for i := 0; ; i++ {
+		resp, err := it.resolve(ctx, name, q.Qtype, 0)
+		if err != nil {
+			return nil, err
+		}
+		reply.Rcode = resp.Rcode
+		reply.Answer = append(reply.Answer, resp.Answer...)
+		reply.Ns = resp.Ns
+		// 答案只有 CNAME 时继续解析其目标
+		target, ok := cnameOnly(resp.Answer, name, q.Qtype)
+		if !ok || i == maxCNAMEs {
+			break
+		}
+		name = target
+	}
+	return reply.Pack()
+}
+
+// cnameOnly returns the CNAME target of name when answer holds no record
+// of type qtype for it
+func cnameOnly(answer []dns.RR, name string, qtype uint16) (string, bool) {
+	if qtype == dns.TypeCNAME {
+		return "", false
+	}
+	var target string
+	for _, rr := range answer {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		if h.Rrtype == qtype {
+			return "", false
+		}
+		if c, ok := rr.(*dns.CNAME); ok {
+			target = c.Target
+		}
+	}
+	if target == "" {
+		return "", false
+	}
+	// 同一响应里已包含目标的记录时不必再查
+	for _, rr := range answer {
+		if strings.EqualFold(rr.Header().Name, target) && rr.Header().Rrtype == qtype {
+			return "", false
+		}
+	}
+	return target, true
+}
+
+// resolve asks the servers of name's closest known zone and follows their
+// referrals down to the servers answering for name
+func (it *Iterative) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	name = dns.CanonicalName(name)
+	zone, servers := it.closest(name)
+	labels := dns.CountLabel(name)
+	asked := dns.CountLabel(zone)
+	minimize := !it.NoMinimize
+
+	for i := 0; i < maxReferrals; i++ {
+		qname, qt := name, qtype
+		// 最后一个标签用原始查询类型查完整名称
+		if minimize && asked+1 < labels {
+			asked++
+			qname, qt = lastLabels(name, asked), dns.TypeNS
+		}
+		resp, err := it.ask(ctx, qname, qt, servers)
+		if err != nil {
+			if qname != name {
+				// 服务器处理不了精简查询时改查完整名称
+				minimize, asked = false, labels
+				continue
+			}
+			return nil, err
+		}
+
+		if child, ns := referral(resp, zone, qname); child != "" {
+			addrs, err := it.nsAddrs(ctx, resp, zone, ns, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", child, err)
+			}
+			it.remember(child, addrs, resp)
+			zone, servers = child, addrs
+			if asked < dns.CountLabel(child) {
+				asked = dns.CountLabel(child)
+			}
+			continue
+		}
+		if qname == name {
+			return resp, nil
+		}
+		if resp.Rcode != dns.RcodeSuccess || hasCNAME(resp.Answer) {
+			// 中间名称不存在或是别名时，完整名称交给同一服务器判断
+			minimize, asked = false, labels
+		}
+	}
+	return nil, fmt.Errorf("%s: too many referrals", name)
+}
+
+// ask sends the query to each of servers in turn until one answers
+func (it *Iterative) ask(ctx context.Context, name string, qtype uint16, servers []string) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(1232, false)
+
+	err := errLameDelegation
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *dns.Msg
+		resp, err = it.send(ctx, msg, server)
+		if err != nil {
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return resp, nil
+		}
+		err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil, err
+}
+
+func (it *Iterative) send(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	if it.exchange != nil {
+		return it.exchange(ctx, msg, server)
+	}
+	ctx, cancel := context.WithTimeout(ctx, iterativeTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(server, "53")
+	client := &dns.Client{Dialer: &net.Dialer{ControlContext: dialControl}}
+	resp, _, err := client.ExchangeContext(ctx, msg, addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, addr)
+	}
+	return resp, err
+}
+
+// referral returns the zone between zone and qname that resp delegates
+// to, and the names of its servers, or "" when resp is not a referral
+func referral(resp *dns.Msg, zone, qname string) (string, []string) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", nil
+	}
+	var child string
+	var ns []string
+	for _, rr := range resp.Ns {
+		n, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(n.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		ns = append(ns, dns.CanonicalName(n.Ns))
+	}
+	return child, ns
+}
+
+// nsAddrs returns the addresses of the servers ns, from the glue the
+// servers of zone sent in resp or by resolving their names. Glue outside
+// zone is ignored, as those servers can't vouch for it.
+func (it *Iterative) nsAddrs(ctx context.Context, resp *dns.Msg, zone string, ns []string, depth int) ([]string, error) {
+	var addrs []string
+	for _, rr := range resp.Extra {
+		if a, ok := rr.(*dns.A); ok && containsFold(ns, a.Hdr.Name) && dns.IsSubDomain(zone, dns.CanonicalName(a.Hdr.Name)) {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if depth >= maxNSDepth {
+		return nil, errors.New("name server lookups nested too deep")
+	}
+	for _, name := range ns {
+		r, err := it.resolve(ctx, name, dns.TypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, a.A.String())
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, errLameDelegation
+}
+
+// closest returns the deepest cached zone enclosing name and its servers
+func (it *Iterative) closest(name string) (string, []string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	now := time.Now()
+	for zone := name; ; {
+		if d, ok := it.zones[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.servers
+			}
+			delete(it.zones, zone)
+		}
+		off, end := dns.NextLabel(zone, 0)
+		if end {
+			break
+		}
+		zone = zone[off:]
+	}
+	roots := it.Roots
+	if len(roots) == 0 {
+		roots = RootServers
+	}
+	return ".", roots
+}
+
+// remember caches the servers of zone for the TTL of its NS records
+func (it *Iterative) remember(zone string, servers []string, resp *dns.Msg) {
+	ttl := uint32(3600)
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS && rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.zones == nil || len(it.zones) >= maxZones {
+		it.zones = make(map[string]delegation)
+	}
+	it.zones[zone] = delegation{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// lastLabels returns the last n labels of the fully qualified name
+func lastLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func hasCNAME(answer []dns.RR) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
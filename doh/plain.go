@@ -0,0 +1,54 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Plain is a Transport sending queries over unencrypted DNS, e.g. to a
+// resolver on the LAN. A truncated UDP answer is retried over TCP.
+type Plain struct {
+	// Addr is the resolver's address and port
+	Addr string
+}
+
+// RoundTrip sends a packed query and returns the packed response. The
+// query goes out with a random ID, as the zero ID of DoH would make
+// spoofed UDP answers easy to forge, and the response gets the query's.
+func (p *Plain) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	id := msg.Id
+	msg.Id = dns.Id()
+
+	client := &dns.Client{Dialer: &net.Dialer{ControlContext: dialControl}}
+	resp, _, err := client.ExchangeContext(ctx, msg, p.Addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, p.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = id
+	return resp.Pack()
+}
+
+// plainUpstream builds a plain DNS upstream for host, with port 53 when
+// it has none
+func plainUpstream(name, host string) (*Upstream, error) {
+	if host == "" {
+		return nil, errors.New("upstream needs a host name")
+	}
+	addr := host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return &Upstream{Name: name, Transport: &Plain{Addr: addr}}, nil
+}
@@ -0,0 +1,284 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultAttemptTimeout bounds the try of one pool member, leaving a
+	// query time to fail over to the next
+	DefaultAttemptTimeout = 2 * time.Second
+	// DefaultHealthInterval is how often Pool.Run checks the members
+	DefaultHealthInterval = 30 * time.Second
+)
+
+// Pool is a Transport spreading queries over several upstreams. A query
+// goes to the fastest healthy member, by a moving average of its response
+// times, and fails over to the next when it times out or errors. A member
+// that fails is marked down and tried only after the healthy ones, until
+// a health check (see Run) or a query gets an answer from it again. In
+// Race mode a query goes to the two fastest members at once and the first
+// answer wins.
+type Pool struct {
+	// Race sends each query to the two fastest members at once
+	Race bool
+	// AttemptTimeout bounds each member's try (default
+	// DefaultAttemptTimeout)
+	AttemptTimeout time.Duration
+	// HealthInterval is how often Run checks the members (default
+	// DefaultHealthInterval)
+	HealthInterval time.Duration
+
+	members []*member
+}
+
+// PoolMember is the state of one upstream of a Pool
+type PoolMember struct {
+	Name    string
+	Healthy bool
+	// RTT is the moving average of the response times; zero until the
+	// member answered once
+	RTT      time.Duration
+	Queries  uint64
+	Failures uint64
+	// Err is the last failure
+	Err string
+}
+
+type member struct {
+	up *Upstream
+
+	mu       sync.Mutex
+	rtt      time.Duration
+	down     bool
+	queries  uint64
+	failures uint64
+	lastErr  error
+}
+
+// NewPool returns a pool of upstreams, all assumed healthy
+func NewPool(upstreams ...*Upstream) *Pool {
+	p := &Pool{}
+	for _, u := range upstreams {
+		p.members = append(p.members, &member{up: u})
+	}
+	return p
+}
+
+// Pool returns the pool u queries through, or nil
+func (u *Upstream) Pool() *Pool {
+	if u == nil {
+		return nil
+	}
+	p, _ := u.Transport.(*Pool)
+	return p
+}
+
+// RoundTrip sends query to the members in order of preference until one
+// answers
+func (p *Pool) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	order := p.order()
+	var errs []error
+	if p.Race && len(order) > 1 {
+		body, err := p.race(ctx, query, order[0], order[1])
+		if err == nil {
+			return body, nil
+		}
+		errs = append(errs, err)
+		order = order[2:]
+	}
+	for _, m := range order {
+		if ctx.Err() != nil {
+			break
+		}
+		body, err := p.try(ctx, m, query)
+		if err == nil {
+			return body, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no upstream configured")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// race sends query to a and b at once and returns the first answer
+func (p *Pool) race(ctx context.Context, query []byte, a, b *member) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		body []byte
+		err  error
+	}
+	results := make(chan result, 2)
+	for _, m := range []*member{a, b} {
+		go func(m *member) {
+			body, err := p.try(ctx, m, query)
+			results <- result{body, err}
+		}(m)
+	}
+	var errs []error
+	for range 2 {
+		r := <-results
+		if r.err == nil {
+			return r.body, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// try sends query to m within AttemptTimeout and records the outcome.
+// Tries cut short by ctx, e.g. the loser of a race, are not held against
+// the member.
+func (p *Pool) try(ctx context.Context, m *member, query []byte) ([]byte, error) {
+	timeout := p.AttemptTimeout
+	if timeout <= 0 {
+		timeout = DefaultAttemptTimeout
+	}
+	attempt, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	body, err := m.up.roundTrip(attempt, query)
+	if err == nil {
+		// 响应无法解析（如被劫持返回网页）同样视为失败，换下一个上游
+		_, err = ParseResponse(body)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	m.record(time.Since(start), err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", m.up, err)
+	}
+	return body, nil
+}
+
+// record updates the member's health and response time
+func (m *member) record(rtt time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries++
+	if err != nil {
+		m.failures++
+		m.lastErr = err
+		if !m.down {
+			log.Printf("⚠️ Upstream %s is down: %v", m.up, err)
+		}
+		m.down = true
+		return
+	}
+	if m.down {
+		log.Printf("✅ Upstream %s is back", m.up)
+	}
+	m.down = false
+	if m.rtt == 0 {
+		m.rtt = rtt
+	} else {
+		m.rtt = (m.rtt*3 + rtt) / 4
+	}
+}
+
+// order returns the healthy members, fastest first, followed by the ones
+// that are down as a last resort. Members not measured yet go first so
+// they get measured.
+func (p *Pool) order() []*member {
+	type ranked struct {
+		m    *member
+		down bool
+		rtt  time.Duration
+	}
+	list := make([]ranked, len(p.members))
+	for i, m := range p.members {
+		m.mu.Lock()
+		list[i] = ranked{m, m.down, m.rtt}
+		m.mu.Unlock()
+	}
+	slices.SortStableFunc(list, func(a, b ranked) int {
+		switch {
+		case a.down != b.down && a.down:
+			return 1
+		case a.down != b.down:
+			return -1
+		}
+		return int(a.rtt - b.rtt)
+	})
+	order := make([]*member, len(list))
+	for i, r := range list {
+		order[i] = r.m
+	}
+	return order
+}
+
+// Run checks every member each HealthInterval until ctx is done, so
+// members that went down come back and idle ones keep their response
+// times current
+func (p *Pool) Run(ctx context.Context) error {
+	interval := p.HealthInterval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			p.Check(ctx)
+		}
+	}
+}
+
+// Check queries every member for the root NS records at once and
+// records the outcome
+func (p *Pool) Check(ctx context.Context) {
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+	packed, err := query.Pack()
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			p.try(ctx, m, packed)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Status returns the state of every member, in configuration order
+func (p *Pool) Status() []PoolMember {
+	if p == nil {
+		return nil
+	}
+	status := make([]PoolMember, len(p.members))
+	for i, m := range p.members {
+		m.mu.Lock()
+		status[i] = PoolMember{
+			Name:     m.up.String(),
+			Healthy:  !m.down,
+			RTT:      m.rtt,
+			Queries:  m.queries,
+			Failures: m.failures,
+		}
+		if m.lastErr != nil {
+			status[i].Err = m.lastErr.Error()
+		}
+		m.mu.Unlock()
+	}
+	return status
+}
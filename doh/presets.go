@@ -0,0 +1,167 @@
+package doh
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Capability is a feature of a provider's resolvers
+type Capability uint8
+
+const (
+	// CapDNSSEC means the resolvers validate DNSSEC
+	CapDNSSEC Capability = 1 << iota
+	// CapECS means the resolvers forward EDNS Client Subnet, so CDNs pick
+	// edges near the client
+	CapECS
+	// CapFiltering means the resolvers block malware and phishing domains
+	CapFiltering
+)
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapDNSSEC, "dnssec"},
+	{CapECS, "ecs"},
+	{CapFiltering, "filtering"},
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseCapabilities parses capability names ("dnssec", "ecs",
+// "filtering")
+func ParseCapabilities(names []string) (Capability, error) {
+	var c Capability
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, n := range capabilityNames {
+			if n.name == name {
+				c |= n.c
+				known = true
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("unknown capability %q, expected dnssec, ecs or filtering", name)
+		}
+	}
+	return c, nil
+}
+
+// Preset is a named upstream provider: its encrypted endpoints and the
+// plain resolvers that look up their host names
+type Preset struct {
+	Name string
+	// Region is where the provider serves best: "global", or a country
+	// code such as "cn"
+	Region string
+	// Upstreams are ParseUpstream specs, queried as a pool when several
+	Upstreams []string
+	// Bootstrap are the provider's plain resolvers, by IP, used for
+	// UseBootstrap
+	Bootstrap    []string
+	Capabilities Capability
+}
+
+// Presets are the built-in providers
+var Presets = []Preset{
+	{
+		Name:         "cloudflare",
+		Region:       "global",
+		Upstreams:    []string{"https://cloudflare-dns.com/dns-query", "tls://one.one.one.one"},
+		Bootstrap:    []string{"1.1.1.1", "1.0.0.1"},
+		Capabilities: CapDNSSEC,
+	},
+	{
+		Name:         "google",
+		Region:       "global",
+		Upstreams:    []string{"https://dns.google/dns-query", "tls://dns.google"},
+		Bootstrap:    []string{"8.8.8.8", "8.8.4.4"},
+		Capabilities: CapDNSSEC | CapECS,
+	},
+	{
+		Name:         "quad9",
+		Region:       "global",
+		Upstreams:    []string{"https://dns.quad9.net/dns-query", "tls://dns.quad9.net"},
+		Bootstrap:    []string{"9.9.9.9", "149.112.112.112"},
+		Capabilities: CapDNSSEC | CapFiltering,
+	},
+	{
+		Name:         "alidns",
+		Region:       "cn",
+		Upstreams:    []string{"https://dns.alidns.com/dns-query", "tls://dns.alidns.com"},
+		Bootstrap:    []string{"223.5.5.5", "223.6.6.6"},
+		Capabilities: CapDNSSEC | CapECS,
+	},
+	{
+		Name:         "dnspod",
+		Region:       "cn",
+		Upstreams:    []string{"https://doh.pub/dns-query", "tls://dot.pub"},
+		Bootstrap:    []string{"119.29.29.29", "119.28.28.28"},
+		Capabilities: CapECS,
+	},
+}
+
+// LookupPreset returns the preset called name, looking in custom before
+// the built-in Presets, so a custom preset can replace a built-in one
+func LookupPreset(name string, custom []Preset) (Preset, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, list := range [][]Preset{custom, Presets} {
+		for _, p := range list {
+			if strings.ToLower(p.Name) == name {
+				return p, true
+			}
+		}
+	}
+	return Preset{}, false
+}
+
+// isPresetName reports whether spec names a preset rather than giving an
+// upstream URL or stamp
+func isPresetName(spec string) bool {
+	return spec != "" && !strings.Contains(spec, "://")
+}
+
+// ExpandPresets replaces the preset names among specs with the presets'
+// upstreams and returns the bootstrap resolvers of the presets used.
+// Other specs are returned unchanged.
+func ExpandPresets(specs []string, custom []Preset) (upstreams, bootstrap []string, err error) {
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !isPresetName(spec) {
+			upstreams = append(upstreams, spec)
+			continue
+		}
+		p, ok := LookupPreset(spec, custom)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown upstream preset %q", spec)
+		}
+		if len(p.Upstreams) == 0 {
+			return nil, nil, fmt.Errorf("upstream preset %q has no upstream", spec)
+		}
+		for _, u := range p.Upstreams {
+			if !slices.Contains(upstreams, u) {
+				upstreams = append(upstreams, u)
+			}
+		}
+		for _, b := range p.Bootstrap {
+			if !slices.Contains(bootstrap, b) {
+				bootstrap = append(bootstrap, b)
+			}
+		}
+	}
+	return upstreams, bootstrap, nil
+}
@@ -0,0 +1,63 @@
+package doh
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"syscall"
+
+	"openvpnadvanced/limits"
+)
+
+// Settings are the query settings of one user of the package, e.g. an
+// engine, so several users can share a process without sharing headers,
+// limits, socket options or connections. They apply to the queries of an
+// Upstream whose Settings field points at them, including those its pool
+// members send.
+type Settings struct {
+	// Header is added to DoH requests; DefaultHeader when nil
+	Header http.Header
+	// Limiter bounds concurrent queries; unbounded when nil
+	Limiter *limits.Limiter
+	// Control is applied to every upstream socket dialed, e.g. to set a
+	// DSCP mark
+	Control func(network, address string, c syscall.RawConn) error
+
+	// client sends the queries of upstreams without a Client of their own,
+	// so connections dialed with Control aren't reused by other users
+	once   sync.Once
+	client *http.Client
+}
+
+type settingsKey struct{}
+
+// defaultSettings apply to queries made without Settings, e.g. through
+// the package-level query functions: DefaultHeader, no limit and no
+// socket control. Only their client's connections are shared.
+var defaultSettings = &Settings{}
+
+// WithSettings returns ctx carrying s for the queries made with it that
+// don't go through an Upstream with Settings of its own, e.g. the health
+// checks of a Pool; ctx itself when s is nil
+func WithSettings(ctx context.Context, s *Settings) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, settingsKey{}, s)
+}
+
+// settingsFrom returns the settings carried by ctx, or defaultSettings
+func settingsFrom(ctx context.Context) *Settings {
+	if s, ok := ctx.Value(settingsKey{}).(*Settings); ok {
+		return s
+	}
+	return defaultSettings
+}
+
+// httpClient returns the client of the settings, creating it on first use
+func (s *Settings) httpClient() *http.Client {
+	s.once.Do(func() {
+		s.client = &http.Client{Timeout: queryTimeout, Transport: newTransport()}
+	})
+	return s.client
+}
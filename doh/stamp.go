@@ -0,0 +1,251 @@
+package doh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnscrypt"
+	"openvpnadvanced/doq"
+	"openvpnadvanced/dot"
+	"openvpnadvanced/stamp"
+)
+
+// ParseUpstream returns the upstream described by spec: an https:// DoH
+// URL, a tls://host[:port] DNS-over-TLS or quic://host[:port]
+// DNS-over-QUIC server, a udp://host[:port] plain DNS server, iterative://
+// for resolving from the root servers (see Iterative), or an
+// sdns:// DNS stamp of a DoH, DoT, DoQ or DNSCrypt server. A stamp's
+// server address is dialed instead of resolving its host name, and its
+// certificate hashes must appear in the server's TLS chain. relays (relay
+// stamps or IP:port) anonymize a DNSCrypt upstream.
+func ParseUpstream(spec string, relays ...string) (*Upstream, error) {
+	var relayAddrs []string
+	for _, relay := range relays {
+		addr, err := ParseRelay(relay)
+		if err != nil {
+			return nil, err
+		}
+		relayAddrs = append(relayAddrs, addr)
+	}
+
+	if strings.HasPrefix(spec, "https://") {
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return &Upstream{URL: spec}, nil
+	}
+	if host, ok := strings.CutPrefix(spec, "tls://"); ok {
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return dotUpstream(spec, host, "", nil)
+	}
+	if host, ok := strings.CutPrefix(spec, "quic://"); ok {
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return doqUpstream(spec, host, "", nil)
+	}
+	if spec == "iterative://" {
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return &Upstream{Name: spec, Transport: &Iterative{}}, nil
+	}
+	if host, ok := strings.CutPrefix(spec, "udp://"); ok {
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return plainUpstream(spec, host)
+	}
+	st, err := stamp.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch st.Proto {
+	case stamp.ProtoDoH:
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return stampDoH(st), nil
+	case stamp.ProtoDoT:
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return dotUpstream("tls://"+st.Host, st.Host, st.Addr, st.Hashes)
+	case stamp.ProtoDoQ:
+		if len(relayAddrs) > 0 {
+			return nil, errors.New("relays require a DNSCrypt upstream")
+		}
+		return doqUpstream("quic://"+st.Host, st.Host, st.Addr, st.Hashes)
+	case stamp.ProtoDNSCrypt:
+		return &Upstream{Name: "dnscrypt://" + st.ProviderName, Transport: &dnscrypt.Client{
+			Addr:           st.HostPort(443),
+			ProviderName:   st.ProviderName,
+			PublicKey:      ed25519.PublicKey(st.PublicKey),
+			Relays:         relayAddrs,
+			ControlContext: dialControl,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported %s stamp, expected DoH, DoT, DoQ or DNSCrypt", st.Proto)
+	}
+}
+
+// ParseUpstreams is ParseUpstream for a list of upstreams: a single spec
+// returns its upstream, several return an upstream querying them through
+// a Pool. relays require a single DNSCrypt upstream.
+func ParseUpstreams(specs []string, relays ...string) (*Upstream, error) {
+	switch len(specs) {
+	case 0:
+		return nil, errors.New("no upstream")
+	case 1:
+		return ParseUpstream(specs[0], relays...)
+	}
+	if len(relays) > 0 {
+		return nil, errors.New("relays require a single DNSCrypt upstream")
+	}
+	members := make([]*Upstream, len(specs))
+	for i, spec := range specs {
+		u, err := ParseUpstream(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		members[i] = u
+	}
+	return &Upstream{Name: fmt.Sprintf("pool of %d upstreams", len(members)), Transport: NewPool(members...)}, nil
+}
+
+// ParseRelay returns the address of an Anonymized DNSCrypt relay given as
+// a relay stamp or an IP address with an optional port (default 443)
+func ParseRelay(spec string) (string, error) {
+	addr := spec
+	if strings.HasPrefix(spec, stamp.Scheme) {
+		st, err := stamp.Parse(spec)
+		if err != nil {
+			return "", err
+		}
+		if st.Proto != stamp.ProtoDNSCryptRelay {
+			return "", fmt.Errorf("%s stamp is not a DNSCrypt relay", st.Proto)
+		}
+		addr = st.HostPort(443)
+	} else if _, _, err := net.SplitHostPort(spec); err != nil {
+		addr = net.JoinHostPort(strings.Trim(spec, "[]"), "443")
+	}
+	if _, err := netip.ParseAddrPort(addr); err != nil {
+		return "", fmt.Errorf("relay %q must be an IP address: %v", spec, err)
+	}
+	return addr, nil
+}
+
+// stampDoH builds a DoH upstream honoring the stamp's address and hashes
+func stampDoH(st stamp.Stamp) *Upstream {
+	host := st.Host
+	serverName := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		serverName = h
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = &tls.Config{
+		ServerName:       serverName,
+		VerifyConnection: verifyHashes(st.Hashes),
+	}
+	if st.Addr != "" {
+		dialer := &net.Dialer{Timeout: 5 * time.Second, ControlContext: dialControl}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			// 连接 stamp 中固定的地址，未指定端口时沿用 URL 的端口
+			pinned := st.Addr
+			if _, _, err := net.SplitHostPort(pinned); err != nil {
+				pinned = net.JoinHostPort(strings.Trim(pinned, "[]"), port)
+			}
+			return dialer.DialContext(ctx, network, pinned)
+		}
+	}
+	return &Upstream{
+		URL:    "https://" + host + st.Path,
+		Client: &http.Client{Timeout: queryTimeout, Transport: transport},
+	}
+}
+
+// dotUpstream builds a DoT upstream for host (with an optional port),
+// dialing addr instead when given and requiring one of hashes in the
+// server's chain
+func dotUpstream(name, host, addr string, hashes [][]byte) (*Upstream, error) {
+	serverName, addr, err := tlsTarget(host, addr, dot.DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{Name: name, Transport: &dot.Client{
+		Addr:           addr,
+		ServerName:     serverName,
+		TLSConfig:      &tls.Config{MinVersion: tls.VersionTLS12, VerifyConnection: verifyHashes(hashes)},
+		ControlContext: dialControl,
+	}}, nil
+}
+
+// doqUpstream is dotUpstream for DNS over QUIC
+func doqUpstream(name, host, addr string, hashes [][]byte) (*Upstream, error) {
+	serverName, addr, err := tlsTarget(host, addr, doq.DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{Name: name, Transport: &doq.Client{
+		Addr:           addr,
+		ServerName:     serverName,
+		TLSConfig:      &tls.Config{MinVersion: tls.VersionTLS13, VerifyConnection: verifyHashes(hashes)},
+		ControlContext: dialControl,
+	}}, nil
+}
+
+// tlsTarget returns the certificate name of host and the address to dial:
+// addr when given, else host, with port added when they have none
+func tlsTarget(host, addr, port string) (string, string, error) {
+	if host == "" {
+		return "", "", errors.New("upstream needs a host name")
+	}
+	serverName := strings.Trim(host, "[]")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		serverName = h
+	}
+	if addr == "" {
+		addr = host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return serverName, addr, nil
+}
+
+// verifyHashes requires one certificate of the verified chain to have a
+// TBS certificate hashing to one of hashes; any chain passes without hashes
+func verifyHashes(hashes [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(hashes) == 0 {
+			return nil
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawTBSCertificate)
+				if slices.ContainsFunc(hashes, func(h []byte) bool { return string(h) == string(sum[:]) }) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate in the chain matches the stamp's hashes")
+	}
+}
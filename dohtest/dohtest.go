@@ -0,0 +1,345 @@
+// Package dohtest provides an in-process fake DoH (RFC 8484) server with
+// programmable answers, delays and failures, so code embedding the engine
+// can test its rule and routing behavior deterministically and offline.
+//
+//	srv := dohtest.NewServer()
+//	defer srv.Close()
+//	srv.A("vpn.example.com", "10.0.0.1")
+//	srv.NXDomain("gone.example.com")
+//	eng, err := engine.New(engine.Options{Upstream: srv.Upstream(), ...})
+//
+// Each server is its own upstream, so tests using them can run in
+// parallel.
+package dohtest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+// HandlerFunc answers a query; returning nil produces SERVFAIL
+type HandlerFunc func(query *dns.Msg) *dns.Msg
+
+// Query is a request received by the server
+type Query struct {
+	Name  string
+	Type  uint16
+	Agent string
+	At    time.Time
+}
+
+// Server is a fake DoH upstream. Names without programmed records get
+// NXDOMAIN (see SetUnknownRcode); names with records of other types get
+// an empty NOERROR answer.
+type Server struct {
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	records    map[string][]dns.RR
+	rcodes     map[string]int
+	httpStatus map[string]int
+	delays     map[string]time.Duration
+	handlers   map[string]HandlerFunc
+	unknown    int
+	ttl        uint32
+	queries    []Query
+}
+
+// NewServer starts a TLS DoH server on a loopback port
+func NewServer() *Server {
+	s := &Server{
+		records:    make(map[string][]dns.RR),
+		rcodes:     make(map[string]int),
+		httpStatus: make(map[string]int),
+		delays:     make(map[string]time.Duration),
+		handlers:   make(map[string]HandlerFunc),
+		unknown:    dns.RcodeNameError,
+		ttl:        300,
+	}
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL returns the DoH endpoint URL
+func (s *Server) URL() string {
+	return s.srv.URL + "/dns-query"
+}
+
+// Client returns an HTTP client trusting the server's certificate
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Upstream returns an upstream querying the server, e.g. for
+// engine.Options.Upstream or dnsmasq.Resolver.Upstream
+func (s *Server) Upstream() *doh.Upstream {
+	return &doh.Upstream{URL: s.URL(), Client: s.Client()}
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func key(name string) string {
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+func typeKey(name string, qtype uint16) string {
+	return key(name) + "/" + dns.TypeToString[qtype]
+}
+
+func (s *Server) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: key(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.ttl}
+}
+
+// SetTTL sets the TTL of records added afterwards (default 300)
+func (s *Server) SetTTL(ttl uint32) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+	return s
+}
+
+// SetUnknownRcode sets the rcode for names without records (default NXDOMAIN)
+func (s *Server) SetUnknownRcode(rcode int) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unknown = rcode
+	return s
+}
+
+// A adds IPv4 answers for name
+func (s *Server) A(name string, ips ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ip := range ips {
+		rr := &dns.A{Hdr: s.header(name, dns.TypeA), A: net.ParseIP(ip)}
+		s.records[key(name)] = append(s.records[key(name)], rr)
+	}
+	return s
+}
+
+// AAAA adds IPv6 answers for name
+func (s *Server) AAAA(name string, ips ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ip := range ips {
+		rr := &dns.AAAA{Hdr: s.header(name, dns.TypeAAAA), AAAA: net.ParseIP(ip)}
+		s.records[key(name)] = append(s.records[key(name)], rr)
+	}
+	return s
+}
+
+// CNAME aliases name to target. Queries for name return the CNAME
+// followed by target's records of the queried type, like a recursive
+// resolver would.
+func (s *Server) CNAME(name, target string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rr := &dns.CNAME{Hdr: s.header(name, dns.TypeCNAME), Target: key(target)}
+	s.records[key(name)] = append(s.records[key(name)], rr)
+	return s
+}
+
+// Record adds arbitrary records in zone file syntax, e.g.
+// "example.com. 60 IN TXT \"hello\""
+func (s *Server) Record(records ...string) error {
+	for _, text := range records {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		name := key(rr.Header().Name)
+		s.records[name] = append(s.records[name], rr)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// NXDomain makes name answer NXDOMAIN
+func (s *Server) NXDomain(name string) *Server {
+	return s.Rcode(name, dns.RcodeNameError)
+}
+
+// ServFail makes name answer SERVFAIL
+func (s *Server) ServFail(name string) *Server {
+	return s.Rcode(name, dns.RcodeServerFailure)
+}
+
+// Rcode makes name answer with rcode and no records
+func (s *Server) Rcode(name string, rcode int) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcodes[key(name)] = rcode
+	return s
+}
+
+// HTTPError makes queries for name fail with an HTTP status; an empty
+// name applies to every query
+func (s *Server) HTTPError(name string, status int) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.httpStatus[s.scope(name)] = status
+	return s
+}
+
+// Delay holds answers for name for d (an empty name applies to every
+// query), e.g. to exercise upstream timeouts
+func (s *Server) Delay(name string, d time.Duration) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delays[s.scope(name)] = d
+	return s
+}
+
+// Handle answers queries for name and qtype with fn, overriding records
+func (s *Server) Handle(name string, qtype uint16, fn HandlerFunc) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[typeKey(name, qtype)] = fn
+	return s
+}
+
+func (s *Server) scope(name string) string {
+	if name == "" {
+		return ""
+	}
+	return key(name)
+}
+
+// Queries returns the queries received so far
+func (s *Server) Queries() []Query {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Query(nil), s.queries...)
+}
+
+// Reset forgets every programmed answer, failure and recorded query
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.records)
+	clear(s.rcodes)
+	clear(s.httpStatus)
+	clear(s.delays)
+	clear(s.handlers)
+	s.unknown = dns.RcodeNameError
+	s.queries = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+		http.Error(w, "expected an RFC 8484 POST", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(body); err != nil || len(query.Question) != 1 {
+		http.Error(w, "malformed DNS query", http.StatusBadRequest)
+		return
+	}
+	q := query.Question[0]
+	name := key(q.Name)
+
+	s.mu.Lock()
+	s.queries = append(s.queries, Query{Name: name, Type: q.Qtype, Agent: r.UserAgent(), At: time.Now()})
+	delay, ok := s.delays[name]
+	if !ok {
+		delay = s.delays[""]
+	}
+	status, ok := s.httpStatus[name]
+	if !ok {
+		status = s.httpStatus[""]
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	resp := s.answer(query)
+	packed, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(packed)
+}
+
+// answer builds the response for a query from the programmed state
+func (s *Server) answer(query *dns.Msg) *dns.Msg {
+	q := query.Question[0]
+
+	s.mu.Lock()
+	handler := s.handlers[typeKey(q.Name, q.Qtype)]
+	s.mu.Unlock()
+	if handler != nil {
+		if resp := handler(query); resp != nil {
+			resp.Id = query.Id
+			return resp
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(query, dns.RcodeServerFailure)
+		return resp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+
+	name := key(q.Name)
+	if rcode, ok := s.rcodes[name]; ok {
+		resp.Rcode = rcode
+		return resp
+	}
+	if _, ok := s.records[name]; !ok {
+		resp.Rcode = s.unknown
+		return resp
+	}
+
+	// 沿 CNAME 链收集答案，最多 8 跳
+	for hops := 0; hops < 8; hops++ {
+		var next string
+		for _, rr := range s.records[name] {
+			switch {
+			case rr.Header().Rrtype == q.Qtype:
+				resp.Answer = append(resp.Answer, rr)
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				resp.Answer = append(resp.Answer, rr)
+				next = rr.(*dns.CNAME).Target
+			}
+		}
+		if next == "" || q.Qtype == dns.TypeCNAME {
+			break
+		}
+		name = next
+	}
+	return resp
+}
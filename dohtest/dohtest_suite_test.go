@@ -0,0 +1,13 @@
+package dohtest_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDohtest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dohtest Suite")
+}
@@ -0,0 +1,114 @@
+package dohtest_test
+
+import (
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/dohtest"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		srv *dohtest.Server
+		up  *doh.Upstream
+	)
+
+	queryA := func(domain string) (string, error) {
+		ips, _, err := up.QueryAddrs(domain, doh.TypeA)
+		if err != nil {
+			return "", err
+		}
+		return ips[0], nil
+	}
+
+	BeforeEach(func() {
+		srv = dohtest.NewServer()
+		up = srv.Upstream()
+	})
+
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	It("answers programmed A records", func() {
+		srv.A("vpn.example.com", "10.0.0.1")
+
+		ip, err := queryA("vpn.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.1"))
+		Expect(srv.Queries()).To(HaveLen(1))
+		Expect(srv.Queries()[0].Type).To(Equal(dns.TypeA))
+	})
+
+	It("reports NXDOMAIN for unknown names", func() {
+		_, err := queryA("missing.example.com")
+		Expect(err).To(MatchError(doh.ErrNXDomain))
+	})
+
+	It("reports SERVFAIL when programmed", func() {
+		srv.ServFail("broken.example.com")
+
+		_, err := queryA("broken.example.com")
+		Expect(err).To(MatchError(doh.ErrServFail))
+	})
+
+	It("carries SERVFAIL through the resolver instead of an empty answer", func() {
+		srv.ServFail("broken.example.com")
+
+		r := &dnsmasq.Resolver{
+			Upstream: up,
+			Cache:    dnsmasq.NewCacheWithTTL(time.Minute),
+			Negative: dnsmasq.NewNegativeCache(time.Minute, time.Minute),
+			Logger:   dnsmasq.DiscardLogger,
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			_, err := r.Decide("broken.example.com", qtype)
+			Expect(err).To(MatchError(dnsmasq.ErrServFail))
+			Expect(err).NotTo(MatchError(dnsmasq.ErrNoAnswer))
+
+			// 负缓存命中时仍是 SERVFAIL
+			_, err = r.Decide("broken.example.com", qtype)
+			Expect(err).To(MatchError(dnsmasq.ErrServFail))
+			Expect(err).To(MatchError(dnsmasq.ErrNegativeCached))
+		}
+	})
+
+	It("follows CNAME chains through the resolver and matches rules", func() {
+		srv.CNAME("www.example.com", "edge.cdn.net").A("edge.cdn.net", "10.0.0.2")
+
+		rules := []dnsmasq.Rule{{Suffix: "example.com"}}
+		cache := dnsmasq.NewCacheWithTTL(time.Minute)
+		r := &dnsmasq.Resolver{Upstream: up, Rules: rules, Cache: cache, Logger: dnsmasq.DiscardLogger}
+
+		viaVPN, ip, err := r.Resolve("www.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(viaVPN).To(BeTrue())
+		Expect(ip).To(Equal("10.0.0.2"))
+	})
+
+	It("returns custom handler answers", func() {
+		srv.Handle("custom.example.com", dns.TypeA, func(q *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(q)
+			rr, _ := dns.NewRR("custom.example.com. 30 IN A 192.0.2.7")
+			resp.Answer = append(resp.Answer, rr)
+			return resp
+		})
+
+		ip, err := queryA("custom.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip).To(Equal("192.0.2.7"))
+	})
+
+	It("fails queries with programmed HTTP errors", func() {
+		srv.HTTPError("", 503)
+
+		_, err := queryA("vpn.example.com")
+		Expect(err).To(HaveOccurred())
+	})
+})
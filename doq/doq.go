@@ -0,0 +1,223 @@
+// Package doq is a DNS-over-QUIC client (RFC 9250) usable as a
+// doh.Transport. Every query travels on its own stream of one QUIC
+// connection that is kept open between queries, so a lost packet only
+// delays its own query and a reconnect can resume the TLS session with
+// 0-RTT.
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultPort is the IANA port of DNS over QUIC
+const DefaultPort = "853"
+
+// ALPN is the TLS application protocol of DoQ
+const ALPN = "doq"
+
+const (
+	// DefaultIdleTimeout is how long an unused connection is kept open
+	DefaultIdleTimeout = 30 * time.Second
+	// dialTimeout bounds the handshake when the query's context has no
+	// deadline
+	dialTimeout = 5 * time.Second
+)
+
+// Client sends queries to one DoQ resolver
+type Client struct {
+	// Addr is the resolver's address and port
+	Addr string
+	// ServerName is the name the resolver's certificate is verified
+	// against; the host of Addr when empty
+	ServerName string
+	// TLSConfig, when set, is the base of the TLS configuration, e.g. to
+	// pin certificate hashes with VerifyConnection
+	TLSConfig *tls.Config
+	// Control, when set, is applied to the UDP socket before it is used
+	// (see net.ListenConfig.Control)
+	Control func(network, address string, c syscall.RawConn) error
+	// ControlContext, when set, is used instead of Control with the
+	// context of the query that creates the socket
+	ControlContext func(ctx context.Context, network, address string, c syscall.RawConn) error
+	// IdleTimeout is how long an unused connection is kept open (default
+	// DefaultIdleTimeout)
+	IdleTimeout time.Duration
+
+	mu        sync.Mutex
+	transport *quic.Transport
+	tokens    quic.TokenStore
+	conn      *quic.Conn
+	config    *tls.Config
+}
+
+// RoundTrip sends a packed query and returns the packed response. A query
+// on a connection the resolver closed meanwhile is retried once on a
+// fresh one.
+func (c *Client) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("short DNS query")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	conn, fresh, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchange(ctx, conn, query)
+	if err != nil && !fresh && ctx.Err() == nil {
+		c.drop(conn)
+		if conn, _, err = c.connect(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = exchange(ctx, conn, query)
+	}
+	return resp, err
+}
+
+// exchange sends query on a new stream of conn. The message ID is 0 on
+// the wire, as RFC 9250 requires, and restored in the response.
+func exchange(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	// 上下文被取消时立即中断读写
+	stop := context.AfterFunc(ctx, func() { stream.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	framed = append(framed, query...)
+	framed[2], framed[3] = 0, 0
+	if _, err := stream.Write(framed); err != nil {
+		return nil, err
+	}
+	// 发送完毕后关闭写方向，服务器据此知道查询已结束
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(stream, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < 2 {
+		return nil, errors.New("short DoQ response")
+	}
+	buf[0], buf[1] = query[0], query[1]
+	return buf, nil
+}
+
+// connect returns the open connection, dialing one when there's none, and
+// whether it was just dialed
+func (c *Client) connect(ctx context.Context) (*quic.Conn, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		if c.conn.Context().Err() == nil {
+			return c.conn, false, nil
+		}
+		c.conn = nil
+	}
+
+	if c.transport == nil {
+		lc := net.ListenConfig{Control: c.Control}
+		if c.ControlContext != nil {
+			lc.Control = func(network, address string, rc syscall.RawConn) error {
+				return c.ControlContext(ctx, network, address, rc)
+			}
+		}
+		pc, err := lc.ListenPacket(ctx, "udp", ":0")
+		if err != nil {
+			return nil, false, err
+		}
+		c.transport = &quic.Transport{Conn: pc}
+		c.tokens = quic.NewLRUTokenStore(4, 4)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.Addr)
+	if err != nil {
+		return nil, false, err
+	}
+	timeout := c.IdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleTimeout
+	}
+	conn, err := c.transport.DialEarly(ctx, addr, c.tlsConfig(), &quic.Config{
+		MaxIdleTimeout: timeout,
+		TokenStore:     c.tokens,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	c.conn = conn
+	return conn, true, nil
+}
+
+// drop closes conn unless it was replaced meanwhile
+func (c *Client) drop(conn *quic.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+// tlsConfig returns the TLS configuration shared by every connection, so
+// they share its session cache. Called with c.mu held.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.config == nil {
+		config := &tls.Config{MinVersion: tls.VersionTLS13}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if c.ServerName != "" {
+			config.ServerName = c.ServerName
+		} else if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(c.Addr)
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+		}
+		config.NextProtos = []string{ALPN}
+		c.config = config
+	}
+	return c.config
+}
+
+// Close closes the connection and its socket
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.CloseWithError(0, "")
+		c.conn = nil
+	}
+	if c.transport == nil {
+		return nil
+	}
+	err := c.transport.Close()
+	c.transport.Conn.Close()
+	c.transport = nil
+	return err
+}
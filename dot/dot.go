@@ -0,0 +1,203 @@
+// Package dot is a DNS-over-TLS client (RFC 7858) usable as a
+// doh.Transport, for networks that block HTTPS to public DoH providers but
+// allow port 853. Connections are kept open and reused between queries,
+// and TLS sessions are resumed when a connection has to be redialed.
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultPort is the IANA port of DNS over TLS
+const DefaultPort = "853"
+
+const (
+	// DefaultIdleTimeout is how long an unused connection is kept open
+	DefaultIdleTimeout = 30 * time.Second
+	// maxIdle bounds the open connections kept for reuse
+	maxIdle = 4
+	// dialTimeout bounds the TCP connect and TLS handshake when the
+	// query's context has no deadline
+	dialTimeout = 5 * time.Second
+)
+
+// Client sends queries to one DoT resolver
+type Client struct {
+	// Addr is the resolver's address and port
+	Addr string
+	// ServerName is the name the resolver's certificate is verified
+	// against; the host of Addr when empty
+	ServerName string
+	// TLSConfig, when set, is the base of the TLS configuration, e.g. to
+	// pin certificate hashes with VerifyConnection
+	TLSConfig *tls.Config
+	// Control, when set, is applied to every socket before it connects
+	// (see net.Dialer.Control)
+	Control func(network, address string, c syscall.RawConn) error
+	// ControlContext, when set, is used instead of Control (see
+	// net.Dialer.ControlContext)
+	ControlContext func(ctx context.Context, network, address string, c syscall.RawConn) error
+	// IdleTimeout is how long an unused connection is kept open (default
+	// DefaultIdleTimeout)
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*conn
+	config *tls.Config
+}
+
+// conn is an open connection and when it was last used
+type conn struct {
+	*tls.Conn
+	used time.Time
+}
+
+// RoundTrip sends a packed query and returns the packed response. A query
+// on a reused connection the resolver closed meanwhile is retried once on
+// a fresh one.
+func (c *Client) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	if cn := c.get(); cn != nil {
+		resp, err := c.exchange(ctx, cn, query)
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, cn, query)
+}
+
+// exchange sends query on cn and keeps cn for reuse if it answered
+func (c *Client) exchange(ctx context.Context, cn *conn, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	cn.SetDeadline(deadline)
+	// 上下文被取消时立即中断读写
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(time.Unix(1, 0)) })
+	resp, err := roundTrip(cn, query)
+	if !stop() || err != nil {
+		cn.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	c.put(cn)
+	return resp, nil
+}
+
+// roundTrip writes query and reads one reply, both framed with a length
+// prefix
+func roundTrip(cn *conn, query []byte) ([]byte, error) {
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := cn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(cn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(cn, buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < 2 || len(query) < 2 || buf[0] != query[0] || buf[1] != query[1] {
+		return nil, errors.New("DoT response ID does not match the query")
+	}
+	return buf, nil
+}
+
+// get returns the most recently used idle connection, closing those idle
+// for longer than IdleTimeout
+func (c *Client) get() *conn {
+	timeout := c.IdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.idle) > 0 {
+		cn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if time.Since(cn.used) < timeout {
+			return cn
+		}
+		cn.Close()
+	}
+	return nil
+}
+
+// put keeps cn for reuse, closing it when enough connections are idle
+func (c *Client) put(cn *conn) {
+	cn.SetDeadline(time.Time{})
+	cn.used = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// dial opens a new connection, resuming an earlier TLS session if the
+// resolver still knows it
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	d := tls.Dialer{NetDialer: &net.Dialer{Control: c.Control, ControlContext: c.ControlContext}, Config: c.tlsConfig()}
+	nc, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc.(*tls.Conn)}, nil
+}
+
+// tlsConfig returns the TLS configuration shared by every connection, so
+// they share its session cache
+func (c *Client) tlsConfig() *tls.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config == nil {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if c.ServerName != "" {
+			config.ServerName = c.ServerName
+		} else if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(c.Addr)
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+		}
+		c.config = config
+	}
+	return c.config
+}
+
+// Close closes the idle connections
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
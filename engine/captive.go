@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"openvpnadvanced/captive"
+	"openvpnadvanced/events"
+)
+
+// captiveRecheck is how often a detected portal is probed until it clears
+const captiveRecheck = 5 * time.Second
+
+// CaptivePortal returns the local resolver queries are passed through to
+// while a captive portal is detected, or "" during normal operation
+func (e *Engine) CaptivePortal() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return ""
+	}
+	return e.server.PassThrough()
+}
+
+// watchCaptive probes for a captive portal every CaptiveInterval and
+// after the network changed. Behind one, DNS is passed through to the
+// network's resolver with no routes injected so the login page can load;
+// once the probe succeeds again, normal operation resumes.
+func (e *Engine) watchCaptive(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	changed, stop := e.notify(events.NetworkChanged)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+
+		next := e.opts.CaptiveInterval
+		if e.checkCaptive(ctx) {
+			next = captiveRecheck
+		}
+		timer.Reset(next)
+	}
+}
+
+// checkCaptive runs one probe, switches pass-through on or off and reports
+// whether a portal is active
+func (e *Engine) checkCaptive(ctx context.Context) bool {
+	resolver, err := e.localResolver(e.opts.DDRResolver)
+	if err != nil {
+		e.logf("⚠️ Captive portal check skipped: %v", err)
+		return false
+	}
+	prober := &captive.Prober{URL: e.opts.CaptiveURL, Resolver: resolver}
+	state, err := prober.Probe(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return false
+	}
+	active := e.server.PassThrough() != ""
+	switch {
+	case state == captive.Portal && !active:
+		e.logf("⚠️ Captive portal detected (%v), passing DNS through to %s until it clears", err, resolver)
+		e.server.SetPassThrough(resolver)
+		return true
+	case state == captive.Open && active:
+		e.logf("✅ Captive portal cleared, resuming normal operation")
+		e.server.SetPassThrough("")
+		return false
+	}
+	// 离线时保持当前模式
+	return active
+}
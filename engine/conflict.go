@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"openvpnadvanced/vpn"
+)
+
+// CoexistMode decides how the engine behaves when another VPN client or
+// Tailscale manages routes or DNS on the same machine
+type CoexistMode int
+
+const (
+	// CoexistOff only warns about conflicts
+	CoexistOff CoexistMode = iota
+	// CoexistAuto switches to coexistence mode when a conflict manages
+	// routes or DNS
+	CoexistAuto
+	// CoexistOn always runs in coexistence mode
+	CoexistOn
+)
+
+// ParseCoexistMode parses "off", "auto" or "on"
+func ParseCoexistMode(s string) (CoexistMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off":
+		return CoexistOff, nil
+	case "auto":
+		return CoexistAuto, nil
+	case "on":
+		return CoexistOn, nil
+	}
+	return 0, fmt.Errorf("unknown coexist mode %q (want off, auto or on)", s)
+}
+
+func (m CoexistMode) String() string {
+	switch m {
+	case CoexistAuto:
+		return "auto"
+	case CoexistOn:
+		return "on"
+	default:
+		return "off"
+	}
+}
+
+// Conflicts returns what was detected managing DNS or routes at the last
+// Start, and whether the engine runs in coexistence mode
+func (e *Engine) Conflicts() ([]vpn.Conflict, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.conflicts), e.coexist
+}
+
+// detectConflicts logs every conflict and decides on coexistence mode.
+// Called by Start with mu held.
+func (e *Engine) detectConflicts() {
+	e.conflicts = vpn.DetectConflicts(context.Background())
+	routes := false
+	for _, c := range e.conflicts {
+		e.logf("⚠️ Detected %s", c)
+		routes = routes || c.Routes
+	}
+	e.coexist = e.opts.Coexist == CoexistOn || (e.opts.Coexist == CoexistAuto && routes)
+	if e.coexist {
+		e.logf("🤝 Coexistence mode: leaving the default route and port 53 to other VPN clients, serving DNS on %s", e.opts.CoexistListenAddr)
+	} else if routes {
+		e.logf("⚠️ Another VPN client manages routes or DNS; set coexist = auto to stop fighting over them")
+	}
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"openvpnadvanced/ddr"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/events"
+	"openvpnadvanced/vpn"
+)
+
+// Designated returns the verified designated resolver DIRECT domains are
+// resolved through, if DDR found one
+func (e *Engine) Designated() (ddr.Designated, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.designated == nil {
+		return ddr.Designated{}, false
+	}
+	return *e.designated, true
+}
+
+// discoverDDR runs discovery on Start, every DDRInterval and after the
+// network changed until ctx is canceled. Failures fall back to the public
+// upstream and are retried.
+func (e *Engine) discoverDDR(ctx context.Context) error {
+	ticker := time.NewTicker(e.opts.DDRInterval)
+	defer ticker.Stop()
+	changed, stop := e.notify(events.NetworkChanged)
+	defer stop()
+
+	for first := true; ; first = false {
+		e.refreshDDR(ctx, first)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// refreshDDR looks up and verifies the designated resolver and swaps it in
+// (or out) as the Direct upstream, logging only changes and the first
+// failure
+func (e *Engine) refreshDDR(ctx context.Context, first bool) {
+	var found *ddr.Designated
+	var up *doh.Upstream
+	resolver, err := e.localResolver(e.opts.DDRResolver)
+	if err == nil {
+		var d ddr.Designated
+		d, up, err = ddr.Find(ctx, resolver)
+		if err == nil {
+			found = &d
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	e.mu.Lock()
+	prev := e.designated
+	e.designated = found
+	e.mu.Unlock()
+
+	switch {
+	case found != nil && (prev == nil || prev.URL() != found.URL() || prev.Resolver != found.Resolver):
+		e.logf("✅ Using designated resolver %s of %s for DIRECT domains", found.URL(), found.Resolver)
+	case found == nil && prev != nil:
+		e.logf("⚠️ Designated resolver %s lost (%v), using the default upstream", prev.URL(), err)
+	case found == nil && first:
+		e.logf("No designated resolver: %v", err)
+	}
+	e.swap(func(sn *dnsproxy.Snapshot) {
+		sn.Direct = e.scoped(up)
+	})
+}
+
+// localResolver returns the network's unencrypted resolver: override when
+// set, else the first non-loopback system nameserver or the default gateway
+func (e *Engine) localResolver(override string) (string, error) {
+	if override != "" {
+		if _, _, err := net.SplitHostPort(override); err != nil {
+			override = net.JoinHostPort(override, "53")
+		}
+		return override, nil
+	}
+	if resolver, err := ddr.SystemResolver(); err == nil {
+		return resolver, nil
+	}
+	// 系统 DNS 指向本进程时，家用路由器通常就是网络的解析器
+	gateway, _, err := vpn.GetDefaultGateway()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(gateway, "53"), nil
+}
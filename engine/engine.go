@@ -0,0 +1,1381 @@
+// Package engine embeds the split-tunnel DNS engine: it loads domain rules,
+// resolves queries over DoH with a cache, answers DNS clients and installs
+// routes through the VPN interface for matched domains.
+//
+// An Engine holds all of its state, so several engines can live in one
+// process and be started and stopped independently:
+//
+//	eng, err := engine.New(engine.Options{
+//		RulePath:   "assets/merged_rule.list",
+//		ListenAddr: "127.0.0.1:5353",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := eng.Start(); err != nil {
+//		return err
+//	}
+//	defer eng.Stop()
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/analytics"
+	"openvpnadvanced/clients"
+	"openvpnadvanced/ddr"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/events"
+	"openvpnadvanced/exprrules"
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/fetcher"
+	"openvpnadvanced/geodata"
+	"openvpnadvanced/geoip"
+	"openvpnadvanced/handoff"
+	"openvpnadvanced/history"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/leaktest"
+	"openvpnadvanced/limits"
+	"openvpnadvanced/metrics"
+	"openvpnadvanced/peersync"
+	"openvpnadvanced/privhelper"
+	"openvpnadvanced/probe"
+	"openvpnadvanced/qos"
+	"openvpnadvanced/querylog"
+	"openvpnadvanced/replay"
+	"openvpnadvanced/rewrite"
+	"openvpnadvanced/safesearch"
+	"openvpnadvanced/telemetry"
+	"openvpnadvanced/vpn"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// Options configures an Engine. Zero values fall back to the defaults
+// used by the openvpnadvanced daemon.
+type Options struct {
+	// RulePath is the rule list to load; ignored when Rules is set
+	RulePath string
+	// Rules are preloaded rules, used instead of reading RulePath
+	Rules []dnsmasq.Rule
+	// CompileRules streams RulePath into a dnsmasq.RuleTrie instead of a
+	// []Rule, keeping memory bounded for million-line blocklists. Rules()
+	// returns nil in this mode.
+	CompileRules bool
+	// RuleDBPath caches the compiled rules at this path and memory-maps it,
+	// recompiling only when RulePath changes; implies CompileRules
+	RuleDBPath string
+	// RuleGroups are rule lists layered over RulePath that can be
+	// switched on and off at runtime; RuleGroupStatePath keeps the
+	// toggles across restarts (not saved when empty)
+	RuleGroups         []RuleGroup
+	RuleGroupStatePath string
+
+	// Exprs are expression rules evaluated when no static rule matches;
+	// loaded from the EXPR lines of RulePath when nil
+	Exprs *exprrules.Set
+	// Rewrites override answers for selected names; loaded from the
+	// REWRITE lines of RulePath when nil
+	Rewrites *rewrite.Set
+
+	// CNAMEMatch decides whether the rules are also matched against the
+	// CNAMEs of an answer, and which match wins (default: the query name,
+	// then each CNAME in chain order)
+	CNAMEMatch dnsproxy.CNAMEMatch
+	// MaxCNAMEDepth is how many CNAMEs are followed before a query fails
+	// (default 10). PartialChain logs and records the CNAMEs followed by
+	// failed resolutions, to diagnose broken CDN configurations.
+	MaxCNAMEDepth int
+	PartialChain  bool
+
+	// Cache stores resolved answers; an in-memory cache with CacheTTL when nil
+	Cache dnsmasq.CacheBackend
+	// CacheTTL is how long resolved answers are reused (default 10m) by
+	// caches that can't expire entries individually, and for answers whose
+	// record TTL is unknown
+	CacheTTL time.Duration
+	// CacheMinTTL and CacheMaxTTL clamp the record TTLs answers are cached
+	// for; zero doesn't clamp
+	CacheMinTTL time.Duration
+	CacheMaxTTL time.Duration
+	// CacheStale lets the default in-memory cache serve answers for up to
+	// this long past their TTL while a single query refreshes them in the
+	// background; answers about to expire are refreshed ahead the same
+	// way. Zero turns it off.
+	CacheStale time.Duration
+	// NegativeTTL is how long NXDOMAIN and empty answers are remembered,
+	// ServFailTTL the same for timeouts and other failures, so names that
+	// don't resolve aren't sent upstream on every query; zero doesn't
+	// remember them
+	NegativeTTL time.Duration
+	ServFailTTL time.Duration
+	// AnswerOrder decides which address of an answer holding several is
+	// returned and routed (default: the upstream's first)
+	AnswerOrder AnswerOrder
+	// QueryTimeout bounds each resolution as a whole, sharing one deadline
+	// between the A, AAAA, CNAME and fallback queries of a chain, so
+	// clients get an answer or SERVFAIL in predictable time; zero leaves
+	// each upstream query its own 5s timeout
+	QueryTimeout time.Duration
+	// AddressFamily orders the addresses of ResolveFull, which queries the
+	// A and AAAA records concurrently (default dnsmasq.PreferIPv4)
+	AddressFamily dnsmasq.Family
+	// CachePath persists the cache across restarts; empty disables it
+	CachePath string
+	// CacheSaveInterval is how often the cache is written to CachePath (default 30s)
+	CacheSaveInterval time.Duration
+	// StatePath snapshots the runtime state (cache, installed routes, rule
+	// hit counters) on Stop and restores it in New, so an upgraded daemon
+	// carries on where the previous one stopped; empty disables it
+	StatePath string
+
+	// Upstream answers the engine's queries; doh.Endpoint when nil
+	Upstream *doh.Upstream
+	// DoHHeader is added to the engine's DoH requests;
+	// doh.DefaultHeader when nil
+	DoHHeader http.Header
+
+	// ListenAddr is the UDP/TCP DNS listen address (default ":53")
+	ListenAddr string
+	// Inherited are sockets passed on by the process this one replaces
+	// (see Handoff), served by the first Start instead of binding the
+	// listen address they were bound for; closed when it differs
+	Inherited *handoff.Sockets
+	// ResolveWorkers bounds concurrent resolutions (default 64)
+	ResolveWorkers int
+	// ResolveQueue bounds resolutions waiting for a worker; queries beyond
+	// it are answered with SERVFAIL (default 1024)
+	ResolveQueue int
+	// UDP tunes the UDP listener: readers, workers, the queue of queries
+	// read but not yet handled, and the socket buffer sizes
+	UDP dnsproxy.UDPOptions
+	// MaxUpstreamQueries bounds concurrent DoH queries; queries wait for a
+	// slot up to the query timeout (default 256, negative for unlimited)
+	MaxUpstreamQueries int
+	// MaxRouteOps bounds concurrent route changes (default 16, negative
+	// for unlimited)
+	MaxRouteOps int
+	// MaxConnections bounds concurrent TCP DNS client connections
+	// (default 512, negative for unlimited)
+	MaxConnections int
+	// ResolveAAAA answers AAAA queries and routes matched IPv6 addresses;
+	// by default AAAA queries get an empty answer so clients use IPv4
+	ResolveAAAA bool
+	// FilterAAAA lists domain suffixes whose AAAA answers are still
+	// suppressed with ResolveAAAA, e.g. sites with broken IPv6 over the VPN
+	FilterAAAA []string
+	// HTTPSRecords forwards HTTPS (type 65) queries instead of answering
+	// them empty. ECH decides whether their ECH configs are stripped
+	// (default: for matched domains); ECHStrip and ECHPass override it
+	// per suffix.
+	HTTPSRecords bool
+	ECH          dnsproxy.ECHPolicy
+	ECHStrip     []string
+	ECHPass      []string
+	// SafeSearch rewrites search engine and YouTube queries to their
+	// safe-search endpoints per client profile; off when nil
+	SafeSearch *safesearch.Policy
+	// Clients identifies LAN clients by address, MAC or EDNS client-id,
+	// tags their queries in the replay recording, hooks and per-client
+	// query counters, selects their safe-search profile and rate-limits
+	// them; clients are only known by address when nil
+	Clients *clients.Registry
+	// VPNInterface receives routes for matched domains; detected when empty
+	VPNInterface string
+	// FixRoutes removes the VPN catch-all routes and restores the local
+	// default gateway on Start
+	FixRoutes bool
+	// Coexist decides what happens when Tailscale or another VPN client
+	// manages routes or DNS (see vpn.DetectConflicts); conflicts are always
+	// logged. In coexistence mode FixRoutes is skipped and DNS is served on
+	// CoexistListenAddr instead of ListenAddr. Tunnels of detected
+	// conflicts never receive routes either way.
+	Coexist CoexistMode
+	// CoexistListenAddr is the DNS listen address in coexistence mode
+	// (default "127.0.0.1:5353")
+	CoexistListenAddr string
+	// VPNDown decides whether matched domains go DIRECT, with their routes
+	// withdrawn, while the VPN interface is down, instead of being routed
+	// into the dead tunnel (the default). VPNDownDirect and VPNDownBlock
+	// override it per suffix. Everything is restored when the interface
+	// comes back.
+	VPNDown       dnsproxy.VPNDownPolicy
+	VPNDownDirect []string
+	VPNDownBlock  []string
+	// Reject decides how queries for domains a REJECT rule matches are
+	// answered: 0.0.0.0 and :: (the default) or NXDOMAIN
+	Reject dnsproxy.RejectPolicy
+	// VerifyUpstream cross-checks answers for the VerifyDomains suffixes
+	// against a second, independent provider; Verify decides what happens
+	// when they disagree (default: answer with VerifyUpstream's address)
+	VerifyUpstream *doh.Upstream
+	VerifyDomains  []string
+	Verify         dnsproxy.VerifyPolicy
+	// UpstreamMark is the DSCP/fwmark set on the upstream DoH and DNSCrypt
+	// sockets; QoS marks traffic to the routed addresses of each class's
+	// domains (Linux only)
+	UpstreamMark qos.Mark
+	QoS          []qos.Class
+	// Helper performs privileged operations when the process isn't root
+	Helper *privhelper.Client
+	// Actions are the custom rule actions of this engine by name
+	// (case-insensitive), e.g. those of an actions.Registry
+	Actions map[string]actions.Action
+
+	// Hooks are notified of resolutions, rule matches, injected routes and
+	// VPN interface changes
+	Hooks *hooks.Hooks
+	// VPNCheckInterval is how often the VPN interface and the default
+	// route are checked for changes (default 5s)
+	VPNCheckInterval time.Duration
+	// FlushOnReconnect flushes the cache whenever the VPN comes back, so
+	// answers cached while it was down or on another network are asked
+	// again
+	FlushOnReconnect bool
+
+	// GeoData keeps GeoIP/GeoSite databases current while running; rules
+	// are reloaded whenever one of its files changes
+	GeoData *geodata.Manager
+	// GeoIP locates resolved addresses for GEOIP rules. It is reloaded
+	// when its file changes while running, and right away when GeoData
+	// replaced it.
+	GeoIP *geoip.DB
+	// Subscriptions refreshes the remote rule lists merged into RulePath
+	// while running; rules are reloaded whenever the merged list changes
+	Subscriptions *fetcher.Subscriptions
+	// WatchRules reloads the rules while running whenever RulePath or a
+	// rule group list is edited
+	WatchRules bool
+
+	// DDR discovers the network resolver's designated DoH endpoint (RFC
+	// 9462) and resolves domains that don't match the rules through it
+	// while it verifies, instead of the public DoH upstream
+	DDR bool
+	// DDRResolver is the unencrypted resolver asked for its designated
+	// endpoint; the first non-loopback nameserver of /etc/resolv.conf, or
+	// the default gateway, when empty
+	DDRResolver string
+	// DDRInterval is how often discovery is repeated, to follow network
+	// changes (default 10m)
+	DDRInterval time.Duration
+
+	// NAT64Detect looks for a NAT64 gateway (RFC 7050) through the
+	// network's resolver (see DDRResolver) on Start and every
+	// NAT64Interval (default 10m). NAT64Prefix sets the prefix instead.
+	// With a prefix, AAAA answers are synthesized for names with only A
+	// records, so IPv6-only clients reach them, and routed domains get
+	// their NAT64 addresses translated back to IPv4 and routed through
+	// the VPN.
+	NAT64Detect   bool
+	NAT64Prefix   netip.Prefix
+	NAT64Interval time.Duration
+
+	// FakeIP, when valid, answers domains routed through the VPN with
+	// addresses from this IPv4 range (e.g. fakeip.DefaultRange), which is
+	// routed through the VPN on Start, instead of installing a host route
+	// per answer; connections are translated to the real addresses
+	// (Linux only). FakeIPTTL is the TTL of fake answers (default
+	// fakeip.DefaultTTL).
+	FakeIP    netip.Prefix
+	FakeIPTTL time.Duration
+
+	// CaptiveDetect probes for captive portals. Behind one, DNS is passed
+	// through to the network's resolver (see DDRResolver) without routes
+	// until the portal is cleared.
+	CaptiveDetect bool
+	// CaptiveURL is the probe URL (default captive.DefaultURL)
+	CaptiveURL string
+	// CaptiveInterval is how often the network is probed (default 1m);
+	// a detected portal is rechecked every few seconds
+	CaptiveInterval time.Duration
+
+	// OfflineDetect probes the upstream every OfflineInterval (default
+	// 30s). While it can't be reached, queries are answered from the cache
+	// only and the rest get SERVFAIL at once instead of timing out.
+	OfflineDetect   bool
+	OfflineInterval time.Duration
+
+	// TelemetryURL, when set, receives an anonymous usage report (see
+	// package telemetry) every TelemetryInterval while running (default
+	// 24h); nothing is sent when empty
+	TelemetryURL      string
+	TelemetryInterval time.Duration
+
+	// WarmUp lists domains resolved right after Start, their routes
+	// installed, so the first queries after boot are fast; WarmUpTop adds
+	// that many of the most-hit rules restored from StatePath
+	WarmUp    []string
+	WarmUpTop int
+
+	// ProbeTargets, when set, are host:port addresses probed with TCP
+	// handshakes through the VPN and the direct egress every ProbeInterval
+	// (default 30s) to measure RTT and loss. With ProbeFallback the VPN is
+	// treated as down, as if its interface had gone, while no probe
+	// through it has been answered for ProbeDownRounds rounds.
+	ProbeTargets  []string
+	ProbeInterval time.Duration
+	ProbeFallback bool
+
+	// SyncListen and SyncPeers share overrides and cache hints with other
+	// instances (see package peersync): SyncListen receives them, SyncPeers
+	// are sent to. Messages are encrypted with SyncSecret, which every
+	// instance must share. SyncID names this instance (the hostname when
+	// empty).
+	SyncListen string
+	SyncPeers  []string
+	SyncSecret string
+	SyncID     string
+
+	// MetricsListen serves Prometheus metrics (see package metrics) at
+	// /metrics on this address; empty disables them
+	MetricsListen string
+
+	// LeakTest runs the checks of the LeakTest method
+	LeakTest leaktest.Tester
+
+	// ReplayPath records every resolution and routing decision to this
+	// file while running, for later replay (see package replay); empty
+	// disables recording
+	ReplayPath string
+
+	// HistoryPath keeps every resolution in this SQLite database while
+	// running (see package history), pruned to HistoryRetention; empty
+	// disables the history
+	HistoryPath      string
+	HistoryRetention history.Retention
+
+	// QueryLog keeps the latest resolutions in memory while running, and
+	// appends them to QueryLog.File when set (see package querylog); nil
+	// disables it
+	QueryLog *querylog.Options
+
+	// Logger receives all engine and resolver output. When set, the colored
+	// per-query console lines are also turned off. Use dnsmasq.DiscardLogger
+	// to silence the engine entirely.
+	Logger dnsmasq.Logger
+}
+
+// Engine is a running split-tunnel engine instance
+type Engine struct {
+	opts   Options
+	router *vpn.Router
+	server *dnsproxy.DNSServer
+	logger dnsmasq.Logger
+	// events carries VPN, network and rule changes between the modules
+	events *events.Bus
+
+	// snapshot holds the rules and cache; reloads replace it copy-on-write
+	snapshot atomic.Pointer[dnsproxy.Snapshot]
+	swapMu   sync.Mutex
+	state    *dnsproxy.State
+	// overrides are the runtime overrides set with Override
+	overrides *dnsproxy.Overrides
+	// pins are the runtime pins set with Pin
+	pins *dnsproxy.Pins
+	// groupMu guards the rule groups and the rules of RulePath they are
+	// layered over
+	groupMu     sync.Mutex
+	groups      []*ruleGroup
+	baseRules   []dnsmasq.Rule
+	baseMatcher dnsmasq.RuleMatcher
+
+	upstreamLimit *limits.Limiter
+	connLimit     *limits.Limiter
+	// dohSettings carry the upstream limit, DoH headers and socket mark of
+	// the engine's queries; upstream is Options.Upstream queried with them
+	dohSettings *doh.Settings
+	upstream    *doh.Upstream
+	// actions are Options.Actions keyed by upper-case name
+	actions map[string]actions.Action
+	// restored are routes from StatePath not yet reinstalled
+	restored []dnsproxy.Route
+	// withdrawn are routes removed while the VPN is down, guarded by mu
+	withdrawn []dnsproxy.Route
+	// telemetry sends usage reports when TelemetryURL is set
+	telemetry *telemetry.Reporter
+	// prober measures the egresses when ProbeTargets is set
+	prober *probe.Prober
+	// sync shares overrides and cache hints when SyncListen or SyncPeers
+	// is set
+	sync *peersync.Node
+	// metrics outlive Stop and Start, so counters keep growing
+	metrics *metrics.Metrics
+	// probeDown is set while ProbeFallback holds the VPN down, guarded
+	// by mu
+	probeDown bool
+	// designated is the verified DDR endpoint in use, guarded by mu
+	designated *ddr.Designated
+	// conflicts were detected by the last Start, which also decided on
+	// coexistence mode; guarded by mu
+	conflicts []vpn.Conflict
+	coexist   bool
+	// checkpoint awaits Confirm before it rolls back, guarded by
+	// rollbackMu
+	rollbackMu sync.Mutex
+	checkpoint *checkpoint
+
+	// lifeMu serializes Start and Stop. mu guards the fields below and is
+	// never held while waiting for background goroutines, so they may
+	// take it themselves.
+	lifeMu  sync.Mutex
+	mu      sync.Mutex
+	running bool
+	// cancel and group own every background goroutine of a running
+	// engine: Stop cancels the context and waits for the group
+	cancel context.CancelFunc
+	group  *errgroup.Group
+}
+
+// ErrAlreadyRunning is returned by Start on a running engine
+var ErrAlreadyRunning = errors.New("engine already running")
+
+// New loads rules and the persisted cache and returns a stopped engine
+func New(opts Options) (*Engine, error) {
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = 10 * time.Minute
+	}
+	if opts.CacheSaveInterval <= 0 {
+		opts.CacheSaveInterval = 30 * time.Second
+	}
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = ":53"
+	}
+	if opts.CoexistListenAddr == "" {
+		opts.CoexistListenAddr = "127.0.0.1:5353"
+	}
+	if opts.VPNCheckInterval <= 0 {
+		opts.VPNCheckInterval = 5 * time.Second
+	}
+	if opts.MaxUpstreamQueries == 0 {
+		opts.MaxUpstreamQueries = 256
+	}
+	if opts.MaxRouteOps == 0 {
+		opts.MaxRouteOps = 16
+	}
+	if opts.MaxConnections == 0 {
+		opts.MaxConnections = 512
+	}
+	if opts.DDRInterval <= 0 {
+		opts.DDRInterval = 10 * time.Minute
+	}
+	if opts.CaptiveInterval <= 0 {
+		opts.CaptiveInterval = time.Minute
+	}
+	if opts.NAT64Interval <= 0 {
+		opts.NAT64Interval = 10 * time.Minute
+	}
+	if opts.FakeIPTTL <= 0 {
+		opts.FakeIPTTL = fakeip.DefaultTTL
+	}
+	if opts.OfflineInterval <= 0 {
+		opts.OfflineInterval = 30 * time.Second
+	}
+
+	sn := &dnsproxy.Snapshot{
+		Rules: opts.Rules, Exprs: opts.Exprs, Rewrites: opts.Rewrites,
+		CNAMEMatch: opts.CNAMEMatch, MaxCNAMEDepth: opts.MaxCNAMEDepth, PartialChain: opts.PartialChain,
+		MinTTL: opts.CacheMinTTL, MaxTTL: opts.CacheMaxTTL, Timeout: opts.QueryTimeout,
+		Prefer: opts.AddressFamily, Negative: dnsmasq.NewNegativeCache(opts.NegativeTTL, opts.ServFailTTL),
+		NAT64: opts.NAT64Prefix,
+	}
+	if sn.Rules == nil {
+		if opts.RulePath == "" {
+			return nil, errors.New("either Rules or RulePath must be set")
+		}
+		var err error
+		sn.Rules, sn.Matcher, err = loadRules(opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sn.Matcher = dnsmasq.NewRuleIndex(sn.Rules)
+	}
+	if sn.Exprs == nil && opts.RulePath != "" {
+		exprs, err := exprrules.LoadFile(opts.RulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load expression rules: %v", err)
+		}
+		sn.Exprs = exprs
+	}
+	if sn.Rewrites == nil && opts.RulePath != "" {
+		rewrites, err := rewrite.LoadFile(opts.RulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rewrite rules: %v", err)
+		}
+		sn.Rewrites = rewrites
+	}
+	groups, err := loadGroups(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FakeIP.IsValid() {
+		if runtime.GOOS != "linux" {
+			return nil, vpn.ErrFakeIPUnsupported
+		}
+		if _, err := fakeip.New(opts.FakeIP); err != nil {
+			return nil, err
+		}
+	}
+
+	cache := opts.Cache
+	if cache == nil {
+		mem := dnsmasq.NewCacheWithTTL(opts.CacheTTL)
+		mem.SetStale(opts.CacheStale)
+		cache = mem
+	}
+	restored := 0
+	if opts.CachePath != "" {
+		rawCache, err := dnsmasq.LoadCacheFile(opts.CachePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DNS cache: %v", err)
+		}
+		// 过期的记录不再恢复，其余的保留剩余 TTL
+		restored = dnsmasq.RestoreCache(cache, rawCache, opts.CacheTTL)
+	}
+
+	sn.Cache = cache
+	if opts.GeoIP != nil {
+		sn.GeoIP = opts.GeoIP
+	}
+
+	e := &Engine{
+		opts:   opts,
+		router: &vpn.Router{Helper: opts.Helper, Limiter: limits.New("route operations", opts.MaxRouteOps)},
+		logger: opts.Logger,
+		events: events.New(),
+		state:  dnsproxy.NewState(),
+
+		overrides:     dnsproxy.NewOverrides(),
+		pins:          dnsproxy.NewPins(),
+		upstreamLimit: limits.New("upstream queries", opts.MaxUpstreamQueries),
+		connLimit:     limits.New("client connections", opts.MaxConnections),
+	}
+	e.dohSettings = &doh.Settings{Header: opts.DoHHeader, Limiter: e.upstreamLimit, Control: opts.UpstreamMark.Control()}
+	e.upstream = e.scoped(opts.Upstream)
+	if e.upstream == nil {
+		e.upstream = e.scoped(&doh.Upstream{URL: doh.Endpoint})
+	}
+	sn.Upstream = e.upstream
+	for name, a := range opts.Actions {
+		if e.actions == nil {
+			e.actions = make(map[string]actions.Action)
+		}
+		e.actions[strings.ToUpper(name)] = a
+	}
+	e.subscribe()
+	sn.Sorter = e.sorter()
+	e.groups, e.baseRules, e.baseMatcher = groups, sn.Rules, sn.Matcher
+	sn.Rules, sn.Matcher = e.layered()
+	e.snapshot.Store(sn)
+	if restored > 0 {
+		e.logf("📦 Restored %d cache entries from %s", restored, opts.CachePath)
+	}
+	if len(opts.ProbeTargets) > 0 {
+		e.prober = &probe.Prober{
+			Targets:  opts.ProbeTargets,
+			Interval: opts.ProbeInterval,
+			Egresses: e.egresses,
+			OnRound:  e.probed,
+		}
+	}
+	if opts.TelemetryURL != "" {
+		e.telemetry = &telemetry.Reporter{
+			URL:      opts.TelemetryURL,
+			Interval: opts.TelemetryInterval,
+			Stats: func() telemetry.Stats {
+				return telemetry.Stats{Rules: e.RuleCount(), Queries: e.Queries()}
+			},
+		}
+	}
+	if opts.SyncListen != "" || len(opts.SyncPeers) > 0 {
+		if opts.SyncSecret == "" {
+			return nil, peersync.ErrNoSecret
+		}
+		e.sync = &peersync.Node{
+			ID:      opts.SyncID,
+			Secret:  opts.SyncSecret,
+			Listen:  opts.SyncListen,
+			Peers:   opts.SyncPeers,
+			Handler: e.applySync,
+			Logf:    e.logf,
+		}
+	}
+	if opts.MetricsListen != "" {
+		e.metrics = metrics.New()
+		e.metrics.SetKernelDrops(func() uint64 { return e.UDPStats().KernelDrops })
+	}
+	if opts.GeoData != nil && opts.RulePath != "" {
+		opts.GeoData.OnUpdate(func(src geodata.Source) {
+			if opts.GeoIP != nil && src.Path == opts.GeoIP.Path {
+				if _, err := opts.GeoIP.Reload(); err != nil {
+					e.logf("⚠️ Failed to reload GeoIP database: %v", err)
+				}
+			}
+			if err := e.Reload(); err != nil {
+				e.logf("⚠️ Failed to reload rules after %s update: %v", src.Name, err)
+			}
+		})
+	}
+	if opts.Subscriptions != nil && opts.RulePath != "" {
+		opts.Subscriptions.OnUpdate(func() {
+			if err := e.Reload(); err != nil {
+				e.logf("⚠️ Failed to reload rules after subscription update: %v", err)
+			}
+		})
+	}
+	if opts.StatePath != "" {
+		if err := e.RestoreState(opts.StatePath); err != nil {
+			return nil, fmt.Errorf("failed to restore state: %v", err)
+		}
+	}
+	return e, nil
+}
+
+// loadRules reads RulePath as a compiled trie, or as a plain rule list
+// with its index
+func loadRules(opts Options) ([]dnsmasq.Rule, dnsmasq.RuleMatcher, error) {
+	var rules []dnsmasq.Rule
+	var matcher dnsmasq.RuleMatcher
+	var err error
+	switch {
+	case opts.RuleDBPath != "":
+		matcher, err = dnsmasq.LoadRuleDB(opts.RulePath, opts.RuleDBPath)
+	case opts.CompileRules:
+		matcher, err = dnsmasq.LoadRuleTrie(opts.RulePath)
+	default:
+		rules, err = dnsmasq.LoadDomainRules(opts.RulePath)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load rule list: %v", err)
+	}
+	if matcher == nil {
+		matcher = dnsmasq.NewRuleIndex(rules)
+	}
+	return rules, matcher, nil
+}
+
+// Reload re-reads RulePath (static, expression and rewrite rules) and the
+// rule groups, and swaps the new rules in without stopping the listener.
+// In-flight queries finish with the old rules; on error the current rules
+// stay in place.
+func (e *Engine) Reload() error {
+	if e.opts.RulePath == "" {
+		return errors.New("no RulePath to reload from")
+	}
+	rules, matcher, err := loadRules(e.opts)
+	if err != nil {
+		return err
+	}
+	exprs, err := exprrules.LoadFile(e.opts.RulePath)
+	if err != nil {
+		return fmt.Errorf("failed to load expression rules: %v", err)
+	}
+	rewrites, err := rewrite.LoadFile(e.opts.RulePath)
+	if err != nil {
+		return fmt.Errorf("failed to load rewrite rules: %v", err)
+	}
+	groupRules := make([][]dnsmasq.Rule, len(e.opts.RuleGroups))
+	for i, g := range e.opts.RuleGroups {
+		if groupRules[i], err = loadGroupRules(g.Paths); err != nil {
+			return fmt.Errorf("rule group %s: %v", g.Name, err)
+		}
+	}
+
+	e.groupMu.Lock()
+	for i, g := range e.groups {
+		g.rules = groupRules[i]
+	}
+	prev := e.RuleCount()
+	e.baseRules, e.baseMatcher = rules, matcher
+	rules, matcher = e.layered()
+	var added, removed int
+	e.swap(func(sn *dnsproxy.Snapshot) {
+		added, removed = diffRules(sn.Rules, rules)
+		sn.Rules, sn.Matcher, sn.Exprs, sn.Rewrites = rules, matcher, exprs, rewrites
+	})
+	e.groupMu.Unlock()
+	if rules == nil {
+		// 编译后的规则只能比较数量
+		e.logf("Rules reloaded: %d (was %d)", e.RuleCount(), prev)
+	} else {
+		e.logf("Rules reloaded: %d (+%d -%d)", e.RuleCount(), added, removed)
+	}
+	e.events.Publish(events.Event{Kind: events.RulesReloaded, Rules: e.RuleCount()})
+	return nil
+}
+
+// SetCache replaces the DNS cache without stopping the listener (e.g. to
+// change its TTL or backend) and returns the previous one, which the
+// caller may close once in-flight queries have drained
+func (e *Engine) SetCache(cache dnsmasq.CacheBackend) dnsmasq.CacheBackend {
+	var old dnsmasq.CacheBackend
+	e.swap(func(sn *dnsproxy.Snapshot) {
+		old, sn.Cache = sn.Cache, cache
+	})
+	return old
+}
+
+// swap applies update to a copy of the current snapshot and publishes it
+// to the engine and the running listener
+func (e *Engine) swap(update func(sn *dnsproxy.Snapshot)) {
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+
+	next := *e.snapshot.Load()
+	update(&next)
+	e.snapshot.Store(&next)
+
+	e.mu.Lock()
+	if e.server != nil {
+		e.server.Swap(&next)
+	}
+	e.mu.Unlock()
+}
+
+// Start detects the VPN interface, optionally fixes the default routes,
+// and starts the DNS listener and cache persistence
+func (e *Engine) Start() error {
+	e.lifeMu.Lock()
+	defer e.lifeMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return ErrAlreadyRunning
+	}
+
+	e.detectConflicts()
+	iface := e.opts.VPNInterface
+	if iface == "" {
+		var err error
+		iface, err = vpn.FindVPNInterface(vpn.ConflictIfaces(e.conflicts)...)
+		if err != nil {
+			return fmt.Errorf("no VPN interface found: %v", err)
+		}
+	} else if slices.Contains(vpn.ConflictIfaces(e.conflicts), iface) {
+		e.logf("⚠️ VPN interface %s belongs to another VPN client", iface)
+	}
+	e.logf("VPN interface detected: %s\n", iface)
+
+	if e.opts.FixRoutes && !e.coexist {
+		// Remove catch-all VPN routes
+		if err := e.router.DeleteDefaultVPNRoutes(); err != nil {
+			e.logf("Warning: failed to delete default VPN routes: %v", err)
+		}
+		if err := e.router.CorrectDefaultRoute(); err != nil {
+			e.logf("Warning: failed to correct default route: %v", err)
+		}
+	}
+
+	sn := e.snapshot.Load()
+	server := dnsproxy.NewServer(sn.Rules, sn.Cache, "127.0.0.1:53", iface)
+	server.Matcher = sn.Matcher
+	server.Exprs = sn.Exprs
+	server.Rewrites = sn.Rewrites
+	server.Swap(sn)
+	server.Addr = e.opts.ListenAddr
+	if e.coexist {
+		server.Addr = e.opts.CoexistListenAddr
+	}
+	server.Helper = e.opts.Helper
+	if in := e.opts.Inherited; in != nil {
+		e.opts.Inherited = nil
+		if in.Addr == server.Addr {
+			server.PacketConn, server.Listener = in.PacketConn, in.Listener
+			e.logf("Taking over the DNS listener on %s", in.Addr)
+		} else {
+			in.Close()
+		}
+	}
+	server.Router = e.router
+	server.Actions = e.actions
+	server.Hooks = e.hooks()
+	server.State = e.state
+	server.Metrics = e.metrics
+	server.ConnLimiter = e.connLimit
+	server.FilterAAAA = !e.opts.ResolveAAAA
+	server.FilterAAAADomains = suffixRules(e.opts.FilterAAAA)
+	server.HTTPSRecords = e.opts.HTTPSRecords
+	server.ECH = e.opts.ECH
+	server.ECHStripDomains = suffixRules(e.opts.ECHStrip)
+	server.ECHPassDomains = suffixRules(e.opts.ECHPass)
+	server.SafeSearch = e.opts.SafeSearch
+	server.Clients = e.opts.Clients
+	server.VPNDown = e.opts.VPNDown
+	server.VPNDownDirectDomains = suffixRules(e.opts.VPNDownDirect)
+	server.VPNDownBlockDomains = suffixRules(e.opts.VPNDownBlock)
+	server.Reject = e.opts.Reject
+	server.VerifyUpstream = e.scoped(e.opts.VerifyUpstream)
+	server.VerifyDomains = suffixRules(e.opts.VerifyDomains)
+	server.Verify = e.opts.Verify
+	server.QoS = e.opts.QoS
+	server.Overrides = e.overrides
+	server.Pins = e.pins
+	if e.opts.ReplayPath != "" {
+		rec, err := replay.Create(e.opts.ReplayPath)
+		if err != nil {
+			return fmt.Errorf("failed to open replay recording: %v", err)
+		}
+		server.Recorder = rec
+	}
+	if e.opts.HistoryPath != "" {
+		store, err := history.Open(e.opts.HistoryPath, e.opts.HistoryRetention)
+		if err != nil {
+			server.Recorder.Close()
+			return fmt.Errorf("failed to open query history: %v", err)
+		}
+		server.History = store
+	}
+	if e.opts.QueryLog != nil {
+		ql, err := querylog.Open(*e.opts.QueryLog)
+		if err != nil {
+			server.Recorder.Close()
+			server.History.Close()
+			return fmt.Errorf("failed to open query log: %v", err)
+		}
+		server.QueryLog = ql
+	}
+	server.Logger = e.opts.Logger
+	server.PrintQueries = e.opts.Logger == nil
+	if e.opts.ResolveWorkers > 0 {
+		server.Workers = e.opts.ResolveWorkers
+	}
+	if e.opts.ResolveQueue > 0 {
+		server.QueueSize = e.opts.ResolveQueue
+	}
+	server.UDP = e.opts.UDP
+	if err := e.startFakeIP(server, iface); err != nil {
+		server.Recorder.Close()
+		server.History.Close()
+		server.QueryLog.Close()
+		return err
+	}
+	if err := server.Start(); err != nil {
+		e.stopFakeIP(server)
+		server.Recorder.Close()
+		server.History.Close()
+		server.QueryLog.Close()
+		return err
+	}
+	e.server = server
+	e.running = true
+	if len(e.restored) > 0 {
+		e.reinstallRoutes(iface)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.group, ctx = errgroup.WithContext(ctx)
+	e.goBackground(ctx, e.maintainCache)
+	if e.opts.GeoData != nil {
+		e.goBackground(ctx, e.opts.GeoData.Run)
+	}
+	if e.opts.GeoIP != nil {
+		e.goBackground(ctx, e.opts.GeoIP.Run)
+	}
+	if e.opts.Subscriptions != nil {
+		e.goBackground(ctx, e.opts.Subscriptions.Run)
+	}
+	if e.opts.WatchRules && e.opts.RulePath != "" {
+		e.goBackground(ctx, e.watchRules)
+	}
+	if e.opts.DDR {
+		e.goBackground(ctx, e.discoverDDR)
+	}
+	if e.opts.CaptiveDetect {
+		e.goBackground(ctx, e.watchCaptive)
+	}
+	if e.opts.NAT64Detect && !e.opts.NAT64Prefix.IsValid() {
+		e.goBackground(ctx, e.detectNAT64)
+	}
+	if e.opts.OfflineDetect {
+		e.goBackground(ctx, e.watchOffline)
+	}
+	if e.telemetry != nil {
+		e.goBackground(ctx, e.telemetry.Run)
+	}
+	if e.prober != nil {
+		e.goBackground(ctx, e.prober.Run)
+	}
+	if pool := e.upstream.Pool(); pool != nil {
+		e.goBackground(ctx, func(ctx context.Context) error {
+			return pool.Run(doh.WithSettings(ctx, e.dohSettings))
+		})
+	}
+	if server.History != nil {
+		e.goBackground(ctx, server.History.Run)
+	}
+	if e.sync != nil {
+		e.goBackground(ctx, e.sync.Run)
+	}
+	if e.metrics != nil {
+		e.goBackground(ctx, func(ctx context.Context) error {
+			return e.metrics.Serve(ctx, e.opts.MetricsListen)
+		})
+	}
+	if len(e.opts.WarmUp) > 0 || e.opts.WarmUpTop > 0 {
+		e.goBackground(ctx, func(ctx context.Context) error {
+			return e.warmUp(ctx, server)
+		})
+	}
+	e.goBackground(ctx, func(ctx context.Context) error {
+		return e.watchVPN(ctx, iface)
+	})
+	e.goBackground(ctx, e.watchNetwork)
+	return nil
+}
+
+// scoped returns a copy of u queried with the engine's settings, or nil
+func (e *Engine) scoped(u *doh.Upstream) *doh.Upstream {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.Settings = e.dohSettings
+	return &c
+}
+
+// suffixRules turns a list of domain suffixes into rules for matching
+func suffixRules(suffixes []string) []dnsmasq.Rule {
+	var rules []dnsmasq.Rule
+	for _, suffix := range suffixes {
+		rules = append(rules, dnsmasq.Rule{Suffix: suffix})
+	}
+	return rules
+}
+
+// goBackground runs fn in the engine's goroutine group until Stop. An
+// error returned by fn stops its siblings and is reported by Stop.
+func (e *Engine) goBackground(ctx context.Context, fn func(ctx context.Context) error) {
+	e.group.Go(func() error {
+		if err := fn(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			e.logf("⚠️ Background task failed: %v", err)
+			return err
+		}
+		return nil
+	})
+}
+
+// Stop shuts down the listener and background workers and saves the cache
+func (e *Engine) Stop() error {
+	e.lifeMu.Lock()
+	defer e.lifeMu.Unlock()
+
+	e.mu.Lock()
+	if !e.running {
+		e.mu.Unlock()
+		return nil
+	}
+	cancel, group := e.cancel, e.group
+	e.mu.Unlock()
+
+	cancel()
+	bgErr := group.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.server.Stop()
+	e.stopFakeIP(e.server)
+	if closeErr := e.server.Recorder.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := e.server.History.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := e.server.QueryLog.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	e.server = nil
+	e.running = false
+	// 下次启动时重新安装 VPN 中断期间撤下的路由
+	e.restored = append(e.restored, e.withdrawn...)
+	e.withdrawn = nil
+	e.cancel, e.group = nil, nil
+	if err == nil {
+		err = bgErr
+	}
+
+	if e.opts.CachePath != "" {
+		if saveErr := dnsmasq.SaveCacheFile(e.opts.CachePath, e.Cache()); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if e.opts.StatePath != "" {
+		if saveErr := e.SaveState(e.opts.StatePath); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Handoff duplicates the sockets of the running listener, which stay open
+// after Stop, for a new process to serve with Options.Inherited
+func (e *Engine) Handoff() (*handoff.Files, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.running {
+		return nil, errors.New("engine is not running")
+	}
+	return e.server.Handoff()
+}
+
+// Running reports whether the engine has been started
+func (e *Engine) Running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.running
+}
+
+// Resolve resolves a domain through the engine's pins, cache, overrides
+// and rules and reports whether it would be routed through the VPN. Errors
+// match the dnsmasq Err* values with errors.Is.
+func (e *Engine) Resolve(domain string) (bool, string, error) {
+	d, err := e.Decide(domain)
+	if err != nil {
+		return false, "", err
+	}
+	return d.Routes(), d.IP(), nil
+}
+
+// Decide is Resolve returning the whole Decision: the answer with its
+// source and the rule matched, by the overrides first, then the rules
+// against the names CNAMEMatch picks, then the address
+func (e *Engine) Decide(domain string) (*dnsmasq.Decision, error) {
+	sn := e.snapshot.Load()
+	now := time.Now()
+	var d *dnsmasq.Decision
+	if pin, ok := e.pins.Lookup(domain, now); ok {
+		d = &dnsmasq.Decision{Domain: domain, Source: dnsmasq.SourceLocal}
+		d.SetAnswers([]string{pin.IP.String()}, 0)
+	} else {
+		var err error
+		if d, err = sn.Resolver(e.logger).Decide(domain, dns.TypeA); err != nil {
+			return d, err
+		}
+	}
+	for _, name := range sn.CNAMEMatch.Names(domain, d.CNAMEs) {
+		if ov, ok := e.overrides.Lookup(name, now); ok {
+			d.Match(dnsmasq.Rule{Suffix: name, Action: ov.Egress}, true)
+			return d, nil
+		}
+	}
+	for _, name := range sn.CNAMEMatch.Names(domain, d.CNAMEs) {
+		if rule, ok := sn.MatchedRule(name); ok {
+			d.Match(rule, true)
+			return d, nil
+		}
+	}
+	d.Match(sn.MatchedIP(d.IP()))
+	return d, nil
+}
+
+// ResolveFull is Resolve returning the whole answer: the CNAME chain and
+// every A and AAAA address with its TTL (see dnsmasq.Resolver.ResolveFull).
+// The result's Rule is decided the way queries are: overrides first, then
+// the rules against the names CNAMEMatch picks, then every address.
+func (e *Engine) ResolveFull(domain string) (*dnsmasq.Result, bool, error) {
+	sn := e.snapshot.Load()
+	res, err := e.resolveFull(sn, domain)
+	if err != nil {
+		return nil, false, err
+	}
+	res.Rule, res.Matched = dnsmasq.Rule{}, false
+	names := sn.CNAMEMatch.Names(domain, res.CNAMEs)
+	for _, name := range names {
+		if ov, ok := e.overrides.Lookup(name, time.Now()); ok {
+			res.Rule, res.Matched = dnsmasq.Rule{Suffix: name, Action: ov.Egress}, true
+			return res, ov.Routes(), nil
+		}
+	}
+	for _, name := range names {
+		if rule, ok := sn.MatchedRule(name); ok {
+			res.Rule, res.Matched = rule, true
+			return res, dnsproxy.Routes(rule), nil
+		}
+	}
+	for _, ip := range res.Addrs() {
+		if rule, ok := sn.MatchedIP(ip); ok {
+			res.Rule, res.Matched = rule, true
+			return res, dnsproxy.Routes(rule), nil
+		}
+	}
+	return res, false, nil
+}
+
+// resolveFull returns the pinned address of domain, else its whole answer
+func (e *Engine) resolveFull(sn *dnsproxy.Snapshot, domain string) (*dnsmasq.Result, error) {
+	pin, ok := e.pins.Lookup(domain, time.Now())
+	if !ok {
+		return sn.Resolver(e.logger).ResolveFull(domain)
+	}
+	res := &dnsmasq.Result{Domain: domain}
+	addr := dnsmasq.Address{IP: pin.IP.String()}
+	if !pin.Expires.IsZero() {
+		addr.TTL = time.Until(pin.Expires)
+	}
+	if pin.IP.Is4() {
+		res.A = []dnsmasq.Address{addr}
+	} else {
+		res.AAAA = []dnsmasq.Address{addr}
+	}
+	return res, nil
+}
+
+// Match reports whether a domain matches the engine's rules
+func (e *Engine) Match(domain string) bool {
+	return e.snapshot.Load().Match(domain)
+}
+
+// Rules returns the loaded rules, or nil when CompileRules is set
+func (e *Engine) Rules() []dnsmasq.Rule {
+	return e.snapshot.Load().Rules
+}
+
+// Rejected returns how many queries the running listener refused because
+// the resolution queue was full
+func (e *Engine) Rejected() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return 0
+	}
+	return e.server.Rejected()
+}
+
+// CacheHits returns how many resolutions of the running listener were
+// answered from the cache and how many asked the upstream
+func (e *Engine) CacheHits() (hits, misses uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return 0, 0
+	}
+	return e.server.CacheHits()
+}
+
+// UDPStats returns the counters of the running UDP listener
+func (e *Engine) UDPStats() dnsproxy.UDPStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return dnsproxy.UDPStats{}
+	}
+	return e.server.UDPStats()
+}
+
+// VerifyMismatches returns how many answers of the running listener
+// disagreed with VerifyUpstream
+func (e *Engine) VerifyMismatches() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return 0
+	}
+	return e.server.VerifyMismatches()
+}
+
+// History returns the resolutions matching f from the query history,
+// newest first. Without a running listener the database at HistoryPath
+// is read directly.
+func (e *Engine) History(f history.Filter) ([]history.Entry, error) {
+	var entries []history.Entry
+	err := e.WithHistory(func(store *history.Store) (err error) {
+		entries, err = store.Query(f)
+		return err
+	})
+	return entries, err
+}
+
+// Analytics analyzes the query history since since (see package
+// analytics)
+func (e *Engine) Analytics(since time.Time, opts analytics.Options) (analytics.Report, error) {
+	var stats []history.DomainStats
+	err := e.WithHistory(func(store *history.Store) (err error) {
+		stats, err = store.Stats(since)
+		return err
+	})
+	if err != nil {
+		return analytics.Report{}, err
+	}
+	return analytics.Analyze(stats, opts), nil
+}
+
+// WithHistory calls fn with the running listener's query history, or
+// with the database at HistoryPath opened for the call
+func (e *Engine) WithHistory(fn func(*history.Store) error) error {
+	e.mu.Lock()
+	var store *history.Store
+	if e.server != nil {
+		store = e.server.History
+	}
+	e.mu.Unlock()
+	if store != nil {
+		return fn(store)
+	}
+	if e.opts.HistoryPath == "" {
+		return errors.New("query history is off (no HistoryPath)")
+	}
+	store, err := history.Open(e.opts.HistoryPath, e.opts.HistoryRetention)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return fn(store)
+}
+
+// Queries returns how many queries the running server has received
+func (e *Engine) Queries() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return 0
+	}
+	return e.server.Queries()
+}
+
+// Telemetry returns the usage report that would be sent now, and false
+// when telemetry is off
+func (e *Engine) Telemetry() (telemetry.Report, bool) {
+	if e.telemetry == nil {
+		return telemetry.Report{}, false
+	}
+	return e.telemetry.Preview(), true
+}
+
+// Upstreams returns the state of the members when Upstream is a pool of
+// several (see doh.ParseUpstreams), and nil otherwise
+func (e *Engine) Upstreams() []doh.PoolMember {
+	return e.opts.Upstream.Pool().Status()
+}
+
+// UpstreamEndpoints returns the state of the addresses the DoH servers of
+// Upstream rotate over (see doh.Upstream.UseBootstrap)
+func (e *Engine) UpstreamEndpoints() []doh.EndpointAddr {
+	return e.opts.Upstream.EndpointStatus()
+}
+
+// Limits returns the state of the upstream query, route operation and
+// client connection limits, including how often each was hit
+func (e *Engine) Limits() []limits.Stats {
+	var stats []limits.Stats
+	for _, l := range []*limits.Limiter{e.upstreamLimit, e.router.Limiter, e.connLimit} {
+		if l != nil {
+			stats = append(stats, l.Stats())
+		}
+	}
+	return stats
+}
+
+// RuleCount returns the number of loaded rules in either mode
+func (e *Engine) RuleCount() int {
+	sn := e.snapshot.Load()
+	n := len(sn.Rules)
+	if t, ok := sn.Matcher.(interface{ Len() int }); ok {
+		n = t.Len()
+	}
+	return n + sn.Exprs.Len() + sn.Rewrites.Len()
+}
+
+// Cache returns the engine's DNS cache
+func (e *Engine) Cache() dnsmasq.CacheBackend {
+	return e.snapshot.Load().Cache
+}
+
+// maintainCache periodically purges expired entries and saves the cache
+// to disk until ctx is canceled
+func (e *Engine) maintainCache(ctx context.Context) error {
+	ticker := time.NewTicker(e.opts.CacheSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			sn := e.snapshot.Load()
+			cache := sn.Cache
+			if mem, ok := cache.(*dnsmasq.Cache); ok {
+				mem.Purge()
+			}
+			sn.Negative.Purge()
+			if e.opts.CachePath == "" {
+				continue
+			}
+			if err := dnsmasq.SaveCacheFile(e.opts.CachePath, cache); err != nil {
+				e.logf("Failed to save cache: %v", err)
+			}
+		}
+	}
+}
+
+// watchVPN polls the VPN interface and publishes VPNDown or VPNUp when it
+// goes down, comes back or is replaced by another interface
+func (e *Engine) watchVPN(ctx context.Context, iface string) error {
+	ticker := time.NewTicker(e.opts.VPNCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			current := e.currentVPNInterface()
+			if current == iface {
+				continue
+			}
+			if current == "" {
+				e.logf("⚠️ VPN interface %s is down", iface)
+			} else {
+				e.logf("VPN interface changed: %q ➜ %s", iface, current)
+			}
+			kind := events.VPNUp
+			if current == "" {
+				kind = events.VPNDown
+			}
+			e.events.Publish(events.Event{Kind: kind, Iface: current, PrevIface: iface, Cause: events.CauseInterface})
+			iface = current
+		}
+	}
+}
+
+// currentVPNInterface returns the active VPN interface, or "" when down
+func (e *Engine) currentVPNInterface() string {
+	if e.opts.VPNInterface != "" {
+		ifi, err := net.InterfaceByName(e.opts.VPNInterface)
+		if err != nil || ifi.Flags&net.FlagUp == 0 {
+			return ""
+		}
+		return ifi.Name
+	}
+	e.mu.Lock()
+	skip := vpn.ConflictIfaces(e.conflicts)
+	e.mu.Unlock()
+	iface, err := vpn.FindVPNInterface(skip...)
+	if err != nil {
+		return ""
+	}
+	return iface
+}
+
+func (e *Engine) logf(format string, args ...any) {
+	if e.logger == nil {
+		dnsmasq.DefaultLogger.Printf(format, args...)
+		return
+	}
+	e.logger.Printf(format, args...)
+}
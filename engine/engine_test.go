@@ -0,0 +1,167 @@
+package engine_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dohtest"
+	"openvpnadvanced/engine"
+
+	"github.com/miekg/dns"
+)
+
+// freeAddr returns a loopback address with a port free at the moment
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+// recorder is a custom action remembering the addresses it was handed
+type recorder struct {
+	mu  sync.Mutex
+	ips []string
+}
+
+func (r *recorder) Handle(req actions.Request) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips = append(r.ips, req.IP)
+	return nil
+}
+
+func (r *recorder) seen(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, got := range r.ips {
+		if got == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// newEngine returns an engine answering from its own fake upstream, which
+// resolves vpn.example.com to ip, and handing matches to its own action
+func newEngine(t *testing.T, ip string) (*engine.Engine, string, *recorder) {
+	t.Helper()
+	srv := dohtest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.A("vpn.example.com", ip)
+
+	rec := &recorder{}
+	addr := freeAddr(t)
+	e, err := engine.New(engine.Options{
+		Rules:        []dnsmasq.Rule{{Suffix: "example.com", Action: "record"}},
+		Upstream:     srv.Upstream(),
+		Actions:      map[string]actions.Action{"record": rec},
+		ListenAddr:   addr,
+		VPNInterface: "lo",
+		Logger:       dnsmasq.DiscardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, addr, rec
+}
+
+func query(t *testing.T, addr string) string {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("vpn.example.com.", dns.TypeA)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(msg, addr)
+	if err != nil {
+		t.Fatalf("query %s: %v", addr, err)
+	}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	t.Fatalf("query %s: no A record in %v", addr, resp)
+	return ""
+}
+
+// waitSeen waits for the asynchronous action to receive ip
+func waitSeen(t *testing.T, rec *recorder, ip string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !rec.seen(ip) {
+		if time.Now().After(deadline) {
+			t.Fatalf("action never received %s", ip)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartStopStart(t *testing.T) {
+	e, addr, rec := newEngine(t, "10.0.0.1")
+	for round := 0; round < 2; round++ {
+		if err := e.Start(); err != nil {
+			t.Fatalf("round %d: Start: %v", round, err)
+		}
+		if got := query(t, addr); got != "10.0.0.1" {
+			t.Errorf("round %d: answer %s, want 10.0.0.1", round, got)
+		}
+		waitSeen(t, rec, "10.0.0.1")
+		if err := e.Stop(); err != nil {
+			t.Fatalf("round %d: Stop: %v", round, err)
+		}
+	}
+}
+
+// TestEnginesShareProcess checks that two running engines each keep their
+// own upstream and actions
+func TestEnginesShareProcess(t *testing.T) {
+	a, addrA, recA := newEngine(t, "10.0.0.1")
+	b, addrB, recB := newEngine(t, "10.0.0.2")
+	for _, e := range []*engine.Engine{a, b} {
+		if err := e.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer e.Stop()
+	}
+
+	if got := query(t, addrA); got != "10.0.0.1" {
+		t.Errorf("first engine answered %s, want 10.0.0.1", got)
+	}
+	if got := query(t, addrB); got != "10.0.0.2" {
+		t.Errorf("second engine answered %s, want 10.0.0.2", got)
+	}
+	waitSeen(t, recA, "10.0.0.1")
+	waitSeen(t, recB, "10.0.0.2")
+	if recA.seen("10.0.0.2") || recB.seen("10.0.0.1") {
+		t.Error("an engine ran the other's action")
+	}
+}
+
+func TestRollbackRestoresPins(t *testing.T) {
+	e, _, _ := newEngine(t, "10.0.0.1")
+	if _, err := e.Pin("kept.example.com", "192.0.2.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Checkpoint(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	e.Unpin("kept.example.com")
+	if _, err := e.Pin("added.example.com", "192.0.2.2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	pins := e.Pins()
+	if len(pins) != 1 || pins[0].Domain != "kept.example.com" || pins[0].IP.String() != "192.0.2.1" {
+		t.Errorf("pins after rollback = %v, want only kept.example.com ➜ 192.0.2.1", pins)
+	}
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"openvpnadvanced/events"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/vpn"
+)
+
+// Events returns the engine's event bus, to react to VPN, network and
+// rule changes. Subscriptions outlive Stop and Start.
+func (e *Engine) Events() *events.Bus {
+	return e.events
+}
+
+// subscribe wires the engine's own reactions to its events
+func (e *Engine) subscribe() {
+	e.events.Subscribe(func(ev events.Event) {
+		if ev.Kind == events.VPNDown {
+			e.vpnDown()
+		} else {
+			e.vpnUp(ev.Iface)
+		}
+	}, events.VPNUp, events.VPNDown)
+	e.events.Subscribe(func(ev events.Event) {
+		// 探测触发的切换不算接口变化，脚本只关心接口本身
+		if ev.Cause != events.CauseInterface {
+			return
+		}
+		e.opts.Hooks.VPNStateChange(hooks.VPNStateEvent{Up: ev.Kind == events.VPNUp, Iface: ev.Iface, PrevIface: ev.PrevIface})
+	}, events.VPNUp, events.VPNDown)
+	if e.opts.FakeIP.IsValid() {
+		e.events.Subscribe(func(ev events.Event) {
+			if ev.Cause == events.CauseInterface {
+				e.moveFakeIP(ev)
+			}
+		}, events.VPNUp)
+	}
+	if e.opts.FlushOnReconnect {
+		e.events.Subscribe(func(ev events.Event) {
+			n, _, err := e.FlushCache("")
+			if err != nil {
+				e.logf("⚠️ Failed to flush the cache after the VPN came back: %v", err)
+				return
+			}
+			e.logf("🧹 VPN back on %s: %d cache entries flushed", ev.Iface, n)
+		}, events.VPNUp)
+	}
+	e.events.Subscribe(func(ev events.Event) {
+		e.logf("🌐 Network changed: %s via %s ➜ %s via %s", ev.PrevGateway, ev.PrevIface, ev.Gateway, ev.Iface)
+	}, events.NetworkChanged)
+}
+
+// notify returns a channel receiving a value after events of kinds, many
+// events in a row coalescing into one, until stop is called
+func (e *Engine) notify(kinds ...events.Kind) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	stop := e.events.Subscribe(func(events.Event) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}, kinds...)
+	return ch, stop
+}
+
+// watchNetwork polls the default route every VPNCheckInterval and
+// publishes NetworkChanged when it moves to another gateway or interface
+func (e *Engine) watchNetwork(ctx context.Context) error {
+	ticker := time.NewTicker(e.opts.VPNCheckInterval)
+	defer ticker.Stop()
+
+	gateway, iface, _ := vpn.GetDefaultGateway()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		nextGateway, nextIface, err := vpn.GetDefaultGateway()
+		// 切换网络的间隙没有默认路由，等新路由出现再比较
+		if err != nil || (nextGateway == gateway && nextIface == iface) {
+			continue
+		}
+		e.events.Publish(events.Event{
+			Kind: events.NetworkChanged, Iface: nextIface, PrevIface: iface,
+			Gateway: nextGateway, PrevGateway: gateway,
+		})
+		gateway, iface = nextGateway, nextIface
+	}
+}
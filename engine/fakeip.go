@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"fmt"
+
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/events"
+	"openvpnadvanced/fakeip"
+)
+
+// startFakeIP gives server a fake-ip pool, with its range routed through
+// iface, when FakeIP is set
+func (e *Engine) startFakeIP(server *dnsproxy.DNSServer, iface string) error {
+	if !e.opts.FakeIP.IsValid() {
+		return nil
+	}
+	pool, err := fakeip.New(e.opts.FakeIP)
+	if err != nil {
+		return err
+	}
+	if err := e.router.SetupFakeIP(pool.Prefix(), iface); err != nil {
+		return fmt.Errorf("failed to route the fake-ip range %s: %v", pool.Prefix(), err)
+	}
+	server.FakeIP, server.FakeIPTTL = pool, e.opts.FakeIPTTL
+	e.logf("🎭 Fake-IP mode: routed domains answer from %s through %s", pool.Prefix(), iface)
+	return nil
+}
+
+// stopFakeIP removes the translations of server's fake-ip pool and the
+// routing of its range
+func (e *Engine) stopFakeIP(server *dnsproxy.DNSServer) {
+	pool := server.FakeIP
+	if pool == nil {
+		return
+	}
+	for _, m := range pool.Mappings() {
+		_ = e.router.UnmapFakeIP(m.Fake, m.Real)
+	}
+	if err := e.router.TeardownFakeIP(pool.Prefix()); err != nil {
+		e.logf("⚠️ Failed to remove the fake-ip routing: %v", err)
+	}
+}
+
+// moveFakeIP routes the fake-ip range through the VPN's new interface
+func (e *Engine) moveFakeIP(ev events.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil || e.server.FakeIP == nil || ev.Iface == "" || ev.Iface == ev.PrevIface {
+		return
+	}
+	if err := e.router.SetupFakeIP(e.server.FakeIP.Prefix(), ev.Iface); err != nil {
+		e.logf("⚠️ Failed to move the fake-ip range to %s: %v", ev.Iface, err)
+		return
+	}
+	e.logf("🎭 Fake-IP range now routed through %s", ev.Iface)
+}
+
+// FakeIPs returns the fake addresses handed out by the running listener,
+// and false when fake-ip mode is off
+func (e *Engine) FakeIPs() ([]fakeip.Mapping, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil || e.server.FakeIP == nil {
+		return nil, false
+	}
+	return e.server.FakeIP.Mappings(), true
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"openvpnadvanced/dnsproxy"
+)
+
+// fallbackEnabled reports whether any matched domain goes DIRECT while
+// the VPN is down
+func (e *Engine) fallbackEnabled() bool {
+	return e.opts.VPNDown == dnsproxy.VPNDownDirect || len(e.opts.VPNDownDirect) > 0
+}
+
+// vpnDown withdraws the routes of domains that fall back to DIRECT, so
+// they stop black-holing into the dead tunnel, and remembers them for
+// vpnUp
+func (e *Engine) vpnDown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil || !e.fallbackEnabled() {
+		return
+	}
+	e.server.SetVPNDown(true)
+	for _, r := range e.state.Routes() {
+		if !e.server.FallsBack(r.Domain) {
+			continue
+		}
+		// 接口消失时系统通常已删除这些路由，失败可忽略
+		_ = e.router.DeleteHostRoute(r.IP)
+		e.state.RemoveRoute(r.IP)
+		e.withdrawn = append(e.withdrawn, r)
+	}
+	e.logf("↩️ VPN down: matched domains go DIRECT, %d routes withdrawn", len(e.withdrawn))
+}
+
+// vpnUp ends the fallback and reinstalls the withdrawn routes on iface
+func (e *Engine) vpnUp(iface string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil || !e.server.VPNDownNow() {
+		return
+	}
+	e.server.SetVPNDown(false)
+	e.restored = append(e.restored, e.withdrawn...)
+	e.withdrawn = nil
+	n := len(e.restored)
+	e.reinstallRoutes(iface)
+	e.logf("✅ VPN back on %s: full operation restored, %d routes reinstalled", iface, n)
+}
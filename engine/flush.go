@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+)
+
+// FlushCache drops the cached answers of the domains matching pattern and
+// withdraws their routes, killing their connections, so the next queries
+// resolve afresh, e.g. after a provider moved to new addresses. pattern is
+// a domain suffix (example.com also flushes www.example.com), a glob such
+// as *.cdn.example.net, or empty to flush everything. CNAME targets of the
+// flushed names and remembered failures are flushed too. It returns the number of entries removed
+// and the addresses whose routes were withdrawn.
+func (e *Engine) FlushCache(pattern string) (int, []string, error) {
+	pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	cache, ok := e.Cache().(dnsmasq.DeleteCache)
+	if !ok {
+		return 0, nil, errors.New("the cache backend can't delete entries")
+	}
+
+	raw := cache.Raw()
+	flush := make(map[string]bool)
+	for domain := range raw {
+		if !matchPattern(pattern, domain) {
+			continue
+		}
+		// 沿 CNAME 链一并清除，否则重新解析时仍会命中旧的中间记录
+		for name, depth := domain, 0; depth <= dnsmasq.DefaultMaxDepth && !flush[name]; depth++ {
+			flush[name] = true
+			record, ok := raw[name]
+			if !ok {
+				break
+			}
+			if _, ok := dnsmasq.SplitAddrs(record.IP); ok {
+				break
+			}
+			name = record.IP
+		}
+	}
+
+	var errs []error
+	removed := 0
+	for domain := range flush {
+		if _, ok := raw[domain]; !ok {
+			continue
+		}
+		if err := cache.Delete(domain); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", domain, err))
+			continue
+		}
+		removed++
+	}
+
+	removed += e.snapshot.Load().Negative.Flush(func(domain string) bool {
+		return flush[domain] || matchPattern(pattern, domain)
+	})
+
+	var routes []dnsproxy.Route
+	for _, r := range e.state.Routes() {
+		if flush[strings.ToLower(r.Domain)] || matchPattern(pattern, r.Domain) {
+			routes = append(routes, r)
+		}
+	}
+	ips := e.withdraw(routes)
+
+	what := pattern
+	if what == "" {
+		what = "all domains"
+	}
+	e.logf("🧹 Cache flushed for %s: %d entries, %d routes withdrawn", what, removed, len(ips))
+	return removed, ips, errors.Join(errs...)
+}
+
+// matchPattern reports whether domain matches a FlushCache pattern
+func matchPattern(pattern, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	switch {
+	case pattern == "":
+		return true
+	case strings.ContainsAny(pattern, "*?["):
+		ok, _ := path.Match(pattern, domain)
+		return ok
+	default:
+		return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+	}
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+)
+
+// ErrUnknownGroup is returned by SetRuleGroup for a group that isn't
+// configured
+var ErrUnknownGroup = errors.New("unknown rule group")
+
+// RuleGroup is a named set of rule lists that can be switched on and off
+// at runtime (see SetRuleGroup), e.g. to send streaming sites through the
+// VPN only while abroad. Its rules take precedence over RulePath.
+type RuleGroup struct {
+	Name string
+	// Paths are rule lists in the RulePath format; only their static
+	// rules are used
+	Paths []string
+	// Enabled is the group's state until it is toggled; toggles saved in
+	// Options.RuleGroupStatePath take precedence
+	Enabled bool
+}
+
+// RuleGroupStatus is the state of a rule group
+type RuleGroupStatus struct {
+	Name    string
+	Enabled bool
+	// Rules is the number of rules the group loaded
+	Rules int
+}
+
+type ruleGroup struct {
+	RuleGroup
+	rules []dnsmasq.Rule
+}
+
+// loadGroups reads the rules of every group and applies the saved toggles
+func loadGroups(opts Options) ([]*ruleGroup, error) {
+	saved, err := readGroupState(opts.RuleGroupStatePath)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*ruleGroup, 0, len(opts.RuleGroups))
+	for _, g := range opts.RuleGroups {
+		rules, err := loadGroupRules(g.Paths)
+		if err != nil {
+			return nil, fmt.Errorf("rule group %s: %v", g.Name, err)
+		}
+		if enabled, ok := saved[g.Name]; ok {
+			g.Enabled = enabled
+		}
+		groups = append(groups, &ruleGroup{RuleGroup: g, rules: rules})
+	}
+	return groups, nil
+}
+
+func loadGroupRules(paths []string) ([]dnsmasq.Rule, error) {
+	var rules []dnsmasq.Rule
+	for _, path := range paths {
+		list, err := dnsmasq.LoadDomainRules(path)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, list...)
+	}
+	return rules, nil
+}
+
+// layered returns the rules of the enabled groups layered over the rules
+// of RulePath. Called with e.groupMu held.
+func (e *Engine) layered() ([]dnsmasq.Rule, dnsmasq.RuleMatcher) {
+	var rules []dnsmasq.Rule
+	for _, g := range e.groups {
+		if g.Enabled {
+			rules = append(rules, g.rules...)
+		}
+	}
+	switch {
+	case len(rules) == 0:
+		return e.baseRules, e.baseMatcher
+	case e.baseRules == nil && e.baseMatcher != nil:
+		// 编译后的规则没有列表可合并
+		return nil, &dnsmasq.Overlay{Rules: rules, Base: e.baseMatcher}
+	}
+	rules = append(rules, e.baseRules...)
+	return rules, dnsmasq.NewRuleIndex(rules)
+}
+
+// SetRuleGroup enables or disables the rule group name and swaps the
+// resulting rules in. Routes of domains only the disabled group matched
+// are withdrawn. The toggle is saved to RuleGroupStatePath, so it
+// survives restarts.
+func (e *Engine) SetRuleGroup(name string, enabled bool) error {
+	e.groupMu.Lock()
+	defer e.groupMu.Unlock()
+	i := slices.IndexFunc(e.groups, func(g *ruleGroup) bool { return strings.EqualFold(g.Name, name) })
+	if i < 0 {
+		return fmt.Errorf("%w %q", ErrUnknownGroup, name)
+	}
+	g := e.groups[i]
+	if g.Enabled != enabled {
+		g.Enabled = enabled
+		rules, matcher := e.layered()
+		e.swap(func(sn *dnsproxy.Snapshot) {
+			sn.Rules, sn.Matcher = rules, matcher
+		})
+		if enabled {
+			e.logf("✅ Rule group %s enabled (%d rules)", g.Name, len(g.rules))
+		} else {
+			e.logf("⏸️ Rule group %s disabled", g.Name)
+			e.withdrawUnmatched(g.rules)
+		}
+	}
+	return e.saveGroupState()
+}
+
+// withdrawUnmatched withdraws the routes of domains matching rules that
+// the current rules no longer match
+func (e *Engine) withdrawUnmatched(rules []dnsmasq.Rule) {
+	sn := e.snapshot.Load()
+	var routes []dnsproxy.Route
+	for _, r := range e.state.Routes() {
+		if dnsmasq.MatchesRules(r.Domain, rules) && !sn.Match(r.Domain) {
+			routes = append(routes, r)
+		}
+	}
+	if ips := e.withdraw(routes); len(ips) > 0 {
+		e.logf("🧹 %d routes withdrawn", len(ips))
+	}
+}
+
+// RuleGroups returns the state of every rule group, in configuration order
+func (e *Engine) RuleGroups() []RuleGroupStatus {
+	e.groupMu.Lock()
+	defer e.groupMu.Unlock()
+	status := make([]RuleGroupStatus, len(e.groups))
+	for i, g := range e.groups {
+		status[i] = RuleGroupStatus{Name: g.Name, Enabled: g.Enabled, Rules: len(g.rules)}
+	}
+	return status
+}
+
+// readGroupState returns the saved toggles; a missing file has none
+func readGroupState(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var saved map[string]bool
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return saved, nil
+}
+
+// saveGroupState writes the state of every group to RuleGroupStatePath.
+// Called with e.groupMu held.
+func (e *Engine) saveGroupState() (err error) {
+	path := e.opts.RuleGroupStatePath
+	if path == "" {
+		return nil
+	}
+	defer func() { audit.Record(audit.FileWrite, path, "rule group toggles", err) }()
+	saved := make(map[string]bool, len(e.groups))
+	for _, g := range e.groups {
+		saved[g.Name] = g.Enabled
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"context"
+	"errors"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/leaktest"
+	"openvpnadvanced/vpn"
+)
+
+// ErrVPNDown is returned by LeakTest while no VPN interface is up
+var ErrVPNDown = errors.New("the VPN is down, PROXY domains have no egress to test")
+
+// LeakTest asks external services which resolver and exit address they
+// observe for PROXY domains, resolved by the upstream and leaving through
+// the VPN, and for DIRECT ones, resolved by the designated resolver when
+// there is one and leaving through the default route. It returns the
+// results and the leaks they show.
+func (e *Engine) LeakTest(ctx context.Context) ([]leaktest.Result, []string, error) {
+	iface := e.currentVPNInterface()
+	if iface == "" {
+		return nil, nil, ErrVPNDown
+	}
+	_, direct, _ := vpn.GetDefaultGateway()
+	r := e.snapshot.Load().Resolver(e.opts.Logger)
+	proxyName, directName := dnsmasq.PolicyProxy.String(), dnsmasq.PolicyDirect.String()
+	results := e.opts.LeakTest.Run(ctx, []leaktest.Path{
+		{Policy: proxyName, Upstream: r.UpstreamFor(dnsmasq.PolicyProxy), Iface: iface},
+		{Policy: directName, Upstream: r.UpstreamFor(dnsmasq.PolicyDirect), Iface: direct},
+	})
+	return results, leaktest.Leaks(results, proxyName, directName), nil
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/events"
+	"openvpnadvanced/nat64"
+)
+
+// NAT64 returns the NAT64 prefix AAAA answers are synthesized with, if
+// the network has one
+func (e *Engine) NAT64() (netip.Prefix, bool) {
+	prefix := e.snapshot.Load().NAT64
+	return prefix, prefix.IsValid()
+}
+
+// detectNAT64 looks for a NAT64 prefix on Start, every NAT64Interval and
+// after the network changed until ctx is canceled, following the device
+// between IPv6-only and dual-stack networks
+func (e *Engine) detectNAT64(ctx context.Context) error {
+	ticker := time.NewTicker(e.opts.NAT64Interval)
+	defer ticker.Stop()
+	changed, stop := e.notify(events.NetworkChanged)
+	defer stop()
+
+	for {
+		e.refreshNAT64(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// refreshNAT64 swaps the detected prefix in, or out when it's gone,
+// logging only changes
+func (e *Engine) refreshNAT64(ctx context.Context) {
+	var found netip.Prefix
+	resolver, err := e.localResolver(e.opts.DDRResolver)
+	if err == nil {
+		var prefixes []netip.Prefix
+		if prefixes, err = nat64.Discover(ctx, resolver); err == nil {
+			found = prefixes[0]
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	prev, _ := e.NAT64()
+	switch {
+	case found == prev:
+		return
+	case found.IsValid():
+		e.logf("🌐 NAT64 detected, prefix %s", found)
+	default:
+		e.logf("🌐 NAT64 gone (%v)", err)
+	}
+	e.swap(func(sn *dnsproxy.Snapshot) {
+		sn.NAT64 = found
+	})
+}
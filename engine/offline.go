@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// offlineAfter is how many probes in a row must fail before offline
+	// mode is entered
+	offlineAfter = 2
+	// offlineRecheck is how often the upstream is probed after a failure
+	// and while offline
+	offlineRecheck = 5 * time.Second
+	// offlineProbeTimeout bounds one probe
+	offlineProbeTimeout = 5 * time.Second
+)
+
+// Offline reports whether queries are answered from the cache only
+// because no upstream is reachable, and since when
+func (e *Engine) Offline() (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return time.Time{}, false
+	}
+	return e.server.Offline()
+}
+
+// watchOffline probes the upstream every OfflineInterval. Once it fails
+// to answer offlineAfter times in a row, queries are answered from the
+// cache only and the rest fail at once; the first answer ends offline
+// mode.
+func (e *Engine) watchOffline(ctx context.Context) error {
+	timer := time.NewTimer(e.opts.OfflineInterval)
+	defer timer.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		err := e.probeUpstream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			failures = 0
+		} else {
+			failures++
+		}
+		e.setOffline(failures >= offlineAfter, err)
+
+		next := e.opts.OfflineInterval
+		if failures > 0 {
+			next = offlineRecheck
+		}
+		timer.Reset(next)
+	}
+}
+
+// probeUpstream asks the upstream for the root name servers. Any answer,
+// even an error code, shows it's reachable.
+func (e *Engine) probeUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, offlineProbeTimeout)
+	defer cancel()
+	_, err := e.upstream.ExchangeContext(ctx, ".", dns.TypeNS)
+	if errors.Is(err, doh.ErrNXDomain) || errors.Is(err, doh.ErrServFail) {
+		return nil
+	}
+	return err
+}
+
+// setOffline switches offline mode, logging only changes
+func (e *Engine) setOffline(offline bool, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return
+	}
+	since, was := e.server.Offline()
+	switch {
+	case offline && !was:
+		e.logf("📴 No upstream reachable (%v), answering from the cache only", err)
+	case !offline && was:
+		e.logf("📶 Upstream reachable again after %s offline", time.Since(since).Round(time.Second))
+	default:
+		return
+	}
+	e.server.SetOffline(offline)
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/probe"
+)
+
+// AnswerOrder decides which address of an answer holding several is
+// returned and routed
+type AnswerOrder int
+
+const (
+	// AnswerOrderUpstream keeps the upstream's order
+	AnswerOrderUpstream AnswerOrder = iota
+	// AnswerOrderShuffle picks addresses in random order, spreading load
+	AnswerOrderShuffle
+	// AnswerOrderRTT prefers the address with the fastest TCP handshake
+	// through the egress it is reached through (see probe.AddrSorter)
+	AnswerOrderRTT
+)
+
+// ParseAnswerOrder parses "upstream", "shuffle" or "rtt"
+func ParseAnswerOrder(s string) (AnswerOrder, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "upstream":
+		return AnswerOrderUpstream, nil
+	case "shuffle":
+		return AnswerOrderShuffle, nil
+	case "rtt":
+		return AnswerOrderRTT, nil
+	}
+	return 0, fmt.Errorf("unknown answer order %q (want upstream, shuffle or rtt)", s)
+}
+
+func (o AnswerOrder) String() string {
+	switch o {
+	case AnswerOrderShuffle:
+		return "shuffle"
+	case AnswerOrderRTT:
+		return "rtt"
+	default:
+		return "upstream"
+	}
+}
+
+// sorter returns the resolver's address sorter for AnswerOrder
+func (e *Engine) sorter() dnsmasq.AddrSorter {
+	switch e.opts.AnswerOrder {
+	case AnswerOrderShuffle:
+		return dnsmasq.Shuffle
+	case AnswerOrderRTT:
+		return &probe.AddrSorter{Iface: func(viaVPN bool) string {
+			// 直连地址走路由表（默认路由已是直连）
+			if viaVPN {
+				return e.currentVPNInterface()
+			}
+			return ""
+		}}
+	}
+	return nil
+}
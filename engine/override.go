@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"openvpnadvanced/actions"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/peersync"
+	"openvpnadvanced/vpn"
+)
+
+// Override pins the domains under suffix to egress for ttl (until
+// cleared when ttl is 0), above the rules. egress is DIRECT, VPN or an
+// action name. Routes already installed for those domains are withdrawn
+// when they now leave the VPN, and their connections killed so clients
+// reconnect directly.
+func (e *Engine) Override(suffix, egress string, ttl time.Duration) (dnsproxy.Override, error) {
+	suffix = strings.TrimSpace(suffix)
+	if suffix == "" {
+		return dnsproxy.Override{}, errors.New("empty domain")
+	}
+	egress, err := e.egress(egress)
+	if err != nil {
+		return dnsproxy.Override{}, err
+	}
+
+	ov := dnsproxy.Override{Suffix: suffix, Egress: egress}
+	if ttl > 0 {
+		ov.Expires = time.Now().Add(ttl)
+	}
+	e.logf("📌 Override: %s ➜ %s", ov.Suffix, ov.Egress)
+	e.setOverride(ov)
+	e.sync.Publish(peersync.Message{Kind: peersync.KindOverride, Suffix: ov.Suffix, Egress: ov.Egress, Expires: ov.Expires})
+	return ov, nil
+}
+
+// egress canonicalizes an override egress: DIRECT, VPN or a known action
+func (e *Engine) egress(egress string) (string, error) {
+	switch {
+	case strings.EqualFold(egress, dnsproxy.Direct):
+		return dnsproxy.Direct, nil
+	case strings.EqualFold(egress, actions.VPN), strings.EqualFold(egress, actions.Proxy):
+		return actions.VPN, nil
+	}
+	if _, ok := e.actions[strings.ToUpper(egress)]; !ok {
+		return "", fmt.Errorf("unknown egress %q (want DIRECT, VPN or an action)", egress)
+	}
+	return egress, nil
+}
+
+// setOverride adds ov and withdraws the routes it takes off the VPN
+func (e *Engine) setOverride(ov dnsproxy.Override) {
+	e.overrides.Set(ov)
+	if !strings.EqualFold(ov.Egress, actions.VPN) {
+		e.withdrawRoutes(ov.Suffix)
+	}
+}
+
+// ClearOverride removes the override for suffix and reports whether there
+// was one. Its domains follow the rules again from their next query.
+func (e *Engine) ClearOverride(suffix string) bool {
+	suffix = strings.TrimSpace(suffix)
+	e.sync.Publish(peersync.Message{Kind: peersync.KindClearOverride, Suffix: suffix})
+	return e.overrides.Remove(suffix)
+}
+
+// Overrides returns the active runtime overrides
+func (e *Engine) Overrides() []dnsproxy.Override {
+	return e.overrides.List()
+}
+
+// Kill closes the live connections to target, an address or a domain
+// suffix whose routed addresses are killed, so clients reconnect along
+// the current routes. It returns the addresses killed.
+func (e *Engine) Kill(target string) ([]string, error) {
+	target = strings.TrimSpace(target)
+	var ips []string
+	if addr, err := netip.ParseAddr(target); err == nil {
+		ips = []string{addr.String()}
+	} else {
+		for _, r := range e.routesUnder(target) {
+			ips = append(ips, r.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no routed address for %s", target)
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		if err := e.router.KillConnections(ip); err != nil {
+			if errors.Is(err, vpn.ErrKillUnsupported) {
+				return nil, err
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", ip, err))
+		}
+	}
+	e.logf("🔪 Killed connections to %s (%s)", target, strings.Join(ips, ", "))
+	return ips, errors.Join(errs...)
+}
+
+// routesUnder returns the installed routes of domains under suffix
+func (e *Engine) routesUnder(suffix string) []dnsproxy.Route {
+	suffix = strings.ToLower(suffix)
+	var routes []dnsproxy.Route
+	for _, r := range e.state.Routes() {
+		if dnsmasq.MatchSuffix(strings.ToLower(r.Domain), suffix) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// withdrawRoutes removes the installed routes of domains under suffix and
+// kills their connections
+func (e *Engine) withdrawRoutes(suffix string) {
+	if ips := e.withdraw(e.routesUnder(suffix)); len(ips) > 0 {
+		e.logf("🧹 %d routes under %s withdrawn", len(ips), suffix)
+	}
+}
+
+// withdraw removes routes and kills their connections, returning the
+// addresses whose routes were removed
+func (e *Engine) withdraw(routes []dnsproxy.Route) []string {
+	var ips []string
+	for _, r := range routes {
+		if err := e.router.DeleteHostRoute(r.IP); err != nil {
+			e.logf("⚠️ Failed to remove route for %s ➜ %s: %v", r.Domain, r.IP, err)
+			continue
+		}
+		e.state.RemoveRoute(r.IP)
+		// 非 Linux 平台无法关闭连接，路由移除后连接会自行失效
+		_ = e.router.KillConnections(r.IP)
+		ips = append(ips, r.IP)
+	}
+	return ips
+}
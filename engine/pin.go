@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsproxy"
+)
+
+// Pin answers domain with ip for ttl (until cleared when ttl is 0)
+// instead of asking the upstream, and routes it by the rules as before.
+// With no ip, the domain is pinned to the address it resolves to now, so
+// a CDN rotating it can't move it off its route mid-session. Queries for
+// the other address family get an empty answer.
+func (e *Engine) Pin(domain, ip string, ttl time.Duration) (dnsproxy.Pin, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	if domain == "" {
+		return dnsproxy.Pin{}, errors.New("empty domain")
+	}
+	if ip == "" {
+		resolved, _, err := e.snapshot.Load().Resolver(e.logger).ResolveChain(domain)
+		if err != nil {
+			return dnsproxy.Pin{}, fmt.Errorf("resolving %s: %w", domain, err)
+		}
+		ip = resolved
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" {
+		return dnsproxy.Pin{}, fmt.Errorf("invalid address %q", ip)
+	}
+
+	pin := dnsproxy.Pin{Domain: domain, IP: addr.Unmap()}
+	if ttl > 0 {
+		pin.Expires = time.Now().Add(ttl)
+	}
+	e.pins.Set(pin)
+	e.logf("📍 Pin: %s ➜ %s", domain, pin.IP)
+	return pin, nil
+}
+
+// Unpin removes the pin of domain and reports whether there was one. The
+// domain is resolved again from its next query.
+func (e *Engine) Unpin(domain string) bool {
+	return e.pins.Remove(strings.TrimSpace(domain))
+}
+
+// Pins returns the active pins
+func (e *Engine) Pins() []dnsproxy.Pin {
+	return e.pins.List()
+}
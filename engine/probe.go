@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"openvpnadvanced/events"
+	"openvpnadvanced/probe"
+	"openvpnadvanced/vpn"
+)
+
+// ProbeDownRounds is how many consecutive unanswered probe rounds make
+// ProbeFallback treat the VPN as down
+const ProbeDownRounds = 3
+
+// Egress names of the probed paths
+const (
+	EgressVPN    = "VPN"
+	EgressDirect = "DIRECT"
+)
+
+// Probes returns the latest RTT and loss measurements of each egress, or
+// nil when ProbeTargets is empty
+func (e *Engine) Probes() []probe.Stats {
+	if e.prober == nil {
+		return nil
+	}
+	return e.prober.Stats()
+}
+
+// egresses returns the paths to probe: the VPN interface while it's up,
+// and the interface of the default route
+func (e *Engine) egresses() []probe.Egress {
+	var egresses []probe.Egress
+	if iface := e.currentVPNInterface(); iface != "" {
+		egresses = append(egresses, probe.Egress{Name: EgressVPN, Iface: iface})
+	}
+	// 找不到默认网关时不绑定接口，由路由表决定
+	_, iface, _ := vpn.GetDefaultGateway()
+	return append(egresses, probe.Egress{Name: EgressDirect, Iface: iface})
+}
+
+// probed switches the VPN fallback on while the tunnel has stopped
+// answering probes and off once it answers again
+func (e *Engine) probed(stats []probe.Stats) {
+	if !e.opts.ProbeFallback {
+		return
+	}
+	for _, st := range stats {
+		if st.Egress != EgressVPN {
+			continue
+		}
+		down := st.Down(ProbeDownRounds)
+		e.mu.Lock()
+		wasDown := e.probeDown
+		e.probeDown = down
+		e.mu.Unlock()
+		switch {
+		case down && !wasDown:
+			e.logf("⚠️ No answer through the VPN (%s) for %d rounds: %s", st.Iface, st.Failing, st.LastErr)
+			e.events.Publish(events.Event{Kind: events.VPNDown, PrevIface: st.Iface, Cause: events.CauseProbe})
+		case !down && wasDown:
+			e.logf("✅ VPN (%s) answers probes again (%s)", st.Iface, st.RTT)
+			e.events.Publish(events.Event{Kind: events.VPNUp, Iface: st.Iface, Cause: events.CauseProbe})
+		}
+	}
+}
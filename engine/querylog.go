@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"errors"
+	"io"
+
+	"openvpnadvanced/querylog"
+)
+
+// ErrNoQueryLog is returned while no query log is kept
+var ErrNoQueryLog = errors.New("query log is off or the listener isn't running")
+
+// QueryLog returns the latest resolutions matching f, newest first
+func (e *Engine) QueryLog(f querylog.Filter) ([]querylog.Entry, error) {
+	ql := e.queryLog()
+	if ql == nil {
+		return nil, ErrNoQueryLog
+	}
+	return ql.Query(f), nil
+}
+
+// ExportQueryLog writes the resolutions matching f to w as JSON lines,
+// oldest first, and returns how many it wrote
+func (e *Engine) ExportQueryLog(w io.Writer, f querylog.Filter) (int, error) {
+	ql := e.queryLog()
+	if ql == nil {
+		return 0, ErrNoQueryLog
+	}
+	return ql.Export(w, f)
+}
+
+func (e *Engine) queryLog() *querylog.Log {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.server == nil {
+		return nil
+	}
+	return e.server.QueryLog
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/peersync"
+)
+
+// DefaultRollbackTimeout is how long Checkpoint waits for Confirm when
+// given no timeout
+const DefaultRollbackTimeout = 60 * time.Second
+
+var (
+	// ErrCheckpointPending is returned by Checkpoint while an earlier
+	// checkpoint awaits confirmation
+	ErrCheckpointPending = errors.New("a checkpoint is already pending")
+	// ErrNoCheckpoint is returned by Confirm and Rollback when no
+	// checkpoint is pending
+	ErrNoCheckpoint = errors.New("no pending checkpoint")
+)
+
+// checkpoint is the state Rollback returns to
+type checkpoint struct {
+	// snapshot holds the rules, rewrites and resolver settings
+	snapshot    *dnsproxy.Snapshot
+	baseRules   []dnsmasq.Rule
+	baseMatcher dnsmasq.RuleMatcher
+	groups      map[string]groupState
+	overrides   []dnsproxy.Override
+	pins        []dnsproxy.Pin
+	// routes are the routes installed when the checkpoint was taken
+	routes []dnsproxy.Route
+
+	deadline time.Time
+	timer    *time.Timer
+}
+
+type groupState struct {
+	enabled bool
+	rules   []dnsmasq.Rule
+}
+
+// Checkpoint records the rules, rule group toggles, rewrites, overrides,
+// pins, upstreams and resolver settings, and the installed routes, and
+// rolls every change made to them afterwards back unless Confirm is
+// called within timeout (DefaultRollbackTimeout when 0). The cache and
+// what the engine detects on the network (the designated resolver and
+// the NAT64 prefix) are left alone. It guards
+// sweeping changes on a remote machine: when a change cuts the session
+// used to make it, the machine recovers on its own. It returns when the
+// rollback is due.
+func (e *Engine) Checkpoint(timeout time.Duration) (time.Time, error) {
+	if timeout <= 0 {
+		timeout = DefaultRollbackTimeout
+	}
+	e.rollbackMu.Lock()
+	defer e.rollbackMu.Unlock()
+	if e.checkpoint != nil {
+		return time.Time{}, ErrCheckpointPending
+	}
+
+	cp := &checkpoint{
+		groups:    make(map[string]groupState),
+		overrides: e.overrides.List(),
+		pins:      e.pins.List(),
+		routes:    e.state.Routes(),
+		deadline:  time.Now().Add(timeout),
+	}
+	e.groupMu.Lock()
+	cp.snapshot = e.snapshot.Load()
+	cp.baseRules, cp.baseMatcher = e.baseRules, e.baseMatcher
+	for _, g := range e.groups {
+		cp.groups[g.Name] = groupState{enabled: g.Enabled, rules: g.rules}
+	}
+	e.groupMu.Unlock()
+	cp.timer = time.AfterFunc(timeout, func() { e.expireCheckpoint(cp) })
+	e.checkpoint = cp
+	e.logf("⏳ Checkpoint taken, changes roll back in %s unless confirmed", timeout)
+	return cp.deadline, nil
+}
+
+// Confirm keeps the changes made since Checkpoint
+func (e *Engine) Confirm() error {
+	e.rollbackMu.Lock()
+	defer e.rollbackMu.Unlock()
+	if e.checkpoint == nil {
+		return ErrNoCheckpoint
+	}
+	e.checkpoint.timer.Stop()
+	e.checkpoint = nil
+	e.logf("✅ Changes confirmed")
+	return nil
+}
+
+// Rollback reverts the changes made since Checkpoint right away
+func (e *Engine) Rollback() error {
+	e.rollbackMu.Lock()
+	defer e.rollbackMu.Unlock()
+	cp := e.checkpoint
+	if cp == nil {
+		return ErrNoCheckpoint
+	}
+	cp.timer.Stop()
+	e.checkpoint = nil
+	return e.restore(cp)
+}
+
+// PendingCheckpoint returns when the pending checkpoint rolls back, if
+// one awaits confirmation
+func (e *Engine) PendingCheckpoint() (time.Time, bool) {
+	e.rollbackMu.Lock()
+	defer e.rollbackMu.Unlock()
+	if e.checkpoint == nil {
+		return time.Time{}, false
+	}
+	return e.checkpoint.deadline, true
+}
+
+// expireCheckpoint rolls cp back once its timer fires, unless it was
+// confirmed or rolled back meanwhile
+func (e *Engine) expireCheckpoint(cp *checkpoint) {
+	e.rollbackMu.Lock()
+	defer e.rollbackMu.Unlock()
+	if e.checkpoint != cp {
+		return
+	}
+	e.checkpoint = nil
+	e.logf("⏪ Changes not confirmed in time, rolling back")
+	if err := e.restore(cp); err != nil {
+		e.logf("⚠️ Rollback incomplete: %v", err)
+	}
+}
+
+// restore returns everything Checkpoint recorded to cp: it reinstalls the
+// routes withdrawn since, and withdraws those installed since that the
+// restored rules no longer send through the VPN. Called with
+// e.rollbackMu held.
+func (e *Engine) restore(cp *checkpoint) error {
+	e.groupMu.Lock()
+	e.baseRules, e.baseMatcher = cp.baseRules, cp.baseMatcher
+	for _, g := range e.groups {
+		if saved, ok := cp.groups[g.Name]; ok {
+			g.Enabled, g.rules = saved.enabled, saved.rules
+		}
+	}
+	e.swap(func(sn *dnsproxy.Snapshot) {
+		// 缓存和网络探测结果不属于检查点
+		cache, negative, geoIP, direct, nat64 := sn.Cache, sn.Negative, sn.GeoIP, sn.Direct, sn.NAT64
+		*sn = *cp.snapshot
+		sn.Cache, sn.Negative, sn.GeoIP, sn.Direct, sn.NAT64 = cache, negative, geoIP, direct, nat64
+	})
+	err := e.saveGroupState()
+	e.groupMu.Unlock()
+
+	current := make(map[string]dnsproxy.Override)
+	for _, ov := range e.overrides.List() {
+		current[ov.Suffix] = ov
+	}
+	saved := make(map[string]bool, len(cp.overrides))
+	now := time.Now()
+	for _, ov := range cp.overrides {
+		saved[ov.Suffix] = true
+		// 检查点之后已过期的覆盖不再恢复
+		if cur, ok := current[ov.Suffix]; (ok && cur == ov) || (!ov.Expires.IsZero() && !now.Before(ov.Expires)) {
+			continue
+		}
+		e.setOverride(ov)
+		e.sync.Publish(peersync.Message{Kind: peersync.KindOverride, Suffix: ov.Suffix, Egress: ov.Egress, Expires: ov.Expires})
+	}
+	for suffix := range current {
+		if !saved[suffix] {
+			e.ClearOverride(suffix)
+		}
+	}
+	e.restorePins(cp.pins, now)
+
+	routed := make(map[string]bool, len(cp.routes))
+	for _, r := range cp.routes {
+		routed[r.IP] = true
+	}
+	installed := make(map[string]bool)
+	sn := e.snapshot.Load()
+	var routes []dnsproxy.Route
+	for _, r := range e.state.Routes() {
+		installed[r.IP] = true
+		if routed[r.IP] {
+			continue
+		}
+		if ov, ok := e.overrides.Lookup(r.Domain, now); ok {
+			if ov.Routes() {
+				continue
+			}
+		} else if sn.Routes(r.Domain) {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	if ips := e.withdraw(routes); len(ips) > 0 {
+		e.logf("🧹 %d routes withdrawn", len(ips))
+	}
+	if n := e.reinstall(cp.routes, installed); n > 0 {
+		e.logf("↩️ %d routes reinstalled", n)
+	}
+	e.logf("⏪ Rolled back: %d rules", e.RuleCount())
+	return err
+}
+
+// restorePins returns the pins to saved, dropping those that expired
+// meanwhile
+func (e *Engine) restorePins(saved []dnsproxy.Pin, now time.Time) {
+	keep := make(map[string]bool, len(saved))
+	for _, p := range saved {
+		if !p.Expires.IsZero() && !now.Before(p.Expires) {
+			continue
+		}
+		keep[p.Domain] = true
+		e.pins.Set(p)
+	}
+	for _, p := range e.pins.List() {
+		if !keep[p.Domain] {
+			e.pins.Remove(p.Domain)
+		}
+	}
+}
+
+// reinstall re-adds the routes not among installed, returning how many
+// it did
+func (e *Engine) reinstall(routes []dnsproxy.Route, installed map[string]bool) int {
+	n := 0
+	for _, r := range routes {
+		if installed[r.IP] {
+			continue
+		}
+		if err := e.router.AddHostRoute(r.IP, r.Iface); err != nil {
+			e.logf("⚠️ Failed to reinstall route for %s ➜ %s: %v", r.Domain, r.IP, err)
+			continue
+		}
+		e.state.AddRoute(r)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+)
+
+// stateVersion is bumped whenever StateFile changes incompatibly
+const stateVersion = 1
+
+// StateFile is the on-disk runtime snapshot written by SaveState
+type StateFile struct {
+	Version  int                          `json:"version"`
+	SavedAt  time.Time                    `json:"saved_at"`
+	Cache    map[string]dnsmasq.DNSRecord `json:"cache"`
+	Routes   []dnsproxy.Route             `json:"routes"`
+	RuleHits map[string]uint64            `json:"rule_hits"`
+}
+
+// State returns the engine's installed routes and rule hit counters
+func (e *Engine) State() *dnsproxy.State {
+	return e.state
+}
+
+// SaveState writes the cache, installed routes and rule hit counters to
+// path. The file is replaced atomically.
+func (e *Engine) SaveState(path string) (err error) {
+	defer func() { audit.Record(audit.FileWrite, path, "runtime state", err) }()
+	sf := StateFile{
+		Version:  stateVersion,
+		SavedAt:  time.Now(),
+		Cache:    e.Cache().Raw(),
+		Routes:   e.state.Routes(),
+		RuleHits: e.state.Hits(),
+	}
+	data, err := json.MarshalIndent(&sf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreState loads a snapshot written by SaveState. Cache entries keep
+// their original age and expired ones are dropped; routes are reinstalled
+// on the next Start. A missing file is not an error.
+func (e *Engine) RestoreState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var sf StateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if sf.Version != stateVersion {
+		return fmt.Errorf("%s: unsupported state version %d", path, sf.Version)
+	}
+
+	dnsmasq.RestoreCache(e.Cache(), sf.Cache, e.opts.CacheTTL)
+	e.state.Restore(sf.Routes, sf.RuleHits)
+
+	e.mu.Lock()
+	e.restored = append(e.restored, sf.Routes...)
+	e.mu.Unlock()
+	e.logf("Restored state from %s: %d cache entries, %d routes", path, len(sf.Cache), len(sf.Routes))
+	return nil
+}
+
+// reinstallRoutes re-adds restored routes through the current VPN
+// interface, in case they were lost while the daemon was down. Called
+// with e.mu held.
+func (e *Engine) reinstallRoutes(iface string) {
+	failed := 0
+	for _, r := range e.restored {
+		if err := e.router.AddHostRoute(r.IP, iface); err != nil {
+			failed++
+			continue
+		}
+		e.state.AddRoute(dnsproxy.Route{Domain: r.Domain, IP: r.IP, Iface: iface, Added: r.Added})
+	}
+	if failed > 0 {
+		e.logf("⚠️ %d of %d restored routes could not be reinstalled", failed, len(e.restored))
+	}
+	e.restored = nil
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"strings"
+
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/hooks"
+	"openvpnadvanced/peersync"
+)
+
+// hooks returns the hooks given to the DNS server: Options.Hooks, plus
+// sharing the answers of matched domains with the peers when syncing
+func (e *Engine) hooks() *hooks.Hooks {
+	if e.sync == nil {
+		return e.opts.Hooks
+	}
+	h := &hooks.Hooks{}
+	if e.opts.Hooks != nil {
+		*h = *e.opts.Hooks
+	}
+	next := h.OnRuleMatch
+	h.OnRuleMatch = func(ev hooks.RuleMatchEvent) {
+		e.sync.Publish(peersync.Message{Kind: peersync.KindCache, Domain: ev.Domain, Value: ev.IP})
+		if next != nil {
+			next(ev)
+		}
+	}
+	return h
+}
+
+// applySync applies a message from a peer without sharing it again
+func (e *Engine) applySync(from string, m peersync.Message) {
+	switch m.Kind {
+	case peersync.KindOverride:
+		egress, err := e.egress(m.Egress)
+		if err != nil {
+			e.logf("⚠️ Ignoring override of %s from %s: %v", m.Suffix, from, err)
+			return
+		}
+		e.setOverride(dnsproxy.Override{Suffix: m.Suffix, Egress: egress, Expires: m.Expires})
+		e.logf("🔗 Override from %s: %s ➜ %s", from, m.Suffix, egress)
+	case peersync.KindClearOverride:
+		if e.overrides.Remove(strings.TrimSpace(m.Suffix)) {
+			e.logf("🔗 Override of %s cleared by %s", m.Suffix, from)
+		}
+	case peersync.KindCache:
+		// 只补充本地没有的答案，本地解析结果优先
+		cache := e.Cache()
+		if m.Domain == "" || m.Value == "" {
+			return
+		}
+		if _, ok := cache.Get(m.Domain); !ok {
+			cache.Set(m.Domain, m.Value)
+		}
+	}
+}
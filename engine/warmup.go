@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/dnsproxy"
+)
+
+// warmUpWorkers bounds concurrent warm-up resolutions so the upstream
+// isn't flooded at boot
+const warmUpWorkers = 8
+
+// warmUpDomains returns WarmUp followed by the WarmUpTop rules with the
+// most hits, as restored from StatePath, without duplicates
+func (e *Engine) warmUpDomains() []string {
+	domains := slices.Clone(e.opts.WarmUp)
+	if e.opts.WarmUpTop > 0 {
+		hits := e.state.Hits()
+		suffixes := slices.Collect(maps.Keys(hits))
+		slices.SortFunc(suffixes, func(a, b string) int {
+			if c := cmp.Compare(hits[b], hits[a]); c != 0 {
+				return c
+			}
+			return strings.Compare(a, b)
+		})
+		if len(suffixes) > e.opts.WarmUpTop {
+			suffixes = suffixes[:e.opts.WarmUpTop]
+		}
+		for _, suffix := range suffixes {
+			domains = append(domains, strings.TrimPrefix(suffix, "."))
+		}
+	}
+	seen := make(map[string]bool, len(domains))
+	return slices.DeleteFunc(domains, func(d string) bool {
+		d = strings.ToLower(strings.TrimSpace(d))
+		dup := d == "" || seen[d]
+		seen[d] = true
+		return dup
+	})
+}
+
+// warmUp pre-resolves the warm-up domains through server and installs the
+// routes of matched ones, so the first queries after boot hit the cache
+func (e *Engine) warmUp(ctx context.Context, server *dnsproxy.DNSServer) error {
+	domains := e.warmUpDomains()
+	if len(domains) == 0 {
+		return nil
+	}
+	start := time.Now()
+	var routed, failed atomic.Int32
+	sem := make(chan struct{}, warmUpWorkers)
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			matched, err := server.WarmUp(domain)
+			switch {
+			case err != nil:
+				failed.Add(1)
+			case matched:
+				routed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	e.logf("🔥 Warm-up resolved %d domains in %v (%d routed, %d failed)",
+		len(domains), time.Since(start).Round(time.Millisecond), routed.Load(), failed.Load())
+	return nil
+}
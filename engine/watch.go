@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"context"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/filewatch"
+)
+
+// watchRules reloads the rules whenever RulePath or a rule group list is
+// edited, until ctx is canceled. Lists included with RULE-SET aren't
+// watched. A failure to watch is logged without stopping the engine.
+func (e *Engine) watchRules(ctx context.Context) error {
+	paths := []string{e.opts.RulePath}
+	for _, g := range e.opts.RuleGroups {
+		paths = append(paths, g.Paths...)
+	}
+	err := filewatch.Watch(ctx, paths, filewatch.DefaultDelay, func(changed []string) {
+		e.logf("🔄 Rule files changed: %v", changed)
+		if err := e.Reload(); err != nil {
+			e.logf("⚠️ Failed to reload rules: %v", err)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		e.logf("⚠️ Stopped watching rule files: %v", err)
+	}
+	return ctx.Err()
+}
+
+// diffRules counts the rules of next missing from prev, and those of prev
+// missing from next
+func diffRules(prev, next []dnsmasq.Rule) (added, removed int) {
+	seen := make(map[dnsmasq.Rule]int, len(prev))
+	for _, r := range prev {
+		seen[r]++
+	}
+	for _, r := range next {
+		if seen[r] > 0 {
+			seen[r]--
+			continue
+		}
+		added++
+	}
+	for _, n := range seen {
+		removed += n
+	}
+	return added, removed
+}
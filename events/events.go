@@ -0,0 +1,145 @@
+// Package events is the engine's in-process publish/subscribe bus. The
+// modules that notice a change (the VPN watcher, the network watcher, rule
+// reloads) publish it once, and the modules that react to it (the route
+// manager's fallback, the hooks, resolver rediscovery, cache flushing)
+// subscribe, instead of each detector calling every reaction by hand.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Kind is the type of an event
+type Kind uint8
+
+const (
+	// VPNUp is published when the VPN interface comes up, is replaced by
+	// another one, or answers probes again; Iface is the interface
+	VPNUp Kind = iota + 1
+	// VPNDown is published when the VPN interface goes down or stops
+	// answering probes; PrevIface is the interface
+	VPNDown
+	// NetworkChanged is published when the default route moves to another
+	// gateway or interface, e.g. joining another Wi-Fi network
+	NetworkChanged
+	// RulesReloaded is published after the rule files were read again and
+	// their rules swapped in
+	RulesReloaded
+)
+
+func (k Kind) String() string {
+	switch k {
+	case VPNUp:
+		return "vpn-up"
+	case VPNDown:
+		return "vpn-down"
+	case NetworkChanged:
+		return "network-changed"
+	case RulesReloaded:
+		return "rules-reloaded"
+	}
+	return "unknown"
+}
+
+// Causes of VPNUp and VPNDown
+const (
+	// CauseInterface means the VPN interface itself changed
+	CauseInterface = "interface"
+	// CauseProbe means probes through the VPN stopped or resumed being
+	// answered while the interface stayed up
+	CauseProbe = "probe"
+)
+
+// Event is something that happened; fields not relevant to Kind are zero
+type Event struct {
+	Kind Kind
+	Time time.Time
+	// Iface is the current interface: the VPN's for VPNUp, the default
+	// route's for NetworkChanged
+	Iface     string
+	PrevIface string
+	// Cause tells VPN events apart (CauseInterface or CauseProbe)
+	Cause string
+	// Gateway and PrevGateway are the default gateways of NetworkChanged
+	Gateway     string
+	PrevGateway string
+	// Rules is the number of rules after RulesReloaded
+	Rules int
+}
+
+type subscriber struct {
+	id    uint64
+	kinds []Kind
+	fn    func(Event)
+}
+
+// Bus delivers published events to the subscribers of their kind. It is
+// safe for concurrent use. Methods are safe on a nil *Bus, which drops
+// events.
+type Bus struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   []subscriber
+}
+
+// New returns a bus with no subscribers
+func New() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls fn with every event of the given kinds, all kinds when
+// none are given, and returns a function that unsubscribes it. fn runs
+// synchronously on the publishing goroutine, so slow work should be
+// handed off; it may publish or subscribe itself.
+func (b *Bus) Subscribe(fn func(Event), kinds ...Kind) func() {
+	if b == nil {
+		return func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	b.subs = append(b.subs, subscriber{id: id, kinds: kinds, fn: fn})
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, s := range b.subs {
+			if s.id == id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers ev to its subscribers in the order they subscribed,
+// stamping its Time when zero
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+	for _, s := range subs {
+		if s.wants(ev.Kind) {
+			s.fn(ev)
+		}
+	}
+}
+
+func (s subscriber) wants(k Kind) bool {
+	if len(s.kinds) == 0 {
+		return true
+	}
+	for _, kind := range s.kinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+// Package exprrules evaluates rules written in the expr language
+// (https://expr-lang.org) for decisions the static rule grammar can't
+// express. A rule is an "EXPR," line in the rule list:
+//
+//	EXPR,domain endsWith ".corp.example" && hour >= 9 && hour < 18
+//	EXPR,cidr(ip, "10.0.0.0/8") ? "mytunnel" : false
+//
+// An expression returning true routes the answer through the VPN; a
+// non-empty string names the action to run instead (see package actions).
+// false, "" and nil don't match.
+package exprrules
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Prefix introduces an expression rule in a rule list
+const Prefix = "EXPR,"
+
+// Env is the data visible to expressions
+type Env struct {
+	// Domain is the queried name, lower-case without the trailing dot
+	Domain string `expr:"domain"`
+	// IP is the resolved address; IPs holds every resolved address
+	IP  string   `expr:"ip"`
+	IPs []string `expr:"ips"`
+	// ClientIP and ClientPort identify the DNS client
+	ClientIP   string `expr:"client_ip"`
+	ClientPort int    `expr:"client_port"`
+	// QType is the query type, e.g. "A"
+	QType string `expr:"qtype"`
+	// Now is the evaluation time; Hour and Weekday ("Monday"...) are
+	// derived from it in local time
+	Now     time.Time `expr:"now"`
+	Hour    int       `expr:"hour"`
+	Weekday string    `expr:"weekday"`
+}
+
+// NewEnv fills the time-derived fields of an Env for now
+func NewEnv(domain, ip, clientIP string, clientPort int, qtype string, now time.Time) Env {
+	return Env{
+		Domain:     strings.TrimSuffix(strings.ToLower(domain), "."),
+		IP:         ip,
+		IPs:        []string{ip},
+		ClientIP:   clientIP,
+		ClientPort: clientPort,
+		QType:      qtype,
+		Now:        now,
+		Hour:       now.Hour(),
+		Weekday:    now.Weekday().String(),
+	}
+}
+
+// cidr reports whether ip lies in prefix; malformed input doesn't match
+func cidr(params ...any) (any, error) {
+	ip, err := netip.ParseAddr(params[0].(string))
+	if err != nil {
+		return false, nil
+	}
+	prefix, err := netip.ParsePrefix(params[1].(string))
+	if err != nil {
+		return false, err
+	}
+	return prefix.Contains(ip), nil
+}
+
+var options = []expr.Option{
+	expr.Env(Env{}),
+	expr.Function("cidr", cidr, new(func(string, string) bool)),
+}
+
+// Rule is a compiled expression rule
+type Rule struct {
+	Source  string
+	program *vm.Program
+}
+
+// Compile compiles an expression
+func Compile(source string) (*Rule, error) {
+	program, err := expr.Compile(source, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Source: source, program: program}, nil
+}
+
+// Eval runs the rule against env and returns whether it matched and the
+// action it selected (empty for the default VPN route)
+func (r *Rule) Eval(env Env) (bool, string, error) {
+	out, err := expr.Run(r.program, env)
+	if err != nil {
+		return false, "", err
+	}
+	switch v := out.(type) {
+	case bool:
+		return v, "", nil
+	case string:
+		return v != "", v, nil
+	case nil:
+		return false, "", nil
+	default:
+		return false, "", fmt.Errorf("expression returned %T, want bool or string", out)
+	}
+}
+
+// Set is an ordered list of expression rules; the first match wins
+type Set struct {
+	Rules []*Rule
+}
+
+// Len returns the number of rules
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.Rules)
+}
+
+// Eval evaluates the rules in order. A rule failing at runtime is skipped
+// and its error returned alongside the overall result.
+func (s *Set) Eval(env Env) (bool, string, error) {
+	if s == nil {
+		return false, "", nil
+	}
+	var firstErr error
+	for _, r := range s.Rules {
+		matched, action, err := r.Eval(env)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", r.Source, err)
+			}
+			continue
+		}
+		if matched {
+			return true, action, firstErr
+		}
+	}
+	return false, "", firstErr
+}
+
+// LoadFile compiles every EXPR line of a rule list, reporting the first
+// bad expression with its line number
+func LoadFile(path string) (*Set, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := &Set{}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		source, ok := strings.CutPrefix(line, Prefix)
+		if !ok {
+			continue
+		}
+		rule, err := Compile(strings.TrimSpace(source))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		set.Rules = append(set.Rules, rule)
+	}
+	return set, scanner.Err()
+}
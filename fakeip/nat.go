@@ -0,0 +1,112 @@
+package fakeip
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// Policy routing of the range: traffic to it is marked with Mark and
+// routed by Table, whose default route is the VPN
+const (
+	Mark  = 0x1053
+	Table = 1053
+)
+
+// PoolRules returns the iptables rules (without the -A/-C/-D verb) for
+// the range: marking traffic to it in the mangle table, in OUTPUT and
+// PREROUTING so LAN clients of a gateway are covered, and masquerading
+// the marked traffic, whose source was picked for the original route. The
+// first element of each rule is the command.
+func PoolRules(prefix netip.Prefix) [][]string {
+	mark := fmt.Sprintf("0x%x", Mark)
+	return [][]string{
+		{"iptables", "-t", "mangle", "OUTPUT", "-d", prefix.String(), "-j", "MARK", "--set-mark", mark},
+		{"iptables", "-t", "mangle", "PREROUTING", "-d", prefix.String(), "-j", "MARK", "--set-mark", mark},
+		{"iptables", "-t", "nat", "POSTROUTING", "-m", "mark", "--mark", mark, "-j", "MASQUERADE"},
+	}
+}
+
+// NATRules returns the nat table rules (without the verb) translating
+// connections to fake into connections to real
+func NATRules(fake, real netip.Addr) [][]string {
+	var rules [][]string
+	for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+		rules = append(rules, []string{"iptables", "-t", "nat", chain, "-d", fake.String(), "-j", "DNAT", "--to-destination", real.String()})
+	}
+	return rules
+}
+
+// Setup routes the range through iface with run (e.g. exec'ing through
+// sudo): Table's default route goes through iface, a rule sends marked
+// traffic to Table, and the PoolRules mark it. Calling it again, e.g.
+// after the VPN came back on another interface, moves the route.
+func Setup(run func(name string, args ...string) error, prefix netip.Prefix, iface string) error {
+	table, mark := strconv.Itoa(Table), fmt.Sprintf("0x%x", Mark)
+	if err := run("ip", "route", "replace", "default", "dev", iface, "table", table); err != nil {
+		return fmt.Errorf("route through %s: %v", iface, err)
+	}
+	// ip rule 不去重：先删掉之前留下的，再添加一条
+	for i := 0; i < 8 && run("ip", "rule", "del", "fwmark", mark, "lookup", table) == nil; i++ {
+	}
+	if err := run("ip", "rule", "add", "fwmark", mark, "lookup", table); err != nil {
+		return fmt.Errorf("rule: %v", err)
+	}
+	return install(run, PoolRules(prefix))
+}
+
+// Teardown removes what Setup installed; translations are removed with
+// Unmap first
+func Teardown(run func(name string, args ...string) error, prefix netip.Prefix) error {
+	firstErr := remove(run, PoolRules(prefix))
+	table, mark := strconv.Itoa(Table), fmt.Sprintf("0x%x", Mark)
+	if err := run("ip", "rule", "del", "fwmark", mark, "lookup", table); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := run("ip", "route", "flush", "table", table); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// Map installs the translation of fake to real
+func Map(run func(name string, args ...string) error, fake, real netip.Addr) error {
+	return install(run, NATRules(fake, real))
+}
+
+// Unmap removes the translation of fake to real
+func Unmap(run func(name string, args ...string) error, fake, real netip.Addr) error {
+	return remove(run, NATRules(fake, real))
+}
+
+// install adds rules, skipping those already present
+func install(run func(name string, args ...string) error, rules [][]string) error {
+	for _, rule := range rules {
+		if run(rule[0], withVerb(rule, "-C")...) == nil {
+			continue
+		}
+		if err := run(rule[0], withVerb(rule, "-A")...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes rules, carrying on past failures
+func remove(run func(name string, args ...string) error, rules [][]string) error {
+	var firstErr error
+	for _, rule := range rules {
+		if err := run(rule[0], withVerb(rule, "-D")...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// withVerb returns the arguments of rule with verb inserted before the
+// chain
+func withVerb(rule []string, verb string) []string {
+	args := append([]string{}, rule[1:3]...)
+	args = append(args, verb)
+	return append(args, rule[3:]...)
+}
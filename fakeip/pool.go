@@ -0,0 +1,227 @@
+// Package fakeip answers routed domains with addresses from a reserved
+// range instead of their real ones. The whole range is routed through the
+// VPN once, up front, and connections to a fake address are translated to
+// the real destination, so the first connection to a newly resolved domain
+// no longer races the installation of its host route. Routing follows the
+// destination address rather than the TLS server name, so it keeps working
+// when Encrypted Client Hello hides the name.
+package fakeip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRange is the benchmarking range of RFC 2544, which no real
+// destination uses
+const DefaultRange = "198.18.0.0/15"
+
+// DefaultTTL is the TTL fake answers carry, short so clients come back
+// soon after a fallback to DIRECT and get the real addresses
+const DefaultTTL = time.Second
+
+// DefaultMinIdle is how long a mapping must have gone unused before its
+// address is recycled for another domain (see Pool.MinIdle)
+const DefaultMinIdle = 10 * time.Minute
+
+// ErrExhausted is returned by Assign when every address of the range was
+// handed out within MinIdle, so none can be recycled yet
+var ErrExhausted = errors.New("fake-ip range exhausted")
+
+// Mapping is a fake address handed out for a domain
+type Mapping struct {
+	Domain string
+	Fake   netip.Addr
+	// Real is the address connections to Fake are translated to
+	Real netip.Addr
+	// Used is when the mapping was last handed out
+	Used time.Time
+}
+
+// Pool hands out the addresses of a range, one per domain. Once every
+// address is taken, the least recently used mapping is recycled, provided
+// it went unused for MinIdle. It is safe for concurrent use.
+type Pool struct {
+	// MinIdle keeps a mapping from being recycled while clients may still
+	// connect to its address, e.g. from an answer they cached, or hold
+	// connections through it (default DefaultMinIdle). Set it before use.
+	MinIdle time.Duration
+
+	prefix netip.Prefix
+	// size is the number of usable addresses, without the range's first
+	// and last
+	size uint32
+
+	mu       sync.Mutex
+	byDomain map[string]*list.Element
+	byFake   map[netip.Addr]*list.Element
+	// lru holds *Mapping, the most recently used first
+	lru *list.List
+	// next is the offset of the first address never handed out
+	next uint32
+	// free are released addresses, handed out again first
+	free []netip.Addr
+}
+
+// New returns a pool over prefix, an IPv4 range of at least 4 addresses
+func New(prefix netip.Prefix) (*Pool, error) {
+	prefix = prefix.Masked()
+	if !prefix.IsValid() || !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("fake-ip range %s: want an IPv4 range", prefix)
+	}
+	if prefix.Bits() > 30 {
+		return nil, fmt.Errorf("fake-ip range %s: want at least a /30", prefix)
+	}
+	return &Pool{
+		MinIdle:  DefaultMinIdle,
+		prefix:   prefix,
+		size:     1<<(32-prefix.Bits()) - 2,
+		byDomain: make(map[string]*list.Element),
+		byFake:   make(map[netip.Addr]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+// Prefix returns the range the pool hands out
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Contains reports whether addr is in the pool's range
+func (p *Pool) Contains(addr netip.Addr) bool {
+	return p.prefix.Contains(addr.Unmap())
+}
+
+// Assignment is the outcome of Assign
+type Assignment struct {
+	Mapping
+	// Changed reports that the translation is new or differs from the
+	// previous one, Prev, so the caller installs it
+	Changed bool
+	Prev    *Mapping
+	// Evicted is a mapping recycled to make room, whose translation the
+	// caller removes
+	Evicted *Mapping
+}
+
+// Assign returns the mapping of domain, whose answer holds the addresses
+// reals, handing out an address when the domain has none. An existing
+// translation is kept while its address is still among reals, so answers
+// rotating between the same addresses don't change it; otherwise it moves
+// to reals[0]. It fails with ErrExhausted when no address is free.
+func (p *Pool) Assign(domain string, reals []netip.Addr, now time.Time) (Assignment, error) {
+	if len(reals) == 0 {
+		return Assignment{}, fmt.Errorf("fake-ip %s: no address to translate to", domain)
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.byDomain[domain]; ok {
+		cur := el.Value.(*Mapping)
+		p.lru.MoveToFront(el)
+		cur.Used = now
+		var a Assignment
+		if !slices.Contains(reals, cur.Real) {
+			old := *cur
+			a.Prev, a.Changed = &old, true
+			cur.Real = reals[0]
+		}
+		a.Mapping = *cur
+		return a, nil
+	}
+
+	var a Assignment
+	var fake netip.Addr
+	if n := len(p.free); n > 0 {
+		fake = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else if p.next < p.size {
+		fake = p.addr(p.next)
+		p.next++
+	} else {
+		// 地址用尽时回收最久未用的映射，但它须已闲置 MinIdle
+		el := p.lru.Back()
+		old := *el.Value.(*Mapping)
+		if now.Sub(old.Used) < p.MinIdle {
+			return Assignment{}, fmt.Errorf("fake-ip %s: %w (%s used %s ago)", domain, ErrExhausted, old.Fake, now.Sub(old.Used).Round(time.Second))
+		}
+		a.Evicted = &old
+		p.lru.Remove(el)
+		delete(p.byDomain, old.Domain)
+		delete(p.byFake, old.Fake)
+		fake = old.Fake
+	}
+	cur := &Mapping{Domain: domain, Fake: fake, Real: reals[0], Used: now}
+	el := p.lru.PushFront(cur)
+	p.byDomain[domain] = el
+	p.byFake[fake] = el
+	a.Mapping, a.Changed = *cur, true
+	return a, nil
+}
+
+// Release drops the mapping of domain, e.g. when its translation couldn't
+// be installed, and returns it
+func (p *Pool) Release(domain string) (Mapping, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.byDomain[domain]
+	if !ok {
+		return Mapping{}, false
+	}
+	m := *el.Value.(*Mapping)
+	p.lru.Remove(el)
+	delete(p.byDomain, domain)
+	delete(p.byFake, m.Fake)
+	p.free = append(p.free, m.Fake)
+	return m, true
+}
+
+// addr returns the address at offset, skipping the range's first
+func (p *Pool) addr(offset uint32) netip.Addr {
+	b := p.prefix.Addr().As4()
+	n := (uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])) + 1 + offset
+	return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+}
+
+// Lookup returns the mapping of a fake address
+func (p *Pool) Lookup(fake netip.Addr) (Mapping, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.byFake[fake.Unmap()]
+	if !ok {
+		return Mapping{}, false
+	}
+	return *el.Value.(*Mapping), true
+}
+
+// Mappings returns the mappings in address order
+func (p *Pool) Mappings() []Mapping {
+	p.mu.Lock()
+	out := make([]Mapping, 0, p.lru.Len())
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		out = append(out, *el.Value.(*Mapping))
+	}
+	p.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Fake.Less(out[j].Fake) })
+	return out
+}
+
+// Len returns the number of mappings
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// Size returns the number of addresses the pool hands out
+func (p *Pool) Size() int {
+	return int(p.size)
+}
@@ -0,0 +1,107 @@
+package fakeip
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	real1 = netip.MustParseAddr("192.0.2.1")
+	real2 = netip.MustParseAddr("192.0.2.2")
+	real3 = netip.MustParseAddr("192.0.2.3")
+)
+
+func TestNewRejectsRanges(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/31", "10.0.0.0/32", "fd00::/64"} {
+		if _, err := New(netip.MustParsePrefix(s)); err == nil {
+			t.Errorf("New(%s) succeeded, want an error", s)
+		}
+	}
+	p, err := New(netip.MustParsePrefix(DefaultRange))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Size() != 1<<17-2 {
+		t.Errorf("Size() = %d, want %d", p.Size(), 1<<17-2)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	p, _ := New(netip.MustParsePrefix("10.0.0.0/30"))
+	now := time.Now()
+
+	a, err := p.Assign("Example.com.", []netip.Addr{real1}, now)
+	if err != nil || !a.Changed || a.Fake != netip.MustParseAddr("10.0.0.1") || a.Domain != "example.com" {
+		t.Fatalf("first Assign = %+v, %v", a, err)
+	}
+
+	// 轮换到同一组地址时不改动转换
+	a, _ = p.Assign("example.com", []netip.Addr{real2, real1}, now)
+	if a.Changed || a.Real != real1 {
+		t.Errorf("rotated answer: %+v, want the translation to %s kept", a, real1)
+	}
+
+	a, _ = p.Assign("example.com", []netip.Addr{real3}, now)
+	if !a.Changed || a.Real != real3 || a.Prev == nil || a.Prev.Real != real1 {
+		t.Errorf("changed answer: %+v, want a move from %s to %s", a, real1, real3)
+	}
+}
+
+func TestAssignRecyclesIdleOnly(t *testing.T) {
+	p, _ := New(netip.MustParsePrefix("10.0.0.0/30"))
+	p.MinIdle = time.Minute
+	now := time.Now()
+	p.Assign("a.com", []netip.Addr{real1}, now)
+	p.Assign("b.com", []netip.Addr{real2}, now.Add(time.Second))
+
+	if _, err := p.Assign("c.com", []netip.Addr{real3}, now.Add(30*time.Second)); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Assign with every address in use: err = %v, want ErrExhausted", err)
+	}
+
+	a, err := p.Assign("c.com", []netip.Addr{real3}, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Evicted == nil || a.Evicted.Domain != "a.com" || a.Fake != a.Evicted.Fake {
+		t.Errorf("Assign = %+v, want a.com's address recycled", a)
+	}
+	if _, ok := p.Lookup(a.Fake); !ok || p.Len() != 2 {
+		t.Errorf("Lookup(%s) = %v, Len() = %d", a.Fake, ok, p.Len())
+	}
+
+	if _, ok := p.Release("c.com"); !ok {
+		t.Fatal("Release(c.com) found nothing")
+	}
+	d, _ := p.Assign("d.com", []netip.Addr{real3}, now.Add(2*time.Minute))
+	if d.Fake != a.Fake || d.Evicted != nil {
+		t.Errorf("Assign after Release = %+v, want the released %s", d, a.Fake)
+	}
+}
+
+func TestRules(t *testing.T) {
+	var cmds []string
+	run := func(name string, args ...string) error {
+		cmds = append(cmds, name+" "+strings.Join(args, " "))
+		if len(args) > 2 && args[2] == "-C" {
+			return fmt.Errorf("no such rule")
+		}
+		return nil
+	}
+	fake := netip.MustParseAddr("198.18.0.1")
+	if err := Map(run, fake, real1); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -t nat -C OUTPUT -d 198.18.0.1 -j DNAT --to-destination 192.0.2.1",
+		"iptables -t nat -A OUTPUT -d 198.18.0.1 -j DNAT --to-destination 192.0.2.1",
+		"iptables -t nat -C PREROUTING -d 198.18.0.1 -j DNAT --to-destination 192.0.2.1",
+		"iptables -t nat -A PREROUTING -d 198.18.0.1 -j DNAT --to-destination 192.0.2.1",
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Map ran\n%s\nwant\n%s", strings.Join(cmds, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -2,58 +2,62 @@ package fetcher
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"strings"
+
+	"openvpnadvanced/audit"
 )
 
-func FetchAndMergeRules(subscriptionFile, outputFile string) error {
-	urls, err := readSubscriptionURLs(subscriptionFile)
+// FetchAndMergeRules fetches the rule lists listed in subscriptionFile
+// once and merges them into outputFile, see Subscriptions
+func FetchAndMergeRules(subscriptionFile, outputFile string) (err error) {
+	s := NewSubscriptions(subscriptionFile, outputFile, 0)
+	n, _, err := s.update(context.Background())
 	if err != nil {
 		return err
 	}
+	fmt.Printf("✅ Merged %d unique rules into %s\n", n, outputFile)
+	return nil
+}
 
-	ruleSet := make(map[string]struct{})
-
-	for _, url := range urls {
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Printf("Failed to fetch %s: %v\n", url, err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("Failed to read from %s: %v\n", url, err)
-			continue
-		}
-
-		lines := strings.Split(string(body), "\n")
-		for _, line := range lines {
+// mergeRules concatenates lists, dropping comments, blank lines and
+// repeated rules. Rules keep their order, the first occurrence winning,
+// since the first matching rule decides.
+func mergeRules(lists [][]byte) ([]byte, int) {
+	seen := make(map[string]struct{})
+	var out bytes.Buffer
+	for _, list := range lists {
+		for _, line := range strings.Split(string(list), "\n") {
 			rule := strings.TrimSpace(line)
 			if rule == "" || strings.HasPrefix(rule, "#") {
 				continue
 			}
-			ruleSet[rule] = struct{}{}
+			if _, ok := seen[rule]; ok {
+				continue
+			}
+			seen[rule] = struct{}{}
+			out.WriteString(rule + "\n")
 		}
 	}
+	return out.Bytes(), len(seen)
+}
 
-	// Write merged rules to file
-	out, err := os.Create(outputFile)
-	if err != nil {
-		return err
+// writeMerged replaces path with data through a rename, so a reload never
+// reads a partial file, and reports whether the content changed
+func writeMerged(path string, data []byte, count int) (changed bool, err error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
 	}
-	defer out.Close()
-
-	for rule := range ruleSet {
-		_, _ = out.WriteString(rule + "\n")
+	defer func() {
+		audit.Record(audit.FileWrite, path, fmt.Sprintf("%d merged rules", count), err)
+	}()
+	if err := writeFile(path, data); err != nil {
+		return false, err
 	}
-
-	fmt.Printf("✅ Merged %d unique rules into %s\n", len(ruleSet), outputFile)
-	return nil
+	return true, nil
 }
 
 func readSubscriptionURLs(path string) ([]string, error) {
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"os"
 	"strings"
+
+	"openvpnadvanced/dnsmasq"
 )
 
 // ParseRules 读取规则文件并返回规则列表
@@ -28,12 +30,9 @@ func ParseRules(path string) ([]string, error) {
 
 // MatchRule 判断一个域名是否匹配规则列表
 func MatchRule(domain string, rules []string) bool {
-	for _, rule := range rules {
-		if strings.HasPrefix(rule, "DOMAIN-SUFFIX,") {
-			suffix := strings.TrimPrefix(rule, "DOMAIN-SUFFIX,")
-			if strings.HasSuffix(domain, suffix) {
-				return true
-			}
+	for _, line := range rules {
+		if rule, ok := dnsmasq.ParseRuleLine([]byte(line)); ok && rule.Matches(domain) {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,314 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/schedule"
+)
+
+// includePrefixes start the lines including a rule set (see dnsmasq)
+var includePrefixes = []string{"RULE-SET,", "DOMAIN-SET,"}
+
+const (
+	// DefaultRefresh is how often Run refreshes the lists when Refresh
+	// is unset
+	DefaultRefresh = 30 * time.Minute
+	// maxListSize bounds a rule list download
+	maxListSize = 64 << 20
+)
+
+// Subscriptions keeps a rule list merged from remote rule lists current.
+// Every list is cached in CacheDir with its ETag and Last-Modified
+// validators: a refresh asks the server only for what changed, and a
+// list that can't be fetched is merged from its cached copy instead of
+// being dropped.
+type Subscriptions struct {
+	// Client is used for downloads (default: 60s timeout)
+	Client *http.Client
+	// ListPath lists the URLs of the rule lists, one per line
+	ListPath string
+	// Output is the merged rule list
+	Output string
+	// CacheDir holds the cached lists (default: "subscriptions" next to
+	// Output)
+	CacheDir string
+	// Refresh is how often Run refreshes the lists (default
+	// DefaultRefresh)
+	Refresh time.Duration
+	// Window, when set, schedules the refreshes instead of Refresh and
+	// defers them while the network is metered
+	Window *schedule.Window
+
+	mu       sync.Mutex
+	onUpdate []func()
+}
+
+// cacheMeta is stored next to each cached list
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// NewSubscriptions merges the lists at the URLs in listPath into output,
+// refreshing them every refresh
+func NewSubscriptions(listPath, output string, refresh time.Duration) *Subscriptions {
+	return &Subscriptions{
+		Client:   &http.Client{Timeout: 60 * time.Second},
+		ListPath: listPath,
+		Output:   output,
+		CacheDir: filepath.Join(filepath.Dir(output), "subscriptions"),
+		Refresh:  refresh,
+	}
+}
+
+// OnUpdate registers fn to be called after Output is replaced with
+// different rules
+func (s *Subscriptions) OnUpdate(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onUpdate = append(s.onUpdate, fn)
+}
+
+// Update refreshes every list and rewrites Output when the merged rules
+// changed, reporting whether they did. Lists that fail are logged and
+// merged from their cached copy.
+func (s *Subscriptions) Update(ctx context.Context) (bool, error) {
+	_, changed, err := s.update(ctx)
+	if err != nil || !changed {
+		return changed, err
+	}
+	s.mu.Lock()
+	subscribers := append([]func(){}, s.onUpdate...)
+	s.mu.Unlock()
+	for _, fn := range subscribers {
+		fn()
+	}
+	return true, nil
+}
+
+func (s *Subscriptions) update(ctx context.Context) (int, bool, error) {
+	urls, err := readSubscriptionURLs(s.ListPath)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := os.MkdirAll(s.CacheDir, 0755); err != nil {
+		return 0, false, err
+	}
+
+	var lists [][]byte
+	// included 记录被引用的规则集是否有变化，合并结果中只有它们的路径
+	included := false
+	for _, url := range urls {
+		list, _, err := s.fetchCached(ctx, url)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, false, ctx.Err()
+			}
+			continue
+		}
+		list, changed, err := s.localizeIncludes(ctx, list)
+		if err != nil {
+			return 0, false, err
+		}
+		included = included || changed
+		lists = append(lists, list)
+	}
+
+	merged, count := mergeRules(lists)
+	changed, err := writeMerged(s.Output, merged, count)
+	if err == nil && !changed && included {
+		// 让规则数据库按修改时间重建
+		now := time.Now()
+		changed, err = true, os.Chtimes(s.Output, now, now)
+	}
+	return count, changed, err
+}
+
+// fetchCached is fetch, logging failures and falling back to the cached
+// copy. It fails only when there is no copy to use.
+func (s *Subscriptions) fetchCached(ctx context.Context, url string) ([]byte, bool, error) {
+	list, fresh, err := s.fetch(ctx, url)
+	if err == nil {
+		return list, fresh, nil
+	}
+	if ctx.Err() == nil {
+		log.Printf("⚠️ Failed to fetch %s: %v", url, err)
+	}
+	if list == nil {
+		return nil, false, err
+	}
+	log.Printf("Using the cached copy of %s", url)
+	return list, false, nil
+}
+
+// localizeIncludes fetches the remote rule sets that RULE-SET and
+// DOMAIN-SET lines of list include and points the lines at their cached
+// copies, which the rule loader reads. It reports whether one of them
+// changed. Includes of the included rule sets are not followed.
+func (s *Subscriptions) localizeIncludes(ctx context.Context, list []byte) ([]byte, bool, error) {
+	lines := strings.Split(string(list), "\n")
+	changed := false
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		var prefix, rest string
+		for _, p := range includePrefixes {
+			if r, ok := strings.CutPrefix(line, p); ok {
+				prefix, rest = p, r
+				break
+			}
+		}
+		target, opts, _ := strings.Cut(rest, ",")
+		target = strings.TrimSpace(target)
+		if prefix == "" || !(strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")) {
+			continue
+		}
+		_, fresh, err := s.fetchCached(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, ctx.Err()
+			}
+			lines[i] = ""
+			continue
+		}
+		changed = changed || fresh
+		path, _ := s.cachePaths(target)
+		if rel, err := filepath.Rel(filepath.Dir(s.Output), path); err == nil {
+			path = rel
+		}
+		lines[i] = prefix + path
+		if opts != "" {
+			lines[i] += "," + opts
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), changed, nil
+}
+
+// fetch returns the current list at url, downloading it only when it
+// changed since it was cached, and whether it differs from the cached
+// copy. On failure it returns the cached copy, if any, along with the
+// error.
+func (s *Subscriptions) fetch(ctx context.Context, url string) ([]byte, bool, error) {
+	listPath, metaPath := s.cachePaths(url)
+	cached, err := os.ReadFile(listPath)
+	if err != nil {
+		cached = nil
+	}
+	var meta cacheMeta
+	if data, err := os.ReadFile(metaPath); err == nil && cached != nil {
+		_ = json.Unmarshal(data, &meta)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return cached, false, err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return cached, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return cached, false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return cached, false, err
+	}
+	if len(body) > maxListSize {
+		return cached, false, fmt.Errorf("larger than %d bytes", maxListSize)
+	}
+
+	meta = cacheMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	if err := writeFile(listPath, body); err != nil {
+		log.Printf("⚠️ Failed to cache %s: %v", url, err)
+	} else if err := writeFile(metaPath, data); err != nil {
+		log.Printf("⚠️ Failed to cache %s: %v", url, err)
+	}
+	return body, !bytes.Equal(body, cached), nil
+}
+
+// cachePaths returns where the list at url and its validators are cached
+func (s *Subscriptions) cachePaths(url string) (list, meta string) {
+	sum := sha256.Sum256([]byte(url))
+	name := filepath.Join(s.CacheDir, hex.EncodeToString(sum[:8]))
+	return name + ".list", name + ".json"
+}
+
+// Run refreshes the lists every Refresh, or when Window schedules them,
+// until ctx is canceled. Failures are logged and retried on the next run.
+func (s *Subscriptions) Run(ctx context.Context) error {
+	refresh := s.Refresh
+	if refresh <= 0 {
+		refresh = DefaultRefresh
+	}
+	for {
+		if err := s.Window.Wait(ctx, "subscriptions", refresh); err != nil {
+			return err
+		}
+		changed, err := s.Update(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, fs.ErrNotExist):
+			// 订阅列表被删除时保留现有规则
+		case err != nil:
+			log.Printf("⚠️ Failed to refresh subscriptions: %v", err)
+		case changed:
+			log.Printf("✅ Subscriptions updated: %s", s.Output)
+		}
+	}
+}
+
+// writeFile replaces path with data through a temporary file and a rename
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,83 @@
+// Package filewatch reports changes to files, so rules and configuration
+// can be reloaded when they're edited
+package filewatch
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDelay is how long Watch lets a burst of changes settle
+const DefaultDelay = 500 * time.Millisecond
+
+// Watch calls fn with the paths that changed whenever some of paths are
+// written, created, replaced, removed or touched, until ctx is canceled.
+// Changes less than delay apart (default DefaultDelay) are reported
+// together, as editors save a file in several steps. The directories of
+// paths are watched rather than the files, so a file replaced through a
+// rename is still followed.
+func Watch(ctx context.Context, paths []string, delay time.Duration, fn func(changed []string)) error {
+	if delay <= 0 {
+		delay = DefaultDelay
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	files := make(map[string]string, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		files[abs] = path
+		dir := filepath.Dir(abs)
+		if !slices.Contains(watcher.WatchList(), dir) {
+			if err := watcher.Add(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	var changed []string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				return err
+			}
+			// 事件丢失时无法知道哪些文件变了
+			changed = slices.Clone(paths)
+			timer.Reset(delay)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			path, watched := files[filepath.Clean(ev.Name)]
+			if !watched {
+				continue
+			}
+			if !slices.Contains(changed, path) {
+				changed = append(changed, path)
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			fn(changed)
+			changed = nil
+		}
+	}
+}
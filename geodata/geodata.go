@@ -0,0 +1,387 @@
+// Package geodata keeps GeoIP (MMDB) and GeoSite database files present
+// and current: a file is downloaded the first time it's needed, every
+// download is checked against a SHA-256 digest before it replaces the
+// old file, files are refreshed on a schedule, and subscribers are told
+// when a file changed so they can reload it without a restart.
+package geodata
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/schedule"
+)
+
+// Defaults for Source and Manager
+const (
+	DefaultRefresh = 24 * time.Hour
+	// retryInterval is how soon a failed refresh is retried
+	retryInterval = 10 * time.Minute
+	// maxSize bounds a database download
+	maxSize = 256 << 20
+)
+
+// ErrChecksum is returned when a download doesn't match its digest
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Source is one managed database file
+type Source struct {
+	// Name identifies the source, e.g. "geoip" or "geosite"
+	Name string
+	URL  string
+	Path string
+	// SHA256 pins the expected hex digest of the file. When empty the
+	// digest is read from ChecksumURL.
+	SHA256 string
+	// ChecksumURL serves "<hex digest> [filename]" for the file (default
+	// URL + ".sha256sum"). A missing default checksum file only skips
+	// verification; an explicit one must be present.
+	ChecksumURL string
+	// Refresh is the maximum age of the file before it's downloaded
+	// again (default DefaultRefresh)
+	Refresh time.Duration
+}
+
+func (s Source) refresh() time.Duration {
+	if s.Refresh <= 0 {
+		return DefaultRefresh
+	}
+	return s.Refresh
+}
+
+// Status reports the state of a source
+type Status struct {
+	Name    string
+	Path    string
+	Updated time.Time
+	SHA256  string
+	// Err is the last refresh error, cleared by a successful refresh
+	Err error
+}
+
+// Manager downloads and refreshes a set of sources
+type Manager struct {
+	// Client is used for downloads (default: 60s timeout)
+	Client *http.Client
+	// Window, when set, schedules the refreshes of existing files instead
+	// of their Refresh and defers them while the network is metered
+	Window *schedule.Window
+
+	sources []Source
+
+	mu        sync.Mutex
+	status    map[string]*Status
+	attempted map[string]time.Time
+	onUpdate  []func(Source)
+
+	// fileMu serializes downloads so a file is fetched once
+	fileMu sync.Mutex
+}
+
+// NewManager manages the given sources
+func NewManager(sources ...Source) *Manager {
+	m := &Manager{
+		Client:    &http.Client{Timeout: 60 * time.Second},
+		sources:   sources,
+		status:    make(map[string]*Status),
+		attempted: make(map[string]time.Time),
+	}
+	for _, src := range sources {
+		st := &Status{Name: src.Name, Path: src.Path}
+		if info, err := os.Stat(src.Path); err == nil {
+			st.Updated = info.ModTime()
+		}
+		m.status[src.Name] = st
+	}
+	return m
+}
+
+// OnUpdate registers fn to be called after a source's file is replaced
+// with different content
+func (m *Manager) OnUpdate(fn func(Source)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onUpdate = append(m.onUpdate, fn)
+}
+
+// Status returns the state of every source
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Status, 0, len(m.sources))
+	for _, src := range m.sources {
+		out = append(out, *m.status[src.Name])
+	}
+	return out
+}
+
+func (m *Manager) source(name string) (Source, bool) {
+	for _, src := range m.sources {
+		if src.Name == name {
+			return src, true
+		}
+	}
+	return Source{}, false
+}
+
+// File returns the path of a source's file, downloading it first if it
+// doesn't exist yet
+func (m *Manager) File(ctx context.Context, name string) (string, error) {
+	src, ok := m.source(name)
+	if !ok {
+		return "", fmt.Errorf("unknown geodata source %q", name)
+	}
+	if _, err := os.Stat(src.Path); err == nil {
+		return src.Path, nil
+	}
+	if _, err := m.Update(ctx, name); err != nil {
+		return "", err
+	}
+	return src.Path, nil
+}
+
+// Update downloads a source, verifies it and replaces the file when the
+// content changed, notifying OnUpdate subscribers. It reports whether
+// the file changed.
+func (m *Manager) Update(ctx context.Context, name string) (bool, error) {
+	src, ok := m.source(name)
+	if !ok {
+		return false, fmt.Errorf("unknown geodata source %q", name)
+	}
+
+	m.fileMu.Lock()
+	changed, digest, err := m.download(ctx, src)
+	m.fileMu.Unlock()
+
+	m.mu.Lock()
+	st := m.status[src.Name]
+	m.attempted[src.Name] = time.Now()
+	st.Err = err
+	if err == nil {
+		st.Updated = time.Now()
+		st.SHA256 = digest
+	}
+	subscribers := slices.Clone(m.onUpdate)
+	m.mu.Unlock()
+
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", src.Name, err)
+	}
+	if changed {
+		for _, fn := range subscribers {
+			fn(src)
+		}
+	}
+	return changed, nil
+}
+
+// download fetches src into a temporary file next to src.Path, checks its
+// digest and renames it into place unless it's identical to the current file
+func (m *Manager) download(ctx context.Context, src Source) (bool, string, error) {
+	want, err := m.expectedDigest(ctx, src)
+	if err != nil {
+		return false, "", err
+	}
+
+	body, err := m.get(ctx, src.URL)
+	if err != nil {
+		return false, "", err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(src.Path), 0755); err != nil {
+		return false, "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(src.Path), filepath.Base(src.Path)+".tmp*")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(body, maxSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if n > maxSize {
+		return false, "", fmt.Errorf("%s is larger than %d bytes", src.URL, maxSize)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if want != "" && !strings.EqualFold(digest, want) {
+		return false, "", fmt.Errorf("%w: got %s, want %s", ErrChecksum, digest, want)
+	}
+	if current, err := fileDigest(src.Path); err == nil && current == digest {
+		// 内容未变，只刷新修改时间以推迟下次检查
+		now := time.Now()
+		return false, digest, os.Chtimes(src.Path, now, now)
+	}
+	err = os.Rename(tmp.Name(), src.Path)
+	audit.Record(audit.FileWrite, src.Path, src.Name+" sha256 "+digest, err)
+	if err != nil {
+		return false, "", err
+	}
+	return true, digest, nil
+}
+
+// expectedDigest returns the pinned or published digest of src, or ""
+// when none is published at the default location
+func (m *Manager) expectedDigest(ctx context.Context, src Source) (string, error) {
+	if src.SHA256 != "" {
+		return src.SHA256, nil
+	}
+	checksumURL := src.ChecksumURL
+	if checksumURL == "" {
+		checksumURL = src.URL + ".sha256sum"
+	}
+
+	body, err := m.get(ctx, checksumURL)
+	if err != nil {
+		var status httpStatusError
+		if src.ChecksumURL == "" && errors.As(err, &status) && status == http.StatusNotFound {
+			log.Printf("⚠️ No checksum published for %s, skipping verification", src.URL)
+			return "", nil
+		}
+		return "", fmt.Errorf("checksum: %w", err)
+	}
+	defer body.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(body, 4096)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("checksum: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("checksum: malformed %s", checksumURL)
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return "", fmt.Errorf("checksum: malformed %s", checksumURL)
+	}
+	return fields[0], nil
+}
+
+type httpStatusError int
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", int(e))
+}
+
+func (m *Manager) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", url, httpStatusError(resp.StatusCode))
+	}
+	return resp.Body, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// due returns when src should next be refreshed: Refresh after the file
+// was last written, or the first scheduled time after it, or
+// retryInterval after a failed attempt
+func (m *Manager) due(src Source) time.Time {
+	m.mu.Lock()
+	st := m.status[src.Name]
+	failed, attempted := st.Err != nil, m.attempted[src.Name]
+	m.mu.Unlock()
+
+	if failed {
+		return attempted.Add(retryInterval)
+	}
+	info, err := os.Stat(src.Path)
+	if err != nil {
+		return time.Time{}
+	}
+	if m.Window.Scheduled() {
+		if next := m.Window.Next(info.ModTime()); !next.IsZero() {
+			return next
+		}
+		return time.Now().Add(DefaultRefresh)
+	}
+	return info.ModTime().Add(src.refresh())
+}
+
+// deferred reports whether the refresh of src waits for an unmetered
+// network; missing files are downloaded regardless
+func (m *Manager) deferred(src Source) bool {
+	if _, err := os.Stat(src.Path); err != nil {
+		return false
+	}
+	if !m.Window.Deferred() {
+		return false
+	}
+	log.Printf("⏸️ Network is metered, deferring the %s refresh", src.Name)
+	return true
+}
+
+// Run downloads missing files and refreshes every source when it's due
+// until ctx is canceled. Failures are logged and retried.
+func (m *Manager) Run(ctx context.Context) error {
+	for {
+		next := time.Now().Add(DefaultRefresh)
+		for _, src := range m.sources {
+			due := m.due(src)
+			if !time.Now().Before(due) && m.deferred(src) {
+				due = time.Now().Add(schedule.MeteredRetry)
+			} else if !time.Now().Before(due) {
+				changed, err := m.Update(ctx, src.Name)
+				switch {
+				case ctx.Err() != nil:
+					return ctx.Err()
+				case err != nil:
+					log.Printf("⚠️ Failed to refresh %v", err)
+				case changed:
+					log.Printf("✅ Updated %s database at %s", src.Name, src.Path)
+				}
+				due = m.due(src)
+			}
+			if due.Before(next) {
+				next = due
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
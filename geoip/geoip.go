@@ -0,0 +1,156 @@
+// Package geoip looks up the country of resolved addresses in a MaxMind
+// (MMDB) database, for GEOIP rules. The database is reopened when its file
+// changes, e.g. after package geodata downloaded a new one.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DefaultInterval is how often Run checks the file when Interval is unset
+const DefaultInterval = time.Hour
+
+// DB is a country database loaded from Path. Methods are safe on a nil
+// *DB, which knows no countries.
+type DB struct {
+	Path string
+	// Interval is how often Run checks Path for a new file (default
+	// DefaultInterval)
+	Interval time.Duration
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+	mtime  time.Time
+}
+
+// record holds the fields read from GeoIP2/GeoLite2 Country databases and
+// the common community variants
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open loads the database at path
+func Open(path string) (*DB, error) {
+	db := &DB{Path: path}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reopens Path when it changed since it was last loaded and reports
+// whether it did. A missing file keeps the current database.
+func (db *DB) Reload() (bool, error) {
+	if db == nil {
+		return false, nil
+	}
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	same := db.reader != nil && info.ModTime().Equal(db.mtime)
+	db.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	reader, err := maxminddb.Open(db.Path)
+	if err != nil {
+		return false, err
+	}
+	db.mu.Lock()
+	old := db.reader
+	db.reader, db.mtime = reader, info.ModTime()
+	db.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return true, nil
+}
+
+// Loaded reports whether a database is loaded
+func (db *DB) Loaded() bool {
+	if db == nil {
+		return false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.reader != nil
+}
+
+// Country returns the upper-case ISO 3166 code of ip's country, or ""
+// when it isn't known
+func (db *DB) Country(ip netip.Addr) string {
+	if db == nil {
+		return ""
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.reader == nil {
+		return ""
+	}
+	var rec record
+	if err := db.reader.Lookup(ip.Unmap().AsSlice(), &rec); err != nil {
+		return ""
+	}
+	code := rec.Country.ISOCode
+	if code == "" {
+		code = rec.RegisteredCountry.ISOCode
+	}
+	return strings.ToUpper(code)
+}
+
+// Run reloads the database whenever its file changes, checking every
+// Interval until ctx is done. The first check happens immediately, so a
+// file that appears later (a first download) is picked up.
+func (db *DB) Run(ctx context.Context) error {
+	interval := db.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if changed, err := db.Reload(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("⚠️ Failed to load GeoIP database %s: %v", db.Path, err)
+		} else if changed {
+			log.Printf("🌍 GeoIP database loaded: %s", db.Path)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close releases the database
+func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	err := db.reader.Close()
+	db.reader = nil
+	return err
+}
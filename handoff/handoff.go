@@ -0,0 +1,196 @@
+// Package handoff passes the DNS listener's sockets to a new process, so
+// the binary can be replaced without the listening address going away:
+// the sockets stay open across the switch and queries arriving meanwhile
+// wait in their buffers instead of being refused.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// envAddr names the inherited sockets' listen address in the environment
+// of the new process
+const envAddr = "OPENVPNADVANCED_HANDOFF"
+
+// Descriptors of the inherited files; ExtraFiles start at 3
+const (
+	fdUDP = 3 + iota
+	fdTCP
+	fdReady
+)
+
+// DefaultTimeout is how long Start waits for the new process to serve
+const DefaultTimeout = 30 * time.Second
+
+// ErrNotReady is returned by Start when the new process didn't take over
+var ErrNotReady = errors.New("new process did not take over the listener")
+
+// Sockets are listening sockets to serve instead of binding Addr
+type Sockets struct {
+	// Addr is the listen address they were bound for
+	Addr       string
+	PacketConn net.PacketConn
+	Listener   net.Listener
+}
+
+// Close closes both sockets; s may be nil
+func (s *Sockets) Close() {
+	if s == nil {
+		return
+	}
+	s.PacketConn.Close()
+	s.Listener.Close()
+}
+
+// Files are duplicates of a listener's UDP and TCP sockets, which stay
+// open while the listener is stopped
+type Files struct {
+	Addr     string
+	UDP, TCP *os.File
+}
+
+// Dup duplicates the sockets of a listener bound for addr
+func Dup(addr string, pc net.PacketConn, ln net.Listener) (*Files, error) {
+	udp, ok := pc.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't pass on a %T", pc)
+	}
+	tcp, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't pass on a %T", ln)
+	}
+	f := &Files{Addr: addr}
+	var err error
+	if f.UDP, err = udp.File(); err != nil {
+		return nil, err
+	}
+	if f.TCP, err = tcp.File(); err != nil {
+		f.UDP.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Sockets returns listening sockets for the files, e.g. to serve them
+// again when the new process failed; the files stay open
+func (f *Files) Sockets() (*Sockets, error) {
+	return sockets(f.Addr, f.UDP, f.TCP)
+}
+
+// Close closes the duplicates
+func (f *Files) Close() {
+	f.UDP.Close()
+	f.TCP.Close()
+}
+
+func sockets(addr string, udp, tcp *os.File) (*Sockets, error) {
+	pc, err := net.FilePacketConn(udp)
+	if err != nil {
+		return nil, fmt.Errorf("inherited UDP socket: %v", err)
+	}
+	ln, err := net.FileListener(tcp)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("inherited TCP socket: %v", err)
+	}
+	return &Sockets{Addr: addr, PacketConn: pc, Listener: ln}, nil
+}
+
+// Start runs argv, the executable first, with the sockets of f and waits
+// up to timeout (default DefaultTimeout) for it to call Ready. A process
+// that doesn't take over is killed. It shares the standard streams of
+// the calling process, which should exit once Start returns nil.
+func Start(f *Files, argv []string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envAddr+"="+f.Addr)
+	cmd.ExtraFiles = []*os.File{f.UDP, f.TCP, w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+		if err == nil {
+			return cmd.Process.Release()
+		}
+	case <-timer.C:
+		err = fmt.Errorf("no answer after %v", timeout)
+	}
+	// 新进程失败时结束它，由旧进程继续服务
+	cmd.Process.Kill()
+	cmd.Wait()
+	return fmt.Errorf("%w: %v", ErrNotReady, err)
+}
+
+var (
+	readyMu sync.Mutex
+	// ready is the pipe to the process this one replaces, until Ready
+	ready *os.File
+)
+
+// Pending reports whether the process was started by Start and hasn't
+// taken the sockets with Inherited yet
+func Pending() bool {
+	_, ok := os.LookupEnv(envAddr)
+	return ok
+}
+
+// Inherited returns the sockets passed by the process this one replaces,
+// once; nil when it wasn't started by Start. Call Ready when done.
+func Inherited() (*Sockets, error) {
+	addr, ok := os.LookupEnv(envAddr)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(envAddr)
+	readyMu.Lock()
+	ready = os.NewFile(fdReady, "handoff-ready")
+	readyMu.Unlock()
+
+	udp, tcp := os.NewFile(fdUDP, "handoff-udp"), os.NewFile(fdTCP, "handoff-tcp")
+	defer udp.Close()
+	defer tcp.Close()
+	return sockets(addr, udp, tcp)
+}
+
+// Ready tells the process this one replaces that it serves the sockets,
+// or with a non-nil err that it failed, so the old process serves them
+// again. It does nothing in a process Start didn't run.
+func Ready(err error) {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if ready == nil {
+		return
+	}
+	if err == nil {
+		ready.Write([]byte{1})
+	}
+	ready.Close()
+	ready = nil
+}
@@ -0,0 +1,377 @@
+// Package history keeps the query history in an SQLite database for
+// later inspection (the `history` command) and analytics. Old entries are
+// pruned by age and row count so the database doesn't grow without bound.
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Entry is one resolved query
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	// Client names the querying client (see package clients)
+	Client string `json:"client,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Route  bool   `json:"route"`
+	Rule   string `json:"rule,omitempty"`
+	Action string `json:"action,omitempty"`
+	// Upstream names the upstream asked; empty for cached and local
+	// answers
+	Upstream string `json:"upstream,omitempty"`
+	// Err is the resolution error; empty on success
+	Err      string        `json:"err,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Retention bounds the history; zero fields don't limit it
+type Retention struct {
+	// MaxAge drops entries older than this
+	MaxAge time.Duration
+	// MaxRows keeps only this many of the newest entries
+	MaxRows int
+}
+
+const (
+	// flushInterval bounds how long an entry may sit in the write buffer
+	flushInterval = time.Second
+	// maxPending flushes early under load
+	maxPending = 512
+	// PruneInterval is how often Run applies the retention
+	PruneInterval = time.Minute
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS queries (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	time     INTEGER NOT NULL,
+	domain   TEXT NOT NULL,
+	client   TEXT NOT NULL DEFAULT '',
+	ip       TEXT NOT NULL DEFAULT '',
+	route    INTEGER NOT NULL DEFAULT 0,
+	rule     TEXT NOT NULL DEFAULT '',
+	action   TEXT NOT NULL DEFAULT '',
+	upstream TEXT NOT NULL DEFAULT '',
+	err      TEXT NOT NULL DEFAULT '',
+	duration INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS queries_time ON queries(time);
+CREATE INDEX IF NOT EXISTS queries_domain ON queries(domain, time);
+CREATE INDEX IF NOT EXISTS queries_client ON queries(client, time);
+`
+
+// Store is an open history database. Methods are safe on a nil *Store,
+// which records nothing.
+type Store struct {
+	db        *sql.DB
+	retention Retention
+
+	mu      sync.Mutex
+	pending []Entry
+	flushed time.Time
+}
+
+// Open opens or creates the history database at path
+func Open(path string, retention Retention) (*Store, error) {
+	// WAL 模式下读取（history 命令）不会阻塞写入
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &Store{db: db, retention: retention, flushed: time.Now()}, nil
+}
+
+// migrate adds the columns databases created by older versions lack
+func migrate(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('queries')`)
+	if err != nil {
+		return err
+	}
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !columns["upstream"] {
+		_, err = db.Exec(`ALTER TABLE queries ADD COLUMN upstream TEXT NOT NULL DEFAULT ''`)
+	}
+	return err
+}
+
+// Record adds e. Writes are batched and committed at least once a second
+// while queries keep arriving, and on Flush and Close.
+func (s *Store) Record(e Entry) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return
+	}
+	s.pending = append(s.pending, e)
+	if len(s.pending) >= maxPending || time.Since(s.flushed) >= flushInterval {
+		if err := s.flushLocked(); err != nil {
+			log.Printf("⚠️ Failed to write query history: %v", err)
+		}
+	}
+}
+
+// ErrClosed is returned by a Store used after Close
+var ErrClosed = errors.New("history is closed")
+
+// Flush commits the buffered entries
+func (s *Store) Flush() error {
+	if s == nil {
+		return nil
+	}
+	_, err := s.flush()
+	return err
+}
+
+// flush commits the buffered entries and returns the database to read
+func (s *Store) flush() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil, ErrClosed
+	}
+	return s.db, s.flushLocked()
+}
+
+func (s *Store) flushLocked() error {
+	s.flushed = time.Now()
+	if len(s.pending) == 0 || s.db == nil {
+		return nil
+	}
+	// 写入失败时丢弃这一批，避免缓冲区无限增长
+	pending := s.pending
+	s.pending = nil
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO queries (time, domain, client, ip, route, rule, action, upstream, err, duration) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range pending {
+		if _, err := stmt.Exec(e.Time.UnixNano(), strings.ToLower(strings.TrimSuffix(e.Domain, ".")), e.Client, e.IP, e.Route, e.Rule, e.Action, e.Upstream, e.Err, int64(e.Duration)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune applies the retention as of now and returns the number of
+// entries removed
+func (s *Store) Prune(now time.Time) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	db, err := s.flush()
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	if s.retention.MaxAge > 0 {
+		res, err := db.Exec(`DELETE FROM queries WHERE time < ?`, now.Add(-s.retention.MaxAge).UnixNano())
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	if s.retention.MaxRows > 0 {
+		res, err := db.Exec(`DELETE FROM queries WHERE id <= (SELECT id FROM queries ORDER BY id DESC LIMIT 1 OFFSET ?)`, s.retention.MaxRows)
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	return removed, nil
+}
+
+// Run flushes the buffer and applies the retention every PruneInterval
+// until ctx is done
+func (s *Store) Run(ctx context.Context) error {
+	ticker := time.NewTicker(PruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if _, err := s.Prune(now); err != nil {
+				log.Printf("⚠️ Failed to prune query history: %v", err)
+			}
+		}
+	}
+}
+
+// Filter selects entries; zero fields match everything
+type Filter struct {
+	// Domain matches the domain and its subdomains
+	Domain string
+	Client string
+	Since  time.Time
+	Until  time.Time
+	// Limit caps the number of entries returned (DefaultLimit when 0)
+	Limit int
+}
+
+// DefaultLimit is the number of entries Query returns by default
+const DefaultLimit = 50
+
+// Query returns the newest entries matching f, newest first
+func (s *Store) Query(f Filter) ([]Entry, error) {
+	if s == nil {
+		return nil, nil
+	}
+	db, err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []any
+	if f.Domain != "" {
+		domain := strings.ToLower(strings.TrimSuffix(f.Domain, "."))
+		where = append(where, `(domain = ? OR domain LIKE ? ESCAPE '\')`)
+		args = append(args, domain, "%."+escapeLike(domain))
+	}
+	if f.Client != "" {
+		where = append(where, `client = ?`)
+		args = append(args, f.Client)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, `time >= ?`)
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, `time < ?`)
+		args = append(args, f.Until.UnixNano())
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	query := `SELECT time, domain, client, ip, route, rule, action, upstream, err, duration FROM queries`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY time DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var at, duration int64
+		if err := rows.Scan(&at, &e.Domain, &e.Client, &e.IP, &e.Route, &e.Rule, &e.Action, &e.Upstream, &e.Err, &duration); err != nil {
+			return nil, err
+		}
+		e.Time, e.Duration = time.Unix(0, at), time.Duration(duration)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DomainStats counts the queries for one domain
+type DomainStats struct {
+	Domain  string `json:"domain"`
+	Queries int    `json:"queries"`
+	// Matched queries matched a rule, including DIRECT rules
+	Matched int `json:"matched"`
+	// Routed queries were routed through the VPN or an action
+	Routed int `json:"routed"`
+	// Failed queries didn't resolve
+	Failed int `json:"failed"`
+}
+
+// Stats returns per-domain counts of the queries since since, busiest
+// domain first
+func (s *Store) Stats(since time.Time) ([]DomainStats, error) {
+	if s == nil {
+		return nil, nil
+	}
+	db, err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT domain, COUNT(*), SUM(rule != ''), SUM(route), SUM(err != '')
+		FROM queries WHERE time >= ? GROUP BY domain ORDER BY COUNT(*) DESC, domain`, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []DomainStats
+	for rows.Next() {
+		var st DomainStats
+		if err := rows.Scan(&st.Domain, &st.Queries, &st.Matched, &st.Routed, &st.Failed); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Close commits the buffered entries and closes the database
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.flushLocked()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	s.db = nil
+	return err
+}
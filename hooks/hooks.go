@@ -0,0 +1,79 @@
+// Package hooks defines the callbacks the engine invokes as queries are
+// resolved and routes change, so library users and scripts can react to
+// them (e.g. notify Home Assistant when the VPN drops).
+package hooks
+
+import "time"
+
+// ResolveEvent is emitted for every resolved query, successful or not
+type ResolveEvent struct {
+	Domain   string
+	IP       string
+	Matched  bool
+	Err      error
+	Duration time.Duration
+	// Client names the querying client (see package clients)
+	Client string
+}
+
+// RuleMatchEvent is emitted when a resolved domain matches a rule
+type RuleMatchEvent struct {
+	Domain string
+	IP     string
+	// Action is the matched rule's action; empty for the default VPN route
+	Action string
+}
+
+// RouteEvent is emitted after a host route was installed
+type RouteEvent struct {
+	Domain string
+	IP     string
+	Iface  string
+	Err    error
+}
+
+// VPNStateEvent is emitted when the VPN interface comes up, goes down or
+// changes. Iface is empty when the VPN is down.
+type VPNStateEvent struct {
+	Up        bool
+	Iface     string
+	PrevIface string
+}
+
+// Hooks holds the subscribed callbacks; nil fields are skipped. Callbacks
+// run synchronously on the emitting goroutine (a resolver worker for the
+// query hooks), so slow work should be handed off.
+type Hooks struct {
+	OnResolve        func(ResolveEvent)
+	OnRuleMatch      func(RuleMatchEvent)
+	OnRouteInjected  func(RouteEvent)
+	OnVPNStateChange func(VPNStateEvent)
+}
+
+// Resolve calls OnResolve if set; h may be nil
+func (h *Hooks) Resolve(ev ResolveEvent) {
+	if h != nil && h.OnResolve != nil {
+		h.OnResolve(ev)
+	}
+}
+
+// RuleMatch calls OnRuleMatch if set; h may be nil
+func (h *Hooks) RuleMatch(ev RuleMatchEvent) {
+	if h != nil && h.OnRuleMatch != nil {
+		h.OnRuleMatch(ev)
+	}
+}
+
+// RouteInjected calls OnRouteInjected if set; h may be nil
+func (h *Hooks) RouteInjected(ev RouteEvent) {
+	if h != nil && h.OnRouteInjected != nil {
+		h.OnRouteInjected(ev)
+	}
+}
+
+// VPNStateChange calls OnVPNStateChange if set; h may be nil
+func (h *Hooks) VPNStateChange(ev VPNStateEvent) {
+	if h != nil && h.OnVPNStateChange != nil {
+		h.OnVPNStateChange(ev)
+	}
+}
@@ -0,0 +1,174 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of ScriptOptions
+const (
+	DefaultScriptWorkers = 4
+	DefaultScriptQueue   = 64
+	DefaultScriptTimeout = 10 * time.Second
+)
+
+// ScriptOptions bounds the runs of a hook script, so a burst of queries
+// can't start a process per event
+type ScriptOptions struct {
+	// IncludeResolve runs the script for every resolved query too. Resolve
+	// events are high-volume; leave it off unless the script is cheap.
+	IncludeResolve bool
+	// Workers is how many runs may be in progress at once (default
+	// DefaultScriptWorkers)
+	Workers int
+	// Queue is how many events may wait for a worker; events arriving while
+	// it is full are dropped and counted (default DefaultScriptQueue)
+	Queue int
+	// Timeout kills a run that takes longer (default DefaultScriptTimeout)
+	Timeout time.Duration
+}
+
+// ScriptRunner runs a hook script for events on a fixed set of workers
+type ScriptRunner struct {
+	path           string
+	includeResolve bool
+	timeout        time.Duration
+	wg             sync.WaitGroup
+	// ctx is canceled by Close, killing the runs in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards jobs against Close
+	mu     sync.RWMutex
+	jobs   chan []string
+	closed bool
+
+	dropped  atomic.Uint64
+	lastWarn atomic.Int64
+}
+
+// Script returns a runner of the executable at path for the selected
+// events. The event is passed in the environment as HOOK_EVENT
+// (resolve, rule-match, route-injected, vpn-state) plus HOOK_DOMAIN,
+// HOOK_IP, HOOK_ACTION, HOOK_IFACE, HOOK_VPN_UP and HOOK_ERROR where they
+// apply. Runs are asynchronous and their failures only logged. Call Close
+// to stop the workers.
+func Script(path string, opts ScriptOptions) *ScriptRunner {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultScriptWorkers
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultScriptQueue
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultScriptTimeout
+	}
+	s := &ScriptRunner{path: path, includeResolve: opts.IncludeResolve, timeout: opts.Timeout, jobs: make(chan []string, opts.Queue)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Hooks returns the callbacks queueing events for the script
+func (s *ScriptRunner) Hooks() *Hooks {
+	h := &Hooks{
+		OnRuleMatch: func(ev RuleMatchEvent) {
+			s.enqueue("rule-match", "HOOK_DOMAIN="+ev.Domain, "HOOK_IP="+ev.IP, "HOOK_ACTION="+ev.Action)
+		},
+		OnRouteInjected: func(ev RouteEvent) {
+			s.enqueue("route-injected", "HOOK_DOMAIN="+ev.Domain, "HOOK_IP="+ev.IP,
+				"HOOK_IFACE="+ev.Iface, "HOOK_ERROR="+errString(ev.Err))
+		},
+		OnVPNStateChange: func(ev VPNStateEvent) {
+			s.enqueue("vpn-state", "HOOK_VPN_UP="+strconv.FormatBool(ev.Up),
+				"HOOK_IFACE="+ev.Iface, "HOOK_PREV_IFACE="+ev.PrevIface)
+		},
+	}
+	if s.includeResolve {
+		h.OnResolve = func(ev ResolveEvent) {
+			s.enqueue("resolve", "HOOK_DOMAIN="+ev.Domain, "HOOK_IP="+ev.IP,
+				"HOOK_MATCHED="+strconv.FormatBool(ev.Matched), "HOOK_CLIENT="+ev.Client, "HOOK_ERROR="+errString(ev.Err))
+		}
+	}
+	return h
+}
+
+// Dropped returns how many events were dropped because the queue was full
+func (s *ScriptRunner) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+// Close stops taking events, drops the queued ones and stops the runs in
+// progress
+func (s *ScriptRunner) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.jobs)
+	}
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s *ScriptRunner) enqueue(event string, env ...string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.jobs <- append([]string{"HOOK_EVENT=" + event}, env...):
+	default:
+		n := s.dropped.Add(1)
+		now := time.Now().UnixNano()
+		if last := s.lastWarn.Load(); now-last >= int64(10*time.Second) && s.lastWarn.CompareAndSwap(last, now) {
+			log.Printf("⚠️ Hook script %s can't keep up, %d events dropped so far", s.path, n)
+		}
+	}
+}
+
+func (s *ScriptRunner) work() {
+	defer s.wg.Done()
+	for env := range s.jobs {
+		if s.ctx.Err() == nil {
+			s.run(env)
+		}
+	}
+}
+
+func (s *ScriptRunner) run(env []string) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.path)
+	cmd.Env = append(os.Environ(), env...)
+	// 脚本被杀后，其子进程可能仍占着输出管道
+	cmd.WaitDelay = time.Second
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("⚠️ Hook script %s (%s) failed: %v: %s", s.path, env[0], err, bytes.TrimSpace(out))
+	}
+}
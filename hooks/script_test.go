@@ -0,0 +1,71 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScriptDropsWhenFull(t *testing.T) {
+	s := Script(writeScript(t, "sleep 1"), ScriptOptions{Workers: 1, Queue: 1, Timeout: time.Minute})
+	h := s.Hooks()
+	for i := 0; i < 10; i++ {
+		h.RuleMatch(RuleMatchEvent{Domain: "example.com"})
+	}
+	// 一个在运行、一个在排队，其余丢弃
+	if got := s.Dropped(); got < 8 {
+		t.Errorf("Dropped() = %d, want at least 8", got)
+	}
+
+	start := time.Now()
+	s.Close()
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Close took %s, want the run in progress killed", took)
+	}
+	h.RuleMatch(RuleMatchEvent{Domain: "example.com"}) // 关闭后的事件被忽略
+}
+
+func TestScriptTimeout(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s := Script(writeScript(t, `echo "$HOOK_EVENT $HOOK_DOMAIN" > `+out+`; sleep 10`), ScriptOptions{Timeout: 200 * time.Millisecond})
+	s.Hooks().RuleMatch(RuleMatchEvent{Domain: "example.com"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(out)
+		if strings.TrimSpace(string(b)) == "rule-match example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("script output = %q", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		// 超时后 worker 空闲，Close 立即返回
+		time.Sleep(time.Second)
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run outlived its timeout")
+	}
+}
@@ -0,0 +1,179 @@
+// Package leaktest checks what external services observe for each egress,
+// the check users otherwise do by hand on dnsleaktest.com: the resolver
+// an authoritative server sees asking for the domains of each policy, and
+// the address traffic leaves with. PROXY domains seen from the DIRECT
+// address are leaks.
+package leaktest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/probe"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultResolverName answers A queries with the address of the
+	// resolver asking for it
+	DefaultResolverName = "whoami.akamai.net"
+	// DefaultExitURL answers with the address of the client, as text
+	DefaultExitURL = "https://api.ipify.org"
+	// DefaultTimeout bounds each check
+	DefaultTimeout = 10 * time.Second
+)
+
+// Path is how the domains of a policy are resolved and leave
+type Path struct {
+	// Policy names the path, e.g. "PROXY" or "DIRECT"
+	Policy string
+	// Upstream resolves the policy's domains
+	Upstream dnsmasq.Upstream
+	// Iface is the interface its traffic leaves through; "" follows the
+	// routing table
+	Iface string
+}
+
+// Result is what the services observed for a Path
+type Result struct {
+	Policy   string
+	Upstream string
+	Iface    string
+	// Resolver is the address the authoritative server saw asking
+	Resolver    string
+	ResolverErr error
+	// Exit is the address the echo service saw connecting
+	Exit    string
+	ExitErr error
+}
+
+// Tester runs the checks; the zero value uses the defaults
+type Tester struct {
+	// ResolverName is queried for the resolver's address (default
+	// DefaultResolverName)
+	ResolverName string
+	// ExitURL is fetched for the exit address (default DefaultExitURL)
+	ExitURL string
+	// Timeout bounds each check (default DefaultTimeout)
+	Timeout time.Duration
+}
+
+// Run checks every path in turn
+func (t *Tester) Run(ctx context.Context, paths []Path) []Result {
+	results := make([]Result, len(paths))
+	for i, p := range paths {
+		r := Result{Policy: p.Policy, Upstream: upstreamName(p.Upstream), Iface: p.Iface}
+		r.Resolver, r.ResolverErr = t.resolver(ctx, p.Upstream)
+		r.Exit, r.ExitErr = t.exit(ctx, p.Iface)
+		results[i] = r
+	}
+	return results
+}
+
+func (t *Tester) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return DefaultTimeout
+}
+
+// resolver asks up for ResolverName, whose answer is the address of the
+// resolver that asked its authoritative server
+func (t *Tester) resolver(ctx context.Context, up dnsmasq.Upstream) (string, error) {
+	name := t.ResolverName
+	if name == "" {
+		name = DefaultResolverName
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.timeout())
+	defer cancel()
+	answer, err := up.Query(ctx, name, dns.TypeA)
+	if err != nil {
+		return "", err
+	}
+	ips, _, err := answer.Addrs(int(dns.TypeA))
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%s: no address in the answer", name)
+	}
+	return ips[0], nil
+}
+
+// exit fetches ExitURL through iface
+func (t *Tester) exit(ctx context.Context, iface string) (string, error) {
+	url := t.ExitURL
+	if url == "" {
+		url = DefaultExitURL
+	}
+	client := &http.Client{
+		Timeout:   t.timeout(),
+		Transport: &http.Transport{DialContext: probe.Dialer(iface, t.timeout()).DialContext},
+	}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return "", fmt.Errorf("%s: not an address: %q", url, body)
+	}
+	return addr.String(), nil
+}
+
+// Leaks describes what the results of the proxied path give away to the
+// direct one: proxied traffic leaving with the direct address, proxied
+// domains resolved from it, or by the resolver of the direct domains
+func Leaks(results []Result, proxy, direct string) []string {
+	var p, d *Result
+	for i := range results {
+		switch results[i].Policy {
+		case proxy:
+			p = &results[i]
+		case direct:
+			d = &results[i]
+		}
+	}
+	if p == nil || d == nil {
+		return nil
+	}
+	var leaks []string
+	if p.Exit != "" && p.Exit == d.Exit {
+		leaks = append(leaks, fmt.Sprintf("%s traffic leaves with the %s address %s", proxy, direct, p.Exit))
+	}
+	if p.Resolver != "" && p.Resolver == d.Exit {
+		leaks = append(leaks, fmt.Sprintf("%s domains are resolved from the %s address %s", proxy, direct, p.Resolver))
+	}
+	if p.Resolver != "" && p.Resolver == d.Resolver && p.Upstream != d.Upstream {
+		leaks = append(leaks, fmt.Sprintf("%s domains reach the %s resolver %s", proxy, direct, p.Resolver))
+	}
+	return leaks
+}
+
+// upstreamName labels u in a Result
+func upstreamName(u dnsmasq.Upstream) string {
+	if s, ok := u.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", u)
+}
@@ -0,0 +1,86 @@
+// Package limits bounds how many operations of a subsystem run at once
+// (upstream queries, route changes, client connections) and counts how
+// often callers had to wait for a slot or gave up waiting.
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrLimited is returned by Acquire when no slot freed up in time
+var ErrLimited = errors.New("concurrency limit reached")
+
+// Limiter is a counting semaphore with hit counters. A nil *Limiter is
+// unlimited, so subsystems can hold one unconditionally.
+type Limiter struct {
+	name     string
+	sem      chan struct{}
+	waited   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// Stats is a point-in-time view of a Limiter
+type Stats struct {
+	Name  string
+	Limit int
+	InUse int
+	// Waited counts acquisitions that found every slot taken
+	Waited uint64
+	// Rejected counts acquisitions abandoned before a slot freed up
+	Rejected uint64
+}
+
+// New returns a limiter allowing n concurrent holders, or nil (unlimited)
+// when n <= 0
+func New(name string, n int) *Limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &Limiter{name: name, sem: make(chan struct{}, n)}
+}
+
+// Acquire takes a slot, waiting until one is free or ctx is done
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.waited.Add(1)
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.rejected.Add(1)
+		return fmt.Errorf("%s: %w", l.name, ErrLimited)
+	}
+}
+
+// Release returns a slot taken by Acquire
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
+
+// Stats returns the limiter's counters; the zero Stats for nil
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	return Stats{
+		Name:     l.name,
+		Limit:    cap(l.sem),
+		InUse:    len(l.sem),
+		Waited:   l.waited.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
@@ -0,0 +1,246 @@
+// Package logging is a leveled, structured logger for the daemon's output.
+// It takes the Printf-style lines of the engine and the resolver (it is a
+// dnsmasq.Logger) and of the standard log package (it is an io.Writer for
+// log.SetOutput), and gives each a module and a level:
+//
+//   - the module is the leading tag of the line, lowercased ("[CACHE] ..."
+//     is module cache), or "main" for untagged lines
+//   - the level is warn for lines starting with ⚠️, error for ❌ and 🚨,
+//     info otherwise
+//
+// Lines below the level of their module, or of the logger, are dropped
+// before they're formatted, so per-module verbosity can silence the
+// resolver's per-query lines without costing their formatting.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Formats of the output
+const (
+	// FormatPlain writes lines as the log package does, emoji and tags
+	// included
+	FormatPlain = "plain"
+	// FormatText writes slog key=value records
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line
+	FormatJSON = "json"
+)
+
+// MainModule is the module of untagged lines
+const MainModule = "main"
+
+// ParseFormat parses "plain", "text" or "json"
+func ParseFormat(s string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(s)); f {
+	case "":
+		return FormatPlain, nil
+	case FormatPlain, FormatText, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q (want plain, text or json)", s)
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error". The older "err"
+// means error, and "vpn" info.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info", "vpn":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error", "err":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// ParseModules parses per-module levels like "cache=error"
+func ParseModules(specs []string) (map[string]slog.Level, error) {
+	modules := make(map[string]slog.Level, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not module=level, e.g. cache=error", spec)
+		}
+		level, err := ParseLevel(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		modules[name] = level
+	}
+	return modules, nil
+}
+
+// Logger writes leveled lines in one of the formats. It is safe for
+// concurrent use; SetLevel and SetModules apply at once.
+type Logger struct {
+	level   slog.LevelVar
+	modules atomic.Pointer[map[string]slog.Level]
+
+	// plain writes FormatPlain lines, handler the others
+	plain   *log.Logger
+	handler slog.Handler
+	mu      sync.Mutex
+}
+
+// New returns a logger writing to w in format at level info
+func New(w io.Writer, format string) (*Logger, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	l := &Logger{}
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case FormatText:
+		l.handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		l.handler = slog.NewJSONHandler(w, opts)
+	default:
+		l.plain = log.New(w, "", log.LstdFlags)
+	}
+	return l, nil
+}
+
+// SetLevel drops lines below level, except in modules with their own
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+// SetModules replaces the per-module levels
+func (l *Logger) SetModules(modules map[string]slog.Level) {
+	l.modules.Store(&modules)
+}
+
+// Enabled reports whether lines of module at level are written
+func (l *Logger) Enabled(module string, level slog.Level) bool {
+	if m := l.modules.Load(); m != nil {
+		if min, ok := (*m)[module]; ok {
+			return level >= min
+		}
+	}
+	return level >= l.level.Level()
+}
+
+// Printf writes a line, classified by its format
+func (l *Logger) Printf(format string, args ...any) {
+	module, level := classify(format)
+	if !l.Enabled(module, level) {
+		return
+	}
+	l.write(module, level, fmt.Sprintf(format, args...))
+}
+
+// Write writes the lines of p, for log.SetOutput with no flags
+func (l *Logger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if module, level := classify(line); l.Enabled(module, level) {
+			l.write(module, level, line)
+		}
+	}
+	return len(p), nil
+}
+
+func (l *Logger) write(module string, level slog.Level, line string) {
+	if l.plain != nil {
+		l.plain.Print(line)
+		return
+	}
+	l.record(module, level, strip(line))
+}
+
+func (l *Logger) record(module string, level slog.Level, msg string) {
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(slog.String("module", module))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.handler.Handle(context.Background(), r)
+}
+
+// classify returns the module and level of a line, from its leading tag
+// and emoji; the emoji may come before or after the tag
+func classify(line string) (string, slog.Level) {
+	module, level := MainModule, slog.LevelInfo
+	for range 2 {
+		if tag, rest, ok := leadingTag(line); ok {
+			module, line = tag, rest
+			continue
+		}
+		if sym, rest, ok := leadingSymbol(line); ok {
+			switch {
+			case strings.HasPrefix(sym, "⚠"):
+				level = slog.LevelWarn
+			case strings.HasPrefix(sym, "❌"), strings.HasPrefix(sym, "🚨"):
+				level = slog.LevelError
+			}
+			line = rest
+		}
+	}
+	return module, level
+}
+
+// strip removes the leading tag and emoji of a line, which the module
+// and level of a structured record carry
+func strip(line string) string {
+	for range 2 {
+		if _, rest, ok := leadingTag(line); ok {
+			line = rest
+		} else if _, rest, ok := leadingSymbol(line); ok {
+			line = rest
+		}
+	}
+	return line
+}
+
+// leadingTag splits "[CACHE] rest" into "cache" and "rest"
+func leadingTag(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "[") {
+		return "", line, false
+	}
+	end := strings.IndexByte(line, ']')
+	if end < 2 {
+		return "", line, false
+	}
+	tag := line[1:end]
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", line, false
+		}
+	}
+	return strings.ToLower(tag), strings.TrimLeft(line[end+1:], " "), true
+}
+
+// leadingSymbol splits a leading emoji (a word without letters or
+// digits) from the rest of the line
+func leadingSymbol(line string) (string, string, bool) {
+	r, _ := utf8.DecodeRuneInString(line)
+	if r < utf8.RuneSelf {
+		return "", line, false
+	}
+	word, rest, _ := strings.Cut(line, " ")
+	for _, r := range word {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return "", line, false
+		}
+	}
+	return word, strings.TrimLeft(rest, " "), true
+}
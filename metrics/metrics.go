@@ -0,0 +1,185 @@
+// Package metrics exposes the resolver's counters and latencies in the
+// Prometheus text format, for running unattended (e.g. on a home gateway)
+// with alerting on failures and stalled upstreams.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path is where the metrics are served
+const Path = "/metrics"
+
+const namespace = "openvpnadvanced"
+
+// Metrics collects the resolver's metrics. Methods are safe on a nil
+// *Metrics, which records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	resolutions *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	cache       *prometheus.CounterVec
+	matches     *prometheus.CounterVec
+	upstream    *prometheus.HistogramVec
+	cnames      prometheus.Histogram
+	routes      *prometheus.CounterVec
+	udpDropped  *prometheus.CounterVec
+	kernelDrops atomic.Pointer[func() uint64]
+}
+
+// New returns Metrics on a registry of their own, which also carries the
+// Go runtime and process collectors
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		resolutions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "resolutions_total",
+			Help: "Resolved queries, by where the answer came from (upstream, cache or local).",
+		}, []string{"source"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "resolution_failures_total",
+			Help: "Failed resolutions, by reason (nxdomain, no_answer, rejected or error).",
+		}, []string{"reason"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "cache_requests_total",
+			Help: "Resolutions answered from the cache (hit) or the upstream (miss).",
+		}, []string{"result"}),
+		matches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "rule_matches_total",
+			Help: "Resolutions a rule matched, by the rule's policy (PROXY, DIRECT or REJECT).",
+		}, []string{"policy"}),
+		upstream: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "upstream_query_duration_seconds",
+			Help:    "Latency of resolutions that asked the upstream, per upstream.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"upstream"}),
+		cnames: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "cname_chain_depth",
+			Help:    "CNAMEs followed per resolution.",
+			Buckets: []float64{0, 1, 2, 3, 4, 6, 8},
+		}),
+		routes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "routes_installed_total",
+			Help: "Host routes installed through the VPN, by result (ok or error).",
+		}, []string{"result"}),
+		udpDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "udp_dropped_total",
+			Help: "UDP datagrams dropped by the listener, by reason (queue_full or malformed).",
+		}, []string{"reason"}),
+	}
+	kernelDrops := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace, Name: "udp_kernel_drops_total",
+		Help: "UDP datagrams the kernel dropped because the listener's read buffer was full (Linux only).",
+	}, func() float64 {
+		if fn := m.kernelDrops.Load(); fn != nil {
+			return float64((*fn)())
+		}
+		return 0
+	})
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.resolutions, m.failures, m.cache, m.matches, m.upstream, m.cnames, m.routes,
+		m.udpDropped, kernelDrops,
+	)
+	return m
+}
+
+// Observe records the resolution d, which failed with err when non-nil
+func (m *Metrics) Observe(d *dnsmasq.Decision, err error) {
+	if m == nil || d == nil {
+		return
+	}
+	m.resolutions.WithLabelValues(d.Source.String()).Inc()
+	switch d.Source {
+	case dnsmasq.SourceCache:
+		m.cache.WithLabelValues("hit").Inc()
+	case dnsmasq.SourceUpstream:
+		m.cache.WithLabelValues("miss").Inc()
+		if d.Upstream != "" {
+			m.upstream.WithLabelValues(d.Upstream).Observe(d.Latency.Seconds())
+		}
+	}
+	m.cnames.Observe(float64(len(d.CNAMEs)))
+	if d.Matched {
+		m.matches.WithLabelValues(d.Policy.String()).Inc()
+	}
+	if err != nil {
+		m.failures.WithLabelValues(reason(err)).Inc()
+	}
+}
+
+// RouteInstalled records a host route installed, or failed with err
+func (m *Metrics) RouteInstalled(err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.routes.WithLabelValues(result).Inc()
+}
+
+// UDPDropped records a UDP datagram dropped by the listener
+func (m *Metrics) UDPDropped(reason string) {
+	if m == nil {
+		return
+	}
+	m.udpDropped.WithLabelValues(reason).Inc()
+}
+
+// SetKernelDrops sets where udp_kernel_drops_total is read from
+func (m *Metrics) SetKernelDrops(fn func() uint64) {
+	if m == nil {
+		return
+	}
+	m.kernelDrops.Store(&fn)
+}
+
+func reason(err error) string {
+	switch {
+	case errors.Is(err, dnsmasq.ErrNXDomain):
+		return "nxdomain"
+	case errors.Is(err, dnsmasq.ErrNoAnswer):
+		return "no_answer"
+	case errors.Is(err, dnsmasq.ErrRejected):
+		return "rejected"
+	}
+	return "error"
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves Path on listen until ctx is done
+func (m *Metrics) Serve(ctx context.Context, listen string) error {
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, m.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(lis)
+	defer srv.Close()
+	log.Printf("📈 Metrics on http://%s%s", lis.Addr(), Path)
+	<-ctx.Done()
+	return ctx.Err()
+}
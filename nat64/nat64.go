@@ -0,0 +1,141 @@
+// Package nat64 detects NAT64 on IPv6-only networks (RFC 7050) and maps
+// between IPv4 addresses and the IPv6 addresses a NAT64 gateway serves
+// them under (RFC 6052). On such networks, including carrier networks
+// running 464XLAT, IPv4-only destinations are reached through addresses
+// inside the NAT64 prefix.
+package nat64
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Name is the well-known name whose only addresses are IPv4, so a DNS64
+// resolver answers its AAAA query with addresses synthesized from the
+// NAT64 prefix
+const Name = "ipv4only.arpa."
+
+// wellKnown are the A records of Name
+var wellKnown = []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 0, 170}), netip.AddrFrom4([4]byte{192, 0, 0, 171})}
+
+// WellKnownPrefix is the NAT64 prefix reserved by RFC 6052
+var WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// ErrNotFound is returned by Discover on networks without DNS64
+var ErrNotFound = errors.New("no NAT64 prefix")
+
+// layout gives the bytes of the IPv6 address holding the IPv4 address for
+// each prefix length; byte 8 (bits 64-71) is always zero
+var layout = map[int][4]int{
+	32: {4, 5, 6, 7},
+	40: {5, 6, 7, 9},
+	48: {6, 7, 9, 10},
+	56: {7, 9, 10, 11},
+	64: {9, 10, 11, 12},
+	96: {12, 13, 14, 15},
+}
+
+// ParseSetting parses a NAT64 setting: "auto" (or empty) to detect the
+// prefix, "off" to disable NAT64, or a prefix to use
+func ParseSetting(value string) (detect bool, prefix netip.Prefix, err error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "auto":
+		return true, netip.Prefix{}, nil
+	case "off", "false":
+		return false, netip.Prefix{}, nil
+	}
+	prefix, err = netip.ParsePrefix(value)
+	if err != nil || !prefix.Addr().Is6() {
+		return false, netip.Prefix{}, fmt.Errorf("invalid nat64 %q: want auto, off or an IPv6 prefix", value)
+	}
+	return false, prefix.Masked(), nil
+}
+
+// Discover asks resolver (port 53 when omitted) for the AAAA records of
+// Name over plain DNS and returns the NAT64 prefixes they reveal
+func Discover(ctx context.Context, resolver string) ([]netip.Prefix, error) {
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(Name, dns.TypeAAAA)
+	client := &dns.Client{Timeout: 3 * time.Second}
+	resp, _, err := client.ExchangeContext(ctx, query, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, dns.RcodeToString[resp.Rcode])
+	}
+
+	var prefixes []netip.Prefix
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(aaaa.AAAA)
+		if !ok {
+			continue
+		}
+		if prefix, ok := prefixOf(addr); ok && !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, ErrNotFound
+	}
+	return prefixes, nil
+}
+
+// prefixOf returns the prefix of an address synthesized for one of the
+// addresses of Name, trying the most common length first
+func prefixOf(addr netip.Addr) (netip.Prefix, bool) {
+	for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if v4, ok := Extract(prefix, addr); ok && slices.Contains(wellKnown, v4) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Synthesize returns the address v4 is reached under through prefix
+func Synthesize(prefix netip.Prefix, v4 netip.Addr) (netip.Addr, bool) {
+	pos, ok := layout[prefix.Bits()]
+	if !ok || !prefix.Addr().Is6() || !v4.Unmap().Is4() {
+		return netip.Addr{}, false
+	}
+	out := prefix.Masked().Addr().As16()
+	in := v4.Unmap().As4()
+	for i, p := range pos {
+		out[p] = in[i]
+	}
+	return netip.AddrFrom16(out), true
+}
+
+// Extract returns the IPv4 address embedded in addr, if addr is inside
+// prefix
+func Extract(prefix netip.Prefix, addr netip.Addr) (netip.Addr, bool) {
+	pos, ok := layout[prefix.Bits()]
+	if !ok || !addr.Is6() || addr.Is4In6() || !prefix.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	in := addr.As16()
+	var out [4]byte
+	for i, p := range pos {
+		out[i] = in[p]
+	}
+	return netip.AddrFrom4(out), true
+}
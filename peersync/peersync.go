@@ -0,0 +1,306 @@
+// Package peersync keeps several daemon instances consistent, e.g. one on
+// a laptop and one on the home router. Instances exchange runtime
+// overrides and cache hints (answers of routed domains) with their peers
+// over HTTP. Every batch is sealed with AES-GCM under a shared secret, so
+// only instances knowing the secret can read or inject messages.
+package peersync
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind tells what a message carries
+type Kind string
+
+const (
+	// KindOverride sets the override in Suffix, Egress and Expires
+	KindOverride Kind = "override"
+	// KindClearOverride removes the override for Suffix
+	KindClearOverride Kind = "clear-override"
+	// KindCache hints that Domain resolved to Value
+	KindCache Kind = "cache"
+)
+
+// Message is one change shared with the peers
+type Message struct {
+	Kind    Kind      `json:"kind"`
+	Suffix  string    `json:"suffix,omitempty"`
+	Egress  string    `json:"egress,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Domain  string    `json:"domain,omitempty"`
+	Value   string    `json:"value,omitempty"`
+}
+
+// batch is what a POST carries once opened
+type batch struct {
+	From     string    `json:"from"`
+	Time     time.Time `json:"time"`
+	Messages []Message `json:"messages"`
+}
+
+const (
+	// Path is where peers receive batches
+	Path = "/v1/sync"
+	// DefaultFlushInterval is how often queued messages are sent
+	DefaultFlushInterval = time.Second
+	// MaxSkew is how far a batch's time may be from the local clock; older
+	// batches are rejected as replays
+	MaxSkew = 2 * time.Minute
+	// maxPending drops the oldest queued messages beyond this, while the
+	// peers are unreachable
+	maxPending = 1024
+	// maxBody bounds a received batch
+	maxBody = 1 << 20
+	// maxHints bounds the memory of cache hints already sent
+	maxHints = 4096
+)
+
+// ErrNoSecret is returned by Run without a Secret
+var ErrNoSecret = errors.New("sync needs a shared secret")
+
+// Node shares messages with its peers. Methods are safe on a nil *Node,
+// which shares nothing.
+type Node struct {
+	// ID names this instance to its peers (the hostname when empty)
+	ID string
+	// Secret is the key shared by all instances
+	Secret string
+	// Listen is the address peers send to; empty only sends
+	Listen string
+	// Peers are the addresses (host:port) or URLs of the other instances
+	Peers []string
+	// FlushInterval is how often queued messages are sent (default
+	// DefaultFlushInterval)
+	FlushInterval time.Duration
+	// Handler receives the messages of peers
+	Handler func(from string, m Message)
+	// Client sends batches (default: 10s timeout)
+	Client *http.Client
+	// Logf receives the node's log messages; nil discards them
+	Logf func(format string, args ...any)
+
+	mu      sync.Mutex
+	pending []Message
+	// hints are the last values sent per domain, so repeated answers
+	// (cache hits) aren't sent again
+	hints map[string]string
+	// seen holds the nonces of batches received within MaxSkew
+	seen map[string]time.Time
+}
+
+// Publish queues m for the peers
+func (n *Node) Publish(m Message) {
+	if n == nil || len(n.Peers) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m.Kind == KindCache {
+		if n.hints[m.Domain] == m.Value {
+			return
+		}
+		if n.hints == nil || len(n.hints) >= maxHints {
+			n.hints = make(map[string]string)
+		}
+		n.hints[m.Domain] = m.Value
+	}
+	n.pending = append(n.pending, m)
+	if len(n.pending) > maxPending {
+		n.pending = n.pending[len(n.pending)-maxPending:]
+	}
+}
+
+// Run serves Listen and sends the queued messages every FlushInterval
+// until ctx is done
+func (n *Node) Run(ctx context.Context) error {
+	aead, err := n.aead()
+	if err != nil {
+		return err
+	}
+	if n.Listen != "" {
+		lis, err := net.Listen("tcp", n.Listen)
+		if err != nil {
+			return fmt.Errorf("sync listen: %v", err)
+		}
+		srv := &http.Server{Handler: n.handler(aead), ReadHeaderTimeout: 10 * time.Second}
+		go srv.Serve(lis)
+		defer srv.Close()
+		n.logf("🔗 Sync listening on %s", lis.Addr())
+	}
+
+	interval := n.FlushInterval
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			n.flush(ctx, aead)
+		}
+	}
+}
+
+// aead derives the cipher from Secret
+func (n *Node) aead() (cipher.AEAD, error) {
+	if n.Secret == "" {
+		return nil, ErrNoSecret
+	}
+	key := sha256.Sum256([]byte(n.Secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (n *Node) logf(format string, args ...any) {
+	if n.Logf != nil {
+		n.Logf(format, args...)
+	}
+}
+
+func (n *Node) id() string {
+	if n.ID != "" {
+		return n.ID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// flush sends the queued messages to every peer. Messages a peer missed
+// are not resent; peers converge again with the next changes.
+func (n *Node) flush(ctx context.Context, aead cipher.AEAD) {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	plain, err := json.Marshal(batch{From: n.id(), Time: time.Now(), Messages: pending})
+	if err != nil {
+		return
+	}
+	body := seal(aead, plain)
+	for _, peer := range n.Peers {
+		if err := n.send(ctx, peer, body); err != nil && ctx.Err() == nil {
+			n.logf("⚠️ Sync to %s failed: %v", peer, err)
+		}
+	}
+}
+
+func (n *Node) send(ctx context.Context, peer string, body []byte) error {
+	url := peer
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+Path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handler receives batches from the peers
+func (n *Node) handler(aead cipher.AEAD) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+Path, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := n.open(aead, body, time.Now())
+		if err != nil {
+			n.logf("⚠️ Rejected sync batch from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		if b.From == n.id() || n.Handler == nil {
+			return
+		}
+		for _, m := range b.Messages {
+			n.Handler(b.From, m)
+		}
+	})
+	return mux
+}
+
+// seal encrypts plain as nonce || ciphertext
+func seal(aead cipher.AEAD, plain []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, nil)
+}
+
+// open decrypts and checks a received batch, rejecting replays
+func (n *Node) open(aead cipher.AEAD, body []byte, now time.Time) (batch, error) {
+	var b batch
+	if len(body) < aead.NonceSize() {
+		return b, errors.New("short message")
+	}
+	nonce := body[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, body[aead.NonceSize():], nil)
+	if err != nil {
+		return b, errors.New("bad secret or corrupt message")
+	}
+	if err := json.Unmarshal(plain, &b); err != nil {
+		return b, err
+	}
+	if d := now.Sub(b.Time); d > MaxSkew || d < -MaxSkew {
+		return b, fmt.Errorf("clock skew of %s", d.Round(time.Second))
+	}
+
+	// 在允许的时间窗口内记住 nonce，拒绝重放
+	key := hex.EncodeToString(nonce)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	for k, at := range n.seen {
+		if now.Sub(at) > 2*MaxSkew {
+			delete(n.seen, k)
+		}
+	}
+	if _, ok := n.seen[key]; ok {
+		return b, errors.New("replayed message")
+	}
+	n.seen[key] = now
+	return b, nil
+}
@@ -0,0 +1,104 @@
+package privhelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Client talks to a running helper over its unix socket
+type Client struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// NewClient returns a client for the helper listening on socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{SocketPath: socketPath, Timeout: 10 * time.Second}
+}
+
+// Call performs a privileged operation that doesn't return a socket
+func (c *Client) Call(op string, args ...string) error {
+	file, err := c.do(Request{Op: op, Args: args})
+	if file != nil {
+		file.Close()
+	}
+	return err
+}
+
+// ListenPacket asks the helper to bind a UDP socket (e.g. :53) and hands
+// it over to the calling process
+func (c *Client) ListenPacket(addr string) (net.PacketConn, error) {
+	file, err := c.do(Request{Op: OpListenUDP, Args: []string{addr}})
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, errors.New("helper did not return a socket")
+	}
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// Listen asks the helper to bind a TCP listener and hands it over
+func (c *Client) Listen(addr string) (net.Listener, error) {
+	file, err := c.do(Request{Op: OpListenTCP, Args: []string{addr}})
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, errors.New("helper did not return a socket")
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+func (c *Client) do(req Request) (*os.File, error) {
+	conn, err := net.DialTimeout("unix", c.SocketPath, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach privileged helper: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var file *os.File
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err == nil && len(msgs) > 0 {
+			fds, err := syscall.ParseUnixRights(&msgs[0])
+			if err == nil && len(fds) > 0 {
+				file = os.NewFile(uintptr(fds[0]), req.Op)
+			}
+		}
+	}
+
+	var resp Response
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	if resp.Error != "" {
+		if file != nil {
+			file.Close()
+		}
+		return nil, errors.New(resp.Error)
+	}
+	return file, nil
+}
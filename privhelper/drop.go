@@ -0,0 +1,38 @@
+package privhelper
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges switches a process started through sudo back to the
+// invoking user (SUDO_UID and SUDO_GID) once it holds the sockets it
+// needs, leaving everything else that needs root to the helper. It
+// reports false when there is nothing to drop: the process isn't root or
+// wasn't started through sudo by another user.
+func DropPrivileges() (bool, error) {
+	if os.Geteuid() != 0 {
+		return false, nil
+	}
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil || uid == 0 {
+		return false, nil
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return false, fmt.Errorf("invalid SUDO_GID: %q", os.Getenv("SUDO_GID"))
+	}
+	// 先放弃附加组和组，setuid 之后就无权再改
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return false, fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return false, fmt.Errorf("setgid %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return false, fmt.Errorf("setuid %d: %v", uid, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,232 @@
+package privhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"regexp"
+	"syscall"
+
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/qos"
+)
+
+// Operations understood by the helper: routes, the listening sockets and
+// the firewall rules (iptables marks, fake-IP NAT, killing connections).
+// Everything that needs root goes through one of these so the main
+// process can run unprivileged.
+const (
+	OpAddRoute        = "route-add"         // ip, iface
+	OpAddIPv6Route    = "route-add6"        // ip, iface
+	OpDeleteRoute     = "route-delete"      // destination (ip or cidr)
+	OpSetDefaultRoute = "route-set-default" // gateway
+	OpListenUDP       = "listen-udp"        // addr, returns a socket fd
+	OpListenTCP       = "listen-tcp"        // addr, returns a socket fd
+	OpMarkHost        = "mark-host"         // ip, dscp, fwmark
+	OpKillConns       = "kill-conns"        // ip
+	OpFakeIPSetup     = "fakeip-setup"      // cidr, iface
+	OpFakeIPTeardown  = "fakeip-teardown"   // cidr
+	OpFakeIPMap       = "fakeip-map"        // fake ip, real ip
+	OpFakeIPUnmap     = "fakeip-unmap"      // fake ip, real ip
+)
+
+// Request is sent by the unprivileged process
+type Request struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args"`
+}
+
+// Response is returned by the helper; listen operations also pass the
+// bound socket as an SCM_RIGHTS control message
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+var ifaceNameRe = regexp.MustCompile(`^[a-zA-Z0-9]{1,15}$`)
+
+// Serve runs the root helper on a unix socket. The socket is owned by uid
+// with mode 0600 so only the unprivileged main process can reach it.
+func Serve(socketPath string, uid int) error {
+	_ = os.Remove(socketPath)
+	// 在限制性 umask 下创建，套接字从出现起就是 0600，不存在 chmod 之前的窗口
+	mask := syscall.Umask(0177)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	syscall.Umask(mask)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	if uid >= 0 {
+		if err := os.Chown(socketPath, uid, -1); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("🔐 Privileged helper listening on %s", socketPath)
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Printf("⚠️ Helper: invalid request: %v", err)
+		return
+	}
+
+	file, err := dispatch(req)
+	resp := Response{}
+	if err != nil {
+		resp.Error = err.Error()
+		log.Printf("❌ Helper: %s %v failed: %v", req.Op, req.Args, err)
+	} else {
+		log.Printf("✅ Helper: %s %v", req.Op, req.Args)
+	}
+
+	payload, _ := json.Marshal(resp)
+	var oob []byte
+	if file != nil {
+		defer file.Close()
+		oob = syscall.UnixRights(int(file.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix(payload, oob, nil); err != nil {
+		log.Printf("⚠️ Helper: failed to write response: %v", err)
+	}
+}
+
+func dispatch(req Request) (*os.File, error) {
+	switch req.Op {
+	case OpAddRoute, OpAddIPv6Route:
+		if len(req.Args) != 2 {
+			return nil, fmt.Errorf("usage: %s <ip> <iface>", req.Op)
+		}
+		ip, iface := req.Args[0], req.Args[1]
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip: %q", ip)
+		}
+		if !ifaceNameRe.MatchString(iface) {
+			return nil, fmt.Errorf("invalid interface: %q", iface)
+		}
+		if req.Op == OpAddIPv6Route {
+			return nil, run("route", "-n", "add", "-inet6", ip, "-interface", iface)
+		}
+		return nil, run("route", "-n", "add", ip, "-interface", iface)
+
+	case OpDeleteRoute:
+		if len(req.Args) != 1 {
+			return nil, fmt.Errorf("usage: %s <destination>", req.Op)
+		}
+		dest := req.Args[0]
+		if _, _, err := net.ParseCIDR(dest); err != nil && net.ParseIP(dest) == nil {
+			return nil, fmt.Errorf("invalid destination: %q", dest)
+		}
+		if ip := net.ParseIP(dest); ip != nil && ip.To4() == nil {
+			return nil, run("route", "-n", "delete", "-inet6", dest)
+		}
+		return nil, run("route", "-n", "delete", dest)
+
+	case OpSetDefaultRoute:
+		if len(req.Args) != 1 || net.ParseIP(req.Args[0]) == nil {
+			return nil, fmt.Errorf("usage: %s <gateway>", req.Op)
+		}
+		for i := 0; i < 3; i++ {
+			_ = run("route", "delete", "default")
+		}
+		return nil, run("route", "add", "default", req.Args[0])
+
+	case OpMarkHost:
+		if len(req.Args) != 3 {
+			return nil, fmt.Errorf("usage: %s <ip> <dscp> <fwmark>", req.Op)
+		}
+		dscp, err := qos.ParseDSCP(req.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		fwmark, err := qos.ParseFWMark(req.Args[2])
+		if err != nil {
+			return nil, err
+		}
+		return nil, qos.MarkHost(run, req.Args[0], qos.Mark{DSCP: dscp, FWMark: fwmark})
+
+	case OpKillConns:
+		if len(req.Args) != 1 || net.ParseIP(req.Args[0]) == nil {
+			return nil, fmt.Errorf("usage: %s <ip>", req.Op)
+		}
+		return nil, run("ss", "-K", "dst", req.Args[0])
+
+	case OpFakeIPSetup, OpFakeIPTeardown:
+		if (req.Op == OpFakeIPSetup && len(req.Args) != 2) || (req.Op == OpFakeIPTeardown && len(req.Args) != 1) {
+			return nil, fmt.Errorf("usage: %s <cidr> [iface]", req.Op)
+		}
+		prefix, err := netip.ParsePrefix(req.Args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %q", req.Args[0])
+		}
+		if req.Op == OpFakeIPTeardown {
+			return nil, fakeip.Teardown(run, prefix)
+		}
+		if !ifaceNameRe.MatchString(req.Args[1]) {
+			return nil, fmt.Errorf("invalid interface: %q", req.Args[1])
+		}
+		return nil, fakeip.Setup(run, prefix, req.Args[1])
+
+	case OpFakeIPMap, OpFakeIPUnmap:
+		if len(req.Args) != 2 {
+			return nil, fmt.Errorf("usage: %s <fake ip> <real ip>", req.Op)
+		}
+		fake, err1 := netip.ParseAddr(req.Args[0])
+		real, err2 := netip.ParseAddr(req.Args[1])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid addresses: %q %q", req.Args[0], req.Args[1])
+		}
+		if req.Op == OpFakeIPUnmap {
+			return nil, fakeip.Unmap(run, fake, real)
+		}
+		return nil, fakeip.Map(run, fake, real)
+
+	case OpListenUDP:
+		if len(req.Args) != 1 {
+			return nil, fmt.Errorf("usage: %s <addr>", req.Op)
+		}
+		pc, err := net.ListenPacket("udp", req.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		defer pc.Close()
+		return pc.(*net.UDPConn).File()
+
+	case OpListenTCP:
+		if len(req.Args) != 1 {
+			return nil, fmt.Errorf("usage: %s <addr>", req.Op)
+		}
+		ln, err := net.Listen("tcp", req.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		defer ln.Close()
+		return ln.(*net.TCPListener).File()
+
+	default:
+		return nil, fmt.Errorf("unknown operation: %q", req.Op)
+	}
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
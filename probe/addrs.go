@@ -0,0 +1,120 @@
+package probe
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AddrSorter orders the addresses of a DNS answer by their handshake RTT
+// through the egress they will be reached through, fastest first.
+// Addresses not measured yet keep their place behind the measured ones and
+// are measured in the background, so probing never delays an answer.
+// Addresses that didn't answer go last.
+type AddrSorter struct {
+	// Port is the TCP port probed (default 443)
+	Port int
+	// Timeout bounds one handshake (default 2s)
+	Timeout time.Duration
+	// MaxAge is how long a measurement is used before it is repeated
+	// (default 10m)
+	MaxAge time.Duration
+	// Iface returns the interface probes are bound to for addresses
+	// reached through the VPN or directly; "" follows the routing table
+	Iface func(viaVPN bool) string
+
+	mu       sync.Mutex
+	rtts     map[addrKey]addrRTT
+	inflight int
+}
+
+type addrKey struct {
+	iface, ip string
+}
+
+type addrRTT struct {
+	rtt time.Duration // -1 表示未应答
+	at  time.Time
+}
+
+const (
+	// maxAddrProbes bounds the background handshakes in flight
+	maxAddrProbes = 16
+	// maxAddrRTTs bounds the remembered measurements
+	maxAddrRTTs = 16384
+)
+
+// SortAddrs sorts ips in place, fastest first
+func (s *AddrSorter) SortAddrs(domain string, ips []string, viaVPN bool) {
+	if len(ips) < 2 {
+		return
+	}
+	var iface string
+	if s.Iface != nil {
+		iface = s.Iface(viaVPN)
+	}
+	maxAge := cmp.Or(s.MaxAge, 10*time.Minute)
+
+	now := time.Now()
+	rank := make(map[string]time.Duration, len(ips))
+	var stale []string
+	s.mu.Lock()
+	for _, ip := range ips {
+		m, ok := s.rtts[addrKey{iface, ip}]
+		switch {
+		case !ok:
+			rank[ip] = time.Hour
+		case m.rtt < 0:
+			rank[ip] = 2 * time.Hour
+		default:
+			rank[ip] = m.rtt
+		}
+		if !ok || now.Sub(m.at) > maxAge {
+			stale = append(stale, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortStableFunc(ips, func(a, b string) int { return cmp.Compare(rank[a], rank[b]) })
+	for _, ip := range stale {
+		s.measure(iface, ip)
+	}
+}
+
+// measure starts a background handshake to ip unless too many are in
+// flight; it is retried with the next answer holding ip
+func (s *AddrSorter) measure(iface, ip string) {
+	s.mu.Lock()
+	if s.inflight >= maxAddrProbes {
+		s.mu.Unlock()
+		return
+	}
+	if s.rtts == nil || len(s.rtts) >= maxAddrRTTs {
+		s.rtts = make(map[addrKey]addrRTT)
+	}
+	key := addrKey{iface, ip}
+	// 先记下时间，避免同一地址在测量完成前被重复探测
+	prev, ok := s.rtts[key]
+	if !ok {
+		prev.rtt = time.Hour
+	}
+	s.rtts[key] = addrRTT{rtt: prev.rtt, at: time.Now()}
+	s.inflight++
+	s.mu.Unlock()
+
+	go func() {
+		port := cmp.Or(s.Port, 443)
+		rtt, err := handshake(context.Background(), iface, net.JoinHostPort(ip, strconv.Itoa(port)), cmp.Or(s.Timeout, 2*time.Second))
+		if err != nil {
+			rtt = -1
+		}
+		s.mu.Lock()
+		s.rtts[key] = addrRTT{rtt: rtt, at: time.Now()}
+		s.inflight--
+		s.mu.Unlock()
+	}()
+}
@@ -0,0 +1,28 @@
+package probe
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindControl binds sockets to iface with IP_BOUND_IF / IPV6_BOUND_IF
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return err
+		}
+		var sockErr error
+		err = c.Control(func(fd uintptr) {
+			if network == "tcp6" || network == "udp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, ifi.Index)
+				return
+			}
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,18 @@
+package probe
+
+import "syscall"
+
+// bindControl binds sockets to iface with SO_BINDTODEVICE, which needs
+// CAP_NET_RAW
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package probe
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindControl fails: binding a socket to an interface isn't supported
+// here, and an unbound probe would measure whatever path the routing
+// table picks
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding probes to " + iface + " is not supported on this platform")
+	}
+}
@@ -0,0 +1,249 @@
+// Package probe measures round-trip time and loss through each egress: a
+// TCP handshake to every probe target over a socket bound to the egress
+// interface, so the VPN tunnel and the direct path are measured
+// separately regardless of the routing table.
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Egress is a path traffic can leave through
+type Egress struct {
+	// Name identifies the egress, e.g. "VPN" or "DIRECT"
+	Name string
+	// Iface is the interface probes are bound to; "" follows the routing
+	// table
+	Iface string
+}
+
+// Stats are the measurements of one egress over the last Window samples
+type Stats struct {
+	Egress string
+	Iface  string
+	// RTT is the median handshake time of the answered samples
+	RTT time.Duration
+	// Loss is the fraction of samples that got no answer
+	Loss    float64
+	Samples int
+	// Failing counts the consecutive rounds in which no target answered
+	Failing int
+	// LastErr describes the last failed sample
+	LastErr string
+	Updated time.Time
+}
+
+// Down reports whether the egress has been unreachable for at least
+// rounds consecutive rounds
+func (s Stats) Down(rounds int) bool {
+	return s.Failing >= rounds
+}
+
+// Prober probes egresses in rounds
+type Prober struct {
+	// Targets are host:port addresses, ideally by IP so DNS isn't measured
+	// too; a refused connection counts as an answer
+	Targets []string
+	// Interval is the time between rounds (default 30s)
+	Interval time.Duration
+	// Timeout bounds one handshake (default 3s)
+	Timeout time.Duration
+	// Window is how many samples per egress the stats cover (default 30)
+	Window int
+	// Egresses returns the egresses to probe each round, e.g. skipping the
+	// VPN while its interface is gone
+	Egresses func() []Egress
+	// OnRound, when set, is called with the stats after every round
+	OnRound func([]Stats)
+
+	mu      sync.Mutex
+	samples map[string]*series
+}
+
+// series is the sample history of one egress
+type series struct {
+	iface   string
+	rtts    []time.Duration // -1 for a lost sample
+	failing int
+	lastErr string
+	updated time.Time
+}
+
+// Run probes every Interval until ctx is done
+func (p *Prober) Run(ctx context.Context) error {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Round(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Round probes every egress once, all targets in parallel
+func (p *Prober) Round(ctx context.Context) {
+	if p.Egresses == nil || len(p.Targets) == 0 {
+		return
+	}
+	egresses := p.Egresses()
+	var wg sync.WaitGroup
+	for _, eg := range egresses {
+		for _, target := range p.Targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rtt, err := p.dial(ctx, eg.Iface, target)
+				p.record(eg, rtt, err)
+			}()
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.mu.Lock()
+	for _, eg := range egresses {
+		s := p.samples[eg.Name]
+		if s == nil {
+			continue
+		}
+		recent := s.rtts[max(0, len(s.rtts)-len(p.Targets)):]
+		if slices.ContainsFunc(recent, func(d time.Duration) bool { return d >= 0 }) {
+			s.failing = 0
+		} else {
+			s.failing++
+		}
+	}
+	p.mu.Unlock()
+	if p.OnRound != nil {
+		p.OnRound(p.Stats())
+	}
+}
+
+// dial times a TCP handshake to target through iface
+func (p *Prober) dial(ctx context.Context, iface, target string) (time.Duration, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	return handshake(ctx, iface, target, timeout)
+}
+
+// Dialer returns a dialer whose sockets leave through iface regardless of
+// the routing table; "" follows it
+func Dialer(iface string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if iface != "" {
+		d.Control = bindControl(iface)
+	}
+	return d
+}
+
+// handshake times a TCP handshake to target through iface
+func handshake(ctx context.Context, iface, target string, timeout time.Duration) (time.Duration, error) {
+	d := Dialer(iface, timeout)
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// RST 也是一次完整往返，路径可达
+		return time.Since(start), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// record adds a sample for eg
+func (p *Prober) record(eg Egress, rtt time.Duration, err error) {
+	window := p.Window
+	if window <= 0 {
+		window = 30
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.samples == nil {
+		p.samples = make(map[string]*series)
+	}
+	s := p.samples[eg.Name]
+	if s == nil || s.iface != eg.Iface {
+		// 接口变化后旧样本不再代表当前路径
+		s = &series{iface: eg.Iface}
+		p.samples[eg.Name] = s
+	}
+	if err != nil {
+		rtt = -1
+		s.lastErr = err.Error()
+	}
+	s.rtts = append(s.rtts, rtt)
+	if len(s.rtts) > window {
+		s.rtts = s.rtts[len(s.rtts)-window:]
+	}
+	s.updated = time.Now()
+}
+
+// Stats returns the current measurements, sorted by egress name
+func (p *Prober) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]Stats, 0, len(p.samples))
+	for name, s := range p.samples {
+		var answered []time.Duration
+		for _, rtt := range s.rtts {
+			if rtt >= 0 {
+				answered = append(answered, rtt)
+			}
+		}
+		st := Stats{
+			Egress: name, Iface: s.iface, Samples: len(s.rtts), Failing: s.failing,
+			LastErr: s.lastErr, Updated: s.updated,
+		}
+		if len(s.rtts) > 0 {
+			st.Loss = float64(len(s.rtts)-len(answered)) / float64(len(s.rtts))
+		}
+		if len(answered) > 0 {
+			slices.Sort(answered)
+			st.RTT = answered[len(answered)/2]
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Egress < stats[j].Egress })
+	return stats
+}
+
+// Best picks among names the egress a url-test group would: the lowest
+// RTT among those not losing every sample, ties broken by loss. It
+// reports false when none has answered.
+func (p *Prober) Best(names ...string) (string, bool) {
+	var best Stats
+	found := false
+	for _, st := range p.Stats() {
+		if !slices.Contains(names, st.Egress) || st.Loss >= 1 || st.Samples == 0 {
+			continue
+		}
+		if !found || st.RTT < best.RTT || (st.RTT == best.RTT && st.Loss < best.Loss) {
+			best, found = st, true
+		}
+	}
+	return best.Egress, found
+}
@@ -0,0 +1,23 @@
+//go:build unix && !linux
+
+package qos
+
+import "syscall"
+
+// Control returns a net.Dialer Control function applying m to new
+// sockets. fwmarks only exist on Linux and are ignored here.
+func (m Mark) Control() func(network, address string, c syscall.RawConn) error {
+	if m.DSCP == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setTOS(int(fd), network, address, m.DSCP<<2)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
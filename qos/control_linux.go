@@ -0,0 +1,25 @@
+package qos
+
+import "syscall"
+
+// Control returns a net.Dialer Control function applying m to new sockets
+func (m Mark) Control() func(network, address string, c syscall.RawConn) error {
+	if m.IsZero() {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if m.DSCP != 0 {
+				sockErr = setTOS(int(fd), network, address, m.DSCP<<2)
+			}
+			if sockErr == nil && m.FWMark != 0 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(m.FWMark))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package qos
+
+import "syscall"
+
+// Control returns nil: marking sockets isn't supported on this platform
+func (m Mark) Control() func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package qos
+
+import (
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// setTOS sets the IPv4 TOS or, for IPv6 destinations, the traffic class
+// of a socket dialing address
+func setTOS(fd int, network, address string, tos int) error {
+	ipv6 := strings.HasSuffix(network, "6")
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		ipv6 = ap.Addr().Is6() && !ap.Addr().Is4In6()
+	}
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,135 @@
+// Package qos marks traffic for downstream QoS, e.g. a router that
+// shapes by DSCP or policy-routes by Linux fwmark: the daemon's own
+// upstream sockets, and traffic to the addresses of domains in a class.
+package qos
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+// Mark is a DSCP code point and a Linux fwmark; zero values are unset
+type Mark struct {
+	DSCP   int
+	FWMark uint32
+}
+
+// IsZero reports whether m marks nothing
+func (m Mark) IsZero() bool {
+	return m.DSCP == 0 && m.FWMark == 0
+}
+
+// dscpNames are the standard per-hop behaviours (RFC 2474, 2597, 3246,
+// 8622)
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "le": 1,
+}
+
+// ParseDSCP parses a code point 0-63 or a name like "EF", "AF41" or "CS1"
+func ParseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	if v, ok := dscpNames[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q (want 0-63 or a name like EF, AF41, CS1)", s)
+	}
+	return v, nil
+}
+
+// ParseFWMark parses a decimal or 0x-prefixed hex fwmark
+func ParseFWMark(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fwmark %q", s)
+	}
+	return uint32(v), nil
+}
+
+// Class marks traffic to the addresses of its domains
+type Class struct {
+	Name string
+	// Domains are suffixes, matched like rule suffixes
+	Domains []string
+	Mark
+}
+
+// Classify returns the mark of the first class listing a suffix of domain
+func Classify(classes []Class, domain string) (Mark, bool) {
+	domain = strings.ToLower(domain)
+	for _, c := range classes {
+		for _, suffix := range c.Domains {
+			if dnsmasq.MatchSuffix(domain, strings.ToLower(suffix)) {
+				return c.Mark, true
+			}
+		}
+	}
+	return Mark{}, false
+}
+
+// IptablesRules returns the mangle table rules (without the -A/-C/-D
+// verb) marking traffic to ip: DSCP in POSTROUTING, so forwarded LAN
+// traffic is marked too, and the fwmark in OUTPUT and PREROUTING, before
+// the routing decision policy routing acts on. The first element of each
+// rule is the command, iptables or ip6tables.
+func IptablesRules(ip string, m Mark, ipv6 bool) [][]string {
+	cmd := "iptables"
+	if ipv6 {
+		cmd = "ip6tables"
+	}
+	var rules [][]string
+	if m.DSCP != 0 {
+		rules = append(rules, []string{cmd, "-t", "mangle", "POSTROUTING", "-d", ip, "-j", "DSCP", "--set-dscp", strconv.Itoa(m.DSCP)})
+	}
+	if m.FWMark != 0 {
+		mark := fmt.Sprintf("0x%x", m.FWMark)
+		for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+			rules = append(rules, []string{cmd, "-t", "mangle", chain, "-d", ip, "-j", "MARK", "--set-mark", mark})
+		}
+	}
+	return rules
+}
+
+// MarkHost installs the IptablesRules for ip with run (e.g. exec'ing
+// through sudo), skipping rules already present so repeated calls for the
+// same address don't stack duplicates
+func MarkHost(run func(name string, args ...string) error, ip string, m Mark) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid ip: %q", ip)
+	}
+	for _, rule := range IptablesRules(ip, m, addr.To4() == nil) {
+		if run(rule[0], withVerb(rule, "-C")...) == nil {
+			continue
+		}
+		if err := run(rule[0], withVerb(rule, "-A")...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withVerb returns the arguments of rule with verb inserted before the
+// chain
+func withVerb(rule []string, verb string) []string {
+	args := append([]string{}, rule[1:3]...)
+	args = append(args, verb)
+	return append(args, rule[3:]...)
+}
@@ -0,0 +1,28 @@
+package qos
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	classes := []Class{
+		{Name: "video", Domains: []string{"Example.com", "*.cdn.net"}, Mark: Mark{DSCP: 34}},
+		{Name: "bulk", Domains: []string{"cdn.net"}, Mark: Mark{DSCP: 8}},
+	}
+	tests := []struct {
+		domain string
+		want   int
+		ok     bool
+	}{
+		{"example.com", 34, true},
+		{"www.EXAMPLE.com.", 34, true},
+		{"notexample.com", 0, false},
+		{"edge.cdn.net", 34, true},
+		{"cdn.net", 8, true},
+		{"mycdn.net", 0, false},
+	}
+	for _, tt := range tests {
+		m, ok := Classify(classes, tt.domain)
+		if ok != tt.ok || m.DSCP != tt.want {
+			t.Errorf("Classify(%s) = %+v, %v, want DSCP %d, %v", tt.domain, m, ok, tt.want, tt.ok)
+		}
+	}
+}
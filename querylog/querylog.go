@@ -0,0 +1,209 @@
+// Package querylog keeps the latest resolutions in memory, like Pi-hole's
+// query log but with the split tunneling decision of each: the matched
+// rule, its policy, and the upstream that answered. Entries can also be
+// appended to a file, one JSON object per line, rotated by size.
+package querylog
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one resolution
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Client names the querying client (see package clients)
+	Client  string   `json:"client,omitempty"`
+	Domain  string   `json:"domain"`
+	QType   string   `json:"qtype"`
+	Answers []string `json:"answers,omitempty"`
+	// Rule is the suffix of the matched rule; empty when none did
+	Rule string `json:"rule,omitempty"`
+	// Policy is PROXY, DIRECT or REJECT; DIRECT when no rule matched
+	Policy string `json:"policy"`
+	Action string `json:"action,omitempty"`
+	// Route reports whether the answer was routed
+	Route bool `json:"route"`
+	// Upstream names the upstream asked; empty unless Source is upstream
+	Upstream string        `json:"upstream,omitempty"`
+	Source   string        `json:"source"`
+	Latency  time.Duration `json:"latency"`
+	// Err is the resolution error; empty on success
+	Err string `json:"err,omitempty"`
+}
+
+// Options configure a Log
+type Options struct {
+	// Size is how many entries are kept in memory (DefaultSize when 0)
+	Size int
+	// File, when set, is appended every entry
+	File string
+	// MaxSize rotates File once it reaches this many bytes
+	// (DefaultMaxSize when 0)
+	MaxSize int64
+	// Backups is how many rotated files are kept, File.1 the newest
+	Backups int
+}
+
+const (
+	// DefaultSize is the number of entries kept in memory by default
+	DefaultSize = 1000
+	// DefaultMaxSize is the size File is rotated at by default
+	DefaultMaxSize = 10 << 20
+	// DefaultLimit is the number of entries Query returns by default
+	DefaultLimit = 50
+)
+
+// Log is a ring buffer of the latest entries. Methods are safe on a nil
+// *Log, which records nothing.
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	// next is where the next entry goes; entries is full once it wrapped
+	next int
+	full bool
+	file *rotator
+}
+
+// Open returns a log per opts, opening File when set
+func Open(opts Options) (*Log, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+	l := &Log{entries: make([]Entry, size)}
+	if opts.File != "" {
+		maxSize := opts.MaxSize
+		if maxSize <= 0 {
+			maxSize = DefaultMaxSize
+		}
+		f, err := openRotator(opts.File, maxSize, opts.Backups)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+	}
+	return l, nil
+}
+
+// Record adds e, dropping the oldest entry when the buffer is full
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	if l.file != nil {
+		if err := writeEntry(l.file, e); err != nil {
+			log.Printf("⚠️ Failed to write query log: %v", err)
+		}
+	}
+}
+
+// Filter selects entries; zero fields match all
+type Filter struct {
+	// Domain matches the domain and its subdomains
+	Domain string
+	Client string
+	Since  time.Time
+	// Routed keeps only routed entries, Failed only failed ones
+	Routed bool
+	Failed bool
+	// Limit caps the number of entries returned (DefaultLimit when 0,
+	// unlimited when negative)
+	Limit int
+}
+
+func (f Filter) match(e *Entry) bool {
+	if f.Domain != "" {
+		domain := strings.ToLower(strings.TrimSuffix(f.Domain, "."))
+		name := strings.ToLower(strings.TrimSuffix(e.Domain, "."))
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return false
+		}
+	}
+	switch {
+	case f.Client != "" && e.Client != f.Client,
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		f.Routed && !e.Route,
+		f.Failed && e.Err == "":
+		return false
+	}
+	return true
+}
+
+// Query returns the newest entries matching f, newest first
+func (l *Log) Query(f Filter) []Entry {
+	if l == nil {
+		return nil
+	}
+	limit := f.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []Entry
+	for i := range l.len() {
+		e := &l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if !f.match(e) {
+			continue
+		}
+		out = append(out, *e)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out
+}
+
+// Export writes the entries matching f to w as JSON lines, oldest first
+func (l *Log) Export(w io.Writer, f Filter) (int, error) {
+	entries := l.Query(f)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := writeEntry(w, entries[i]); err != nil {
+			return len(entries) - 1 - i, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (l *Log) len() int {
+	if l.full {
+		return len(l.entries)
+	}
+	return l.next
+}
+
+// Close closes File; the entries in memory stay readable
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func writeEntry(w io.Writer, e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,80 @@
+package querylog
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotator appends to a file, renaming it to path.1 (and path.1 to path.2,
+// up to backups) once it reaches maxSize
+type rotator struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotator(path string, maxSize int64, backups int) (*rotator, error) {
+	r := &rotator{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotator) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, dropping the oldest, and starts a new file
+func (r *rotator) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.backups <= 0 {
+		// 不保留备份时直接清空
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(backup(r.path, i), backup(r.path, i+1))
+	}
+	// 改名失败时继续写原文件，下次写入再试
+	err := os.Rename(r.path, backup(r.path, 1))
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (r *rotator) Close() error {
+	return r.f.Close()
+}
+
+func backup(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
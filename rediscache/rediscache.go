@@ -0,0 +1,153 @@
+// Package rediscache implements dnsmasq.CacheBackend on top of Redis so
+// several daemon instances (e.g. on a router cluster) share one DNS cache.
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix namespaces the cache keys inside the Redis database
+const DefaultPrefix = "openvpnadvanced:dns:"
+
+// Options configures a Redis cache
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+	// Prefix is prepended to every key (default DefaultPrefix)
+	Prefix string
+	// TTL expires entries inside Redis (default 10m)
+	TTL time.Duration
+	// Timeout bounds every Redis round trip (default 500ms), so a slow
+	// Redis degrades to cache misses rather than stalling DNS answers
+	Timeout time.Duration
+}
+
+// Cache is a Redis-backed dnsmasq.CacheBackend
+type Cache struct {
+	client  *redis.Client
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+var _ dnsmasq.CacheBackend = (*Cache)(nil)
+
+// New connects to Redis and verifies the connection with a PING
+func New(opts Options) (*Cache, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &Cache{
+		client:  client,
+		prefix:  opts.Prefix,
+		ttl:     opts.TTL,
+		timeout: opts.Timeout,
+	}, nil
+}
+
+// Get returns the cached value for domain
+func (c *Cache) Get(domain string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, c.prefix+domain).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("⚠️ Redis cache get %s failed: %v", domain, err)
+		}
+		return "", false
+	}
+
+	var record dnsmasq.DNSRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return "", false
+	}
+	return record.IP, true
+}
+
+// Set stores value for domain with the configured TTL
+func (c *Cache) Set(domain, value string) {
+	c.SetTTL(domain, value, 0)
+}
+
+// SetTTL stores value for domain, expiring after ttl instead of the
+// configured TTL when positive
+func (c *Cache) SetTTL(domain, value string, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	expiry := c.ttl
+	if ttl > 0 {
+		expiry = ttl
+	}
+	data, _ := json.Marshal(dnsmasq.DNSRecord{IP: value, Timestamp: time.Now(), TTL: max(ttl, 0)})
+	if err := c.client.Set(ctx, c.prefix+domain, data, expiry).Err(); err != nil {
+		log.Printf("⚠️ Redis cache set %s failed: %v", domain, err)
+	}
+}
+
+// Delete removes the entry for domain
+func (c *Cache) Delete(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.client.Del(ctx, c.prefix+domain).Err()
+}
+
+// Raw returns every entry under the key prefix
+func (c *Cache) Raw() map[string]dnsmasq.DNSRecord {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result := make(map[string]dnsmasq.DNSRecord)
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		data, err := c.client.Get(ctx, key).Bytes()
+		if err != nil {
+			continue
+		}
+		var record dnsmasq.DNSRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		result[strings.TrimPrefix(key, c.prefix)] = record
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("⚠️ Redis cache scan failed: %v", err)
+	}
+	return result
+}
+
+// Close closes the Redis connection pool
+func (c *Cache) Close() error {
+	return c.client.Close()
+}
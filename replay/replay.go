@@ -0,0 +1,158 @@
+// Package replay records every resolution and routing decision to a file
+// and re-runs the decisions of a recording against other rules, so a
+// change in routing can be traced to the config change that caused it.
+//
+// Recordings are JSON lines, one Record per query. Replay never queries
+// upstream: the recorded answers, client addresses and times are fed to
+// the rules as they were, which makes the result deterministic.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+)
+
+// Record is one recorded resolution
+type Record struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	// CNAMEs is the CNAME chain of the answer, in order
+	CNAMEs []string       `json:"cnames,omitempty"`
+	IP     string         `json:"ip,omitempty"`
+	Client netip.AddrPort `json:"client"`
+	// ClientName is the identified client (see package clients)
+	ClientName string `json:"client_name,omitempty"`
+	// Err is the resolution error; failed queries have no decision
+	Err    string `json:"err,omitempty"`
+	Route  bool   `json:"route"`
+	Rule   string `json:"rule,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// flushInterval bounds how long a record may sit in the write buffer
+const flushInterval = time.Second
+
+// Recorder appends Records to a file. Methods are safe on a nil
+// *Recorder, which records nothing.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	flushed time.Time
+}
+
+// Create opens path for appending records, creating it if needed
+func Create(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	return &Recorder{file: file, w: w, enc: json.NewEncoder(w), flushed: time.Now()}, nil
+}
+
+// Record appends rec. Writes are buffered and flushed at least once a
+// second while queries keep arriving, and on Close.
+func (r *Recorder) Record(rec Record) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	_ = r.enc.Encode(&rec)
+	if time.Since(r.flushed) >= flushInterval {
+		_ = r.w.Flush()
+		r.flushed = time.Now()
+	}
+}
+
+// Close flushes buffered records and closes the file
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// Decider computes a routing decision the way the DNS server does (see
+// dnsproxy.Snapshot.Decide)
+type Decider func(domain string, cnames []string, ip string, client netip.AddrPort, at time.Time) (bool, dnsmasq.Rule, error)
+
+// Diff is a recorded query whose decision changed on replay
+type Diff struct {
+	Record Record
+	Route  bool
+	Rule   string
+	Action string
+	// Err is an expression rule error raised during replay
+	Err error
+}
+
+// Report summarizes a replay
+type Report struct {
+	Total int
+	// Skipped counts recorded queries that failed to resolve
+	Skipped   int
+	Unchanged int
+	Diffs     []Diff
+}
+
+// Run replays every record read from r through decide and reports the
+// queries whose route or action differ from the recording
+func Run(r io.Reader, decide Decider) (Report, error) {
+	var report Report
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return report, nil
+			}
+			return report, fmt.Errorf("record %d: %v", line, err)
+		}
+		report.Total++
+		if rec.Err != "" {
+			report.Skipped++
+			continue
+		}
+
+		route, rule, err := decide(rec.Domain, rec.CNAMEs, rec.IP, rec.Client, rec.Time)
+		if route == rec.Route && rule.Action == rec.Action {
+			report.Unchanged++
+			continue
+		}
+		report.Diffs = append(report.Diffs, Diff{Record: rec, Route: route, Rule: rule.Suffix, Action: rule.Action, Err: err})
+	}
+}
+
+// RunFile is Run over the recording at path
+func RunFile(path string, decide Decider) (Report, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Report{}, err
+	}
+	defer file.Close()
+	return Run(file, decide)
+}
@@ -0,0 +1,146 @@
+// Package rewrite overrides answers for selected names, e.g. to point a
+// production name at staging or pin a CDN endpoint. A rule is a
+// "REWRITE," line in the rule list:
+//
+//	REWRITE,api.example.com,api.staging.example.com
+//	REWRITE,*.cdn.example.com,203.0.113.10
+//	REWRITE,*.cdn.example.com,2001:db8::10
+//
+// A name target is answered as a CNAME followed by the target's address.
+// An address target is answered directly; give one line per address
+// family. "*." matches every subdomain, but not the name itself.
+package rewrite
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Prefix introduces a rewrite rule in a rule list
+const Prefix = "REWRITE,"
+
+// Rule rewrites one name or, with Wildcard, its subdomains
+type Rule struct {
+	// Name is lower-case without the trailing dot or "*." prefix
+	Name     string
+	Wildcard bool
+	// Target is the CNAME target; empty when the rule maps to addresses
+	Target string
+	// IPv4 and IPv6 are the addresses answered for A and AAAA queries
+	IPv4, IPv6 netip.Addr
+}
+
+// Match reports whether the rule applies to domain
+func (r *Rule) Match(domain string) bool {
+	if r.Wildcard {
+		return strings.HasSuffix(domain, "."+r.Name)
+	}
+	return domain == r.Name
+}
+
+// Parse parses the part of a rule after Prefix
+func Parse(source string) (*Rule, error) {
+	name, target, ok := strings.Cut(source, ",")
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	target = strings.TrimSuffix(strings.TrimSpace(target), ".")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("want REWRITE,name,target")
+	}
+	r := &Rule{}
+	r.Name, r.Wildcard = strings.CutPrefix(name, "*.")
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t*,") {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	if addr, err := netip.ParseAddr(target); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			r.IPv4 = addr
+		} else {
+			r.IPv6 = addr
+		}
+		return r, nil
+	}
+	if strings.ContainsAny(target, " \t,") {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+	r.Target = strings.ToLower(target)
+	return r, nil
+}
+
+// Set is an ordered list of rewrite rules
+type Set struct {
+	Rules []*Rule
+}
+
+// Len returns the number of rules
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.Rules)
+}
+
+// Lookup returns the rewrite for domain: address rules for the same name
+// are merged so one line per family can be given, otherwise the first
+// matching rule wins. A nil set never rewrites.
+func (s *Set) Lookup(domain string) (Rule, bool) {
+	if s == nil {
+		return Rule{}, false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	var found Rule
+	ok := false
+	for _, r := range s.Rules {
+		if !r.Match(domain) {
+			continue
+		}
+		if !ok {
+			found, ok = *r, true
+			if found.Target != "" {
+				return found, true
+			}
+			continue
+		}
+		// 同名地址规则按地址族合并
+		if r.Target == "" && r.Name == found.Name && r.Wildcard == found.Wildcard {
+			if !found.IPv4.IsValid() {
+				found.IPv4 = r.IPv4
+			}
+			if !found.IPv6.IsValid() {
+				found.IPv6 = r.IPv6
+			}
+		}
+	}
+	return found, ok
+}
+
+// LoadFile parses every REWRITE line of a rule list, reporting the first
+// bad rule with its line number
+func LoadFile(path string) (*Set, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := &Set{}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		source, ok := strings.CutPrefix(line, Prefix)
+		if !ok {
+			continue
+		}
+		rule, err := Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		set.Rules = append(set.Rules, rule)
+	}
+	return set, scanner.Err()
+}
@@ -0,0 +1,184 @@
+// Package safesearch maps search engine and YouTube domains to the
+// safe-search and restricted-mode endpoints their operators provide for
+// network-level enforcement. A DNS server answers queries for those
+// domains with a CNAME to the endpoint, per client profile.
+package safesearch
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// YouTube is a YouTube Restricted Mode level
+type YouTube int
+
+const (
+	YouTubeOff YouTube = iota
+	YouTubeModerate
+	YouTubeStrict
+)
+
+// ParseYouTube parses "off", "moderate" or "strict"
+func ParseYouTube(s string) (YouTube, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off":
+		return YouTubeOff, nil
+	case "moderate":
+		return YouTubeModerate, nil
+	case "strict":
+		return YouTubeStrict, nil
+	}
+	return 0, fmt.Errorf("unknown YouTube restriction %q (want off, moderate or strict)", s)
+}
+
+func (y YouTube) String() string {
+	switch y {
+	case YouTubeModerate:
+		return "moderate"
+	case YouTubeStrict:
+		return "strict"
+	default:
+		return "off"
+	}
+}
+
+// searchTargets are the safe-search endpoints by domain, "www." stripped
+var searchTargets = map[string]string{
+	"bing.com":       "strict.bing.com",
+	"duckduckgo.com": "safe.duckduckgo.com",
+	"yandex.com":     "familysearch.yandex.ru",
+	"yandex.ru":      "familysearch.yandex.ru",
+	"pixabay.com":    "safesearch.pixabay.com",
+}
+
+// youtubeDomains are the hosts YouTube Restricted Mode is enforced on
+var youtubeDomains = map[string]bool{
+	"youtube.com":              true,
+	"www.youtube.com":          true,
+	"m.youtube.com":            true,
+	"youtube-nocookie.com":     true,
+	"www.youtube-nocookie.com": true,
+	"youtubei.googleapis.com":  true,
+	"youtube.googleapis.com":   true,
+}
+
+// Profile is the enforcement applied to a group of clients
+type Profile struct {
+	Name string
+	// Clients are the addresses the profile applies to
+	Clients []netip.Prefix
+	// Search enforces safe search on Google, Bing, DuckDuckGo, Yandex and
+	// Pixabay
+	Search  bool
+	YouTube YouTube
+}
+
+// Rewrite returns the endpoint queries for domain are redirected to
+func (p Profile) Rewrite(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if p.YouTube != YouTubeOff && youtubeDomains[domain] {
+		if p.YouTube == YouTubeStrict {
+			return "restrict.youtube.com", true
+		}
+		return "restrictmoderate.youtube.com", true
+	}
+	if !p.Search {
+		return "", false
+	}
+	host := strings.TrimPrefix(domain, "www.")
+	if target, ok := searchTargets[host]; ok {
+		return target, true
+	}
+	if isGoogle(host) {
+		return "forcesafesearch.google.com", true
+	}
+	return "", false
+}
+
+// isGoogle matches google.<tld> and google.co(m).<cc>
+func isGoogle(host string) bool {
+	rest, ok := strings.CutPrefix(host, "google.")
+	if !ok || rest == "" {
+		return false
+	}
+	labels := strings.Split(rest, ".")
+	switch len(labels) {
+	case 1:
+		return true
+	case 2:
+		return labels[0] == "co" || labels[0] == "com"
+	}
+	return false
+}
+
+// Policy picks the profile for a client: the first profile listing its
+// address, else Default
+type Policy struct {
+	Default  Profile
+	Profiles []Profile
+}
+
+// For returns the profile applying to client
+func (p *Policy) For(client netip.Addr) Profile {
+	client = client.Unmap()
+	for _, profile := range p.Profiles {
+		for _, prefix := range profile.Clients {
+			if prefix.Contains(client) {
+				return profile
+			}
+		}
+	}
+	return p.Default
+}
+
+// Named returns the profile called name
+func (p *Policy) Named(name string) (Profile, bool) {
+	if p == nil || name == "" {
+		return Profile{}, false
+	}
+	if name == p.Default.Name {
+		return p.Default, true
+	}
+	for _, profile := range p.Profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Rewrite returns the endpoint client's queries for domain are redirected
+// to. A nil policy never rewrites.
+func (p *Policy) Rewrite(client netip.Addr, domain string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	return p.For(client).Rewrite(domain)
+}
+
+// ParseClients parses addresses and CIDR prefixes
+func ParseClients(specs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if strings.Contains(spec, "/") {
+			prefix, err := netip.ParsePrefix(spec)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(spec)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
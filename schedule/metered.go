@@ -0,0 +1,37 @@
+package schedule
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// NetworkMetered reports whether the system marks the current connection
+// metered. Only NetworkManager on Linux is asked; elsewhere, and when it
+// can't be asked, the network counts as unmetered.
+func NetworkMetered() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "busctl", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false
+	}
+	return parseNMMetered(string(out))
+}
+
+// parseNMMetered parses the NMMetered property as busctl prints it, e.g.
+// "u 4": 1 (yes) and 3 (guessed yes) are metered
+func parseNMMetered(out string) bool {
+	fields := strings.Fields(out)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false
+	}
+	return fields[1] == "1" || fields[1] == "3"
+}
@@ -0,0 +1,94 @@
+package schedule
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// MeteredRetry is how often a refresh deferred by a metered network checks
+// the network again
+const MeteredRetry = 15 * time.Minute
+
+// Window is when refreshes may run. Methods are safe on a nil *Window,
+// which refreshes at the caller's interval and never defers.
+type Window struct {
+	// Cron, when set, is when refreshes run instead of at an interval
+	Cron *Cron
+	// Metered, when set, reports whether the network is metered;
+	// refreshes are deferred while it is
+	Metered func() bool
+
+	// offset delays every scheduled time, picked once up to the jitter
+	offset time.Duration
+}
+
+// New returns a window running at cron (every interval when nil), each run
+// delayed by the same random duration up to jitter
+func New(cron *Cron, jitter time.Duration, metered func() bool) *Window {
+	w := &Window{Cron: cron, Metered: metered}
+	if jitter > 0 {
+		w.offset = rand.N(jitter)
+	}
+	return w
+}
+
+// Scheduled reports whether refreshes follow a cron schedule
+func (w *Window) Scheduled() bool {
+	return w != nil && w.Cron != nil
+}
+
+// Next returns the first scheduled time after t, jitter included. It
+// returns the zero time when there is no schedule or it never runs.
+func (w *Window) Next(t time.Time) time.Time {
+	if !w.Scheduled() {
+		return time.Time{}
+	}
+	next := w.Cron.Next(t.Add(-w.offset))
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(w.offset)
+}
+
+// Deferred reports whether refreshes should wait for the network to be
+// unmetered
+func (w *Window) Deferred() bool {
+	return w != nil && w.Metered != nil && w.Metered()
+}
+
+// Wait blocks until the next refresh of name: the next scheduled time,
+// or every from now without a schedule, then for as long as the network
+// is metered
+func (w *Window) Wait(ctx context.Context, name string, every time.Duration) error {
+	next := time.Now().Add(every)
+	if w.Scheduled() {
+		if next = w.Next(time.Now()); next.IsZero() {
+			// 永远不会触发的计划，等待退出
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+	if err := sleepUntil(ctx, next); err != nil {
+		return err
+	}
+	for w.Deferred() {
+		log.Printf("⏸️ Network is metered, deferring the %s refresh", name)
+		if err := sleepUntil(ctx, time.Now().Add(MeteredRetry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,296 @@
+// Package stamp parses and encodes DNS stamps (sdns:// URIs), the compact
+// server descriptions used by public resolver lists
+// (https://dnscrypt.info/stamps-specifications).
+package stamp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Scheme prefixes every stamp
+const Scheme = "sdns://"
+
+// Proto identifies the protocol a stamp describes
+type Proto uint8
+
+const (
+	ProtoPlain         Proto = 0x00
+	ProtoDNSCrypt      Proto = 0x01
+	ProtoDoH           Proto = 0x02
+	ProtoDoT           Proto = 0x03
+	ProtoDoQ           Proto = 0x04
+	ProtoODoHTarget    Proto = 0x05
+	ProtoDNSCryptRelay Proto = 0x81
+	ProtoODoHRelay     Proto = 0x85
+)
+
+func (p Proto) String() string {
+	switch p {
+	case ProtoPlain:
+		return "Plain"
+	case ProtoDNSCrypt:
+		return "DNSCrypt"
+	case ProtoDoH:
+		return "DoH"
+	case ProtoDoT:
+		return "DoT"
+	case ProtoDoQ:
+		return "DoQ"
+	case ProtoODoHTarget:
+		return "ODoH target"
+	case ProtoDNSCryptRelay:
+		return "DNSCrypt relay"
+	case ProtoODoHRelay:
+		return "ODoH relay"
+	default:
+		return fmt.Sprintf("Proto(0x%02x)", uint8(p))
+	}
+}
+
+// Props are the informal properties a server announces
+type Props uint64
+
+const (
+	PropDNSSEC   Props = 1 << 0
+	PropNoLog    Props = 1 << 1
+	PropNoFilter Props = 1 << 2
+)
+
+// ErrInvalid is returned for malformed stamps
+var ErrInvalid = errors.New("invalid DNS stamp")
+
+// Stamp is a decoded server stamp. Which fields are set depends on Proto.
+type Stamp struct {
+	Proto Proto
+	Props Props
+	// Addr is the server's IP address with an optional port. It's empty
+	// when the server is reached by resolving Host.
+	Addr string
+	// PublicKey is the DNSCrypt provider's Ed25519 public key
+	PublicKey []byte
+	// ProviderName is the DNSCrypt provider name, e.g. 2.dnscrypt-cert.example.com
+	ProviderName string
+	// Hashes are SHA-256 digests of the TBS certificates of which at least
+	// one must appear in the server's TLS chain
+	Hashes [][]byte
+	// Host is the TLS host name with an optional port
+	Host string
+	// Path is the DoH/ODoH request path
+	Path string
+	// Bootstrap are resolvers for Host
+	Bootstrap []string
+}
+
+// Parse decodes an sdns:// stamp
+func Parse(s string) (Stamp, error) {
+	if !strings.HasPrefix(s, Scheme) {
+		return Stamp{}, fmt.Errorf("%w: missing %s prefix", ErrInvalid, Scheme)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(Scheme):], "="))
+	if err != nil {
+		return Stamp{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if len(raw) == 0 {
+		return Stamp{}, fmt.Errorf("%w: empty", ErrInvalid)
+	}
+
+	d := decoder{buf: raw[1:]}
+	st := Stamp{Proto: Proto(raw[0])}
+	if st.Proto != ProtoDNSCryptRelay {
+		st.Props = d.props()
+	}
+	switch st.Proto {
+	case ProtoPlain:
+		st.Addr = d.lp()
+	case ProtoDNSCrypt:
+		st.Addr = d.lp()
+		st.PublicKey = []byte(d.lp())
+		st.ProviderName = d.lp()
+	case ProtoDoH, ProtoODoHRelay:
+		st.Addr = d.lp()
+		st.Hashes = d.vlpBytes()
+		st.Host = d.lp()
+		st.Path = d.lp()
+		st.Bootstrap = d.optionalVLP()
+	case ProtoDoT, ProtoDoQ:
+		st.Addr = d.lp()
+		st.Hashes = d.vlpBytes()
+		st.Host = d.lp()
+		st.Bootstrap = d.optionalVLP()
+	case ProtoODoHTarget:
+		st.Host = d.lp()
+		st.Path = d.lp()
+	case ProtoDNSCryptRelay:
+		st.Addr = d.lp()
+	default:
+		return Stamp{}, fmt.Errorf("%w: unknown protocol 0x%02x", ErrInvalid, raw[0])
+	}
+	if d.err != nil {
+		return Stamp{}, fmt.Errorf("%w: %s: %v", ErrInvalid, st.Proto, d.err)
+	}
+	if len(d.buf) != 0 {
+		return Stamp{}, fmt.Errorf("%w: %d trailing bytes", ErrInvalid, len(d.buf))
+	}
+	if st.Proto == ProtoDNSCrypt && len(st.PublicKey) != 32 {
+		return Stamp{}, fmt.Errorf("%w: public key must be 32 bytes", ErrInvalid)
+	}
+	return st, nil
+}
+
+// String encodes the stamp as an sdns:// URI
+func (st Stamp) String() string {
+	buf := []byte{byte(st.Proto)}
+	if st.Proto != ProtoDNSCryptRelay {
+		for i := 0; i < 8; i++ {
+			buf = append(buf, byte(st.Props>>(8*i)))
+		}
+	}
+	switch st.Proto {
+	case ProtoPlain, ProtoDNSCryptRelay:
+		buf = appendLP(buf, st.Addr)
+	case ProtoDNSCrypt:
+		buf = appendLP(buf, st.Addr)
+		buf = appendLP(buf, string(st.PublicKey))
+		buf = appendLP(buf, st.ProviderName)
+	case ProtoDoH, ProtoODoHRelay:
+		buf = appendLP(buf, st.Addr)
+		buf = appendVLP(buf, st.Hashes)
+		buf = appendLP(buf, st.Host)
+		buf = appendLP(buf, st.Path)
+		if len(st.Bootstrap) > 0 {
+			buf = appendVLP(buf, stringsToBytes(st.Bootstrap))
+		}
+	case ProtoDoT, ProtoDoQ:
+		buf = appendLP(buf, st.Addr)
+		buf = appendVLP(buf, st.Hashes)
+		buf = appendLP(buf, st.Host)
+		if len(st.Bootstrap) > 0 {
+			buf = appendVLP(buf, stringsToBytes(st.Bootstrap))
+		}
+	case ProtoODoHTarget:
+		buf = appendLP(buf, st.Host)
+		buf = appendLP(buf, st.Path)
+	}
+	return Scheme + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// HostPort returns Addr, or Host when Addr is empty, with defaultPort
+// added unless a port is given
+func (st Stamp) HostPort(defaultPort int) string {
+	addr := st.Addr
+	if addr == "" {
+		addr = st.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(defaultPort))
+}
+
+// decoder reads length-prefixed fields, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) props() Props {
+	if len(d.buf) < 8 {
+		d.err = errors.New("truncated properties")
+		d.buf = nil
+		return 0
+	}
+	var p Props
+	for i := 0; i < 8; i++ {
+		p |= Props(d.buf[i]) << (8 * i)
+	}
+	d.buf = d.buf[8:]
+	return p
+}
+
+func (d *decoder) lp() string {
+	if d.err != nil {
+		return ""
+	}
+	if len(d.buf) == 0 || len(d.buf) < 1+int(d.buf[0]) {
+		d.err = errors.New("truncated field")
+		return ""
+	}
+	n := int(d.buf[0])
+	s := string(d.buf[1 : 1+n])
+	d.buf = d.buf[1+n:]
+	return s
+}
+
+// vlp reads a set of fields whose length bytes have 0x80 set on all but
+// the last one
+func (d *decoder) vlp() []string {
+	var out []string
+	for d.err == nil {
+		if len(d.buf) == 0 {
+			d.err = errors.New("truncated field set")
+			return nil
+		}
+		more := d.buf[0]&0x80 != 0
+		n := int(d.buf[0] &^ 0x80)
+		if len(d.buf) < 1+n {
+			d.err = errors.New("truncated field set")
+			return nil
+		}
+		if n > 0 {
+			out = append(out, string(d.buf[1:1+n]))
+		}
+		d.buf = d.buf[1+n:]
+		if !more {
+			break
+		}
+	}
+	return out
+}
+
+func (d *decoder) vlpBytes() [][]byte {
+	var out [][]byte
+	for _, s := range d.vlp() {
+		out = append(out, []byte(s))
+	}
+	return out
+}
+
+func (d *decoder) optionalVLP() []string {
+	if d.err != nil || len(d.buf) == 0 {
+		return nil
+	}
+	return d.vlp()
+}
+
+func appendLP(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...)
+}
+
+func appendVLP(buf []byte, items [][]byte) []byte {
+	if len(items) == 0 {
+		return append(buf, 0)
+	}
+	for i, item := range items {
+		n := byte(len(item))
+		if i < len(items)-1 {
+			n |= 0x80
+		}
+		buf = append(buf, n)
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+func stringsToBytes(items []string) [][]byte {
+	out := make([][]byte, len(items))
+	for i, s := range items {
+		out[i] = []byte(s)
+	}
+	return out
+}
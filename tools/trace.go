@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"openvpnadvanced/dnsmasq"
 	"openvpnadvanced/vpn"
 
+	"github.com/miekg/dns"
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -35,11 +37,13 @@ func main() {
 	}
 
 	// 3. Resolve domain (recursively handles CNAME)
-	shouldRoute, ip, cname := dnsmasq.ResolveWithCNAME(domain, rules, cache)
-	if ip == "" {
-		fmt.Println("❌ Failed to resolve domain.")
+	resolver := &dnsmasq.Resolver{Rules: rules, Cache: cache}
+	d, err := resolver.Decide(domain, dns.TypeA)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve domain: %v\n", err)
 		return
 	}
+	shouldRoute, ip := d.Routes(), d.IP()
 
 	// 4. Get VPN interface
 	vpnIface, err := vpn.FindVPNInterface()
@@ -71,9 +75,13 @@ func main() {
 	networkTable.SetBorder(false)
 	networkTable.Append([]string{"Domain", domain})
 	networkTable.Append([]string{"Resolved IP", ip})
-	networkTable.Append([]string{"Matched Rule", map[bool]string{true: "VPN", false: "DIRECT"}[shouldRoute]})
-	if cname != "" && cname != domain {
-		networkTable.Append([]string{"CNAME Chain", domain + " -> " + cname})
+	networkTable.Append([]string{"Answer", fmt.Sprintf("%s from %s in %v", strings.Join(d.IPs(), ", "), sourceOf(d), d.Latency.Round(time.Millisecond))})
+	if d.Matched {
+		networkTable.Append([]string{"Matched Rule", fmt.Sprintf("%s,%s", d.Rule.Type, d.Rule.Suffix)})
+	}
+	networkTable.Append([]string{"Policy", d.Policy.String()})
+	if len(d.CNAMEs) > 0 {
+		networkTable.Append([]string{"CNAME Chain", domain + " -> " + strings.Join(d.CNAMEs, " -> ")})
 	}
 	networkTable.Render()
 
@@ -94,7 +102,7 @@ func main() {
 	if shouldRoute && currentIface != vpnIface {
 		fmt.Println("\n⚠️ Warning: Domain should be routed through VPN but is using direct connection")
 		fmt.Printf("Attempting to fix routing...\n")
-		if err := vpn.AddRoute(ip, vpnIface); err != nil {
+		if err := (&vpn.Router{}).AddRoute(ip, vpnIface); err != nil {
 			fmt.Printf("❌ Failed to fix routing: %v\n", err)
 		} else {
 			fmt.Println("✅ Routing fixed successfully")
@@ -111,3 +119,11 @@ func main() {
 
 	fmt.Println("\n—————————————— End of Trace ——————————————")
 }
+
+// sourceOf describes where the answer of d came from
+func sourceOf(d *dnsmasq.Decision) string {
+	if d.Upstream != "" {
+		return d.Source.String() + " " + d.Upstream
+	}
+	return d.Source.String()
+}
@@ -0,0 +1,84 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X openvpnadvanced/version.Version=$(cat VERSION) \
+//	  -X openvpnadvanced/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X openvpnadvanced/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build info, falling back to the VCS stamp embedded by
+// the Go toolchain when ldflags were not provided
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+					if len(info.Commit) > 12 {
+						info.Commit = info.Commit[:12]
+					}
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// String returns a one-line human readable version
+func String() string {
+	info := Get()
+	return fmt.Sprintf("openvpnadvanced %s (commit %s, built %s, %s, %s)",
+		info.Version, info.Commit, info.BuildDate, info.GoVersion, info.Platform)
+}
+
+// UserAgent returns the User-Agent sent to DoH upstreams with
+// doh-user-agent = default
+func UserAgent() string {
+	return "openvpnadvanced/" + Get().Version
+}
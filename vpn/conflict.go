@@ -0,0 +1,156 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Conflict is another component managing DNS or routes on this machine
+type Conflict struct {
+	// Name identifies the component, e.g. "Tailscale"
+	Name string
+	// Iface is the tunnel interface it owns, if known
+	Iface string
+	// Detail says how it was detected
+	Detail string
+	// Routes is set when it manages routes or DNS itself, so fixing the
+	// default route or taking over DNS would fight it
+	Routes bool
+}
+
+func (c Conflict) String() string {
+	s := c.Name
+	if c.Iface != "" {
+		s += " on " + c.Iface
+	}
+	return s + " (" + c.Detail + ")"
+}
+
+var (
+	// tailscaleV4 is the CGNAT range Tailscale assigns addresses from
+	tailscaleV4 = netip.MustParsePrefix("100.64.0.0/10")
+	// tailscaleV6 is Tailscale's ULA prefix
+	tailscaleV6 = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+)
+
+// vpnApps are other VPN clients by process name
+var vpnApps = []struct{ name, process string }{
+	{"WireGuard", "WireGuard"},
+	{"WireGuard", "wireguard-go"},
+	{"Cloudflare WARP", "Cloudflare WARP"},
+	{"Cloudflare WARP", "warp-svc"},
+	{"Mullvad VPN", "mullvad-daemon"},
+	{"NordVPN", "NordVPN"},
+	{"ExpressVPN", "expressvpnd"},
+	{"Proton VPN", "ProtonVPN"},
+	{"Cisco Secure Client", "vpnagentd"},
+	{"GlobalProtect", "PanGPS"},
+	{"ZeroTier", "zerotier-one"},
+}
+
+// privateRelayHosts are the names Apple documents for turning iCloud
+// Private Relay off network-wide: it stays off while they don't resolve
+var privateRelayHosts = []string{"mask.icloud.com", "mask-h2.icloud.com"}
+
+// DetectConflicts looks for Tailscale, other VPN clients and iCloud
+// Private Relay
+func DetectConflicts(ctx context.Context) []Conflict {
+	var found []Conflict
+	if c, ok := detectTailscale(); ok {
+		found = append(found, c)
+	}
+	seen := map[string]bool{}
+	for _, app := range vpnApps {
+		if seen[app.name] || !processRunning(app.process) {
+			continue
+		}
+		seen[app.name] = true
+		found = append(found, Conflict{Name: app.name, Detail: "process " + app.process + " running", Routes: true})
+	}
+	if c, ok := detectPrivateRelay(ctx); ok {
+		found = append(found, c)
+	}
+	return found
+}
+
+// ConflictIfaces returns the interfaces owned by conflicts
+func ConflictIfaces(conflicts []Conflict) []string {
+	var ifaces []string
+	for _, c := range conflicts {
+		if c.Iface != "" && !slices.Contains(ifaces, c.Iface) {
+			ifaces = append(ifaces, c.Iface)
+		}
+	}
+	return ifaces
+}
+
+// detectTailscale finds an interface with a Tailscale address. A CGNAT
+// IPv4 address alone is only trusted while tailscaled runs, since other
+// VPNs use that range too.
+func detectTailscale() (Conflict, bool) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return Conflict{}, false
+	}
+	running := processRunning("tailscaled") || processRunning("Tailscale")
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			ip = ip.Unmap()
+			if tailscaleV6.Contains(ip) || (running && tailscaleV4.Contains(ip)) {
+				return Conflict{Name: "Tailscale", Iface: iface.Name, Detail: "address " + ip.String(), Routes: true}, true
+			}
+		}
+	}
+	if running {
+		return Conflict{Name: "Tailscale", Detail: "tailscaled running", Routes: true}, true
+	}
+	return Conflict{}, false
+}
+
+// detectPrivateRelay reports iCloud Private Relay as possibly active on
+// macOS when the network doesn't block it. It can't be told apart from
+// the outside whether it's switched on, and it doesn't touch routes or
+// DNS settings, but Safari traffic and its DNS then bypass the proxy.
+func detectPrivateRelay(ctx context.Context) (Conflict, bool) {
+	if runtime.GOOS != "darwin" {
+		return Conflict{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for _, host := range privateRelayHosts {
+		if addrs, err := net.DefaultResolver.LookupHost(ctx, host); err == nil && len(addrs) > 0 {
+			return Conflict{
+				Name:   "iCloud Private Relay",
+				Detail: fmt.Sprintf("%s resolves, Safari may bypass the proxy", host),
+			}, true
+		}
+	}
+	return Conflict{}, false
+}
+
+func processRunning(name string) bool {
+	out, err := exec.Command("pgrep", "-x", name).Output()
+	return err == nil && len(strings.TrimSpace(string(out))) > 0
+}
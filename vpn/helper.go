@@ -0,0 +1,14 @@
+package vpn
+
+import (
+	"openvpnadvanced/limits"
+	"openvpnadvanced/privhelper"
+)
+
+// Router performs route changes, either directly through sudo or through
+// the privileged helper when Helper is set
+type Router struct {
+	Helper *privhelper.Client
+	// Limiter bounds concurrent per-address route changes; unlimited when nil
+	Limiter *limits.Limiter
+}
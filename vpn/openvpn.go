@@ -8,7 +8,11 @@ import (
 	"net"
 	"os/exec"
 	"regexp"
+	"slices"
 	"strings"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/privhelper"
 )
 
 // IsTunnelblickRunning checks if Tunnelblick is running
@@ -17,14 +21,18 @@ func IsTunnelblickRunning() bool {
 	return err == nil && len(out) > 0
 }
 
-// FindVPNInterface returns the first utun interface that has an IPv4 address
-func FindVPNInterface() (string, error) {
+// FindVPNInterface returns the first utun interface that has an IPv4
+// address, ignoring the interfaces in skip (e.g. another VPN's tunnel)
+func FindVPNInterface(skip ...string) (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
 	}
 
 	for _, iface := range ifaces {
+		if slices.Contains(skip, iface.Name) {
+			continue
+		}
 		if strings.HasPrefix(iface.Name, "utun") && iface.Flags&net.FlagUp != 0 {
 			addrs, err := iface.Addrs()
 			if err != nil {
@@ -42,7 +50,7 @@ func FindVPNInterface() (string, error) {
 }
 
 // CorrectDefaultRoute resets the system default route to the local gateway
-func CorrectDefaultRoute() error {
+func (r *Router) CorrectDefaultRoute() error {
 	// Step 1: Get current default gateway via `route -n get default`
 	cmd := exec.Command("route", "-n", "get", "default")
 	out, err := cmd.Output()
@@ -66,6 +74,16 @@ func CorrectDefaultRoute() error {
 		return errors.New("could not find default gateway from route output")
 	}
 
+	if r.Helper != nil {
+		err := r.Helper.Call(privhelper.OpSetDefaultRoute, gateway)
+		audit.Record(audit.DefaultRoute, gateway, "reset to local gateway", err)
+		if err != nil {
+			return fmt.Errorf("failed to add corrected default route: %w", err)
+		}
+		fmt.Printf("✅ Corrected default route to local gateway: %s\n", gateway)
+		return nil
+	}
+
 	// Step 2: Delete all default routes (may need to run multiple times)
 	for i := 0; i < 3; i++ {
 		_ = exec.Command("sudo", "route", "delete", "default").Run()
@@ -73,7 +91,9 @@ func CorrectDefaultRoute() error {
 
 	// Step 3: Add back default route to real gateway
 	cmd = exec.Command("sudo", "route", "add", "default", gateway)
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	audit.Record(audit.DefaultRoute, gateway, "reset to local gateway", err)
+	if err != nil {
 		return fmt.Errorf("failed to add corrected default route: %w", err)
 	}
 
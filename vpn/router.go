@@ -1,16 +1,33 @@
 package vpn
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/fakeip"
+	"openvpnadvanced/privhelper"
+	"openvpnadvanced/qos"
 )
 
 // AddRoute adds a static route to force <ip> to go through VPN interface
-func AddRoute(ip, vpnInterface string) error {
+func (r *Router) AddRoute(ip, vpnInterface string) (err error) {
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() { audit.Record(audit.RouteAdd, ip, "via "+vpnInterface, err) }()
+
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpAddRoute, ip, vpnInterface)
+	}
 	cmd := exec.Command("sudo", "route", "-n", "add", ip, "-interface", vpnInterface)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -18,8 +35,24 @@ func AddRoute(ip, vpnInterface string) error {
 	return cmd.Run()
 }
 
+// DeleteHostRoute removes the route AddHostRoute installed for ip
+func (r *Router) DeleteHostRoute(ip string) (err error) {
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() { audit.Record(audit.RouteDelete, ip, "", err) }()
+
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpDeleteRoute, ip)
+	}
+	args := []string{"route", "-n", "delete", ip}
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() && !addr.Is4In6() {
+		args = []string{"route", "-n", "delete", "-inet6", ip}
+	}
+	return exec.Command("sudo", args...).Run()
+}
+
 // DeleteDefaultVPNRoutes removes OpenVPN's default redirect routes
-func DeleteDefaultVPNRoutes() error {
+func (r *Router) DeleteDefaultVPNRoutes() error {
 	log.Println("🧹 Removing default VPN catch-all routes (0.0.0.0/1 and 128.0.0.0/1)...")
 
 	routes := [][]string{
@@ -28,11 +61,21 @@ func DeleteDefaultVPNRoutes() error {
 	}
 
 	for _, args := range routes {
+		dest := args[len(args)-1]
+		if r.Helper != nil {
+			err := r.Helper.Call(privhelper.OpDeleteRoute, dest)
+			audit.Record(audit.RouteDelete, dest, "VPN catch-all", err)
+			if err != nil {
+				fmt.Printf("⚠️ Failed to delete route: %v\n", args)
+			}
+			continue
+		}
 		cmd := exec.Command("sudo", args...)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		err := cmd.Run()
+		audit.Record(audit.RouteDelete, dest, "VPN catch-all", err)
 		if err != nil {
 			fmt.Printf("⚠️ Failed to delete route: %v\n", args)
 		}
@@ -57,7 +100,14 @@ func ResolveIPv6(domain string) ([]string, error) {
 }
 
 // AddIPv6Route adds IPv6 route via specified interface
-func AddIPv6Route(ip, iface string) error {
+func (r *Router) AddIPv6Route(ip, iface string) (err error) {
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() { audit.Record(audit.RouteAdd, ip, "via "+iface, err) }()
+
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpAddIPv6Route, ip, iface)
+	}
 	cmd := exec.Command("sudo", "route", "-n", "add", "-inet6", ip, "-interface", iface)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -65,8 +115,121 @@ func AddIPv6Route(ip, iface string) error {
 	return cmd.Run()
 }
 
+// AddHostRoute adds a route for ip through iface with AddRoute or
+// AddIPv6Route depending on the address family
+func (r *Router) AddHostRoute(ip, iface string) error {
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() && !addr.Is4In6() {
+		return r.AddIPv6Route(ip, iface)
+	}
+	return r.AddRoute(ip, iface)
+}
+
+// MarkHost marks traffic to ip with m for downstream QoS. Marking uses
+// the iptables mangle table, so it is Linux-only.
+func (r *Router) MarkHost(ip string, m qos.Mark) (err error) {
+	if m.IsZero() {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return ErrMarkUnsupported
+	}
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() {
+		audit.Record(audit.Firewall, ip, fmt.Sprintf("mangle dscp=%d fwmark=0x%x", m.DSCP, m.FWMark), err)
+	}()
+
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpMarkHost, ip, strconv.Itoa(m.DSCP), strconv.FormatUint(uint64(m.FWMark), 10))
+	}
+	return qos.MarkHost(sudo, ip, m)
+}
+
+// ErrMarkUnsupported is returned by MarkHost on platforms without iptables
+var ErrMarkUnsupported = errors.New("QoS marking of routed traffic is only supported on Linux")
+
+// ErrFakeIPUnsupported is returned by the fake-ip methods on platforms
+// without iptables
+var ErrFakeIPUnsupported = errors.New("fake-ip mode is only supported on Linux")
+
+// SetupFakeIP routes the fake-ip range prefix through iface (see
+// fakeip.Setup)
+func (r *Router) SetupFakeIP(prefix netip.Prefix, iface string) (err error) {
+	if runtime.GOOS != "linux" {
+		return ErrFakeIPUnsupported
+	}
+	defer func() { audit.Record(audit.Firewall, prefix.String(), "fake-ip range via "+iface, err) }()
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpFakeIPSetup, prefix.String(), iface)
+	}
+	return fakeip.Setup(sudo, prefix, iface)
+}
+
+// TeardownFakeIP removes the routing SetupFakeIP installed
+func (r *Router) TeardownFakeIP(prefix netip.Prefix) (err error) {
+	if runtime.GOOS != "linux" {
+		return ErrFakeIPUnsupported
+	}
+	defer func() { audit.Record(audit.Firewall, prefix.String(), "fake-ip range removed", err) }()
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpFakeIPTeardown, prefix.String())
+	}
+	return fakeip.Teardown(sudo, prefix)
+}
+
+// MapFakeIP translates connections to fake into connections to real
+func (r *Router) MapFakeIP(fake, real netip.Addr) (err error) {
+	if runtime.GOOS != "linux" {
+		return ErrFakeIPUnsupported
+	}
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() { audit.Record(audit.Firewall, fake.String(), "fake-ip ➜ "+real.String(), err) }()
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpFakeIPMap, fake.String(), real.String())
+	}
+	return fakeip.Map(sudo, fake, real)
+}
+
+// UnmapFakeIP removes the translation MapFakeIP installed
+func (r *Router) UnmapFakeIP(fake, real netip.Addr) (err error) {
+	if runtime.GOOS != "linux" {
+		return ErrFakeIPUnsupported
+	}
+	r.Limiter.Acquire(context.Background())
+	defer r.Limiter.Release()
+	defer func() { audit.Record(audit.Firewall, fake.String(), "fake-ip ➜ "+real.String()+" removed", err) }()
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpFakeIPUnmap, fake.String(), real.String())
+	}
+	return fakeip.Unmap(sudo, fake, real)
+}
+
+// sudo runs name with args through sudo
+func sudo(name string, args ...string) error {
+	return exec.Command("sudo", append([]string{name}, args...)...).Run()
+}
+
+// KillConnections closes the local TCP connections to ip so clients
+// reconnect along the current route. It uses ss -K (socket destroy), so it
+// is Linux-only.
+func (r *Router) KillConnections(ip string) (err error) {
+	if runtime.GOOS != "linux" {
+		return ErrKillUnsupported
+	}
+	defer func() { audit.Record(audit.KillConnections, ip, "", err) }()
+	if r.Helper != nil {
+		return r.Helper.Call(privhelper.OpKillConns, ip)
+	}
+	return exec.Command("sudo", "ss", "-K", "dst", ip).Run()
+}
+
+// ErrKillUnsupported is returned by KillConnections on platforms without
+// socket destroy support
+var ErrKillUnsupported = errors.New("killing connections is only supported on Linux")
+
 // HijackIPv6 resolves domain and adds route for each IPv6 address
-func HijackIPv6(domain, iface string) error {
+func (r *Router) HijackIPv6(domain, iface string) error {
 	ips, err := ResolveIPv6(domain)
 	if err != nil {
 		return err
@@ -74,7 +237,7 @@ func HijackIPv6(domain, iface string) error {
 
 	for _, ip := range ips {
 		fmt.Printf("Adding IPv6 route for %s via %s\n", ip, iface)
-		if err := AddIPv6Route(ip, iface); err != nil {
+		if err := r.AddIPv6Route(ip, iface); err != nil {
 			fmt.Printf("[!] Failed to add IPv6 route: %v\n", err)
 		}
 	}
@@ -101,7 +264,7 @@ func GetRouteInterface(ip string) (string, error) {
 }
 
 // AddRouteForDomain resolves domain and adds both IPv4 and IPv6 routes
-func AddRouteForDomain(domain, vpnInterface string) {
+func (r *Router) AddRouteForDomain(domain, vpnInterface string) {
 	ips, err := net.LookupIP(domain)
 	if err != nil {
 		fmt.Printf("Failed to resolve domain %s: %v\n", domain, err)
@@ -112,7 +275,7 @@ func AddRouteForDomain(domain, vpnInterface string) {
 		if ip.To4() != nil {
 			ipStr := ip.String()
 			fmt.Printf("add host %s: gateway %s\n", ipStr, vpnInterface)
-			if err := AddRoute(ipStr, vpnInterface); err != nil {
+			if err := r.AddRoute(ipStr, vpnInterface); err != nil {
 				fmt.Printf("[!] Failed to add route: %v\n", err)
 			} else {
 				fmt.Printf("✅ Route added: %s ➜ %s\n", ipStr, vpnInterface)
@@ -120,7 +283,7 @@ func AddRouteForDomain(domain, vpnInterface string) {
 		} else {
 			ipStr := ip.String()
 			fmt.Printf("add IPv6 host %s: gateway %s\n", ipStr, vpnInterface)
-			if err := AddIPv6Route(ipStr, vpnInterface); err != nil {
+			if err := r.AddIPv6Route(ipStr, vpnInterface); err != nil {
 				fmt.Printf("[!] Failed to add IPv6 route: %v\n", err)
 			} else {
 				fmt.Printf("✅ IPv6 Route added: %s ➜ %s\n", ipStr, vpnInterface)
@@ -0,0 +1,361 @@
+// Package walcache implements a persistent dnsmasq.CacheBackend that keeps
+// entries in memory and appends writes to a write-ahead log in batches.
+// The log is periodically compacted into a snapshot, so persistence costs
+// one buffered append per query instead of a disk write per entry or a
+// full rewrite of the cache.
+package walcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"openvpnadvanced/audit"
+	"openvpnadvanced/dnsmasq"
+)
+
+// Options configures a WAL cache
+type Options struct {
+	// TTL is how long entries are served and kept (default 10m)
+	TTL time.Duration
+	// FlushInterval is how often buffered writes are appended to the log
+	// (default 1s); a write is lost only if the process dies in between
+	FlushInterval time.Duration
+	// FlushSize flushes early once this many bytes are buffered (default 64KiB)
+	FlushSize int
+	// CompactSize rewrites the snapshot and truncates the log once the log
+	// grows past this many bytes (default 8MiB)
+	CompactSize int64
+	// Sync fsyncs the log after every flush
+	Sync bool
+}
+
+// Cache is a dnsmasq.CacheBackend persisted through a write-ahead log.
+// The snapshot lives at the path given to Open and the log next to it
+// with a ".wal" suffix.
+type Cache struct {
+	mem  *dnsmasq.Cache
+	opts Options
+	path string
+
+	// mu guards the write buffer filled by Set
+	mu      sync.Mutex
+	pending []byte
+
+	// fileMu serializes appends to the log and compaction
+	fileMu  sync.Mutex
+	wal     *os.File
+	walSize int64
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+var _ dnsmasq.CacheBackend = (*Cache)(nil)
+
+// ErrCorrupt reports a snapshot or log record that fails its checksum
+var ErrCorrupt = errors.New("corrupt cache record")
+
+// Open loads the snapshot at path, replays the log over it and starts the
+// background flusher. A torn record at the end of the log (from a crash
+// mid-write) is discarded.
+func Open(path string, opts Options) (*Cache, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Minute
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.FlushSize <= 0 {
+		opts.FlushSize = 64 << 10
+	}
+	if opts.CompactSize <= 0 {
+		opts.CompactSize = 8 << 20
+	}
+
+	c := &Cache{
+		mem:  dnsmasq.NewCacheWithTTL(opts.TTL),
+		opts: opts,
+		path: path,
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if _, err := c.replay(path); err != nil && !os.IsNotExist(err) {
+		if !errors.Is(err, ErrCorrupt) {
+			return nil, err
+		}
+		log.Printf("⚠️ %s: %v, keeping the entries read so far", path, err)
+	}
+	valid, err := c.replay(c.walPath())
+	if err != nil && !os.IsNotExist(err) && !errors.Is(err, ErrCorrupt) {
+		return nil, err
+	}
+
+	c.wal, err = os.OpenFile(c.walPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// 丢弃崩溃时写了一半的尾部记录
+	if err := c.wal.Truncate(valid); err != nil {
+		c.wal.Close()
+		return nil, err
+	}
+	if _, err := c.wal.Seek(valid, io.SeekStart); err != nil {
+		c.wal.Close()
+		return nil, err
+	}
+	c.walSize = valid
+
+	go c.flusher()
+	return c, nil
+}
+
+func (c *Cache) walPath() string {
+	return c.path + ".wal"
+}
+
+// Get returns the cached value for domain if it hasn't expired
+func (c *Cache) Get(domain string) (string, bool) {
+	return c.mem.Get(domain)
+}
+
+// Set stores value for domain and queues it for the log
+func (c *Cache) Set(domain, value string) {
+	record := dnsmasq.DNSRecord{IP: value, Timestamp: time.Now()}
+	c.mem.SetRecord(domain, record)
+
+	c.mu.Lock()
+	c.pending = appendRecord(c.pending, domain, record)
+	full := len(c.pending) >= c.opts.FlushSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Delete removes the entry for domain and queues a tombstone for the log
+func (c *Cache) Delete(domain string) error {
+	c.mem.Delete(domain)
+
+	c.mu.Lock()
+	c.pending = appendRecord(c.pending, domain, dnsmasq.DNSRecord{Timestamp: time.Now()})
+	c.mu.Unlock()
+	return nil
+}
+
+// Raw returns a snapshot of all stored entries
+func (c *Cache) Raw() map[string]dnsmasq.DNSRecord {
+	return c.mem.Raw()
+}
+
+// Flush appends buffered writes to the log
+func (c *Cache) Flush() error {
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *Cache) flushLocked() error {
+	c.mu.Lock()
+	buf := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if len(buf) == 0 {
+		return nil
+	}
+
+	n, err := c.wal.Write(buf)
+	c.walSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if c.opts.Sync {
+		return c.wal.Sync()
+	}
+	return nil
+}
+
+// Compact writes the live entries to the snapshot and truncates the log.
+// Expired entries are dropped from memory and disk.
+func (c *Cache) Compact() error {
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	c.mem.Purge()
+
+	// 写入期间到达的新记录留在缓冲区，下次刷盘时进入截断后的日志
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, 1<<20)
+	var buf []byte
+	for domain, record := range c.mem.Raw() {
+		buf = appendRecord(buf[:0], domain, record)
+		w.Write(buf)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), c.path)
+	audit.Record(audit.FileWrite, c.path, "cache snapshot", err)
+	if err != nil {
+		return err
+	}
+
+	if err := c.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := c.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.walSize = 0
+	return nil
+}
+
+// flusher appends buffered writes every FlushInterval, or sooner when the
+// buffer fills, and compacts the log once it grows past CompactSize
+func (c *Cache) flusher() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.kick:
+		}
+		if err := c.Flush(); err != nil {
+			log.Printf("⚠️ Cache WAL flush failed: %v", err)
+			continue
+		}
+		c.fileMu.Lock()
+		size := c.walSize
+		c.fileMu.Unlock()
+		if size >= c.opts.CompactSize {
+			if err := c.Compact(); err != nil {
+				log.Printf("⚠️ Cache WAL compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// Close flushes pending writes, compacts the log and closes it
+func (c *Cache) Close() error {
+	close(c.stop)
+	<-c.done
+
+	err := c.Compact()
+	if closeErr := c.wal.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 记录格式（小端序）：
+//
+//	crc32 uint32 | length uint32 | timestamp int64 | len(domain) uint16 | domain | value
+//
+// crc32 覆盖 length 之后的全部字节。value 为空的记录是删除标记。
+const recordHeader = 4 + 4 + 8 + 2
+
+func appendRecord(buf []byte, domain string, record dnsmasq.DNSRecord) []byte {
+	if len(domain) > 0xffff {
+		return buf
+	}
+	start := len(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(8+2+len(domain)+len(record.IP)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(record.Timestamp.UnixNano()))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(domain)))
+	buf = append(buf, domain...)
+	buf = append(buf, record.IP...)
+	binary.LittleEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(buf[start+8:]))
+	return buf
+}
+
+// replay loads the records of path into memory and returns the length of
+// the valid prefix. Expired records are skipped.
+func (c *Cache) replay(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	var valid int64
+	var hdr [8]byte
+	var body []byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return valid, nil
+			}
+			return valid, ErrCorrupt
+		}
+		sum := binary.LittleEndian.Uint32(hdr[0:])
+		n := binary.LittleEndian.Uint32(hdr[4:])
+		if n < recordHeader-8 || n > 8+2+0xffff+0xffff {
+			return valid, ErrCorrupt
+		}
+		if cap(body) < int(n) {
+			body = make([]byte, n)
+		}
+		body = body[:n]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return valid, ErrCorrupt
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			return valid, ErrCorrupt
+		}
+		dlen := int(binary.LittleEndian.Uint16(body[8:]))
+		if 10+dlen > len(body) {
+			return valid, ErrCorrupt
+		}
+		valid += int64(8 + n)
+
+		record := dnsmasq.DNSRecord{
+			IP:        string(body[10+dlen:]),
+			Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(body))),
+		}
+		if record.IP == "" {
+			c.mem.Delete(string(body[10 : 10+dlen]))
+			continue
+		}
+		if record.Age() > c.opts.TTL {
+			continue
+		}
+		c.mem.SetRecord(string(body[10:10+dlen]), record)
+	}
+}